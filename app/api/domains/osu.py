@@ -1087,15 +1087,15 @@ async def getReplay(
     if not score:
         return Response(b"", status_code=404)
 
-    file = REPLAYS_PATH / f"{score_id}.osr"
-    if not file.exists():
+    replay_data = app.utils.read_replay_file(REPLAYS_PATH / f"{score_id}.osr")
+    if replay_data is None:
         return Response(b"", status_code=404)
 
     # increment replay views for this score
     if score.player is not None and player.id != score.player.id:
         app.state.loop.create_task(score.increment_replay_views())
 
-    return FileResponse(file)
+    return Response(replay_data, media_type="application/octet-stream")
 
 
 @router.get("/web/osu-rate.php")
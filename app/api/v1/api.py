@@ -19,6 +19,7 @@ from fastapi.security import HTTPBearer
 import app.packets
 import app.state
 import app.usecases.performance
+import app.utils
 from app.constants import regexes
 from app.constants.gamemodes import GameMode
 from app.constants.mods import Mods
@@ -702,15 +703,14 @@ async def api_get_replay(
     Note that this endpoint does not increment
     the player's total replay views.
     """
-    # fetch replay file & make sure it exists
-    replay_file = REPLAYS_PATH / f"{score_id}.osr"
-    if not replay_file.exists():
+    # read replay frames from file (which may be gzipped at rest, as .osr.gz)
+    raw_replay_data = app.utils.read_replay_file(REPLAYS_PATH / f"{score_id}.osr")
+    # make sure it exists
+    if raw_replay_data is None:
         return ORJSONResponse(
             {"status": "Replay not found."},
             status_code=status.HTTP_404_NOT_FOUND,
         )
-    # read replay frames from file
-    raw_replay_data = replay_file.read_bytes()
     if not include_headers:
         return Response(
             bytes(raw_replay_data),
@@ -29,6 +29,7 @@ STRANGE_LOG_DIR = Path.cwd() / ".data/logs"
 
 VERSION_RGX = re.compile(r"^# v(?P<ver>\d+\.\d+\.\d+)$")
 SQL_UPDATES_FILE = Path.cwd() / "migrations/migrations.sql"
+ER_DUP_KEYNAME = 1061
 
 
 """ session objects """
@@ -470,6 +471,15 @@ async def run_sql_migrations() -> None:
         try:
             await app.state.services.database.execute(query)
         except pymysql.err.MySQLError as exc:
+            if (
+                exc.args
+                and exc.args[0] == ER_DUP_KEYNAME
+                and query.startswith("create index")
+            ):
+                # tools/migrate (migrate up) may have already built it
+                log(f"Skipped: {query} (the index already exists)", Ansi.GRAY)
+                continue
+
             log(f"Failed: {query}", Ansi.GRAY)
             log(repr(exc))
             log(
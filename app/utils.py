@@ -1,6 +1,7 @@
 from __future__ import annotations
 
 import ctypes
+import gzip
 import inspect
 import os
 import socket
@@ -243,6 +244,18 @@ def display_startup_dialog() -> None:
         log("No internet connectivity detected", Ansi.LYELLOW)
 
 
+def read_replay_file(path: Path) -> bytes | None:
+    """Read a replay, which may be gzipped at rest (as `<id>.osr.gz`)."""
+    if path.exists():
+        return path.read_bytes()
+
+    compressed_path = path.with_name(path.name + ".gz")
+    if compressed_path.exists():
+        return gzip.decompress(compressed_path.read_bytes())
+
+    return None
+
+
 def has_jpeg_headers_and_trailers(data_view: memoryview) -> bool:
     return data_view[:4] == b"\xff\xd8\xff\xe0" and data_view[6:11] == b"JFIF\x00"
 
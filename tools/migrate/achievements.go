@@ -0,0 +1,402 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// achievements regrant re-evaluates every achievement's condition against
+// players' scores, in the same way as score submission does, and grants
+// any which were missed. this covers achievements added since the scores
+// were set, and those lost when moving between schemas. as in bancho.py,
+// only passes on ranked & approved maps by unrestricted players count.
+
+var select_achievement_scores = `
+SELECT s.id, s.userid, s.mode, s.mods, s.score, s.pp, s.acc, s.max_combo,
+s.n300, s.n100, s.n50, s.nmiss, s.ngeki, s.nkatu, s.perfect, s.status, m.id AS map_id
+FROM scores s JOIN maps m ON m.md5 = s.map_md5
+WHERE s.userid IN (?) AND s.status != 0 AND m.status IN (?, ?) %s
+ORDER BY s.userid, s.id`
+
+// the names achievement conditions can use, as given to them by bancho.py
+var achievementNames = map[string]bool{
+	"mode_vn": true, "score.mode": true, "score.mods": true, "score.sr": true,
+	"score.score": true, "score.pp": true, "score.acc": true, "score.max_combo": true,
+	"score.n300": true, "score.n100": true, "score.n50": true, "score.nmiss": true,
+	"score.ngeki": true, "score.nkatu": true, "score.perfect": true, "score.status": true,
+}
+
+type achievement struct {
+	ID   int
+	File string
+	Cond string
+	cond *Condition
+}
+
+type achievementScore struct {
+	ID       int64
+	UserID   int64 `db:"userid"`
+	Mode     int
+	Mods     int
+	Score    int64
+	PP       float64
+	Acc      float64
+	MaxCombo int `db:"max_combo"`
+	N300     int
+	N100     int
+	N50      int
+	Nmiss    int
+	Ngeki    int
+	Nkatu    int
+	Perfect  bool
+	Status   int
+	MapID    int64 `db:"map_id"`
+}
+
+type userAchievement struct {
+	UserID int64 `db:"userid"`
+	AchID  int   `db:"achid"`
+}
+
+// regrantCounts are the totals of re-granting achievements.
+type regrantCounts struct {
+	Scores  int64
+	Granted int64
+	NoSR    int64 // scores whose star rating couldn't be calculated
+	Failed  int64 // users whose achievements couldn't be re-evaluated
+}
+
+// starRatings works out the star ratings conditions need, only as needed,
+// and remembers them per beatmap & mods.
+type starRatings struct {
+	calc   *ppCalculator
+	stars  map[ppRequest]float64
+	failed map[ppRequest]error
+}
+
+func (s *starRatings) get(score achievementScore) (float64, error) {
+	req := ppRequest{
+		Path: filepath.Join(cfg.BeatmapDirectory(), fmt.Sprintf("%d.osu", score.MapID)),
+		Mode: score.Mode % 4,
+		Mods: score.Mods,
+	}
+	if stars, ok := s.stars[req]; ok {
+		return stars, nil
+	}
+	if err, ok := s.failed[req]; ok {
+		return 0, err
+	}
+
+	if _, err := os.Stat(req.Path); err != nil {
+		s.failed[req] = fmt.Errorf("beatmap %d isn't in .data/osu", score.MapID)
+		return 0, s.failed[req]
+	}
+	if s.calc == nil {
+		var err error
+		if s.calc, err = startPPCalculator(cfg.PPCalculator); err != nil {
+			return 0, err
+		}
+	}
+
+	result, err := s.calc.calculate(req)
+	if errors.Is(err, errCalculatorStopped) {
+		s.calc.Close()
+		s.calc = nil
+		return 0, err
+	} else if err != nil {
+		s.failed[req] = err
+		return 0, err
+	}
+	s.stars[req] = result.Stars
+	return result.Stars, nil
+}
+
+func (s *starRatings) Close() {
+	if s.calc != nil {
+		s.calc.Close()
+	}
+}
+
+// scoreEnv gives conditions the values of a score's fields.
+func scoreEnv(score achievementScore, stars *starRatings) condEnv {
+	return func(name string) (float64, error) {
+		switch name {
+		case "mode_vn":
+			return float64(score.Mode % 4), nil
+		case "score.mode":
+			return float64(score.Mode), nil
+		case "score.mods":
+			return float64(score.Mods), nil
+		case "score.sr":
+			return stars.get(score)
+		case "score.score":
+			return float64(score.Score), nil
+		case "score.pp":
+			return score.PP, nil
+		case "score.acc":
+			return score.Acc, nil
+		case "score.max_combo":
+			return float64(score.MaxCombo), nil
+		case "score.n300":
+			return float64(score.N300), nil
+		case "score.n100":
+			return float64(score.N100), nil
+		case "score.n50":
+			return float64(score.N50), nil
+		case "score.nmiss":
+			return float64(score.Nmiss), nil
+		case "score.ngeki":
+			return float64(score.Ngeki), nil
+		case "score.nkatu":
+			return float64(score.Nkatu), nil
+		case "score.perfect":
+			return truth(score.Perfect), nil
+		case "score.status":
+			return float64(score.Status), nil
+		}
+		return 0, fmt.Errorf("unknown name %s", name)
+	}
+}
+
+// loadAchievements compiles every achievement's condition. achievements
+// whose conditions can't be evaluated here are left out, with a warning.
+func loadAchievements() ([]*achievement, error) {
+	var all []*achievement
+	if err := DB.Select(&all, "SELECT id, file, cond FROM achievements ORDER BY id"); err != nil {
+		return nil, err
+	}
+
+	achievements := all[:0]
+	for _, a := range all {
+		cond, err := compileCondition(a.Cond, achievementNames)
+		if err != nil {
+			logger.Warn("skipping achievement with an unsupported condition", "id", a.ID, "file", a.File, "err", err)
+			continue
+		}
+		a.cond = cond
+		achievements = append(achievements, a)
+	}
+	return achievements, nil
+}
+
+// regrantAchievements re-evaluates the achievements of a chunk of users.
+func regrantAchievements(users []int64, achievements []*achievement, stars *starRatings, counts *regrantCounts) error {
+	query, args, err := sqlx.In("SELECT userid, achid FROM user_achievements WHERE userid IN (?)", users)
+	if err != nil {
+		return err
+	}
+	var existing []userAchievement
+	if err := DB.Select(&existing, query, args...); err != nil {
+		return err
+	}
+	has := make(map[userAchievement]bool, len(existing))
+	for _, ua := range existing {
+		has[ua] = true
+	}
+
+	var filter string
+	args = []interface{}{users, mapStatusRanked, mapStatusApproved}
+	if cfg.RecalcMode >= 0 {
+		filter = "AND s.mode = ?"
+		args = append(args, cfg.RecalcMode)
+	}
+	query, args, err = sqlx.In(fmt.Sprintf(select_achievement_scores, filter), args...)
+	if err != nil {
+		return err
+	}
+	var scores []achievementScore
+	if err := DB.Select(&scores, query, args...); err != nil {
+		return err
+	}
+	atomic.AddInt64(&counts.Scores, int64(len(scores)))
+
+	var granted []userAchievement
+	for _, score := range scores {
+		env := scoreEnv(score, stars)
+		noSR := false
+		for _, a := range achievements {
+			ua := userAchievement{UserID: score.UserID, AchID: a.ID}
+			if has[ua] {
+				continue
+			}
+
+			ok, err := a.cond.Eval(env)
+			if errors.Is(err, errCalculatorStopped) {
+				return err
+			} else if err != nil {
+				if a.cond.Uses("score.sr") {
+					noSR = true
+				} else {
+					logger.Warn("failed to evaluate achievement", "id", a.ID, "score_id", score.ID, "err", err)
+				}
+				continue
+			}
+			if ok {
+				has[ua] = true
+				granted = append(granted, ua)
+			}
+		}
+		if noSR {
+			atomic.AddInt64(&counts.NoSR, 1)
+		}
+	}
+
+	if !cfg.DryRun && len(granted) != 0 {
+		_, err := DB.NamedExec("INSERT IGNORE INTO user_achievements (userid, achid) VALUES (:userid, :achid)", granted)
+		if err != nil {
+			return err
+		}
+	}
+	atomic.AddInt64(&counts.Granted, int64(len(granted)))
+	return nil
+}
+
+func runAchievementsRegrant() error {
+	if cfg.RecalcMode >= 0 && !statsModes[cfg.RecalcMode] {
+		return fmt.Errorf("--mode %d is not one of bancho.py's modes", cfg.RecalcMode)
+	}
+
+	achievements, err := loadAchievements()
+	if err != nil {
+		return err
+	}
+	usesSR := false
+	for _, a := range achievements {
+		usesSR = usesSR || a.cond.Uses("score.sr")
+	}
+
+	// make sure the calculator can be started before starting any workers
+	if usesSR {
+		calc, err := startPPCalculator(cfg.PPCalculator)
+		if err != nil {
+			return err
+		}
+		calc.Close()
+	}
+
+	var users []int64
+	if cfg.RecalcUser != "" {
+		user, err := findUser(cfg.RecalcUser)
+		if err != nil {
+			return err
+		}
+		users = []int64{user}
+	} else if err := DB.Select(&users, "SELECT id FROM users WHERE priv & 1 ORDER BY id"); err != nil {
+		return err
+	}
+
+	if err := tuneWorkers(); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	logger.Info("re-granting achievements", "achievements", len(achievements), "users", len(users), "dry_run", cfg.DryRun)
+
+	counts := &regrantCounts{}
+	chunks := make(chan []int64, NumWorkers)
+	var wg sync.WaitGroup
+	for i := 0; i < NumWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stars := &starRatings{stars: make(map[ppRequest]float64), failed: make(map[ppRequest]error)}
+			defer stars.Close()
+			for chunk := range chunks {
+				if err := regrantAchievements(chunk, achievements, stars, counts); err != nil {
+					logger.Error("failed to re-grant achievements", "first_user", chunk[0], "users", len(chunk), "err", err)
+					atomic.AddInt64(&counts.Failed, int64(len(chunk)))
+				}
+			}
+		}()
+	}
+
+	// achievements are evaluated per score, so chunks are kept small
+	chunkSize := recalcChunkSize / 10
+	for len(users) != 0 {
+		n := chunkSize
+		if n > len(users) {
+			n = len(users)
+		}
+		chunks <- users[:n]
+		users = users[n:]
+	}
+	close(chunks)
+	wg.Wait()
+
+	logger.Info("re-granted achievements", "scores", counts.Scores, "granted", counts.Granted,
+		"without_star_rating", counts.NoSR, "failed_users", counts.Failed, "dry_run", cfg.DryRun,
+		"elapsed", time.Since(start).Round(time.Second))
+	if counts.NoSR != 0 {
+		logger.Warn("some scores' star ratings couldn't be calculated (is .data/osu complete?), so achievements needing them weren't checked", "scores", counts.NoSR)
+	}
+	if counts.Failed != 0 {
+		return errors.New("some users' achievements could not be re-granted")
+	}
+	return nil
+}
+
+// achievements were per mode (in a mode column) until v3.3.7, and catch's
+// were named ctb- until v3.2.4. achievements are matched up by file.
+func oldAchievementFile(prefix string) string {
+	return fmt.Sprintf("IF(%[1]sfile LIKE 'ctb-%%', CONCAT('fruits-', SUBSTRING(%[1]sfile, 5)), %[1]sfile)", prefix)
+}
+
+// convertAchievements brings over any custom achievements.
+func convertAchievements(src *OldSchema) (int64, error) {
+	if !src.Has("achievements") {
+		return 0, nil
+	}
+
+	cond := "a.cond"
+	if src.HasColumn("achievements", "mode") {
+		cond = "CONCAT(a.cond, ' and mode_vn == ', a.mode)"
+	}
+	return copyRows(fmt.Sprintf(`
+	INSERT IGNORE INTO achievements (file, name, `+"`desc`"+`, cond)
+	SELECT %s, a.name, a.desc, %s FROM %s a ORDER BY a.id`,
+		oldAchievementFile("a."), cond, src.Table("achievements")))
+}
+
+func convertUserAchievements(src *OldSchema) (int64, error) {
+	if !src.Has("user_achievements") || !src.Has("achievements") {
+		return 0, nil
+	}
+	return copyRows(fmt.Sprintf(`
+	INSERT IGNORE INTO user_achievements (userid, achid)
+	SELECT ua.userid, a.id FROM %s ua
+	JOIN %s oa ON oa.id = ua.achid
+	JOIN achievements a ON a.file = %s
+	JOIN users u ON u.id = ua.userid`,
+		src.Table("user_achievements"), src.Table("achievements"), oldAchievementFile("oa.")))
+}
+
+func init() {
+	registerTableConverter(&TableConverter{Table: "achievements", Convert: convertAchievements})
+	registerTableConverter(&TableConverter{
+		Table:     "user_achievements",
+		DependsOn: []string{"users", "achievements"},
+		Convert:   convertUserAchievements,
+	})
+
+	registerCommand(&Command{
+		Name:              "achievements regrant",
+		Summary:           "re-evaluate achievement conditions against players' scores, granting any which were missed",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.PPCalculator, "calculator", "python3 pp_calculator.py", "command which calculates star ratings, see pp_calculator.py")
+			flags.IntVar(&c.RecalcMode, "mode", -1, "only check scores in this mode (0-3 vanilla, 4-6 relax, 8 autopilot)")
+			flags.StringVar(&c.RecalcUser, "user", "", "only check this user's scores, by name or id")
+			flags.BoolVar(&c.DryRun, "dry-run", false, "report how many achievements would be granted without granting them")
+			flags.IntVar(&c.Workers, "workers", 0, "number of concurrent workers (default: tuned to the database's max_connections)")
+		},
+		Run: runAchievementsRegrant,
+	})
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// import akatsuki is import ripple for akatsuki, the ripple fork, whose
+// schema has drifted from ripple's in a few ways:
+//
+//   - relax & autopilot have lived in databases of their own, next to the
+//     main one, with their scores & stats tables (scores_relax & rx_stats,
+//     scores_ap & ap_stats), which --relax-db & --autopilot-db point at.
+//   - newer versions keep stats in user_stats, a row per user & mode (with
+//     relax & autopilot as modes 4-8, like bancho.py), rather than a column
+//     per mode in users_stats, rx_stats & ap_stats.
+//   - premium, a tier above donor, is another privilege bit, and users can
+//     have any number of badges, whereas bancho.py has a single custom one.
+//   - vanilla, relax & autopilot's replays can each be on a different lets
+//     instance, which --relax-replays & --autopilot-replays point at.
+//   - multiplayer matches are kept, in matches, match_games & match_game_scores,
+//     which are imported into the match history tables of the same names,
+//     see matches.go.
+//
+// everything else (users, beatmaps, and how scores are read) is the same as
+// ripple, see ripple.go.
+
+// akatsuki's premium privilege, which is a supporter tag in bancho.py
+const akatsukiUserPremium = 1 << 23
+
+func akatsukiPrivileges(akatsuki int) int {
+	priv := ripplePrivileges(akatsuki)
+	if akatsuki&akatsukiUserPremium != 0 {
+		priv |= privSupporter
+	}
+	return priv
+}
+
+// akatsukiModeTables places ripple's relax & autopilot tables in their own
+// databases, if they're elsewhere.
+func akatsukiModeTables(tables []rippleModeTable) []rippleModeTable {
+	placed := make([]rippleModeTable, len(tables))
+	for i, t := range tables {
+		switch t.modeOffset {
+		case 4:
+			t.schema = cfg.AkatsukiRelaxDB
+		case 8:
+			t.schema = cfg.AkatsukiAutopilotDB
+		}
+		placed[i] = t
+	}
+	return placed
+}
+
+// akatsukiReplayDir returns where a scores table's replays are, which is
+// lets' .data directory for vanilla, unless relax & autopilot's were given.
+func akatsukiReplayDir(t rippleModeTable) string {
+	switch {
+	case t.modeOffset == 4 && cfg.AkatsukiRelaxReplays != "":
+		return cfg.AkatsukiRelaxReplays
+	case t.modeOffset == 8 && cfg.AkatsukiAutopilotReplays != "":
+		return cfg.AkatsukiAutopilotReplays
+	}
+	return strings.TrimRight(cfg.RippleReplays, "/") + "/" + t.replays
+}
+
+// importAkatsukiStats copies the stats from user_stats if there is one, and
+// otherwise from users_stats, rx_stats & ap_stats, the way ripple's are.
+func importAkatsukiStats() error {
+	exists, err := rippleTableExists("user_stats")
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return importRippleStats(akatsukiModeTables(rippleStatsTables))
+	}
+
+	columns, err := rippleColumns("user_stats")
+	if err != nil {
+		return err
+	}
+	modes := make([]string, 0, len(statsModes))
+	for mode := range statsModes {
+		modes = append(modes, fmt.Sprint(mode))
+	}
+
+	col := func(name string) string {
+		if !columns[name] {
+			return "0"
+		}
+		return fmt.Sprintf("COALESCE(s.%s, 0)", name)
+	}
+	_, err = copyRows(fmt.Sprintf(`
+	INSERT IGNORE INTO stats (id, mode, tscore, rscore, pp, plays, playtime, acc, total_hits, replay_views)
+	SELECT u.id, s.mode, %s, %s, %s, %s, %s, %s, %s, %s
+	FROM %s s JOIN users u ON u.id = s.user_id
+	WHERE s.mode IN (%s)`,
+		col("total_score"), col("ranked_score"), col("pp"), col("playcount"), col("playtime"),
+		col("avg_accuracy"), col("total_hits"), col("replays_watched"),
+		rippleTable("user_stats"), strings.Join(modes, ", ")))
+	if err != nil {
+		return err
+	}
+
+	if err := fillStatsModes(); err != nil {
+		return err
+	}
+	logger.Info("imported stats")
+	return nil
+}
+
+// importAkatsukiBadges gives each user their first badge as their custom
+// badge, as bancho.py only has the one. users with more are logged.
+func importAkatsukiBadges() error {
+	for _, table := range []string{"badges", "user_badges"} {
+		if exists, err := rippleTableExists(table); err != nil || !exists {
+			return err
+		}
+	}
+
+	given, err := copyRows(fmt.Sprintf(`
+	UPDATE users u JOIN (
+		SELECT user, MIN(badge) AS badge FROM %s GROUP BY user
+	) ub ON ub.user = u.id
+	JOIN %s b ON b.id = ub.badge
+	SET u.custom_badge_name = b.name, u.custom_badge_icon = b.icon
+	WHERE u.custom_badge_name IS NULL`,
+		rippleTable("user_badges"), rippleTable("badges")))
+	if err != nil {
+		return fmt.Errorf("failed to import badges: %w", err)
+	}
+
+	var extra int
+	err = DB.Get(&extra, fmt.Sprintf(`
+	SELECT COUNT(*) FROM (SELECT user FROM %s GROUP BY user HAVING COUNT(*) > 1) x`,
+		rippleTable("user_badges")))
+	if err != nil {
+		return err
+	}
+
+	logger.Info("imported badges", "users", given)
+	if extra != 0 {
+		logger.Warn("some users have more than one badge, and only kept their first, as bancho.py has a single custom badge", "users", extra)
+	}
+	return nil
+}
+
+// akatsukiTime selects a time column as a datetime, as akatsuki's have been
+// both unix timestamps & datetimes.
+func akatsukiTime(column string) string {
+	return fmt.Sprintf("IF(%[1]s REGEXP '^[0-9]+$', FROM_UNIXTIME(%[1]s), %[1]s)", column)
+}
+
+// importAkatsukiMatches copies akatsuki's multiplayer history, if it kept
+// any, into the match tables, which are created if they're not there yet.
+// scores of users who weren't imported are left out.
+func importAkatsukiMatches() error {
+	for _, table := range matchTables {
+		if exists, err := rippleTableExists(table); err != nil || !exists {
+			return err
+		}
+	}
+	if err := createMatchTables(); err != nil {
+		return err
+	}
+
+	matchColumns, err := rippleColumns("matches")
+	if err != nil {
+		return err
+	}
+	host := "NULL"
+	if exists, err := rippleTableExists("match_events"); err != nil {
+		return err
+	} else if exists {
+		host = fmt.Sprintf(`(SELECT e.user_id FROM %s e
+		WHERE e.match_id = m.id AND e.event_type = 'MATCH_CREATION' LIMIT 1)`, rippleTable("match_events"))
+	}
+	matches, err := copyRows(fmt.Sprintf(`
+	INSERT IGNORE INTO matches (id, name, host_id, private, created_at, ended_at)
+	SELECT m.id, LEFT(m.name, 50), %s, %s, %s, %s
+	FROM %s m`,
+		host, optionalColumn(matchColumns, "m.", "private", "0"),
+		akatsukiTime("m.start_time"), akatsukiTime("m.end_time"), rippleTable("matches")))
+	if err != nil {
+		return fmt.Errorf("failed to import matches: %w", err)
+	}
+
+	gameColumns, err := rippleColumns("match_games")
+	if err != nil {
+		return err
+	}
+	_, err = copyRows(fmt.Sprintf(`
+	INSERT IGNORE INTO match_games (id, match_id, map_id, mode, mods, win_condition, team_type, started_at, ended_at)
+	SELECT g.id, g.match_id, g.beatmap_id, g.mode, g.mods, %s, %s, %s, %s
+	FROM %s g JOIN matches m ON m.id = g.match_id`,
+		optionalColumn(gameColumns, "g.", "scoring_type", "0"), optionalColumn(gameColumns, "g.", "team_type", "0"),
+		akatsukiTime("g.start_time"), akatsukiTime("g.end_time"), rippleTable("match_games")))
+	if err != nil {
+		return fmt.Errorf("failed to import match games: %w", err)
+	}
+
+	scoreColumns, err := rippleColumns("match_game_scores")
+	if err != nil {
+		return err
+	}
+	scores, err := copyRows(fmt.Sprintf(`
+	INSERT IGNORE INTO match_game_scores (id, game_id, userid, team, mods, score, acc, max_combo,
+		n300, n100, n50, nmiss, ngeki, nkatu, passed)
+	SELECT s.id, s.game_id, s.user_id, %s, s.mods, s.score, s.accuracy, s.max_combo,
+		s.count_300, s.count_100, s.count_50, s.count_miss, s.count_geki, s.count_katu, %s
+	FROM %s s
+	JOIN match_games g ON g.id = s.game_id
+	JOIN users u ON u.id = s.user_id`,
+		optionalColumn(scoreColumns, "s.", "team", "0"), optionalColumn(scoreColumns, "s.", "passed", "1"),
+		rippleTable("match_game_scores")))
+	if err != nil {
+		return fmt.Errorf("failed to import match scores: %w", err)
+	}
+
+	logger.Info("imported matches", "matches", matches, "scores", scores)
+	return nil
+}
+
+func runImportAkatsuki() error {
+	if !validSchemaName.MatchString(cfg.RippleDB) {
+		return errors.New("--akatsuki-db must be the name of the akatsuki database")
+	}
+	for option, name := range map[string]string{"relax-db": cfg.AkatsukiRelaxDB, "autopilot-db": cfg.AkatsukiAutopilotDB} {
+		if name != "" && !validSchemaName.MatchString(name) {
+			return fmt.Errorf("--%s must be the name of a database", option)
+		}
+	}
+	if cfg.RippleReplays == "" {
+		return errors.New("--akatsuki-replays must be the path to lets' .data directory")
+	}
+
+	return importRippleFork(rippleFork{
+		name:        "akatsuki",
+		privileges:  akatsukiPrivileges,
+		scores:      akatsukiModeTables(rippleScoresTables),
+		replayDir:   akatsukiReplayDir,
+		importStats: importAkatsukiStats,
+		afterUsers:  importAkatsukiBadges,
+		afterScores: importAkatsukiMatches,
+	})
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:              "import akatsuki",
+		Summary:           "import an akatsuki database (with its relax & autopilot databases) into a fresh bancho.py database",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.RippleDB, "akatsuki-db", "", "name of the main akatsuki database, on the same server as bancho.py's")
+			flags.StringVar(&c.AkatsukiRelaxDB, "relax-db", "", "name of the database with scores_relax & rx_stats (default: --akatsuki-db)")
+			flags.StringVar(&c.AkatsukiAutopilotDB, "autopilot-db", "", "name of the database with scores_ap & ap_stats (default: --akatsuki-db)")
+			flags.StringVar(&c.RippleReplays, "akatsuki-replays", "", "lets' .data directory (with replays, replays_relax & replays_ap), a path or s3://bucket/prefix")
+			flags.StringVar(&c.AkatsukiRelaxReplays, "relax-replays", "", "where relax replays are, if not in --akatsuki-replays, a path or s3://bucket/prefix")
+			flags.StringVar(&c.AkatsukiAutopilotReplays, "autopilot-replays", "", "where autopilot replays are, if not in --akatsuki-replays, a path or s3://bucket/prefix")
+			flags.BoolVar(&c.Resume, "resume", false, "continue an interrupted import")
+			flags.IntVar(&c.Workers, "workers", 0, "number of concurrent workers (default: tuned to the database's max_connections)")
+			flags.IntVar(&c.MaxRetries, "max-retries", 5, "times to retry a batch after a deadlock, lock wait timeout or lost connection")
+			batchingFlags(flags, c)
+			filterFlags(flags, c)
+			flags.StringVar(&c.DeadLetterPath, "dead-letter", "", "file to write rows which failed to migrate to (default: DATA_DIRECTORY/migrate_dead_letters.jsonl)")
+			flags.StringVar(&c.ReplayJournalPath, "replay-journal", "", "journal of replay moves (default: DATA_DIRECTORY/migrate_replays.journal)")
+			flags.DurationVar(&c.ProgressInterval, "progress-interval", 10*time.Second, "how often to report progress (0 to disable)")
+			flags.StringVar(&c.ProgressFormat, "progress-format", "auto", "progress output format: tui for a dashboard, text, or log to report through the (structured) logger (default: tui on a terminal, otherwise text)")
+			flags.StringVar(&c.NewReplays, "new-replays", "", "where imported replays are written, a path or s3://bucket/prefix (default: DATA_DIRECTORY/osr)")
+		},
+		Run: runImportAkatsuki,
+	})
+}
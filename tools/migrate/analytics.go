@@ -0,0 +1,456 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// export analytics writes the scores, users & stats tables out as files to
+// be queried with duckdb, bigquery or spark, so analysing the server's data
+// doesn't need access to its database. the files are parquet, or csv with
+// --format csv, partitioned hive-style, so the partitions read as columns:
+//
+//	scores/mode=0/year=2024/part-00000.parquet
+//	stats/mode=0/part-00000.parquet
+//	users/part-00000.parquet
+//
+//	SELECT mode, year, avg(pp) FROM read_parquet('analytics/scores/*/*/*.parquet', hive_partitioning = true) GROUP BY ALL;
+//
+// scores are read in id order, so each partition's scores mostly come
+// together; when they don't (e.g. imported scores), the partition gets
+// another part. --columns picks the columns of a table, e.g.
+// --columns scores:id,userid,pp,acc, the partitions' always being included.
+//
+// password hashes & api keys are never exported. players' names, emails &
+// userpages are personal, so are hashed with --hash-key by default, which
+// still lets them be counted & joined on, or are dropped with --pii drop.
+// --pii keep exports them as they are.
+
+// parts are closed, least recently written first, past this many open
+const analyticsOpenParts = 16
+
+const (
+	analyticsParquet = "parquet"
+	analyticsCSV     = "csv"
+)
+
+const (
+	piiHash = "hash"
+	piiDrop = "drop"
+	piiKeep = "keep"
+)
+
+var analyticsTables = []string{"scores", "users", "stats"}
+
+// columns which are never exported
+var analyticsSecrets = map[string][]string{
+	"users": {"pw_bcrypt", "api_key"},
+}
+
+// columns which are personal, see --pii
+var analyticsPII = map[string][]string{
+	"users": {"name", "safe_name", "email", "userpage_content"},
+}
+
+var errAnalyticsKey = errors.New("--hash-key is required to hash names & emails, or use --pii drop")
+
+// analyticsPartitions builds each row's partition, as an extra column, and
+// names the columns it's built from, which are left out of the files.
+func analyticsPartitions(table string) (string, []string, error) {
+	switch table {
+	case "scores":
+		switch cfg.AnalyticsPeriod {
+		case "year":
+			return "CONCAT('mode=', mode, '/year=', YEAR(play_time))", []string{"mode"}, nil
+		case "month":
+			return "CONCAT('mode=', mode, '/year=', YEAR(play_time), '/month=', LPAD(MONTH(play_time), 2, '0'))", []string{"mode"}, nil
+		}
+		return "", nil, fmt.Errorf("unknown --period %q, expected year or month", cfg.AnalyticsPeriod)
+	case "stats":
+		return "CONCAT('mode=', mode)", []string{"mode"}, nil
+	}
+	return "''", nil, nil
+}
+
+// analyticsColumns picks the columns of a table to export.
+func analyticsColumns(t *TableSchema, partitionedBy []string) ([]ColumnSchema, error) {
+	wanted, picked := cfg.AnalyticsColumns[t.Name]
+	var columns []ColumnSchema
+	for _, c := range t.Columns {
+		switch {
+		case picked && !slices.Contains(wanted, c.Name):
+		case slices.Contains(analyticsSecrets[t.Name], c.Name):
+		case cfg.AnalyticsPII == piiDrop && slices.Contains(analyticsPII[t.Name], c.Name):
+		case slices.Contains(partitionedBy, c.Name):
+		default:
+			columns = append(columns, c)
+		}
+	}
+
+	for _, name := range wanted {
+		if slices.Contains(analyticsSecrets[t.Name], name) {
+			return nil, fmt.Errorf("--columns: %s.%s is never exported", t.Name, name)
+		}
+		found := false
+		for _, c := range t.Columns {
+			found = found || c.Name == name
+		}
+		if !found {
+			return nil, fmt.Errorf("--columns: %s has no %s column", t.Name, name)
+		}
+	}
+	return columns, nil
+}
+
+// analyticsType is the parquet type a column is written as.
+func analyticsType(table string, c ColumnSchema) ParquetColumn {
+	column := ParquetColumn{Name: c.Name, Type: parquetByteArray, Converted: parquetUTF8}
+	switch c.DataType {
+	case "tinyint", "smallint", "mediumint", "int", "bigint", "year":
+		column.Type, column.Converted = parquetInt64, -1
+	case "float", "double", "decimal":
+		column.Type, column.Converted = parquetDouble, -1
+	case "date", "datetime", "timestamp":
+		column.Type, column.Converted = parquetInt64, parquetTimestampMillis
+	default:
+		if c.Binary() && !slices.Contains(analyticsPII[table], c.Name) {
+			column.Converted = -1
+		}
+	}
+	return column
+}
+
+// analyticsValue converts a value as read from mysql into its column's
+// type, hashing personal columns.
+func analyticsValue(v interface{}, column ParquetColumn, hashKey []byte) (interface{}, error) {
+	b, isBytes := v.([]byte)
+	if v == nil || !isBytes {
+		return v, nil
+	}
+	switch {
+	case hashKey != nil:
+		mac := hmac.New(sha256.New, hashKey)
+		mac.Write(b)
+		return hex.EncodeToString(mac.Sum(nil)[:16]), nil
+	case column.Type == parquetInt64 && column.Converted != parquetTimestampMillis:
+		n, err := strconv.ParseInt(string(b), 10, 64)
+		if err != nil {
+			// bigint unsigned past int64's range
+			u, uerr := strconv.ParseUint(string(b), 10, 64)
+			n, err = int64(u), uerr
+		}
+		return n, err
+	case column.Type == parquetDouble:
+		return strconv.ParseFloat(string(b), 64)
+	case column.Type == parquetInt64:
+		// a zero date, which the driver leaves as text
+		return nil, nil
+	case column.Converted == parquetUTF8:
+		return string(b), nil
+	}
+	return b, nil
+}
+
+// analyticsPart is a file of a partition, being written.
+type analyticsPart struct {
+	upload  BackupUpload
+	gz      *gzip.Writer
+	csv     *csv.Writer
+	parquet *ParquetWriter
+	written int64 // when it was last written to, to close the oldest
+}
+
+// analyticsExport writes a table's partitions.
+type analyticsExport struct {
+	dest    BackupDestination
+	table   string
+	columns []ParquetColumn
+	parts   map[string]*analyticsPart
+	started map[string]int // parts started, per partition
+	files   int
+	writes  int64
+}
+
+func (e *analyticsExport) open(partition string) (*analyticsPart, error) {
+	if part, ok := e.parts[partition]; ok {
+		return part, nil
+	}
+	if len(e.parts) >= analyticsOpenParts {
+		oldest := ""
+		for name, part := range e.parts {
+			if oldest == "" || part.written < e.parts[oldest].written {
+				oldest = name
+			}
+		}
+		if err := e.close(oldest); err != nil {
+			return nil, err
+		}
+	}
+
+	ext := "." + cfg.AnalyticsFormat
+	if cfg.AnalyticsFormat == analyticsCSV && cfg.AnalyticsCompress == "gzip" {
+		ext += ".gz"
+	}
+	name := e.table + "/"
+	if partition != "" {
+		name += partition + "/"
+	}
+	name += fmt.Sprintf("part-%05d%s", e.started[partition], ext)
+	e.started[partition]++
+
+	upload, err := e.dest.Create(name, map[string]string{"type": "analytics"})
+	if err != nil {
+		return nil, err
+	}
+	part := &analyticsPart{upload: upload}
+	if cfg.AnalyticsFormat == analyticsParquet {
+		part.parquet, err = NewParquetWriter(upload, e.columns, cfg.AnalyticsCompress == "gzip")
+	} else {
+		var w io.Writer = upload
+		if cfg.AnalyticsCompress == "gzip" {
+			part.gz = gzip.NewWriter(upload)
+			w = part.gz
+		}
+		part.csv = csv.NewWriter(w)
+		header := make([]string, len(e.columns))
+		for i, column := range e.columns {
+			header[i] = column.Name
+		}
+		err = part.csv.Write(header)
+	}
+	if err != nil {
+		upload.Abort()
+		return nil, err
+	}
+	e.parts[partition] = part
+	e.files++
+	return part, nil
+}
+
+func (e *analyticsExport) write(partition string, row []interface{}) error {
+	part, err := e.open(partition)
+	if err != nil {
+		return err
+	}
+	e.writes++
+	part.written = e.writes
+	if part.parquet != nil {
+		return part.parquet.Write(row)
+	}
+
+	record := make([]string, len(row))
+	for i, v := range row {
+		switch v := v.(type) {
+		case nil:
+		case time.Time:
+			record[i] = v.Format(time.DateTime)
+		case []byte:
+			record[i] = string(v)
+		default:
+			record[i] = fmt.Sprint(v)
+		}
+	}
+	return part.csv.Write(record)
+}
+
+// close finishes a partition's part.
+func (e *analyticsExport) close(partition string) error {
+	part := e.parts[partition]
+	delete(e.parts, partition)
+	var err error
+	if part.parquet != nil {
+		err = part.parquet.Close()
+	} else {
+		part.csv.Flush()
+		err = part.csv.Error()
+		if part.gz != nil && err == nil {
+			err = part.gz.Close()
+		}
+	}
+	if err != nil {
+		part.upload.Abort()
+		return err
+	}
+	return part.upload.Commit()
+}
+
+func (e *analyticsExport) closeAll() error {
+	for partition := range e.parts {
+		if err := e.close(partition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *analyticsExport) abort() {
+	for _, part := range e.parts {
+		part.upload.Abort()
+	}
+}
+
+// exportAnalyticsTable writes a table's rows into its partitions, returning
+// how many rows, and files, were written.
+func exportAnalyticsTable(dest BackupDestination, t *TableSchema, hashKey []byte) (int64, int, error) {
+	partitionExpr, partitionedBy, err := analyticsPartitions(t.Name)
+	if err != nil {
+		return 0, 0, err
+	}
+	columns, err := analyticsColumns(t, partitionedBy)
+	if err != nil {
+		return 0, 0, err
+	}
+	e := &analyticsExport{dest: dest, table: t.Name, parts: map[string]*analyticsPart{}, started: map[string]int{}}
+	names := make([]string, len(columns))
+	keys := make([][]byte, len(columns))
+	for i, c := range columns {
+		e.columns = append(e.columns, analyticsType(t.Name, c))
+		names[i] = "`" + c.Name + "`"
+		if cfg.AnalyticsPII == piiHash && slices.Contains(analyticsPII[t.Name], c.Name) {
+			keys[i] = hashKey
+		}
+	}
+
+	order := "id"
+	if len(partitionedBy) != 0 && t.Name != "scores" {
+		order = strings.Join(partitionedBy, ", ") + ", id"
+	}
+	rows, err := ReadDB.Queryx(fmt.Sprintf("SELECT %s, %s FROM `%s` ORDER BY %s",
+		strings.Join(names, ", "), partitionExpr, t.Name, order))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+
+	var n int64
+	for rows.Next() {
+		if n++; n%int64(BatchSize) == 0 && isInterrupted() {
+			e.abort()
+			return n, e.files, errInterrupted
+		}
+		values, err := rows.SliceScan()
+		if err != nil {
+			e.abort()
+			return n, e.files, err
+		}
+		partition := fmt.Sprintf("%s", values[len(values)-1])
+		row := values[:len(values)-1]
+		for i := range row {
+			if row[i], err = analyticsValue(row[i], e.columns[i], keys[i]); err != nil {
+				e.abort()
+				return n, e.files, fmt.Errorf("%s.%s: %w", t.Name, columns[i].Name, err)
+			}
+		}
+		if err := e.write(partition, row); err != nil {
+			e.abort()
+			return n, e.files, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		e.abort()
+		return n, e.files, err
+	}
+	return n, e.files, e.closeAll()
+}
+
+func runExportAnalytics() error {
+	if cfg.AnalyticsDir == "" {
+		return errors.New("--dir is required")
+	}
+	if cfg.AnalyticsFormat != analyticsParquet && cfg.AnalyticsFormat != analyticsCSV {
+		return fmt.Errorf("unknown --format %q, expected parquet or csv", cfg.AnalyticsFormat)
+	}
+	if cfg.AnalyticsCompress != "gzip" && cfg.AnalyticsCompress != "none" {
+		return fmt.Errorf("unknown --compress %q, expected gzip or none", cfg.AnalyticsCompress)
+	}
+	var hashKey []byte
+	switch cfg.AnalyticsPII {
+	case piiHash:
+		if cfg.AnalyticsHashKey == "" {
+			return errAnalyticsKey
+		}
+		hashKey = []byte(cfg.AnalyticsHashKey)
+	case piiDrop, piiKeep:
+	default:
+		return fmt.Errorf("unknown --pii %q, expected hash, drop or keep", cfg.AnalyticsPII)
+	}
+
+	tables := analyticsTables
+	if cfg.AnalyticsTables != "" {
+		tables = strings.Split(cfg.AnalyticsTables, ",")
+	}
+	for _, table := range tables {
+		if !slices.Contains(analyticsTables, table) {
+			return fmt.Errorf("--tables: %s can't be exported, only %s", table, strings.Join(analyticsTables, ", "))
+		}
+	}
+	for table := range cfg.AnalyticsColumns {
+		if !slices.Contains(tables, table) {
+			return fmt.Errorf("--columns picks %s's columns, which isn't being exported", table)
+		}
+	}
+	schemas, err := loadTableSchemas(cfg.DBName, tables)
+	if err != nil {
+		return err
+	}
+	if len(schemas) != len(tables) {
+		return fmt.Errorf("--tables lists %d tables, but only %d of them exist", len(tables), len(schemas))
+	}
+	dest, err := openBackupDestination(cfg.AnalyticsDir)
+	if err != nil {
+		return err
+	}
+
+	handleSignals()
+	start := time.Now()
+	for _, t := range schemas {
+		rows, files, err := exportAnalyticsTable(dest, t, hashKey)
+		if err != nil {
+			return fmt.Errorf("failed to export %s: %w", t.Name, err)
+		}
+		logger.Info("exported table", "table", t.Name, "rows", rows, "files", files)
+	}
+	logger.Info("exported analytics", "to", cfg.AnalyticsDir, "format", cfg.AnalyticsFormat,
+		"elapsed", time.Since(start).Round(time.Second))
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "export analytics",
+		Summary: "write scores, users & stats as partitioned parquet or csv files, for duckdb, bigquery or spark",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.AnalyticsDir, "dir", "", "where to write the files: a directory, s3://bucket/prefix, b2://bucket/prefix or sftp://host/path")
+			flags.StringVar(&c.AnalyticsFormat, "format", analyticsParquet, "parquet or csv")
+			flags.StringVar(&c.AnalyticsCompress, "compress", "gzip", "gzip or none")
+			flags.StringVar(&c.AnalyticsTables, "tables", "", "comma-separated tables to export, of scores, users & stats (default: all three)")
+			flags.Func("columns", "only export these columns of a table, as table:column,column (can be repeated)", func(value string) error {
+				table, columns, ok := strings.Cut(value, ":")
+				if !ok || columns == "" {
+					return fmt.Errorf("expected table:column,column, e.g. scores:id,userid,pp")
+				}
+				if c.AnalyticsColumns == nil {
+					c.AnalyticsColumns = make(map[string][]string)
+				}
+				c.AnalyticsColumns[table] = strings.Split(columns, ",")
+				return nil
+			})
+			flags.StringVar(&c.AnalyticsPeriod, "period", "year", "partition scores by mode and year, or by mode, year and month")
+			flags.StringVar(&c.AnalyticsPII, "pii", piiHash, "players' names, emails & userpages: hash, drop or keep")
+			flags.StringVar(&c.AnalyticsHashKey, "hash-key", "", "the secret key personal columns are hashed with; the same key gives the same hashes on later exports")
+			flags.IntVar(&c.MaxRetries, "max-retries", 5, "times to retry a failed upload")
+		},
+		Run: runExportAnalytics,
+	})
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// anticheat scan looks through every unrestricted user's scores for the
+// statistically improbable, for staff to review; nothing is restricted or
+// blocked. its checks are:
+//
+//   - jumps: a score worth much more pp than the user's previous top play
+//   - caps: an unmodded score worth more pp than the mode's cap, from a user
+//     who isn't whitelisted (bancho.py used to enforce these on submission)
+//   - ur: a score whose 300s, 100s & 50s are too consistent for a human;
+//     assuming normally distributed hit errors, the share of 300s & the map's
+//     od give the unstable rate the player must have had
+//   - bursts: a score submitted sooner after the user's previous score than
+//     its map takes to play
+
+var scanChecks = []string{"jumps", "caps", "ur", "bursts"}
+
+// the mods which don't count towards a score being modded, for pp caps
+const capIgnoredMods = modNoFail | modSuddenDeath | modPerfect | modRelax | modAutopilot
+
+// minURHits is how many hits a score needs for its unstable rate to be estimated.
+const minURHits = 500
+
+// burstTolerance is how much of a map's length a score may be submitted
+// early by, as the map's length includes its intro & outro.
+const burstTolerance = 0.8
+
+var select_scan_users = `
+SELECT id FROM users WHERE id != 1 AND priv & 1 != 0 ORDER BY id`
+
+var select_scan_previous_tops = `
+SELECT userid, mode, MAX(pp) AS pp FROM scores
+WHERE userid IN (?) AND status != 0 AND play_time < FROM_UNIXTIME(?)
+GROUP BY userid, mode`
+
+var select_scan_scores = `
+SELECT s.id, s.userid, u.name, u.priv, s.map_md5, s.mode, s.mods, s.pp, s.status,
+	s.n300, s.n100, s.n50, s.play_time, COALESCE(m.od, 0) AS od, COALESCE(m.total_length, 0) AS total_length
+FROM scores s JOIN users u ON u.id = s.userid LEFT JOIN maps m ON m.md5 = s.map_md5
+WHERE s.userid IN (?) AND s.play_time >= FROM_UNIXTIME(?) AND s.play_time < FROM_UNIXTIME(?)
+ORDER BY s.userid, s.play_time, s.id`
+
+type scanScore struct {
+	ID          int64
+	UserID      int64 `db:"userid"`
+	Name        string
+	Priv        int
+	MapMD5      string `db:"map_md5"`
+	Mode        int
+	Mods        int
+	PP          float64
+	Status      int
+	N300        int
+	N100        int
+	N50         int
+	PlayTime    time.Time `db:"play_time"`
+	OD          float64   `db:"od"`
+	TotalLength int       `db:"total_length"`
+}
+
+// Anomaly is a score which failed a check, in the report.
+type Anomaly struct {
+	Check    string    `json:"check"`
+	ScoreID  int64     `json:"score_id"`
+	UserID   int64     `json:"user_id"`
+	Name     string    `json:"name"`
+	MapMD5   string    `json:"map_md5"`
+	Mode     int       `json:"mode"`
+	Mods     int       `json:"mods"`
+	PP       float64   `json:"pp"`
+	PlayTime time.Time `json:"play_time"`
+	Detail   string    `json:"detail"`
+}
+
+// AnomalyReport is the result of anticheat scan.
+type AnomalyReport struct {
+	Scores    int64          `json:"scores"`
+	Counts    map[string]int `json:"counts"` // anomalies per check
+	Anomalies []*Anomaly     `json:"anomalies"`
+}
+
+func (r *AnomalyReport) add(check string, s *scanScore, detail string) {
+	r.Counts[check]++
+	r.Anomalies = append(r.Anomalies, &Anomaly{
+		Check:    check,
+		ScoreID:  s.ID,
+		UserID:   s.UserID,
+		Name:     s.Name,
+		MapMD5:   s.MapMD5,
+		Mode:     s.Mode,
+		Mods:     s.Mods,
+		PP:       s.PP,
+		PlayTime: s.PlayTime,
+		Detail:   detail,
+	})
+}
+
+// parsePPCaps reads the pp caps, as mode:pp, comma separated.
+func parsePPCaps(value string) (map[int]float64, error) {
+	caps := make(map[int]float64)
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		mode, pp, found := strings.Cut(part, ":")
+		m, err1 := strconv.Atoi(mode)
+		limit, err2 := strconv.ParseFloat(pp, 64)
+		if !found || err1 != nil || err2 != nil || m < 0 || m > 11 {
+			return nil, fmt.Errorf("--pp-caps %q must be mode:pp, e.g. 0:800", part)
+		}
+		caps[m] = limit
+	}
+	return caps, nil
+}
+
+// clockRate is how much faster than normal a score's mods play its map.
+func clockRate(mods int) float64 {
+	switch {
+	case mods&(modDoubleTime|modNightcore) != 0:
+		return 1.5
+	case mods&modHalfTime != 0:
+		return 0.75
+	}
+	return 1
+}
+
+// estimatedUR works out the unstable rate (10x the standard deviation of
+// hit errors, in ms) which would give a score its share of 300s, for
+// osu!standard scores which aren't relax, as relax taps by itself. with
+// every hit a 300 there's no telling how consistent the player was.
+func estimatedUR(s *scanScore) (float64, bool) {
+	hits := s.N300 + s.N100 + s.N50
+	if s.Mode != 0 && s.Mode != 8 || hits < minURHits || s.N300 == hits || s.OD == 0 {
+		return 0, false
+	}
+	od := s.OD
+	if s.Mods&modHardRock != 0 {
+		od = min(od*1.4, 10)
+	} else if s.Mods&modEasy != 0 {
+		od /= 2
+	}
+	window := 80 - 6*od
+
+	share := float64(s.N300) / float64(hits)
+	sigma := window / (math.Sqrt2 * math.Erfinv(share))
+	return 10 * sigma / clockRate(s.Mods), true
+}
+
+// scanUsers runs the checks on a chunk of users' scores.
+func scanUsers(users []int64, checks map[string]bool, caps map[int]float64, since, until int64, report *AnomalyReport) error {
+	type userMode struct {
+		user int64
+		mode int
+	}
+	tops := make(map[userMode]float64)
+	if checks["jumps"] {
+		var rows []struct {
+			UserID int64 `db:"userid"`
+			Mode   int
+			PP     float64
+		}
+		query, args, err := sqlx.In(select_scan_previous_tops, users, since)
+		if err != nil {
+			return err
+		}
+		if err := DB.Select(&rows, query, args...); err != nil {
+			return err
+		}
+		for _, row := range rows {
+			tops[userMode{row.UserID, row.Mode}] = row.PP
+		}
+	}
+
+	query, args, err := sqlx.In(select_scan_scores, users, since, until)
+	if err != nil {
+		return err
+	}
+	rows, err := DB.Queryx(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var lastUser int64
+	var lastSubmission time.Time
+	for rows.Next() {
+		var s scanScore
+		if err := rows.StructScan(&s); err != nil {
+			return err
+		}
+		report.Scores++
+
+		previous := lastSubmission
+		if s.UserID != lastUser {
+			previous = time.Time{}
+		}
+		lastUser, lastSubmission = s.UserID, s.PlayTime
+		if s.Status == 0 {
+			continue
+		}
+
+		key := userMode{s.UserID, s.Mode}
+		if checks["jumps"] {
+			if top := tops[key]; top > 0 && s.PP >= cfg.ScanMinPP && s.PP > top*cfg.ScanPPFactor {
+				report.add("jumps", &s, fmt.Sprintf("%.2fpp, %.1fx their previous top play of %.2fpp", s.PP, s.PP/top, top))
+			}
+			tops[key] = max(tops[key], s.PP)
+		}
+
+		if limit, ok := caps[s.Mode]; checks["caps"] && ok && s.PP > limit &&
+			s.Mods&^capIgnoredMods == 0 && s.Priv&privWhitelisted == 0 {
+			report.add("caps", &s, fmt.Sprintf("unmodded %.2fpp, over mode %d's cap of %gpp", s.PP, s.Mode, limit))
+		}
+
+		if ur, ok := estimatedUR(&s); checks["ur"] && ok && ur < cfg.ScanMinUR {
+			report.add("ur", &s, fmt.Sprintf("%d/%d/%d 300s/100s/50s at od %g need an unstable rate of %.1f",
+				s.N300, s.N100, s.N50, s.OD, ur))
+		}
+
+		if checks["bursts"] && !previous.IsZero() && s.TotalLength > 0 {
+			gap := s.PlayTime.Sub(previous)
+			length := time.Duration(float64(s.TotalLength) / clockRate(s.Mods) * float64(time.Second))
+			if gap < time.Duration(float64(length)*burstTolerance) {
+				report.add("bursts", &s, fmt.Sprintf("submitted %s after their previous score, but the map takes %s",
+					gap, length.Round(time.Second)))
+			}
+		}
+	}
+	return rows.Err()
+}
+
+func runAnticheatScan() error {
+	if cfg.ReportFormat != "json" && cfg.ReportFormat != "csv" {
+		return fmt.Errorf("unknown --format %q, expected json or csv", cfg.ReportFormat)
+	}
+	checks := make(map[string]bool)
+	for _, check := range strings.Split(cfg.ScanChecks, ",") {
+		if check = strings.ToLower(strings.TrimSpace(check)); check == "" {
+			continue
+		}
+		known := false
+		for _, c := range scanChecks {
+			known = known || c == check
+		}
+		if !known {
+			return fmt.Errorf("unknown check %q, expected %s", check, strings.Join(scanChecks, ", "))
+		}
+		checks[check] = true
+	}
+	if len(checks) == 0 {
+		return fmt.Errorf("--checks must name at least one of %s", strings.Join(scanChecks, ", "))
+	}
+	caps, err := parsePPCaps(cfg.ScanPPCaps)
+	if err != nil {
+		return err
+	}
+	since, until := int64(0), time.Now().Add(24*time.Hour).Unix()
+	if cfg.ScanSince != "" {
+		if since, err = parseFilterTime("since", cfg.ScanSince); err != nil {
+			return err
+		}
+	}
+	if cfg.ScanUntil != "" {
+		if until, err = parseFilterTime("until", cfg.ScanUntil); err != nil {
+			return err
+		}
+	}
+
+	var users []int64
+	if err := DB.Select(&users, select_scan_users); err != nil {
+		return err
+	}
+	report := &AnomalyReport{Counts: map[string]int{}, Anomalies: []*Anomaly{}}
+	for len(users) != 0 {
+		n := min(recalcChunkSize, len(users))
+		if err := scanUsers(users[:n], checks, caps, since, until, report); err != nil {
+			return err
+		}
+		users = users[n:]
+		logger.Debug("scanned users", "scores", report.Scores, "anomalies", len(report.Anomalies), "remaining", len(users))
+	}
+
+	var counts []string
+	for _, check := range scanChecks {
+		if checks[check] {
+			counts = append(counts, fmt.Sprintf("%d %s", report.Counts[check], check))
+		}
+	}
+	fmt.Printf("scanned %d scores: %s\n", report.Scores, strings.Join(counts, ", "))
+
+	// the users with the most anomalies first
+	perUser := make(map[int64]int)
+	for _, a := range report.Anomalies {
+		perUser[a.UserID]++
+	}
+	sort.SliceStable(report.Anomalies, func(i, j int) bool {
+		a, b := report.Anomalies[i], report.Anomalies[j]
+		if perUser[a.UserID] != perUser[b.UserID] {
+			return perUser[a.UserID] > perUser[b.UserID]
+		}
+		return a.UserID < b.UserID
+	})
+	for i, a := range report.Anomalies {
+		if i == 25 {
+			fmt.Printf("  ... and %d more, see --report\n", len(report.Anomalies)-i)
+			break
+		}
+		fmt.Printf("  %-15s %-6s %d: %s\n", a.Name, a.Check, a.ScoreID, a.Detail)
+	}
+
+	if cfg.ReportPath == "" {
+		return nil
+	}
+	if cfg.ReportFormat == "json" {
+		return writeReport(cfg.ReportPath, report)
+	}
+	rows := make([][]string, len(report.Anomalies))
+	for i, a := range report.Anomalies {
+		rows[i] = []string{a.Check, strconv.FormatInt(a.ScoreID, 10), strconv.FormatInt(a.UserID, 10), a.Name,
+			a.MapMD5, strconv.Itoa(a.Mode), strconv.Itoa(a.Mods), strconv.FormatFloat(a.PP, 'f', 3, 64),
+			a.PlayTime.Format("2006-01-02 15:04:05"), a.Detail}
+	}
+	return writeCSVReport(cfg.ReportPath, []string{"check", "score_id", "user_id", "name", "map_md5", "mode", "mods", "pp", "play_time", "detail"}, rows)
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "anticheat scan",
+		Summary: "look through scores for improbable pp jumps, pp over the caps, inhuman accuracy & impossible submission bursts",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.ScanChecks, "checks", strings.Join(scanChecks, ","), "the checks to run, comma separated")
+			flags.StringVar(&c.ScanSince, "since", "", "only scores played since this date, or duration ago (e.g. 720h)")
+			flags.StringVar(&c.ScanUntil, "until", "", "only scores played before this date, or duration ago")
+			flags.Float64Var(&c.ScanPPFactor, "pp-factor", 1.5, "flag scores worth this many times the user's previous top play")
+			flags.Float64Var(&c.ScanMinPP, "min-pp", 200, "only flag jumps to scores worth at least this much pp")
+			flags.StringVar(&c.ScanPPCaps, "pp-caps", "0:800,1:600,2:700,3:800", "the most pp an unmodded score may be worth, per mode, as mode:pp")
+			flags.Float64Var(&c.ScanMinUR, "min-ur", 50, "flag scores which need an unstable rate below this")
+			flags.StringVar(&c.ReportPath, "report", "", "write the report to this path (- for stdout)")
+			flags.StringVar(&c.ReportFormat, "format", "json", "the report's format: json or csv")
+		},
+		Run: runAnticheatScan,
+	})
+}
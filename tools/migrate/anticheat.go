@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// anticheat flags decodes the client_flags osu! sends with each score, which
+// are its own (old, and false positive prone) anticheat's findings, from
+// app/constants/clientflags.py. by default it ranks the users with the most
+// flagged scores in a date range, for staff to look into; with --user, it
+// lists that user's flagged scores instead.
+//
+// incorrect_mod_value is ignored by default, as bancho.py does, since osu!
+// sets it on scores which are fine.
+
+// a client flag, as in bancho.py's ClientFlags & LastFMFlags
+type clientFlag struct {
+	name string
+	bit  int
+}
+
+var clientFlags = []clientFlag{
+	{"speed_hack_detected", 1 << 1},
+	{"incorrect_mod_value", 1 << 2},
+	{"multiple_osu_clients", 1 << 3},
+	{"checksum_failure", 1 << 4},
+	{"flashlight_checksum_incorrect", 1 << 5},
+	{"osu_executable_checksum", 1 << 6},
+	{"missing_processes_in_list", 1 << 7},
+	{"flashlight_image_hack", 1 << 8},
+	{"spinner_hack", 1 << 9},
+	{"transparent_window", 1 << 10},
+	{"fast_press", 1 << 11},
+	{"raw_mouse_discrepancy", 1 << 12},
+	{"raw_keyboard_discrepancy", 1 << 13},
+	{"run_with_ld_flag", 1 << 14},
+	{"console_open", 1 << 15},
+	{"extra_threads", 1 << 16},
+	{"hq_assembly", 1 << 17},
+	{"hq_file", 1 << 18},
+	{"registry_edits", 1 << 19},
+	{"sdl2_library", 1 << 20},
+	{"openssl_library", 1 << 21},
+	{"aqn_menu_sample", 1 << 22},
+}
+
+// decodeClientFlags names the flags set, with any unknown bits left as an integer.
+func decodeClientFlags(flags int) []string {
+	var names []string
+	for _, f := range clientFlags {
+		if flags&f.bit != 0 {
+			names = append(names, f.name)
+			flags &^= f.bit
+		}
+	}
+	if flags != 0 {
+		names = append(names, fmt.Sprintf("unknown (%d)", flags))
+	}
+	return names
+}
+
+// parseClientFlags reads flags by name or integer, comma separated.
+func parseClientFlags(value string) (int, error) {
+	bits := 0
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.ToLower(strings.TrimSpace(part)); part == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(part); err == nil {
+			bits |= n
+			continue
+		}
+		found := false
+		for _, f := range clientFlags {
+			if f.name == part {
+				bits |= f.bit
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown client flag %q", part)
+		}
+	}
+	return bits, nil
+}
+
+var select_flagged_users = `
+SELECT s.userid, u.name, u.priv, s.client_flags & ~? AS flags, COUNT(*) AS scores
+FROM scores s JOIN users u ON u.id = s.userid
+WHERE s.client_flags & ~? != 0 AND s.play_time >= FROM_UNIXTIME(?) AND s.play_time < FROM_UNIXTIME(?)
+GROUP BY s.userid, u.name, u.priv, flags`
+
+var select_user_score_counts = `
+SELECT userid, COUNT(*) AS scores FROM scores
+WHERE play_time >= FROM_UNIXTIME(?) AND play_time < FROM_UNIXTIME(?)
+GROUP BY userid`
+
+var select_flagged_scores = `
+SELECT s.id, s.map_md5, s.mode, s.mods, s.pp, s.status, s.client_flags & ~? AS flags,
+	UNIX_TIMESTAMP(s.play_time) AS play_time
+FROM scores s
+WHERE s.userid = ? AND s.client_flags & ~? != 0
+	AND s.play_time >= FROM_UNIXTIME(?) AND s.play_time < FROM_UNIXTIME(?)
+ORDER BY s.play_time`
+
+// FlaggedUser is a user's flag statistics, in the report.
+type FlaggedUser struct {
+	ID         int64          `json:"id"`
+	Name       string         `json:"name"`
+	Restricted bool           `json:"restricted"`
+	Scores     int64          `json:"scores"`  // in the date range
+	Flagged    int64          `json:"flagged"` // scores with any flag
+	Flags      map[string]int `json:"flags"`   // scores with each flag
+}
+
+// FlaggedScore is one of a user's flagged scores, in the report.
+type FlaggedScore struct {
+	ID       int64    `json:"id"`
+	MapMD5   string   `json:"map_md5" db:"map_md5"`
+	Mode     int      `json:"mode"`
+	Mods     int      `json:"mods"`
+	PP       float64  `json:"pp"`
+	Status   int      `json:"status"`
+	Flags    int      `json:"client_flags"`
+	Names    []string `json:"flags" db:"-"`
+	PlayTime int64    `json:"play_time" db:"play_time"`
+}
+
+// writeCSVReport writes the report's rows as csv, to a path or - for stdout.
+func writeCSVReport(path string, header []string, rows [][]string) error {
+	out := os.Stdout
+	if path != "-" {
+		var err error
+		if out, err = os.Create(path); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	w := csv.NewWriter(out)
+	w.Write(header)
+	w.WriteAll(rows)
+	return w.Error()
+}
+
+// flaggedUsers aggregates every user's flagged scores in the range, most
+// flagged first.
+func flaggedUsers(ignore int, since, until int64) ([]*FlaggedUser, error) {
+	var rows []struct {
+		UserID int64 `db:"userid"`
+		Name   string
+		Priv   int
+		Flags  int
+		Scores int64
+	}
+	if err := DB.Select(&rows, select_flagged_users, ignore, ignore, since, until); err != nil {
+		return nil, err
+	}
+	var totals []struct {
+		UserID int64 `db:"userid"`
+		Scores int64
+	}
+	if err := DB.Select(&totals, select_user_score_counts, since, until); err != nil {
+		return nil, err
+	}
+
+	byID := make(map[int64]*FlaggedUser)
+	for _, row := range rows {
+		u := byID[row.UserID]
+		if u == nil {
+			u = &FlaggedUser{ID: row.UserID, Name: row.Name, Restricted: row.Priv&privUnrestricted == 0, Flags: map[string]int{}}
+			byID[row.UserID] = u
+		}
+		u.Flagged += row.Scores
+		for _, name := range decodeClientFlags(row.Flags) {
+			u.Flags[name] += int(row.Scores)
+		}
+	}
+	for _, total := range totals {
+		if u := byID[total.UserID]; u != nil {
+			u.Scores = total.Scores
+		}
+	}
+
+	users := make([]*FlaggedUser, 0, len(byID))
+	for _, u := range byID {
+		if u.Flagged >= int64(cfg.FlagsMinScores) {
+			users = append(users, u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].Flagged != users[j].Flagged {
+			return users[i].Flagged > users[j].Flagged
+		}
+		if len(users[i].Flags) != len(users[j].Flags) {
+			return len(users[i].Flags) > len(users[j].Flags)
+		}
+		return users[i].ID < users[j].ID
+	})
+	return users, nil
+}
+
+// flagNames lists the names in a user's flag counts, most common first.
+func flagNames(counts map[string]int) []string {
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if counts[names[i]] != counts[names[j]] {
+			return counts[names[i]] > counts[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+func runAnticheatFlags() error {
+	if cfg.ReportFormat != "json" && cfg.ReportFormat != "csv" {
+		return fmt.Errorf("unknown --format %q, expected json or csv", cfg.ReportFormat)
+	}
+	ignore, err := parseClientFlags(cfg.FlagsIgnore)
+	if err != nil {
+		return fmt.Errorf("--ignore: %w", err)
+	}
+	since, until := int64(0), time.Now().Add(24*time.Hour).Unix()
+	if cfg.FlagsSince != "" {
+		if since, err = parseFilterTime("since", cfg.FlagsSince); err != nil {
+			return err
+		}
+	}
+	if cfg.FlagsUntil != "" {
+		if until, err = parseFilterTime("until", cfg.FlagsUntil); err != nil {
+			return err
+		}
+	}
+
+	if cfg.FlagsUser != "" {
+		user, err := findUser(cfg.FlagsUser)
+		if err != nil {
+			return err
+		}
+		var scores []FlaggedScore
+		if err := DB.Select(&scores, select_flagged_scores, ignore, user, ignore, since, until); err != nil {
+			return err
+		}
+		for i := range scores {
+			scores[i].Names = decodeClientFlags(scores[i].Flags)
+		}
+
+		fmt.Printf("%d flagged scores\n", len(scores))
+		for _, s := range scores {
+			fmt.Printf("  %d  %s  mode %d  %.2fpp  %s\n", s.ID, time.Unix(s.PlayTime, 0).Format("2006-01-02 15:04"),
+				s.Mode, s.PP, strings.Join(s.Names, ", "))
+		}
+		if cfg.ReportPath == "" {
+			return nil
+		}
+		if cfg.ReportFormat == "json" {
+			return writeReport(cfg.ReportPath, scores)
+		}
+		rows := make([][]string, len(scores))
+		for i, s := range scores {
+			rows[i] = []string{strconv.FormatInt(s.ID, 10), s.MapMD5, strconv.Itoa(s.Mode), strconv.Itoa(s.Mods),
+				strconv.FormatFloat(s.PP, 'f', 3, 64), strconv.Itoa(s.Status),
+				time.Unix(s.PlayTime, 0).Format(time.RFC3339), strconv.Itoa(s.Flags), strings.Join(s.Names, " ")}
+		}
+		return writeCSVReport(cfg.ReportPath, []string{"id", "map_md5", "mode", "mods", "pp", "status", "play_time", "client_flags", "flags"}, rows)
+	}
+
+	users, err := flaggedUsers(ignore, since, until)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d users with at least %d flagged scores\n", len(users), cfg.FlagsMinScores)
+	for i, u := range users {
+		if i == 25 {
+			fmt.Printf("  ... and %d more, see --report\n", len(users)-i)
+			break
+		}
+		restricted := ""
+		if u.Restricted {
+			restricted = " (restricted)"
+		}
+		fmt.Printf("  %-15s %6d/%-6d %s%s\n", u.Name, u.Flagged, u.Scores, strings.Join(flagNames(u.Flags), ", "), restricted)
+	}
+
+	if cfg.ReportPath == "" {
+		return nil
+	}
+	if cfg.ReportFormat == "json" {
+		return writeReport(cfg.ReportPath, users)
+	}
+	rows := make([][]string, len(users))
+	for i, u := range users {
+		var flags []string
+		for _, name := range flagNames(u.Flags) {
+			flags = append(flags, fmt.Sprintf("%s:%d", name, u.Flags[name]))
+		}
+		rows[i] = []string{strconv.Itoa(i + 1), strconv.FormatInt(u.ID, 10), u.Name, strconv.FormatBool(u.Restricted),
+			strconv.FormatInt(u.Scores, 10), strconv.FormatInt(u.Flagged, 10), strings.Join(flags, " ")}
+	}
+	return writeCSVReport(cfg.ReportPath, []string{"rank", "id", "name", "restricted", "scores", "flagged", "flags"}, rows)
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "anticheat flags",
+		Summary: "decode scores' client flags, and rank the users with the most flagged scores",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.FlagsUser, "user", "", "list this user's flagged scores, by name or id, rather than ranking every user")
+			flags.StringVar(&c.FlagsSince, "since", "", "only scores played since this date, or duration ago (e.g. 720h)")
+			flags.StringVar(&c.FlagsUntil, "until", "", "only scores played before this date, or duration ago")
+			flags.StringVar(&c.FlagsIgnore, "ignore", "incorrect_mod_value", "flags to ignore, by name or integer, comma separated")
+			flags.IntVar(&c.FlagsMinScores, "min-flagged", 3, "only rank users with at least this many flagged scores")
+			flags.StringVar(&c.ReportPath, "report", "", "write the report to this path (- for stdout)")
+			flags.StringVar(&c.ReportFormat, "format", "json", "the report's format: json or csv")
+		},
+		Run: runAnticheatFlags,
+	})
+}
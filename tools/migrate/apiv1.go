@@ -0,0 +1,530 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// third-party tools (score trackers, discord bots, stream overlays) often
+// only speak osu!'s legacy api (v1), which bancho.py serves itself. while
+// bancho.py is down, e.g. during a migration's cutover, api serve can stand
+// in for it, serving the read-only endpoints they use most from the
+// database directly:
+//
+//	/api/get_user        a player's stats, with their global & country rank.
+//	/api/get_scores      a beatmap's leaderboard, or a player's score on it.
+//	/api/get_user_best   a player's best performance scores.
+//
+// the responses are shaped like osu!'s, json arrays of objects whose values
+// are all strings. m is bancho.py's mode (0-3 vanilla, 4-6 relax, 8
+// autopilot), and k must be a player's api key, unless --no-key is given.
+// restricted players are left out, as bancho.py does.
+
+var metricAPIRequests = newCounter("migrate_api_requests_total",
+	"Requests served by api serve.", "endpoint", "status")
+
+// the most scores a request can ask for, as osu!'s api allows
+const apiMaxLimit = 100
+
+// apiError is a request which can't be answered, e.g. a missing parameter.
+type apiError struct {
+	status  int
+	message string
+}
+
+func (e *apiError) Error() string { return e.message }
+
+func badRequest(format string, args ...interface{}) error {
+	return &apiError{http.StatusBadRequest, fmt.Sprintf(format, args...)}
+}
+
+// apiUser is get_user's response.
+type apiUser struct {
+	UserID             string     `json:"user_id"`
+	Username           string     `json:"username"`
+	JoinDate           string     `json:"join_date"`
+	Count300           string     `json:"count300"`
+	Count100           string     `json:"count100"`
+	Count50            string     `json:"count50"`
+	Playcount          string     `json:"playcount"`
+	RankedScore        string     `json:"ranked_score"`
+	TotalScore         string     `json:"total_score"`
+	PPRank             string     `json:"pp_rank"`
+	Level              string     `json:"level"`
+	PPRaw              string     `json:"pp_raw"`
+	Accuracy           string     `json:"accuracy"`
+	CountRankSS        string     `json:"count_rank_ss"`
+	CountRankSSH       string     `json:"count_rank_ssh"`
+	CountRankS         string     `json:"count_rank_s"`
+	CountRankSH        string     `json:"count_rank_sh"`
+	CountRankA         string     `json:"count_rank_a"`
+	Country            string     `json:"country"`
+	TotalSecondsPlayed string     `json:"total_seconds_played"`
+	PPCountryRank      string     `json:"pp_country_rank"`
+	Events             []struct{} `json:"events"`
+}
+
+// apiScore is a score of get_scores' & get_user_best's responses, the
+// first of which leaves out beatmap_id, and the second username.
+type apiScore struct {
+	BeatmapID       string `json:"beatmap_id,omitempty"`
+	ScoreID         string `json:"score_id"`
+	Score           string `json:"score"`
+	Username        string `json:"username,omitempty"`
+	MaxCombo        string `json:"maxcombo"`
+	Count50         string `json:"count50"`
+	Count100        string `json:"count100"`
+	Count300        string `json:"count300"`
+	CountMiss       string `json:"countmiss"`
+	CountKatu       string `json:"countkatu"`
+	CountGeki       string `json:"countgeki"`
+	Perfect         string `json:"perfect"`
+	EnabledMods     string `json:"enabled_mods"`
+	UserID          string `json:"user_id"`
+	Date            string `json:"date"`
+	Rank            string `json:"rank"`
+	PP              string `json:"pp"`
+	ReplayAvailable string `json:"replay_available"`
+}
+
+// apiScoreRow is a score as it's read, for an apiScore.
+type apiScoreRow struct {
+	ID        int64
+	BeatmapID int64 `db:"beatmap_id"`
+	Score     int64
+	Username  string
+	MaxCombo  int `db:"max_combo"`
+	N50       int
+	N100      int
+	N300      int
+	Nmiss     int
+	Nkatu     int
+	Ngeki     int
+	Perfect   bool
+	Mods      int
+	UserID    int64  `db:"userid"`
+	PlayTime  string `db:"play_time"`
+	Grade     string
+	PP        float64
+}
+
+// dates are bancho.py's wall clock, where osu!'s api gives them in utc
+var select_api_scores = `
+SELECT s.id, COALESCE(m.id, 0) AS beatmap_id, s.score, u.name AS username, s.max_combo,
+s.n50, s.n100, s.n300, s.nmiss, s.nkatu, s.ngeki, s.perfect, s.mods, s.userid,
+DATE_FORMAT(s.play_time, '%Y-%m-%d %H:%i:%s') AS play_time, s.grade, s.pp
+FROM scores s
+JOIN users u ON u.id = s.userid
+LEFT JOIN maps m ON m.md5 = s.map_md5
+WHERE s.status = 2 AND s.mode = ? AND u.priv & 1`
+
+// apiServer answers the api's requests.
+type apiServer struct {
+	replays ReplayStore
+}
+
+// handle serves an endpoint, whose handler returns the response to encode.
+func (api *apiServer) handle(mux *http.ServeMux, endpoint string, handler func(query apiQuery) (interface{}, error)) {
+	mux.HandleFunc("/api/"+endpoint, func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		var response interface{}
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			status, response = http.StatusMethodNotAllowed, map[string]string{"error": "Method not allowed."}
+		} else if err := api.authenticate(r.FormValue("k")); err != nil {
+			status, response = apiErrorResponse(endpoint, err)
+		} else if result, err := handler(apiQuery{r}); err != nil {
+			status, response = apiErrorResponse(endpoint, err)
+		} else {
+			response = result
+		}
+
+		metricAPIRequests.Inc(endpoint, strconv.Itoa(status))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			logger.Debug("failed to write an api response", "endpoint", endpoint, "err", err)
+		}
+	})
+}
+
+// apiErrorResponse is the status & body a failed request is answered with.
+func apiErrorResponse(endpoint string, err error) (int, interface{}) {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr.status, map[string]string{"error": apiErr.message}
+	}
+	logger.Error("failed to answer an api request", "endpoint", endpoint, "err", err)
+	return http.StatusInternalServerError, map[string]string{"error": "Internal server error."}
+}
+
+// authenticate checks k is a player's api key, as osu!'s api requires.
+func (api *apiServer) authenticate(key string) error {
+	if cfg.APINoKey {
+		return nil
+	}
+	invalid := &apiError{http.StatusUnauthorized, "Please provide a valid API key."}
+	if key == "" {
+		return invalid
+	}
+	var found bool
+	err := ReadDB.Get(&found, "SELECT 1 FROM users WHERE api_key = ? AND priv & 1", key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return invalid
+	}
+	return err
+}
+
+// apiQuery reads a request's parameters.
+type apiQuery struct {
+	r *http.Request
+}
+
+// int reads an integer parameter, which is fallback if it isn't given.
+func (q apiQuery) int(name string, fallback int64) (int64, error) {
+	v := q.r.FormValue(name)
+	if v == "" {
+		return fallback, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, badRequest("%s must be a number", name)
+	}
+	return n, nil
+}
+
+// mode reads m, bancho.py's mode, which is osu! standard if it isn't given.
+func (q apiQuery) mode() (int, error) {
+	m, err := q.int("m", 0)
+	if err != nil {
+		return 0, err
+	}
+	if m < 0 || m > 8 || m == 7 {
+		return 0, badRequest("m must be 0-3 (vanilla), 4-6 (relax) or 8 (autopilot)")
+	}
+	return int(m), nil
+}
+
+// limit reads how many scores were asked for.
+func (q apiQuery) limit(fallback int64) (int, error) {
+	limit, err := q.int("limit", fallback)
+	if err != nil {
+		return 0, err
+	}
+	return int(min(max(limit, 1), apiMaxLimit)), nil
+}
+
+// user reads u, a player's id or name (as type says, or id if it's a
+// number), returning 0 if there's no such (unrestricted) player.
+func (q apiQuery) user() (int64, error) {
+	u := q.r.FormValue("u")
+	if u == "" {
+		return 0, badRequest("u is required")
+	}
+	byID := q.r.FormValue("type") != "string"
+	if _, err := strconv.ParseInt(u, 10, 64); err != nil {
+		byID = false
+	}
+
+	var id int64
+	var err error
+	if byID {
+		err = ReadDB.Get(&id, "SELECT id FROM users WHERE id = ? AND priv & 1", u)
+	} else {
+		err = ReadDB.Get(&id, "SELECT id FROM users WHERE safe_name = ? AND priv & 1",
+			strings.ReplaceAll(strings.ToLower(u), " ", "_"))
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return id, err
+}
+
+// apiLevel is a player's level, from their total score, as osu! works it out.
+func apiLevel(totalScore int64) float64 {
+	required := func(level float64) float64 {
+		if level <= 100 {
+			return 5000.0/3*(4*math.Pow(level, 3)-3*math.Pow(level, 2)-level) + 1.25*math.Pow(1.8, level-60)
+		}
+		return 26931190827 + 99999999999*(level-100)
+	}
+	score := float64(totalScore)
+	level := 1.0
+	for required(level+1) <= score {
+		level++
+	}
+	next := required(level + 1)
+	return level + (score-required(level))/(next-required(level))
+}
+
+func (api *apiServer) getUser(q apiQuery) (interface{}, error) {
+	mode, err := q.mode()
+	if err != nil {
+		return nil, err
+	}
+	id, err := q.user()
+	if err != nil || id == 0 {
+		return []apiUser{}, err
+	}
+
+	var user struct {
+		ID           int64
+		Name         string
+		Country      string
+		CreationTime int64 `db:"creation_time"`
+		TScore       int64
+		RScore       int64
+		PP           int64
+		Plays        int64
+		Playtime     int64
+		Acc          float64
+		XHCount      int64 `db:"xh_count"`
+		XCount       int64 `db:"x_count"`
+		SHCount      int64 `db:"sh_count"`
+		SCount       int64 `db:"s_count"`
+		ACount       int64 `db:"a_count"`
+	}
+	err = ReadDB.Get(&user, `
+	SELECT u.id, u.name, u.country, u.creation_time, s.tscore, s.rscore, s.pp, s.plays,
+	s.playtime, s.acc, s.xh_count, s.x_count, s.sh_count, s.s_count, s.a_count
+	FROM users u JOIN stats s ON s.id = u.id
+	WHERE u.id = ? AND s.mode = ?`, id, mode)
+	if errors.Is(err, sql.ErrNoRows) {
+		return []apiUser{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var counts struct {
+		N300 int64
+		N100 int64
+		N50  int64
+	}
+	err = ReadDB.Get(&counts, `
+	SELECT COALESCE(SUM(n300), 0) AS n300, COALESCE(SUM(n100), 0) AS n100, COALESCE(SUM(n50), 0) AS n50
+	FROM scores WHERE userid = ? AND mode = ?`, id, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	// players without pp aren't ranked
+	var rank, countryRank int64
+	if user.PP > 0 {
+		err = ReadDB.Get(&rank, `
+		SELECT COUNT(*) + 1 FROM stats s JOIN users u ON u.id = s.id
+		WHERE s.mode = ? AND s.pp > ? AND u.priv & 1`, mode, user.PP)
+		if err != nil {
+			return nil, err
+		}
+		err = ReadDB.Get(&countryRank, `
+		SELECT COUNT(*) + 1 FROM stats s JOIN users u ON u.id = s.id
+		WHERE s.mode = ? AND s.pp > ? AND u.country = ? AND u.priv & 1`, mode, user.PP, user.Country)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	itoa := func(n int64) string { return strconv.FormatInt(n, 10) }
+	return []apiUser{{
+		UserID:             itoa(user.ID),
+		Username:           user.Name,
+		JoinDate:           time.Unix(user.CreationTime, 0).UTC().Format(time.DateTime),
+		Count300:           itoa(counts.N300),
+		Count100:           itoa(counts.N100),
+		Count50:            itoa(counts.N50),
+		Playcount:          itoa(user.Plays),
+		RankedScore:        itoa(user.RScore),
+		TotalScore:         itoa(user.TScore),
+		PPRank:             itoa(rank),
+		Level:              strconv.FormatFloat(apiLevel(user.TScore), 'f', -1, 64),
+		PPRaw:              itoa(user.PP),
+		Accuracy:           strconv.FormatFloat(user.Acc, 'f', -1, 64),
+		CountRankSS:        itoa(user.XCount),
+		CountRankSSH:       itoa(user.XHCount),
+		CountRankS:         itoa(user.SCount),
+		CountRankSH:        itoa(user.SHCount),
+		CountRankA:         itoa(user.ACount),
+		Country:            strings.ToUpper(user.Country),
+		TotalSecondsPlayed: itoa(user.Playtime),
+		PPCountryRank:      itoa(countryRank),
+		Events:             []struct{}{},
+	}}, nil
+}
+
+// getScores is a beatmap's leaderboard: the players' best scores on it,
+// ordered by score, or by pp for relax & autopilot, as bancho.py orders
+// them. with mods, only the best scores set with exactly those mods are
+// listed, rather than each player's best with them.
+func (api *apiServer) getScores(q apiQuery) (interface{}, error) {
+	beatmap, err := q.int("b", 0)
+	if err != nil {
+		return nil, err
+	} else if beatmap == 0 {
+		return nil, badRequest("b is required")
+	}
+	mode, err := q.mode()
+	if err != nil {
+		return nil, err
+	}
+	limit, err := q.limit(50)
+	if err != nil {
+		return nil, err
+	}
+
+	query := select_api_scores + " AND m.id = ?"
+	args := []interface{}{mode, beatmap}
+	if q.r.FormValue("u") != "" {
+		user, err := q.user()
+		if err != nil || user == 0 {
+			return []apiScore{}, err
+		}
+		query += " AND s.userid = ?"
+		args = append(args, user)
+	}
+	if q.r.FormValue("mods") != "" {
+		mods, err := q.int("mods", 0)
+		if err != nil {
+			return nil, err
+		}
+		query += " AND s.mods = ?"
+		args = append(args, mods)
+	}
+	if mode >= 4 {
+		query += " ORDER BY s.pp DESC, s.id LIMIT ?"
+	} else {
+		query += " ORDER BY s.score DESC, s.id LIMIT ?"
+	}
+	args = append(args, limit)
+
+	scores, err := api.scores(query, args)
+	for i := range scores {
+		scores[i].BeatmapID = ""
+	}
+	return scores, err
+}
+
+// getUserBest is a player's best scores, ordered by pp.
+func (api *apiServer) getUserBest(q apiQuery) (interface{}, error) {
+	mode, err := q.mode()
+	if err != nil {
+		return nil, err
+	}
+	limit, err := q.limit(10)
+	if err != nil {
+		return nil, err
+	}
+	user, err := q.user()
+	if err != nil || user == 0 {
+		return []apiScore{}, err
+	}
+
+	scores, err := api.scores(select_api_scores+" AND s.userid = ? ORDER BY s.pp DESC, s.id LIMIT ?",
+		[]interface{}{mode, user, limit})
+	for i := range scores {
+		scores[i].Username = ""
+	}
+	return scores, err
+}
+
+// scores reads scores, and whether their replays are available.
+func (api *apiServer) scores(query string, args []interface{}) ([]apiScore, error) {
+	var rows []apiScoreRow
+	if err := ReadDB.Select(&rows, query, args...); err != nil {
+		return nil, err
+	}
+
+	scores := make([]apiScore, 0, len(rows))
+	for _, row := range rows {
+		_, err := api.replays.Stat(replayKey(row.ID))
+		scores = append(scores, apiScore{
+			BeatmapID:       strconv.FormatInt(row.BeatmapID, 10),
+			ScoreID:         strconv.FormatInt(row.ID, 10),
+			Score:           strconv.FormatInt(row.Score, 10),
+			Username:        row.Username,
+			MaxCombo:        strconv.Itoa(row.MaxCombo),
+			Count50:         strconv.Itoa(row.N50),
+			Count100:        strconv.Itoa(row.N100),
+			Count300:        strconv.Itoa(row.N300),
+			CountMiss:       strconv.Itoa(row.Nmiss),
+			CountKatu:       strconv.Itoa(row.Nkatu),
+			CountGeki:       strconv.Itoa(row.Ngeki),
+			Perfect:         apiBool(row.Perfect),
+			EnabledMods:     strconv.Itoa(row.Mods),
+			UserID:          strconv.FormatInt(row.UserID, 10),
+			Date:            row.PlayTime,
+			Rank:            row.Grade,
+			PP:              strconv.FormatFloat(row.PP, 'f', 3, 64),
+			ReplayAvailable: apiBool(err == nil),
+		})
+	}
+	return scores, nil
+}
+
+func apiBool(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+func runAPIServe() error {
+	replays, err := openReplayStore(cfg.ReplayDirectory())
+	if cfg.APIReplays != "" {
+		replays, err = openReplayStore(cfg.APIReplays)
+	}
+	if err != nil {
+		return err
+	}
+
+	api := &apiServer{replays: replays}
+	mux := http.NewServeMux()
+	api.handle(mux, "get_user", api.getUser)
+	api.handle(mux, "get_scores", api.getScores)
+	api.handle(mux, "get_user_best", api.getUserBest)
+
+	listener, err := net.Listen("tcp", cfg.APIListen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", cfg.APIListen, err)
+	}
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	handleSignals()
+	go func() {
+		<-interrupted
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	if cfg.APINoKey {
+		logger.Warn("--no-key is set, so anyone who can reach the api can use it")
+	}
+	logger.Info("serving osu!'s legacy api", "address", listener.Addr().String())
+	if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:              "api serve",
+		Summary:           "serve osu!'s read-only legacy api (get_user, get_scores, get_user_best) from the database, e.g. while bancho.py is down",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.APIListen, "listen", ":8081", "the address to serve the api on")
+			flags.StringVar(&c.APIReplays, "replays", "", "where replays are, for replay_available, a path or s3://bucket/prefix (default: DATA_DIRECTORY/osr)")
+			flags.BoolVar(&c.APINoKey, "no-key", false, "answer requests without a player's api key (k)")
+		},
+		Run: runAPIServe,
+	})
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// archive scores moves failed scores older than --older-than days out of
+// the scores table, which they otherwise make up most of, while they're
+// rarely looked at again: into the scores_archive table (which can be on
+// slower storage, or left out of backups), or into gzipped json files in
+// --dir. archive restore moves them back.
+//
+// failed scores aren't on any leaderboard, and bancho.py doesn't keep their
+// replays, so nothing else is changed. recalc stats counts the archive
+// table's scores towards plays & playtime, but not archived files'.
+
+const archiveTable = "scores_archive"
+
+const (
+	archiveToTable = "table"
+	archiveToFiles = "files"
+)
+
+var select_archive_ids = `
+SELECT id FROM scores
+WHERE status = 0 AND play_time < ? AND id > ?
+ORDER BY id LIMIT ?`
+
+// archiveFileName names a file of archived scores by its range of ids, so
+// that files sort in id order.
+func archiveFileName(first, last int64) string {
+	return fmt.Sprintf("scores-%012d-%012d.jsonl.gz", first, last)
+}
+
+// writeArchiveFile writes scores as gzipped json lines, synced before the
+// file is moved into place, as the scores are deleted once it is.
+func writeArchiveFile(path string, ids []int64) error {
+	query, args, err := sqlx.In("SELECT * FROM scores WHERE id IN (?) ORDER BY id", ids)
+	if err != nil {
+		return err
+	}
+	rows, err := DB.Queryx(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns, err := rows.ColumnTypes()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path + ".tmp")
+	gz := gzip.NewWriter(f)
+	enc := json.NewEncoder(gz)
+
+	n := 0
+	for rows.Next() {
+		values, err := rows.SliceScan()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		record := make(map[string]interface{}, len(values))
+		for i, v := range values {
+			if t, ok := v.(time.Time); ok {
+				// stored as the server's wall clock, as play_time is
+				v = t.Format("2006-01-02 15:04:05")
+			}
+			record[columns[i].Name()] = jsonValue(v, columns[i])
+		}
+		if err := enc.Encode(record); err != nil {
+			f.Close()
+			return err
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		f.Close()
+		return err
+	}
+	if n != len(ids) {
+		f.Close()
+		return fmt.Errorf("expected %d scores, but read %d", len(ids), n)
+	}
+
+	err = gz.Close()
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// archiveBatch moves a batch of scores into the archive table or a file.
+func archiveBatch(ids []int64) error {
+	tx, err := DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if cfg.ArchiveTo == archiveToTable {
+		query, args, err := sqlx.In("INSERT INTO "+archiveTable+" SELECT * FROM scores WHERE id IN (?)", ids)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(query, args...); err != nil {
+			return err
+		}
+	} else {
+		path := filepath.Join(cfg.ArchiveDir, archiveFileName(ids[0], ids[len(ids)-1]))
+		if err := writeArchiveFile(path, ids); err != nil {
+			return fmt.Errorf("failed to write %s: %w", path, err)
+		}
+	}
+
+	query, args, err := sqlx.In("DELETE FROM scores WHERE id IN (?) AND status = 0", ids)
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n != int64(len(ids)) {
+		return fmt.Errorf("expected to delete %d scores, but deleted %d", len(ids), n)
+	}
+	return tx.Commit()
+}
+
+func runArchiveScores() error {
+	switch cfg.ArchiveTo {
+	case archiveToTable:
+		if _, err := DB.Exec("CREATE TABLE IF NOT EXISTS " + archiveTable + " LIKE scores"); err != nil {
+			return err
+		}
+	case archiveToFiles:
+		if cfg.ArchiveDir == "" {
+			cfg.ArchiveDir = filepath.Join(cfg.DataDirectory, "archive")
+		}
+		if err := os.MkdirAll(cfg.ArchiveDir, 0755); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown --to %q, expected table or files", cfg.ArchiveTo)
+	}
+	if cfg.ArchiveOlderThan < 1 {
+		return errors.New("--older-than must be at least a day")
+	}
+	cutoff := wallClock(time.Now().AddDate(0, 0, -cfg.ArchiveOlderThan))
+
+	var total int64
+	err := DB.Get(&total, "SELECT COUNT(*) FROM scores WHERE status = 0 AND play_time < ?", cutoff)
+	if err != nil {
+		return err
+	}
+	logger.Info("found failed scores to archive", "scores", total, "played_before", cutoff.Format("2006-01-02"), "to", cfg.ArchiveTo)
+	if cfg.DryRun || total == 0 {
+		return nil
+	}
+
+	// files hold more scores than a transaction should
+	batchSize := BatchSize
+	if cfg.ArchiveTo == archiveToFiles {
+		batchSize = cfg.ArchiveFileRows
+	}
+
+	handleSignals()
+	start := time.Now()
+	var archived, lastID int64
+	for {
+		if isInterrupted() {
+			logger.Info("interrupted, archived scores are kept, and the rest can be archived by running this again", "archived", archived)
+			return errInterrupted
+		}
+		var ids []int64
+		if err := DB.Select(&ids, select_archive_ids, cutoff, lastID, batchSize); err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			break
+		}
+		if err := throttle(len(ids)); err != nil {
+			return err
+		}
+		if err := archiveBatch(ids); err != nil {
+			return err
+		}
+		archived += int64(len(ids))
+		lastID = ids[len(ids)-1]
+		logger.Debug("archived scores", "scores", len(ids), "through_id", lastID, "archived", archived, "total", total)
+	}
+
+	logger.Info("archived failed scores", "scores", archived, "to", cfg.ArchiveTo,
+		"elapsed", time.Since(start).Round(time.Second))
+	return nil
+}
+
+// restoreArchiveTable moves scores back from the archive table.
+func restoreArchiveTable(user int64) (int64, error) {
+	if exists, err := tableExists(archiveTable); err != nil {
+		return 0, err
+	} else if !exists {
+		return 0, fmt.Errorf("there's no %s table, scores haven't been archived to it", archiveTable)
+	}
+
+	condition, args := "id > ?", []interface{}{}
+	if user != 0 {
+		condition += " AND userid = ?"
+		args = append(args, user)
+	}
+	var restored, lastID int64
+	for {
+		if isInterrupted() {
+			return restored, errInterrupted
+		}
+		var ids []int64
+		err := DB.Select(&ids, "SELECT id FROM "+archiveTable+" WHERE "+condition+" ORDER BY id LIMIT ?",
+			append(append([]interface{}{lastID}, args...), BatchSize)...)
+		if err != nil {
+			return restored, err
+		}
+		if len(ids) == 0 {
+			return restored, nil
+		}
+
+		tx, err := DB.Beginx()
+		if err != nil {
+			return restored, err
+		}
+		for _, query := range []string{
+			"INSERT IGNORE INTO scores SELECT * FROM " + archiveTable + " WHERE id IN (?)",
+			"DELETE FROM " + archiveTable + " WHERE id IN (?)",
+		} {
+			q, qargs, err := sqlx.In(query, ids)
+			if err == nil {
+				_, err = tx.Exec(q, qargs...)
+			}
+			if err != nil {
+				tx.Rollback()
+				return restored, err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return restored, err
+		}
+		restored += int64(len(ids))
+		lastID = ids[len(ids)-1]
+	}
+}
+
+// restoreArchiveFile inserts a file's scores back into the scores table,
+// or just the user's, if user isn't 0.
+func restoreArchiveFile(path string, user int64) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return 0, err
+	}
+	dec := json.NewDecoder(gz)
+	dec.UseNumber()
+
+	var records []map[string]interface{}
+	for {
+		var record map[string]interface{}
+		if err := dec.Decode(&record); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		if user != 0 && fmt.Sprint(record["userid"]) != fmt.Sprint(user) {
+			continue
+		}
+		records = append(records, record)
+	}
+	if len(records) == 0 {
+		return 0, nil
+	}
+
+	columns := make([]string, 0, len(records[0]))
+	for column := range records[0] {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	tx, err := DB.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	for start := 0; start < len(records); start += BatchSize {
+		end := min(start+BatchSize, len(records))
+		args := make([]interface{}, 0, (end-start)*len(columns))
+		for _, record := range records[start:end] {
+			for _, column := range columns {
+				args = append(args, record[column])
+			}
+		}
+		query := fmt.Sprintf("INSERT IGNORE INTO scores (`%s`) VALUES %s",
+			strings.Join(columns, "`, `"), placeholders(end-start, len(columns), func(int) string { return "?" }))
+		if _, err := tx.Exec(query, args...); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(records)), tx.Commit()
+}
+
+func runArchiveRestore() error {
+	var user int64
+	if cfg.ArchiveUser != "" {
+		var err error
+		if user, err = findUser(cfg.ArchiveUser); err != nil {
+			return err
+		}
+	}
+
+	handleSignals()
+	start := time.Now()
+	var restored int64
+	var err error
+	switch cfg.ArchiveTo {
+	case archiveToTable:
+		restored, err = restoreArchiveTable(user)
+	case archiveToFiles:
+		if cfg.ArchiveDir == "" {
+			cfg.ArchiveDir = filepath.Join(cfg.DataDirectory, "archive")
+		}
+		var paths []string
+		if paths, err = filepath.Glob(filepath.Join(cfg.ArchiveDir, "scores-*.jsonl.gz")); err != nil {
+			return err
+		}
+		for _, path := range paths {
+			if isInterrupted() {
+				err = errInterrupted
+				break
+			}
+			var n int64
+			if n, err = restoreArchiveFile(path, user); err != nil {
+				err = fmt.Errorf("failed to restore %s: %w", path, err)
+				break
+			}
+			restored += n
+			// a file is only removed once every score in it is restored
+			if user == 0 {
+				if err = os.Remove(path); err != nil {
+					break
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("unknown --from %q, expected table or files", cfg.ArchiveTo)
+	}
+
+	logger.Info("restored archived scores", "scores", restored, "from", cfg.ArchiveTo,
+		"elapsed", time.Since(start).Round(time.Second))
+	return err
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:              "archive scores",
+		Summary:           "move old failed scores out of the scores table, into an archive table or compressed files",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.IntVar(&c.ArchiveOlderThan, "older-than", 180, "archive failed scores played more than this many days ago")
+			flags.StringVar(&c.ArchiveTo, "to", archiveToTable, "table, to move them to the "+archiveTable+" table, or files, to write them to gzipped json files")
+			flags.StringVar(&c.ArchiveDir, "dir", "", "directory of the archive files (default: DATA_DIRECTORY/archive)")
+			flags.IntVar(&c.ArchiveFileRows, "file-rows", 100000, "scores per archive file")
+			flags.BoolVar(&c.DryRun, "dry-run", false, "count the scores which would be archived, without archiving them")
+		},
+		Run: runArchiveScores,
+	})
+
+	registerCommand(&Command{
+		Name:              "archive restore",
+		Summary:           "move archived scores back into the scores table",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.ArchiveTo, "from", archiveToTable, "where the scores were archived to: table or files")
+			flags.StringVar(&c.ArchiveDir, "dir", "", "directory of the archive files (default: DATA_DIRECTORY/archive)")
+			flags.StringVar(&c.ArchiveUser, "user", "", "only restore this user's scores, by name or id")
+		},
+		Run: runArchiveRestore,
+	})
+}
@@ -0,0 +1,588 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrations only move rows, so the avatars in DATA_DIRECTORY/avatars,
+// which are kept as <user id>.<ext>, need looking after too:
+//
+//   - avatars rekey renames (or, with --from, copies) avatars to users' new
+//     ids, from a merge's --report, or a csv of old_id,new_id. merge does
+//     this itself with --merge-avatars.
+//   - avatars convert rewrites every avatar in one format, named after what
+//     it really is, and removes those shadowed by another of the user's.
+//   - avatars verify checks every avatar can be read, and belongs to a user,
+//     and lists the users without one (who are shown default.jpg).
+//
+// nginx & caddy serve the first of <id>.png, .jpg, .gif, .jpeg & .jfif
+// which exists (see ext/nginx.conf.example), so a user with several has
+// the others shadowed.
+
+// the extensions avatars are served with, in the order they're tried
+var avatarExtensions = []string{"png", "jpg", "gif", "jpeg", "jfif"}
+
+var avatarName = regexp.MustCompile(`^(\d+)\.(png|jpg|gif|jpeg|jfif)$`)
+
+// the avatar shown to users without one, see app/utils.py
+const defaultAvatar = "default.jpg"
+
+// renames in place go through here, so that avatars swapping ids don't
+// overwrite each other
+const rekeyDirectory = ".rekey"
+
+var errAvatarProblems = errors.New("some avatars have problems")
+
+// avatarFile is one of a user's avatars.
+type avatarFile struct {
+	UserID int64
+	Ext    string
+	Path   string
+}
+
+func avatarRank(ext string) int {
+	for i, e := range avatarExtensions {
+		if e == ext {
+			return i
+		}
+	}
+	return len(avatarExtensions)
+}
+
+// listAvatars reads a directory's avatars, by user, in the order they're
+// served, along with the files which aren't avatars.
+func listAvatars(dir string) (map[int64][]avatarFile, []string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	avatars := make(map[int64][]avatarFile)
+	var others []string
+	for _, entry := range entries {
+		name := entry.Name()
+		m := avatarName.FindStringSubmatch(name)
+		if entry.IsDir() || m == nil {
+			if name != defaultAvatar && name != rekeyDirectory {
+				others = append(others, name)
+			}
+			continue
+		}
+		id, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			others = append(others, name)
+			continue
+		}
+		avatars[id] = append(avatars[id], avatarFile{id, m[2], filepath.Join(dir, name)})
+	}
+	for _, files := range avatars {
+		sort.Slice(files, func(i, j int) bool { return avatarRank(files[i].Ext) < avatarRank(files[j].Ext) })
+	}
+	return avatars, others, nil
+}
+
+// imageFormat reads what an image really is: png, jpeg or gif.
+func imageFormat(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	_, format, err := image.DecodeConfig(f)
+	return format, err
+}
+
+// formatExtension is the extension an image format is named with.
+func formatExtension(format string) string {
+	if format == "jpeg" {
+		return "jpg"
+	}
+	return format
+}
+
+// copyAvatar copies a file, replacing any existing one atomically.
+func copyAvatar(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(to + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(to + ".tmp")
+		return err
+	}
+	return os.Rename(to+".tmp", to)
+}
+
+// readAvatarMapping reads users' old & new ids, from a merge's json report,
+// or a csv of old_id,new_id.
+func readAvatarMapping(path string) (map[int64]int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	mapping := make(map[int64]int64)
+	if trimmed := bytes.TrimSpace(data); len(trimmed) != 0 && trimmed[0] == '{' {
+		var report MergeReport
+		if err := json.Unmarshal(trimmed, &report); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		for _, user := range report.Merged {
+			mapping[user.OldID] = user.NewID
+		}
+		return mapping, nil
+	}
+
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i, record := range records {
+		if len(record) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected old_id,new_id", path, i+1)
+		}
+		oldID, err1 := strconv.ParseInt(strings.TrimSpace(record[0]), 10, 64)
+		newID, err2 := strconv.ParseInt(strings.TrimSpace(record[1]), 10, 64)
+		if err1 != nil || err2 != nil {
+			if i == 0 {
+				continue // a header
+			}
+			return nil, fmt.Errorf("%s:%d: expected old_id,new_id", path, i+1)
+		}
+		mapping[oldID] = newID
+	}
+	return mapping, nil
+}
+
+// AvatarRekeyReport is the result of avatars rekey.
+type AvatarRekeyReport struct {
+	Users   int      `json:"users"` // users in the mapping
+	Rekeyed int      `json:"rekeyed"`
+	Missing int      `json:"missing"` // users without an avatar to rekey
+	Kept    []string `json:"kept"`    // avatars left alone, as the new id already has one
+}
+
+// copyAvatars copies users' avatars from another instance's directory to
+// their new ids here. users who already have an avatar here keep it, e.g.
+// those linked by merge, unless overwrite is set.
+func copyAvatars(from string, mapping map[int64]int64, overwrite, dryRun bool) (*AvatarRekeyReport, error) {
+	dir := cfg.AvatarDirectory()
+	source, _, err := listAvatars(from)
+	if err != nil {
+		return nil, err
+	}
+	existing, _, err := listAvatars(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &AvatarRekeyReport{Users: len(mapping), Kept: []string{}}
+	for oldID, newID := range mapping {
+		files := source[oldID]
+		if len(files) == 0 {
+			report.Missing++
+			continue
+		}
+		if len(existing[newID]) != 0 && !overwrite {
+			report.Kept = append(report.Kept, filepath.Base(files[0].Path))
+			continue
+		}
+		report.Rekeyed++
+		if dryRun {
+			continue
+		}
+		// only the avatar which is served is copied, replacing any here
+		to := filepath.Join(dir, fmt.Sprintf("%d.%s", newID, files[0].Ext))
+		if err := copyAvatar(files[0].Path, to); err != nil {
+			return report, err
+		}
+		for _, f := range existing[newID] {
+			if f.Path != to {
+				if err := os.Remove(f.Path); err != nil {
+					return report, err
+				}
+			}
+		}
+	}
+	return report, nil
+}
+
+// renameAvatars renames avatars in place to users' new ids, first into
+// .rekey, then back out, so ids can be swapped. renames are instant, so
+// they aren't stopped by ctrl-c; a run which is stopped anyway (e.g. by a
+// crash) is finished by running again, which then doesn't rekey any more.
+func renameAvatars(mapping map[int64]int64, dryRun bool) (*AvatarRekeyReport, error) {
+	dir := cfg.AvatarDirectory()
+	staging := filepath.Join(dir, rekeyDirectory)
+	if pending, err := os.ReadDir(staging); err == nil && len(pending) != 0 {
+		logger.Warn("finishing an interrupted rekey, without rekeying anything else", "avatars", len(pending))
+		if dryRun {
+			return &AvatarRekeyReport{Kept: []string{}}, nil
+		}
+		return &AvatarRekeyReport{Kept: []string{}}, unstageAvatars(staging)
+	}
+
+	avatars, _, err := listAvatars(dir)
+	if err != nil {
+		return nil, err
+	}
+	report := &AvatarRekeyReport{Users: len(mapping), Kept: []string{}}
+	moves := make(map[int64]int64)
+	for oldID, newID := range mapping {
+		if len(avatars[oldID]) == 0 {
+			report.Missing++
+		} else if oldID != newID {
+			moves[oldID] = newID
+		}
+	}
+	// users whose avatars stay where they are keep them, which may keep
+	// others' in place in turn
+	for kept := true; kept; {
+		kept = false
+		for oldID, newID := range moves {
+			if _, moving := moves[newID]; len(avatars[newID]) != 0 && !moving {
+				report.Kept = append(report.Kept, filepath.Base(avatars[oldID][0].Path))
+				delete(moves, oldID)
+				kept = true
+			}
+		}
+	}
+	report.Rekeyed = len(moves)
+	if dryRun {
+		return report, nil
+	}
+
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		return report, err
+	}
+	for oldID, newID := range moves {
+		for _, f := range avatars[oldID] {
+			if err := os.Rename(f.Path, filepath.Join(staging, fmt.Sprintf("%d.%s", newID, f.Ext))); err != nil {
+				return report, err
+			}
+		}
+	}
+	return report, unstageAvatars(staging)
+}
+
+// unstageAvatars moves the avatars in .rekey to their place.
+func unstageAvatars(staging string) error {
+	entries, err := os.ReadDir(staging)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.Rename(filepath.Join(staging, entry.Name()), filepath.Join(filepath.Dir(staging), entry.Name())); err != nil {
+			return err
+		}
+	}
+	return os.Remove(staging)
+}
+
+func runAvatarsRekey() error {
+	if cfg.AvatarMapping == "" {
+		return errors.New("--mapping is required, a merge's --report or a csv of old_id,new_id")
+	}
+	mapping, err := readAvatarMapping(cfg.AvatarMapping)
+	if err != nil {
+		return err
+	}
+
+	var report *AvatarRekeyReport
+	if cfg.AvatarSource != "" {
+		report, err = copyAvatars(cfg.AvatarSource, mapping, cfg.AvatarOverwrite, cfg.DryRun)
+	} else {
+		report, err = renameAvatars(mapping, cfg.DryRun)
+	}
+	if err != nil {
+		return err
+	}
+	for _, name := range report.Kept[:min(len(report.Kept), maxExamples)] {
+		fmt.Printf("  kept the avatar here instead of %s\n", name)
+	}
+	if err := writeReport(cfg.ReportPath, report); err != nil {
+		return err
+	}
+	logger.Info("avatars rekey finished", "users", report.Users, "rekeyed", report.Rekeyed,
+		"without_avatar", report.Missing, "kept", len(report.Kept), "dry_run", cfg.DryRun)
+	return nil
+}
+
+// AvatarConvertReport is the result of avatars convert.
+type AvatarConvertReport struct {
+	Converted int      `json:"converted"`
+	Renamed   int      `json:"renamed"` // avatars named after the wrong format
+	Shadowed  int      `json:"shadowed_removed"`
+	Failed    []string `json:"failed"`
+}
+
+// convertAvatar rewrites a user's served avatar in format, removing the
+// ones it shadows.
+func convertAvatar(files []avatarFile, format string, report *AvatarConvertReport) error {
+	served := files[0]
+	to := strings.TrimSuffix(served.Path, "."+served.Ext) + "." + formatExtension(format)
+
+	actual, err := imageFormat(served.Path)
+	if err != nil {
+		return err
+	}
+	switch {
+	case actual == format && served.Path == to:
+	case actual == format:
+		if err := os.Rename(served.Path, to); err != nil {
+			return err
+		}
+		report.Renamed++
+	default:
+		f, err := os.Open(served.Path)
+		if err != nil {
+			return err
+		}
+		img, _, err := image.Decode(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if format == "png" {
+			err = png.Encode(&buf, img)
+		} else {
+			err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: cfg.AvatarQuality})
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(to+".tmp", buf.Bytes(), 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(to+".tmp", to); err != nil {
+			return err
+		}
+		if served.Path != to {
+			if err := os.Remove(served.Path); err != nil {
+				return err
+			}
+		}
+		report.Converted++
+	}
+
+	for _, f := range files[1:] {
+		if f.Path == to {
+			continue
+		}
+		if err := os.Remove(f.Path); err != nil {
+			return err
+		}
+		report.Shadowed++
+	}
+	return nil
+}
+
+func runAvatarsConvert() error {
+	format := cfg.AvatarFormat
+	if format == "jpg" {
+		format = "jpeg"
+	}
+	if format != "png" && format != "jpeg" {
+		return fmt.Errorf("unknown --format %q, expected png or jpg", cfg.AvatarFormat)
+	}
+	avatars, _, err := listAvatars(cfg.AvatarDirectory())
+	if err != nil {
+		return err
+	}
+	ids := make([]int64, 0, len(avatars))
+	for id := range avatars {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	if cfg.DryRun {
+		var convert, shadowed int
+		for _, id := range ids {
+			actual, err := imageFormat(avatars[id][0].Path)
+			if err != nil || actual != format || avatars[id][0].Ext != formatExtension(format) {
+				convert++
+			}
+			shadowed += len(avatars[id]) - 1
+		}
+		fmt.Printf("%d of %d avatars would be converted to %s, and %d shadowed ones removed\n",
+			convert, len(ids), formatExtension(format), shadowed)
+		return nil
+	}
+
+	// ctrl-c stops between avatars
+	handleSignals()
+	start := time.Now()
+	report := &AvatarConvertReport{Failed: []string{}}
+	for _, id := range ids {
+		if isInterrupted() {
+			return errInterrupted
+		}
+		if err := convertAvatar(avatars[id], format, report); err != nil {
+			// e.g. a corrupt file, which avatars verify reports too
+			logger.Warn("failed to convert avatar", "user", id, "err", err)
+			report.Failed = append(report.Failed, filepath.Base(avatars[id][0].Path))
+		}
+	}
+	if err := writeReport(cfg.ReportPath, report); err != nil {
+		return err
+	}
+	logger.Info("avatars convert finished", "avatars", len(ids), "converted", report.Converted, "renamed", report.Renamed,
+		"shadowed_removed", report.Shadowed, "failed", len(report.Failed), "elapsed", time.Since(start).Round(time.Second))
+	return nil
+}
+
+// AvatarVerifyReport is the result of avatars verify.
+type AvatarVerifyReport struct {
+	Users          int      `json:"users"`
+	Avatars        int      `json:"avatars"`
+	Missing        []int64  `json:"missing"`    // users without an avatar
+	Orphaned       []string `json:"orphaned"`   // avatars of users which don't exist
+	Unreadable     []string `json:"unreadable"` // files which aren't png, jpeg or gif
+	Misnamed       []string `json:"misnamed"`   // avatars named after the wrong format
+	Shadowed       []string `json:"shadowed"`   // avatars never served, as the user has another
+	Others         []string `json:"others"`     // files which aren't avatars
+	DefaultMissing bool     `json:"default_missing"`
+}
+
+func runAvatarsVerify() error {
+	dir := cfg.AvatarDirectory()
+	avatars, others, err := listAvatars(dir)
+	if err != nil {
+		return err
+	}
+	var users []int64
+	if err := DB.Select(&users, "SELECT id FROM users ORDER BY id"); err != nil {
+		return err
+	}
+
+	report := &AvatarVerifyReport{Users: len(users), Missing: []int64{}, Orphaned: []string{},
+		Unreadable: []string{}, Misnamed: []string{}, Shadowed: []string{}, Others: others}
+	exists := make(map[int64]bool, len(users))
+	for _, id := range users {
+		exists[id] = true
+		if len(avatars[id]) == 0 {
+			report.Missing = append(report.Missing, id)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, defaultAvatar)); err != nil {
+		report.DefaultMissing = true
+	}
+
+	ids := make([]int64, 0, len(avatars))
+	for id := range avatars {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		for i, f := range avatars[id] {
+			name := filepath.Base(f.Path)
+			report.Avatars++
+			if !exists[id] {
+				report.Orphaned = append(report.Orphaned, name)
+			}
+			if i != 0 {
+				report.Shadowed = append(report.Shadowed, name)
+			}
+			format, err := imageFormat(f.Path)
+			switch {
+			case err != nil:
+				report.Unreadable = append(report.Unreadable, name)
+			case formatExtension(format) != f.Ext && !(format == "jpeg" && (f.Ext == "jpeg" || f.Ext == "jfif")):
+				report.Misnamed = append(report.Misnamed, name)
+			}
+		}
+	}
+
+	fmt.Printf("%d users, %d avatars\n", report.Users, report.Avatars)
+	for _, problem := range []struct {
+		name  string
+		files []string
+	}{
+		{"of users which don't exist", report.Orphaned},
+		{"which can't be read", report.Unreadable},
+		{"named after the wrong format", report.Misnamed},
+		{"shadowed by another of the user's", report.Shadowed},
+		{"files which aren't avatars", report.Others},
+	} {
+		if len(problem.files) != 0 {
+			fmt.Printf("  %d %s: %s\n", len(problem.files), problem.name,
+				strings.Join(problem.files[:min(len(problem.files), maxExamples)], ", "))
+		}
+	}
+	fmt.Printf("  %d users without an avatar\n", len(report.Missing))
+	if report.DefaultMissing {
+		fmt.Printf("  %s is missing, so they have none at all\n", defaultAvatar)
+	}
+	if err := writeReport(cfg.ReportPath, report); err != nil {
+		return err
+	}
+
+	if len(report.Orphaned) != 0 || len(report.Unreadable) != 0 || report.DefaultMissing ||
+		cfg.AvatarStrict && len(report.Missing) != 0 {
+		return errAvatarProblems
+	}
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:              "avatars rekey",
+		Summary:           "move avatars to users' new ids, after a merge or an import which remapped them",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.AvatarMapping, "mapping", "", "users' old & new ids: a merge's --report, or a csv of old_id,new_id")
+			flags.StringVar(&c.AvatarSource, "from", "", "copy the avatars from this directory, e.g. another instance's .data/avatars (default: rename them in place)")
+			flags.BoolVar(&c.AvatarOverwrite, "overwrite", false, "with --from, replace the avatars of users who already have one here")
+			flags.BoolVar(&c.DryRun, "dry-run", false, "report what would be moved, without moving anything")
+			flags.StringVar(&c.ReportPath, "report", "", "write what was moved as json to this path (- for stdout)")
+		},
+		Run: runAvatarsRekey,
+	})
+	registerCommand(&Command{
+		Name:              "avatars convert",
+		Summary:           "rewrite every avatar in one format, removing those shadowed by another of the user's",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.AvatarFormat, "format", "png", "the format to rewrite avatars in, png or jpg (gifs lose their animation)")
+			flags.IntVar(&c.AvatarQuality, "quality", 90, "with --format jpg, the jpeg quality (1-100)")
+			flags.BoolVar(&c.DryRun, "dry-run", false, "report how many avatars would be converted, without converting them")
+			flags.StringVar(&c.ReportPath, "report", "", "write what was converted as json to this path (- for stdout)")
+		},
+		Run: runAvatarsConvert,
+	})
+	registerCommand(&Command{
+		Name:              "avatars verify",
+		Summary:           "check every avatar can be read and belongs to a user, and list users without one",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.BoolVar(&c.AvatarStrict, "strict", false, "fail if any user has no avatar, e.g. after a merge which should have brought them")
+			flags.StringVar(&c.ReportPath, "report", "", "write what was found as json to this path (- for stdout)")
+		},
+		Run: runAvatarsVerify,
+	})
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a small backblaze b2 client, with just what backups need: uploading
+// files (large ones in parts), listing, downloading & deleting them.
+// https://www.backblaze.com/apidocs/introduction-to-the-b2-native-api
+
+// B2Client talks to a single bucket.
+type B2Client struct {
+	Bucket      string
+	bucketID    string
+	apiURL      string
+	downloadURL string
+	token       string
+	http        *http.Client
+}
+
+// b2Error is the body of an unsuccessful response.
+type b2Error struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *b2Error) Error() string {
+	return fmt.Sprintf("b2 %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+func b2ResponseError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	e := &b2Error{Status: resp.StatusCode}
+	if json.Unmarshal(body, e) != nil || e.Code == "" {
+		e.Code, e.Message = resp.Status, strings.TrimSpace(string(body))
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %v", os.ErrNotExist, e)
+	}
+	return e
+}
+
+func newB2Client(bucket string) (*B2Client, error) {
+	if cfg.B2KeyID == "" || cfg.B2Key == "" {
+		return nil, fmt.Errorf("b2 credentials are not set (B2_APPLICATION_KEY_ID, B2_APPLICATION_KEY)")
+	}
+	c := &B2Client{Bucket: bucket, http: &http.Client{Timeout: 10 * time.Minute}}
+
+	req, err := http.NewRequest(http.MethodGet, "https://api.backblazeb2.com/b2api/v2/b2_authorize_account", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(cfg.B2KeyID, cfg.B2Key)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, b2ResponseError(resp)
+	}
+	var auth struct {
+		AccountID   string `json:"accountId"`
+		Token       string `json:"authorizationToken"`
+		APIURL      string `json:"apiUrl"`
+		DownloadURL string `json:"downloadUrl"`
+		Allowed     struct {
+			BucketID   string `json:"bucketId"`
+			BucketName string `json:"bucketName"`
+		} `json:"allowed"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&auth); err != nil {
+		return nil, err
+	}
+	c.apiURL, c.downloadURL, c.token = auth.APIURL, auth.DownloadURL, auth.Token
+
+	// a key limited to one bucket names it, otherwise it's looked up
+	if auth.Allowed.BucketName == bucket {
+		c.bucketID = auth.Allowed.BucketID
+		return c, nil
+	}
+	var buckets struct {
+		Buckets []struct {
+			BucketID string `json:"bucketId"`
+		} `json:"buckets"`
+	}
+	err = c.call("b2_list_buckets", map[string]string{"accountId": auth.AccountID, "bucketName": bucket}, &buckets)
+	if err != nil {
+		return nil, err
+	}
+	if len(buckets.Buckets) == 0 {
+		return nil, fmt.Errorf("there's no b2 bucket named %s", bucket)
+	}
+	c.bucketID = buckets.Buckets[0].BucketID
+	return c, nil
+}
+
+// call calls an api method, with a json request & response.
+func (c *B2Client) call(method string, request, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.apiURL+"/b2api/v2/"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", c.token)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return b2ResponseError(resp)
+	}
+	if response == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+// upload posts a file or part to an upload url. b2 checks the body against
+// its sha1.
+func (c *B2Client) upload(method string, target map[string]string, headers map[string]string, body []byte) error {
+	var endpoint struct {
+		UploadURL string `json:"uploadUrl"`
+		Token     string `json:"authorizationToken"`
+	}
+	if err := c.call(method, target, &endpoint); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint.UploadURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	sum := sha1.Sum(body)
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Authorization", endpoint.Token)
+	req.Header.Set("X-Bz-Content-Sha1", hex.EncodeToString(sum[:]))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return b2ResponseError(resp)
+	}
+	return nil
+}
+
+// b2File is a file as listed by b2_list_file_names.
+type b2File struct {
+	Name string `json:"fileName"`
+	ID   string `json:"fileId"`
+	Size int64  `json:"contentLength"`
+}
+
+// list lists the files under prefix.
+func (c *B2Client) list(prefix string) ([]b2File, error) {
+	var files []b2File
+	start := ""
+	for {
+		var page struct {
+			Files []b2File `json:"files"`
+			Next  *string  `json:"nextFileName"`
+		}
+		request := map[string]interface{}{"bucketId": c.bucketID, "prefix": prefix, "maxFileCount": 1000}
+		if start != "" {
+			request["startFileName"] = start
+		}
+		if err := c.call("b2_list_file_names", request, &page); err != nil {
+			return nil, err
+		}
+		files = append(files, page.Files...)
+		if page.Next == nil {
+			return files, nil
+		}
+		start = *page.Next
+	}
+}
+
+// B2Destination keeps backups as files under a prefix of a bucket.
+type B2Destination struct {
+	client *B2Client
+	prefix string // either empty, or ending in a slash
+}
+
+func openB2Destination(u *url.URL) (*B2Destination, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid b2 destination %q, expected b2://bucket/prefix", u.String())
+	}
+	client, err := newB2Client(u.Host)
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.Trim(u.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &B2Destination{client: client, prefix: prefix}, nil
+}
+
+// b2Upload buffers a part at a time, as s3Upload does. b2's parts must be
+// at least 5 MB, as s3's.
+type b2Upload struct {
+	d      *B2Destination
+	name   string
+	info   map[string]string
+	buf    []byte
+	fileID string
+	sha1s  []string
+}
+
+func (d *B2Destination) Create(name string, tags map[string]string) (BackupUpload, error) {
+	return &b2Upload{
+		d:    d,
+		name: d.prefix + name,
+		info: tags,
+		buf:  make([]byte, 0, cfg.BackupPartSize<<20),
+	}, nil
+}
+
+func (u *b2Upload) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(u.buf[len(u.buf):cap(u.buf)], p)
+		u.buf = u.buf[:len(u.buf)+n]
+		p = p[n:]
+		written += n
+		if len(u.buf) == cap(u.buf) {
+			if err := u.uploadPart(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (u *b2Upload) uploadPart() error {
+	if u.fileID == "" {
+		var started struct {
+			FileID string `json:"fileId"`
+		}
+		err := retryUpload(u.name, func() error {
+			return u.d.client.call("b2_start_large_file", map[string]interface{}{
+				"bucketId":    u.d.client.bucketID,
+				"fileName":    u.name,
+				"contentType": "application/octet-stream",
+				"fileInfo":    u.info,
+			}, &started)
+		})
+		if err != nil {
+			return err
+		}
+		u.fileID = started.FileID
+	}
+
+	n := len(u.sha1s) + 1
+	err := retryUpload(fmt.Sprintf("%s part %d", u.name, n), func() error {
+		return u.d.client.upload("b2_get_upload_part_url", map[string]string{"fileId": u.fileID},
+			map[string]string{"X-Bz-Part-Number": strconv.Itoa(n)}, u.buf)
+	})
+	if err != nil {
+		return err
+	}
+	sum := sha1.Sum(u.buf)
+	u.sha1s = append(u.sha1s, hex.EncodeToString(sum[:]))
+	u.buf = u.buf[:0]
+	return nil
+}
+
+func (u *b2Upload) Commit() error {
+	if u.fileID == "" {
+		headers := map[string]string{
+			"X-Bz-File-Name": url.PathEscape(u.name),
+			"Content-Type":   "application/octet-stream",
+		}
+		for k, v := range u.info {
+			headers["X-Bz-Info-"+k] = url.PathEscape(v)
+		}
+		return retryUpload(u.name, func() error {
+			return u.d.client.upload("b2_get_upload_url", map[string]string{"bucketId": u.d.client.bucketID}, headers, u.buf)
+		})
+	}
+
+	if len(u.buf) != 0 {
+		if err := u.uploadPart(); err != nil {
+			u.Abort()
+			return err
+		}
+	}
+	// b2 checks the parts' sha1s against those it received
+	err := retryUpload(u.name, func() error {
+		return u.d.client.call("b2_finish_large_file", map[string]interface{}{
+			"fileId":        u.fileID,
+			"partSha1Array": u.sha1s,
+		}, nil)
+	})
+	if err != nil {
+		u.Abort()
+	}
+	return err
+}
+
+func (u *b2Upload) Abort() {
+	if u.fileID == "" {
+		return
+	}
+	if err := u.d.client.call("b2_cancel_large_file", map[string]string{"fileId": u.fileID}, nil); err != nil {
+		logger.Warn("failed to cancel the upload, its parts are kept until it's cancelled", "name", u.name, "err", err)
+	}
+	u.fileID = ""
+}
+
+func (d *B2Destination) Open(name string) (io.ReadCloser, error) {
+	u := d.client.downloadURL + "/file/" + url.PathEscape(d.client.Bucket) + "/" + awsEscape(d.prefix+name, true)
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", d.client.token)
+	resp, err := d.client.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, b2ResponseError(resp)
+	}
+	return resp.Body, nil
+}
+
+func (d *B2Destination) List() ([]string, error) {
+	files, err := d.client.list(d.prefix)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, f := range files {
+		if name := strings.TrimPrefix(f.Name, d.prefix); !strings.Contains(name, "/") {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// Delete deletes every version of the file, rather than hiding it, so that
+// rotated backups don't keep using space.
+func (d *B2Destination) Delete(name string) error {
+	var versions struct {
+		Files []b2File `json:"files"`
+	}
+	err := d.client.call("b2_list_file_versions", map[string]interface{}{
+		"bucketId": d.client.bucketID, "prefix": d.prefix + name, "maxFileCount": 1000,
+	}, &versions)
+	if err != nil {
+		return err
+	}
+	for _, f := range versions.Files {
+		if f.Name != d.prefix+name {
+			continue
+		}
+		err := d.client.call("b2_delete_file_version", map[string]string{"fileName": f.Name, "fileId": f.ID}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *B2Destination) Location(name string) string {
+	return fmt.Sprintf("b2://%s/%s%s", d.client.Bucket, d.prefix, name)
+}
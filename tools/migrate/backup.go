@@ -0,0 +1,783 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// backup takes a logical backup of the database, and a tarball of the data
+// directory's replays, avatars & beatmaps, for running from cron instead of
+// a hand-rolled mysqldump script. each backup is a set of files named
+// bancho-<time>, in --dir:
+//
+//	bancho-<time>.sql.gz      every table's schema & rows, as sql
+//	bancho-<time>.data.tar.gz the data directory
+//	bancho-<time>.json        the manifest: sizes, checksums & row counts
+//
+// with --encryption-key, the sql & tarball are encrypted (see crypt.go),
+// and named .enc. after a backup succeeds, all but the newest --keep full
+// backups are removed.
+//
+// with --consistency transaction (the default), the tables are read in one
+// transaction with a consistent snapshot, which doesn't block bancho.py, but
+// only covers innodb tables. with --consistency lock, FLUSH TABLES WITH READ
+// LOCK is held until the tarball is written as well, so the tables & the
+// replays match exactly, at the cost of bancho.py's writes waiting.
+//
+// with --incremental, a backup only holds what's changed since the newest
+// backup in --dir, which it's based on: scores & logs rows newer than that
+// backup's, and files modified since it was taken. the other tables are
+// small next to those, so are dumped whole. a score beating a player's
+// previous best changes the old one's status, so the scores of the same
+// player, map & mode are dumped again with each new one. rows deleted
+// since (e.g. by dedupe scores or gdpr erase) aren't, so take a full backup
+// after such maintenance, or after recalc pp.
+//
+// backup restore restores a full backup, and the increments based on it,
+// up to a chosen point in time.
+
+const (
+	consistencyTransaction = "transaction"
+	consistencyLock        = "lock"
+)
+
+// rows per INSERT statement in the dump
+const dumpRowsPerInsert = 500
+
+const (
+	backupFull        = "full"
+	backupIncremental = "incremental"
+)
+
+// IncrementalTable is a table which increments only hold the new rows of,
+// i.e. those whose id is newer than the base backup's newest. Related is an
+// optional condition of older rows which are dumped again too, where ? is
+// the base's newest id.
+type IncrementalTable struct {
+	Table   string
+	Related string
+}
+
+var incrementalTables = []IncrementalTable{
+	{Table: "scores", Related: "(userid, map_md5, mode) IN (SELECT userid, map_md5, mode FROM scores WHERE id > ?)"},
+	{Table: "logs"},
+}
+
+// BackupFile is one of a backup's files.
+type BackupFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// BackupManifest describes a backup, and is written once it's complete,
+// so a backup without one is incomplete.
+type BackupManifest struct {
+	Name        string           `json:"name"`
+	Type        string           `json:"type"`           // full or incremental
+	Base        string           `json:"base,omitempty"` // the backup an increment follows
+	StartedAt   time.Time        `json:"started_at"`
+	FinishedAt  time.Time        `json:"finished_at"`
+	Database    string           `json:"database"`
+	Consistency string           `json:"consistency"`
+	Encrypted   bool             `json:"encrypted"`
+	Tables      map[string]int64 `json:"tables"`    // rows per table
+	Positions   map[string]int64 `json:"positions"` // the newest id of each incremental table
+	DataFiles   int64            `json:"data_files"`
+	Files       []BackupFile     `json:"files"`
+}
+
+// backupSink writes a backup file through gzip & optionally encryption,
+// checksumming what reaches the destination.
+type backupSink struct {
+	name   string
+	upload BackupUpload
+	hash   hash.Hash
+	size   countingWriter
+	enc    io.WriteCloser
+	gz     *gzip.Writer
+	buf    *bufio.Writer
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func createBackupFile(dest BackupDestination, name string, tags map[string]string, key []byte) (*backupSink, error) {
+	upload, err := dest.Create(name, tags)
+	if err != nil {
+		return nil, err
+	}
+	s := &backupSink{name: name, upload: upload, hash: sha256.New()}
+	s.size.w = io.MultiWriter(upload, s.hash)
+
+	var w io.Writer = &s.size
+	if key != nil {
+		if s.enc, err = newEncryptWriter(w, key); err != nil {
+			upload.Abort()
+			return nil, err
+		}
+		w = s.enc
+	}
+	if s.gz, err = gzip.NewWriterLevel(w, cfg.BackupCompression); err != nil {
+		upload.Abort()
+		return nil, err
+	}
+	s.buf = bufio.NewWriterSize(s.gz, 256*1024)
+	return s, nil
+}
+
+func (s *backupSink) Write(p []byte) (int, error) {
+	return s.buf.Write(p)
+}
+
+// Close finishes the file, and commits it to the destination.
+func (s *backupSink) Close() (BackupFile, error) {
+	err := s.buf.Flush()
+	if err == nil {
+		err = s.gz.Close()
+	}
+	if err == nil && s.enc != nil {
+		err = s.enc.Close()
+	}
+	if err != nil {
+		s.upload.Abort()
+		return BackupFile{}, err
+	}
+	if err := s.upload.Commit(); err != nil {
+		return BackupFile{}, err
+	}
+	return BackupFile{Name: s.name, Size: s.size.n, SHA256: hex.EncodeToString(s.hash.Sum(nil))}, nil
+}
+
+// abort removes the unfinished file.
+func (s *backupSink) abort() {
+	s.upload.Abort()
+}
+
+// dumpConnection opens a connection which reads values as the server
+// sends them, rather than parsing times, so that they're dumped exactly.
+func dumpConnection() (*sqlx.DB, error) {
+	dsn, err := cfg.DSN()
+	if err != nil {
+		return nil, err
+	}
+	dsnConfig, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	dsnConfig.ParseTime = false
+	db, err := sqlx.Connect("mysql", dsnConfig.FormatDSN())
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+// sqlLiteral writes a value scanned as text as a mysql literal.
+func sqlLiteral(w *bufio.Writer, value sql.RawBytes, binary bool) {
+	if value == nil {
+		w.WriteString("NULL")
+		return
+	}
+	if binary {
+		if len(value) == 0 {
+			w.WriteString("''")
+			return
+		}
+		w.WriteString("0x")
+		w.WriteString(hex.EncodeToString(value))
+		return
+	}
+	w.WriteByte('\'')
+	for _, b := range value {
+		switch b {
+		case 0:
+			w.WriteString(`\0`)
+		case '\n':
+			w.WriteString(`\n`)
+		case '\r':
+			w.WriteString(`\r`)
+		case 0x1a:
+			w.WriteString(`\Z`)
+		case '\'':
+			w.WriteString(`\'`)
+		case '\\':
+			w.WriteString(`\\`)
+		default:
+			w.WriteByte(b)
+		}
+	}
+	w.WriteByte('\'')
+}
+
+// dumpTable writes a table's schema, and its rows as multi-row INSERTs.
+// where is an optional condition on the rows.
+func dumpTable(ctx context.Context, conn *sqlx.Conn, w *bufio.Writer, t *TableSchema, where string, args ...interface{}) (int64, error) {
+	var name, create string
+	if err := conn.QueryRowContext(ctx, "SHOW CREATE TABLE `"+t.Name+"`").Scan(&name, &create); err != nil {
+		return 0, err
+	}
+	fmt.Fprintf(w, "\nDROP TABLE IF EXISTS `%s`;\n%s;\n", t.Name, create)
+
+	query := "SELECT * FROM `" + t.Name + "`"
+	if where != "" {
+		query += " WHERE " + where
+	}
+	return dumpRows(ctx, conn, w, t, "INSERT", query, args...)
+}
+
+// dumpRows writes the rows of a query over a table as INSERTs, or
+// REPLACEs for rows which may exist already.
+func dumpRows(ctx context.Context, conn *sqlx.Conn, w *bufio.Writer, t *TableSchema, verb, query string, args ...interface{}) (int64, error) {
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	binary := make([]bool, len(columns))
+	for i, column := range columns {
+		for _, c := range t.Columns {
+			if c.Name == column {
+				binary[i] = c.Binary()
+			}
+		}
+	}
+	values := make([]sql.RawBytes, len(columns))
+	ptrs := make([]interface{}, len(columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+
+	insert := verb + " INTO `" + t.Name + "` (`" + strings.Join(columns, "`, `") + "`) VALUES\n"
+	var n int64
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return n, err
+		}
+		if n%dumpRowsPerInsert == 0 {
+			if n != 0 {
+				w.WriteString(";\n")
+			}
+			w.WriteString(insert)
+		} else {
+			w.WriteString(",\n")
+		}
+		w.WriteByte('(')
+		for i, value := range values {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			sqlLiteral(w, value, binary[i])
+		}
+		w.WriteByte(')')
+		n++
+
+		if n%BatchSize == 0 && isInterrupted() {
+			return n, errInterrupted
+		}
+	}
+	if n != 0 {
+		w.WriteString(";\n")
+	}
+	return n, rows.Err()
+}
+
+// dumpIncrement writes a table's rows since the base backup, which are
+// REPLACEd, as some may be older rows dumped again.
+func dumpIncrement(ctx context.Context, conn *sqlx.Conn, w *bufio.Writer, t *TableSchema, inc IncrementalTable, since int64) (int64, error) {
+	fmt.Fprintf(w, "\n-- rows of `%s` since id %d\n", t.Name, since)
+	query := "SELECT * FROM `" + t.Name + "` WHERE id > ?"
+	args := []interface{}{since}
+	if inc.Related != "" {
+		query += " OR " + inc.Related
+		args = append(args, since)
+	}
+	return dumpRows(ctx, conn, w, t, "REPLACE", query, args...)
+}
+
+// dumpDatabase writes every table to w, through conn's snapshot. with a
+// base, the incremental tables only have their rows since it.
+func dumpDatabase(ctx context.Context, conn *sqlx.Conn, w io.Writer, manifest, base *BackupManifest) error {
+	tables, err := loadTableSchemas(cfg.DBName, nil)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriterSize(w, 256*1024)
+	fmt.Fprintf(bw, "-- bancho.py backup of %s, taken %s\n", cfg.DBName, manifest.StartedAt.Format(time.RFC3339))
+	bw.WriteString("SET NAMES utf8mb4;\nSET FOREIGN_KEY_CHECKS = 0;\nSET UNIQUE_CHECKS = 0;\nSET SQL_MODE = 'NO_AUTO_VALUE_ON_ZERO';\n")
+
+	incremental := make(map[string]IncrementalTable, len(incrementalTables))
+	for _, inc := range incrementalTables {
+		incremental[inc.Table] = inc
+	}
+
+	for _, t := range tables {
+		start := time.Now()
+		inc, isIncremental := incremental[t.Name]
+		if isIncremental {
+			var position int64
+			err := conn.GetContext(ctx, &position, "SELECT COALESCE(MAX(id), 0) FROM `"+t.Name+"`")
+			if err != nil {
+				return err
+			}
+			manifest.Positions[t.Name] = position
+		}
+
+		var n int64
+		since, hasPosition := int64(0), false
+		if base != nil {
+			since, hasPosition = base.Positions[t.Name]
+		}
+		if isIncremental && hasPosition {
+			n, err = dumpIncrement(ctx, conn, bw, t, inc, since)
+		} else {
+			n, err = dumpTable(ctx, conn, bw, t, "")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to dump %s: %w", t.Name, err)
+		}
+		manifest.Tables[t.Name] = n
+		logger.Debug("dumped table", "table", t.Name, "rows", n, "elapsed", time.Since(start).Round(time.Millisecond))
+	}
+	bw.WriteString("\nSET FOREIGN_KEY_CHECKS = 1;\nSET UNIQUE_CHECKS = 1;\n")
+	return bw.Flush()
+}
+
+// archiveDataDirectory writes the data directory's subdirectories into a
+// tarball. replays hardlinked by replays compact are stored as links. only
+// files for which include returns true are written, if it's set.
+func archiveDataDirectory(w io.Writer, include func(path string, info fs.FileInfo) bool) (int64, error) {
+	tw := tar.NewWriter(w)
+	links := make(map[uint64]string)
+	var files int64
+
+	for _, dir := range strings.Split(cfg.BackupDataDirs, ",") {
+		dir = strings.TrimSpace(dir)
+		root := filepath.Join(cfg.DataDirectory, dir)
+		if _, err := os.Stat(root); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if isInterrupted() {
+				return errInterrupted
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() && !info.IsDir() {
+				return nil
+			}
+			if strings.HasSuffix(path, ".tmp") || (!info.IsDir() && include != nil && !include(path, info)) {
+				return nil
+			}
+
+			name, err := filepath.Rel(cfg.DataDirectory, path)
+			if err != nil {
+				return err
+			}
+			header, err := tar.FileInfoHeader(info, "")
+			if err != nil {
+				return err
+			}
+			header.Name = filepath.ToSlash(name)
+			if info.IsDir() {
+				header.Name += "/"
+				return tw.WriteHeader(header)
+			}
+
+			if id := fileID(info); id != 0 {
+				if target, ok := links[id]; ok {
+					header.Typeflag, header.Linkname, header.Size = tar.TypeLink, target, 0
+					files++
+					return tw.WriteHeader(header)
+				}
+				links[id] = header.Name
+			}
+
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			// a file growing while it's copied is cut at its size when stat'd
+			if _, err := io.CopyN(tw, f, header.Size); err != nil {
+				return fmt.Errorf("failed to archive %s: %w", path, err)
+			}
+			files++
+			return nil
+		})
+		if err != nil {
+			return files, err
+		}
+	}
+	return files, tw.Close()
+}
+
+// beginSnapshot starts the backup's transaction on conn. with
+// --consistency lock, the returned function releases the read lock.
+func beginSnapshot(ctx context.Context, conn *sqlx.Conn) (unlock func(), err error) {
+	unlock = func() {}
+	if _, err := conn.ExecContext(ctx, "SET SESSION TRANSACTION ISOLATION LEVEL REPEATABLE READ"); err != nil {
+		return unlock, err
+	}
+
+	if cfg.BackupConsistency == consistencyLock {
+		if _, err := conn.ExecContext(ctx, "FLUSH TABLES WITH READ LOCK"); err != nil {
+			return unlock, fmt.Errorf("failed to lock the tables, which needs the RELOAD privilege: %w", err)
+		}
+		unlock = func() {
+			if _, err := conn.ExecContext(context.Background(), "UNLOCK TABLES"); err != nil {
+				logger.Error("failed to unlock the tables", "err", err)
+			}
+		}
+	} else {
+		var others []string
+		err := DB.Select(&others, `
+		SELECT table_name FROM information_schema.tables
+		WHERE table_schema = ? AND table_type = 'BASE TABLE' AND engine != 'InnoDB'`, cfg.DBName)
+		if err != nil {
+			return unlock, err
+		}
+		if len(others) != 0 {
+			logger.Warn("these tables aren't innodb, so aren't covered by the snapshot, use --consistency lock to include them",
+				"tables", strings.Join(others, ","))
+		}
+	}
+
+	if _, err := conn.ExecContext(ctx, "START TRANSACTION WITH CONSISTENT SNAPSHOT"); err != nil {
+		unlock()
+		return func() {}, err
+	}
+	return unlock, nil
+}
+
+// backupName names a backup by when it was started.
+func backupName(t time.Time) string {
+	return "bancho-" + t.UTC().Format("20060102-150405")
+}
+
+// listBackups lists the complete backups at dest, i.e. those with a
+// manifest, oldest first.
+func listBackups(dest BackupDestination) ([]BackupManifest, error) {
+	names, err := dest.List()
+	if err != nil {
+		return nil, err
+	}
+	var manifests []BackupManifest
+	for _, name := range names {
+		if !strings.HasPrefix(name, "bancho-") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		f, err := dest.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		var m BackupManifest
+		err = json.NewDecoder(f).Decode(&m)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", dest.Location(name), err)
+		}
+		manifests = append(manifests, m)
+	}
+	sort.Slice(manifests, func(i, j int) bool { return manifests[i].StartedAt.Before(manifests[j].StartedAt) })
+	return manifests, nil
+}
+
+// backupChain finds the backups needed to restore one: its full backup,
+// then each increment up to it, in order.
+func backupChain(backups []BackupManifest, name string) ([]BackupManifest, error) {
+	byName := make(map[string]BackupManifest, len(backups))
+	for _, b := range backups {
+		byName[b.Name] = b
+	}
+	var chain []BackupManifest
+	for {
+		b, ok := byName[name]
+		if !ok {
+			if len(chain) == 0 {
+				return nil, fmt.Errorf("there's no backup named %s", name)
+			}
+			return nil, fmt.Errorf("%s is based on %s, which is missing", chain[0].Name, name)
+		}
+		chain = append([]BackupManifest{b}, chain...)
+		if b.Base == "" {
+			return chain, nil
+		}
+		name = b.Base
+	}
+}
+
+// rotateBackups removes all but the newest --keep full backups, along with
+// the increments based on them, and anything left by backups which didn't
+// finish.
+func rotateBackups(dest BackupDestination) error {
+	backups, err := listBackups(dest)
+	if err != nil {
+		return err
+	}
+	// each backup's full backup, the first of its chain
+	var fulls []string
+	root := make(map[string]string, len(backups))
+	for _, b := range backups {
+		root[b.Name] = b.Name
+		if b.Base != "" {
+			if r, ok := root[b.Base]; ok {
+				root[b.Name] = r
+			}
+		}
+		if root[b.Name] == b.Name {
+			fulls = append(fulls, b.Name)
+		}
+	}
+	if len(fulls) <= cfg.BackupKeep {
+		return nil
+	}
+	expired := make(map[string]bool)
+	for _, name := range fulls[:len(fulls)-cfg.BackupKeep] {
+		expired[name] = true
+	}
+
+	for _, b := range backups {
+		if !expired[root[b.Name]] {
+			continue
+		}
+		// the manifest goes first, so a backup is never listed without
+		// its files
+		if err := dest.Delete(b.Name + ".json"); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		for _, f := range b.Files {
+			if err := dest.Delete(f.Name); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		logger.Info("removed old backup", "name", b.Name, "type", b.Type)
+	}
+
+	// object storage never shows unfinished uploads, but directories do
+	names, err := dest.List()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if strings.HasPrefix(name, "bancho-") && strings.HasSuffix(name, ".tmp") {
+			dest.Delete(name)
+		}
+	}
+	return nil
+}
+
+func runBackup() error {
+	switch cfg.BackupConsistency {
+	case consistencyTransaction, consistencyLock:
+	default:
+		return fmt.Errorf("unknown --consistency %q, expected transaction or lock", cfg.BackupConsistency)
+	}
+	var key []byte
+	if cfg.BackupKeyPath != "" {
+		var err error
+		if key, err = loadEncryptionKey(cfg.BackupKeyPath); err != nil {
+			return err
+		}
+	}
+	dest, err := openBackupDestination(cfg.BackupDirectory)
+	if err != nil {
+		return err
+	}
+	tags, err := parseTags(cfg.BackupTags)
+	if err != nil {
+		return err
+	}
+	if cfg.BackupPartSize < 5 {
+		return errors.New("--part-size must be at least 5 MiB, the smallest part s3 & b2 accept")
+	}
+
+	dumpDB, err := dumpConnection()
+	if err != nil {
+		return err
+	}
+	defer dumpDB.Close()
+	ctx := context.Background()
+	conn, err := dumpDB.Connx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	handleSignals()
+	manifest := &BackupManifest{
+		Name:        backupName(time.Now()),
+		Type:        backupFull,
+		StartedAt:   time.Now().UTC(),
+		Database:    cfg.DBName,
+		Consistency: cfg.BackupConsistency,
+		Encrypted:   key != nil,
+		Tables:      map[string]int64{},
+		Positions:   map[string]int64{},
+	}
+
+	var base *BackupManifest
+	var include func(path string, info fs.FileInfo) bool
+	if cfg.BackupIncremental {
+		backups, err := listBackups(dest)
+		if err != nil {
+			return err
+		}
+		if len(backups) == 0 {
+			return fmt.Errorf("there are no backups at %s for an incremental backup to follow, take a full backup first", cfg.BackupDirectory)
+		}
+		base = &backups[len(backups)-1]
+		if base.Database != cfg.DBName {
+			return fmt.Errorf("the newest backup, %s, is of %s rather than %s", base.Name, base.Database, cfg.DBName)
+		}
+		manifest.Type, manifest.Base = backupIncremental, base.Name
+
+		// files written while the base was being taken may be in it, or
+		// not, so they're included again
+		include = func(path string, info fs.FileInfo) bool {
+			return !info.ModTime().Before(base.StartedAt)
+		}
+	}
+	ext := ".gz"
+	if key != nil {
+		ext = ".gz.enc"
+	}
+	tags["backup-type"] = manifest.Type
+	logger.Info("backing up", "name", manifest.Name, "type", manifest.Type, "base", manifest.Base,
+		"consistency", cfg.BackupConsistency, "encrypted", key != nil, "to", dest.Location(""))
+
+	unlock, err := beginSnapshot(ctx, conn)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	sink, err := createBackupFile(dest, manifest.Name+".sql"+ext, tags, key)
+	if err != nil {
+		return err
+	}
+	if err := dumpDatabase(ctx, conn, sink, manifest, base); err != nil {
+		sink.abort()
+		return err
+	}
+	file, err := sink.Close()
+	if err != nil {
+		return err
+	}
+	manifest.Files = append(manifest.Files, file)
+	conn.ExecContext(ctx, "COMMIT")
+	logger.Info("dumped the database", "tables", len(manifest.Tables), "size", formatBytes(file.Size))
+
+	if cfg.BackupDataDirs != "" {
+		sink, err := createBackupFile(dest, manifest.Name+".data.tar"+ext, tags, key)
+		if err != nil {
+			return err
+		}
+		if manifest.DataFiles, err = archiveDataDirectory(sink, include); err != nil {
+			sink.abort()
+			return err
+		}
+		file, err := sink.Close()
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, file)
+		logger.Info("archived the data directory", "files", manifest.DataFiles, "size", formatBytes(file.Size))
+	}
+	unlock()
+	unlock = func() {}
+
+	manifest.FinishedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	upload, err := dest.Create(manifest.Name+".json", tags)
+	if err != nil {
+		return err
+	}
+	if _, err := upload.Write(append(data, '\n')); err != nil {
+		upload.Abort()
+		return err
+	}
+	if err := upload.Commit(); err != nil {
+		return err
+	}
+
+	if cfg.BackupKeep > 0 {
+		if err := rotateBackups(dest); err != nil {
+			return fmt.Errorf("the backup succeeded, but old ones couldn't be removed: %w", err)
+		}
+	}
+
+	var size int64
+	for _, f := range manifest.Files {
+		size += f.Size
+	}
+	logger.Info("backed up", "name", manifest.Name, "type", manifest.Type, "size", formatBytes(size),
+		"elapsed", manifest.FinishedAt.Sub(manifest.StartedAt).Round(time.Second))
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:              "backup",
+		Summary:           "take a consistent backup of the database & data directory, compressed & optionally encrypted",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.BackupDirectory, "dir", "backups", "where backups are kept: a directory, s3://bucket/prefix, b2://bucket/prefix or sftp://user@host/path")
+			flags.StringVar(&c.BackupConsistency, "consistency", consistencyTransaction, "transaction (a consistent snapshot of innodb tables, without blocking), or lock (blocks writes until the data directory is archived as well)")
+			flags.StringVar(&c.BackupDataDirs, "data", "osr,avatars,osu", "subdirectories of the data directory to archive, comma separated, or empty for none")
+			flags.IntVar(&c.BackupCompression, "compression-level", gzip.DefaultCompression, "gzip level, from 1 (fastest) to 9 (smallest)")
+			flags.StringVar(&c.BackupKeyPath, "encryption-key", "", "encrypt the backup with the key in this file, 64 hex characters (e.g. from `openssl rand -hex 32`)")
+			flags.BoolVar(&c.BackupIncremental, "incremental", false, "only back up what's changed since the newest backup in --dir")
+			flags.IntVar(&c.BackupPartSize, "part-size", 16, "size in MiB of the parts large files are uploaded to s3 & b2 in, which are buffered in memory")
+			flags.StringVar(&c.BackupTags, "tags", "", "tags for the uploaded files, e.g. retention=monthly, which s3 lifecycle rules can match")
+			flags.IntVar(&c.BackupKeep, "keep", 7, "how many full backups to keep, with their increments, removing the oldest, 0 to keep every one")
+		},
+		Run: runBackup,
+	})
+}
@@ -0,0 +1,642 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// beatmaps refresh does what bancho.py does when a map's cached info
+// expires, for every map at once: each set whose last_osuapi_check is older
+// than --stale-after is looked up on the osu! api (or a mirror of it), and
+// its maps' status, md5, last_update, length, max combo, bpm, difficulty &
+// star rating are updated. maps which are frozen keep their status.
+// beatmaps daemon does so on a schedule, so the server rarely has to.
+//
+// bancho.py keeps maps it has looked up in memory, so a running server only
+// sees the new info once it restarts, or the map expires from its cache.
+// other services caching maps in redis can have their keys deleted with
+// --invalidate.
+
+const (
+	metaSourceV1        = "v1"         // old.ppy.sh, with OSU_API_KEY
+	metaSourceV2        = "v2"         // osu.ppy.sh, with OSU_CLIENT_ID & OSU_CLIENT_SECRET
+	metaSourceOsuDirect = "osu.direct" // bancho.py's fallback without an api key
+)
+
+// sets are written this many at a time, each in one transaction
+const metaFlushSets = 50
+
+// ApiBeatmap is a map as the osu! api describes it.
+type ApiBeatmap struct {
+	ID          int64
+	SetID       int64
+	MD5         string
+	Status      int // the api's status, see bpyStatus
+	LastUpdate  time.Time
+	TotalLength int
+	MaxCombo    int
+	Mode        int
+	BPM         float64
+	CS          float64
+	AR          float64
+	OD          float64
+	HP          float64
+	Diff        float64
+}
+
+// bpyStatus converts the api's ranked status into bancho.py's, as in
+// RankedStatus.from_osuapi.
+func bpyStatus(status int) int {
+	switch status {
+	case -2, -1, 0:
+		return 0 // pending
+	case 1:
+		return 2 // ranked
+	case 2:
+		return 3 // approved
+	case 3:
+		return 4 // qualified
+	case 4:
+		return 5 // loved
+	}
+	return 1 // update available
+}
+
+type metaMap struct {
+	ID         int64
+	SetID      int64 `db:"set_id"`
+	MD5        string
+	Status     int
+	Frozen     bool
+	LastUpdate time.Time `db:"last_update"`
+	MaxCombo   int       `db:"max_combo"`
+	Diff       float64
+}
+
+// BeatmapRefreshReport is the totals of a refresh.
+type BeatmapRefreshReport struct {
+	Sets        int     `json:"sets"`
+	Failed      int     `json:"failed"`
+	Missing     int     `json:"missing"` // sets the api doesn't know, e.g. deleted ones
+	Maps        int     `json:"maps"`
+	Changed     int     `json:"changed"`
+	Statuses    int     `json:"statuses"` // maps whose status changed
+	Outdated    []int64 `json:"outdated"` // maps whose md5 changed, so .data/osu needs a sync
+	Invalidated int     `json:"invalidated"`
+}
+
+// apiClient fetches sets from the configured source, no faster than --rate.
+type apiClient struct {
+	source  string
+	limiter *time.Ticker
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func newApiClient(source string, rate int) (*apiClient, error) {
+	switch source {
+	case "":
+		source = metaSourceOsuDirect
+		if cfg.OsuAPIKey != "" {
+			source = metaSourceV1
+		}
+	case metaSourceV1:
+		if cfg.OsuAPIKey == "" {
+			return nil, errors.New("--source v1 needs OSU_API_KEY")
+		}
+	case metaSourceV2:
+		if cfg.OsuClientID == "" || cfg.OsuClientSecret == "" {
+			return nil, errors.New("--source v2 needs OSU_CLIENT_ID & OSU_CLIENT_SECRET")
+		}
+	case metaSourceOsuDirect:
+	default:
+		return nil, fmt.Errorf("unknown --source %q, expected v1, v2 or osu.direct", source)
+	}
+	if rate <= 0 {
+		return nil, errors.New("--rate must be positive")
+	}
+	return &apiClient{source: source, limiter: time.NewTicker(time.Minute / time.Duration(rate))}, nil
+}
+
+// get fetches a url as json, retrying when the api is rate limiting or
+// erroring. a 404 isn't an error, but isn't found either.
+func (c *apiClient) get(url string, header http.Header, v interface{}) (found bool, err error) {
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-c.limiter.C:
+		case <-interrupted:
+			return false, errInterrupted
+		}
+
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return false, err
+		}
+		for k, values := range header {
+			req.Header[k] = values
+		}
+		req.Header.Set("User-Agent", "bancho.py-migrate")
+
+		resp, err := beatmapHTTP.Do(req)
+		if err == nil {
+			body, readErr := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			switch {
+			case readErr != nil:
+				err = readErr
+			case resp.StatusCode == http.StatusOK:
+				return true, json.Unmarshal(body, v)
+			case resp.StatusCode == http.StatusNotFound:
+				return false, nil
+			case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+				err = fmt.Errorf("%s returned %s", req.URL.Host, resp.Status)
+			default:
+				return false, fmt.Errorf("%s returned %s", req.URL.Host, resp.Status)
+			}
+		}
+
+		if attempt >= cfg.MaxRetries {
+			return false, err
+		}
+		select {
+		case <-time.After(retryDelay(attempt)):
+		case <-interrupted:
+			return false, errInterrupted
+		}
+	}
+}
+
+// v1Beatmap is a map from get_beatmaps, where every value is a string.
+type v1Beatmap struct {
+	BeatmapID   string  `json:"beatmap_id"`
+	SetID       string  `json:"beatmapset_id"`
+	Approved    string  `json:"approved"`
+	LastUpdate  string  `json:"last_update"`
+	TotalLength string  `json:"total_length"`
+	MaxCombo    *string `json:"max_combo"`
+	Mode        string  `json:"mode"`
+	BPM         *string `json:"bpm"`
+	CS          string  `json:"diff_size"`
+	OD          string  `json:"diff_overall"`
+	AR          string  `json:"diff_approach"`
+	HP          string  `json:"diff_drain"`
+	Diff        *string `json:"difficultyrating"`
+	FileMD5     string  `json:"file_md5"`
+}
+
+// v2Beatmapset is the part of /api/v2/beatmapsets/{id} which is used.
+type v2Beatmapset struct {
+	Beatmaps []struct {
+		ID          int64     `json:"id"`
+		SetID       int64     `json:"beatmapset_id"`
+		Checksum    string    `json:"checksum"`
+		Ranked      int       `json:"ranked"`
+		LastUpdated time.Time `json:"last_updated"`
+		TotalLength int       `json:"total_length"`
+		MaxCombo    int       `json:"max_combo"`
+		Mode        int       `json:"mode_int"`
+		BPM         float64   `json:"bpm"`
+		CS          float64   `json:"cs"`
+		AR          float64   `json:"ar"`
+		OD          float64   `json:"accuracy"`
+		HP          float64   `json:"drain"`
+		Diff        float64   `json:"difficulty_rating"`
+	} `json:"beatmaps"`
+}
+
+// fetchSet looks up a set's maps. a set the api doesn't know has none.
+func (c *apiClient) fetchSet(setID int64) ([]ApiBeatmap, error) {
+	if c.source == metaSourceV2 {
+		return c.fetchSetV2(setID)
+	}
+
+	query := url.Values{"s": {strconv.FormatInt(setID, 10)}}
+	endpoint := "https://osu.direct/api/get_beatmaps"
+	if c.source == metaSourceV1 {
+		endpoint = "https://old.ppy.sh/api/get_beatmaps"
+		query.Set("k", cfg.OsuAPIKey)
+	}
+	var maps []v1Beatmap
+	if _, err := c.get(endpoint+"?"+query.Encode(), nil, &maps); err != nil {
+		return nil, err
+	}
+
+	beatmaps := make([]ApiBeatmap, 0, len(maps))
+	for _, m := range maps {
+		var errs []error
+		integer := func(s string) int64 {
+			v, err := strconv.ParseInt(s, 10, 64)
+			errs = append(errs, err)
+			return v
+		}
+		float := func(s *string) float64 {
+			if s == nil {
+				return 0
+			}
+			v, err := strconv.ParseFloat(*s, 64)
+			errs = append(errs, err)
+			return v
+		}
+		b := ApiBeatmap{
+			ID:          integer(m.BeatmapID),
+			SetID:       integer(m.SetID),
+			MD5:         m.FileMD5,
+			Status:      int(integer(m.Approved)),
+			TotalLength: int(integer(m.TotalLength)),
+			MaxCombo:    int(float(m.MaxCombo)),
+			Mode:        int(integer(m.Mode)),
+			BPM:         float(m.BPM),
+			CS:          float(&m.CS),
+			AR:          float(&m.AR),
+			OD:          float(&m.OD),
+			HP:          float(&m.HP),
+			Diff:        float(m.Diff),
+		}
+		// the api's times are utc, as bancho.py stores them
+		var err error
+		b.LastUpdate, err = time.Parse("2006-01-02 15:04:05", m.LastUpdate)
+		errs = append(errs, err)
+		if err := errors.Join(errs...); err != nil {
+			return nil, fmt.Errorf("unexpected map %s from the api: %w", m.BeatmapID, err)
+		}
+		beatmaps = append(beatmaps, b)
+	}
+	return beatmaps, nil
+}
+
+func (c *apiClient) fetchSetV2(setID int64) ([]ApiBeatmap, error) {
+	token, err := c.accessToken()
+	if err != nil {
+		return nil, err
+	}
+	var set v2Beatmapset
+	found, err := c.get(fmt.Sprintf("https://osu.ppy.sh/api/v2/beatmapsets/%d", setID),
+		http.Header{"Authorization": {"Bearer " + token}}, &set)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	beatmaps := make([]ApiBeatmap, len(set.Beatmaps))
+	for i, m := range set.Beatmaps {
+		beatmaps[i] = ApiBeatmap{
+			ID:          m.ID,
+			SetID:       m.SetID,
+			MD5:         m.Checksum,
+			Status:      m.Ranked,
+			LastUpdate:  m.LastUpdated.UTC(),
+			TotalLength: m.TotalLength,
+			MaxCombo:    m.MaxCombo,
+			Mode:        m.Mode,
+			BPM:         m.BPM,
+			CS:          m.CS,
+			AR:          m.AR,
+			OD:          m.OD,
+			HP:          m.HP,
+			Diff:        m.Diff,
+		}
+	}
+	return beatmaps, nil
+}
+
+// accessToken returns a client credentials token for api v2, requesting a
+// new one when the last has (almost) expired.
+func (c *apiClient) accessToken() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Now().Before(c.expires) {
+		return c.token, nil
+	}
+
+	resp, err := beatmapHTTP.PostForm("https://osu.ppy.sh/oauth/token", url.Values{
+		"client_id":     {cfg.OsuClientID},
+		"client_secret": {cfg.OsuClientSecret},
+		"grant_type":    {"client_credentials"},
+		"scope":         {"public"},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to authenticate with the osu! api: %s", resp.Status)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	c.token = token.AccessToken
+	c.expires = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return c.token, nil
+}
+
+// staleSets lists the sets due a refresh, those never checked first.
+func staleSets() ([]int64, error) {
+	query := `
+	SELECT m.set_id FROM maps m
+	LEFT JOIN mapsets s ON s.server = m.server AND s.id = m.set_id
+	WHERE m.server = 'osu!' AND m.frozen = 0
+	AND (s.last_osuapi_check IS NULL OR s.last_osuapi_check < ?)`
+	if !cfg.MetaAll {
+		// ranked & approved maps don't change anymore
+		query += " AND m.status NOT IN (2, 3)"
+	}
+	query += " GROUP BY m.set_id ORDER BY MIN(s.last_osuapi_check), m.set_id"
+	if cfg.MetaLimit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", cfg.MetaLimit)
+	}
+
+	// last_osuapi_check is written in the server's local time
+	var sets []int64
+	err := DB.Select(&sets, query, wallClock(time.Now().Add(-cfg.MetaStaleAfter)))
+	return sets, err
+}
+
+// metaUpdate is a map's new info, and whether anything in it changed.
+type metaUpdate struct {
+	ApiBeatmap
+	Old     metaMap
+	Changed bool
+}
+
+// writeSets updates the maps of a few sets, and marks the sets as checked.
+func writeSets(sets []int64, updates []metaUpdate) error {
+	tx, err := DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, u := range updates {
+		if !u.Changed {
+			continue
+		}
+		_, err := tx.Exec(`
+		UPDATE maps SET status = IF(frozen, status, ?), md5 = ?, last_update = ?, total_length = ?,
+		max_combo = ?, bpm = ?, cs = ?, ar = ?, od = ?, hp = ?, diff = ?
+		WHERE server = 'osu!' AND id = ?`,
+			bpyStatus(u.Status), u.MD5, u.LastUpdate, u.TotalLength,
+			u.MaxCombo, u.BPM, u.CS, u.AR, u.OD, u.HP, u.Diff, u.ID)
+		if err != nil {
+			return fmt.Errorf("failed to update map %d: %w", u.ID, err)
+		}
+	}
+
+	checked := make([]interface{}, len(sets))
+	for i, id := range sets {
+		checked[i] = id
+	}
+	_, err = tx.Exec("INSERT INTO mapsets (server, id, last_osuapi_check) VALUES "+
+		placeholders(len(sets), 1, func(int) string { return "'osu!', ?, NOW()" })+
+		" ON DUPLICATE KEY UPDATE last_osuapi_check = NOW()", checked...)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// invalidateMaps deletes the redis keys of maps which changed, by both
+// their old & new md5.
+func invalidateMaps(updates []metaUpdate) (int, error) {
+	rc, err := dialRedis(cfg)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	keys := make(map[string]bool)
+	for _, u := range updates {
+		if !u.Changed {
+			continue
+		}
+		for _, template := range strings.Split(cfg.MetaInvalidate, ",") {
+			for _, md5 := range []string{u.Old.MD5, u.MD5} {
+				keys[strings.NewReplacer(
+					"{id}", strconv.FormatInt(u.ID, 10),
+					"{set_id}", strconv.FormatInt(u.SetID, 10),
+					"{md5}", md5,
+				).Replace(strings.TrimSpace(template))] = true
+			}
+		}
+	}
+	for key := range keys {
+		rc.Send("DEL", key)
+	}
+	_, err = rc.Flush(len(keys))
+	return len(keys), err
+}
+
+// refreshBeatmaps refreshes every stale set once.
+func refreshBeatmaps(client *apiClient) (*BeatmapRefreshReport, error) {
+	start := time.Now()
+	report := &BeatmapRefreshReport{Outdated: []int64{}}
+
+	sets, err := staleSets()
+	if err != nil {
+		return nil, err
+	}
+	report.Sets = len(sets)
+	logger.Info("refreshing beatmaps", "sets", len(sets), "source", client.source, "dry_run", cfg.DryRun)
+
+	var pending []int64
+	var updates []metaUpdate
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		if !cfg.DryRun {
+			if err := writeSets(pending, updates); err != nil {
+				return err
+			}
+			if cfg.MetaInvalidate != "" {
+				n, err := invalidateMaps(updates)
+				if err != nil {
+					logger.Warn("failed to invalidate cached maps", "err", err)
+				}
+				report.Invalidated += n
+			}
+		}
+		pending, updates = pending[:0], updates[:0]
+		return nil
+	}
+
+	for i := 0; i < len(sets); i += metaFlushSets {
+		end := i + metaFlushSets
+		if end > len(sets) {
+			end = len(sets)
+		}
+
+		query, args, err := sqlx.In(`SELECT id, set_id, md5, status, frozen, last_update, max_combo, diff
+		FROM maps WHERE server = 'osu!' AND set_id IN (?)`, sets[i:end])
+		if err != nil {
+			return nil, err
+		}
+		var known []metaMap
+		if err := DB.Select(&known, query, args...); err != nil {
+			return nil, err
+		}
+		current := make(map[int64]metaMap, len(known))
+		for _, m := range known {
+			current[m.ID] = m
+		}
+
+		for _, setID := range sets[i:end] {
+			if isInterrupted() {
+				return report, errInterrupted
+			}
+			beatmaps, err := client.fetchSet(setID)
+			if errors.Is(err, errInterrupted) {
+				return report, err
+			}
+			if err != nil {
+				logger.Warn("failed to fetch beatmap set", "set_id", setID, "err", err)
+				report.Failed++
+				continue
+			}
+			if len(beatmaps) == 0 {
+				// still marked as checked, so it isn't asked for again until it's stale
+				report.Missing++
+			}
+
+			for _, b := range beatmaps {
+				old, ok := current[b.ID]
+				if !ok {
+					// new difficulties are added by bancho.py once they're played
+					continue
+				}
+				status := bpyStatus(b.Status)
+				if old.Frozen {
+					status = old.Status
+				}
+				u := metaUpdate{ApiBeatmap: b, Old: old}
+				u.Changed = old.MD5 != b.MD5 || old.Status != status || !old.LastUpdate.Equal(b.LastUpdate) ||
+					old.MaxCombo != b.MaxCombo || old.Diff != b.Diff
+				report.Maps++
+				if u.Changed {
+					report.Changed++
+					if old.Status != status {
+						report.Statuses++
+						logger.Debug("map status changed", "id", b.ID, "from", old.Status, "to", status)
+					}
+					if old.MD5 != b.MD5 {
+						report.Outdated = append(report.Outdated, b.ID)
+					}
+				}
+				updates = append(updates, u)
+			}
+			pending = append(pending, setID)
+		}
+		if err := flush(); err != nil {
+			return report, err
+		}
+	}
+
+	logger.Info("refreshed beatmaps", "sets", report.Sets, "missing", report.Missing, "failed", report.Failed,
+		"maps", report.Maps, "changed", report.Changed, "statuses", report.Statuses,
+		"outdated", len(report.Outdated), "invalidated", report.Invalidated, "dry_run", cfg.DryRun,
+		"elapsed", time.Since(start).Round(time.Second))
+	if len(report.Outdated) != 0 && !cfg.DryRun {
+		logger.Info("some maps were updated, run beatmaps sync to download their new .osu files", "maps", len(report.Outdated))
+	}
+	return report, nil
+}
+
+func runBeatmapsRefresh() error {
+	client, err := newApiClient(cfg.MetaSource, cfg.MetaRate)
+	if err != nil {
+		return err
+	}
+	handleSignals()
+	report, err := refreshBeatmaps(client)
+	if err != nil {
+		return err
+	}
+	if err := writeReport(cfg.ReportPath, report); err != nil {
+		return err
+	}
+	if report.Failed != 0 {
+		return errors.New("some beatmap sets could not be refreshed")
+	}
+	return nil
+}
+
+func runBeatmapsDaemon() error {
+	schedule, err := parseSchedule(cfg.MetaSchedule)
+	if err != nil {
+		return err
+	}
+	client, err := newApiClient(cfg.MetaSource, cfg.MetaRate)
+	if err != nil {
+		return err
+	}
+
+	handleSignals()
+	for {
+		next := schedule.next(time.Now())
+		if next.IsZero() {
+			return fmt.Errorf("schedule %q never runs", cfg.MetaSchedule)
+		}
+		logger.Info("waiting for the next beatmap refresh", "at", next.Format(time.RFC3339))
+
+		select {
+		case <-time.After(time.Until(next)):
+		case <-interrupted:
+			return nil
+		}
+
+		// sets which failed are still stale, so they're retried next time
+		if _, err := refreshBeatmaps(client); errors.Is(err, errInterrupted) {
+			return nil
+		} else if err != nil {
+			logger.Error("failed to refresh beatmaps", "err", err)
+		}
+	}
+}
+
+func beatmapRefreshFlags(flags *flag.FlagSet, c *Config) {
+	flags.StringVar(&c.MetaSource, "source", "", "where to look maps up: v1 (needs OSU_API_KEY), v2 (needs OSU_CLIENT_ID & OSU_CLIENT_SECRET) or osu.direct (default: v1 with an api key, like bancho.py, otherwise osu.direct)")
+	flags.DurationVar(&c.MetaStaleAfter, "stale-after", 24*time.Hour, "refresh sets which haven't been checked for this long")
+	flags.BoolVar(&c.MetaAll, "all", false, "refresh ranked & approved sets as well")
+	flags.IntVar(&c.MetaLimit, "limit", 0, "refresh at most this many sets per run, 0 for all")
+	flags.IntVar(&c.MetaRate, "rate", 60, "api requests per minute")
+	flags.IntVar(&c.MaxRetries, "max-retries", 5, "times to retry a request when the api is rate limiting or erroring")
+	flags.StringVar(&c.MetaInvalidate, "invalidate", "", "redis keys to delete for changed maps, comma separated templates containing {id}, {set_id} or {md5}")
+	flags.BoolVar(&c.DryRun, "dry-run", false, "report which maps changed, without updating them")
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "beatmaps refresh",
+		Summary: "update stale maps' status, md5, star rating etc from the osu! api",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			beatmapRefreshFlags(flags, c)
+			flags.StringVar(&c.ReportPath, "report", "", "write the totals, and the maps whose md5 changed, as json to this path (- for stdout)")
+		},
+		Run: runBeatmapsRefresh,
+	})
+
+	registerCommand(&Command{
+		Name:    "beatmaps daemon",
+		Summary: "refresh stale maps from the osu! api on a schedule, until stopped",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			beatmapRefreshFlags(flags, c)
+			flags.StringVar(&c.MetaSchedule, "schedule", "*/15 * * * *", "when to refresh, as a cron expression")
+		},
+		Run: runBeatmapsDaemon,
+	})
+}
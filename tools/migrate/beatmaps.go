@@ -0,0 +1,304 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// beatmaps sync brings .data/osu in line with the maps table, so that pp
+// can be recalculated for every score: missing .osu files, and those which
+// don't match their map's md5 (i.e. from before the map was updated), are
+// downloaded from a mirror, and files of maps which aren't in the table are
+// removed. a download is only saved if its md5 matches the map's, so a
+// mirror serving a newer version of a map doesn't replace anything.
+//
+// only mirrors serving single .osu files by beatmap id can be used, so
+// those only serving whole sets as .osz (e.g. chimu) aren't supported.
+
+var beatmapMirrors = map[string]string{
+	"ppy":        "https://old.ppy.sh/osu/{id}", // as used by bancho.py
+	"osu.direct": "https://osu.direct/api/osu/{id}",
+	"catboy":     "https://catboy.best/osu/{id}",
+}
+
+var beatmapHTTP = &http.Client{Timeout: time.Minute}
+
+type syncMap struct {
+	ID     int64
+	MD5    string `db:"md5"`
+	Server string
+}
+
+// BeatmapSyncReport is the totals of a sync.
+type BeatmapSyncReport struct {
+	Maps           int64 `json:"maps"`
+	OK             int64 `json:"ok"`
+	Missing        int64 `json:"missing"`
+	Outdated       int64 `json:"outdated"`   // on disk, but not matching the map's md5
+	Downloaded     int64 `json:"downloaded"` // missing & outdated files which were fixed
+	MirrorMismatch int64 `json:"mirror_mismatch"`
+	Unavailable    int64 `json:"unavailable"` // private maps, or not on the mirror
+	Failed         int64 `json:"failed"`
+	Stale          int64 `json:"stale"` // files of maps which aren't in the table
+
+	MismatchedIDs []int64 `json:"mismatched_ids"`
+	mu            sync.Mutex
+}
+
+// mirrorURL returns the url of a map's .osu file on a mirror, by name or template.
+func mirrorURL(mirror string, id int64) (string, error) {
+	template, ok := beatmapMirrors[mirror]
+	if !ok {
+		if !strings.Contains(mirror, "{id}") {
+			return "", fmt.Errorf("unknown mirror %q, expected ppy, osu.direct, catboy or a url containing {id}", mirror)
+		}
+		template = mirror
+	}
+	return strings.ReplaceAll(template, "{id}", strconv.FormatInt(id, 10)), nil
+}
+
+func fileMD5(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+var errNotOnMirror = errors.New("the mirror doesn't have this map")
+
+// downloadBeatmap fetches a map's .osu file, retrying when the mirror is
+// rate limiting or erroring.
+func downloadBeatmap(id int64) ([]byte, error) {
+	url, err := mirrorURL(cfg.BeatmapMirror, id)
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("User-Agent", "bancho.py-migrate")
+
+		resp, err := beatmapHTTP.Do(req)
+		if err == nil {
+			body, readErr := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			switch {
+			case readErr != nil:
+				err = readErr
+			case resp.StatusCode == http.StatusOK && len(body) != 0:
+				return body, nil
+			case resp.StatusCode == http.StatusOK, resp.StatusCode == http.StatusNotFound:
+				// some mirrors answer 200 with an empty body for unknown maps
+				return nil, errNotOnMirror
+			case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+				err = fmt.Errorf("%s returned %s", url, resp.Status)
+			default:
+				return nil, fmt.Errorf("%s returned %s", url, resp.Status)
+			}
+		}
+
+		if attempt >= cfg.MaxRetries {
+			return nil, err
+		}
+		select {
+		case <-time.After(retryDelay(attempt)):
+		case <-interrupted:
+			return nil, errInterrupted
+		}
+	}
+}
+
+// writeBeatmap saves a .osu file, replacing any existing one atomically.
+func writeBeatmap(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// syncBeatmap checks a single map's .osu file, and downloads it if needed.
+func syncBeatmap(m syncMap, present bool, report *BeatmapSyncReport) {
+	path := filepath.Join(cfg.BeatmapDirectory(), fmt.Sprintf("%d.osu", m.ID))
+	if present {
+		sum, err := fileMD5(path)
+		if err != nil {
+			logger.Warn("failed to read beatmap", "id", m.ID, "err", err)
+			atomic.AddInt64(&report.Failed, 1)
+			return
+		}
+		if sum == m.MD5 {
+			atomic.AddInt64(&report.OK, 1)
+			return
+		}
+		atomic.AddInt64(&report.Outdated, 1)
+	} else {
+		atomic.AddInt64(&report.Missing, 1)
+	}
+
+	if m.Server == "private" {
+		atomic.AddInt64(&report.Unavailable, 1)
+		return
+	}
+	if cfg.DryRun {
+		return
+	}
+
+	data, err := downloadBeatmap(m.ID)
+	switch {
+	case errors.Is(err, errNotOnMirror):
+		atomic.AddInt64(&report.Unavailable, 1)
+		return
+	case err != nil:
+		logger.Warn("failed to download beatmap", "id", m.ID, "err", err)
+		atomic.AddInt64(&report.Failed, 1)
+		return
+	}
+
+	sum := md5.Sum(data)
+	if hex.EncodeToString(sum[:]) != m.MD5 {
+		logger.Debug("the mirror has another version of the map", "id", m.ID, "md5", m.MD5)
+		atomic.AddInt64(&report.MirrorMismatch, 1)
+		report.mu.Lock()
+		report.MismatchedIDs = append(report.MismatchedIDs, m.ID)
+		report.mu.Unlock()
+		return
+	}
+	if err := writeBeatmap(path, data); err != nil {
+		logger.Warn("failed to save beatmap", "id", m.ID, "err", err)
+		atomic.AddInt64(&report.Failed, 1)
+		return
+	}
+	atomic.AddInt64(&report.Downloaded, 1)
+}
+
+func runBeatmapsSync() error {
+	if _, err := mirrorURL(cfg.BeatmapMirror, 0); err != nil {
+		return err
+	}
+	dir := cfg.BeatmapDirectory()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	var maps []syncMap
+	if err := DB.Select(&maps, "SELECT id, md5, server FROM maps ORDER BY id"); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	files := make(map[int64]bool, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".osu") {
+			continue
+		}
+		if id, err := strconv.ParseInt(strings.TrimSuffix(name, ".osu"), 10, 64); err == nil {
+			files[id] = true
+		}
+	}
+
+	handleSignals()
+	start := time.Now()
+	report := &BeatmapSyncReport{Maps: int64(len(maps)), MismatchedIDs: []int64{}}
+	logger.Info("syncing beatmaps", "maps", len(maps), "files", len(files), "mirror", cfg.BeatmapMirror, "dry_run", cfg.DryRun)
+
+	workers := cfg.Workers
+	if workers == 0 {
+		workers = 4
+	}
+	queue := make(chan syncMap, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for m := range queue {
+				if !isInterrupted() {
+					syncBeatmap(m, files[m.ID], report)
+				}
+			}
+		}()
+	}
+
+	known := make(map[int64]bool, len(maps))
+	for _, m := range maps {
+		known[m.ID] = true
+		if isInterrupted() {
+			break
+		}
+		queue <- m
+	}
+	close(queue)
+	wg.Wait()
+	if isInterrupted() {
+		return errInterrupted
+	}
+
+	// anything left is the file of a map bancho.py doesn't know
+	for id := range files {
+		if known[id] {
+			continue
+		}
+		report.Stale++
+		if cfg.DryRun {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, fmt.Sprintf("%d.osu", id))); err != nil {
+			logger.Warn("failed to remove stale beatmap", "id", id, "err", err)
+		}
+	}
+
+	logger.Info("synced beatmaps", "maps", report.Maps, "ok", report.OK, "missing", report.Missing,
+		"outdated", report.Outdated, "downloaded", report.Downloaded, "mirror_mismatch", report.MirrorMismatch,
+		"unavailable", report.Unavailable, "failed", report.Failed, "stale", report.Stale,
+		"dry_run", cfg.DryRun, "elapsed", time.Since(start).Round(time.Second))
+	if err := writeReport(cfg.ReportPath, report); err != nil {
+		return err
+	}
+	if report.Failed != 0 {
+		return errors.New("some beatmaps could not be synced")
+	}
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:              "beatmaps sync",
+		Summary:           "download missing & outdated .osu files into .data/osu, and remove stale ones",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.BeatmapMirror, "mirror", "ppy", "where to download .osu files from: ppy, osu.direct, catboy, or a url containing {id}")
+			flags.IntVar(&c.Workers, "workers", 4, "number of concurrent downloads")
+			flags.IntVar(&c.MaxRetries, "max-retries", 5, "times to retry a download when the mirror is rate limiting or erroring")
+			flags.BoolVar(&c.DryRun, "dry-run", false, "report which files are missing, outdated or stale, without changing anything")
+			flags.StringVar(&c.ReportPath, "report", "", "write the totals, and the maps the mirror has another version of, as json to this path (- for stdout)")
+		},
+		Run: runBeatmapsSync,
+	})
+}
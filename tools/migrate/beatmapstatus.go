@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// beatmaps status sets the ranked status of many maps at once, as !map does
+// for one: from a csv of maps or sets & the statuses they should have, or
+// from the osu! api (--mirror), bringing the maps of some sets (by default,
+// every frozen one) back in line with their official status. maps are
+// frozen as they're changed, as !map does, so beatmaps refresh & bancho.py
+// keep the new status; --freeze=false leaves them to follow the api again.
+//
+// the csv has a header naming its columns: map_id, set_id or md5 for the
+// maps, status (a name, e.g. loved, or bancho.py's number), and optionally
+// frozen (0 or 1). later lines win, so a set can be loved with one line, and
+// one of its maps left ranked with another.
+//
+// once the maps are updated, their open map requests are closed, redis keys
+// given with --invalidate are deleted, and the #1s of maps whose status
+// changed are worked out again, if there's a first_places table. bancho.py
+// keeps maps it has looked up in memory, so it only sees the new statuses
+// once it's restarted, or the maps expire from its cache.
+
+// bancho.py's statuses, by the names osu! & its commands use
+var mapStatusNames = map[string]int{
+	"pending": 0, "unranked": 0, "graveyard": 0, "wip": 0,
+	"update_available": 1, "outdated": 1,
+	"ranked": 2, "approved": 3, "qualified": 4, "loved": 5,
+}
+
+// mapStatusLabels are the statuses' names, by number
+var mapStatusLabels = []string{"pending", "update_available", "ranked", "approved", "qualified", "loved"}
+
+// parseMapStatus reads a status as a name or number.
+func parseMapStatus(s string) (int, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if status, ok := mapStatusNames[s]; ok {
+		return status, nil
+	}
+	if status, err := strconv.Atoi(s); err == nil && status >= 0 && status <= 5 {
+		return status, nil
+	}
+	return 0, fmt.Errorf("unknown status %q", s)
+}
+
+// statusTarget is the status a line of the csv, or the api, gives maps.
+type statusTarget struct {
+	column string // map_id, set_id or md5
+	value  string
+	status int
+	frozen bool
+}
+
+// BeatmapStatusChange is a map whose status, or whether it's frozen, changed.
+type BeatmapStatusChange struct {
+	MapID     int64  `json:"map_id" db:"id"`
+	SetID     int64  `json:"set_id" db:"set_id"`
+	MD5       string `json:"md5" db:"md5"`
+	OldStatus int    `json:"old_status" db:"status"`
+	NewStatus int    `json:"new_status"`
+	OldFrozen bool   `json:"old_frozen" db:"frozen"`
+	NewFrozen bool   `json:"new_frozen"`
+}
+
+// BeatmapStatusReport is what beatmaps status changed.
+type BeatmapStatusReport struct {
+	Changes     []*BeatmapStatusChange `json:"changes"`
+	Unknown     []string               `json:"unknown"` // maps & sets which aren't in the maps table
+	Requests    int64                  `json:"requests_closed"`
+	Invalidated int                    `json:"invalidated"`
+	FirstPlaces []FirstPlaceChange     `json:"first_places"`
+}
+
+// readStatusCSV reads the maps & statuses to set from a csv.
+func readStatusCSV(path string) ([]statusTarget, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(records) < 2 {
+		return nil, fmt.Errorf("%s: expected a header, then a line per map or set", path)
+	}
+
+	columns := map[string]int{}
+	for i, name := range records[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	key := ""
+	for _, name := range []string{"map_id", "set_id", "md5"} {
+		if _, ok := columns[name]; ok {
+			key = name
+			break
+		}
+	}
+	if _, ok := columns["status"]; !ok || key == "" {
+		return nil, fmt.Errorf("%s: the header must name a status column, and a map_id, set_id or md5 column", path)
+	}
+
+	targets := make([]statusTarget, 0, len(records)-1)
+	for i, record := range records[1:] {
+		t := statusTarget{column: key, frozen: cfg.StatusFreeze}
+		// a line can name a set or map, whichever it has
+		for _, name := range []string{"map_id", "set_id", "md5"} {
+			if c, ok := columns[name]; ok && strings.TrimSpace(record[c]) != "" {
+				t.column, t.value = name, strings.TrimSpace(record[c])
+				break
+			}
+		}
+		if t.value == "" {
+			return nil, fmt.Errorf("%s:%d: no map_id, set_id or md5", path, i+2)
+		}
+		if t.column != "md5" {
+			if _, err := strconv.ParseInt(t.value, 10, 64); err != nil {
+				return nil, fmt.Errorf("%s:%d: %s must be a number", path, i+2, t.column)
+			}
+		}
+		if t.status, err = parseMapStatus(record[columns["status"]]); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, i+2, err)
+		}
+		if c, ok := columns["frozen"]; ok && strings.TrimSpace(record[c]) != "" {
+			if t.frozen, err = strconv.ParseBool(strings.TrimSpace(record[c])); err != nil {
+				return nil, fmt.Errorf("%s:%d: frozen must be 0 or 1", path, i+2)
+			}
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// mirrorStatuses looks the sets up on the api, for their maps' official
+// statuses. without --sets, every set with a frozen map is looked up.
+func mirrorStatuses(client *apiClient) ([]statusTarget, error) {
+	var sets []int64
+	if cfg.StatusSets != "" {
+		for _, set := range strings.Split(cfg.StatusSets, ",") {
+			id, err := strconv.ParseInt(strings.TrimSpace(set), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("--sets must be a list of set ids, not %q", set)
+			}
+			sets = append(sets, id)
+		}
+	} else if err := DB.Select(&sets, "SELECT DISTINCT set_id FROM maps WHERE server = 'osu!' AND frozen = 1 ORDER BY set_id"); err != nil {
+		return nil, err
+	}
+	logger.Info("looking sets up", "sets", len(sets), "source", client.source)
+
+	var targets []statusTarget
+	for i, set := range sets {
+		if isInterrupted() {
+			return nil, errInterrupted
+		}
+		maps, err := client.fetchSet(set)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look set %d up: %w", set, err)
+		}
+		for _, m := range maps {
+			targets = append(targets, statusTarget{column: "map_id", value: strconv.FormatInt(m.ID, 10),
+				status: bpyStatus(m.Status), frozen: cfg.StatusFreeze})
+		}
+		if (i+1)%100 == 0 {
+			logger.Info("looking sets up", "done", i+1, "sets", len(sets))
+		}
+	}
+	return targets, nil
+}
+
+// diffStatuses finds the maps whose status or freeze the targets change.
+func diffStatuses(targets []statusTarget, report *BeatmapStatusReport) error {
+	values := map[string][]string{}
+	for _, t := range targets {
+		values[t.column] = append(values[t.column], t.value)
+	}
+	maps := map[int64]*BeatmapStatusChange{}
+	var order []int64
+	byKey := map[string][]*BeatmapStatusChange{}
+	for column, vs := range values {
+		for start := 0; start < len(vs); start += BatchSize {
+			query, args, err := sqlx.In(fmt.Sprintf("SELECT id, set_id, md5, status, frozen FROM maps WHERE %s IN (?)",
+				strings.Replace(column, "map_id", "id", 1)), vs[start:min(start+BatchSize, len(vs))])
+			if err != nil {
+				return err
+			}
+			var rows []*BeatmapStatusChange
+			if err := DB.Select(&rows, query, args...); err != nil {
+				return err
+			}
+			for _, m := range rows {
+				if maps[m.MapID] == nil {
+					maps[m.MapID] = m
+					order = append(order, m.MapID)
+				}
+				m = maps[m.MapID]
+				var key string
+				switch column {
+				case "map_id":
+					key = strconv.FormatInt(m.MapID, 10)
+				case "set_id":
+					key = strconv.FormatInt(m.SetID, 10)
+				default:
+					key = m.MD5
+				}
+				byKey[column+":"+key] = append(byKey[column+":"+key], m)
+			}
+		}
+	}
+
+	targeted := map[int64]bool{}
+	for _, t := range targets {
+		matched := byKey[t.column+":"+t.value]
+		if len(matched) == 0 {
+			report.Unknown = append(report.Unknown, t.column+" "+t.value)
+		}
+		for _, m := range matched {
+			m.NewStatus, m.NewFrozen = t.status, t.frozen
+			targeted[m.MapID] = true
+		}
+	}
+	sort.Slice(order, func(i, j int) bool { return order[i] < order[j] })
+	for _, id := range order {
+		m := maps[id]
+		if targeted[id] && (m.NewStatus != m.OldStatus || m.NewFrozen != m.OldFrozen) {
+			report.Changes = append(report.Changes, m)
+		}
+	}
+	return nil
+}
+
+// applyStatuses updates the maps, and closes their requests, in one
+// transaction.
+func applyStatuses(changes []*BeatmapStatusChange) (int64, error) {
+	type group struct {
+		status int
+		frozen bool
+	}
+	groups := map[group][]int64{}
+	var changed []int64
+	for _, c := range changes {
+		g := group{c.NewStatus, c.NewFrozen}
+		groups[g] = append(groups[g], c.MapID)
+		if c.NewStatus != c.OldStatus {
+			changed = append(changed, c.MapID)
+		}
+	}
+	requests, err := tableExists("map_requests")
+	if err != nil {
+		return 0, err
+	}
+
+	if err := throttle(len(changes) + len(changed)); err != nil {
+		return 0, err
+	}
+	tx, err := DB.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	for g, ids := range groups {
+		for start := 0; start < len(ids); start += BatchSize {
+			query, args, err := sqlx.In("UPDATE maps SET status = ?, frozen = ? WHERE id IN (?)",
+				g.status, g.frozen, ids[start:min(start+BatchSize, len(ids))])
+			if err != nil {
+				return 0, err
+			}
+			if _, err := tx.Exec(query, args...); err != nil {
+				return 0, err
+			}
+		}
+	}
+	var closed int64
+	for start := 0; requests && start < len(changed); start += BatchSize {
+		query, args, err := sqlx.In("UPDATE map_requests SET active = 0 WHERE active = 1 AND map_id IN (?)",
+			changed[start:min(start+BatchSize, len(changed))])
+		if err != nil {
+			return 0, err
+		}
+		res, err := tx.Exec(query, args...)
+		if err != nil {
+			return 0, err
+		}
+		n, _ := res.RowsAffected()
+		closed += n
+	}
+	return closed, tx.Commit()
+}
+
+// rebuildChangedFirstPlaces works out the #1s of maps whose status changed,
+// in every mode.
+func rebuildChangedFirstPlaces(changes []*BeatmapStatusChange) ([]FirstPlaceChange, error) {
+	var md5s []string
+	for _, c := range changes {
+		if c.NewStatus != c.OldStatus {
+			md5s = append(md5s, c.MD5)
+		}
+	}
+	modes := make([]int, 0, len(statsModes))
+	for mode := range statsModes {
+		modes = append(modes, mode)
+	}
+	sort.Ints(modes)
+
+	firsts := []FirstPlaceChange{}
+	for start := 0; start < len(md5s); start += BatchSize {
+		for _, mode := range modes {
+			changed, err := rebuildFirstPlaces(mode, md5s[start:min(start+BatchSize, len(md5s))])
+			if err != nil {
+				return firsts, err
+			}
+			firsts = append(firsts, changed...)
+		}
+	}
+	return firsts, nil
+}
+
+func runBeatmapsStatus() error {
+	if (cfg.StatusCSV == "") == (cfg.StatusMirror == "") {
+		return errors.New("expected either --csv or --mirror, for the statuses to set")
+	}
+	if cfg.StatusSets != "" && cfg.StatusMirror == "" {
+		return errors.New("--sets is only for --mirror")
+	}
+
+	handleSignals()
+	var targets []statusTarget
+	var err error
+	if cfg.StatusCSV != "" {
+		targets, err = readStatusCSV(cfg.StatusCSV)
+	} else {
+		var client *apiClient
+		if client, err = newApiClient(cfg.StatusMirror, cfg.MetaRate); err == nil {
+			targets, err = mirrorStatuses(client)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	report := &BeatmapStatusReport{Changes: []*BeatmapStatusChange{}, Unknown: []string{}, FirstPlaces: []FirstPlaceChange{}}
+	if err := diffStatuses(targets, report); err != nil {
+		return err
+	}
+
+	// e.g. "ranked -> loved: 12 maps"
+	transitions := map[string]int{}
+	frozen := 0
+	for _, c := range report.Changes {
+		if c.NewStatus != c.OldStatus {
+			transitions[enumName(mapStatusLabels, c.OldStatus)+" -> "+enumName(mapStatusLabels, c.NewStatus)]++
+		} else {
+			frozen++
+		}
+	}
+	names := make([]string, 0, len(transitions))
+	for name := range transitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Printf("%d maps change\n", len(report.Changes))
+	for _, name := range names {
+		fmt.Printf("  %-30s %d maps\n", name, transitions[name])
+	}
+	if frozen != 0 {
+		fmt.Printf("  %d maps only have whether they're frozen changed\n", frozen)
+	}
+	for _, unknown := range report.Unknown[:min(len(report.Unknown), maxExamples)] {
+		fmt.Printf("  not in the maps table: %s\n", unknown)
+	}
+	if len(report.Unknown) > maxExamples {
+		fmt.Printf("  ... and %d more not in the maps table\n", len(report.Unknown)-maxExamples)
+	}
+
+	if cfg.DryRun || len(report.Changes) == 0 {
+		return writeReport(cfg.ReportPath, report)
+	}
+	if !confirm(fmt.Sprintf("Change the status of %d maps?", len(report.Changes))) {
+		return errors.New("not changing any statuses")
+	}
+
+	if report.Requests, err = applyStatuses(report.Changes); err != nil {
+		return fmt.Errorf("failed to update the maps: %w", err)
+	}
+	logger.Info("updated maps", "maps", len(report.Changes), "requests_closed", report.Requests)
+
+	if cfg.MetaInvalidate != "" {
+		updates := make([]metaUpdate, len(report.Changes))
+		for i, c := range report.Changes {
+			updates[i] = metaUpdate{ApiBeatmap: ApiBeatmap{ID: c.MapID, SetID: c.SetID, MD5: c.MD5},
+				Old: metaMap{MD5: c.MD5}, Changed: true}
+		}
+		if report.Invalidated, err = invalidateMaps(updates); err != nil {
+			logger.Warn("failed to invalidate cached maps", "err", err)
+		}
+	}
+
+	if exists, err := tableExists("first_places"); err != nil {
+		return err
+	} else if exists && cfg.StatusFirstPlaces {
+		if report.FirstPlaces, err = rebuildChangedFirstPlaces(report.Changes); err != nil {
+			return fmt.Errorf("failed to rebuild the maps' first places: %w", err)
+		}
+		logger.Info("rebuilt first places", "changed", len(report.FirstPlaces))
+	}
+
+	if err := writeReport(cfg.ReportPath, report); err != nil {
+		return err
+	}
+	logger.Info("changed map statuses, run recalc stats for players' pp to follow them", "maps", len(report.Changes),
+		"elapsed", time.Since(start).Round(time.Second))
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "beatmaps status",
+		Summary: "bulk set maps' ranked status from a csv or the osu! api, freezing them, then fix caches & first places",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.StatusCSV, "csv", "", "csv of maps (map_id, set_id or md5) & the status to give them, with a header")
+			flags.StringVar(&c.StatusMirror, "mirror", "", "set maps to their official status from the api instead: v1 (needs OSU_API_KEY), v2 (needs OSU_CLIENT_ID & OSU_CLIENT_SECRET) or osu.direct")
+			flags.StringVar(&c.StatusSets, "sets", "", "with --mirror, comma separated ids of the sets to look up (default: every set with a frozen map)")
+			flags.IntVar(&c.MetaRate, "rate", 60, "api requests per minute, with --mirror")
+			flags.IntVar(&c.MaxRetries, "max-retries", 5, "times to retry a request when the api is rate limiting or erroring")
+			flags.BoolVar(&c.StatusFreeze, "freeze", true, "freeze the maps changed, so their status isn't refreshed from the api (the csv's frozen column overrides it)")
+			flags.BoolVar(&c.StatusFirstPlaces, "first-places", true, "rebuild the first places of maps whose status changed, if there's a first_places table")
+			flags.StringVar(&c.MetaInvalidate, "invalidate", "", "redis keys to delete for changed maps, comma separated templates containing {id}, {set_id} or {md5}")
+			flags.StringVar(&c.ReportPath, "report", "", "write the maps changed, and first places which changed hands, as json to this path (- for stdout)")
+			flags.BoolVar(&c.DryRun, "dry-run", false, "list what would change without changing anything")
+		},
+		Run: runBeatmapsStatus,
+	})
+}
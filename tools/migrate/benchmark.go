@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// up --benchmark times the score migration before the real run, which can
+// take hours on big servers. a sample of each old table's rows is read into
+// memory, then inserted into the new (temporarily created) tables, once for
+// each combination of --benchmark-workers & --benchmark-commit-every, going
+// through the same workers, transactions & retries as the migration. the
+// fastest combination is recommended, along with how long the full run
+// would take with it.
+//
+// the sample is spread across each table, in pages, and replays aren't
+// moved, so the estimate leaves out moving them. the new tables, & the
+// migration's bookkeeping tables, are dropped afterwards, so they mustn't
+// exist beforehand.
+
+// benchmarking is set while the benchmark runs, so replays aren't moved.
+var benchmarking bool
+
+// the smallest sample the benchmark takes, unless the tables are smaller
+const minBenchmarkRows = 10000
+
+// BenchmarkResult is the throughput of one combination.
+type BenchmarkResult struct {
+	Workers     int
+	CommitEvery int
+	Rows        int64
+	Failed      int64
+	Elapsed     time.Duration
+}
+
+func (r BenchmarkResult) rate() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Rows) / r.Elapsed.Seconds()
+}
+
+// estimate is how long inserting rows would take at the same rate.
+func (r BenchmarkResult) estimate(rows int64) string {
+	if r.rate() == 0 {
+		return "-"
+	}
+	return time.Duration(float64(rows) / r.rate() * float64(time.Second)).Round(time.Second).String()
+}
+
+// parseSizes reads a comma separated list of positive numbers.
+func parseSizes(name, value string) ([]int, error) {
+	var sizes []int
+	for _, s := range strings.Split(value, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("--%s %q must be positive numbers, comma separated", name, value)
+		}
+		sizes = append(sizes, n)
+	}
+	if len(sizes) == 0 {
+		return nil, fmt.Errorf("--%s must list at least one size", name)
+	}
+	return sizes, nil
+}
+
+// sampleScores reads a sample of a table's rows, a page at a time from
+// evenly spaced ids, so that it's spread across the table's history.
+func sampleScores(table SourceTable, n int64) ([]Score, error) {
+	var bounds struct {
+		Min int64 `db:"min_id"`
+		Max int64 `db:"max_id"`
+	}
+	err := DB.Get(&bounds, fmt.Sprintf("SELECT COALESCE(MIN(id), 0) AS min_id, COALESCE(MAX(id), 0) AS max_id FROM %s", table.Name))
+	if err != nil || n == 0 {
+		return nil, err
+	}
+
+	pages := (n + BatchSize - 1) / BatchSize
+	span := bounds.Max - bounds.Min + 1
+	scores := make([]Score, 0, n)
+	for page := int64(0); page < pages && int64(len(scores)) < n; page++ {
+		after := bounds.Min - 1 + page*span/pages
+		if len(scores) != 0 && after < scores[len(scores)-1].ID {
+			after = scores[len(scores)-1].ID
+		}
+		limit := n - int64(len(scores))
+		if limit > BatchSize {
+			limit = BatchSize
+		}
+
+		var rows []Score
+		if err := DB.Select(&rows, table.selectQuery(), after, limit); err != nil {
+			return nil, err
+		}
+		for _, score := range rows {
+			if scoreFilter.match(table, score) {
+				scores = append(scores, score)
+			}
+		}
+	}
+	return scores, nil
+}
+
+// benchmarkRun inserts the sample with a number of workers & commit size,
+// into the emptied new tables.
+func benchmarkRun(tables []SourceTable, samples map[string][]Score, workers, commitEvery, batchSize int) (BenchmarkResult, error) {
+	result := BenchmarkResult{Workers: workers, CommitEvery: commitEvery}
+	for _, table := range []string{"scores", "migration_score_ids"} {
+		if _, err := DB.Exec("truncate table " + table); err != nil {
+			return result, err
+		}
+	}
+	scoreIDs.Lock()
+	scoreIDs.next = 0
+	scoreIDs.Unlock()
+
+	NumWorkers = workers
+	DB.SetMaxOpenConns(workers + 1)
+	DB.SetMaxIdleConns(workers + 1)
+	cfg.CommitEvery, cfg.ChunkSize = commitEvery, commitEvery
+	cfg.BatchSize = batchSize
+	if cfg.BatchSize > commitEvery {
+		cfg.BatchSize = commitEvery
+	}
+	progress = newProgress(tables, workers)
+
+	batches := make(chan ScoreBatch, workers)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for batch := range batches {
+				if !isInterrupted() {
+					migrateBatch(batch, worker)
+				}
+			}
+		}(i)
+	}
+	for _, table := range tables {
+		scores := samples[table.Name]
+		for seq := 0; len(scores) != 0 && !isInterrupted(); seq++ {
+			n := commitEvery
+			if n > len(scores) {
+				n = len(scores)
+			}
+			batches <- ScoreBatch{Table: table, Seq: seq, Scores: scores[:n]}
+			scores = scores[n:]
+		}
+	}
+	close(batches)
+	wg.Wait()
+	result.Elapsed = time.Since(start)
+
+	if isInterrupted() {
+		return result, errInterrupted
+	}
+	_, _, result.Rows, result.Failed, _ = progress.totals()
+	return result, nil
+}
+
+func runBenchmark(tables []SourceTable) error {
+	if cfg.BenchmarkSample <= 0 || cfg.BenchmarkSample > 100 {
+		return fmt.Errorf("--benchmark-sample %g must be a percentage, above 0 and up to 100", cfg.BenchmarkSample)
+	}
+	commitSizes, err := parseSizes("benchmark-commit-every", cfg.BenchmarkCommitEvery)
+	if err != nil {
+		return err
+	}
+	free, _, err := freeConnections()
+	if err != nil {
+		return err
+	}
+	var workerCounts []int
+	if cfg.BenchmarkWorkers != "" {
+		if workerCounts, err = parseSizes("benchmark-workers", cfg.BenchmarkWorkers); err != nil {
+			return err
+		}
+	} else {
+		for n := 1; n <= maxAutoWorkers && n <= free; n *= 2 {
+			workerCounts = append(workerCounts, n)
+		}
+		if len(workerCounts) == 0 {
+			workerCounts = []int{1}
+		}
+	}
+
+	for _, table := range []string{"scores", "migration_score_ids", "migration_checkpoints"} {
+		exists, err := tableExists(table)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return fmt.Errorf("the %s table already exists, so the migration has already started, and can't be benchmarked", table)
+		}
+	}
+	if err := checkInsertMode(); err != nil {
+		return err
+	}
+	if err := tuneBatching(); err != nil {
+		return err
+	}
+	batchSize := cfg.BatchSize
+	if err := setupScoreFilter(); err != nil {
+		return err
+	}
+	handleSignals()
+
+	// the sample, a percentage of each table, and at least a few pages
+	samples := map[string][]Score{}
+	var total, sampled int64
+	for _, table := range tables {
+		var count int64
+		if err := DB.Get(&count, fmt.Sprintf("SELECT COUNT(*) FROM %s", table.Name)); err != nil {
+			return err
+		}
+		n := int64(math.Ceil(float64(count) * cfg.BenchmarkSample / 100))
+		if n < minBenchmarkRows {
+			n = minBenchmarkRows
+		}
+		if n > count {
+			n = count
+		}
+		scores, err := sampleScores(table, n)
+		if err != nil {
+			return fmt.Errorf("failed to sample %s: %w", table.Name, err)
+		}
+		samples[table.Name] = scores
+		total += count
+		sampled += int64(len(scores))
+		logger.Info("sampled table", "table", table.Name, "rows", count, "sampled", len(scores))
+	}
+	if sampled == 0 {
+		return fmt.Errorf("there are no scores to benchmark with")
+	}
+
+	// the new tables only exist while benchmarking
+	if err := createCheckpointTables(); err != nil {
+		return err
+	}
+	defer dropCheckpointTables()
+	if _, err := DB.Exec(create_scores); err != nil {
+		return err
+	}
+	defer DB.MustExec("drop table if exists scores")
+
+	benchmarking = true
+	defer func() { benchmarking = false }()
+	deadLetters = nil
+
+	var results []BenchmarkResult
+	for _, workers := range workerCounts {
+		for _, commitEvery := range commitSizes {
+			result, err := benchmarkRun(tables, samples, workers, commitEvery, batchSize)
+			if err != nil {
+				return err
+			}
+			logger.Info("benchmarked", "workers", workers, "commit_every", commitEvery, "rows", result.Rows,
+				"failed", result.Failed, "elapsed", result.Elapsed.Round(time.Millisecond), "rows_per_second", int64(result.rate()))
+			results = append(results, result)
+		}
+	}
+
+	fmt.Printf("\nInserted %d of %d rows (%.2g%%) with --insert-mode %s:\n\n", sampled, total, 100*float64(sampled)/float64(total), cfg.InsertMode)
+	fmt.Printf("%8s %13s %10s %12s %12s\n", "workers", "commit-every", "rows/s", "elapsed", "full run")
+	for _, r := range results {
+		fmt.Printf("%8d %13d %10d %12s %12s\n", r.Workers, r.CommitEvery, int64(r.rate()),
+			r.Elapsed.Round(time.Millisecond), r.estimate(total))
+	}
+
+	sort.SliceStable(results, func(i, j int) bool { return results[i].rate() > results[j].rate() })
+	best := results[0]
+	fmt.Printf("\nRecommended: --workers %d --commit-every %d --insert-mode %s\n", best.Workers, best.CommitEvery, cfg.InsertMode)
+	fmt.Printf("which would insert the %d rows in about %s, plus the time to move their replays and build the indexes.\n",
+		total, best.estimate(total))
+	if best.Failed != 0 {
+		logger.Warn("some rows failed to insert while benchmarking, and would be dead lettered by the migration", "failed", best.Failed)
+	}
+	if cfg.InsertMode == insertModeRow {
+		fmt.Println("(--insert-mode multirow or infile are usually much faster, and can be benchmarked too)")
+	}
+	return nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bancho.py ranks players with redis sorted sets of pp, per mode, globally
+// (bancho:leaderboard:<mode>) and per country (bancho:leaderboard:<mode>:<country>).
+// they're only updated as scores are submitted, so after redis loses its
+// data, or moves, players have no rank until they next submit a score.
+// cache rebuild repopulates them all from the stats table.
+//
+// leaderboards rebuild does the same, and with --scope, only the global or
+// only the country leaderboards. each is replaced whole, so players whose
+// country changed move to their new country's, and restricted or deleted
+// players are dropped; how many of each were found is logged, as that's
+// how far the leaderboards had drifted.
+
+const leaderboardKeyPrefix = "bancho:leaderboard:"
+
+// each leaderboard is written under this prefix, then renamed into place,
+// so that ranks never disappear while they're being rebuilt
+const rebuildKeyPrefix = "bancho:leaderboard_rebuild:"
+
+// how many players are added per ZADD, and commands sent per pipeline
+const (
+	zaddChunkSize     = 1000
+	redisPipelineSize = 100
+)
+
+// restricted players are left off of the leaderboards, as in bancho.py
+var select_leaderboard_stats = `
+SELECT st.id, st.mode, st.pp, u.country
+FROM stats st JOIN users u ON u.id = st.id
+WHERE u.priv & 1 AND st.pp > 0 %s`
+
+type leaderboardEntry struct {
+	ID      int64
+	Mode    int
+	PP      int64
+	Country string
+}
+
+type leaderboardMember struct {
+	id int64
+	pp int64
+}
+
+// leaderboardMode parses the mode out of a leaderboard's key.
+func leaderboardMode(key string) (int, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(key, leaderboardKeyPrefix), ":", 2)
+	mode, err := strconv.Atoi(parts[0])
+	return mode, err == nil
+}
+
+// inLeaderboardScope reports whether a leaderboard is one of --scope's.
+func inLeaderboardScope(key string) bool {
+	country := strings.Contains(strings.TrimPrefix(key, leaderboardKeyPrefix), ":")
+	switch cfg.LeaderboardScope {
+	case "global":
+		return !country
+	case "country":
+		return country
+	}
+	return true
+}
+
+// leaderboardDrift counts the players on the leaderboards in redis who
+// shouldn't be: those who moved to another country's, and those who are
+// on none (restricted, deleted, or without pp).
+func leaderboardDrift(rc *RedisConn, keys []string, rebuilt map[string][]leaderboardMember, entries []leaderboardEntry) (int, int, error) {
+	ranked := make(map[[2]int64]bool, len(entries))
+	for _, entry := range entries {
+		ranked[[2]int64{int64(entry.Mode), entry.ID}] = true
+	}
+
+	moved, purged := 0, 0
+	for _, key := range keys {
+		reply, err := rc.Do("ZRANGE", key, "0", "-1")
+		if err != nil {
+			return 0, 0, err
+		}
+		current, ok := reply.([]interface{})
+		if !ok {
+			return 0, 0, fmt.Errorf("redis: unexpected ZRANGE reply %v", reply)
+		}
+		kept := make(map[int64]bool, len(rebuilt[key]))
+		for _, member := range rebuilt[key] {
+			kept[member.id] = true
+		}
+		mode, _ := leaderboardMode(key)
+		for _, member := range current {
+			name, _ := member.(string)
+			id, err := strconv.ParseInt(name, 10, 64)
+			if err != nil || kept[id] {
+				continue
+			}
+			if ranked[[2]int64{int64(mode), id}] {
+				moved++
+			} else {
+				purged++
+			}
+		}
+	}
+	return moved, purged, nil
+}
+
+// writeLeaderboard replaces a leaderboard's members in one pipeline, which
+// is renamed over the old leaderboard at the end.
+func writeLeaderboard(rc *RedisConn, key string, members []leaderboardMember) error {
+	tmp := rebuildKeyPrefix + strings.TrimPrefix(key, leaderboardKeyPrefix)
+
+	rc.Send("DEL", tmp)
+	pending := 1
+	for start := 0; start < len(members); start += zaddChunkSize {
+		end := start + zaddChunkSize
+		if end > len(members) {
+			end = len(members)
+		}
+
+		args := make([]string, 0, 2+2*(end-start))
+		args = append(args, "ZADD", tmp)
+		for _, member := range members[start:end] {
+			args = append(args, strconv.FormatInt(member.pp, 10), strconv.FormatInt(member.id, 10))
+		}
+		rc.Send(args...)
+
+		if pending++; pending >= redisPipelineSize {
+			if _, err := rc.Flush(pending); err != nil {
+				return err
+			}
+			pending = 0
+		}
+	}
+	rc.Send("RENAME", tmp, key)
+	_, err := rc.Flush(pending + 1)
+	return err
+}
+
+// scanLeaderboards lists the leaderboards in redis, of every mode & country.
+func scanLeaderboards(rc *RedisConn) ([]string, error) {
+	var leaderboards []string
+	cursor := "0"
+	for {
+		reply, err := rc.Do("SCAN", cursor, "MATCH", leaderboardKeyPrefix+"*", "COUNT", "1000")
+		if err != nil {
+			return nil, err
+		}
+		page, ok := reply.([]interface{})
+		if !ok || len(page) != 2 {
+			return nil, fmt.Errorf("redis: unexpected SCAN reply %v", reply)
+		}
+		keys, _ := page[1].([]interface{})
+		for _, key := range keys {
+			key, _ := key.(string)
+			leaderboards = append(leaderboards, key)
+		}
+
+		if cursor, _ = page[0].(string); cursor == "0" {
+			return leaderboards, nil
+		}
+	}
+}
+
+// staleLeaderboards finds the leaderboards in redis which weren't rebuilt,
+// such as countries whose players have all been restricted.
+func staleLeaderboards(rc *RedisConn, rebuilt map[string][]leaderboardMember, modes map[int]bool) ([]string, error) {
+	keys, err := scanLeaderboards(rc)
+	if err != nil {
+		return nil, err
+	}
+	var stale []string
+	for _, key := range keys {
+		if mode, ok := leaderboardMode(key); ok && modes[mode] && rebuilt[key] == nil && inLeaderboardScope(key) {
+			stale = append(stale, key)
+		}
+	}
+	return stale, nil
+}
+
+func runCacheRebuild() error {
+	if cfg.LeaderboardScope != "all" && cfg.LeaderboardScope != "global" && cfg.LeaderboardScope != "country" {
+		return fmt.Errorf("unknown --scope %q, expected all, global or country", cfg.LeaderboardScope)
+	}
+	modes := make(map[int]bool)
+	var filter string
+	if cfg.RecalcMode >= 0 {
+		if !statsModes[cfg.RecalcMode] {
+			return fmt.Errorf("--mode %d is not one of bancho.py's modes", cfg.RecalcMode)
+		}
+		modes[cfg.RecalcMode] = true
+		filter = fmt.Sprintf("AND st.mode = %d", cfg.RecalcMode)
+	} else {
+		modes = statsModes
+	}
+
+	start := time.Now()
+	var entries []leaderboardEntry
+	if err := DB.Select(&entries, fmt.Sprintf(select_leaderboard_stats, filter)); err != nil {
+		return err
+	}
+
+	leaderboards := make(map[string][]leaderboardMember)
+	for _, entry := range entries {
+		member := leaderboardMember{id: entry.ID, pp: entry.PP}
+		global := fmt.Sprintf("%s%d", leaderboardKeyPrefix, entry.Mode)
+		country := fmt.Sprintf("%s%d:%s", leaderboardKeyPrefix, entry.Mode, entry.Country)
+		for _, key := range []string{global, country} {
+			if inLeaderboardScope(key) {
+				leaderboards[key] = append(leaderboards[key], member)
+			}
+		}
+	}
+
+	rc, err := dialRedis(cfg)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	stale, err := staleLeaderboards(rc, leaderboards, modes)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(leaderboards))
+	for key := range leaderboards {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	moved, purged, err := leaderboardDrift(rc, append(append([]string{}, keys...), stale...), leaderboards, entries)
+	if err != nil {
+		return err
+	}
+	// a player who moved is on their old country's leaderboard, not their
+	// new one's, and the global leaderboard is unchanged for them
+	logger.Info("compared the leaderboards in redis", "moved_country", moved, "purged", purged, "scope", cfg.LeaderboardScope)
+
+	if cfg.DryRun {
+		logger.Info("would rebuild leaderboards", "leaderboards", len(leaderboards),
+			"players", len(entries), "stale", len(stale))
+		return nil
+	}
+	for _, key := range keys {
+		if err := writeLeaderboard(rc, key, leaderboards[key]); err != nil {
+			return fmt.Errorf("failed to rebuild %s: %w", key, err)
+		}
+		logger.Debug("rebuilt leaderboard", "key", key, "players", len(leaderboards[key]))
+	}
+
+	for _, key := range stale {
+		rc.Send("DEL", key)
+	}
+	if _, err := rc.Flush(len(stale)); err != nil {
+		return fmt.Errorf("failed to remove stale leaderboards: %w", err)
+	}
+
+	logger.Info("rebuilt leaderboards", "leaderboards", len(keys), "players", len(entries),
+		"removed", len(stale), "elapsed", time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "cache rebuild",
+		Summary: "repopulate bancho.py's global & country leaderboards in redis from the stats table",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.IntVar(&c.RecalcMode, "mode", -1, "only rebuild this mode's leaderboards (0-3 vanilla, 4-6 relax, 8 autopilot)")
+			flags.BoolVar(&c.DryRun, "dry-run", false, "report what would be rebuilt without changing anything")
+			c.LeaderboardScope = "all"
+		},
+		Run: runCacheRebuild,
+	})
+
+	registerCommand(&Command{
+		Name:    "leaderboards rebuild",
+		Summary: "regenerate the global or per-country leaderboards in redis from the stats table, fixing drift",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.LeaderboardScope, "scope", "all", "which leaderboards to rebuild: all, global or country")
+			flags.IntVar(&c.RecalcMode, "mode", -1, "only rebuild this mode's leaderboards (0-3 vanilla, 4-6 relax, 8 autopilot)")
+			flags.BoolVar(&c.DryRun, "dry-run", false, "report how far the leaderboards have drifted without changing anything")
+		},
+		Run: runCacheRebuild,
+	})
+}
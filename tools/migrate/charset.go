@@ -0,0 +1,191 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// charset convert converts every table, and its text columns, to utf8mb4.
+// old gulag databases have latin1 & 3-byte utf8 columns, which can't keep
+// emoji, and some cjk names. utf8mb4_general_ci compares text as utf8_general_ci did,
+// so names which were unique stay unique. text which was mangled before
+// the conversion stays mangled; the conversion reports how much mojibake
+// there is, which charset mojibake can try to decode (see mojibake.go).
+//
+// converting rebuilds each table, blocking writes to it meanwhile, so with
+// --online, tables which can be are converted as copies swapped in once
+// they're done instead (see tableswap.go), while bancho.py keeps running.
+//
+// bancho.py's own schema (migrations/base.sql) isn't utf8mb4 throughout, so
+// this isn't a migration of it, but a conversion servers can choose to run.
+
+const (
+	targetCharset   = "utf8mb4"
+	targetCollation = "utf8mb4_general_ci"
+)
+
+// the tables, & text columns, which aren't utf8mb4 yet
+var select_unconverted_columns = `
+SELECT t.table_name AS table_name, COALESCE(c.column_name, '') AS column_name,
+	COALESCE(c.character_set_name, '') AS charset, t.table_collation AS collation
+FROM information_schema.tables t
+LEFT JOIN information_schema.columns c ON c.table_schema = t.table_schema AND c.table_name = t.table_name
+	AND c.character_set_name IS NOT NULL AND c.character_set_name != 'utf8mb4'
+WHERE t.table_schema = DATABASE() AND t.table_type = 'BASE TABLE'
+	AND (c.column_name IS NOT NULL OR t.table_collation NOT LIKE 'utf8mb4%')
+ORDER BY t.table_name, c.ordinal_position`
+
+type unconvertedColumn struct {
+	Table     string `db:"table_name"`
+	Column    string `db:"column_name"`
+	Charset   string
+	Collation string
+}
+
+// unconvertedTables returns the tables to convert, with the columns of each
+// which aren't utf8mb4 (none, if it's only the table's default).
+func unconvertedTables() (map[string][]unconvertedColumn, error) {
+	var columns []unconvertedColumn
+	if err := DB.Select(&columns, select_unconverted_columns); err != nil {
+		return nil, err
+	}
+	tables := make(map[string][]unconvertedColumn)
+	for _, c := range columns {
+		if _, ok := tables[c.Table]; !ok {
+			tables[c.Table] = nil
+		}
+		if c.Column != "" {
+			tables[c.Table] = append(tables[c.Table], c)
+		}
+	}
+	return tables, nil
+}
+
+func printUnconvertedTables(tables map[string][]unconvertedColumn) {
+	for _, table := range sortedTableNames(tables) {
+		columns := tables[table]
+		if len(columns) == 0 {
+			fmt.Printf("  %s: only the table's default charset\n", table)
+			continue
+		}
+		described := make([]string, len(columns))
+		for i, c := range columns {
+			described[i] = c.Column + " (" + c.Charset + ")"
+		}
+		fmt.Printf("  %s: %s\n", table, strings.Join(described, ", "))
+	}
+}
+
+func sortedTableNames(tables map[string][]unconvertedColumn) []string {
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func runCharsetConvert() error {
+	if cfg.DryRun {
+		return dryRunCharsetConvert()
+	}
+
+	// ctrl-c stops between tables, the next run converts the rest
+	handleSignals()
+
+	tables, err := unconvertedTables()
+	if err != nil {
+		return err
+	}
+	if len(tables) == 0 {
+		logger.Info("every table is already " + targetCharset)
+		return nil
+	}
+
+	// new tables are created as utf8mb4 too
+	if _, err := DB.Exec(fmt.Sprintf("ALTER DATABASE CHARACTER SET %s COLLATE %s", targetCharset, targetCollation)); err != nil {
+		return err
+	}
+
+	// each table is rebuilt, which takes as long as copying it
+	for _, table := range sortedTableNames(tables) {
+		if isInterrupted() {
+			return errInterrupted
+		}
+		start := time.Now()
+		convert := fmt.Sprintf("CONVERT TO CHARACTER SET %s COLLATE %s", targetCharset, targetCollation)
+		online := cfg.Online
+		if online {
+			if _, err := checkSwappable(table); err != nil {
+				logger.Info("can't convert the table online, so converting it in place", "table", table, "reason", err)
+				online = false
+			}
+		}
+		if online {
+			// the unconverted copy is dropped, or the migration wouldn't verify
+			err = alterOnline(table, convert, false)
+		} else {
+			_, err = DB.Exec(fmt.Sprintf("ALTER TABLE `%s` %s", table, convert))
+		}
+		if err != nil {
+			return fmt.Errorf("failed to convert %s: %w", table, err)
+		}
+		logger.Info("converted table", "table", table, "columns", len(tables[table]),
+			"elapsed", time.Since(start).Round(time.Millisecond))
+	}
+
+	// the conversion keeps text as it was, mojibake included
+	report, err := scanMojibake(nil, false)
+	if err != nil {
+		return err
+	}
+	if report.Found != 0 {
+		printMojibakeReport(report)
+		logger.Warn("some text was mangled before the conversion, run charset mojibake --action redecode to try to decode it", "values", report.Found)
+	}
+
+	// anything left over, e.g. a table created meanwhile by an old bancho.py
+	if tables, err = unconvertedTables(); err != nil {
+		return err
+	} else if len(tables) != 0 {
+		fmt.Printf("%d tables still aren't %s:\n", len(tables), targetCharset)
+		printUnconvertedTables(tables)
+		return fmt.Errorf("some tables still aren't %s, run charset convert again", targetCharset)
+	}
+	logger.Info("every table is " + targetCharset)
+	return nil
+}
+
+func dryRunCharsetConvert() error {
+	tables, err := unconvertedTables()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("  %d tables would be converted to %s (%s)\n", len(tables), targetCharset, targetCollation)
+	printUnconvertedTables(tables)
+
+	report, err := scanMojibake(nil, false)
+	if err != nil {
+		return err
+	}
+	if report.Found != 0 {
+		fmt.Printf("  the conversion keeps mojibake as it is; ")
+		printMojibakeReport(report)
+	}
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "charset convert",
+		Summary: "convert every table, and its text columns, to utf8mb4",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.BoolVar(&c.Online, "online", false, "convert the tables which can be as copies, swapped in once they're done, while bancho.py keeps running (see tableswap.go)")
+			flags.BoolVar(&c.DryRun, "dry-run", false, "report the tables which would be converted, without converting them")
+		},
+		Run: runCharsetConvert,
+	})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// the id map records every score migrated so far, and is written in the
+// same transaction as the scores themselves. this makes it the source of
+// truth for which rows have been migrated, lets an interrupted run finish
+// moving the replays of scores which were already committed, and serves
+// as the journal of replay moves for rolling the migration back.
+var create_score_id_map = `
+create table migration_score_ids (
+	source_table varchar(64) not null,
+	old_id bigint unsigned not null,
+	new_id bigint unsigned not null,
+	has_replay tinyint(1) not null default 0,
+	replay_moved tinyint(1) not null default 0,
+	primary key (source_table, old_id)
+);
+`
+
+// the checkpoints table holds, per source table, the highest old score id
+// for which it and every lower id are known to have been migrated.
+var create_checkpoints = `
+create table migration_checkpoints (
+	source_table varchar(64) not null primary key,
+	last_id bigint unsigned not null
+);
+`
+
+var insert_score_id = `
+INSERT INTO migration_score_ids (source_table, old_id, new_id, has_replay)
+VALUES (?, ?, ?, ?)`
+
+var upsert_checkpoint = `
+INSERT INTO migration_checkpoints (source_table, last_id) VALUES (?, ?)
+ON DUPLICATE KEY UPDATE last_id = GREATEST(last_id, VALUES(last_id))`
+
+// createCheckpointTables creates the bookkeeping tables for a fresh run.
+func createCheckpointTables() error {
+	for _, ddl := range []string{create_score_id_map, create_checkpoints} {
+		if _, err := DB.Exec(ddl); err != nil {
+			return fmt.Errorf("%w (if a previous migration was interrupted, rerun with --resume)", err)
+		}
+	}
+	return nil
+}
+
+// dropCheckpointTables removes the bookkeeping tables once they're no longer needed.
+func dropCheckpointTables() error {
+	for _, table := range []string{"migration_checkpoints", "migration_score_ids"} {
+		if _, err := DB.Exec("drop table if exists " + table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadCheckpoint returns the last contiguously migrated id of a source table.
+func loadCheckpoint(table SourceTable) (int64, error) {
+	var lastID int64
+	err := DB.Get(&lastID, "SELECT COALESCE(MAX(last_id), 0) FROM migration_checkpoints WHERE source_table = ?", table.Name)
+	return lastID, err
+}
+
+// migratedIDs returns which ids in [fromID, toID] of a source table are already migrated.
+func migratedIDs(table SourceTable, fromID, toID int64) (map[int64]bool, error) {
+	var ids []int64
+	err := DB.Select(&ids, `
+	SELECT old_id FROM migration_score_ids
+	WHERE source_table = ? AND old_id BETWEEN ? AND ?`, table.Name, fromID, toID)
+	if err != nil {
+		return nil, err
+	}
+
+	migrated := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		migrated[id] = true
+	}
+	return migrated, nil
+}
+
+// markReplaysMoved records replays as having been moved to their new ids.
+func markReplaysMoved(table SourceTable, oldIDs []int64) error {
+	if len(oldIDs) == 0 {
+		return nil
+	}
+
+	query, args, err := sqlx.In(`
+	UPDATE migration_score_ids SET replay_moved = 1
+	WHERE source_table = ? AND old_id IN (?)`, table.Name, oldIDs)
+	if err != nil {
+		return err
+	}
+
+	_, err = DB.Exec(query, args...)
+	return err
+}
+
+// resumePendingReplays finishes moving replays for scores which were
+// committed by an interrupted run before their replays could be moved.
+func resumePendingReplays(tables []SourceTable) error {
+	for _, table := range tables {
+		var moves []ReplayMove
+		err := DB.Select(&moves, `
+		SELECT old_id, new_id FROM migration_score_ids
+		WHERE source_table = ? AND has_replay = 1 AND replay_moved = 0`, table.Name)
+		if err != nil {
+			return err
+		}
+
+		if len(moves) > 0 {
+			logger.Info("resuming pending replay moves", "table", table.Name, "count", len(moves))
+			moveReplays(table, moves)
+		}
+	}
+	return nil
+}
+
+// replayAlreadyMoved reports whether an interrupted run already moved a replay.
+func replayAlreadyMoved(move ReplayMove) bool {
+	_, err := newReplays.Stat(newReplayKey(move))
+	return err == nil
+}
+
+// checkpointTracker advances each source table's checkpoint as batches
+// complete. batches can finish out of order, so the checkpoint only moves
+// past a batch once every batch read before it has been committed.
+type checkpointTracker struct {
+	mu     sync.Mutex
+	tables map[string]*tableProgress
+}
+
+type tableProgress struct {
+	next int           // sequence number of the next batch we're waiting on
+	done map[int]int64 // finished batches (by sequence) -> their last id
+	bad  map[int]bool  // batches which failed to commit
+}
+
+func newCheckpointTracker() *checkpointTracker {
+	return &checkpointTracker{tables: make(map[string]*tableProgress)}
+}
+
+// complete records a finished batch, and persists the table's new checkpoint if it advanced.
+func (t *checkpointTracker) complete(batch ScoreBatch, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	progress, exists := t.tables[batch.Table.Name]
+	if !exists {
+		progress = &tableProgress{done: make(map[int]int64), bad: make(map[int]bool)}
+		t.tables[batch.Table.Name] = progress
+	}
+
+	if !ok {
+		// a failed batch holds the checkpoint back for good; its rows
+		// will be picked up again by the next run with --resume.
+		progress.bad[batch.Seq] = true
+		return
+	}
+
+	progress.done[batch.Seq] = batch.Scores[len(batch.Scores)-1].ID
+
+	var lastID int64
+	for !progress.bad[progress.next] {
+		id, finished := progress.done[progress.next]
+		if !finished {
+			break
+		}
+		delete(progress.done, progress.next)
+		lastID = id
+		progress.next++
+	}
+
+	if lastID != 0 {
+		if _, err := DB.Exec(upsert_checkpoint, batch.Table.Name, lastID); err != nil {
+			logger.Error("failed to save checkpoint", "table", batch.Table.Name, "last_id", lastID, "err", err)
+		}
+	}
+}
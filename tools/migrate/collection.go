@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// export collection picks maps from the server's data and writes them as an
+// osu! collection (collection.db, which players drop into their osu! folder)
+// or as a beatmap pack list (csv, with a download link per map), so admins
+// can publish curated collections. maps are picked by --from:
+//
+//   - firsts: the maps --user has the #1 on, from recalc first-places' table.
+//   - most-played: the most played maps, by scores submitted in a range
+//     (e.g. --since 720h for this month), or ever, by the maps' play count.
+//   - user-best: --user's best scores, by pp.
+//   - pool: a tourney pool's maps, in slot order.
+//
+// writing into an existing collection.db adds the collection to it, or
+// replaces the collection of the same name, so several can be put in one
+// file by running this a few times.
+
+// osu! has written collections with this version since 2015
+const collectionDBVersion = 20150203
+
+// Collection is one of a collection.db's collections.
+type Collection struct {
+	Name string
+	MD5s []string
+}
+
+type collectionMap struct {
+	ID      int64
+	SetID   int64 `db:"set_id"`
+	MD5     string
+	Artist  string
+	Title   string
+	Version string
+	Creator string
+	Plays   int64
+}
+
+// readCollectionDB reads a collection.db's collections.
+func readCollectionDB(data []byte) (int, []Collection, error) {
+	r := &osrReader{data: data}
+	version := r.i32()
+	var collections []Collection
+	for n := r.i32(); n > 0 && r.err == nil; n-- {
+		c := Collection{Name: r.string()}
+		for n := r.i32(); n > 0 && r.err == nil; n-- {
+			c.MD5s = append(c.MD5s, r.string())
+		}
+		collections = append(collections, c)
+	}
+	return version, collections, r.err
+}
+
+// encodeCollectionDB writes collections as a collection.db.
+func encodeCollectionDB(version int, collections []Collection) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, int32(version))
+	binary.Write(&buf, binary.LittleEndian, int32(len(collections)))
+	for _, c := range collections {
+		writeOsuString(&buf, c.Name)
+		binary.Write(&buf, binary.LittleEndian, int32(len(c.MD5s)))
+		for _, md5 := range c.MD5s {
+			writeOsuString(&buf, md5)
+		}
+	}
+	return buf.Bytes()
+}
+
+// collectionQuery returns the query picking the maps' md5s, best first.
+func collectionQuery() (string, []interface{}, string, error) {
+	mode, modeArgs := "", []interface{}{}
+	if cfg.CollectionMode >= 0 {
+		mode, modeArgs = " AND s.mode = ?", []interface{}{cfg.CollectionMode}
+	}
+	user := func() (int64, error) {
+		if cfg.CollectionUser == "" {
+			return 0, fmt.Errorf("--from %s needs --user", cfg.CollectionSource)
+		}
+		return findUser(cfg.CollectionUser)
+	}
+
+	switch cfg.CollectionSource {
+	case "firsts":
+		id, err := user()
+		if err != nil {
+			return "", nil, "", err
+		}
+		if exists, err := tableExists("first_places"); err != nil {
+			return "", nil, "", err
+		} else if !exists {
+			return "", nil, "", errors.New("there's no first_places table, run recalc first-places first")
+		}
+		return `SELECT s.map_md5 FROM first_places s WHERE s.userid = ?` + mode + ` ORDER BY s.score_id`,
+			append([]interface{}{id}, modeArgs...), fmt.Sprintf("#1s of %s", cfg.CollectionUser), nil
+
+	case "most-played":
+		if cfg.CollectionSince == "" && cfg.CollectionUntil == "" {
+			query := `SELECT md5 FROM maps WHERE 1`
+			if cfg.CollectionMode >= 0 {
+				query += ` AND mode = ?`
+				modeArgs = []interface{}{cfg.CollectionMode % 4}
+			}
+			return query + ` ORDER BY plays DESC, id LIMIT ?`, append(modeArgs, cfg.CollectionLimit), "most played", nil
+		}
+		since, until := int64(0), int64(1<<31-1)
+		var err error
+		if cfg.CollectionSince != "" {
+			if since, err = parseFilterTime("since", cfg.CollectionSince); err != nil {
+				return "", nil, "", err
+			}
+		}
+		if cfg.CollectionUntil != "" {
+			if until, err = parseFilterTime("until", cfg.CollectionUntil); err != nil {
+				return "", nil, "", err
+			}
+		}
+		return `SELECT s.map_md5 FROM scores s
+		WHERE s.play_time >= FROM_UNIXTIME(?) AND s.play_time < FROM_UNIXTIME(?)` + mode + `
+		GROUP BY s.map_md5 ORDER BY COUNT(*) DESC, s.map_md5 LIMIT ?`,
+			append(append([]interface{}{since, until}, modeArgs...), cfg.CollectionLimit), "most played", nil
+
+	case "user-best":
+		id, err := user()
+		if err != nil {
+			return "", nil, "", err
+		}
+		return `SELECT s.map_md5 FROM scores s WHERE s.userid = ? AND s.status = 2` + mode + `
+		GROUP BY s.map_md5 ORDER BY MAX(s.pp) DESC LIMIT ?`,
+			append(append([]interface{}{id}, modeArgs...), cfg.CollectionLimit), fmt.Sprintf("best of %s", cfg.CollectionUser), nil
+
+	case "pool":
+		if cfg.CollectionPool == "" {
+			return "", nil, "", errors.New("--from pool needs --pool")
+		}
+		return `SELECT m.md5 FROM tourney_pool_maps pm
+		JOIN tourney_pools p ON p.id = pm.pool_id
+		JOIN maps m ON m.id = pm.map_id
+		WHERE p.id = ? OR p.name = ? ORDER BY pm.mods, pm.slot`,
+			[]interface{}{cfg.CollectionPool, cfg.CollectionPool}, cfg.CollectionPool, nil
+	}
+	return "", nil, "", fmt.Errorf("unknown --from %q, expected firsts, most-played, user-best or pool", cfg.CollectionSource)
+}
+
+// collectionMaps looks the maps up, in the order they were picked. maps
+// bancho.py doesn't know are left out.
+func collectionMaps(md5s []string) ([]collectionMap, error) {
+	found := map[string]collectionMap{}
+	for start := 0; start < len(md5s); start += BatchSize {
+		query, args, err := sqlx.In(`
+		SELECT id, set_id, md5, artist, title, version, creator, plays
+		FROM maps WHERE md5 IN (?)`, md5s[start:min(start+BatchSize, len(md5s))])
+		if err != nil {
+			return nil, err
+		}
+		var maps []collectionMap
+		if err := DB.Select(&maps, query, args...); err != nil {
+			return nil, err
+		}
+		for _, m := range maps {
+			found[m.MD5] = m
+		}
+	}
+	maps := make([]collectionMap, 0, len(md5s))
+	for _, md5 := range md5s {
+		if m, ok := found[md5]; ok {
+			maps = append(maps, m)
+		}
+	}
+	return maps, nil
+}
+
+// writeCollection adds the collection to --out, replacing one of the same
+// name.
+func writeCollection(name string, maps []collectionMap) error {
+	c := Collection{Name: name, MD5s: make([]string, len(maps))}
+	for i, m := range maps {
+		c.MD5s[i] = m.MD5
+	}
+	return mergeCollections(cfg.CollectionOut, []Collection{c})
+}
+
+// mergeCollections adds collections to the collection.db at path, replacing
+// ones of the same name, or creates it.
+func mergeCollections(path string, add []Collection) error {
+	version, collections := collectionDBVersion, []Collection{}
+	if data, err := os.ReadFile(path); err == nil {
+		if version, collections, err = readCollectionDB(data); err != nil {
+			return fmt.Errorf("%s isn't a collection.db: %w", path, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	replaced := 0
+	for _, c := range add {
+		i := slices.IndexFunc(collections, func(existing Collection) bool { return existing.Name == c.Name })
+		if i >= 0 {
+			collections[i] = c
+			replaced++
+		} else {
+			collections = append(collections, c)
+		}
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, encodeCollectionDB(version, collections), 0644); err != nil {
+		return err
+	}
+	logger.Info("wrote the collections", "added", len(add)-replaced, "replaced", replaced, "collections", len(collections), "path", path)
+	return os.Rename(tmp, path)
+}
+
+// writePackList writes the maps as a csv, with a link to each.
+func writePackList(maps []collectionMap) error {
+	rows := make([][]string, len(maps))
+	for i, m := range maps {
+		link := strings.NewReplacer(
+			"{id}", strconv.FormatInt(m.ID, 10),
+			"{set_id}", strconv.FormatInt(m.SetID, 10),
+			"{md5}", m.MD5,
+		).Replace(cfg.CollectionLink)
+		rows[i] = []string{strconv.FormatInt(m.SetID, 10), strconv.FormatInt(m.ID, 10), m.MD5, m.Artist, m.Title,
+			m.Version, m.Creator, strconv.FormatInt(m.Plays, 10), link}
+	}
+	logger.Info("wrote the pack list", "maps", len(maps), "path", cfg.CollectionOut)
+	return writeCSVReport(cfg.CollectionOut, []string{"set_id", "map_id", "md5", "artist", "title", "version",
+		"creator", "plays", "link"}, rows)
+}
+
+func runExportCollection() error {
+	if cfg.CollectionFormat != "db" && cfg.CollectionFormat != "list" {
+		return fmt.Errorf("unknown --format %q, expected db or list", cfg.CollectionFormat)
+	}
+	if cfg.CollectionLimit < 1 {
+		return errors.New("--limit must be at least 1")
+	}
+	query, args, name, err := collectionQuery()
+	if err != nil {
+		return err
+	}
+	if cfg.CollectionName != "" {
+		name = cfg.CollectionName
+	}
+	if cfg.CollectionOut == "" {
+		cfg.CollectionOut = map[string]string{"db": "collection.db", "list": "pack.csv"}[cfg.CollectionFormat]
+	}
+
+	var md5s []string
+	if err := DB.Select(&md5s, query, args...); err != nil {
+		return err
+	}
+	maps, err := collectionMaps(md5s[:min(len(md5s), cfg.CollectionLimit)])
+	if err != nil {
+		return err
+	}
+	if len(maps) == 0 {
+		return errors.New("no maps were picked")
+	}
+	if missing := len(md5s[:min(len(md5s), cfg.CollectionLimit)]) - len(maps); missing != 0 {
+		logger.Warn("some maps picked aren't in the maps table, so were left out", "maps", missing)
+	}
+
+	if cfg.CollectionFormat == "list" {
+		return writePackList(maps)
+	}
+	return writeCollection(name, maps)
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "export collection",
+		Summary: "write maps picked from server data (a user's #1s, most played, etc) as an osu! collection.db or pack list",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.CollectionSource, "from", "", "how maps are picked: firsts, most-played, user-best or pool")
+			flags.StringVar(&c.CollectionUser, "user", "", "name or id of the user, for firsts & user-best")
+			flags.StringVar(&c.CollectionPool, "pool", "", "name or id of the tourney pool, for pool")
+			flags.IntVar(&c.CollectionMode, "mode", -1, "only this mode (0-3 vanilla, 4-6 relax, 8 autopilot)")
+			flags.StringVar(&c.CollectionSince, "since", "", "for most-played, count scores since this date, or duration ago (e.g. 720h)")
+			flags.StringVar(&c.CollectionUntil, "until", "", "for most-played, count scores before this date, or duration ago")
+			flags.IntVar(&c.CollectionLimit, "limit", 100, "at most this many maps")
+			flags.StringVar(&c.CollectionName, "name", "", "the collection's name (default: e.g. \"#1s of <user>\")")
+			flags.StringVar(&c.CollectionFormat, "format", "db", "db for an osu! collection.db, or list for a csv pack list")
+			flags.StringVar(&c.CollectionOut, "out", "", "file to write, an existing collection.db is added to (default: collection.db, or pack.csv)")
+			flags.StringVar(&c.CollectionLink, "link", "https://osu.ppy.sh/b/{id}", "each map's link in a pack list, a template containing {id}, {set_id} or {md5}")
+		},
+		Run: runExportCollection,
+	})
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// scores combos finds scores with a higher max_combo than their map has,
+// which imports from other servers often leave behind. a map's max combo
+// comes from the maps table, or, for maps without one, its .osu file (only
+// for osu!standard, whose combo can be worked out from it, see osufile.go).
+// converted maps' combos differ from their own, so only scores in the map's
+// own mode are checked.
+//
+// by default they're only reported; --action clamp lowers their max_combo
+// to the map's, and --action quarantine moves them into quarantined_<table>.
+// either way, the players' stats are brought up to date afterwards.
+
+const (
+	combosReport     = "report"
+	combosClamp      = "clamp"
+	combosQuarantine = "quarantine"
+)
+
+// a .osu file's combo may be slightly off from stable's, see osufile.go
+const parsedComboSlack = 2
+
+var errBadCombosFound = errors.New("scores with impossible combos were found")
+
+var select_combo_scores = `
+SELECT s.id, s.userid, s.mode, s.max_combo, m.id AS map_id, m.mode AS map_mode, m.max_combo AS map_max_combo
+FROM %s s JOIN maps m ON m.md5 = s.map_md5
+WHERE s.id > ? ORDER BY s.id LIMIT ?`
+
+type comboScore struct {
+	ID          int64
+	UserID      int64 `db:"userid"`
+	Mode        int
+	MaxCombo    int   `db:"max_combo"`
+	MapID       int64 `db:"map_id"`
+	MapMode     int   `db:"map_mode"`
+	MapMaxCombo int   `db:"map_max_combo"`
+}
+
+// ComboProblem is a score with more combo than its map has.
+type ComboProblem struct {
+	ScoreID     int64  `json:"score_id"`
+	UserID      int64  `json:"user_id"`
+	MapID       int64  `json:"map_id"`
+	MaxCombo    int    `json:"max_combo"`
+	MapMaxCombo int    `json:"map_max_combo"`
+	Source      string `json:"source"` // where the map's combo came from: maps or .osu
+}
+
+// CombosReport is the result of scores combos.
+type CombosReport struct {
+	Table       string         `json:"table"`
+	Action      string         `json:"action"`
+	Checked     int64          `json:"checked"`
+	Unknown     int64          `json:"unknown"` // scores on maps whose combo isn't known
+	Impossible  int64          `json:"impossible"`
+	Clamped     int64          `json:"clamped"`
+	Quarantined int64          `json:"quarantined"`
+	Examples    []ComboProblem `json:"examples"`
+}
+
+// parsedCombos caches the combos worked out from .osu files, by map id; 0
+// when the file is missing or isn't osu!standard.
+type parsedCombos map[int64]int
+
+func (c parsedCombos) get(id int64) int {
+	if combo, ok := c[id]; ok {
+		return combo
+	}
+	combo := 0
+	if f, err := os.Open(filepath.Join(cfg.BeatmapDirectory(), fmt.Sprintf("%d.osu", id))); err == nil {
+		if combo, err = beatmapMaxCombo(f); err != nil {
+			logger.Debug("couldn't work out a map's combo", "map", id, "err", err)
+			combo = 0
+		}
+		f.Close()
+	}
+	c[id] = combo
+	return combo
+}
+
+// clampCombos lowers scores' max_combo to their maps', in one transaction.
+func clampCombos(table string, problems []ComboProblem) error {
+	tx, err := DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Preparex(fmt.Sprintf("UPDATE %s SET max_combo = ? WHERE id = ?", table))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, p := range problems {
+		if _, err := stmt.Exec(p.MapMaxCombo, p.ScoreID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func runScoresCombos() error {
+	switch cfg.CombosAction {
+	case combosReport, combosClamp, combosQuarantine:
+	default:
+		return fmt.Errorf("unknown --action %q, expected report, clamp or quarantine", cfg.CombosAction)
+	}
+	exists, err := tableExists(cfg.CheckTable)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("table %s does not exist", cfg.CheckTable)
+	}
+
+	start := time.Now()
+	report := CombosReport{Table: cfg.CheckTable, Action: cfg.CombosAction, Examples: []ComboProblem{}}
+	var problems []ComboProblem
+	parsed := parsedCombos{}
+
+	var lastID int64
+	for !isInterrupted() {
+		var scores []comboScore
+		if err := ReadDB.Select(&scores, fmt.Sprintf(select_combo_scores, cfg.CheckTable), lastID, BatchSize); err != nil {
+			return err
+		}
+		if len(scores) == 0 {
+			break
+		}
+		if err := throttle(len(scores)); err != nil {
+			return err
+		}
+
+		for _, s := range scores {
+			if s.Mode%4 != s.MapMode {
+				continue
+			}
+			report.Checked++
+
+			limit, source := s.MapMaxCombo, "maps"
+			if limit <= 0 && s.MapMode == 0 {
+				if combo := parsed.get(s.MapID); combo > 0 {
+					limit, source = combo+parsedComboSlack, ".osu"
+				}
+			}
+			if limit <= 0 {
+				report.Unknown++
+				continue
+			}
+			if s.MaxCombo <= limit {
+				continue
+			}
+
+			problem := ComboProblem{ScoreID: s.ID, UserID: s.UserID, MapID: s.MapID,
+				MaxCombo: s.MaxCombo, MapMaxCombo: limit, Source: source}
+			problems = append(problems, problem)
+			if len(report.Examples) < maxExamples {
+				report.Examples = append(report.Examples, problem)
+			}
+		}
+		lastID = scores[len(scores)-1].ID
+	}
+	if isInterrupted() {
+		return errInterrupted
+	}
+	report.Impossible = int64(len(problems))
+
+	fmt.Printf("%s: %d scores checked, %d with more combo than their map, %d on maps whose combo isn't known\n",
+		cfg.CheckTable, report.Checked, report.Impossible, report.Unknown)
+	for _, p := range report.Examples {
+		fmt.Printf("  %d: combo %d on map %d, which has %d (from %s)\n", p.ScoreID, p.MaxCombo, p.MapID, p.MapMaxCombo, p.Source)
+	}
+
+	if len(problems) != 0 && cfg.CombosAction != combosReport {
+		fmt.Printf("This will %s %d scores.\n", cfg.CombosAction, len(problems))
+		if !confirm("Continue?") {
+			fmt.Println("Not repairing the scores")
+			return nil
+		}
+
+		users := make(map[int64]bool)
+		for _, p := range problems {
+			users[p.UserID] = true
+		}
+		if cfg.CombosAction == combosClamp {
+			if err := clampCombos(cfg.CheckTable, problems); err != nil {
+				return fmt.Errorf("failed to clamp the scores' combos: %w", err)
+			}
+			report.Clamped = report.Impossible
+			if _, err := DB.Exec(update_stats_from_scores); err != nil {
+				return fmt.Errorf("failed to update the players' max combos: %w", err)
+			}
+		} else {
+			ids := make([]int64, len(problems))
+			for i, p := range problems {
+				ids[i] = p.ScoreID
+			}
+			tx, err := DB.Beginx()
+			if err != nil {
+				return err
+			}
+			if err := quarantineScores(tx, cfg.CheckTable, ids); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("failed to quarantine the scores: %w", err)
+			}
+			if err := tx.Commit(); err != nil {
+				return err
+			}
+			report.Quarantined = report.Impossible
+
+			// the scores are gone by now, so anything failing below
+			// can be finished with recalc status & recalc stats
+			counts, err := rebuildUserStats(users)
+			if err != nil {
+				return fmt.Errorf("failed to rebuild the stats, run recalc status & recalc stats: %w", err)
+			}
+			logger.Info("recalculated the players' best scores & stats", "users", len(users),
+				"promoted", counts.Promoted, "demoted", counts.Demoted)
+		}
+		logger.Info("repaired the scores' combos", "action", cfg.CombosAction, "scores", len(problems))
+	}
+
+	if err := writeReport(cfg.ReportPath, report); err != nil {
+		return err
+	}
+	logger.Info("scores combos finished", "found", report.Impossible, "action", cfg.CombosAction,
+		"elapsed", time.Since(start).Round(time.Second))
+	if report.Impossible != 0 && cfg.CombosAction == combosReport {
+		return errBadCombosFound
+	}
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:              "scores combos",
+		Summary:           "find scores with more combo than their map has, and clamp or quarantine them",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.CheckTable, "table", "scores", "the scores table to check, e.g. "+archiveTable)
+			flags.StringVar(&c.CombosAction, "action", combosReport, "what to do with them: report, clamp (to the map's max combo) or quarantine (into quarantined_<table>)")
+			flags.StringVar(&c.ReportPath, "report", "", "write what was found as json to this path (- for stdout)")
+		},
+		Run: runScoresCombos,
+	})
+}
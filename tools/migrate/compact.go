@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// replays compact shrinks a local replay directory: byte-identical replays
+// (e.g. left by imports, or restored twice) are hardlinked to one file, and
+// with --compress gzip, replays are gzipped at rest as <id>.osr.gz, which
+// bancho.py serves like any other replay. bancho.py only stores the lzma
+// compressed frames of a replay, so gzip rarely saves much; a replay is only
+// kept compressed when it saves at least --min-savings. --decompress undoes it.
+//
+// linked replays are never written in place: bancho.py only writes new
+// replays, and this tool replaces replays by renaming over them.
+//
+// the sidecar index (compact.idx, in the directory) lists every replay's
+// sha256 & original size, so that the next run only hashes replays which
+// changed, and other services can find compressed replays without
+// decompressing them. each line is tab separated: the key, its encoding
+// (raw or gzip), original size, stored size, modification time & sha256.
+
+const compactIndexName = "compact.idx"
+
+const (
+	encodingRaw  = "raw"
+	encodingGzip = "gzip"
+)
+
+// compactEntry is a replay as it's stored on disk.
+type compactEntry struct {
+	Key        string
+	Encoding   string
+	Size       int64 // uncompressed
+	StoredSize int64
+	ModTime    int64 // unix nanoseconds
+	SHA256     string
+
+	inode     uint64
+	origInode uint64 // before this run, to tell which replays were linked to which
+}
+
+func (e *compactEntry) path(dir string) string {
+	if e.Encoding == encodingGzip {
+		return filepath.Join(dir, e.Key+compressedSuffix)
+	}
+	return filepath.Join(dir, e.Key)
+}
+
+// CompactReport is the totals of a compaction, in bytes on disk.
+type CompactReport struct {
+	Replays      int64 `json:"replays"`
+	Hashed       int64 `json:"hashed"` // the rest were unchanged since the last run
+	Groups       int64 `json:"groups"` // sets of identical replays
+	Linked       int64 `json:"linked"` // replays replaced by a hardlink
+	Compressed   int64 `json:"compressed"`
+	Incompressed int64 `json:"incompressible"` // saved less than --min-savings
+	Decompressed int64 `json:"decompressed"`
+	Failed       int64 `json:"failed"`
+	BytesBefore  int64 `json:"bytes_before"`
+	BytesAfter   int64 `json:"bytes_after"`
+	BytesSaved   int64 `json:"bytes_saved"`
+	DryRun       bool  `json:"dry_run"`
+}
+
+func readCompactIndex(path string) (map[string]compactEntry, error) {
+	index := make(map[string]compactEntry)
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("%s:%d: expected 6 fields, got %d", path, lineNo, len(fields))
+		}
+		e := compactEntry{Key: fields[0], Encoding: fields[1], SHA256: fields[5]}
+		var errs [3]error
+		e.Size, errs[0] = strconv.ParseInt(fields[2], 10, 64)
+		e.StoredSize, errs[1] = strconv.ParseInt(fields[3], 10, 64)
+		e.ModTime, errs[2] = strconv.ParseInt(fields[4], 10, 64)
+		if err := errors.Join(errs[:]...); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+		index[e.Key] = e
+	}
+	return index, scanner.Err()
+}
+
+// writeCompactIndex replaces the index, sorted by key.
+func writeCompactIndex(path string, entries []*compactEntry) error {
+	sorted := make([]*compactEntry, len(entries))
+	copy(sorted, entries)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+
+	var buf bytes.Buffer
+	for _, e := range sorted {
+		fmt.Fprintf(&buf, "%s\t%s\t%d\t%d\t%d\t%s\n", e.Key, e.Encoding, e.Size, e.StoredSize, e.ModTime, e.SHA256)
+	}
+	return writeBeatmap(path, buf.Bytes())
+}
+
+// scanReplayFiles stats every replay in a directory. a replay stored both
+// compressed & not is left as it is, as it's unclear which is current.
+func scanReplayFiles(dir string) ([]*compactEntry, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*compactEntry
+	seen := make(map[string]*compactEntry, len(dirEntries))
+	for _, d := range dirEntries {
+		key := strings.TrimSuffix(d.Name(), compressedSuffix)
+		if d.IsDir() || !strings.HasSuffix(key, ".osr") {
+			continue
+		}
+		// entries are sorted by name, so <key> comes just before <key>.gz
+		if e, ok := seen[key]; ok {
+			logger.Warn("skipping a replay stored both compressed & not", "key", key)
+			e.Key = ""
+			continue
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil, err
+		}
+		e := &compactEntry{Key: key, Encoding: encodingRaw, StoredSize: info.Size(), ModTime: info.ModTime().UnixNano()}
+		if key != d.Name() {
+			e.Encoding = encodingGzip
+		}
+		e.inode = fileID(info)
+		e.origInode = e.inode
+		seen[key] = e
+		entries = append(entries, e)
+	}
+
+	kept := entries[:0]
+	for _, e := range entries {
+		if e.Key != "" {
+			kept = append(kept, e)
+		}
+	}
+	return kept, nil
+}
+
+// hashReplay reads a replay, returning its uncompressed size & sha256.
+func hashReplay(dir string, e *compactEntry) error {
+	f, err := os.Open(e.path(dir))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if e.Encoding == encodingGzip {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		r = zr
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return err
+	}
+	e.Size, e.SHA256 = n, hex.EncodeToString(h.Sum(nil))
+	return nil
+}
+
+// readReplayFile returns a replay's uncompressed contents.
+func readReplayFile(dir string, e *compactEntry) ([]byte, error) {
+	data, err := os.ReadFile(e.path(dir))
+	if err != nil || e.Encoding != encodingGzip {
+		return data, err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(zr)
+}
+
+// recode compresses or decompresses the replay a group's files link to,
+// returning whether it changed. with a dry run, only the savings are worked out.
+func recode(dir string, e *compactEntry, report *CompactReport) (bool, error) {
+	data, err := readReplayFile(dir, e)
+	if err != nil {
+		return false, err
+	}
+
+	encoding := encodingRaw
+	if !cfg.CompactDecompress {
+		var buf bytes.Buffer
+		zw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		zw.Write(data)
+		if err := zw.Close(); err != nil {
+			return false, err
+		}
+		if float64(len(data)-buf.Len()) < float64(len(data))*cfg.CompactMinSavings/100 {
+			atomic.AddInt64(&report.Incompressed, 1)
+			return false, nil
+		}
+		data, encoding = buf.Bytes(), encodingGzip
+	}
+	if cfg.DryRun {
+		e.Encoding, e.StoredSize = encoding, int64(len(data))
+		return true, nil
+	}
+
+	old := e.path(dir)
+	e.Encoding = encoding
+	if err := writeBeatmap(e.path(dir), data); err != nil {
+		return false, err
+	}
+	if err := os.Remove(old); err != nil {
+		return false, err
+	}
+	info, err := os.Stat(e.path(dir))
+	if err != nil {
+		return false, err
+	}
+	e.StoredSize, e.ModTime, e.inode = info.Size(), info.ModTime().UnixNano(), fileID(info)
+	return true, nil
+}
+
+// linkReplay replaces a replay with a hardlink to an identical one.
+func linkReplay(dir string, canonical, e *compactEntry) error {
+	if cfg.DryRun {
+		e.Encoding, e.StoredSize, e.inode = canonical.Encoding, canonical.StoredSize, canonical.inode
+		return nil
+	}
+
+	old := e.path(dir)
+	e.Encoding = canonical.Encoding
+	tmp := e.path(dir) + ".tmp"
+	os.Remove(tmp)
+	if err := os.Link(canonical.path(dir), tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, e.path(dir)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if old != e.path(dir) {
+		if err := os.Remove(old); err != nil {
+			return err
+		}
+	}
+	e.StoredSize, e.ModTime, e.inode = canonical.StoredSize, canonical.ModTime, canonical.inode
+	return nil
+}
+
+// diskUsage is the bytes used by replays, counting linked files once.
+func diskUsage(entries []*compactEntry) int64 {
+	var total int64
+	inodes := make(map[uint64]bool, len(entries))
+	for _, e := range entries {
+		if e.inode != 0 {
+			if inodes[e.inode] {
+				continue
+			}
+			inodes[e.inode] = true
+		}
+		total += e.StoredSize
+	}
+	return total
+}
+
+// forEachEntry runs fn over entries with --workers goroutines.
+func forEachEntry(entries []*compactEntry, fn func(e *compactEntry)) {
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = 4
+	}
+	queue := make(chan *compactEntry, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range queue {
+				if !isInterrupted() {
+					fn(e)
+				}
+			}
+		}()
+	}
+	for _, e := range entries {
+		if isInterrupted() {
+			break
+		}
+		queue <- e
+	}
+	close(queue)
+	wg.Wait()
+}
+
+func runReplaysCompact() error {
+	if cfg.CompactCompress != encodingGzip && cfg.CompactCompress != "none" {
+		return fmt.Errorf("unknown --compress %q, expected gzip or none (zstd isn't supported)", cfg.CompactCompress)
+	}
+	if cfg.CompactDecompress && cfg.CompactCompress != "none" {
+		return errors.New("--decompress can't be used with --compress")
+	}
+
+	dir := cfg.ReplayDirectory()
+	if cfg.NewReplays != "" {
+		if strings.Contains(cfg.NewReplays, "://") {
+			return errors.New("replays compact only works on local directories, as object storage can't hardlink")
+		}
+		dir = strings.TrimRight(cfg.NewReplays, "/")
+	}
+	indexPath := filepath.Join(dir, compactIndexName)
+	index, err := readCompactIndex(indexPath)
+	if err != nil {
+		return err
+	}
+
+	handleSignals()
+	start := time.Now()
+	entries, err := scanReplayFiles(dir)
+	if err != nil {
+		return err
+	}
+	report := &CompactReport{Replays: int64(len(entries)), DryRun: cfg.DryRun}
+	report.BytesBefore = diskUsage(entries)
+	logger.Info("compacting replays", "directory", dir, "replays", len(entries), "compress", cfg.CompactCompress,
+		"decompress", cfg.CompactDecompress, "dedupe", cfg.CompactDedupe, "dry_run", cfg.DryRun)
+
+	// replays unchanged since they were last indexed aren't hashed again
+	var failed sync.Map
+	forEachEntry(entries, func(e *compactEntry) {
+		if known, ok := index[e.Key]; ok && known.Encoding == e.Encoding &&
+			known.StoredSize == e.StoredSize && known.ModTime == e.ModTime {
+			e.Size, e.SHA256 = known.Size, known.SHA256
+			return
+		}
+		if err := hashReplay(dir, e); err != nil {
+			logger.Warn("failed to read replay", "location", e.path(dir), "err", err)
+			atomic.AddInt64(&report.Failed, 1)
+			failed.Store(e, true)
+			return
+		}
+		atomic.AddInt64(&report.Hashed, 1)
+	})
+	if isInterrupted() {
+		return errInterrupted
+	}
+
+	// identical replays are grouped, each group's first replay being the
+	// one the rest are linked to
+	groups := make(map[string][]*compactEntry)
+	var hashes []string
+	for _, e := range entries {
+		if _, bad := failed.Load(e); bad {
+			continue
+		}
+		if groups[e.SHA256] == nil {
+			hashes = append(hashes, e.SHA256)
+		}
+		groups[e.SHA256] = append(groups[e.SHA256], e)
+	}
+	canonicals := make([]*compactEntry, len(hashes))
+	for i, hash := range hashes {
+		canonicals[i] = groups[hash][0]
+		if len(groups[hash]) > 1 {
+			report.Groups++
+		}
+	}
+
+	if cfg.CompactCompress == encodingGzip || cfg.CompactDecompress {
+		want := encodingGzip
+		if cfg.CompactDecompress {
+			want = encodingRaw
+		}
+		forEachEntry(canonicals, func(e *compactEntry) {
+			if e.Encoding == want {
+				return
+			}
+			changed, err := recode(dir, e, report)
+			if err != nil {
+				logger.Warn("failed to recode replay", "location", e.path(dir), "err", err)
+				atomic.AddInt64(&report.Failed, 1)
+				return
+			}
+			if changed && want == encodingGzip {
+				atomic.AddInt64(&report.Compressed, 1)
+			} else if changed {
+				atomic.AddInt64(&report.Decompressed, 1)
+			}
+		})
+	}
+
+	// every replay of a group is linked to its first. with --dedupe=false,
+	// only those which were already linked are, and the rest are recoded
+	// on their own
+	for _, hash := range hashes {
+		group := groups[hash]
+		canonical := group[0]
+		for _, e := range group[1:] {
+			if isInterrupted() {
+				break
+			}
+			if e.inode != 0 && e.inode == canonical.inode && e.Encoding == canonical.Encoding {
+				continue
+			}
+			wasLinked := e.origInode != 0 && e.origInode == canonical.origInode
+
+			if !cfg.CompactDedupe && !wasLinked {
+				if (cfg.CompactCompress == encodingGzip && e.Encoding != encodingGzip) ||
+					(cfg.CompactDecompress && e.Encoding != encodingRaw) {
+					changed, err := recode(dir, e, report)
+					if err != nil {
+						logger.Warn("failed to recode replay", "location", e.path(dir), "err", err)
+						report.Failed++
+					} else if changed && cfg.CompactDecompress {
+						report.Decompressed++
+					} else if changed {
+						report.Compressed++
+					}
+				}
+				continue
+			}
+
+			if err := linkReplay(dir, canonical, e); err != nil {
+				logger.Warn("failed to link replay", "location", e.path(dir), "to", canonical.path(dir), "err", err)
+				report.Failed++
+				continue
+			}
+			if !wasLinked {
+				report.Linked++
+			}
+		}
+	}
+
+	// the index is written even when interrupted, so that the work done isn't repeated
+	var indexed []*compactEntry
+	for _, e := range entries {
+		if _, bad := failed.Load(e); !bad {
+			indexed = append(indexed, e)
+		}
+	}
+	if !cfg.DryRun {
+		if err := writeCompactIndex(indexPath, indexed); err != nil {
+			return fmt.Errorf("failed to write the index: %w", err)
+		}
+	}
+	if isInterrupted() {
+		return errInterrupted
+	}
+
+	report.BytesAfter = diskUsage(entries)
+	report.BytesSaved = report.BytesBefore - report.BytesAfter
+	logger.Info("compacted replays", "replays", report.Replays, "hashed", report.Hashed, "groups", report.Groups,
+		"linked", report.Linked, "compressed", report.Compressed, "incompressible", report.Incompressed,
+		"decompressed", report.Decompressed, "failed", report.Failed,
+		"before", formatBytes(report.BytesBefore), "after", formatBytes(report.BytesAfter),
+		"saved", formatBytes(report.BytesSaved), "dry_run", cfg.DryRun, "elapsed", time.Since(start).Round(time.Second))
+	if err := writeReport(cfg.ReportPath, report); err != nil {
+		return err
+	}
+	if report.Failed != 0 {
+		return errors.New("some replays could not be compacted")
+	}
+	return nil
+}
+
+// formatBytes formats a size for logs, e.g. 1.2 GiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit && n > -unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit || m <= -unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:              "replays compact",
+		Summary:           "hardlink identical replays, and optionally gzip them at rest",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.CompactCompress, "compress", "none", "compress replays at rest: gzip, or none")
+			flags.BoolVar(&c.CompactDecompress, "decompress", false, "decompress every compressed replay, undoing --compress")
+			flags.Float64Var(&c.CompactMinSavings, "min-savings", 5, "only keep a replay compressed when it's at least this many percent smaller")
+			flags.BoolVar(&c.CompactDedupe, "dedupe", true, "hardlink byte-identical replays to one file")
+			flags.IntVar(&c.Workers, "workers", 4, "number of replays hashed or compressed at a time")
+			flags.BoolVar(&c.DryRun, "dry-run", false, "report how much space would be saved, without changing anything")
+			flags.StringVar(&c.ReportPath, "report", "", "write the totals as json to this path (- for stdout)")
+			flags.StringVar(&c.NewReplays, "replays", "", "the replay directory to compact (default: DATA_DIRECTORY/osr)")
+		},
+		Run: runReplaysCompact,
+	})
+}
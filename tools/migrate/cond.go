@@ -0,0 +1,390 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// bancho.py keeps each achievement's condition as a python expression, run
+// with eval() against a submitted score, e.g.
+//   (score.mods & 1 == 0) and 1 <= score.sr < 2 and mode_vn == 0
+// this evaluates the subset of python used by conditions: numbers, names,
+// boolean & bitwise operators, arithmetic and (chained) comparisons, with
+// python's precedence, e.g. & binding tighter than ==.
+
+// condEnv looks up the value of a name in a condition, e.g. score.sr.
+type condEnv func(name string) (float64, error)
+
+// Condition is a compiled achievement condition.
+type Condition struct {
+	source string
+	root   condNode
+	names  map[string]bool
+}
+
+type condNode func(env condEnv) (float64, error)
+
+// Uses reports whether the condition refers to a name, e.g. score.sr.
+func (c *Condition) Uses(name string) bool {
+	return c.names[name]
+}
+
+// Eval reports whether the condition holds, by python's truthiness.
+func (c *Condition) Eval(env condEnv) (bool, error) {
+	v, err := c.root(env)
+	if err != nil {
+		return false, fmt.Errorf("%q: %w", c.source, err)
+	}
+	return v != 0, nil
+}
+
+type condToken struct {
+	kind  byte // 'n'umber, 'i'dentifier, 'o'perator
+	text  string
+	value float64
+}
+
+func tokenizeCondition(src string) ([]condToken, error) {
+	var tokens []condToken
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsDigit(c) || c == '.' && i+1 < len(src) && unicode.IsDigit(rune(src[i+1])):
+			j := i
+			for j < len(src) && (unicode.IsDigit(rune(src[j])) || src[j] == '.' || src[j] == '_') {
+				j++
+			}
+			v, err := strconv.ParseFloat(strings.ReplaceAll(src[i:j], "_", ""), 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad number %q", src[i:j])
+			}
+			tokens = append(tokens, condToken{kind: 'n', text: src[i:j], value: v})
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(src) && (unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j])) || src[j] == '_' || src[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, condToken{kind: 'i', text: src[i:j]})
+			i = j
+		default:
+			op := ""
+			for _, candidate := range []string{"==", "!=", "<=", ">=", "<<", ">>", "//", "<", ">", "&", "|", "^", "~", "+", "-", "*", "/", "%", "(", ")"} {
+				if strings.HasPrefix(src[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q", src[i:i+1])
+			}
+			tokens = append(tokens, condToken{kind: 'o', text: op})
+			i += len(op)
+		}
+	}
+	return tokens, nil
+}
+
+type condParser struct {
+	tokens []condToken
+	pos    int
+	names  map[string]bool
+	known  map[string]bool
+}
+
+// compileCondition parses a condition, which may only refer to known names.
+func compileCondition(src string, known map[string]bool) (*Condition, error) {
+	tokens, err := tokenizeCondition(src)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %w", src, err)
+	}
+
+	p := &condParser{tokens: tokens, names: make(map[string]bool), known: known}
+	root, err := p.or()
+	if err == nil && p.pos != len(p.tokens) {
+		err = fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%q: %w", src, err)
+	}
+	return &Condition{source: src, root: root, names: p.names}, nil
+}
+
+func (p *condParser) peek(text string) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind != 'n' && p.tokens[p.pos].text == text
+}
+
+func (p *condParser) accept(texts ...string) (string, bool) {
+	for _, text := range texts {
+		if p.peek(text) {
+			p.pos++
+			return text, true
+		}
+	}
+	return "", false
+}
+
+func truth(v bool) float64 {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+// or & and return their deciding operand, as in python
+func (p *condParser) or() (condNode, error) {
+	left, err := p.and()
+	for err == nil {
+		if _, ok := p.accept("or"); !ok {
+			return left, nil
+		}
+		var right condNode
+		if right, err = p.and(); err != nil {
+			break
+		}
+		l := left
+		left = func(env condEnv) (float64, error) {
+			v, err := l(env)
+			if err != nil || v != 0 {
+				return v, err
+			}
+			return right(env)
+		}
+	}
+	return nil, err
+}
+
+func (p *condParser) and() (condNode, error) {
+	left, err := p.not()
+	for err == nil {
+		if _, ok := p.accept("and"); !ok {
+			return left, nil
+		}
+		var right condNode
+		if right, err = p.not(); err != nil {
+			break
+		}
+		l := left
+		left = func(env condEnv) (float64, error) {
+			v, err := l(env)
+			if err != nil || v == 0 {
+				return v, err
+			}
+			return right(env)
+		}
+	}
+	return nil, err
+}
+
+func (p *condParser) not() (condNode, error) {
+	if _, ok := p.accept("not"); ok {
+		operand, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return func(env condEnv) (float64, error) {
+			v, err := operand(env)
+			return truth(v == 0), err
+		}, nil
+	}
+	return p.comparison()
+}
+
+// comparison handles chains like 1 <= x < 2, meaning 1 <= x and x < 2
+func (p *condParser) comparison() (condNode, error) {
+	first, err := p.binary(0)
+	if err != nil {
+		return nil, err
+	}
+
+	var ops []string
+	operands := []condNode{first}
+	for {
+		op, ok := p.accept("==", "!=", "<=", ">=", "<", ">")
+		if !ok {
+			break
+		}
+		operand, err := p.binary(0)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+		operands = append(operands, operand)
+	}
+	if len(ops) == 0 {
+		return first, nil
+	}
+
+	return func(env condEnv) (float64, error) {
+		left, err := operands[0](env)
+		if err != nil {
+			return 0, err
+		}
+		for i, op := range ops {
+			right, err := operands[i+1](env)
+			if err != nil {
+				return 0, err
+			}
+			var holds bool
+			switch op {
+			case "==":
+				holds = left == right
+			case "!=":
+				holds = left != right
+			case "<=":
+				holds = left <= right
+			case ">=":
+				holds = left >= right
+			case "<":
+				holds = left < right
+			case ">":
+				holds = left > right
+			}
+			if !holds {
+				return 0, nil
+			}
+			left = right
+		}
+		return 1, nil
+	}, nil
+}
+
+// the binary operators, from loosest to tightest
+var condPrecedence = [][]string{
+	{"|"},
+	{"^"},
+	{"&"},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/", "//", "%"},
+}
+
+func (p *condParser) binary(level int) (condNode, error) {
+	if level == len(condPrecedence) {
+		return p.unary()
+	}
+
+	left, err := p.binary(level + 1)
+	for err == nil {
+		op, ok := p.accept(condPrecedence[level]...)
+		if !ok {
+			return left, nil
+		}
+		var right condNode
+		if right, err = p.binary(level + 1); err != nil {
+			break
+		}
+		l := left
+		left = func(env condEnv) (float64, error) {
+			a, err := l(env)
+			if err != nil {
+				return 0, err
+			}
+			b, err := right(env)
+			if err != nil {
+				return 0, err
+			}
+			return applyCondOperator(op, a, b)
+		}
+	}
+	return nil, err
+}
+
+func applyCondOperator(op string, a, b float64) (float64, error) {
+	switch op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	}
+
+	if b == 0 && (op == "/" || op == "//" || op == "%") {
+		return 0, fmt.Errorf("division by zero")
+	}
+	switch op {
+	case "/":
+		return a / b, nil
+	case "//":
+		return math.Floor(a / b), nil
+	case "%":
+		return a - b*math.Floor(a/b), nil
+	}
+
+	// bitwise operators only work on integers in python
+	if a != math.Trunc(a) || b != math.Trunc(b) {
+		return 0, fmt.Errorf("unsupported operand for %s: %v, %v", op, a, b)
+	}
+	x, y := int64(a), int64(b)
+	switch op {
+	case "|":
+		return float64(x | y), nil
+	case "^":
+		return float64(x ^ y), nil
+	case "&":
+		return float64(x & y), nil
+	case "<<":
+		return float64(x << uint64(y)), nil
+	case ">>":
+		return float64(x >> uint64(y)), nil
+	}
+	return 0, fmt.Errorf("unknown operator %s", op)
+}
+
+func (p *condParser) unary() (condNode, error) {
+	if op, ok := p.accept("-", "+", "~"); ok {
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(env condEnv) (float64, error) {
+			v, err := operand(env)
+			switch op {
+			case "-":
+				v = -v
+			case "~":
+				v = float64(^int64(v))
+			}
+			return v, err
+		}, nil
+	}
+	return p.atom()
+}
+
+func (p *condParser) atom() (condNode, error) {
+	if p.pos == len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end of condition")
+	}
+	token := p.tokens[p.pos]
+	p.pos++
+
+	switch {
+	case token.kind == 'n':
+		return func(condEnv) (float64, error) { return token.value, nil }, nil
+	case token.kind == 'o' && token.text == "(":
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.accept(")"); !ok {
+			return nil, fmt.Errorf("missing )")
+		}
+		return inner, nil
+	case token.kind == 'i' && (token.text == "True" || token.text == "False"):
+		v := truth(token.text == "True")
+		return func(condEnv) (float64, error) { return v, nil }, nil
+	case token.kind == 'i':
+		if !p.known[token.text] {
+			return nil, fmt.Errorf("unknown name %s", token.text)
+		}
+		p.names[token.text] = true
+		return func(env condEnv) (float64, error) { return env(token.text) }, nil
+	}
+	return nil, fmt.Errorf("unexpected %q", token.text)
+}
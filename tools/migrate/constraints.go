@@ -0,0 +1,373 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// bancho.py's schema has no foreign keys, which is how orphaned rows come
+// about (see fsck.go). as an opt-in hardening step, constraints check finds
+// the rows which would violate the foreign keys below, and constraints add
+// adds every foreign key which nothing violates. constraints drop removes
+// them again, e.g. before running a bancho.py migration which doesn't expect
+// them.
+//
+// deleting a user is restricted rather than cascaded, as it would otherwise
+// silently take their scores along. maps have no foreign keys pointing at
+// them, as scores outlive the maps they were set on, when a map is updated.
+
+// ForeignKey is a column which references another table's.
+type ForeignKey struct {
+	Table     string
+	Column    string
+	RefTable  string
+	RefColumn string
+}
+
+func (fk ForeignKey) Name() string {
+	return fmt.Sprintf("fk_%s_%s_%s", fk.Table, fk.Column, fk.RefTable)
+}
+
+func (fk ForeignKey) String() string {
+	return fmt.Sprintf("%s.%s -> %s.%s", fk.Table, fk.Column, fk.RefTable, fk.RefColumn)
+}
+
+var foreignKeys = []ForeignKey{
+	{"scores", "userid", "users", "id"},
+	{"stats", "id", "users", "id"},
+	{"favourites", "userid", "users", "id"},
+	{"ratings", "userid", "users", "id"},
+	{"comments", "userid", "users", "id"},
+	{"relationships", "user1", "users", "id"},
+	{"relationships", "user2", "users", "id"},
+	{"mail", "from_id", "users", "id"},
+	{"mail", "to_id", "users", "id"},
+	{"ingame_logins", "userid", "users", "id"},
+	{"client_hashes", "userid", "users", "id"},
+	{"map_requests", "player_id", "users", "id"},
+	{"user_achievements", "userid", "users", "id"},
+	{"user_achievements", "achid", "achievements", "id"},
+	{"tourney_pool_maps", "pool_id", "tourney_pools", "id"},
+}
+
+// constraintExamples is how many violating values are listed per key.
+const constraintExamples = 10
+
+// ConstraintCheck is whether a foreign key can be added.
+type ConstraintCheck struct {
+	Key        string   `json:"key"`
+	Name       string   `json:"name"`
+	Exists     bool     `json:"exists"`
+	Problems   []string `json:"problems"`   // which stop it from being added
+	Violations int64    `json:"violations"` // rows referencing nothing
+	Examples   []string `json:"examples"`   // of the values they reference
+
+	fk ForeignKey
+}
+
+func (c *ConstraintCheck) OK() bool {
+	return len(c.Problems) == 0 && c.Violations == 0
+}
+
+type ConstraintsReport struct {
+	Checks []*ConstraintCheck `json:"checks"`
+}
+
+var errConstraintsViolated = errors.New("some foreign keys can't be added")
+
+// foreignKeyCompatible reports whether mysql accepts a foreign key between
+// two columns, which must be of the same type, sign & charset.
+func foreignKeyCompatible(column, ref ColumnSchema) bool {
+	if column.DataType != ref.DataType || column.Unsigned() != ref.Unsigned() {
+		return false
+	}
+	return column.Charset == ref.Charset
+}
+
+// existingForeignKeys returns the names of the database's foreign keys,
+// by the column they're on & the column they reference.
+func existingForeignKeys() (map[ForeignKey]string, error) {
+	var rows []struct {
+		Name      string `db:"constraint_name"`
+		Table     string `db:"table_name"`
+		Column    string `db:"column_name"`
+		RefTable  string `db:"referenced_table_name"`
+		RefColumn string `db:"referenced_column_name"`
+	}
+	err := DB.Select(&rows, `
+	SELECT constraint_name AS constraint_name, table_name AS table_name, column_name AS column_name,
+	       referenced_table_name AS referenced_table_name, referenced_column_name AS referenced_column_name
+	FROM information_schema.key_column_usage
+	WHERE table_schema = DATABASE() AND referenced_table_name IS NOT NULL`)
+	if err != nil {
+		return nil, err
+	}
+
+	existing := make(map[ForeignKey]string, len(rows))
+	for _, row := range rows {
+		existing[ForeignKey{row.Table, row.Column, row.RefTable, row.RefColumn}] = row.Name
+	}
+	return existing, nil
+}
+
+// selectedForeignKeys returns the foreign keys picked with --only.
+func selectedForeignKeys() ([]ForeignKey, error) {
+	if cfg.ConstraintTables == "" {
+		return foreignKeys, nil
+	}
+
+	var selected []ForeignKey
+	for _, table := range strings.Split(cfg.ConstraintTables, ",") {
+		table = strings.TrimSpace(table)
+		found := false
+		for _, fk := range foreignKeys {
+			if fk.Table == table {
+				selected = append(selected, fk)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no foreign keys are defined on %q", table)
+		}
+	}
+	return selected, nil
+}
+
+// checkConstraints checks whether each foreign key can be added.
+func checkConstraints(keys []ForeignKey) ([]*ConstraintCheck, error) {
+	existing, err := existingForeignKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	var engines []struct {
+		Name   string `db:"table_name"`
+		Engine string `db:"engine"`
+	}
+	err = DB.Select(&engines, `
+	SELECT table_name AS table_name, COALESCE(engine, '') AS engine FROM information_schema.tables
+	WHERE table_schema = DATABASE() AND table_type = 'BASE TABLE'`)
+	if err != nil {
+		return nil, err
+	}
+	engine := make(map[string]string, len(engines))
+	for _, t := range engines {
+		engine[t.Name] = t.Engine
+	}
+
+	schemas, err := loadTableSchemas(cfg.DBName, nil)
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]ColumnSchema)
+	for _, t := range schemas {
+		for _, c := range t.Columns {
+			columns[t.Name+"."+c.Name] = c
+		}
+	}
+
+	checks := make([]*ConstraintCheck, 0, len(keys))
+	for _, fk := range keys {
+		check := &ConstraintCheck{Key: fk.String(), Name: fk.Name(), Problems: []string{}, Examples: []string{}, fk: fk}
+		checks = append(checks, check)
+		if _, ok := existing[fk]; ok {
+			check.Exists = true
+			continue
+		}
+
+		column, columnOK := columns[fk.Table+"."+fk.Column]
+		ref, refOK := columns[fk.RefTable+"."+fk.RefColumn]
+		switch {
+		case !columnOK:
+			check.Problems = append(check.Problems, fmt.Sprintf("%s.%s doesn't exist", fk.Table, fk.Column))
+		case !refOK:
+			check.Problems = append(check.Problems, fmt.Sprintf("%s.%s doesn't exist", fk.RefTable, fk.RefColumn))
+		case !foreignKeyCompatible(column, ref):
+			check.Problems = append(check.Problems, fmt.Sprintf("%s.%s is %s, but %s.%s is %s",
+				fk.Table, fk.Column, column.ColumnType, fk.RefTable, fk.RefColumn, ref.ColumnType))
+		}
+		for _, table := range []string{fk.Table, fk.RefTable} {
+			if e := engine[table]; e != "" && !strings.EqualFold(e, "InnoDB") {
+				check.Problems = append(check.Problems, fmt.Sprintf("%s uses %s, which doesn't support foreign keys", table, e))
+			}
+		}
+		if len(check.Problems) != 0 {
+			continue
+		}
+
+		violating := fmt.Sprintf(`
+		FROM %s c WHERE c.%s IS NOT NULL AND NOT EXISTS (
+			SELECT 1 FROM %s r WHERE r.%s = c.%s
+		)`, fk.Table, fk.Column, fk.RefTable, fk.RefColumn, fk.Column)
+		if err := DB.Get(&check.Violations, "SELECT COUNT(*)"+violating); err != nil {
+			return nil, fmt.Errorf("failed to check %s: %w", fk, err)
+		}
+		if check.Violations != 0 {
+			err := DB.Select(&check.Examples, fmt.Sprintf("SELECT DISTINCT CAST(c.%s AS CHAR) %s LIMIT %d",
+				fk.Column, violating, constraintExamples))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return checks, nil
+}
+
+func printConstraintChecks(checks []*ConstraintCheck) {
+	for _, check := range checks {
+		switch {
+		case check.Exists:
+			fmt.Printf("%-45s exists\n", check.Key)
+		case len(check.Problems) != 0:
+			fmt.Printf("%-45s error: %s\n", check.Key, strings.Join(check.Problems, "; "))
+		case check.Violations != 0:
+			fmt.Printf("%-45s %d rows reference nothing (e.g. %s)\n", check.Key, check.Violations, strings.Join(check.Examples, ", "))
+		default:
+			fmt.Printf("%-45s ok\n", check.Key)
+		}
+	}
+}
+
+func runConstraintsCheck() error {
+	keys, err := selectedForeignKeys()
+	if err != nil {
+		return err
+	}
+	checks, err := checkConstraints(keys)
+	if err != nil {
+		return err
+	}
+	printConstraintChecks(checks)
+	if err := writeReport(cfg.ReportPath, ConstraintsReport{checks}); err != nil {
+		return err
+	}
+
+	for _, check := range checks {
+		if !check.Exists && !check.OK() {
+			fmt.Println("\nthe violating rows must be fixed or removed first, `migrate fsck` removes the scores & stats of deleted users")
+			return errConstraintsViolated
+		}
+	}
+	return nil
+}
+
+func runConstraintsAdd() error {
+	keys, err := selectedForeignKeys()
+	if err != nil {
+		return err
+	}
+	checks, err := checkConstraints(keys)
+	if err != nil {
+		return err
+	}
+	printConstraintChecks(checks)
+	if err := writeReport(cfg.ReportPath, ConstraintsReport{checks}); err != nil {
+		return err
+	}
+
+	// each table is altered once, adding all of its foreign keys together
+	byTable := make(map[string][]string)
+	skipped := 0
+	for _, check := range checks {
+		switch {
+		case check.Exists:
+		case !check.OK():
+			skipped++
+		default:
+			fk := check.fk
+			byTable[fk.Table] = append(byTable[fk.Table], fmt.Sprintf(
+				"ADD CONSTRAINT %s FOREIGN KEY (%s) REFERENCES %s (%s) ON DELETE RESTRICT ON UPDATE CASCADE",
+				fk.Name(), fk.Column, fk.RefTable, fk.RefColumn))
+		}
+	}
+	tables := make([]string, 0, len(byTable))
+	for table := range byTable {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	added := 0
+	for _, table := range tables {
+		stmt := fmt.Sprintf("ALTER TABLE %s %s", table, strings.Join(byTable[table], ", "))
+		if cfg.DryRun {
+			fmt.Printf("%s;\n", stmt)
+			continue
+		}
+		if _, err := DB.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to add foreign keys to %s: %w", table, err)
+		}
+		added += len(byTable[table])
+		logger.Info("added foreign keys", "table", table, "keys", len(byTable[table]))
+	}
+
+	logger.Info("finished adding foreign keys", "added", added, "skipped", skipped, "dry_run", cfg.DryRun)
+	if skipped != 0 {
+		return errConstraintsViolated
+	}
+	return nil
+}
+
+func runConstraintsDrop() error {
+	keys, err := selectedForeignKeys()
+	if err != nil {
+		return err
+	}
+	existing, err := existingForeignKeys()
+	if err != nil {
+		return err
+	}
+
+	dropped := 0
+	for _, fk := range keys {
+		name, ok := existing[fk]
+		if !ok || name != fk.Name() {
+			// only the keys added by constraints add are dropped
+			continue
+		}
+		stmt := fmt.Sprintf("ALTER TABLE %s DROP FOREIGN KEY %s", fk.Table, name)
+		if cfg.DryRun {
+			fmt.Printf("%s;\n", stmt)
+			continue
+		}
+		if _, err := DB.Exec(stmt); err != nil {
+			return err
+		}
+		dropped++
+	}
+	logger.Info("dropped foreign keys", "dropped", dropped, "dry_run", cfg.DryRun)
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "constraints check",
+		Summary: "find the rows which stop foreign keys from being added to bancho.py's tables",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.ConstraintTables, "only", "", "only check the foreign keys on these tables, comma separated (default: every table)")
+			flags.StringVar(&c.ReportPath, "report", "", "write the checks as json to this path (- for stdout)")
+		},
+		Run: runConstraintsCheck,
+	})
+	registerCommand(&Command{
+		Name:    "constraints add",
+		Summary: "add foreign keys to bancho.py's tables, wherever nothing violates them",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.ConstraintTables, "only", "", "only add the foreign keys on these tables, comma separated (default: every table)")
+			flags.BoolVar(&c.DryRun, "dry-run", false, "print the statements adding the foreign keys, without running them")
+			flags.StringVar(&c.ReportPath, "report", "", "write the checks as json to this path (- for stdout)")
+		},
+		Run: runConstraintsAdd,
+	})
+	registerCommand(&Command{
+		Name:    "constraints drop",
+		Summary: "drop the foreign keys added by constraints add",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.ConstraintTables, "only", "", "only drop the foreign keys on these tables, comma separated (default: every table)")
+			flags.BoolVar(&c.DryRun, "dry-run", false, "print the statements dropping the foreign keys, without running them")
+		},
+		Run: runConstraintsDrop,
+	})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// a TableConverter copies one table of an older gulag (or bancho.py)
+// database into the current schema. converters run after the converters
+// of the tables they depend on, e.g. stats after users, so that rows can
+// be joined against what was already imported, and orphans left behind.
+
+type TableConverter struct {
+	Table     string   // the table in bancho.py's schema
+	DependsOn []string // tables which must be converted first
+	Create    string   // run first, for tables which aren't in base.sql
+
+	// Convert copies the table's rows, returning how many were copied.
+	// converters must be safe to run again, as imports can be resumed.
+	Convert func(src *OldSchema) (int64, error)
+}
+
+var tableConverters = map[string]*TableConverter{}
+
+// registerTableConverter makes a table importable, and is intended to be
+// called from init functions.
+func registerTableConverter(c *TableConverter) {
+	if _, exists := tableConverters[c.Table]; exists {
+		panic("table converter registered twice: " + c.Table)
+	}
+	tableConverters[c.Table] = c
+}
+
+// converterOrder sorts the converters so each runs after its dependencies.
+// independent tables are ordered by name, so the order is always the same.
+func converterOrder() ([]*TableConverter, error) {
+	names := make([]string, 0, len(tableConverters))
+	for name, c := range tableConverters {
+		for _, dep := range c.DependsOn {
+			if tableConverters[dep] == nil {
+				return nil, fmt.Errorf("%s depends on %s, which has no converter", name, dep)
+			}
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	done := make(map[string]bool, len(names))
+	order := make([]*TableConverter, 0, len(names))
+	for len(order) < len(names) {
+		progressed := false
+		for _, name := range names {
+			c := tableConverters[name]
+			if done[name] {
+				continue
+			}
+
+			ready := true
+			for _, dep := range c.DependsOn {
+				ready = ready && done[dep]
+			}
+			if ready {
+				done[name] = true
+				order = append(order, c)
+				progressed = true
+			}
+		}
+
+		if !progressed {
+			var cycle []string
+			for _, name := range names {
+				if !done[name] {
+					cycle = append(cycle, name)
+				}
+			}
+			return nil, fmt.Errorf("table converters have a dependency cycle between %s", strings.Join(cycle, ", "))
+		}
+	}
+	return order, nil
+}
+
+// OldSchema describes the database being imported from, on the same mysql
+// server. its tables & columns depend on the version it was last run with,
+// so converters check what's there rather than assuming a version.
+type OldSchema struct {
+	Name    string
+	columns map[string]map[string]bool // table -> its columns
+
+	// the scores tables, read through the score pipeline
+	ScoreTables []SourceTable
+}
+
+func loadOldSchema(name string) (*OldSchema, error) {
+	var rows []struct {
+		Table  string `db:"table_name"`
+		Column string `db:"column_name"`
+	}
+	err := DB.Select(&rows, `
+	SELECT table_name AS table_name, column_name AS column_name
+	FROM information_schema.columns WHERE table_schema = ?`, name)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &OldSchema{Name: name, columns: make(map[string]map[string]bool)}
+	for _, row := range rows {
+		table := strings.ToLower(row.Table)
+		if s.columns[table] == nil {
+			s.columns[table] = make(map[string]bool)
+		}
+		s.columns[table][strings.ToLower(row.Column)] = true
+	}
+	return s, nil
+}
+
+// Table returns the qualified name of one of the old database's tables.
+func (s *OldSchema) Table(name string) string {
+	return s.Name + "." + name
+}
+
+func (s *OldSchema) Has(table string) bool {
+	return s.columns[table] != nil
+}
+
+func (s *OldSchema) HasColumn(table, column string) bool {
+	return s.columns[table][column]
+}
+
+// Column selects a column of a table if it exists, or the fallback if it
+// doesn't, as each was added in a different version.
+func (s *OldSchema) Column(table, prefix, column, fallback string) string {
+	return optionalColumn(s.columns[table], prefix, column, fallback)
+}
+
+// copyRows runs an INSERT ... SELECT (or an UPDATE ... JOIN) from another
+// database, returning how many rows it wrote. it often copies a whole table
+// at once, so it can't be throttled by its rows up front; it waits for the
+// database to be quiet, and its rows count towards --max-rows-per-sec
+// afterwards, holding back whatever's written next.
+func copyRows(query string, args ...interface{}) (int64, error) {
+	if err := throttle(0); err != nil {
+		return 0, err
+	}
+	res, err := DB.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return n, throttle(int(n))
+}
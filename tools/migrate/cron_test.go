@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"@yearly",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"1-x * * * *",
+		"1,,2 * * * *",
+	} {
+		if _, err := parseSchedule(expr); err == nil {
+			t.Errorf("parseSchedule(%q) succeeded, want an error", expr)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	at := func(s string) time.Time {
+		t.Helper()
+		v, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	// 2024-01-01 is a monday
+	for _, tt := range []struct {
+		expr, from, want string
+	}{
+		{"*/15 * * * *", "2024-01-01 00:07", "2024-01-01 00:15"},
+		{"* * * * *", "2024-01-01 00:07", "2024-01-01 00:08"},
+		{"0 0 * * *", "2024-01-01 00:00", "2024-01-02 00:00"},
+		{"@daily", "2024-01-01 23:59", "2024-01-02 00:00"},
+		{"@hourly", "2024-01-01 10:30", "2024-01-01 11:00"},
+		{"@weekly", "2024-01-01 00:00", "2024-01-07 00:00"},
+		{"@monthly", "2024-01-15 00:00", "2024-02-01 00:00"},
+		{"5/20 * * * *", "2024-01-01 00:26", "2024-01-01 00:45"},
+		{"0 9-17/4 * * *", "2024-01-01 13:01", "2024-01-01 17:00"},
+		{"30 4 1,15 * *", "2024-01-02 00:00", "2024-01-15 04:30"},
+		{"0 12 * * 7", "2024-01-01 00:00", "2024-01-07 12:00"},
+		{"0 12 * * 0", "2024-01-01 00:00", "2024-01-07 12:00"},
+		{"0 0 * * 1-5", "2024-01-05 12:00", "2024-01-08 00:00"},
+		// when both days are given, either matches
+		{"0 0 13 * 5", "2024-01-01 00:00", "2024-01-05 00:00"},
+		{"0 0 29 2 *", "2024-03-01 00:00", "2028-02-29 00:00"},
+	} {
+		s, err := parseSchedule(tt.expr)
+		if err != nil {
+			t.Errorf("parseSchedule(%q) = %v", tt.expr, err)
+			continue
+		}
+		if got := s.next(at(tt.from)); !got.Equal(at(tt.want)) {
+			t.Errorf("parseSchedule(%q).next(%s) = %s, want %s", tt.expr, tt.from, got.Format("2006-01-02 15:04"), tt.want)
+		}
+	}
+}
+
+func TestScheduleNever(t *testing.T) {
+	s, err := parseSchedule("0 0 31 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.next(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)); !got.IsZero() {
+		t.Errorf("the 31st of february is next at %v, want never", got)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// backups are encrypted with aes-256-gcm, in chunks so that they can be
+// streamed: a header of the magic & a random 8 byte nonce prefix, then each
+// chunk of up to encryptChunkSize bytes sealed with the prefix & the
+// chunk's number as its nonce. the last chunk is sealed with "last" as its
+// additional data, so a truncated backup fails to decrypt, rather than
+// looking complete.
+
+const (
+	encryptMagic     = "BPYENC01"
+	encryptChunkSize = 64 * 1024
+)
+
+var errBackupKey = errors.New("the backup can't be decrypted with this key, or is corrupt")
+
+// loadEncryptionKey reads a key file, of 64 hex characters (e.g. made by
+// `openssl rand -hex 32`).
+func loadEncryptionKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s must hold a 32 byte key as 64 hex characters, e.g. from `openssl rand -hex 32`", path)
+	}
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type encryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	nonce  []byte
+	chunk  uint32
+	buf    []byte
+	sealed []byte
+}
+
+// newEncryptWriter encrypts everything written to it into w. it must be
+// closed to write the last chunk, which doesn't close w.
+func newEncryptWriter(w io.Writer, key []byte) (io.WriteCloser, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce[:8]); err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, encryptMagic); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(nonce[:8]); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, nonce: nonce, buf: make([]byte, 0, encryptChunkSize)}, nil
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	var ad []byte
+	if last {
+		ad = []byte("last")
+	}
+	binary.BigEndian.PutUint32(e.nonce[8:], e.chunk)
+	e.chunk++
+	e.sealed = e.aead.Seal(e.sealed[:0], e.nonce, e.buf, ad)
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(e.sealed)
+	return err
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+		// a full chunk is only sealed once more follows, so that the last
+		// chunk is never sealed as if it wasn't
+		if len(e.buf) == cap(e.buf) && len(p) > 0 {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+type decryptReader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	nonce  []byte
+	chunk  uint32
+	sealed []byte
+	buf    []byte // decrypted, not yet read
+	done   bool
+}
+
+// newDecryptReader decrypts what newEncryptWriter wrote. reads fail with
+// errBackupKey if the key is wrong, or the data was altered or truncated.
+func newDecryptReader(r io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, len(encryptMagic)+8)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(encryptMagic)]) != encryptMagic {
+		return nil, errors.New("not an encrypted backup")
+	}
+	nonce := make([]byte, aead.NonceSize())
+	copy(nonce, header[len(encryptMagic):])
+	return &decryptReader{
+		r:      bufio.NewReaderSize(r, encryptChunkSize+aead.Overhead()+1),
+		aead:   aead,
+		nonce:  nonce,
+		sealed: make([]byte, encryptChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (d *decryptReader) open() error {
+	n, err := io.ReadFull(d.r, d.sealed)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		d.done = true
+	} else if err != nil {
+		return err
+	} else if _, err := d.r.Peek(1); err == io.EOF {
+		// a full chunk can be the last
+		d.done = true
+	}
+
+	var ad []byte
+	if d.done {
+		ad = []byte("last")
+	}
+	binary.BigEndian.PutUint32(d.nonce[8:], d.chunk)
+	d.chunk++
+	d.buf, err = d.aead.Open(d.buf[:0], d.nonce, d.sealed[:n], ad)
+	if err != nil {
+		return errBackupKey
+	}
+	return nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+func encryptForTest(t *testing.T, key, data []byte) []byte {
+	var buf bytes.Buffer
+	w, err := newEncryptWriter(&buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// in uneven writes, as backups are
+	for len(data) > 0 {
+		n := min(len(data), 10000)
+		if _, err := w.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decryptForTest(key, data []byte) ([]byte, error) {
+	r, err := newDecryptReader(bytes.NewReader(data), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	for _, size := range []int{0, 1, encryptChunkSize - 1, encryptChunkSize, encryptChunkSize + 1, 3*encryptChunkSize + 123} {
+		data := make([]byte, size)
+		rand.Read(data)
+		encrypted := encryptForTest(t, key, data)
+		got, err := decryptForTest(key, encrypted)
+		if err != nil {
+			t.Errorf("%d bytes: %v", size, err)
+		} else if !bytes.Equal(got, data) {
+			t.Errorf("%d bytes: decrypted %d different bytes", size, len(got))
+		}
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	data := make([]byte, 3*encryptChunkSize+123)
+	rand.Read(data)
+	encrypted := encryptForTest(t, key, data)
+
+	header := len(encryptMagic) + 8
+	sealedChunk := encryptChunkSize + 16
+	flipped := append([]byte{}, encrypted...)
+	flipped[header+sealedChunk+5] ^= 1
+	otherKey := make([]byte, 32)
+	rand.Read(otherKey)
+
+	for name, tt := range map[string]struct {
+		key, data []byte
+	}{
+		// cut where a chunk ends, so what's left looks whole
+		"truncated after a chunk":   {key, encrypted[:header+2*sealedChunk]},
+		"truncated after the first": {key, encrypted[:header+sealedChunk]},
+		"truncated mid chunk":       {key, encrypted[:header+sealedChunk+100]},
+		"last chunk dropped":        {key, encrypted[:len(encrypted)-123-16]},
+		"header only":               {key, encrypted[:header]},
+		"altered":                   {key, flipped},
+		"wrong key":                 {otherKey, encrypted},
+	} {
+		if _, err := decryptForTest(tt.key, tt.data); !errors.Is(err, errBackupKey) {
+			t.Errorf("%s: decrypting = %v, want errBackupKey", name, err)
+		}
+	}
+
+	if _, err := decryptForTest(key, []byte("not encrypted at all")); err == nil {
+		t.Error("decrypting plaintext succeeded")
+	}
+}
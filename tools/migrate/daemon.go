@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// daemon runs other commands on schedules, so one process (and one unit
+// file) replaces a crontab of them. the jobs are read from a json file:
+//
+//	{"jobs": [
+//	  {"name": "stats", "command": "recalc stats", "schedule": "0 4 * * *", "jitter": "10m"},
+//	  {"name": "leaderboards", "command": "cache rebuild", "schedule": "@hourly"},
+//	  {"name": "logs", "command": "logs rotate", "args": ["--older-than", "30"], "schedule": "@daily"},
+//	  {"name": "backup", "command": "backup", "args": ["--dir", "s3://backups/bpy"], "schedule": "30 3 * * *", "timeout": "4h"},
+//	  {"name": "beatmaps", "command": "beatmaps refresh", "schedule": "*/15 * * * *"}
+//	]}
+//
+// each job is run as its own process of this binary, with the daemon's
+// --config, --log-level & --log-format before its args. a job never
+// overlaps itself: runs which come due while it's still going are skipped,
+// and it holds a mysql lock (GET_LOCK) while running, so a second daemon,
+// say on a standby host, skips it too. jitter delays each run by up to that
+// long, so jobs scheduled alike don't all hit the database at once.
+//
+// how each job last went is exposed on --metrics-addr, for alerting on jobs
+// which fail, or haven't succeeded in too long.
+
+// jobs still running at shutdown are interrupted, then killed after this
+const jobStopTimeout = time.Minute
+
+// DaemonJobsFile is the daemon's --jobs file.
+type DaemonJobsFile struct {
+	Jobs []DaemonJob `json:"jobs"`
+}
+
+// DaemonJob is a command run on a schedule.
+type DaemonJob struct {
+	Name     string   `json:"name"`
+	Command  string   `json:"command"`
+	Args     []string `json:"args"`
+	Schedule string   `json:"schedule"`
+	Jitter   string   `json:"jitter"`  // a duration, e.g. 10m
+	Timeout  string   `json:"timeout"` // a duration, none by default
+
+	schedule *Schedule
+	jitter   time.Duration
+	timeout  time.Duration
+}
+
+var (
+	metricJobRuns = newCounter("migrate_daemon_job_runs_total",
+		"Scheduled job runs, by result: succeeded, warnings, failed, interrupted, locked or overlapped.", "job", "result")
+	metricJobRunning = newGauge("migrate_daemon_job_running",
+		"Whether the job is running.", "job")
+	metricJobLastSuccess = newGauge("migrate_daemon_job_last_success_timestamp_seconds",
+		"When the job last succeeded, as a unix time.", "job")
+	metricJobLastDuration = newGauge("migrate_daemon_job_last_duration_seconds",
+		"How long the job's last run took.", "job")
+	metricJobNextRun = newGauge("migrate_daemon_job_next_run_timestamp_seconds",
+		"When the job is next due, as a unix time.", "job")
+)
+
+// loadDaemonJobs reads & checks the jobs file.
+func loadDaemonJobs(path string) ([]*DaemonJob, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file DaemonJobsFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(file.Jobs) == 0 {
+		return nil, fmt.Errorf("%s: there are no jobs", path)
+	}
+
+	names := make(map[string]bool)
+	jobs := make([]*DaemonJob, len(file.Jobs))
+	for i := range file.Jobs {
+		job := &file.Jobs[i]
+		if job.Name == "" || names[job.Name] {
+			return nil, fmt.Errorf("%s: job %d needs a unique name", path, i+1)
+		}
+		names[job.Name] = true
+
+		cmd, rest := findCommand(strings.Fields(job.Command))
+		if cmd == nil || len(rest) != 0 {
+			return nil, fmt.Errorf("%s: job %s: %q isn't a command", path, job.Name, job.Command)
+		} else if cmd.Name == "daemon" || cmd.Name == "api serve" || strings.HasSuffix(cmd.Name, " daemon") {
+			return nil, fmt.Errorf("%s: job %s: %s runs until stopped, so can't be scheduled", path, job.Name, cmd.Name)
+		}
+		if job.schedule, err = parseSchedule(job.Schedule); err != nil {
+			return nil, fmt.Errorf("%s: job %s: %w", path, job.Name, err)
+		}
+		for _, d := range []struct {
+			value string
+			into  *time.Duration
+		}{{job.Jitter, &job.jitter}, {job.Timeout, &job.timeout}} {
+			if d.value == "" {
+				continue
+			}
+			if *d.into, err = time.ParseDuration(d.value); err != nil || *d.into < 0 {
+				return nil, fmt.Errorf("%s: job %s: bad duration %q", path, job.Name, d.value)
+			}
+		}
+		jobs[i] = job
+	}
+	return jobs, nil
+}
+
+// lockJob takes the job's mysql lock, on a connection of its own, as the
+// lock is held by the session. it returns nil if another process has it.
+func lockJob(job *DaemonJob) (func(), error) {
+	ctx := context.Background()
+	conn, err := DB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	name := "bancho_migrate:" + job.Name
+	var locked *int
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 0)", name).Scan(&locked); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if locked == nil || *locked != 1 {
+		conn.Close()
+		return nil, nil
+	}
+	return func() {
+		conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", name)
+		conn.Close()
+	}, nil
+}
+
+// runJob runs the job once, as a process of its own, returning the result
+// for the runs metric.
+func runJob(ctx context.Context, job *DaemonJob) (string, error) {
+	unlock, err := lockJob(job)
+	if err != nil {
+		return "failed", fmt.Errorf("failed to take the job's lock: %w", err)
+	} else if unlock == nil {
+		return "locked", nil
+	}
+	defer unlock()
+
+	self, err := os.Executable()
+	if err != nil {
+		return "failed", err
+	}
+	args := append(strings.Fields(job.Command), "--log-level", cfg.LogLevel, "--log-format", cfg.LogFormat)
+	if cfg.ConfigPath != "" {
+		args = append(args, "--config", cfg.ConfigPath)
+	}
+	args = append(args, job.Args...)
+
+	if job.timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, job.timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, self, args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	// the job stops as if ctrl+c'd, finishing what it's in the middle of
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = jobStopTimeout
+
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return "succeeded", nil
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == exitWarnings:
+		return "warnings", nil
+	case errors.Is(ctx.Err(), context.Canceled):
+		return "interrupted", nil
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return "failed", fmt.Errorf("timed out after %s", job.timeout)
+	}
+	return "failed", err
+}
+
+// scheduleJob runs the job each time it's due, until the daemon's stopped.
+func scheduleJob(ctx context.Context, job *DaemonJob) {
+	for {
+		next := job.schedule.next(time.Now())
+		if next.IsZero() {
+			logger.Error("the job's schedule never runs", "job", job.Name, "schedule", job.Schedule)
+			return
+		}
+		if job.jitter > 0 {
+			next = next.Add(time.Duration(rand.Int63n(int64(job.jitter))))
+		}
+		metricJobNextRun.Set(float64(next.Unix()), job.Name)
+		logger.Debug("waiting for the job's next run", "job", job.Name, "at", next.Format(time.RFC3339))
+
+		select {
+		case <-time.After(time.Until(next)):
+		case <-ctx.Done():
+			return
+		}
+
+		logger.Info("running job", "job", job.Name, "command", job.Command)
+		start := time.Now()
+		metricJobRunning.Set(1, job.Name)
+		result, err := runJob(ctx, job)
+		metricJobRunning.Set(0, job.Name)
+		metricJobRuns.Inc(job.Name, result)
+
+		elapsed := time.Since(start)
+		switch result {
+		case "locked":
+			logger.Warn("skipped the job, another process is running it", "job", job.Name)
+			continue
+		case "interrupted":
+			logger.Warn("job interrupted", "job", job.Name, "elapsed", elapsed.Round(time.Second))
+			return
+		case "succeeded", "warnings":
+			metricJobLastSuccess.Set(float64(time.Now().Unix()), job.Name)
+			logger.Info("job finished", "job", job.Name, "result", result, "elapsed", elapsed.Round(time.Second))
+		default:
+			logger.Error("job failed", "job", job.Name, "err", err, "elapsed", elapsed.Round(time.Second))
+		}
+		metricJobLastDuration.Set(elapsed.Seconds(), job.Name)
+
+		// runs which came due while this one was going are skipped
+		if due := job.schedule.next(start); !due.IsZero() && due.Before(time.Now()) && ctx.Err() == nil {
+			metricJobRuns.Inc(job.Name, "overlapped")
+			logger.Warn("the job took longer than its schedule allows, so runs were skipped", "job", job.Name)
+		}
+	}
+}
+
+func runDaemon() error {
+	if cfg.DaemonJobs == "" {
+		return errors.New("--jobs is required")
+	}
+	jobs, err := loadDaemonJobs(cfg.DaemonJobs)
+	if err != nil {
+		return err
+	}
+	if cfg.MetricsAddr == "" {
+		logger.Info("--metrics-addr isn't set, so the jobs' status is only logged")
+	}
+
+	handleSignals()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-interrupted
+		cancel()
+	}()
+
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		metricJobRunning.Set(0, job.Name)
+		wg.Add(1)
+		go func(job *DaemonJob) {
+			defer wg.Done()
+			scheduleJob(ctx, job)
+		}(job)
+	}
+	logger.Info("daemon started", "jobs", len(jobs))
+	wg.Wait()
+	logger.Info("daemon stopped")
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "daemon",
+		Summary: "run other commands (recalc stats, backup, logs rotate etc) on schedules, until stopped",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.DaemonJobs, "jobs", "", "json file of the jobs to run, and their schedules")
+		},
+		Run: runDaemon,
+	})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// DeadLetter is a row which could not be migrated, even after retrying.
+type DeadLetter struct {
+	Time  time.Time `json:"time"`
+	Table string    `json:"table"`
+	OldID int64     `json:"old_id"`
+	Error string    `json:"error"`
+	Score Score     `json:"score"` // the row as it was read from the old table
+}
+
+// DeadLetterFile collects failed rows, one json object per line, so that
+// nothing is lost quietly. it's only created once a row fails.
+type DeadLetterFile struct {
+	mu    sync.Mutex
+	path  string
+	f     *os.File
+	count int
+}
+
+var deadLetters *DeadLetterFile
+
+func newDeadLetterFile(path string) *DeadLetterFile {
+	return &DeadLetterFile{path: path}
+}
+
+// record appends rows to the file, and syncs it to disk.
+func (d *DeadLetterFile) record(letters []DeadLetter) error {
+	if d == nil || len(letters) == 0 {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.f == nil {
+		f, err := os.OpenFile(d.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open dead letter file: %w", err)
+		}
+		d.f = f
+	}
+
+	w := bufio.NewWriter(d.f)
+	encoder := json.NewEncoder(w)
+	for _, letter := range letters {
+		if err := encoder.Encode(letter); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	d.count += len(letters)
+	return d.f.Sync()
+}
+
+// Close closes the file, and warns about any rows which were written to it.
+func (d *DeadLetterFile) Close() error {
+	if d == nil || d.f == nil {
+		return nil
+	}
+	logger.Warn("some rows could not be migrated, they were written to the dead letter file",
+		"rows", d.count, "path", d.path)
+	return d.f.Close()
+}
+
+func failedRow(table SourceTable, score Score, err error) DeadLetter {
+	return DeadLetter{
+		Time:  time.Now(),
+		Table: table.Name,
+		OldID: score.ID,
+		Error: err.Error(),
+		Score: score,
+	}
+}
+
+// deadLetter records rows which failed to migrate. if even that fails,
+// the rows are logged in full as a last resort.
+func deadLetter(letters []DeadLetter) {
+	if err := deadLetters.record(letters); err != nil {
+		logger.Error("failed to write dead letters", "err", err)
+		for _, letter := range letters {
+			logger.Error("row could not be migrated", "table", letter.Table, "old_id", letter.OldID,
+				"err", letter.Error, "score", fmt.Sprintf("%+v", letter.Score))
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// dedupe scores removes scores which were migrated or imported more than
+// once, e.g. by running an import twice, or importing a server's scores
+// after migrating them. scores are duplicates when they match on every
+// column of a key, by default either the same online_checksum, or the same
+// player, map, mode, mods, score & play time.
+//
+// of each group of duplicates, one is kept, and the rest deleted along with
+// their replays, or with --archive, moved to the scores_duplicates table.
+// if the kept score is missing its replay, a duplicate's takes its place.
+// afterwards, the players' best scores & stats are recalculated.
+
+var defaultDedupeKeys = [][]string{
+	{"online_checksum"},
+	{"userid", "map_md5", "mode", "mods", "score", "play_time"},
+}
+
+// the order of each group's scores, the first of which is kept
+var dedupeKeepOrders = map[string]string{
+	"best":     "status DESC, pp DESC, score DESC, id",
+	"earliest": "play_time, id",
+}
+
+var select_duplicate_scores = `
+SELECT id, userid, mode, CONCAT_WS(0x1f, %[1]s) AS dedupe_key FROM scores
+WHERE %[2]s AND (%[1]s) IN (
+	SELECT %[1]s FROM scores WHERE %[2]s
+	GROUP BY %[1]s HAVING COUNT(*) > 1
+)
+ORDER BY %[1]s, %[3]s`
+
+var create_scores_duplicates = `
+create table if not exists scores_duplicates like scores;
+`
+
+var alter_scores_duplicates = `
+alter table scores_duplicates
+	add kept_id bigint unsigned not null,
+	add deduped_at datetime not null default current_timestamp;
+`
+
+type dedupeRow struct {
+	ID     int64
+	UserID int64 `db:"userid"`
+	Mode   int
+	Key    string `db:"dedupe_key"`
+}
+
+// Duplicate is a score which duplicates another, which is kept.
+type Duplicate struct {
+	ID     int64  `json:"id"`
+	KeptID int64  `json:"kept_id"`
+	Key    string `json:"key"`
+	UserID int64  `json:"-"`
+	Mode   int    `json:"-"`
+}
+
+type DedupeReport struct {
+	Groups     int         `json:"groups"`
+	Duplicates []Duplicate `json:"duplicates"`
+}
+
+// parseDedupeKey reads a key, a comma separated list of the scores' columns.
+func parseDedupeKey(value string) ([]string, error) {
+	valid := make(map[string]bool, len(scoreColumns))
+	for _, column := range scoreColumns[1:] {
+		valid[column] = true
+	}
+
+	var key []string
+	for _, column := range strings.Split(value, ",") {
+		column = strings.TrimSpace(column)
+		if !valid[column] {
+			return nil, fmt.Errorf("%q isn't a column of the scores table", column)
+		}
+		key = append(key, column)
+	}
+	return key, nil
+}
+
+// findDuplicates finds the scores duplicating another by a key, leaving
+// out the scores already found to be duplicates by an earlier key.
+func findDuplicates(key []string, removed map[int64]bool) ([]Duplicate, int, error) {
+	columns := strings.Join(key, ", ")
+	conditions := make([]string, len(key))
+	for i, column := range key {
+		conditions[i] = column + " IS NOT NULL"
+		if column == "online_checksum" {
+			// scores from before checksums were kept have an empty one
+			conditions[i] += " AND online_checksum != ''"
+		}
+	}
+
+	var rows []dedupeRow
+	err := DB.Select(&rows, fmt.Sprintf(select_duplicate_scores, columns,
+		strings.Join(conditions, " AND "), dedupeKeepOrders[cfg.DedupeKeep]))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var duplicates []Duplicate
+	groups := 0
+	var kept dedupeRow
+	for i, row := range rows {
+		if removed[row.ID] {
+			continue
+		}
+		if i == 0 || row.Key != kept.Key {
+			kept = row
+			continue
+		}
+		if len(duplicates) == 0 || duplicates[len(duplicates)-1].KeptID != kept.ID {
+			groups++
+		}
+		removed[row.ID] = true
+		duplicates = append(duplicates, Duplicate{ID: row.ID, KeptID: kept.ID, Key: columns, UserID: row.UserID, Mode: row.Mode})
+	}
+	return duplicates, groups, nil
+}
+
+// removeDuplicates deletes or archives a chunk of duplicates.
+func removeDuplicates(duplicates []Duplicate) error {
+	ids := make([]int64, len(duplicates))
+	for i, d := range duplicates {
+		ids[i] = d.ID
+	}
+	if err := throttle(len(ids)); err != nil {
+		return err
+	}
+
+	tx, err := DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if cfg.DedupeArchive {
+		for _, d := range duplicates {
+			_, err := tx.Exec("INSERT INTO scores_duplicates SELECT s.*, ?, NOW() FROM scores s WHERE s.id = ?", d.KeptID, d.ID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	query, args, err := sqlx.In("DELETE FROM scores WHERE id IN (?)", ids)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(query, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// reconcileReplays gives kept scores without a replay their duplicate's,
+// and unless archiving, deletes the duplicates' replays.
+func reconcileReplays(duplicates []Duplicate) (moved, deleted int) {
+	for _, d := range duplicates {
+		if _, err := newReplays.Stat(replayKey(d.ID)); err != nil {
+			continue
+		}
+
+		if _, err := newReplays.Stat(replayKey(d.KeptID)); errors.Is(err, os.ErrNotExist) {
+			done, err := relocateReplays("dedupe", "scores", []ReplayMove{{OldID: d.ID, NewID: d.KeptID}},
+				newReplays, oldReplayKey, newReplays, newReplayKey)
+			if err != nil {
+				logger.Warn("failed to move a duplicate's replay to the kept score", "id", d.ID, "kept_id", d.KeptID, "err", err)
+			}
+			moved += len(done)
+			continue
+		}
+
+		if !cfg.DedupeArchive {
+			if err := newReplays.Delete(replayKey(d.ID)); err != nil {
+				logger.Warn("failed to delete a duplicate's replay", "id", d.ID, "err", err)
+				continue
+			}
+			deleted++
+		}
+	}
+	return moved, deleted
+}
+
+// reconcileStats recalculates the best scores & stats of the players whose
+// scores were removed.
+func reconcileStats(duplicates []Duplicate) error {
+	users := make(map[int64]bool)
+	modes := make(map[int]map[int64]bool)
+	for _, d := range duplicates {
+		users[d.UserID] = true
+		if modes[d.Mode] == nil {
+			modes[d.Mode] = make(map[int64]bool)
+		}
+		modes[d.Mode][d.UserID] = true
+	}
+
+	// a removed duplicate may have been the best score on its map
+	cfg.RecalcMode = -1
+	counts := &statusCounts{}
+	for _, chunk := range userChunks(users) {
+		if err := recalculateStatuses(chunk, nil, counts); err != nil {
+			return err
+		}
+	}
+	for mode, users := range modes {
+		for _, chunk := range userChunks(users) {
+			if err := recalculateChunk(recalcChunk{Mode: mode, Users: chunk}); err != nil {
+				return err
+			}
+		}
+	}
+	logger.Info("recalculated the players' best scores & stats", "users", len(users),
+		"promoted", counts.Promoted, "demoted", counts.Demoted)
+	return nil
+}
+
+func runDedupeScores() error {
+	if _, ok := dedupeKeepOrders[cfg.DedupeKeep]; !ok {
+		return fmt.Errorf("unknown --keep %q, expected best or earliest", cfg.DedupeKeep)
+	}
+	keys := cfg.DedupeKeys
+	if len(keys) == 0 {
+		keys = defaultDedupeKeys
+	}
+	if err := setupReplayStores(); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	report := DedupeReport{Duplicates: []Duplicate{}}
+	removed := make(map[int64]bool)
+	for _, key := range keys {
+		duplicates, groups, err := findDuplicates(key, removed)
+		if err != nil {
+			return err
+		}
+		logger.Info("found duplicates", "key", strings.Join(key, ","), "groups", groups, "duplicates", len(duplicates))
+		report.Groups += groups
+		report.Duplicates = append(report.Duplicates, duplicates...)
+	}
+
+	// a score kept by one key may be a duplicate by a later one, in which
+	// case its duplicates are kept by whichever score it was kept by
+	keptBy := make(map[int64]int64, len(report.Duplicates))
+	for _, d := range report.Duplicates {
+		keptBy[d.ID] = d.KeptID
+	}
+	for i, d := range report.Duplicates {
+		for next, ok := keptBy[d.KeptID]; ok; next, ok = keptBy[next] {
+			report.Duplicates[i].KeptID = next
+		}
+	}
+
+	if err := writeReport(cfg.ReportPath, report); err != nil {
+		return err
+	}
+	if cfg.DryRun || len(report.Duplicates) == 0 {
+		logger.Info("nothing was changed", "duplicates", len(report.Duplicates), "dry_run", cfg.DryRun)
+		return nil
+	}
+
+	if cfg.DedupeArchive {
+		exists, err := tableExists("scores_duplicates")
+		if err != nil {
+			return err
+		}
+		if !exists {
+			for _, stmt := range []string{create_scores_duplicates, alter_scores_duplicates} {
+				if _, err := DB.Exec(stmt); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	duplicates := report.Duplicates
+	for len(duplicates) != 0 {
+		if isInterrupted() {
+			return errInterrupted
+		}
+		n := BatchSize
+		if n > len(duplicates) {
+			n = len(duplicates)
+		}
+		if err := removeDuplicates(duplicates[:n]); err != nil {
+			return err
+		}
+		duplicates = duplicates[n:]
+	}
+
+	// replays given to kept scores are journaled like any other move
+	var err error
+	replayJournal, err = openReplayJournal(cfg.ReplayJournalPath)
+	if err != nil {
+		return err
+	}
+	defer replayJournal.Close()
+
+	moved, deleted := reconcileReplays(report.Duplicates)
+	if err := reconcileStats(report.Duplicates); err != nil {
+		return err
+	}
+
+	logger.Info("removed duplicate scores", "groups", report.Groups, "duplicates", len(report.Duplicates),
+		"archived", cfg.DedupeArchive, "replays_moved", moved, "replays_deleted", deleted,
+		"elapsed", time.Since(start).Round(time.Second))
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:              "dedupe scores",
+		Summary:           "remove scores which were migrated or imported more than once",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.Func("key", "columns which duplicates share, e.g. userid,map_md5,score (repeatable, default: online_checksum, then userid,map_md5,mode,mods,score,play_time)", func(value string) error {
+				key, err := parseDedupeKey(value)
+				if err != nil {
+					return err
+				}
+				c.DedupeKeys = append(c.DedupeKeys, key)
+				return nil
+			})
+			flags.StringVar(&c.DedupeKeep, "keep", "best", "which of the duplicates to keep: best (by status & pp), or earliest")
+			flags.BoolVar(&c.DedupeArchive, "archive", false, "move the duplicates to scores_duplicates, keeping their replays, rather than deleting them")
+			flags.BoolVar(&c.DryRun, "dry-run", false, "report the duplicates without removing them")
+			flags.StringVar(&c.ReportPath, "report", "", "write the duplicates as json to this path (- for stdout)")
+			flags.StringVar(&c.NewReplays, "replays", "", "where the scores' replays are, a path or s3://bucket/prefix (default: DATA_DIRECTORY/osr)")
+		},
+		Run: runDedupeScores,
+	})
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// backups are kept in a directory, or streamed to object storage or another
+// server as they're taken, so the local disk needn't have room for them:
+//
+//	/srv/backups                 a local directory
+//	s3://bucket/prefix           s3-compatible storage, see S3_ENDPOINT
+//	b2://bucket/prefix           backblaze b2, with B2_APPLICATION_KEY_ID & B2_APPLICATION_KEY
+//	sftp://user@host:port/path   another server, over sftp through the ssh command
+//
+// large files are uploaded in parts of --part-size, each retried on its own.
+// a file only appears once it's completely uploaded & its checksum was
+// verified, and each backup's manifest is uploaded last.
+//
+// s3 objects are tagged with the backup's type (backup-type=full or
+// incremental) and --tags, so the bucket's lifecycle rules can expire or
+// archive them. b2's lifecycle rules only match prefixes, so there the
+// tags are kept as file info, and each policy needs its own prefix.
+
+// BackupDestination is where backups are kept.
+type BackupDestination interface {
+	// Create starts writing a file, which appears once committed.
+	Create(name string, tags map[string]string) (BackupUpload, error)
+	Open(name string) (io.ReadCloser, error)
+	// List lists the names of the files.
+	List() ([]string, error)
+	Delete(name string) error
+	Location(name string) string
+}
+
+// BackupUpload is a file being written to a destination.
+type BackupUpload interface {
+	io.Writer
+	Commit() error
+	Abort()
+}
+
+// openBackupDestination opens a destination from a path or url.
+func openBackupDestination(location string) (BackupDestination, error) {
+	u, err := url.Parse(location)
+	if err != nil || !strings.Contains(location, "://") {
+		return &LocalDestination{dir: location}, nil
+	}
+	switch u.Scheme {
+	case "s3":
+		store, err := openS3Store(location)
+		if err != nil {
+			return nil, err
+		}
+		return &S3Destination{client: store.client, prefix: store.prefix}, nil
+	case "b2":
+		return openB2Destination(u)
+	case "sftp":
+		return openSFTPDestination(u)
+	}
+	return nil, fmt.Errorf("unsupported backup destination %q, expected a path, s3://, b2:// or sftp://", location)
+}
+
+// retryUpload calls fn until it succeeds, up to --max-retries times, as
+// uploading a part again is harmless.
+func retryUpload(what string, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= cfg.MaxRetries {
+			return err
+		}
+		logger.Warn("upload failed, retrying", "what", what, "attempt", attempt+1, "err", err)
+		select {
+		case <-time.After(retryDelay(attempt)):
+		case <-interrupted:
+			return errInterrupted
+		}
+	}
+}
+
+// parseTags reads --tags, e.g. retention=monthly,server=eu.
+func parseTags(s string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, tag := range strings.Split(s, ",") {
+		if tag = strings.TrimSpace(tag); tag == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(tag, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("--tags %q must be key=value pairs, comma separated", s)
+		}
+		tags[k] = v
+	}
+	return tags, nil
+}
+
+// LocalDestination keeps backups in a directory.
+type LocalDestination struct {
+	dir string
+}
+
+type localUpload struct {
+	f    *os.File
+	path string
+}
+
+func (d *LocalDestination) Create(name string, _ map[string]string) (BackupUpload, error) {
+	p := filepath.Join(d.dir, name)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(p+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &localUpload{f: f, path: p}, nil
+}
+
+func (u *localUpload) Write(p []byte) (int, error) {
+	return u.f.Write(p)
+}
+
+func (u *localUpload) Commit() error {
+	err := u.f.Sync()
+	if closeErr := u.f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(u.path+".tmp", u.path)
+	}
+	if err != nil {
+		os.Remove(u.path + ".tmp")
+	}
+	return err
+}
+
+func (u *localUpload) Abort() {
+	u.f.Close()
+	os.Remove(u.path + ".tmp")
+}
+
+func (d *LocalDestination) Open(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(d.dir, name))
+}
+
+func (d *LocalDestination) List() ([]string, error) {
+	entries, err := os.ReadDir(d.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+func (d *LocalDestination) Delete(name string) error {
+	err := os.Remove(filepath.Join(d.dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (d *LocalDestination) Location(name string) string {
+	return filepath.Join(d.dir, name)
+}
+
+// S3Destination keeps backups as objects under a prefix of a bucket.
+type S3Destination struct {
+	client *S3Client
+	prefix string // either empty, or ending in a slash
+}
+
+// s3Upload buffers a part at a time. files smaller than a part are put in
+// one request, larger ones are uploaded in parts.
+type s3Upload struct {
+	d        *S3Destination
+	key      string
+	headers  map[string]string
+	buf      []byte
+	uploadID string
+	parts    []S3Part
+	md5s     []byte // each part's md5, for checking the object's etag
+}
+
+func (d *S3Destination) Create(name string, tags map[string]string) (BackupUpload, error) {
+	headers := map[string]string{"content-type": "application/octet-stream"}
+	if len(tags) != 0 {
+		values := url.Values{}
+		for k, v := range tags {
+			values.Set(k, v)
+		}
+		headers["x-amz-tagging"] = values.Encode()
+	}
+	return &s3Upload{
+		d:       d,
+		key:     d.prefix + name,
+		headers: headers,
+		buf:     make([]byte, 0, cfg.BackupPartSize<<20),
+	}, nil
+}
+
+func (u *s3Upload) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(u.buf[len(u.buf):cap(u.buf)], p)
+		u.buf = u.buf[:len(u.buf)+n]
+		p = p[n:]
+		written += n
+		if len(u.buf) == cap(u.buf) {
+			if err := u.uploadPart(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (u *s3Upload) uploadPart() error {
+	if u.uploadID == "" {
+		err := retryUpload(u.key, func() (err error) {
+			u.uploadID, err = u.d.client.CreateMultipartUpload(u.key, u.headers)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	n := len(u.parts) + 1
+	var part S3Part
+	err := retryUpload(fmt.Sprintf("%s part %d", u.key, n), func() (err error) {
+		part, err = u.d.client.UploadPart(u.key, u.uploadID, n, u.buf)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	sum := md5.Sum(u.buf)
+	u.md5s = append(u.md5s, sum[:]...)
+	u.parts = append(u.parts, part)
+	u.buf = u.buf[:0]
+	return nil
+}
+
+func (u *s3Upload) Commit() error {
+	// the body's sha256 is signed, so s3 rejects anything which didn't
+	// arrive intact
+	if u.uploadID == "" {
+		return retryUpload(u.key, func() error {
+			return u.d.client.Put(u.key, u.buf, u.headers)
+		})
+	}
+	if len(u.buf) != 0 {
+		if err := u.uploadPart(); err != nil {
+			u.Abort()
+			return err
+		}
+	}
+	var etag string
+	err := retryUpload(u.key, func() (err error) {
+		etag, err = u.d.client.CompleteMultipartUpload(u.key, u.uploadID, u.parts)
+		return err
+	})
+	if err != nil {
+		u.Abort()
+		return err
+	}
+
+	// a multipart object's etag is the md5 of its parts' md5s, which
+	// confirms the parts were assembled as uploaded. not every s3-compatible
+	// service follows this, so other etags aren't checked.
+	sum := md5.Sum(u.md5s)
+	expected := fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), len(u.parts))
+	if etag = strings.Trim(etag, `"`); strings.Contains(etag, "-") && etag != expected {
+		return fmt.Errorf("s3 object %s was assembled wrongly, its etag is %s rather than %s", u.key, etag, expected)
+	}
+	return nil
+}
+
+func (u *s3Upload) Abort() {
+	if u.uploadID == "" {
+		return
+	}
+	if err := u.d.client.AbortMultipartUpload(u.key, u.uploadID); err != nil {
+		logger.Warn("failed to abort the upload, its parts are kept until it's aborted (e.g. by a lifecycle rule)",
+			"key", u.key, "err", err)
+	}
+	u.uploadID = ""
+}
+
+func (d *S3Destination) Open(name string) (io.ReadCloser, error) {
+	return d.client.Get(d.prefix + name)
+}
+
+func (d *S3Destination) List() ([]string, error) {
+	var names []string
+	err := d.client.List(d.prefix, func(key string, _ int64) error {
+		if name := strings.TrimPrefix(key, d.prefix); !strings.Contains(name, "/") {
+			names = append(names, name)
+		}
+		return nil
+	})
+	return names, err
+}
+
+func (d *S3Destination) Delete(name string) error {
+	return d.client.Delete(d.prefix + name)
+}
+
+func (d *S3Destination) Location(name string) string {
+	return fmt.Sprintf("s3://%s/%s%s", d.client.Bucket, d.prefix, name)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestPostgresType(t *testing.T) {
+	n := func(v int64) sql.NullInt64 { return sql.NullInt64{Int64: v, Valid: true} }
+	for _, tt := range []struct {
+		column ColumnSchema
+		want   string
+	}{
+		{ColumnSchema{DataType: "tinyint", ColumnType: "tinyint(1)"}, "smallint"},
+		{ColumnSchema{DataType: "smallint", ColumnType: "smallint"}, "smallint"},
+		{ColumnSchema{DataType: "smallint", ColumnType: "smallint unsigned"}, "integer"},
+		{ColumnSchema{DataType: "mediumint", ColumnType: "mediumint unsigned"}, "integer"},
+		{ColumnSchema{DataType: "int", ColumnType: "int"}, "integer"},
+		{ColumnSchema{DataType: "int", ColumnType: "int unsigned"}, "bigint"},
+		{ColumnSchema{DataType: "bigint", ColumnType: "bigint unsigned"}, "bigint"},
+		{ColumnSchema{DataType: "float", ColumnType: "float"}, "real"},
+		{ColumnSchema{DataType: "float", ColumnType: "float(7,3)", Precision: n(7), Scale: n(3)}, "numeric(7,3)"},
+		{ColumnSchema{DataType: "double", ColumnType: "double"}, "double precision"},
+		{ColumnSchema{DataType: "decimal", ColumnType: "decimal(10,2)", Precision: n(10), Scale: n(2)}, "numeric(10,2)"},
+		{ColumnSchema{DataType: "char", ColumnType: "char(32)", Length: n(32)}, "char(32)"},
+		{ColumnSchema{DataType: "varchar", ColumnType: "varchar(2048)", Length: n(2048)}, "varchar(2048)"},
+		{ColumnSchema{DataType: "enum", ColumnType: "enum('osu!','private')", Length: n(7)}, "varchar(7)"},
+		{ColumnSchema{DataType: "datetime", ColumnType: "datetime"}, "timestamp"},
+		{ColumnSchema{DataType: "date", ColumnType: "date"}, "date"},
+		{ColumnSchema{DataType: "year", ColumnType: "year"}, "smallint"},
+		{ColumnSchema{DataType: "json", ColumnType: "json"}, "jsonb"},
+		{ColumnSchema{DataType: "mediumblob", ColumnType: "mediumblob"}, "bytea"},
+		{ColumnSchema{DataType: "varbinary", ColumnType: "varbinary(16)", Length: n(16)}, "bytea"},
+		{ColumnSchema{DataType: "mediumtext", ColumnType: "mediumtext"}, "text"},
+	} {
+		if got := postgresType(tt.column); got != tt.want {
+			t.Errorf("postgresType(%s) = %s, want %s", tt.column.ColumnType, got, tt.want)
+		}
+	}
+}
+
+func TestTranslateExpr(t *testing.T) {
+	for _, tt := range []struct {
+		expr, postgres, sqlite string
+	}{
+		{"CURRENT_TIMESTAMP", "CURRENT_TIMESTAMP", "(CURRENT_TIMESTAMP)"},
+		{"current_timestamp()", "CURRENT_TIMESTAMP", "(CURRENT_TIMESTAMP)"},
+		{"CURRENT_TIMESTAMP(6)", "CURRENT_TIMESTAMP", "(CURRENT_TIMESTAMP)"},
+		{"now()", "CURRENT_TIMESTAMP", "(CURRENT_TIMESTAMP)"},
+		{"unix_timestamp()", "extract(epoch from CURRENT_TIMESTAMP)::bigint", "(CAST(strftime('%s', 'now') AS INTEGER))"},
+		{"UNIX_TIMESTAMP( )", "extract(epoch from CURRENT_TIMESTAMP)::bigint", "(CAST(strftime('%s', 'now') AS INTEGER))"},
+		{"from_unixtime(`creation_time`)", `to_timestamp("creation_time")`, `(datetime("creation_time", 'unixepoch'))`},
+		{"`pp` * 2", `"pp" * 2`, `("pp" * 2)`},
+		// not functions, only names which start the same
+		{"nowhere", "nowhere", "(nowhere)"},
+	} {
+		if got := translatePostgresExpr(tt.expr); got != tt.postgres {
+			t.Errorf("translatePostgresExpr(%q) = %q, want %q", tt.expr, got, tt.postgres)
+		}
+		if got := translateSqliteExpr(tt.expr); got != tt.sqlite {
+			t.Errorf("translateSqliteExpr(%q) = %q, want %q", tt.expr, got, tt.sqlite)
+		}
+	}
+}
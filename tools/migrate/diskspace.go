@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// before v4.2.0 starts, the space it'll take up is estimated & compared with
+// what's free, so it stops straight away rather than filling the disk most
+// of the way through:
+//
+//   - the new scores table, about as big as the tables it's merged from
+//     (less whatever was migrated before, when resuming), in mysql's data
+//     directory.
+//   - the replays, wherever they're copied to: nothing when they're moved
+//     within a filesystem, as each batch's originals are removed once
+//     they're copied, but all of them when they're moved to another
+//     filesystem, or kept where they are (with --online). nothing when
+//     they're left in place, with --keep-ids.
+//
+// needs on the same filesystem (e.g. mysql & .data on one disk) are added
+// up. mysql's free space can only be checked when it's on this machine, and
+// replays in object storage needn't be. --no-space-check skips it all.
+
+// information_schema's sizes are estimates, and index builds sort in
+// temporary files, so this much more is asked for
+const spaceHeadroom = 1.1
+
+// SpaceNeed is disk space a migration will take up on a filesystem.
+type SpaceNeed struct {
+	What   string
+	Path   string // on the filesystem, or "" if it isn't on this machine
+	Needed int64
+}
+
+// tableSizes returns the size (data & indexes) of each table in the database.
+func tableSizes() (map[string]int64, error) {
+	var tables []struct {
+		Name string
+		Size int64
+	}
+	err := DB.Select(&tables, `
+	SELECT table_name AS name, COALESCE(data_length + index_length, 0) AS size
+	FROM information_schema.tables WHERE table_schema = DATABASE()`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the tables' sizes: %w", err)
+	}
+	sizes := make(map[string]int64, len(tables))
+	for _, t := range tables {
+		sizes[t.Name] = t.Size
+	}
+	return sizes, nil
+}
+
+// mysqlDataDirectory returns where mysql keeps its tables, or "" if mysql
+// isn't on this machine.
+func mysqlDataDirectory() (string, error) {
+	switch {
+	case cfg.DBSocket != "":
+	case cfg.WriteDSN == "" && (cfg.DBHost == "localhost" || cfg.DBHost == "127.0.0.1" || cfg.DBHost == "::1"):
+	default:
+		return "", nil
+	}
+	var datadir string
+	err := DB.Get(&datadir, "SELECT @@datadir")
+	return datadir, err
+}
+
+// newScoresSpace is the space the new scores table will take up.
+func newScoresSpace(tables []SourceTable) (SpaceNeed, error) {
+	sizes, err := tableSizes()
+	if err != nil {
+		return SpaceNeed{}, err
+	}
+	need := SpaceNeed{What: "the new scores table"}
+	for _, table := range tables {
+		need.Needed += sizes[table.Name]
+	}
+	// what's already been migrated, when resuming
+	need.Needed = max(need.Needed-sizes["scores"], 0)
+	need.Path, err = mysqlDataDirectory()
+	return need, err
+}
+
+// existingParent returns path, or its closest parent which exists.
+func existingParent(path string) (string, os.FileInfo, error) {
+	for {
+		info, err := os.Stat(path)
+		if err == nil || !errors.Is(err, os.ErrNotExist) || filepath.Dir(path) == path {
+			return path, info, err
+		}
+		path = filepath.Dir(path)
+	}
+}
+
+// directorySize returns the size of the files under a directory.
+func directorySize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err == nil {
+			size += info.Size()
+		}
+		return err
+	})
+	return size, err
+}
+
+// replayMoveSpace is the space moving the replays to their new ids will
+// take up, where they're moved to.
+func replayMoveSpace(keepOriginals bool) (SpaceNeed, error) {
+	from, to := cfg.OldReplays, cfg.NewReplays
+	if from == "" {
+		from = cfg.ReplayDirectory()
+	}
+	if to == "" {
+		to = cfg.ReplayDirectory()
+	}
+	need := SpaceNeed{What: "the moved replays"}
+	if replaysInPlace || strings.Contains(to, "://") {
+		return need, nil
+	}
+	if need.Path = to; strings.Contains(from, "://") {
+		logger.Warn("replays copied from object storage can't be measured, make sure there's space for them", "from", from, "to", to)
+		return need, nil
+	}
+
+	src, err := os.Stat(from)
+	if err != nil {
+		return need, err
+	}
+	// staged replays are moved back into .data/osr, so only take up space
+	// in the staging directory, when .data/osr is a mount of its own
+	if replaysStaged() {
+		if cfg.Resume {
+			return need, nil
+		}
+		need.What, need.Path, to = "the staged replays", stagingReplayDirectory(), stagingReplayDirectory()
+	}
+
+	_, dst, err := existingParent(to)
+	if err != nil {
+		return need, err
+	}
+	if device := fileDevice(src); !keepOriginals && device != 0 && device == fileDevice(dst) {
+		return need, nil
+	}
+	need.Needed, err = directorySize(from)
+	return need, err
+}
+
+// spaceProblems compares the needs with the free space of their
+// filesystems, returning which don't fit.
+func spaceProblems(needs []SpaceNeed) ([]string, error) {
+	type filesystem struct {
+		path   string
+		free   uint64
+		needed int64
+		what   []string
+	}
+	var filesystems []*filesystem
+	byDevice := make(map[uint64]*filesystem)
+	for _, need := range needs {
+		if need.Path == "" || need.Needed == 0 {
+			continue
+		}
+		path, info, err := existingParent(need.Path)
+		if err != nil {
+			return nil, err
+		}
+		fsys := byDevice[fileDevice(info)]
+		if fsys == nil || fileDevice(info) == 0 {
+			free, err := diskFree(path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to check %s's free space: %w", path, err)
+			}
+			fsys = &filesystem{path: path, free: free}
+			filesystems = append(filesystems, fsys)
+			byDevice[fileDevice(info)] = fsys
+		}
+		fsys.needed += need.Needed
+		fsys.what = append(fsys.what, fmt.Sprintf("%s (%s)", need.What, formatBytes(need.Needed)))
+	}
+
+	var problems []string
+	for _, fsys := range filesystems {
+		needed := int64(float64(fsys.needed) * spaceHeadroom)
+		if fsys.free < uint64(needed) {
+			verb := "needs"
+			if len(fsys.what) > 1 {
+				verb = "need"
+			}
+			problems = append(problems, fmt.Sprintf("%s has %s free, but %s %s about %s",
+				fsys.path, formatBytes(int64(fsys.free)), strings.Join(fsys.what, " & "), verb, formatBytes(needed)))
+		}
+	}
+	return problems, nil
+}
+
+var errNotEnoughSpace = errors.New("not enough disk space for the migration, free some up, or give --no-space-check if the estimate is wrong")
+
+// migrationSpace estimates the space v4.2.0 needs, returning where it
+// won't fit.
+func migrationSpace(tables []SourceTable) (needs []SpaceNeed, problems []string, err error) {
+	scores, err := newScoresSpace(tables)
+	if err != nil {
+		return nil, nil, err
+	}
+	replays, err := replayMoveSpace(cfg.Online)
+	if err != nil {
+		return nil, nil, err
+	}
+	needs = []SpaceNeed{scores, replays}
+	problems, err = spaceProblems(needs)
+	return needs, problems, err
+}
+
+// checkMigrationSpace stops v4.2.0 before it starts if it'd run out of space.
+func checkMigrationSpace(tables []SourceTable) error {
+	if cfg.NoSpaceCheck {
+		return nil
+	}
+	needs, problems, err := migrationSpace(tables)
+	if err != nil {
+		return err
+	}
+	for _, problem := range problems {
+		logger.Error(problem)
+	}
+	if len(problems) != 0 {
+		return errNotEnoughSpace
+	}
+	for _, need := range needs {
+		if need.Path == "" && need.Needed != 0 {
+			logger.Info("mysql isn't on this machine, so its free space can't be checked", "needed", formatBytes(need.Needed), "for", need.What)
+		}
+	}
+	logger.Info("estimated the space needed", "scores", formatBytes(needs[0].Needed), "replays", formatBytes(needs[1].Needed))
+	return nil
+}
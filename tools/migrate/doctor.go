@@ -0,0 +1,330 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// doctor checks everything the other commands rely on before they're run,
+// so a migration doesn't fail hours in for want of a privilege or disk space:
+//
+//   - the database can be connected to, with the privileges they need.
+//   - mysql's settings (max_allowed_packet, the buffer pool & redo log)
+//     won't make them crawl.
+//   - there's space for the new scores table, and the replays to be moved
+//     (see diskspace.go).
+//   - the open file limit, and the .data directories bancho.py keeps
+//     replays, screenshots, avatars & beatmaps in.
+//
+// each check passes, warns (it'll work, but slowly or with less) or fails.
+
+const (
+	doctorPass = "pass"
+	doctorWarn = "warn"
+	doctorFail = "fail"
+)
+
+// doctorCheck is the result of one of doctor's checks.
+type doctorCheck struct {
+	Name   string
+	Status string // doctorPass, doctorWarn or doctorFail
+	Detail string
+}
+
+var errDoctorFailed = errors.New("some checks failed")
+
+// privileges every migration needs on the database, and others only some
+// commands need, with what they're for
+var (
+	requiredPrivileges = []string{"SELECT", "INSERT", "UPDATE", "DELETE", "CREATE", "DROP", "ALTER", "INDEX"}
+	optionalPrivileges = []struct{ name, usedBy string }{
+		{"TRIGGER", "up --online & schema alter"},
+		{"RELOAD", "backup --consistency lock"},
+	}
+)
+
+// the open files needed by workers moving replays, and writers' open parts
+const recommendedOpenFiles = 4096
+
+// mysql's settings below which it works, but slowly
+const (
+	recommendedMaxPacket  = 16 << 20
+	recommendedBufferPool = 1 << 30
+	recommendedRedoLog    = 256 << 20
+)
+
+var grantPattern = regexp.MustCompile(`^GRANT (.+?) ON (\S+) TO `)
+
+// grantedPrivileges returns the privileges the user has on the database.
+func grantedPrivileges() (map[string]bool, error) {
+	var grants []string
+	if err := DB.Select(&grants, "SHOW GRANTS FOR CURRENT_USER()"); err != nil {
+		return nil, err
+	}
+
+	granted := make(map[string]bool)
+	for _, grant := range grants {
+		m := grantPattern.FindStringSubmatch(grant)
+		if m == nil || !grantCovers(m[2], cfg.DBName) {
+			continue
+		}
+		for _, privilege := range strings.Split(m[1], ",") {
+			// column privileges, e.g. SELECT (id, name), cover only them
+			if privilege = strings.TrimSpace(privilege); strings.Contains(privilege, "(") {
+				continue
+			}
+			granted[strings.ToUpper(privilege)] = true
+		}
+	}
+	if granted["ALL PRIVILEGES"] || granted["ALL"] {
+		for _, privilege := range requiredPrivileges {
+			granted[privilege] = true
+		}
+		for _, privilege := range optionalPrivileges {
+			granted[privilege.name] = true
+		}
+	}
+	return granted, nil
+}
+
+// grantCovers reports whether a grant's scope, e.g. *.* or `bancho\_py`.*,
+// covers every table of a database. database names may have % & _
+// wildcards, as in LIKE, escaped with a backslash.
+func grantCovers(scope, database string) bool {
+	if scope == "*.*" {
+		return true
+	}
+	name, ok := strings.CutSuffix(scope, ".*")
+	if !ok {
+		return false
+	}
+	name = strings.Trim(name, "`")
+
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; {
+		case c == '\\' && i+1 < len(name):
+			i++
+			pattern.WriteString(regexp.QuoteMeta(name[i : i+1]))
+		case c == '%':
+			pattern.WriteString(".*")
+		case c == '_':
+			pattern.WriteString(".")
+		default:
+			pattern.WriteString(regexp.QuoteMeta(name[i : i+1]))
+		}
+	}
+	pattern.WriteString("$")
+	matched, err := regexp.MatchString(pattern.String(), database)
+	return err == nil && matched
+}
+
+func checkPrivileges() doctorCheck {
+	check := doctorCheck{Name: "privileges"}
+	granted, err := grantedPrivileges()
+	if err != nil {
+		check.Status, check.Detail = doctorWarn, fmt.Sprintf("failed to read the user's grants: %s", err)
+		return check
+	}
+
+	var missing, unused []string
+	for _, privilege := range requiredPrivileges {
+		if !granted[privilege] {
+			missing = append(missing, privilege)
+		}
+	}
+	for _, privilege := range optionalPrivileges {
+		if !granted[privilege.name] {
+			unused = append(unused, fmt.Sprintf("%s (for %s)", privilege.name, privilege.usedBy))
+		}
+	}
+	switch {
+	case len(missing) != 0:
+		check.Status = doctorFail
+		check.Detail = fmt.Sprintf("%s is missing %s on %s", cfg.DBUser, strings.Join(missing, ", "), cfg.DBName)
+	case len(unused) != 0:
+		check.Status = doctorWarn
+		check.Detail = fmt.Sprintf("%s is missing %s", cfg.DBUser, strings.Join(unused, ", "))
+	default:
+		check.Status, check.Detail = doctorPass, fmt.Sprintf("%s has every privilege needed on %s", cfg.DBUser, cfg.DBName)
+	}
+	return check
+}
+
+// checkMySQLSettings checks the settings which size, or slow, migrations.
+func checkMySQLSettings(databaseSize int64) []doctorCheck {
+	var settings struct {
+		MaxPacket  int64 `db:"max_packet"`
+		BufferPool int64 `db:"buffer_pool"`
+	}
+	err := DB.Get(&settings, "SELECT @@max_allowed_packet AS max_packet, @@innodb_buffer_pool_size AS buffer_pool")
+	if err != nil {
+		return []doctorCheck{{"mysql settings", doctorFail, fmt.Sprintf("failed to read mysql's settings: %s", err)}}
+	}
+
+	packet := doctorCheck{"max_allowed_packet", doctorPass, formatBytes(settings.MaxPacket)}
+	if settings.MaxPacket < recommendedMaxPacket {
+		packet.Status = doctorWarn
+		packet.Detail += fmt.Sprintf(", inserts will be small & slow, at least %s is recommended", formatBytes(recommendedMaxPacket))
+	}
+
+	// the buffer pool needn't be bigger than the database
+	pool := doctorCheck{"innodb_buffer_pool", doctorPass, formatBytes(settings.BufferPool)}
+	if settings.BufferPool < min(recommendedBufferPool, databaseSize) {
+		pool.Status = doctorWarn
+		pool.Detail += fmt.Sprintf(" for a %s database, reads & index builds will hit the disk, at least %s is recommended",
+			formatBytes(databaseSize), formatBytes(recommendedBufferPool))
+	}
+
+	redo := doctorCheck{Name: "innodb redo log", Status: doctorPass}
+	if capacity, err := redoLogCapacity(); err != nil {
+		redo.Status, redo.Detail = doctorWarn, fmt.Sprintf("failed to read its size: %s", err)
+	} else if redo.Detail = formatBytes(capacity); capacity < recommendedRedoLog {
+		redo.Status = doctorWarn
+		redo.Detail += fmt.Sprintf(", transactions will be small, as they're kept to a tenth of it, at least %s is recommended",
+			formatBytes(recommendedRedoLog))
+	}
+	return []doctorCheck{packet, pool, redo}
+}
+
+// checkDiskSpace checks there's space for the new scores table & the moved
+// replays, as up does before v4.2.0 (see diskspace.go), or for a copy of the
+// scores table (for schema alter) once it's been migrated.
+func checkDiskSpace() (databaseSize int64, checks []doctorCheck) {
+	sizes, err := tableSizes()
+	if err != nil {
+		return 0, []doctorCheck{{"disk space", doctorFail, err.Error()}}
+	}
+	scores := SpaceNeed{What: "the new scores table"}
+	for name, size := range sizes {
+		databaseSize += size
+		for _, table := range SourceTables {
+			if name == table.Name {
+				scores.Needed += size
+			}
+		}
+	}
+	if scores.Needed == 0 {
+		scores = SpaceNeed{What: "a copy of the scores table", Needed: sizes["scores"]}
+	}
+	if scores.Path, err = mysqlDataDirectory(); err != nil {
+		return databaseSize, []doctorCheck{{"disk space", doctorFail, fmt.Sprintf("failed to read mysql's data directory: %s", err)}}
+	} else if scores.Path == "" {
+		checks = append(checks, doctorCheck{"database disk space", doctorWarn,
+			fmt.Sprintf("mysql isn't on this machine, make sure it has %s free for %s", formatBytes(scores.Needed), scores.What)})
+	}
+
+	var replays SpaceNeed
+	if cfg.DataDirectory == "" && (cfg.OldReplays == "" || cfg.NewReplays == "") {
+		checks = append(checks, doctorCheck{"replay disk space", doctorWarn, "DATA_DIRECTORY isn't set, so where replays are moved can't be checked"})
+	} else if replays, err = replayMoveSpace(false); err != nil {
+		checks = append(checks, doctorCheck{"replay disk space", doctorFail, err.Error()})
+	}
+
+	problems, err := spaceProblems([]SpaceNeed{scores, replays})
+	switch {
+	case err != nil:
+		checks = append(checks, doctorCheck{"disk space", doctorWarn, err.Error()})
+	case len(problems) != 0:
+		checks = append(checks, doctorCheck{"disk space", doctorFail, strings.Join(problems, "; ")})
+	default:
+		checks = append(checks, doctorCheck{"disk space", doctorPass,
+			fmt.Sprintf("%s needs about %s, and the moved replays %s", scores.What, formatBytes(scores.Needed), formatBytes(replays.Needed))})
+	}
+	return databaseSize, checks
+}
+
+func checkOpenFiles() doctorCheck {
+	check := doctorCheck{Name: "open file limit"}
+	limit, err := openFileLimit()
+	switch {
+	case err != nil:
+		check.Status, check.Detail = doctorWarn, fmt.Sprintf("failed to read it: %s", err)
+	case limit < recommendedOpenFiles:
+		check.Status = doctorWarn
+		check.Detail = fmt.Sprintf("%d, raise it (ulimit -n) to at least %d, as workers & writers hold many files open", limit, recommendedOpenFiles)
+	default:
+		check.Status, check.Detail = doctorPass, fmt.Sprint(limit)
+	}
+	return check
+}
+
+// checkDataDirectory checks bancho.py's .data directories are there, and
+// that replays can be written.
+func checkDataDirectory() []doctorCheck {
+	if cfg.DataDirectory == "" {
+		return []doctorCheck{{"data directory", doctorWarn, "DATA_DIRECTORY isn't set, so replays, screenshots & avatars can't be checked"}}
+	}
+	if info, err := os.Stat(cfg.DataDirectory); err != nil || !info.IsDir() {
+		return []doctorCheck{{"data directory", doctorFail, fmt.Sprintf("%s isn't a directory", cfg.DataDirectory)}}
+	}
+
+	checks := []doctorCheck{{"data directory", doctorPass, cfg.DataDirectory}}
+	for _, dir := range []struct{ name, path string }{
+		{"replays", cfg.ReplayDirectory()},
+		{"screenshots", cfg.ScreenshotDirectory()},
+		{"avatars", cfg.AvatarDirectory()},
+		{"beatmaps", cfg.BeatmapDirectory()},
+	} {
+		check := doctorCheck{Name: dir.name + " directory", Status: doctorPass, Detail: dir.path}
+		if info, err := os.Stat(dir.path); err != nil || !info.IsDir() {
+			check.Status, check.Detail = doctorWarn, fmt.Sprintf("%s isn't a directory", dir.path)
+		} else if dir.path == cfg.ReplayDirectory() {
+			f, err := os.CreateTemp(dir.path, ".doctor-*")
+			if err != nil {
+				check.Status, check.Detail = doctorFail, fmt.Sprintf("replays can't be written to %s: %s", dir.path, err)
+			} else {
+				f.Close()
+				os.Remove(f.Name())
+			}
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+func runDoctor() error {
+	var checks []doctorCheck
+	if err := connectDatabase(); err != nil {
+		checks = append(checks, doctorCheck{"database", doctorFail, err.Error()})
+	} else {
+		var version string
+		if err := DB.Get(&version, "SELECT VERSION()"); err != nil {
+			return err
+		}
+		checks = append(checks, doctorCheck{"database", doctorPass,
+			fmt.Sprintf("connected to %s as %s, mysql %s", cfg.DBAddress(), cfg.DBUser, version)})
+		checks = append(checks, checkPrivileges())
+
+		databaseSize, space := checkDiskSpace()
+		checks = append(checks, checkMySQLSettings(databaseSize)...)
+		checks = append(checks, space...)
+	}
+	checks = append(checks, checkOpenFiles())
+	checks = append(checks, checkDataDirectory()...)
+
+	counts := make(map[string]int)
+	for _, check := range checks {
+		fmt.Printf("%s  %-22s %s\n", check.Status, check.Name, check.Detail)
+		counts[check.Status]++
+	}
+	fmt.Printf("\n%d passed, %d warnings, %d failed\n", counts[doctorPass], counts[doctorWarn], counts[doctorFail])
+	if counts[doctorFail] != 0 {
+		return errDoctorFailed
+	}
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:           "doctor",
+		Summary:        "check the database's privileges & settings, disk space, ulimits and .data directories before migrating",
+		ConnectsItself: true,
+		Flags:          replayStoreFlags,
+		Run:            runDoctor,
+	})
+}
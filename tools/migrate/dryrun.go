@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// maxExamples caps how many example ids are listed per problem in reports.
+const maxExamples = 10
+
+type modeStatusCount struct {
+	Mode   int
+	Status int
+	Count  int64
+}
+
+// checkSchema returns the problems which would stop a source table from migrating.
+func checkSchema(table SourceTable) ([]string, error) {
+	var columns []string
+	err := DB.Select(&columns, `
+	SELECT column_name FROM information_schema.columns
+	WHERE table_schema = DATABASE() AND table_name = ?`, table.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(columns) == 0 {
+		return []string{fmt.Sprintf("table %s does not exist", table.Name)}, nil
+	}
+
+	present := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		present[strings.ToLower(column)] = true
+	}
+
+	// tables adapted by preflight.go were already checked column by column
+	var problems []string
+	for _, column := range expectedScoreColumns {
+		if !present[column.Name] && column.Fallback == "" && table.Columns == "" {
+			problems = append(problems, fmt.Sprintf("table %s is missing column %s", table.Name, column.Name))
+		}
+	}
+	return problems, nil
+}
+
+// findMissingReplays pages through the submitted scores of a table and
+// checks that each of them has a replay file in the replay directory.
+func findMissingReplays(table SourceTable, replays ReplayStore) (found int64, missing int64, examples []int64, err error) {
+	var lastID int64
+	for {
+		var ids []int64
+		err = DB.Select(&ids, fmt.Sprintf(`
+		SELECT id FROM %s WHERE id > ? AND status != 0
+		ORDER BY id LIMIT ?`, table.Name), lastID, BatchSize)
+		if err != nil || len(ids) == 0 {
+			return
+		}
+
+		for _, id := range ids {
+			if _, statErr := replays.Stat(replayKey(id)); statErr != nil {
+				missing++
+				if len(examples) < maxExamples {
+					examples = append(examples, id)
+				}
+			} else {
+				found++
+			}
+		}
+
+		lastID = ids[len(ids)-1]
+	}
+}
+
+// countReplayFiles counts the replays currently in a store.
+func countReplayFiles(replays ReplayStore) (int64, error) {
+	var count int64
+	err := replays.List(func(string) error {
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// runDryRun reports what the migration would do, without writing anything.
+func runDryRun(tables []SourceTable) error {
+	fmt.Println("Dry run: nothing will be created, inserted, moved or dropped.")
+	fmt.Println()
+
+	var problems []string
+	var totalRows, totalReplays int64
+
+	replays, err := preMigrationReplays()
+	if err != nil {
+		return err
+	}
+
+	var targetExists int
+	err = DB.Get(&targetExists, `
+	SELECT COUNT(*) FROM information_schema.tables
+	WHERE table_schema = DATABASE() AND table_name = 'scores'`)
+	if err != nil {
+		return err
+	}
+	if targetExists != 0 {
+		problems = append(problems, "the new scores table already exists")
+	}
+
+	for _, table := range tables {
+		schemaProblems, err := checkSchema(table)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s (mode offset +%d)\n", table.Name, table.ModeOffset)
+		if len(schemaProblems) != 0 {
+			for _, problem := range schemaProblems {
+				fmt.Printf("  schema: %s\n", problem)
+			}
+			problems = append(problems, schemaProblems...)
+			fmt.Println()
+			continue
+		}
+
+		var counts []modeStatusCount
+		err = DB.Select(&counts, fmt.Sprintf(`
+		SELECT mode, status, COUNT(*) AS count FROM %s
+		GROUP BY mode, status`, table.Name))
+		if err != nil {
+			return err
+		}
+		sort.Slice(counts, func(i, j int) bool {
+			if counts[i].Mode != counts[j].Mode {
+				return counts[i].Mode < counts[j].Mode
+			}
+			return counts[i].Status < counts[j].Status
+		})
+
+		var rows int64
+		fmt.Printf("  %-10s %-8s %-8s %s\n", "old mode", "new mode", "status", "rows")
+		for _, c := range counts {
+			fmt.Printf("  %-10d %-8d %-8d %d\n", c.Mode, c.Mode+table.ModeOffset, c.Status, c.Count)
+			rows += c.Count
+		}
+		fmt.Printf("  total rows: %d\n", rows)
+		totalRows += rows
+
+		found, missing, examples, err := findMissingReplays(table, replays)
+		if err != nil {
+			return err
+		}
+		if table.KeepIDs && !table.MoveKeptReplays {
+			fmt.Printf("  replays left in place: %d\n", found)
+		} else {
+			fmt.Printf("  replays to move: %d\n", found)
+		}
+		totalReplays += found
+		if missing != 0 {
+			fmt.Printf("  submitted scores missing replays: %d (e.g. ids %v)\n", missing, examples)
+		}
+		fmt.Println()
+	}
+
+	replayFiles, err := countReplayFiles(replays)
+	if err != nil {
+		return err
+	}
+
+	if replaysInPlace {
+		fmt.Printf("Would migrate %d scores, keeping their ids, and leave their %d replays in place\n", totalRows, totalReplays)
+	} else {
+		fmt.Printf("Would migrate %d scores and move %d replays\n", totalRows, totalReplays)
+	}
+	if leftover := replayFiles - totalReplays; leftover > 0 {
+		fmt.Printf("%d replay files have no matching score and would be left behind\n", leftover)
+	}
+	fmt.Printf("Would then create %d indexes on the new scores table, and analyze it (bancho.py creates the rest when it next starts)\n", len(scoreIndexes))
+
+	needs, full, err := migrationSpace(tables)
+	if err != nil {
+		return err
+	}
+	for _, need := range needs {
+		fmt.Printf("Would take up about %s for %s\n", formatBytes(need.Needed), need.What)
+	}
+	problems = append(problems, full...)
+
+	if cfg.KeepScoreIDs {
+		collisions, err := idCollisions(tables)
+		if err != nil {
+			return err
+		}
+		problems = append(problems, collisions...)
+	}
+
+	if len(problems) != 0 {
+		fmt.Printf("\nThe migration would fail:\n  - %s\n", strings.Join(problems, "\n  - "))
+	} else {
+		fmt.Println("\nNo problems found.")
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// export replays packages replays as full .osr files in a zip, e.g. for a
+// tournament's archive, or a player asking for their data: a user's scores,
+// a map's, or the top of a map's leaderboards. alongside the replays, the
+// zip has a manifest.json describing each score, and listing the scores
+// whose replay is missing.
+
+var select_export_replays = `
+SELECT s.id, s.map_md5, s.score, s.pp, s.acc, s.max_combo, s.mods, s.n300, s.n100, s.n50,
+s.nmiss, s.ngeki, s.nkatu, s.grade, s.status, s.mode, s.perfect,
+UNIX_TIMESTAMP(s.play_time) AS play_time, s.userid, u.name AS username,
+COALESCE(m.id, 0) AS map_id, COALESCE(m.set_id, 0) AS set_id, COALESCE(m.artist, '') AS artist,
+COALESCE(m.title, s.map_md5) AS title, COALESCE(m.version, '') AS version
+FROM scores s JOIN users u ON u.id = s.userid
+LEFT JOIN maps m ON m.md5 = s.map_md5
+WHERE s.status != 0 AND %s`
+
+// leaderboards are ranked as bancho.py does, by pp for relax & autopilot,
+// otherwise by score, and only list unrestricted players' best scores
+var select_export_leaderboard = `
+SELECT * FROM (
+	SELECT x.*, ROW_NUMBER() OVER (
+		PARTITION BY x.mode ORDER BY IF(x.mode >= 4, x.pp, x.score) DESC, x.play_time
+	) AS placement FROM (` + select_export_replays + ` AND s.status = 2 AND u.priv & 1) x
+) ranked WHERE placement <= ?`
+
+// ManifestScore describes an exported replay.
+type ManifestScore struct {
+	File      string   `json:"file,omitempty"`
+	ScoreID   int64    `json:"score_id"`
+	UserID    int64    `json:"user_id"`
+	Player    string   `json:"player"`
+	MapMD5    string   `json:"map_md5"`
+	MapID     int64    `json:"map_id,omitempty"`
+	SetID     int64    `json:"set_id,omitempty"`
+	Map       string   `json:"map"`
+	Mode      int      `json:"mode"`
+	Mods      []string `json:"mods"`
+	Score     int      `json:"score"`
+	PP        float64  `json:"pp"`
+	Acc       float64  `json:"acc"`
+	MaxCombo  int      `json:"max_combo"`
+	Grade     string   `json:"grade"`
+	Best      bool     `json:"best"`
+	Placement int      `json:"placement,omitempty"`
+	PlayTime  string   `json:"play_time"`
+	ReplayMD5 string   `json:"replay_md5"`
+}
+
+type ReplayManifest struct {
+	ExportedAt string          `json:"exported_at"`
+	Selection  string          `json:"selection"`
+	Replays    []ManifestScore `json:"replays"`
+	Missing    []ManifestScore `json:"missing"` // scores without a replay
+}
+
+type leaderboardScore struct {
+	exportScore
+	Placement int
+}
+
+// selectExportScores finds the scores selected by --user, --map & --top.
+func selectExportScores() ([]leaderboardScore, string, error) {
+	var conditions []string
+	var args []interface{}
+	var selection []string
+
+	if cfg.ExportUser != "" {
+		user, err := findUser(cfg.ExportUser)
+		if err != nil {
+			return nil, "", err
+		}
+		conditions = append(conditions, "s.userid = ?")
+		args = append(args, user)
+		selection = append(selection, fmt.Sprintf("user %d", user))
+	}
+	if cfg.ExportMap != "" {
+		// a map's md5, or its id
+		if len(cfg.ExportMap) == 32 {
+			conditions = append(conditions, "s.map_md5 = ?")
+		} else if _, err := strconv.ParseInt(cfg.ExportMap, 10, 64); err == nil {
+			conditions = append(conditions, "s.map_md5 = (SELECT md5 FROM maps WHERE id = ? LIMIT 1)")
+		} else {
+			return nil, "", fmt.Errorf("--map %q must be a beatmap id or md5", cfg.ExportMap)
+		}
+		args = append(args, cfg.ExportMap)
+		selection = append(selection, "map "+cfg.ExportMap)
+	}
+	if len(conditions) == 0 {
+		return nil, "", errors.New("--user or --map is needed, to select which replays to export")
+	}
+	if cfg.ExportMode >= 0 {
+		conditions = append(conditions, "s.mode = ?")
+		args = append(args, cfg.ExportMode)
+		selection = append(selection, fmt.Sprintf("mode %d", cfg.ExportMode))
+	}
+
+	query := fmt.Sprintf(select_export_replays, strings.Join(conditions, " AND "))
+	if cfg.ExportTop > 0 {
+		query = fmt.Sprintf(select_export_leaderboard, strings.Join(conditions, " AND "))
+		args = append(args, cfg.ExportTop)
+		selection = append(selection, fmt.Sprintf("top %d", cfg.ExportTop))
+		query += " ORDER BY mode, placement"
+	} else {
+		query += " ORDER BY s.id"
+	}
+
+	var scores []leaderboardScore
+	err := DB.Select(&scores, query, args...)
+	return scores, strings.Join(selection, ", "), err
+}
+
+func manifestScore(s leaderboardScore) ManifestScore {
+	mods := acronymsFromMods(s.Mods)
+	if mods == nil {
+		mods = []string{}
+	}
+	return ManifestScore{
+		ScoreID:   s.ID,
+		UserID:    s.UserID,
+		Player:    s.Username,
+		MapMD5:    s.MapMD5,
+		MapID:     s.MapID,
+		SetID:     s.SetID,
+		Map:       fmt.Sprintf("%s - %s [%s]", s.Artist, s.Title, s.Version),
+		Mode:      s.Mode,
+		Mods:      mods,
+		Score:     s.Score,
+		PP:        s.PP,
+		Acc:       s.Acc,
+		MaxCombo:  s.MaxCombo,
+		Grade:     s.Grade,
+		Best:      s.Status == 2,
+		Placement: s.Placement,
+		PlayTime:  time.Unix(s.PlayTime, 0).UTC().Format(time.RFC3339),
+		ReplayMD5: s.replayMD5(),
+	}
+}
+
+// addReplay adds a score's replay to a zip as a full .osr file, or returns
+// an error satisfying errors.Is(err, os.ErrNotExist) if it has none.
+func addReplay(zw *zip.Writer, name string, s exportScore) error {
+	in, err := newReplays.Open(replayKey(s.ID))
+	if err != nil {
+		return err
+	}
+	frames, err := io.ReadAll(in)
+	in.Close()
+	if err != nil {
+		return err
+	}
+
+	// replay frames are lzma compressed already, so they're stored as they are
+	f, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: time.Unix(s.PlayTime, 0),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(s.encode(frames))
+	return err
+}
+
+// writeReplayBundle writes the zip, replays first, then the manifest.
+func writeReplayBundle(w io.Writer, scores []leaderboardScore, selection string) (*ReplayManifest, error) {
+	manifest := &ReplayManifest{
+		ExportedAt: time.Now().UTC().Format(time.RFC3339),
+		Selection:  selection,
+		Replays:    []ManifestScore{},
+		Missing:    []ManifestScore{},
+	}
+
+	zw := zip.NewWriter(w)
+	for _, s := range scores {
+		if isInterrupted() {
+			return nil, errInterrupted
+		}
+
+		entry := manifestScore(s)
+		err := addReplay(zw, s.filename(), s.exportScore)
+		if errors.Is(err, os.ErrNotExist) {
+			manifest.Missing = append(manifest.Missing, entry)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		entry.File = s.filename()
+		manifest.Replays = append(manifest.Replays, entry)
+	}
+
+	f, err := zw.Create("manifest.json")
+	if err != nil {
+		return nil, err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		return nil, err
+	}
+	return manifest, zw.Close()
+}
+
+func runExportReplays() error {
+	if cfg.ExportBundle == "" {
+		return errors.New("--out must be the zip file to write")
+	}
+	if cfg.ExportTop > 0 && cfg.ExportMap == "" {
+		return errors.New("--top needs --map, the leaderboard to export the top of")
+	}
+	if err := setupReplayStores(); err != nil {
+		return err
+	}
+
+	scores, selection, err := selectExportScores()
+	if err != nil {
+		return err
+	}
+	if len(scores) == 0 {
+		return fmt.Errorf("no scores were found for %s", selection)
+	}
+
+	// the zip is written beside its destination, so that an interrupted
+	// export doesn't leave a partial bundle
+	handleSignals()
+	tmp := cfg.ExportBundle + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	manifest, err := writeReplayBundle(out, scores, selection)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, cfg.ExportBundle); err != nil {
+		return err
+	}
+
+	logger.Info("exported replays", "selection", selection, "replays", len(manifest.Replays),
+		"without_replays", len(manifest.Missing), "path", cfg.ExportBundle)
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:              "export replays",
+		Summary:           "package the replays of a user, a map, or a map's top scores into a zip, with a manifest",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.ExportUser, "user", "", "name or id of the user whose replays are exported")
+			flags.StringVar(&c.ExportMap, "map", "", "id or md5 of the beatmap whose replays are exported")
+			flags.IntVar(&c.ExportTop, "top", 0, "only export the top n of the map's leaderboards, per mode")
+			flags.IntVar(&c.ExportMode, "mode", -1, "only export scores of this mode (0-8, as in bancho.py), -1 for every mode")
+			flags.StringVar(&c.ExportBundle, "out", "", "the zip file to write")
+			flags.StringVar(&c.NewReplays, "replays", "", "where bancho.py's replays are, a path or s3://bucket/prefix (default: DATA_DIRECTORY/osr)")
+		},
+		Run: runExportReplays,
+	})
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// export ripple is import ripple in reverse, for instances moving from
+// bancho.py to ripple (or one of its forks): users, stats, beatmaps & scores
+// are copied into a ripple database on the same mysql server, which must
+// already have been created from ripple's schema, and replays are copied
+// into lets' .data directory. bancho.py's database & replays are only ever
+// read from.
+//
+// scores keep their ids, which are unique across modes in bancho.py, so
+// relax & autopilot scores are split into scores_relax & scores_ap without
+// renumbering, and each replay is simply replay_<id>.osr. rows which were
+// already exported are skipped, so an interrupted export can be run again.
+// with --leaderboards, ripple's global & country leaderboards are written
+// to redis too, from the stats.
+
+// how bancho.py's privileges map back onto ripple's. restricted players keep
+// UserNormal, as bancho.py doesn't tell restrictions & bans apart.
+var rippleExportPrivileges = []struct{ bpy, ripple int }{
+	{privUnrestricted, rippleUserPublic},
+	{privSupporter, rippleUserDonor},
+	{privTourneyManager, rippleUserTournamentStaff},
+	{privNominator, rippleAdminManageBeatmaps},
+	{privModerator, rippleAdminSilenceUsers | rippleAdminKickUsers | rippleAdminChatMod},
+	{privAdministrator, rippleAdminManageUsers | rippleAdminBanUsers | rippleAdminWipeUsers},
+	{privDeveloper, rippleAdminManageServers | rippleAdminManageSettings | rippleAdminManagePrivileges},
+}
+
+// ripplePrivilegesExpr converts a bancho.py privileges column to ripple's, in sql.
+func ripplePrivilegesExpr(column string) string {
+	terms := []string{fmt.Sprint(rippleUserNormal)}
+	for _, p := range rippleExportPrivileges {
+		terms = append(terms, fmt.Sprintf("IF(%s & %d, %d, 0)", column, p.bpy, p.ripple))
+	}
+	terms = append(terms, fmt.Sprintf("IF(%s & %d, 0, %d)", column, privVerified, rippleUserPendingVerification))
+	return "(" + strings.Join(terms, " | ") + ")"
+}
+
+// rippleExportPrivilege converts bancho.py privileges to ripple's, as
+// ripplePrivilegesExpr does in sql.
+func rippleExportPrivilege(priv int) int {
+	ripple := rippleUserNormal
+	for _, p := range rippleExportPrivileges {
+		if priv&p.bpy != 0 {
+			ripple |= p.ripple
+		}
+	}
+	if priv&privVerified == 0 {
+		ripple |= rippleUserPendingVerification
+	}
+	return ripple
+}
+
+// where each of bancho.py's modes goes in ripple: its scores table, the
+// stats table & column suffix, and the redis leaderboard's key
+var rippleExportModes = []struct {
+	mode        int
+	scores      string
+	stats       string
+	suffix      string
+	leaderboard string
+}{
+	{0, "scores", "users_stats", "std", "ripple:leaderboard:std"},
+	{1, "scores", "users_stats", "taiko", "ripple:leaderboard:taiko"},
+	{2, "scores", "users_stats", "ctb", "ripple:leaderboard:ctb"},
+	{3, "scores", "users_stats", "mania", "ripple:leaderboard:mania"},
+	{4, "scores_relax", "rx_stats", "std", "ripple:leaderboard_relax:std"},
+	{5, "scores_relax", "rx_stats", "taiko", "ripple:leaderboard_relax:taiko"},
+	{6, "scores_relax", "rx_stats", "ctb", "ripple:leaderboard_relax:ctb"},
+	{8, "scores_ap", "ap_stats", "std", "ripple:leaderboard_ap:std"},
+}
+
+// ripple marks personal bests with completed = 3, and passes with 2
+var export_ripple_scores = `
+INSERT IGNORE INTO %s (id, beatmap_md5, userid, score, max_combo, full_combo, mods,
+	` + "`300_count`, `100_count`, `50_count`," + ` katus_count, gekis_count, misses_count,
+	time, play_mode, completed, accuracy, pp)
+SELECT id, map_md5, userid, score, max_combo, perfect, mods, n300, n100, n50, nkatu,
+	ngeki, nmiss, UNIX_TIMESTAMP(play_time), mode %% 4,
+	CASE status WHEN 2 THEN 3 WHEN 1 THEN 2 ELSE 0 END, acc, pp
+FROM scores WHERE mode IN (%s) AND id > ? AND id <= ?`
+
+// rippleColumnList picks the columns which the ripple table has, out of
+// column -> expression pairs, returning the insert & select lists.
+func rippleColumnList(table string, pairs [][2]string) (string, string, error) {
+	columns, err := rippleColumns(table)
+	if err != nil {
+		return "", "", err
+	}
+	var names, exprs []string
+	for _, pair := range pairs {
+		if columns[pair[0]] {
+			names = append(names, pair[0])
+			exprs = append(exprs, pair[1])
+		}
+	}
+	return strings.Join(names, ", "), strings.Join(exprs, ", "), nil
+}
+
+// exportRippleUsers copies every user but the bot, and gives each a row in
+// the stats tables.
+func exportRippleUsers() error {
+	names, exprs, err := rippleColumnList("users", [][2]string{
+		{"id", "u.id"},
+		{"username", "u.name"},
+		{"username_safe", "u.safe_name"},
+		{"password_md5", "u.pw_bcrypt"}, // both are bcrypt(md5(password))
+		{"email", "u.email"},
+		{"register_datetime", "u.creation_time"},
+		{"privileges", ripplePrivilegesExpr("u.priv")},
+		{"donor_expire", "u.donor_end"},
+		{"latest_activity", "u.latest_activity"},
+		{"silence_end", "u.silence_end"},
+		{"country", "UPPER(u.country)"}, // akatsuki's
+	})
+	if err != nil {
+		return err
+	}
+	n, err := copyRows(fmt.Sprintf(`
+	INSERT IGNORE INTO %s (%s) SELECT %s FROM users u
+	WHERE u.id != 1 AND u.id NOT IN (SELECT id FROM %s)`,
+		rippleTable("users"), names, exprs, rippleTable("users")))
+	if err != nil {
+		return err
+	}
+	logger.Info("exported users", "exported", n)
+
+	var clashing int
+	err = DB.Get(&clashing, fmt.Sprintf(`
+	SELECT COUNT(*) FROM users u JOIN %s r ON r.id = u.id
+	WHERE u.id != 1 AND r.username_safe != u.safe_name`, rippleTable("users")))
+	if err != nil {
+		return err
+	}
+	if clashing != 0 {
+		logger.Warn("some users' ids are taken by other users in the ripple database (e.g. fokabot's, 999), and weren't exported", "count", clashing)
+	}
+
+	for _, stats := range []string{"users_stats", "rx_stats", "ap_stats"} {
+		if exists, err := rippleTableExists(stats); err != nil {
+			return err
+		} else if !exists {
+			continue
+		}
+		names, exprs, err := rippleColumnList(stats, [][2]string{
+			{"id", "u.id"},
+			{"username", "u.name"},
+			{"country", "UPPER(u.country)"},
+			{"favourite_mode", "u.preferred_mode % 4"},
+			{"play_style", "u.play_style"},
+			{"custom_badge_name", "COALESCE(u.custom_badge_name, '')"},
+			{"custom_badge_icon", "COALESCE(u.custom_badge_icon, '')"},
+			{"userpage_content", "COALESCE(u.userpage_content, '')"},
+		})
+		if err != nil {
+			return err
+		}
+		_, err = copyRows(fmt.Sprintf(`
+		INSERT IGNORE INTO %s (%s) SELECT %s FROM users u JOIN %s r ON r.id = u.id
+		WHERE r.username_safe = u.safe_name`,
+			rippleTable(stats), names, exprs, rippleTable("users")))
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %w", stats, err)
+		}
+	}
+	return nil
+}
+
+// exportRippleStats fills in each mode's columns of the stats tables.
+func exportRippleStats() error {
+	for _, m := range rippleExportModes {
+		exists, err := rippleTableExists(m.stats)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		columns, err := rippleColumns(m.stats)
+		if err != nil {
+			return err
+		}
+
+		var set []string
+		for _, c := range []struct{ ripple, bpy string }{
+			{"ranked_score", "rscore"}, {"total_score", "tscore"}, {"playcount", "plays"},
+			{"playtime", "playtime"}, {"avg_accuracy", "acc"}, {"pp", "pp"},
+			{"total_hits", "total_hits"}, {"replays_watched", "replay_views"},
+		} {
+			if column := c.ripple + "_" + m.suffix; columns[column] {
+				set = append(set, fmt.Sprintf("r.%s = st.%s", column, c.bpy))
+			}
+		}
+		if len(set) == 0 {
+			continue
+		}
+		_, err = copyRows(fmt.Sprintf(`
+		UPDATE %s r JOIN stats st ON st.id = r.id AND st.mode = ? SET %s`,
+			rippleTable(m.stats), strings.Join(set, ", ")), m.mode)
+		if err != nil {
+			return fmt.Errorf("failed to export mode %d's stats: %w", m.mode, err)
+		}
+	}
+	logger.Info("exported stats")
+	return nil
+}
+
+// exportRippleMaps copies the cached beatmaps from the official servers,
+// as ripple has no private maps. the statuses are the same as ripple's.
+func exportRippleMaps() error {
+	difficulty := func(mode int) string { return fmt.Sprintf("IF(m.mode = %d, m.diff, 0)", mode) }
+	names, exprs, err := rippleColumnList("beatmaps", [][2]string{
+		{"beatmap_id", "m.id"},
+		{"beatmapset_id", "m.set_id"},
+		{"beatmap_md5", "m.md5"},
+		{"song_name", "CONCAT(m.artist, ' - ', m.title, ' [', m.version, ']')"},
+		{"file_name", "m.filename"},
+		{"ar", "m.ar"},
+		{"od", "m.od"},
+		{"mode", "m.mode"},
+		{"max_combo", "m.max_combo"},
+		{"hit_length", "m.total_length"},
+		{"bpm", "m.bpm"},
+		{"ranked", "m.status"},
+		{"latest_update", "UNIX_TIMESTAMP(m.last_update)"},
+		{"ranked_status_freezed", "m.frozen"},
+		{"playcount", "m.plays"},
+		{"passcount", "m.passes"},
+		{"difficulty_std", difficulty(0)},
+		{"difficulty_taiko", difficulty(1)},
+		{"difficulty_ctb", difficulty(2)},
+		{"difficulty_mania", difficulty(3)},
+	})
+	if err != nil {
+		return err
+	}
+	n, err := copyRows(fmt.Sprintf(`
+	INSERT INTO %s (%s) SELECT %s FROM maps m
+	WHERE m.server = 'osu!' AND m.md5 NOT IN (SELECT beatmap_md5 FROM %s)`,
+		rippleTable("beatmaps"), names, exprs, rippleTable("beatmaps")))
+	if err != nil {
+		return err
+	}
+	logger.Info("exported beatmaps", "exported", n)
+	return nil
+}
+
+// exportRippleScores copies the scores into their mode's table, a range of
+// ids at a time.
+func exportRippleScores() (map[string][]int, error) {
+	byTable := make(map[string][]int)
+	for _, m := range rippleExportModes {
+		byTable[m.scores] = append(byTable[m.scores], m.mode)
+	}
+
+	var maxID int64
+	if err := DB.Get(&maxID, "SELECT COALESCE(MAX(id), 0) FROM scores"); err != nil {
+		return nil, err
+	}
+
+	tables := make([]string, 0, len(byTable))
+	for table := range byTable {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	exported := make(map[string][]int)
+	for _, table := range tables {
+		modes := make([]string, len(byTable[table]))
+		for i, mode := range byTable[table] {
+			modes[i] = fmt.Sprint(mode)
+		}
+
+		exists, err := rippleTableExists(table)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			var count int
+			if err := DB.Get(&count, fmt.Sprintf("SELECT COUNT(*) FROM scores WHERE mode IN (%s)", strings.Join(modes, ", "))); err != nil {
+				return nil, err
+			}
+			if count != 0 {
+				logger.Warn("the ripple database has no table for some modes' scores, which weren't exported", "table", table, "modes", strings.Join(modes, ","), "scores", count)
+			}
+			continue
+		}
+		exported[table] = byTable[table]
+
+		query := fmt.Sprintf(export_ripple_scores, rippleTable(table), strings.Join(modes, ", "))
+		var total int64
+		step := int64(BatchSize) * 10
+		for after := int64(0); after < maxID; after += step {
+			if isInterrupted() {
+				return nil, errInterrupted
+			}
+			n, err := copyRows(query, after, after+step)
+			if err != nil {
+				return nil, fmt.Errorf("failed to export scores to %s: %w", table, err)
+			}
+			total += n
+		}
+		logger.Info("exported scores", "table", table, "exported", total)
+	}
+	return exported, nil
+}
+
+// exportRippleReplays copies the replays of the exported scores into lets'
+// directories, as replay_<id>.osr.
+func exportRippleReplays(tables map[string][]int) error {
+	for _, t := range rippleScoresTables {
+		modes := tables[t.table]
+		if len(modes) == 0 {
+			continue
+		}
+		dst, err := openReplayStore(strings.TrimRight(cfg.RippleReplays, "/") + "/" + t.replays)
+		if err != nil {
+			return err
+		}
+
+		in := make([]string, len(modes))
+		for i, mode := range modes {
+			in[i] = fmt.Sprint(mode)
+		}
+		query := fmt.Sprintf("SELECT id FROM scores WHERE mode IN (%s) AND status != 0 AND id > ? ORDER BY id LIMIT ?", strings.Join(in, ", "))
+
+		var copied, skipped, missing int
+		for after := int64(0); ; {
+			if isInterrupted() {
+				return errInterrupted
+			}
+			var ids []int64
+			if err := DB.Select(&ids, query, after, BatchSize); err != nil {
+				return err
+			}
+			if len(ids) == 0 {
+				break
+			}
+			after = ids[len(ids)-1]
+
+			for _, id := range ids {
+				key := fmt.Sprintf("replay_%d.osr", id)
+				if _, err := dst.Stat(key); err == nil {
+					skipped++
+					continue
+				}
+				_, _, err := copyReplay(newReplays, replayKey(id), dst, key)
+				switch {
+				case errors.Is(err, os.ErrNotExist):
+					missing++
+				case err != nil:
+					logger.Warn("failed to copy replay", "id", id, "err", err)
+				default:
+					copied++
+				}
+			}
+		}
+		logger.Info("exported replays", "directory", t.replays, "copied", copied, "already_there", skipped, "missing", missing)
+	}
+	return nil
+}
+
+// exportRippleLeaderboards writes ripple's leaderboards to redis.
+func exportRippleLeaderboards() error {
+	var entries []leaderboardEntry
+	if err := DB.Select(&entries, fmt.Sprintf(select_leaderboard_stats, "")); err != nil {
+		return err
+	}
+	keys := make(map[int]string, len(rippleExportModes))
+	for _, m := range rippleExportModes {
+		keys[m.mode] = m.leaderboard
+	}
+
+	leaderboards := make(map[string][]leaderboardMember)
+	for _, entry := range entries {
+		key, ok := keys[entry.Mode]
+		if !ok {
+			continue
+		}
+		member := leaderboardMember{id: entry.ID, pp: entry.PP}
+		leaderboards[key] = append(leaderboards[key], member)
+		leaderboards[key+":"+entry.Country] = append(leaderboards[key+":"+entry.Country], member)
+	}
+
+	rc, err := dialRedis(cfg)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	for key, members := range leaderboards {
+		if err := writeLeaderboard(rc, key, members); err != nil {
+			return fmt.Errorf("failed to write %s: %w", key, err)
+		}
+	}
+	logger.Info("exported leaderboards", "leaderboards", len(leaderboards), "players", len(entries))
+	return nil
+}
+
+func runExportRipple() error {
+	if !validSchemaName.MatchString(cfg.RippleDB) {
+		return errors.New("--ripple-db must be the name of the ripple database")
+	}
+	if cfg.RippleReplays == "" {
+		return errors.New("--ripple-replays must be the path to lets' .data directory")
+	}
+	for _, table := range []string{"users", "beatmaps", "scores"} {
+		if exists, err := rippleTableExists(table); err != nil {
+			return err
+		} else if !exists {
+			return fmt.Errorf("%s has no %s table, create the ripple database from ripple's schema first", cfg.RippleDB, table)
+		}
+	}
+	if err := setupReplayStores(); err != nil {
+		return err
+	}
+
+	// ctrl-c stops between batches, see signal.go
+	handleSignals()
+
+	start := time.Now()
+	if err := exportRippleUsers(); err != nil {
+		return fmt.Errorf("failed to export users: %w", err)
+	}
+	if err := exportRippleStats(); err != nil {
+		return fmt.Errorf("failed to export stats: %w", err)
+	}
+	if err := exportRippleMaps(); err != nil {
+		return fmt.Errorf("failed to export beatmaps: %w", err)
+	}
+	tables, err := exportRippleScores()
+	if err != nil {
+		return err
+	}
+	if err := exportRippleReplays(tables); err != nil {
+		return fmt.Errorf("failed to export replays: %w", err)
+	}
+	if cfg.ExportLeaderboards {
+		if err := exportRippleLeaderboards(); err != nil {
+			return fmt.Errorf("failed to export leaderboards: %w", err)
+		}
+	}
+
+	logger.Info("ripple export finished", "elapsed", time.Since(start).Round(time.Second))
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:              "export ripple",
+		Summary:           "copy users, stats, beatmaps, scores & replays into a ripple database",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.RippleDB, "ripple-db", "", "name of the ripple database, on the same server as bancho.py's, created from ripple's schema")
+			flags.StringVar(&c.RippleReplays, "ripple-replays", "", "lets' .data directory to copy replays into (as replays, replays_relax & replays_ap), a path or s3://bucket/prefix")
+			flags.StringVar(&c.NewReplays, "replays", "", "where bancho.py's replays are, a path or s3://bucket/prefix (default: DATA_DIRECTORY/osr)")
+			flags.BoolVar(&c.ExportLeaderboards, "leaderboards", false, "also write ripple's global & country leaderboards to redis (REDIS_HOST etc)")
+		},
+		Run: runExportRipple,
+	})
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// by default, scores are inserted one statement per row, which is what
+// bounds how fast a large table can be migrated. with --insert-mode multirow,
+// each statement inserts --batch-size rows, and with --insert-mode infile,
+// each batch is streamed to the server as tab separated text, through
+// LOAD DATA LOCAL INFILE (which needs local_infile enabled on the server).
+//
+// either way, the new ids must be known to map the old ones & move the
+// replays, so the ids are handed out by the migrator rather than by
+// auto_increment (or kept, when the scores table is rebuilt, or with
+// up --keep-ids). this assumes nothing else inserts into the scores table
+// while migrating, which holds for v4.2.0's new table, even with --online.
+
+const (
+	insertModeRow      = "row"
+	insertModeMultirow = "multirow"
+	insertModeInfile   = "infile"
+)
+
+// the columns of the new scores table, in the order rows are inserted
+var scoreColumns = []string{
+	"id", "map_md5", "score", "pp", "acc", "max_combo", "mods", "n300", "n100",
+	"n50", "nmiss", "ngeki", "nkatu", "grade", "status", "mode", "play_time",
+	"time_elapsed", "client_flags", "userid", "perfect", "online_checksum",
+}
+
+// play_time is read as a unix timestamp, and converted by the server
+const playTimeColumn = 16
+
+func scoreValues(id int64, s *Score) []interface{} {
+	return []interface{}{
+		id, s.MapMD5, s.Score, s.PP, s.Acc, s.MaxCombo, s.Mods, s.N300, s.N100,
+		s.N50, s.Nmiss, s.Ngeki, s.Nkatu, s.Grade, s.Status, s.Mode, s.PlayTime,
+		s.TimeElapsed, s.ClientFlags, s.UserID, s.Perfect, s.OnlineChecksum.String,
+	}
+}
+
+// scoreIDs hands out the new scores' ids, continuing from the table's highest.
+var scoreIDs struct {
+	sync.Mutex
+	next int64
+}
+
+func reserveScoreIDs(n int) (int64, error) {
+	scoreIDs.Lock()
+	defer scoreIDs.Unlock()
+
+	if scoreIDs.next == 0 {
+		var max int64
+		if err := DB.Get(&max, "SELECT COALESCE(MAX(id), 0) FROM scores"); err != nil {
+			return 0, err
+		}
+		scoreIDs.next = max + 1
+	}
+	first := scoreIDs.next
+	scoreIDs.next += int64(n)
+	return first, nil
+}
+
+// checkInsertMode makes sure the server accepts what the insert mode sends.
+func checkInsertMode() error {
+	if cfg.InsertMode != insertModeInfile {
+		return nil
+	}
+	var enabled bool
+	if err := DB.Get(&enabled, "SELECT @@local_infile"); err != nil {
+		return err
+	}
+	if !enabled {
+		return errors.New("--insert-mode infile needs local_infile enabled on the server (SET GLOBAL local_infile = 1), or use --insert-mode multirow")
+	}
+	return nil
+}
+
+// errInfileRejected is returned when the server loaded a batch with
+// warnings, i.e. rows which were skipped or silently altered.
+var errInfileRejected = errors.New("LOAD DATA loaded the batch with warnings")
+
+// insertBatchBulk inserts a batch many rows per statement. a statement which
+// fails for any reason other than a retryable one is retried a row at a
+// time, so that only the rows at fault are skipped.
+func insertBatchBulk(batch ScoreBatch, mode string) (batchResult, error) {
+	var result batchResult
+
+	scores := make([]Score, len(batch.Scores))
+	for i, score := range batch.Scores {
+		score.Mode += batch.Table.ModeOffset
+		if batch.Table.Prepare != nil {
+			batch.Table.Prepare(&score)
+		}
+		if !score.OnlineChecksum.Valid {
+			score.OnlineChecksum.String = ""
+			score.OnlineChecksum.Valid = true
+		}
+		scores[i] = score
+	}
+
+	ids := make([]int64, len(scores))
+	if batch.Table.KeepIDs {
+		for i, score := range scores {
+			ids[i] = batch.Table.keptID(score.ID)
+		}
+	} else {
+		first, err := reserveScoreIDs(len(scores))
+		if err != nil {
+			return result, err
+		}
+		for i := range ids {
+			ids[i] = first + int64(i)
+		}
+	}
+
+	tx, err := DB.Beginx()
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	inserted := make([]bool, len(scores))
+	insertRows := func(start, end int) error {
+		if mode == insertModeInfile {
+			return loadScores(tx, scores[start:end], ids[start:end])
+		}
+		return insertScores(tx, scores[start:end], ids[start:end])
+	}
+
+	step := len(scores)
+	if mode == insertModeMultirow {
+		step = cfg.BatchSize
+	}
+	for start := 0; start < len(scores); start += step {
+		end := start + step
+		if end > len(scores) {
+			end = len(scores)
+		}
+
+		err := insertRows(start, end)
+		if err == nil {
+			for i := start; i < end; i++ {
+				inserted[i] = true
+			}
+			continue
+		}
+		if _, retryable := retryReason(err); retryable || errors.Is(err, errInfileRejected) {
+			return result, err
+		}
+
+		for i := start; i < end; i++ {
+			if err := insertScores(tx, scores[i:i+1], ids[i:i+1]); err != nil {
+				if _, retryable := retryReason(err); retryable {
+					return result, err
+				}
+				logger.Warn("failed to insert score", "table", batch.Table.Name, "old_id", scores[i].ID, "err", err)
+				result.failed = append(result.failed, failedRow(batch.Table, batch.Scores[i], err))
+				continue
+			}
+			inserted[i] = true
+		}
+	}
+
+	// the id mappings are inserted many rows per statement as well
+	var insertedIDs []int64
+	mappings := make([]interface{}, 0, 4*len(scores))
+	for i, score := range scores {
+		if !inserted[i] {
+			continue
+		}
+		newID := ids[i]
+
+		// this is a submitted score, its replay file must move as well
+		hasReplay := score.Status != 0 && (!batch.Table.KeepIDs || batch.Table.MoveKeptReplays)
+		if hasReplay {
+			result.moves = append(result.moves, ReplayMove{OldID: score.ID, NewID: newID})
+		}
+		mappings = append(mappings, batch.Table.Name, score.ID, newID, hasReplay)
+		insertedIDs = append(insertedIDs, score.ID)
+		result.inserted++
+	}
+	for start := 0; start < len(mappings); start += 4 * cfg.BatchSize {
+		end := start + 4*cfg.BatchSize
+		if end > len(mappings) {
+			end = len(mappings)
+		}
+		query := "INSERT INTO migration_score_ids (source_table, old_id, new_id, has_replay) VALUES " +
+			placeholders((end-start)/4, 4, func(int) string { return "?" })
+		if _, err := tx.Exec(query, mappings[start:end]...); err != nil {
+			return result, fmt.Errorf("failed to record id mappings: %w", err)
+		}
+	}
+
+	commitStart := time.Now()
+	if err := tx.Commit(); err != nil {
+		if reason, _ := retryReason(err); reason == "connection" && batchCommitted(batch.Table, insertedIDs) {
+			return result, nil
+		}
+		return result, err
+	}
+	metricBatchCommitSeconds.ObserveSince(commitStart)
+
+	return result, nil
+}
+
+// insertScores inserts scores with a single multi-row INSERT.
+func insertScores(tx *sqlx.Tx, scores []Score, ids []int64) error {
+	values := make([]interface{}, 0, len(scores)*len(scoreColumns))
+	for i := range scores {
+		values = append(values, scoreValues(ids[i], &scores[i])...)
+	}
+	query := fmt.Sprintf("INSERT INTO scores (%s) VALUES %s", strings.Join(scoreColumns, ", "),
+		placeholders(len(scores), len(scoreColumns), func(n int) string {
+			if (n-1)%len(scoreColumns) == playTimeColumn {
+				return "FROM_UNIXTIME(?)"
+			}
+			return "?"
+		}))
+	_, err := tx.Exec(query, values...)
+	return err
+}
+
+var infileReaders int64
+
+// loadScores streams scores to the server with LOAD DATA LOCAL INFILE.
+// the server only warns about rows it couldn't load as they are, so any
+// warning rejects the whole load.
+func loadScores(tx *sqlx.Tx, scores []Score, ids []int64) error {
+	var buf bytes.Buffer
+	for i := range scores {
+		for column, value := range scoreValues(ids[i], &scores[i]) {
+			if column > 0 {
+				buf.WriteByte('\t')
+			}
+			writeInfileValue(&buf, value)
+		}
+		buf.WriteByte('\n')
+	}
+
+	name := "scores_" + strconv.FormatInt(atomic.AddInt64(&infileReaders, 1), 10)
+	mysql.RegisterReaderHandler(name, func() io.Reader { return &buf })
+	defer mysql.DeregisterReaderHandler(name)
+
+	columns := make([]string, len(scoreColumns))
+	copy(columns, scoreColumns)
+	columns[playTimeColumn] = "@play_time"
+	res, err := tx.Exec(fmt.Sprintf(`
+	LOAD DATA LOCAL INFILE 'Reader::%s' INTO TABLE scores CHARACTER SET utf8mb4 (%s)
+	SET play_time = FROM_UNIXTIME(@play_time)`, name, strings.Join(columns, ", ")))
+	if err != nil {
+		return err
+	}
+
+	var warnings int
+	if err := tx.Get(&warnings, "SELECT @@warning_count"); err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != int64(len(scores)) || warnings != 0 {
+		return errInfileRejected
+	}
+	return nil
+}
+
+// writeInfileValue writes a value in LOAD DATA's default format, where
+// tabs, newlines & backslashes are escaped with a backslash.
+func writeInfileValue(buf *bytes.Buffer, value interface{}) {
+	s, ok := value.(string)
+	if !ok {
+		fmt.Fprint(buf, value)
+		return
+	}
+	for _, r := range s {
+		switch r {
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case 0:
+			buf.WriteString(`\0`)
+		default:
+			buf.WriteRune(r)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// fileID is 0 where inodes aren't available, so every file is counted.
+func fileID(info os.FileInfo) uint64 {
+	return 0
+}
+
+// fileDevice is 0 where devices aren't available, i.e. unknown.
+func fileDevice(info os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the score migrations can migrate a subset of the scores, e.g. leaving out
+// failed scores, or those older than a couple of years, which most servers
+// never look at again:
+//
+//	--users cmyui,3    only these users' scores, by name or id
+//	--modes 0,4        only these modes, as in bancho.py (0-3 vanilla, 4-6 relax, 8 autopilot)
+//	--since 2022-01-01 only scores played since, or a duration ago (e.g. 17520h)
+//	--until 2024-01-01 only scores played before
+//	--min-status 1     only scores with at least this status (0 failed, 1 submitted, 2 best)
+//
+// rows left out are still read, as the old tables' queries can't all be
+// filtered the same way, but aren't inserted, nor are their replays moved.
+// they stay in the old tables, so those shouldn't be dropped until they're
+// no longer wanted, and migrate verify will count them as missing.
+
+// ScoreFilter selects which scores are migrated.
+type ScoreFilter struct {
+	Users     map[int64]bool // empty for every user
+	Modes     map[int]bool   // bancho.py's modes, after the tables' offsets
+	Since     int64          // unix time, 0 for no limit
+	Until     int64
+	MinStatus int
+}
+
+// scoreFilter is set by setupScoreFilter, and nil when every score is migrated.
+var scoreFilter *ScoreFilter
+
+// filterFlags registers the flags selecting which scores are migrated.
+func filterFlags(flags *flag.FlagSet, c *Config) {
+	flags.StringVar(&c.FilterUsers, "users", "", "only migrate these users' scores, names or ids, comma separated")
+	flags.StringVar(&c.FilterModes, "modes", "", "only migrate these modes, comma separated (0-3 vanilla, 4-6 relax, 8 autopilot)")
+	flags.StringVar(&c.FilterSince, "since", "", "only migrate scores played since this date, or duration ago (e.g. 17520h)")
+	flags.StringVar(&c.FilterUntil, "until", "", "only migrate scores played before this date, or duration ago")
+	flags.IntVar(&c.FilterMinStatus, "min-status", 0, "only migrate scores with at least this status: 0 every score, 1 to leave out failed scores, 2 only best scores")
+}
+
+// parseFilterTime reads a date or time in the server's time zone, or a
+// duration before now, as a unix time.
+func parseFilterTime(name, value string) (int64, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d).Unix(), nil
+	}
+	for _, layout := range []string{"2006-01-02", "2006-01-02 15:04:05", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t.Unix(), nil
+		}
+	}
+	return 0, fmt.Errorf("--%s %q must be a date (e.g. 2024-01-31) or a duration (e.g. 24h)", name, value)
+}
+
+// setupScoreFilter reads the filter flags.
+func setupScoreFilter() error {
+	f := &ScoreFilter{Users: map[int64]bool{}, Modes: map[int]bool{}, MinStatus: cfg.FilterMinStatus}
+	var err error
+
+	for _, user := range strings.Split(cfg.FilterUsers, ",") {
+		if user = strings.TrimSpace(user); user == "" {
+			continue
+		}
+		id, err := findUser(user)
+		if err != nil {
+			return err
+		}
+		f.Users[id] = true
+	}
+	for _, mode := range strings.Split(cfg.FilterModes, ",") {
+		if mode = strings.TrimSpace(mode); mode == "" {
+			continue
+		}
+		n, err := strconv.Atoi(mode)
+		if err != nil || n < 0 || n > 8 || n == 7 {
+			return fmt.Errorf("--modes %q must be bancho.py's modes, 0-6 or 8", cfg.FilterModes)
+		}
+		f.Modes[n] = true
+	}
+	if cfg.FilterSince != "" {
+		if f.Since, err = parseFilterTime("since", cfg.FilterSince); err != nil {
+			return err
+		}
+	}
+	if cfg.FilterUntil != "" {
+		if f.Until, err = parseFilterTime("until", cfg.FilterUntil); err != nil {
+			return err
+		}
+	}
+	if f.MinStatus < 0 || f.MinStatus > 2 {
+		return fmt.Errorf("--min-status %d must be 0, 1 or 2", f.MinStatus)
+	}
+
+	if len(f.Users) == 0 && len(f.Modes) == 0 && f.Since == 0 && f.Until == 0 && f.MinStatus == 0 {
+		scoreFilter = nil
+		return nil
+	}
+	scoreFilter = f
+	logger.Info("only migrating some scores", "users", len(f.Users), "modes", cfg.FilterModes,
+		"since", cfg.FilterSince, "until", cfg.FilterUntil, "min_status", f.MinStatus)
+	return nil
+}
+
+// match reports whether a score read from table is migrated.
+func (f *ScoreFilter) match(table SourceTable, score Score) bool {
+	if f == nil {
+		return true
+	}
+	switch {
+	case len(f.Users) != 0 && !f.Users[score.UserID]:
+		return false
+	case len(f.Modes) != 0 && !f.Modes[table.mode(score)]:
+		return false
+	case f.Since != 0 && score.PlayTime < f.Since:
+		return false
+	case f.Until != 0 && score.PlayTime >= f.Until:
+		return false
+	case score.Status < f.MinStatus:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseFilterTime(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  time.Time
+	}{
+		{"2024-01-31", time.Date(2024, 1, 31, 0, 0, 0, 0, time.Local)},
+		{"2024-01-31 12:30:00", time.Date(2024, 1, 31, 12, 30, 0, 0, time.Local)},
+		{"2024-01-31T12:30:00Z", time.Date(2024, 1, 31, 12, 30, 0, 0, time.UTC)},
+	} {
+		if got, err := parseFilterTime("since", tt.value); err != nil || got != tt.want.Unix() {
+			t.Errorf("parseFilterTime(%q) = %d, %v, want %d", tt.value, got, err, tt.want.Unix())
+		}
+	}
+
+	got, err := parseFilterTime("since", "48h")
+	if want := time.Now().Add(-48 * time.Hour).Unix(); err != nil || got < want-5 || got > want {
+		t.Errorf("parseFilterTime(48h) = %d, %v, want about %d", got, err, want)
+	}
+
+	for _, value := range []string{"yesterday", "2024-13-01", "31/01/2024", ""} {
+		if _, err := parseFilterTime("since", value); err == nil {
+			t.Errorf("parseFilterTime(%q) succeeded", value)
+		}
+	}
+}
+
+func TestSetupScoreFilter(t *testing.T) {
+	defer func(c *Config) { cfg, scoreFilter = c, nil }(cfg)
+
+	for _, tt := range []struct {
+		name   string
+		config Config
+		want   *ScoreFilter
+		ok     bool
+	}{
+		{"no filters", Config{}, nil, true},
+		{"modes", Config{FilterModes: "0, 4,8"},
+			&ScoreFilter{Users: map[int64]bool{}, Modes: map[int]bool{0: true, 4: true, 8: true}}, true},
+		{"since & status", Config{FilterSince: "2022-01-01", FilterMinStatus: 1},
+			&ScoreFilter{Users: map[int64]bool{}, Modes: map[int]bool{}, Since: time.Date(2022, 1, 1, 0, 0, 0, 0, time.Local).Unix(), MinStatus: 1}, true},
+		{"mode 7", Config{FilterModes: "7"}, nil, false},
+		{"mode out of range", Config{FilterModes: "0,9"}, nil, false},
+		{"mode name", Config{FilterModes: "osu"}, nil, false},
+		{"bad date", Config{FilterUntil: "soon"}, nil, false},
+		{"bad status", Config{FilterMinStatus: 3}, nil, false},
+	} {
+		cfg, scoreFilter = &tt.config, nil
+		err := setupScoreFilter()
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: setupScoreFilter() = %v, want ok %v", tt.name, err, tt.ok)
+		} else if err == nil && !reflect.DeepEqual(scoreFilter, tt.want) {
+			t.Errorf("%s: scoreFilter = %+v, want %+v", tt.name, scoreFilter, tt.want)
+		}
+	}
+}
+
+func TestScoreFilterMatch(t *testing.T) {
+	f := &ScoreFilter{
+		Users:     map[int64]bool{3: true},
+		Modes:     map[int]bool{4: true},
+		Since:     1000,
+		Until:     2000,
+		MinStatus: 1,
+	}
+	rx := SourceTable{Name: "scores_rx", ModeOffset: 4}
+	match := Score{UserID: 3, Mode: 0, PlayTime: 1500, Status: 2}
+	for _, tt := range []struct {
+		name  string
+		table SourceTable
+		edit  func(s *Score)
+		want  bool
+	}{
+		{"matching", rx, func(s *Score) {}, true},
+		{"other user", rx, func(s *Score) { s.UserID = 4 }, false},
+		{"vanilla table", SourceTable{Name: "scores_vn"}, func(s *Score) {}, false},
+		{"before since", rx, func(s *Score) { s.PlayTime = 999 }, false},
+		{"at since", rx, func(s *Score) { s.PlayTime = 1000 }, true},
+		{"at until", rx, func(s *Score) { s.PlayTime = 2000 }, false},
+		{"failed", rx, func(s *Score) { s.Status = 0 }, false},
+	} {
+		score := match
+		tt.edit(&score)
+		if got := f.match(tt.table, score); got != tt.want {
+			t.Errorf("%s: match() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	var none *ScoreFilter
+	if !none.match(rx, Score{}) {
+		t.Error("a nil filter left a score out")
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// bancho.py works out #1s on the fly, when a score is submitted. frontends
+// (#1 counts, first place listings) need them all at once though, so they're
+// kept in the first_places table, which recalc first-places rebuilds from the
+// scores table after pp or statuses change. the #1 is picked the same way as
+// bancho.py's leaderboards: by score for vanilla, or by pp for relax &
+// autopilot, from unrestricted players' best scores on maps with leaderboards.
+
+var create_first_places = `
+CREATE TABLE IF NOT EXISTS first_places (
+	map_md5 char(32) not null,
+	mode tinyint(1) not null,
+	score_id bigint unsigned not null,
+	userid int not null,
+	primary key (map_md5, mode),
+	index first_places_userid_index (userid)
+)`
+
+// ordered by map, then best first; the earlier score wins ties
+var select_first_place_candidates = `
+SELECT s.map_md5, s.mode, s.id AS score_id, s.userid
+FROM scores s
+JOIN users u ON u.id = s.userid
+JOIN maps m ON m.md5 = s.map_md5
+WHERE s.mode = ? AND s.status = 2 AND u.priv & 1 AND m.status IN (?, ?, ?)%s
+ORDER BY s.map_md5, s.%s DESC, s.id`
+
+// FirstPlace is the #1 score on a map, in a mode.
+type FirstPlace struct {
+	MapMD5  string `db:"map_md5" json:"map_md5"`
+	Mode    int    `db:"mode" json:"mode"`
+	ScoreID int64  `db:"score_id" json:"score_id"`
+	UserID  int64  `db:"userid" json:"userid"`
+}
+
+// FirstPlaceChange is a map whose #1 changed hands, for announcements.
+// the old or new user is 0 if the map had, or now has, no #1.
+type FirstPlaceChange struct {
+	MapMD5     string `json:"map_md5"`
+	Mode       int    `json:"mode"`
+	OldUserID  int64  `json:"old_userid"`
+	NewUserID  int64  `json:"new_userid"`
+	NewScoreID int64  `json:"new_score_id,omitempty"`
+}
+
+// FirstPlacesReport is the diff written by --diff.
+type FirstPlacesReport struct {
+	Time     time.Time          `json:"time"`
+	Baseline bool               `json:"baseline"` // false on the first run, when nothing is compared
+	Changes  []FirstPlaceChange `json:"changes"`
+}
+
+// leaderboardMetric is what bancho.py ranks a mode's leaderboards by.
+func leaderboardMetric(mode int) string {
+	if mode >= 4 {
+		return "pp"
+	}
+	return "score"
+}
+
+// inMaps adds a condition on the map to a query, if only some maps are
+// being rebuilt.
+func inMaps(query, column string, args []interface{}, md5s []string) (string, []interface{}, error) {
+	if md5s == nil {
+		return fmt.Sprintf(query, ""), args, nil
+	}
+	return sqlx.In(fmt.Sprintf(query, " AND "+column+" IN (?)"), append(args, md5s)...)
+}
+
+// findFirstPlaces works out the #1 of every map in a mode, or of the maps
+// given.
+func findFirstPlaces(mode int, md5s []string) ([]FirstPlace, error) {
+	// the condition on the map is left for inMaps
+	query := fmt.Sprintf(select_first_place_candidates, "%s", leaderboardMetric(mode))
+	query, args, err := inMaps(query, "s.map_md5",
+		[]interface{}{mode, mapStatusRanked, mapStatusApproved, mapStatusLoved}, md5s)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := DB.Queryx(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var firsts []FirstPlace
+	for rows.Next() {
+		var first FirstPlace
+		if err := rows.StructScan(&first); err != nil {
+			return nil, err
+		}
+		if len(firsts) == 0 || firsts[len(firsts)-1].MapMD5 != first.MapMD5 {
+			firsts = append(firsts, first)
+		}
+	}
+	return firsts, rows.Err()
+}
+
+// rebuildFirstPlaces replaces a mode's #1s, or just those of the maps
+// given, returning which changed hands.
+func rebuildFirstPlaces(mode int, md5s []string) ([]FirstPlaceChange, error) {
+	firsts, err := findFirstPlaces(mode, md5s)
+	if err != nil {
+		return nil, err
+	}
+
+	var previous []FirstPlace
+	query, args, err := inMaps("SELECT map_md5, mode, score_id, userid FROM first_places WHERE mode = ?%s", "map_md5",
+		[]interface{}{mode}, md5s)
+	if err != nil {
+		return nil, err
+	}
+	if err := DB.Select(&previous, query, args...); err != nil {
+		return nil, err
+	}
+	old := make(map[string]FirstPlace, len(previous))
+	for _, first := range previous {
+		old[first.MapMD5] = first
+	}
+
+	var changes []FirstPlaceChange
+	for _, first := range firsts {
+		if prev, ok := old[first.MapMD5]; !ok || prev.UserID != first.UserID {
+			changes = append(changes, FirstPlaceChange{MapMD5: first.MapMD5, Mode: mode,
+				OldUserID: prev.UserID, NewUserID: first.UserID, NewScoreID: first.ScoreID})
+		}
+		delete(old, first.MapMD5)
+	}
+	// maps which no longer have a #1 at all
+	for _, prev := range old {
+		changes = append(changes, FirstPlaceChange{MapMD5: prev.MapMD5, Mode: mode, OldUserID: prev.UserID})
+	}
+
+	if cfg.DryRun {
+		return changes, nil
+	}
+	if err := throttle(len(firsts)); err != nil {
+		return nil, err
+	}
+
+	tx, err := DB.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query, args, err = inMaps("DELETE FROM first_places WHERE mode = ?%s", "map_md5", []interface{}{mode}, md5s)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(query, args...); err != nil {
+		return nil, err
+	}
+	for start := 0; start < len(firsts); start += BatchSize {
+		end := start + BatchSize
+		if end > len(firsts) {
+			end = len(firsts)
+		}
+		_, err := tx.NamedExec(`
+		INSERT INTO first_places (map_md5, mode, score_id, userid)
+		VALUES (:map_md5, :mode, :score_id, :userid)`, firsts[start:end])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return changes, tx.Commit()
+}
+
+func runRecalcFirstPlaces() error {
+	modes := make([]int, 0, len(statsModes))
+	if cfg.RecalcMode >= 0 {
+		if !statsModes[cfg.RecalcMode] {
+			return fmt.Errorf("--mode %d is not one of bancho.py's modes", cfg.RecalcMode)
+		}
+		modes = append(modes, cfg.RecalcMode)
+	} else {
+		for mode := range statsModes {
+			modes = append(modes, mode)
+		}
+		sort.Ints(modes)
+	}
+
+	exists, err := tableExists("first_places")
+	if err != nil {
+		return err
+	}
+	if !exists && !cfg.DryRun {
+		if _, err := DB.Exec(create_first_places); err != nil {
+			return err
+		}
+	}
+	report := &FirstPlacesReport{Time: time.Now().UTC(), Baseline: exists, Changes: []FirstPlaceChange{}}
+
+	// each mode is a single (sorted) pass over its scores
+	start := time.Now()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	failed := false
+	for _, mode := range modes {
+		wg.Add(1)
+		go func(mode int) {
+			defer wg.Done()
+
+			var changes []FirstPlaceChange
+			var err error
+			if exists || !cfg.DryRun {
+				changes, err = rebuildFirstPlaces(mode, nil)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				logger.Error("failed to rebuild first places", "mode", mode, "err", err)
+				failed = true
+				return
+			}
+			logger.Info("rebuilt first places", "mode", mode, "changed", len(changes))
+			if exists {
+				report.Changes = append(report.Changes, changes...)
+			}
+		}(mode)
+	}
+	wg.Wait()
+
+	sort.Slice(report.Changes, func(i, j int) bool {
+		a, b := report.Changes[i], report.Changes[j]
+		return a.Mode < b.Mode || a.Mode == b.Mode && a.MapMD5 < b.MapMD5
+	})
+	if err := writeReport(cfg.ReportPath, report); err != nil {
+		return err
+	}
+
+	logger.Info("rebuilt first places", "changed", len(report.Changes), "dry_run", cfg.DryRun,
+		"elapsed", time.Since(start).Round(time.Second))
+	if !exists {
+		logger.Info("first_places was empty, so there was nothing to compare against")
+	}
+	if failed {
+		return errors.New("some modes' first places could not be rebuilt")
+	}
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "recalc first-places",
+		Summary: "rebuild the first_places table, the #1 score of each map in each mode",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.IntVar(&c.RecalcMode, "mode", -1, "only rebuild this mode (0-3 vanilla, 4-6 relax, 8 autopilot)")
+			flags.StringVar(&c.ReportPath, "diff", "", "write the maps whose #1 changed hands to this file as json (- for stdout)")
+			flags.BoolVar(&c.DryRun, "dry-run", false, "report what would change without changing anything")
+		},
+		Run: runRecalcFirstPlaces,
+	})
+}
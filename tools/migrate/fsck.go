@@ -0,0 +1,313 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// fsck scans for data left pointing at something which no longer exists:
+// scores & stats of deleted users, favourites of unknown beatmaps, and
+// replays without a score. bancho.py's schema has no foreign keys, so these
+// accumulate whenever rows are deleted by hand. by default they're only
+// reported; --action archive moves them aside (rows into orphaned_<table>,
+// replays into --archive-replays), and --action delete removes them.
+
+const (
+	fsckReport  = "report"
+	fsckArchive = "archive"
+	fsckDelete  = "delete"
+)
+
+// fsckExamples is how many of each check's orphans are listed.
+const fsckExamples = 10
+
+// OrphanCheck finds the rows of a table which point at nothing. condition
+// is over the table, aliased as t.
+type OrphanCheck struct {
+	Name        string
+	Table       string
+	Description string
+	Key         string // identifies a row in the report
+	Condition   string
+}
+
+var orphanChecks = []OrphanCheck{
+	{
+		Name:        "scores",
+		Table:       "scores",
+		Description: "scores of users who don't exist",
+		Key:         "t.id",
+		Condition:   "NOT EXISTS (SELECT 1 FROM users u WHERE u.id = t.userid)",
+	},
+	{
+		Name:        "stats",
+		Table:       "stats",
+		Description: "stats of users who don't exist",
+		Key:         "CONCAT(t.id, ':', t.mode)",
+		Condition:   "NOT EXISTS (SELECT 1 FROM users u WHERE u.id = t.id)",
+	},
+	{
+		Name:        "favourites",
+		Table:       "favourites",
+		Description: "favourites of beatmap sets which aren't known",
+		Key:         "CONCAT(t.userid, ':', t.setid)",
+		Condition:   "NOT EXISTS (SELECT 1 FROM maps m WHERE m.set_id = t.setid)",
+	},
+}
+
+// OrphanResult is what a check found.
+type OrphanResult struct {
+	Check       string   `json:"check"`
+	Description string   `json:"description"`
+	Count       int64    `json:"count"`
+	Examples    []string `json:"examples"`
+	Skipped     string   `json:"skipped,omitempty"` // why the check didn't run
+}
+
+type FsckReport struct {
+	Action  string         `json:"action"`
+	Results []OrphanResult `json:"results"`
+}
+
+var errOrphansFound = errors.New("orphaned data was found")
+
+// scanOrphans counts a check's orphans, and lists a few.
+func scanOrphans(check OrphanCheck) (OrphanResult, error) {
+	result := OrphanResult{Check: check.Name, Description: check.Description, Examples: []string{}}
+
+	exists, err := tableExists(check.Table)
+	if err != nil || !exists {
+		result.Skipped = fmt.Sprintf("%s doesn't exist", check.Table)
+		return result, err
+	}
+
+	err = ReadDB.Get(&result.Count, fmt.Sprintf("SELECT COUNT(*) FROM %s t WHERE %s", check.Table, check.Condition))
+	if err != nil {
+		return result, err
+	}
+	if result.Count != 0 {
+		err = ReadDB.Select(&result.Examples, fmt.Sprintf("SELECT %s FROM %s t WHERE %s LIMIT %d",
+			check.Key, check.Table, check.Condition, fsckExamples))
+	}
+	return result, err
+}
+
+// removeOrphans archives or deletes a check's orphans, in one transaction.
+func removeOrphans(check OrphanCheck, archive bool) (int64, error) {
+	tx, err := DB.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if archive {
+		archived := "orphaned_" + check.Table
+		if _, err := tx.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s LIKE %s", archived, check.Table)); err != nil {
+			return 0, err
+		}
+		_, err := tx.Exec(fmt.Sprintf("INSERT IGNORE INTO %s SELECT t.* FROM %s t WHERE %s", archived, check.Table, check.Condition))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	res, err := tx.Exec(fmt.Sprintf("DELETE t FROM %s t WHERE %s", check.Table, check.Condition))
+	if err != nil {
+		return 0, err
+	}
+	removed, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return removed, tx.Commit()
+}
+
+// scanOrphanedReplays finds the replays whose score doesn't exist.
+func scanOrphanedReplays() ([]int64, error) {
+	var ids []int64
+	err := newReplays.List(func(key string) error {
+		id, err := strconv.ParseInt(strings.TrimSuffix(key, ".osr"), 10, 64)
+		if err != nil {
+			logger.Warn("skipping a replay which isn't named by its score's id", "location", newReplays.Location(key))
+			return nil
+		}
+		ids = append(ids, id)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []int64
+	for start := 0; start < len(ids); start += BatchSize {
+		end := start + BatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		query, args, err := sqlx.In("SELECT id FROM scores WHERE id IN (?)", ids[start:end])
+		if err != nil {
+			return nil, err
+		}
+		var found []int64
+		if err := DB.Select(&found, query, args...); err != nil {
+			return nil, err
+		}
+		exists := make(map[int64]bool, len(found))
+		for _, id := range found {
+			exists[id] = true
+		}
+		for _, id := range ids[start:end] {
+			if !exists[id] {
+				orphans = append(orphans, id)
+			}
+		}
+	}
+	return orphans, nil
+}
+
+// removeOrphanedReplays moves orphaned replays into the archive, or deletes them.
+func removeOrphanedReplays(ids []int64, archive bool) (int, error) {
+	if !archive {
+		removed := 0
+		for _, id := range ids {
+			if err := newReplays.Delete(replayKey(id)); err != nil {
+				logger.Warn("failed to delete an orphaned replay", "id", id, "err", err)
+				continue
+			}
+			removed++
+		}
+		return removed, nil
+	}
+
+	location := cfg.ArchiveReplays
+	if location == "" {
+		location = cfg.ReplayDirectory() + "_orphaned"
+		if err := os.MkdirAll(location, 0755); err != nil {
+			return 0, err
+		}
+	}
+	store, err := openReplayStore(location)
+	if err != nil {
+		return 0, err
+	}
+
+	replayJournal, err = openReplayJournal(cfg.ReplayJournalPath)
+	if err != nil {
+		return 0, err
+	}
+	defer replayJournal.Close()
+
+	moves := make([]ReplayMove, len(ids))
+	for i, id := range ids {
+		moves[i] = ReplayMove{OldID: id, NewID: id}
+	}
+	moved, err := relocateReplays("archive", "scores", moves, newReplays, oldReplayKey, store, newReplayKey)
+	return len(moved), err
+}
+
+func runFsck() error {
+	switch cfg.FsckAction {
+	case fsckReport, fsckArchive, fsckDelete:
+	default:
+		return fmt.Errorf("unknown --action %q, expected report, archive or delete", cfg.FsckAction)
+	}
+	archive := cfg.FsckAction == fsckArchive
+	if err := setupReplayStores(); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	report := FsckReport{Action: cfg.FsckAction}
+	var found int64
+	for _, check := range orphanChecks {
+		if isInterrupted() {
+			return errInterrupted
+		}
+
+		result, err := scanOrphans(check)
+		if err != nil {
+			return fmt.Errorf("failed to check %s: %w", check.Name, err)
+		}
+		report.Results = append(report.Results, result)
+		found += result.Count
+		if result.Count == 0 || cfg.FsckAction == fsckReport {
+			continue
+		}
+
+		removed, err := removeOrphans(check, archive)
+		if err != nil {
+			return fmt.Errorf("failed to remove orphaned %s: %w", check.Name, err)
+		}
+		logger.Info("removed orphans", "check", check.Name, "rows", removed, "archived", archive)
+	}
+
+	// replays are checked last, so those of the scores just removed are included
+	result := OrphanResult{Check: "replays", Description: "replays of scores which don't exist", Examples: []string{}}
+	if exists, err := tableExists("scores"); err != nil {
+		return err
+	} else if !exists {
+		result.Skipped = "scores doesn't exist, as v4.2.0 hasn't been migrated to"
+	} else {
+		orphans, err := scanOrphanedReplays()
+		if err != nil {
+			return fmt.Errorf("failed to check replays: %w", err)
+		}
+		result.Count = int64(len(orphans))
+		for i := 0; i < len(orphans) && i < fsckExamples; i++ {
+			result.Examples = append(result.Examples, newReplays.Location(replayKey(orphans[i])))
+		}
+		found += result.Count
+
+		if len(orphans) != 0 && cfg.FsckAction != fsckReport {
+			removed, err := removeOrphanedReplays(orphans, archive)
+			if err != nil {
+				return fmt.Errorf("failed to remove orphaned replays: %w", err)
+			}
+			logger.Info("removed orphans", "check", "replays", "replays", removed, "archived", archive)
+		}
+	}
+	report.Results = append(report.Results, result)
+
+	for _, result := range report.Results {
+		switch {
+		case result.Skipped != "":
+			fmt.Printf("%-10s skipped: %s\n", result.Check, result.Skipped)
+		case result.Count == 0:
+			fmt.Printf("%-10s ok\n", result.Check)
+		default:
+			fmt.Printf("%-10s %d %s (e.g. %s)\n", result.Check, result.Count, result.Description, strings.Join(result.Examples, ", "))
+		}
+	}
+	if err := writeReport(cfg.ReportPath, report); err != nil {
+		return err
+	}
+
+	logger.Info("fsck finished", "orphans", found, "action", cfg.FsckAction,
+		"elapsed", time.Since(start).Round(time.Second))
+	if found != 0 && cfg.FsckAction == fsckReport {
+		return errOrphansFound
+	}
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:              "fsck",
+		Summary:           "find scores, stats, favourites & replays left pointing at users, maps or scores which don't exist",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.FsckAction, "action", fsckReport, "what to do with orphans: report, archive (into orphaned_<table> & --archive-replays) or delete")
+			flags.StringVar(&c.ArchiveReplays, "archive-replays", "", "where orphaned replays are archived to, a path or s3://bucket/prefix (default: DATA_DIRECTORY/osr_orphaned)")
+			flags.StringVar(&c.ReportPath, "report", "", "write the orphans found as json to this path (- for stdout)")
+			flags.StringVar(&c.NewReplays, "replays", "", "where the scores' replays are, a path or s3://bucket/prefix (default: DATA_DIRECTORY/osr)")
+		},
+		Run: runFsck,
+	})
+}
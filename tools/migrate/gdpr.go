@@ -0,0 +1,307 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gdpr export collects everything bancho.py keeps about a user into one zip,
+// for answering data requests: a json file per table (their account, stats,
+// scores, logs, mail, relationships, logins, etc), their replays as full
+// .osr files, and their avatar. the password hash & api key are left out,
+// as they're credentials rather than data about the user.
+//
+// mail & logs are included both ways, i.e. messages the user received, and
+// actions taken on their account, as well as by them. screenshots aren't
+// linked to their uploader, so can't be included.
+
+// UserData is a table's rows about a user. condition is over the table,
+// and each ? is the user's id.
+type UserData struct {
+	Name      string
+	Table     string
+	Condition string
+	Omit      []string // columns left out of the export
+}
+
+var userData = []UserData{
+	{Name: "account", Table: "users", Condition: "id = ?", Omit: []string{"pw_bcrypt", "api_key"}},
+	{Name: "stats", Table: "stats", Condition: "id = ?"},
+	{Name: "scores", Table: "scores", Condition: "userid = ?"},
+	{Name: "archived_scores", Table: archiveTable, Condition: "userid = ?"},
+	{Name: "performance_reports", Table: "performance_reports", Condition: "scoreid IN (SELECT id FROM scores WHERE userid = ?)"},
+	{Name: "map_plays", Table: "user_map_plays", Condition: "userid = ?"},
+	{Name: "match_scores", Table: "match_game_scores", Condition: "userid = ?"},
+	{Name: "rank_history", Table: "rank_history", Condition: "userid = ?"},
+	{Name: "achievements", Table: "user_achievements", Condition: "userid = ?"},
+	{Name: "favourites", Table: "favourites", Condition: "userid = ?"},
+	{Name: "ratings", Table: "ratings", Condition: "userid = ?"},
+	{Name: "comments", Table: "comments", Condition: "userid = ?"},
+	{Name: "relationships", Table: "relationships", Condition: "user1 = ?"},
+	{Name: "mail", Table: "mail", Condition: "from_id = ? OR to_id = ?"},
+	{Name: "logs", Table: "logs", Condition: "`from` = ? OR `to` = ?"},
+	{Name: "ingame_logins", Table: "ingame_logins", Condition: "userid = ?"},
+	{Name: "client_hashes", Table: "client_hashes", Condition: "userid = ?"},
+	{Name: "map_requests", Table: "map_requests", Condition: "player_id = ?"},
+	{Name: "name_history", Table: "name_history", Condition: "userid = ?"},
+	{Name: "clans", Table: "clans", Condition: "owner = ?"},
+	{Name: "tourney_pools", Table: "tourney_pools", Condition: "created_by = ?"},
+}
+
+// GDPRManifest lists what an export contains.
+type GDPRManifest struct {
+	UserID     int64          `json:"user_id"`
+	ExportedAt string         `json:"exported_at"`
+	Tables     map[string]int `json:"tables"`  // rows per file in data/
+	Skipped    []string       `json:"skipped"` // tables which don't exist on this server
+	Replays    int            `json:"replays"`
+	Missing    []int64        `json:"missing_replays"` // scores whose replay wasn't found
+	Files      []string       `json:"files"`
+}
+
+// jsonValue converts a value scanned from mysql, where most types come back
+// as text, into what it is.
+func jsonValue(v interface{}, column *sql.ColumnType) interface{} {
+	b, ok := v.([]byte)
+	if !ok {
+		return v
+	}
+	s := string(b)
+	typeName := strings.TrimPrefix(column.DatabaseTypeName(), "UNSIGNED ")
+	switch typeName {
+	case "TINYINT", "SMALLINT", "MEDIUMINT", "INT", "BIGINT", "YEAR":
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n
+		}
+		if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+			return n
+		}
+	case "FLOAT", "DOUBLE", "DECIMAL":
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	case "BINARY", "VARBINARY", "BLOB", "TINYBLOB", "MEDIUMBLOB", "LONGBLOB":
+		return b // encoded as base64
+	}
+	return s
+}
+
+// exportUserData writes a table's rows about the user as a json array.
+func exportUserData(w io.Writer, data UserData, user int64) (int, error) {
+	args := make([]interface{}, strings.Count(data.Condition, "?"))
+	for i := range args {
+		args[i] = user
+	}
+	rows, err := DB.Queryx(fmt.Sprintf("SELECT * FROM %s WHERE %s", data.Table, data.Condition), args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.ColumnTypes()
+	if err != nil {
+		return 0, err
+	}
+	omit := make(map[string]bool, len(data.Omit))
+	for _, column := range data.Omit {
+		omit[column] = true
+	}
+
+	records := []map[string]interface{}{}
+	for rows.Next() {
+		values, err := rows.SliceScan()
+		if err != nil {
+			return 0, err
+		}
+		record := make(map[string]interface{}, len(values))
+		for i, v := range values {
+			if !omit[columns[i].Name()] {
+				record[columns[i].Name()] = jsonValue(v, columns[i])
+			}
+		}
+		records = append(records, record)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return len(records), enc.Encode(records)
+}
+
+// addFile copies a file on disk into the zip.
+func addFile(zw *zip.Writer, name, path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: info.ModTime()})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, in)
+	return err
+}
+
+func writeGDPRExport(w io.Writer, user int64) (*GDPRManifest, error) {
+	manifest := &GDPRManifest{
+		UserID:     user,
+		ExportedAt: time.Now().UTC().Format(time.RFC3339),
+		Tables:     map[string]int{},
+		Skipped:    []string{},
+		Missing:    []int64{},
+		Files:      []string{},
+	}
+	zw := zip.NewWriter(w)
+
+	for _, data := range userData {
+		if isInterrupted() {
+			return nil, errInterrupted
+		}
+		exists, err := tableExists(data.Table)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			manifest.Skipped = append(manifest.Skipped, data.Table)
+			continue
+		}
+
+		name := "data/" + data.Name + ".json"
+		f, err := zw.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		n, err := exportUserData(f, data, user)
+		if err != nil {
+			return nil, fmt.Errorf("failed to export %s: %w", data.Table, err)
+		}
+		manifest.Tables[name] = n
+		manifest.Files = append(manifest.Files, name)
+	}
+
+	// replays, named & encoded as export replays does
+	var scores []exportScore
+	if exists, err := tableExists("scores"); err != nil {
+		return nil, err
+	} else if exists {
+		err := DB.Select(&scores, fmt.Sprintf(select_export_replays, "s.userid = ?")+" ORDER BY s.id", user)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range scores {
+		if isInterrupted() {
+			return nil, errInterrupted
+		}
+		name := "replays/" + s.filename()
+		err := addReplay(zw, name, s)
+		if errors.Is(err, os.ErrNotExist) {
+			manifest.Missing = append(manifest.Missing, s.ID)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		manifest.Replays++
+		manifest.Files = append(manifest.Files, name)
+	}
+
+	// avatars are kept as <id>.<ext>
+	avatars, err := filepath.Glob(filepath.Join(cfg.AvatarDirectory(), strconv.FormatInt(user, 10)+".*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range avatars {
+		name := "avatar/" + filepath.Base(path)
+		if err := addFile(zw, name, path); err != nil {
+			return nil, err
+		}
+		manifest.Files = append(manifest.Files, name)
+	}
+
+	f, err := zw.Create("manifest.json")
+	if err != nil {
+		return nil, err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		return nil, err
+	}
+	return manifest, zw.Close()
+}
+
+func runGDPRExport() error {
+	if cfg.ExportUser == "" {
+		return errors.New("--user must be the name or id of the user whose data is exported")
+	}
+	user, err := findUser(cfg.ExportUser)
+	if err != nil {
+		return err
+	}
+	if err := setupReplayStores(); err != nil {
+		return err
+	}
+
+	path := cfg.ExportBundle
+	if path == "" {
+		path = fmt.Sprintf("user-%d.zip", user)
+	}
+
+	handleSignals()
+	tmp := path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	manifest, err := writeGDPRExport(out, user)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	rows := 0
+	for _, n := range manifest.Tables {
+		rows += n
+	}
+	logger.Info("exported the user's data", "user", user, "rows", rows, "replays", manifest.Replays,
+		"without_replays", len(manifest.Missing), "skipped_tables", len(manifest.Skipped), "path", path)
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:              "gdpr export",
+		Summary:           "collect everything kept about a user (account, scores, replays, logs, mail, etc) into a zip",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.ExportUser, "user", "", "name or id of the user whose data is exported")
+			flags.StringVar(&c.ExportBundle, "out", "", "the zip file to write (default: user-<id>.zip)")
+			flags.StringVar(&c.NewReplays, "replays", "", "where bancho.py's replays are, a path or s3://bucket/prefix (default: DATA_DIRECTORY/osr)")
+		},
+		Run: runGDPRExport,
+	})
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	osuser "os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gdpr erase irreversibly anonymizes a user, for erasure requests. the
+// account is kept, so that nothing referring to its id breaks, but is
+// scrubbed of its name, email, country, privileges, profile & credentials,
+// and can no longer be logged into. what ties the account to a person is
+// deleted: logins (with their ips), client hashes, mail & logs both ways,
+// comments, relationships, favourites, ratings, map requests, clans they
+// own, their previous names, their avatar, and their lines of the chat log.
+//
+// by default their scores are kept, under the now anonymous account, so
+// maps' leaderboards & play counts stay intact. bancho.py only keeps the
+// frames of a replay, which don't name the player, so replays are kept with
+// them unless --delete-replays. with --scores delete, the scores, replays,
+// rank history & stats are removed as well.
+//
+// every erasure is recorded in the gdpr_erasures table, with what was
+// removed, but nothing identifying the user other than their id.
+
+var create_gdpr_erasures = `
+create table if not exists gdpr_erasures (
+	id int auto_increment primary key,
+	userid int not null,
+	erased_at datetime not null,
+	erased_by varchar(64) not null,
+	summary text not null,
+	index gdpr_erasures_userid_index (userid)
+);`
+
+// EraseStep removes or scrubs some of a user's rows. each ? is the user's id.
+type EraseStep struct {
+	Name  string
+	Table string
+	Query string
+}
+
+var eraseSteps = []EraseStep{
+	{"ingame_logins", "ingame_logins", "DELETE FROM ingame_logins WHERE userid = ?"},
+	{"client_hashes", "client_hashes", "DELETE FROM client_hashes WHERE userid = ?"},
+	{"mail", "mail", "DELETE FROM mail WHERE from_id = ? OR to_id = ?"},
+	{"logs", "logs", "DELETE FROM logs WHERE `from` = ? OR `to` = ?"},
+	{"comments", "comments", "DELETE FROM comments WHERE userid = ?"},
+	{"relationships", "relationships", "DELETE FROM relationships WHERE user1 = ? OR user2 = ?"},
+	{"favourites", "favourites", "DELETE FROM favourites WHERE userid = ?"},
+	{"ratings", "ratings", "DELETE FROM ratings WHERE userid = ?"},
+	{"map_requests", "map_requests", "DELETE FROM map_requests WHERE player_id = ?"},
+	{"name_history", "name_history", "DELETE FROM name_history WHERE userid = ?"},
+	// clans they own are disbanded, as bancho.py's !clan disband does
+	{"clan_members", "clans", "UPDATE users SET clan_id = 0, clan_priv = 0 WHERE clan_id IN (SELECT id FROM clans WHERE owner = ?)"},
+	{"clans", "clans", "DELETE FROM clans WHERE owner = ?"},
+}
+
+// with --scores delete, these run before the account is scrubbed
+var eraseScoreSteps = []EraseStep{
+	{"performance_reports", "performance_reports", "DELETE p FROM performance_reports p JOIN scores s ON s.id = p.scoreid WHERE s.userid = ?"},
+	{"scores", "scores", "DELETE FROM scores WHERE userid = ?"},
+	{"archived_scores", archiveTable, "DELETE FROM " + archiveTable + " WHERE userid = ?"},
+	{"map_plays", "user_map_plays", "DELETE FROM user_map_plays WHERE userid = ?"},
+	{"match_scores", "match_game_scores", "DELETE FROM match_game_scores WHERE userid = ?"},
+	{"rank_history", "rank_history", "DELETE FROM rank_history WHERE userid = ?"},
+	{"stats", "stats", "DELETE FROM stats WHERE id = ?"},
+}
+
+// only unrestricted & verified are kept, so the account's scores stay on
+// leaderboards, but any donor or staff privileges are removed
+var scrub_user = `
+UPDATE users SET name = ?, safe_name = ?, email = ?, pw_bcrypt = '', country = 'xx',
+priv = priv & 3, silence_end = 0, donor_end = 0, latest_activity = 0, clan_id = 0, clan_priv = 0,
+custom_badge_name = NULL, custom_badge_icon = NULL, userpage_content = NULL, api_key = NULL
+WHERE id = ?`
+
+// ErasureSummary is what an erasure removed, as recorded in gdpr_erasures.
+type ErasureSummary struct {
+	Scores          string           `json:"scores"` // kept or deleted
+	Rows            map[string]int64 `json:"rows"`
+	Replays         int              `json:"replays_deleted"`
+	Avatars         int              `json:"avatars_deleted"`
+	ChatLines       int              `json:"chat_lines_deleted"`
+	ErasedAccountAs string           `json:"erased_account_as"`
+}
+
+// erasedName is what an erased account is renamed to, unique as ids are.
+func erasedName(id int64) (name, safeName, email string) {
+	name = fmt.Sprintf("Deleted User %d", id)
+	return name, strings.ReplaceAll(strings.ToLower(name), " ", "_"), fmt.Sprintf("deleted-%d@erased.invalid", id)
+}
+
+func eraseArgs(query string, user int64) []interface{} {
+	args := make([]interface{}, strings.Count(query, "?"))
+	for i := range args {
+		args[i] = user
+	}
+	return args
+}
+
+// countErasure counts the rows each step would remove, for the prompt & --dry-run.
+func countErasure(steps []EraseStep, user int64) (map[string]int64, error) {
+	counts := make(map[string]int64)
+	for _, step := range steps {
+		exists, err := tableExists(step.Table)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+
+		// each step's rows are counted by its condition
+		query := step.Query
+		switch {
+		case strings.HasPrefix(query, "DELETE p FROM"):
+			query = "SELECT COUNT(*) FROM" + strings.TrimPrefix(query, "DELETE p FROM")
+		case strings.HasPrefix(query, "DELETE FROM"):
+			query = "SELECT COUNT(*) FROM" + strings.TrimPrefix(query, "DELETE FROM")
+		case strings.HasPrefix(query, "UPDATE users SET"):
+			query = "SELECT COUNT(*) FROM users WHERE" + query[strings.Index(query, " WHERE")+6:]
+		}
+		var n int64
+		if err := DB.Get(&n, query, eraseArgs(query, user)...); err != nil {
+			return nil, fmt.Errorf("failed to count %s: %w", step.Name, err)
+		}
+		counts[step.Name] = n
+	}
+	return counts, nil
+}
+
+// eraseRows runs the steps & scrubs the account, in one transaction.
+func eraseRows(steps []EraseStep, user int64, summary *ErasureSummary) error {
+	tx, err := DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var modes []int
+	if cfg.EraseScores == "delete" {
+		if err := tx.Select(&modes, "SELECT mode FROM stats WHERE id = ?", user); err != nil {
+			return err
+		}
+	}
+
+	for _, step := range steps {
+		exists, err := tableExists(step.Table)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		res, err := tx.Exec(step.Query, eraseArgs(step.Query, user)...)
+		if err != nil {
+			return fmt.Errorf("failed to erase %s: %w", step.Name, err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		summary.Rows[step.Name] = n
+	}
+
+	// the account keeps empty stats, as bancho.py expects a row per mode
+	for _, mode := range modes {
+		if _, err := tx.Exec("INSERT INTO stats (id, mode) VALUES (?, ?)", user, mode); err != nil {
+			return err
+		}
+	}
+
+	name, safeName, email := erasedName(user)
+	if _, err := tx.Exec(scrub_user, name, safeName, email, user); err != nil {
+		return fmt.Errorf("failed to scrub the account: %w", err)
+	}
+	summary.ErasedAccountAs = name
+	return tx.Commit()
+}
+
+// eraseChatLog removes the user's messages, and messages sent to them, from
+// bancho.py's chat log. bancho.py appends to it while running, so the log is
+// only replaced if it didn't grow while being filtered.
+func eraseChatLog(name string, user int64) (int, error) {
+	path := filepath.Join(cfg.DataDirectory, "logs", "chat.log")
+	tag := fmt.Sprintf("<%s (%d)>", name, user)
+
+	for attempt := 0; ; attempt++ {
+		info, err := os.Stat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		} else if err != nil {
+			return 0, err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return 0, err
+		}
+
+		// lines are "[time] <sender (id)> @ <target>: message"
+		var kept bytes.Buffer
+		removed := 0
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if i := strings.Index(line, "] "); i >= 0 && (strings.HasPrefix(line[i+2:], tag+" @ ") ||
+				strings.Contains(line, " @ "+tag+": ")) {
+				removed++
+				continue
+			}
+			kept.WriteString(line)
+			kept.WriteByte('\n')
+		}
+		if err := scanner.Err(); err != nil {
+			return 0, err
+		}
+		if removed == 0 {
+			return 0, nil
+		}
+
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, kept.Bytes(), info.Mode()); err != nil {
+			return 0, err
+		}
+		if now, err := os.Stat(path); err == nil && now.Size() != int64(len(data)) {
+			os.Remove(tmp)
+			if attempt < 3 {
+				continue
+			}
+			return 0, errors.New("the chat log kept growing while being filtered, try again while bancho.py is stopped")
+		}
+		return removed, os.Rename(tmp, path)
+	}
+}
+
+// eraseFiles deletes the user's avatar, and replays unless they're kept.
+func eraseFiles(scoreIDs []int64, user int64, summary *ErasureSummary) error {
+	for _, id := range scoreIDs {
+		err := newReplays.Delete(replayKey(id))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to delete replay %d: %w", id, err)
+		}
+		if err == nil {
+			summary.Replays++
+		}
+	}
+
+	avatars, err := filepath.Glob(filepath.Join(cfg.AvatarDirectory(), strconv.FormatInt(user, 10)+".*"))
+	if err != nil {
+		return err
+	}
+	for _, path := range avatars {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		summary.Avatars++
+	}
+	return nil
+}
+
+// eraseLeaderboards removes the user from the country leaderboards in redis,
+// as their country is now unknown, and with --scores delete, the global ones.
+func eraseLeaderboards(user int64, country string) error {
+	rc, err := dialRedis(cfg)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	id := strconv.FormatInt(user, 10)
+	n := 0
+	for mode := 0; mode <= 8; mode++ {
+		key := leaderboardKeyPrefix + strconv.Itoa(mode)
+		rc.Send("ZREM", key+":"+strings.ToLower(country), id)
+		n++
+		if cfg.EraseScores == "delete" {
+			rc.Send("ZREM", key, id)
+			n++
+		}
+	}
+	_, err = rc.Flush(n)
+	return err
+}
+
+func runGDPRErase() error {
+	if cfg.ExportUser == "" {
+		return errors.New("--user must be the name or id of the user to erase")
+	}
+	if cfg.EraseScores != "keep" && cfg.EraseScores != "delete" {
+		return fmt.Errorf("unknown --scores %q, expected keep or delete", cfg.EraseScores)
+	}
+	user, err := findUser(cfg.ExportUser)
+	if err != nil {
+		return err
+	}
+	if user <= 2 {
+		// 1 is the bot, and 2 is reserved for ppy
+		return fmt.Errorf("user %d is reserved, and can't be erased", user)
+	}
+	if err := setupReplayStores(); err != nil {
+		return err
+	}
+
+	var account struct {
+		Name    string
+		Country string
+	}
+	if err := DB.Get(&account, "SELECT name, country FROM users WHERE id = ?", user); err != nil {
+		return err
+	}
+
+	steps := eraseSteps
+	var scoreIDs []int64
+	if cfg.EraseScores == "delete" || cfg.EraseReplays {
+		if err := DB.Select(&scoreIDs, "SELECT id FROM scores WHERE userid = ? AND status != 0", user); err != nil {
+			return err
+		}
+	}
+	if cfg.EraseScores == "delete" {
+		steps = append(append([]EraseStep{}, eraseScoreSteps...), eraseSteps...)
+	}
+
+	counts, err := countErasure(steps, user)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("This will irreversibly erase %s (%d):\n", account.Name, user)
+	for _, step := range steps {
+		if n, ok := counts[step.Name]; ok && n != 0 {
+			fmt.Printf("  %-20s %d rows\n", step.Name, n)
+		}
+	}
+	fmt.Printf("  %-20s %d files\n", "replays", len(scoreIDs))
+	fmt.Printf("  and scrub the account, which keeps its scores: %t\n", cfg.EraseScores == "keep")
+	if cfg.DryRun {
+		return nil
+	}
+	if !confirm("Continue?") {
+		fmt.Println("Not erasing the user")
+		return nil
+	}
+
+	summary := &ErasureSummary{Scores: cfg.EraseScores, Rows: map[string]int64{}}
+	if err := eraseRows(steps, user, summary); err != nil {
+		return err
+	}
+	logger.Info("erased the user's rows", "user", user, "rows", summary.Rows)
+
+	// the rows are gone by now, so anything failing below is only logged,
+	// and can be finished by hand
+	if err := eraseFiles(scoreIDs, user, summary); err != nil {
+		logger.Error("failed to delete the user's files", "user", user, "err", err)
+	}
+	if summary.ChatLines, err = eraseChatLog(account.Name, user); err != nil {
+		logger.Error("failed to erase the user from the chat log", "user", user, "err", err)
+	}
+	if err := eraseLeaderboards(user, account.Country); err != nil {
+		logger.Warn("failed to remove the user from redis' leaderboards, run cache rebuild", "err", err)
+	}
+
+	by := cfg.EraseBy
+	if by == "" {
+		if u, err := osuser.Current(); err == nil {
+			by = u.Username
+		}
+	}
+	record, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	if _, err := DB.Exec(create_gdpr_erasures); err != nil {
+		return err
+	}
+	_, err = DB.Exec("INSERT INTO gdpr_erasures (userid, erased_at, erased_by, summary) VALUES (?, ?, ?, ?)",
+		user, time.Now().UTC(), by, string(record))
+	if err != nil {
+		return fmt.Errorf("failed to record the erasure: %w", err)
+	}
+
+	logger.Info("erased the user", "user", user, "as", summary.ErasedAccountAs, "scores", cfg.EraseScores,
+		"replays", summary.Replays, "avatars", summary.Avatars, "chat_lines", summary.ChatLines)
+	if cfg.EraseScores == "delete" {
+		logger.Info("their scores were deleted, run recalc first-places if maps' #1s are kept")
+	}
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:              "gdpr erase",
+		Summary:           "irreversibly anonymize a user, deleting what identifies them, and optionally their scores",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.ExportUser, "user", "", "name or id of the user to erase")
+			flags.StringVar(&c.EraseScores, "scores", "keep", "what to do with their scores: keep (under the anonymized account), or delete (with replays, rank history & stats)")
+			flags.BoolVar(&c.EraseReplays, "delete-replays", false, "delete their replays, even when their scores are kept")
+			flags.StringVar(&c.EraseBy, "by", "", "who's erasing the user, for the audit record (default: the current os user)")
+			flags.BoolVar(&c.DryRun, "dry-run", false, "show what would be erased, without changing anything")
+			flags.StringVar(&c.NewReplays, "replays", "", "where bancho.py's replays are, a path or s3://bucket/prefix (default: DATA_DIRECTORY/osr)")
+		},
+		Run: runGDPRErase,
+	})
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// users geoip sets users' countries from their last known ip, the one of
+// their latest ingame_logins row, using a local MaxMind database (e.g.
+// GeoLite2-Country.mmdb, see mmdb.go). by default only users whose country
+// is unknown ('xx') are filled in; --refresh checks everyone's. bancho.py
+// only stores the country, its latitude & longitude are kept in memory,
+// looked up again on each login, so there's nothing else to backfill.
+//
+// --normalize-ips rewrites ingame_logins.ip to its canonical form, e.g.
+// "::ffff:1.2.3.4" as "1.2.3.4", and "2001:DB8:0:0::1" as "2001:db8::1",
+// so the same address is always written the same way.
+//
+// --hash-ips replaces every ip with a keyed hash of it, for instances which
+// would rather not keep them. the same ip always hashes the same (with the
+// same --hash-key), so multi-accounting can still be spotted, but they can't
+// be looked up anymore, so this runs after the countries are set. it can't
+// be undone. bancho.py keeps writing plain ips, so it's run again as needed.
+
+// hashed ips are written with this prefix, which plain ips never have
+const hashedIPPrefix = "h:"
+
+// bancho.py's country codes, see app/constants/countries.py
+const osuCountryCodes = "oc eu ad ae af ag ai al am an ao aq ar as at au aw az ba bb bd be bf bg bh bi bj bm bn bo br bs bt bv bw by bz " +
+	"ca cc cd cf cg ch ci ck cl cm cn co cr cu cv cx cy cz de dj dk dm do dz ec ee eg eh er es et fi fj fk fm fo fr fx ga gb gd ge " +
+	"gf gh gi gl gm gn gp gq gr gs gt gu gw gy hk hm hn hr ht hu id ie il in io iq ir is it jm jo jp ke kg kh ki km kn kp kr kw ky " +
+	"kz la lb lc li lk lr ls lt lu lv ly ma mc md mg mh mk ml mm mn mo mp mq mr ms mt mu mv mw mx my mz na nc ne nf ng ni nl no np " +
+	"nr nu nz om pa pe pf pg ph pk pl pm pn pr ps pt pw py qa re ro ru rw sa sb sc sd se sg sh si sj sk sl sm sn so sr st sv sy sz " +
+	"tc td tf tg th tj tk tm tn to tl tr tt tv tw tz ua ug um us uy uz va vc ve vg vi vn vu wf ws ye yt rs za zm me zw xx a2 o1 ax " +
+	"gg im je bl mf"
+
+var osuCountries = func() map[string]bool {
+	countries := make(map[string]bool)
+	for _, code := range strings.Fields(osuCountryCodes) {
+		countries[code] = true
+	}
+	return countries
+}()
+
+var errGeoIPKey = errors.New("--hash-ips needs a --hash-key, which must be kept to hash ips the same way again")
+
+// each user's latest login, & their country
+var select_last_ips = `
+SELECT u.id AS id, u.country AS country, l.ip AS ip FROM users u
+JOIN (SELECT userid, MAX(id) AS id FROM ingame_logins GROUP BY userid) latest ON latest.userid = u.id
+JOIN ingame_logins l ON l.id = latest.id
+WHERE u.id > ? AND (? OR u.country = 'xx')
+ORDER BY u.id LIMIT ?`
+
+type lastIP struct {
+	ID      int64
+	Country string
+	IP      string
+}
+
+// CountryChange is a user whose country was (or would be) changed.
+type CountryChange struct {
+	UserID int64  `json:"user_id"`
+	IP     string `json:"ip"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+}
+
+// GeoIPReport is the result of users geoip.
+type GeoIPReport struct {
+	Users       int64            `json:"users"` // users with a login to look up
+	Changed     int64            `json:"changed"`
+	Unchanged   int64            `json:"unchanged"`
+	NotFound    int64            `json:"not_found"`   // ips the database has no country for
+	Unsupported map[string]int64 `json:"unsupported"` // countries osu! has no flag for
+	Invalid     int64            `json:"invalid"`     // ips which couldn't be parsed
+	Hashed      int64            `json:"hashed"`      // users whose last ip was already hashed
+	Countries   map[string]int64 `json:"countries"`   // the countries set, & how many users got each
+	Examples    []CountryChange  `json:"examples"`
+
+	IPsNormalized int64    `json:"ips_normalized"`
+	IPsHashed     int64    `json:"ips_hashed"`
+	InvalidIPs    []string `json:"invalid_ips,omitempty"`
+}
+
+// normalizeIP parses an ip as bancho.py may have written it, e.g. from an
+// X-Real-IP header, returning its canonical form.
+func normalizeIP(ip string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(strings.Trim(strings.TrimSpace(ip), "[]"))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addr.Unmap().WithZone(""), nil
+}
+
+// hashIP is a keyed hash of an ip's canonical form, short enough for the
+// ip column (varchar(45)).
+func hashIP(key []byte, addr netip.Addr) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(addr.String()))
+	return hashedIPPrefix + hex.EncodeToString(mac.Sum(nil)[:20])
+}
+
+// lookupCountry returns an ip's country code, as bancho.py stores it.
+func lookupCountry(db *MMDB, addr netip.Addr) (string, error) {
+	record, err := db.Lookup(addr)
+	if err != nil || record == nil {
+		return "", err
+	}
+	code := mmdbString(record, "country", "iso_code")
+	if code == "" {
+		// e.g. anonymous proxies & satellite providers have no country
+		code = mmdbString(record, "registered_country", "iso_code")
+	}
+	return strings.ToLower(code), nil
+}
+
+// geolocateUsers looks up users' countries, changing them unless dryRun.
+func geolocateUsers(db *MMDB, report *GeoIPReport, dryRun bool) error {
+	var lastID int64
+	for {
+		if isInterrupted() {
+			return errInterrupted
+		}
+		var users []lastIP
+		if err := DB.Select(&users, select_last_ips, lastID, cfg.GeoIPRefresh, BatchSize); err != nil {
+			return err
+		}
+		if len(users) == 0 {
+			return nil
+		}
+		lastID = users[len(users)-1].ID
+
+		var changes []CountryChange
+		for _, u := range users {
+			report.Users++
+			if strings.HasPrefix(u.IP, hashedIPPrefix) {
+				report.Hashed++
+				continue
+			}
+			addr, err := normalizeIP(u.IP)
+			if err != nil {
+				report.Invalid++
+				continue
+			}
+			country, err := lookupCountry(db, addr)
+			if err != nil {
+				return fmt.Errorf("failed to look up %s: %w", addr, err)
+			}
+			switch {
+			case country == "":
+				report.NotFound++
+			case !osuCountries[country]:
+				report.Unsupported[country]++
+			case country == u.Country:
+				report.Unchanged++
+			default:
+				changes = append(changes, CountryChange{UserID: u.ID, IP: addr.String(), From: u.Country, To: country})
+			}
+		}
+
+		for _, change := range changes {
+			report.Changed++
+			report.Countries[change.To]++
+			if len(report.Examples) < maxExamples {
+				report.Examples = append(report.Examples, change)
+			}
+		}
+		if dryRun || len(changes) == 0 {
+			continue
+		}
+		if err := throttle(len(changes)); err != nil {
+			return err
+		}
+		tx, err := DB.Beginx()
+		if err != nil {
+			return err
+		}
+		for _, change := range changes {
+			if _, err := tx.Exec("UPDATE users SET country = ? WHERE id = ?", change.To, change.UserID); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+}
+
+type loginIP struct {
+	ID int64
+	IP string
+}
+
+// rewriteLoginIPs normalizes (or hashes, if key is set) every login's ip,
+// a batch of rows at a time, changing them unless dryRun.
+func rewriteLoginIPs(key []byte, report *GeoIPReport, dryRun bool) (int64, error) {
+	var rewritten, lastID int64
+	for {
+		if isInterrupted() {
+			return rewritten, errInterrupted
+		}
+		var logins []loginIP
+		if err := DB.Select(&logins, "SELECT id, ip FROM ingame_logins WHERE id > ? ORDER BY id LIMIT ?", lastID, BatchSize); err != nil {
+			return rewritten, err
+		}
+		if len(logins) == 0 {
+			return rewritten, nil
+		}
+		lastID = logins[len(logins)-1].ID
+
+		var changed []loginIP
+		for _, login := range logins {
+			if strings.HasPrefix(login.IP, hashedIPPrefix) {
+				continue
+			}
+			addr, err := normalizeIP(login.IP)
+			if err != nil {
+				if len(report.InvalidIPs) < maxExamples && !slices.Contains(report.InvalidIPs, login.IP) {
+					report.InvalidIPs = append(report.InvalidIPs, login.IP)
+				}
+				continue
+			}
+			ip := addr.String()
+			if key != nil {
+				ip = hashIP(key, addr)
+			}
+			if ip != login.IP {
+				changed = append(changed, loginIP{login.ID, ip})
+			}
+		}
+		rewritten += int64(len(changed))
+		if dryRun || len(changed) == 0 {
+			continue
+		}
+		if err := throttle(len(changed)); err != nil {
+			return rewritten, err
+		}
+		tx, err := DB.Beginx()
+		if err != nil {
+			return rewritten, err
+		}
+		for _, login := range changed {
+			if _, err := tx.Exec("UPDATE ingame_logins SET ip = ? WHERE id = ?", login.IP, login.ID); err != nil {
+				tx.Rollback()
+				return rewritten, err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return rewritten, err
+		}
+	}
+}
+
+func printGeoIPReport(report *GeoIPReport, dryRun bool) {
+	verb := "changed"
+	if dryRun {
+		verb = "would change"
+	}
+	fmt.Printf("%d users looked up, %d countries %s, %d unchanged\n", report.Users, report.Changed, verb, report.Unchanged)
+	fmt.Printf("  %d not in the database, %d invalid ips, %d already hashed\n", report.NotFound, report.Invalid, report.Hashed)
+	for code, n := range report.Unsupported {
+		fmt.Printf("  %d in %s, which osu! has no flag for\n", n, strings.ToUpper(code))
+	}
+
+	codes := make([]string, 0, len(report.Countries))
+	for code := range report.Countries {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return report.Countries[codes[i]] > report.Countries[codes[j]] })
+	for _, code := range codes[:min(len(codes), maxExamples)] {
+		fmt.Printf("  %s %d\n", code, report.Countries[code])
+	}
+	for _, change := range report.Examples {
+		fmt.Printf("  user %d (%s): %s -> %s\n", change.UserID, change.IP, change.From, change.To)
+	}
+	for _, ip := range report.InvalidIPs {
+		fmt.Printf("  invalid ip: %q\n", ip)
+	}
+}
+
+func runUsersGeoIP() error {
+	if cfg.GeoIPDatabase == "" {
+		return errors.New("--mmdb is required, e.g. GeoLite2-Country.mmdb from maxmind.com")
+	}
+	var key []byte
+	if cfg.HashIPs {
+		if cfg.HashIPsKey == "" {
+			return errGeoIPKey
+		}
+		key = []byte(cfg.HashIPsKey)
+	}
+	db, err := openMMDB(cfg.GeoIPDatabase)
+	if err != nil {
+		return err
+	}
+
+	// ctrl-c stops between batches
+	handleSignals()
+	start := time.Now()
+	report := &GeoIPReport{Unsupported: map[string]int64{}, Countries: map[string]int64{}, Examples: []CountryChange{}}
+
+	// everything is looked up first, so the changes are shown before any is made
+	if err := geolocateUsers(db, report, true); err != nil {
+		return err
+	}
+	if cfg.NormalizeIPs {
+		if report.IPsNormalized, err = rewriteLoginIPs(nil, report, true); err != nil {
+			return err
+		}
+	}
+	if cfg.HashIPs {
+		if report.IPsHashed, err = rewriteLoginIPs(key, report, true); err != nil {
+			return err
+		}
+	}
+	printGeoIPReport(report, true)
+	if cfg.NormalizeIPs {
+		fmt.Printf("%d login ips would be normalized\n", report.IPsNormalized)
+	}
+	if cfg.HashIPs {
+		fmt.Printf("%d login ips would be hashed\n", report.IPsHashed)
+	}
+	if cfg.DryRun {
+		return writeReport(cfg.ReportPath, report)
+	}
+	if report.Changed == 0 && report.IPsNormalized == 0 && report.IPsHashed == 0 {
+		fmt.Println("nothing to change")
+		return writeReport(cfg.ReportPath, report)
+	}
+
+	if cfg.HashIPs {
+		fmt.Println("Hashing ips can't be undone: they can't be looked up again afterwards, or by bancho.py's admins.")
+	}
+	if !confirm("Continue?") {
+		fmt.Println("Not changing anything")
+		return nil
+	}
+
+	if report.Changed != 0 {
+		*report = GeoIPReport{Unsupported: map[string]int64{}, Countries: map[string]int64{}, Examples: []CountryChange{},
+			IPsNormalized: report.IPsNormalized, IPsHashed: report.IPsHashed, InvalidIPs: report.InvalidIPs}
+		if err := geolocateUsers(db, report, false); err != nil {
+			return fmt.Errorf("failed to set users' countries: %w", err)
+		}
+		logger.Info("set users' countries", "changed", report.Changed)
+	}
+	if cfg.NormalizeIPs && report.IPsNormalized != 0 {
+		if report.IPsNormalized, err = rewriteLoginIPs(nil, report, false); err != nil {
+			return fmt.Errorf("failed to normalize ips: %w", err)
+		}
+		logger.Info("normalized login ips", "ips", report.IPsNormalized)
+	}
+	if cfg.HashIPs && report.IPsHashed != 0 {
+		if report.IPsHashed, err = rewriteLoginIPs(key, report, false); err != nil {
+			return fmt.Errorf("failed to hash ips: %w", err)
+		}
+		logger.Info("hashed login ips", "ips", report.IPsHashed)
+	}
+
+	logger.Info("users geoip finished", "elapsed", time.Since(start).Round(time.Second))
+	return writeReport(cfg.ReportPath, report)
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "users geoip",
+		Summary: "set users' countries from their last login's ip with a local maxmind database, and normalize or hash login ips",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.GeoIPDatabase, "mmdb", "", "the maxmind database to look ips up in, e.g. GeoLite2-Country.mmdb (GeoLite2-City works too)")
+			flags.BoolVar(&c.GeoIPRefresh, "refresh", false, "look up every user's country, rather than only unknown ('xx') ones")
+			flags.BoolVar(&c.NormalizeIPs, "normalize-ips", false, "rewrite login ips to their canonical form, e.g. ::ffff:1.2.3.4 as 1.2.3.4")
+			flags.BoolVar(&c.HashIPs, "hash-ips", false, "replace login ips with a keyed hash of them, after the countries are set (can't be undone)")
+			flags.StringVar(&c.HashIPsKey, "hash-key", "", "the secret key ips are hashed with; the same key must be used on later runs")
+			flags.BoolVar(&c.DryRun, "dry-run", false, "show what would change, without changing it")
+			flags.StringVar(&c.ReportPath, "report", "", "write what was found as json to this path (- for stdout)")
+		},
+		Run: runUsersGeoIP,
+	})
+}
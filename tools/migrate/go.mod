@@ -0,0 +1,10 @@
+module github.com/osuAkatsuki/bancho.py/tools/migrate
+
+go 1.21
+
+require (
+	github.com/go-sql-driver/mysql v1.6.0
+	github.com/jmoiron/sqlx v1.3.4
+	github.com/lib/pq v1.9.0
+	github.com/mattn/go-sqlite3 v1.14.22
+)
@@ -0,0 +1,134 @@
+package main
+
+// the mods which matter to the migrator
+const (
+	modNoFail         = 1 << 0
+	modEasy           = 1 << 1
+	modHidden         = 1 << 3
+	modHardRock       = 1 << 4
+	modSuddenDeath    = 1 << 5
+	modDoubleTime     = 1 << 6
+	modRelax          = 1 << 7
+	modHalfTime       = 1 << 8
+	modNightcore      = 1 << 9
+	modFlashlight     = 1 << 10
+	modAutopilot      = 1 << 13
+	modPerfect        = 1 << 14
+	modFadeIn         = 1 << 20
+	modTargetPractice = 1 << 23
+	modScoreV2        = 1 << 29
+)
+
+// modeFromMods returns bancho.py's mode for a vanilla mode and its mods,
+// as relax & autopilot scores are kept in their own modes.
+func modeFromMods(mode int, mods int) int {
+	switch {
+	case mods&modAutopilot != 0:
+		return mode + 8
+	case mods&modRelax != 0:
+		return mode + 4
+	default:
+		return mode
+	}
+}
+
+// calculateAccuracy works out a score's accuracy as a percentage,
+// for formats which only store the hit counts.
+func calculateAccuracy(score *Score) float32 {
+	var hits, total float64
+	switch score.Mode % 4 {
+	case 0:
+		total = float64(score.N300 + score.N100 + score.N50 + score.Nmiss)
+		hits = float64(300*score.N300+100*score.N100+50*score.N50) / 300
+	case 1:
+		total = float64(score.N300 + score.N100 + score.Nmiss)
+		hits = float64(score.N300) + float64(score.N100)/2
+	case 2:
+		total = float64(score.N300 + score.N100 + score.N50 + score.Nkatu + score.Nmiss)
+		hits = float64(score.N300 + score.N100 + score.N50)
+	case 3:
+		total = float64(score.Ngeki + score.N300 + score.Nkatu + score.N100 + score.N50 + score.Nmiss)
+		hits = float64(300*(score.Ngeki+score.N300)+200*score.Nkatu+100*score.N100+50*score.N50) / 300
+		// scorev2 weights max 300s a little more than 300s
+		if score.Mods&modScoreV2 != 0 {
+			hits = float64(305*score.Ngeki+300*score.N300+200*score.Nkatu+100*score.N100+50*score.N50) / 305
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float32(100 * hits / total)
+}
+
+// calculateGrade works out a score's letter grade the same way osu!
+// does, for servers which don't store it. failed scores are graded F.
+func calculateGrade(score *Score) string {
+	if score.Status == 0 {
+		return "F"
+	}
+
+	var grade string
+	switch score.Mode % 4 {
+	case 0, 1: // osu!, taiko
+		total := float64(score.N300 + score.N100 + score.N50 + score.Nmiss)
+		if total == 0 {
+			return "D"
+		}
+		r300 := float64(score.N300) / total
+		r50 := float64(score.N50) / total
+
+		switch {
+		case r300 == 1:
+			grade = "X"
+		case r300 > 0.9 && r50 <= 0.01 && score.Nmiss == 0:
+			grade = "S"
+		case r300 > 0.8 && score.Nmiss == 0 || r300 > 0.9:
+			grade = "A"
+		case r300 > 0.7 && score.Nmiss == 0 || r300 > 0.8:
+			grade = "B"
+		case r300 > 0.6:
+			grade = "C"
+		default:
+			grade = "D"
+		}
+
+	case 2: // catch, where n50 are droplets & nkatu are missed droplets
+		total := float64(score.N300 + score.N100 + score.N50 + score.Nkatu + score.Nmiss)
+		if total == 0 {
+			return "D"
+		}
+		acc := float64(score.N300+score.N100+score.N50) / total
+		grade = gradeForAccuracy(acc, 0.98, 0.94, 0.9, 0.85)
+
+	case 3: // mania, where ngeki are max 300s & nkatu are 200s
+		total := float64(score.Ngeki + score.N300 + score.Nkatu + score.N100 + score.N50 + score.Nmiss)
+		if total == 0 {
+			return "D"
+		}
+		acc := float64(300*(score.Ngeki+score.N300)+200*score.Nkatu+100*score.N100+50*score.N50) / (300 * total)
+		grade = gradeForAccuracy(acc, 0.95, 0.9, 0.8, 0.7)
+	}
+
+	// hidden & flashlight (and fade in for mania) give silver grades
+	if (grade == "X" || grade == "S") && score.Mods&(modHidden|modFlashlight|modFadeIn) != 0 {
+		grade += "H"
+	}
+	return grade
+}
+
+func gradeForAccuracy(acc, s, a, b, c float64) string {
+	switch {
+	case acc == 1:
+		return "X"
+	case acc > s:
+		return "S"
+	case acc > a:
+		return "A"
+	case acc > b:
+		return "B"
+	case acc > c:
+		return "C"
+	default:
+		return "D"
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestModeFromMods(t *testing.T) {
+	for _, tt := range []struct {
+		mode, mods, want int
+	}{
+		{0, 0, 0},
+		{0, modRelax, 4},
+		{1, modRelax | modHidden, 5},
+		{2, modRelax, 6},
+		{0, modAutopilot, 8},
+		{3, modDoubleTime, 3},
+	} {
+		if got := modeFromMods(tt.mode, tt.mods); got != tt.want {
+			t.Errorf("modeFromMods(%d, %d) = %d, want %d", tt.mode, tt.mods, got, tt.want)
+		}
+	}
+}
+
+func TestCalculateAccuracy(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		score Score
+		want  float64
+	}{
+		{"osu! ss", Score{Mode: 0, N300: 100}, 100},
+		{"osu!", Score{Mode: 0, N300: 90, N100: 10}, 93.333333},
+		{"osu! with 50s & misses", Score{Mode: 0, N300: 80, N100: 10, N50: 5, Nmiss: 5}, 84.166667},
+		{"osu! relax", Score{Mode: 4, N300: 90, N100: 10}, 93.333333},
+		{"taiko", Score{Mode: 1, N300: 8, N100: 2}, 90},
+		{"taiko with misses", Score{Mode: 1, N300: 6, N100: 2, Nmiss: 2}, 70},
+		{"catch", Score{Mode: 2, N300: 90, N100: 5, N50: 3, Nkatu: 2}, 98},
+		{"catch with misses", Score{Mode: 2, N300: 80, N100: 5, N50: 5, Nkatu: 5, Nmiss: 5}, 90},
+		{"mania", Score{Mode: 3, Ngeki: 50, N300: 40, Nkatu: 10}, 96.666667},
+		{"mania scorev2", Score{Mode: 3, Ngeki: 50, N300: 50, Mods: modScoreV2}, 99.180328},
+		{"nothing hit", Score{Mode: 0}, 0},
+	} {
+		if got := calculateAccuracy(&tt.score); math.Abs(float64(got)-tt.want) > 1e-4 {
+			t.Errorf("%s: calculateAccuracy() = %f, want %f", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCalculateGrade(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		score Score
+		want  string
+	}{
+		{"failed", Score{Status: 0, Mode: 0, N300: 100}, "F"},
+		{"nothing hit", Score{Status: 1, Mode: 0}, "D"},
+
+		{"osu! ss", Score{Status: 1, Mode: 0, N300: 100}, "X"},
+		{"osu! hidden ss", Score{Status: 1, Mode: 0, N300: 100, Mods: modHidden}, "XH"},
+		{"osu! s", Score{Status: 1, Mode: 0, N300: 95, N100: 5}, "S"},
+		{"osu! flashlight s", Score{Status: 1, Mode: 0, N300: 95, N100: 5, Mods: modFlashlight}, "SH"},
+		{"osu! s with too many 50s", Score{Status: 1, Mode: 0, N300: 95, N50: 5}, "A"},
+		{"osu! s with a miss", Score{Status: 1, Mode: 0, N300: 95, N100: 4, Nmiss: 1}, "A"},
+		{"osu! a", Score{Status: 1, Mode: 0, N300: 85, N100: 15}, "A"},
+		{"osu! a with a miss", Score{Status: 1, Mode: 0, N300: 85, N100: 14, Nmiss: 1}, "B"},
+		{"osu! b", Score{Status: 1, Mode: 0, N300: 75, N100: 25}, "B"},
+		{"osu! b with a miss", Score{Status: 1, Mode: 0, N300: 75, N100: 24, Nmiss: 1}, "C"},
+		{"osu! c", Score{Status: 1, Mode: 0, N300: 65, N100: 35}, "C"},
+		{"osu! d", Score{Status: 1, Mode: 0, N300: 50, N100: 50}, "D"},
+		{"osu! hidden a", Score{Status: 1, Mode: 0, N300: 85, N100: 15, Mods: modHidden}, "A"},
+		{"taiko s", Score{Status: 2, Mode: 1, N300: 95, N100: 5}, "S"},
+		{"autopilot ss", Score{Status: 2, Mode: 8, N300: 10}, "X"},
+
+		{"catch ss", Score{Status: 1, Mode: 2, N300: 100, N50: 20}, "X"},
+		{"catch s", Score{Status: 1, Mode: 2, N300: 99, Nkatu: 1}, "S"},
+		{"catch a", Score{Status: 1, Mode: 2, N300: 95, Nmiss: 5}, "A"},
+		{"catch b", Score{Status: 1, Mode: 2, N300: 92, Nmiss: 8}, "B"},
+		{"catch c", Score{Status: 1, Mode: 2, N300: 87, Nmiss: 13}, "C"},
+		{"catch d", Score{Status: 1, Mode: 2, N300: 80, Nmiss: 20}, "D"},
+
+		{"mania ss", Score{Status: 1, Mode: 3, Ngeki: 60, N300: 40}, "X"},
+		{"mania fade in s", Score{Status: 1, Mode: 3, Ngeki: 60, N300: 30, Nkatu: 10, Mods: modFadeIn}, "SH"},
+		{"mania a", Score{Status: 1, Mode: 3, N300: 90, N100: 10}, "A"},
+		{"mania d", Score{Status: 1, Mode: 3, N300: 60, Nmiss: 40}, "D"},
+	} {
+		if got := calculateGrade(&tt.score); got != tt.want {
+			t.Errorf("%s: calculateGrade() = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
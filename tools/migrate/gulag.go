@@ -0,0 +1,586 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// import gulag brings a whole gulag (or older bancho.py) instance forward
+// into a fresh bancho.py database, created from migrations/base.sql, in a
+// single run. each table has its own converter (see converters.go), which
+// copies it across from the old database on the same mysql server, taking
+// care of the schema changes listed in migrations/migrations.sql. scores
+// go through the same pipeline as migrations, with replays renamed to the
+// new score ids, so an interrupted import can be continued with --resume.
+
+// the old database's scores tables: the per-mod tables from before v4.2.0,
+// or the merged table of instances which have already been migrated, or of
+// early gulag v3, from before the scores were split by mods.
+var gulagScoresTables = []struct {
+	table      string
+	modeOffset int
+}{
+	{"scores_vn", 0},
+	{"scores_rx", 4},
+	{"scores_ap", 8},
+	{"scores", 0},
+}
+
+// gulagVersion describes which version the old database's scores are from,
+// judged by its tables & columns, as gulag never recorded its version.
+func gulagVersion(src *OldSchema) string {
+	switch {
+	case src.Has("scores_vn") && src.HasColumn("scores_vn", "online_checksum"):
+		return "gulag v3.5.2 or later, with scores split by mods"
+	case src.Has("scores_vn"):
+		return "gulag before v3.5.2, with scores split by mods"
+	case src.HasColumn("scores", "game_mode"):
+		return "early gulag v3, from before the scores were split by mods"
+	case src.Has("scores"):
+		return "bancho.py v4.2.0 or later"
+	}
+	return "gulag, without any scores"
+}
+
+// unsplitScoreMode gives the scores of a merged table their mode. relax &
+// autopilot scores from before the tables were split by mods are in the
+// vanilla modes, and are moved into their own by their mods.
+func unsplitScoreMode(score *Score) {
+	if score.Mode < 4 {
+		score.Mode = modeFromMods(score.Mode, score.Mods)
+	}
+}
+
+// the stats table had a column per stat & mode until it was split into
+// a row per mode, named like pp_rx_std. autopilot was mode 7 back then.
+var gulagWideStatsModes = []struct {
+	mods   string
+	modes  []string
+	offset int
+}{
+	{"vn", []string{"std", "taiko", "catch", "mania"}, 0},
+	{"rx", []string{"std", "taiko", "catch"}, 4},
+	{"ap", []string{"std"}, 8},
+}
+
+// gulagSourceTables returns the old scores tables which exist, set up to
+// be read by the score pipeline. the columns each version renamed or didn't
+// have yet are read the same way as by migrations, see preflight.go.
+func gulagSourceTables(src *OldSchema) ([]SourceTable, error) {
+	replays, err := openReplayStore(cfg.GulagReplays)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("detected the old database's version", "version", gulagVersion(src))
+
+	var names []string
+	for _, t := range gulagScoresTables {
+		if src.Has(t.table) {
+			names = append(names, t.table)
+		}
+	}
+	schemas, err := loadTableSchemas(src.Name, names)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*TableSchema, len(schemas))
+	for _, t := range schemas {
+		byName[strings.ToLower(t.Name)] = t
+	}
+
+	var tables []SourceTable
+	var checks []SchemaCheck
+	for _, t := range gulagScoresTables {
+		schema := byName[t.table]
+		if schema == nil {
+			continue
+		}
+		check := checkTableSchema(schema, expectedScoreColumns, nil)
+		checks = append(checks, check)
+
+		table := SourceTable{
+			Name:       src.Table(t.table),
+			ModeOffset: t.modeOffset,
+			Columns:    selectExpectedColumns(expectedScoreColumns, check.Exprs),
+			Replays:    replays,
+		}
+		if t.table == "scores" {
+			table.Prepare = unsplitScoreMode
+		}
+		tables = append(tables, table)
+	}
+	if printSchemaChecks(checks) {
+		return nil, errPreflightFailed
+	}
+	return tables, nil
+}
+
+func convertUsers(src *OldSchema) (int64, error) {
+	// renamed in v3.0.6
+	safeName, password := "u.safe_name", "u.pw_bcrypt"
+	if !src.HasColumn("users", "safe_name") {
+		safeName = "u.name_safe"
+	}
+	if !src.HasColumn("users", "pw_bcrypt") {
+		password = "u.pw_hash"
+	}
+
+	// clan_rank became clan_priv in v3.2.2
+	clanPriv := src.Column("users", "u.", "clan_priv", "0")
+	if src.HasColumn("users", "clan_rank") {
+		clanPriv = "u.clan_rank"
+	}
+
+	return copyRows(fmt.Sprintf(`
+	INSERT IGNORE INTO users (id, name, safe_name, email, priv, pw_bcrypt, country,
+		silence_end, donor_end, creation_time, latest_activity, clan_id, clan_priv,
+		preferred_mode, play_style, custom_badge_name, custom_badge_icon,
+		userpage_content, api_key)
+	SELECT u.id, u.name, %s, u.email, u.priv, %s, %s, %s, %s, %s, %s, %s, %s, %s,
+		%s, %s, %s, %s, %s
+	FROM %s u`,
+		safeName, password,
+		src.Column("users", "u.", "country", "'xx'"),
+		src.Column("users", "u.", "silence_end", "0"),
+		src.Column("users", "u.", "donor_end", "0"),
+		src.Column("users", "u.", "creation_time", "0"),
+		src.Column("users", "u.", "latest_activity", "0"),
+		src.Column("users", "u.", "clan_id", "0"), clanPriv,
+		src.Column("users", "u.", "preferred_mode", "0"),
+		src.Column("users", "u.", "play_style", "0"),
+		src.Column("users", "u.", "custom_badge_name", "NULL"),
+		src.Column("users", "u.", "custom_badge_icon", "NULL"),
+		src.Column("users", "u.", "userpage_content", "NULL"),
+		src.Column("users", "u.", "api_key", "NULL"),
+		src.Table("users")))
+}
+
+// convertClans copies clans, whose members are kept by users' clan_id.
+// members of clans which weren't imported (as their owner wasn't) are
+// left clanless.
+func convertClans(src *OldSchema) (int64, error) {
+	n, err := TableMapping{Table: "clans", UserColumn: "owner"}.convert(src)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = DB.Exec(`
+	UPDATE users SET clan_id = 0, clan_priv = 0
+	WHERE clan_id != 0 AND clan_id NOT IN (SELECT id FROM clans)`)
+	return n, err
+}
+
+func convertStats(src *OldSchema) (int64, error) {
+	if !src.Has("stats") {
+		return 0, fillStatsModes()
+	}
+
+	var copied int64
+	if src.HasColumn("stats", "mode") {
+		n, err := copyRows(fmt.Sprintf(`
+		INSERT IGNORE INTO stats (id, mode, tscore, rscore, pp, plays, playtime, acc,
+			max_combo, total_hits, replay_views, xh_count, x_count, sh_count, s_count, a_count)
+		SELECT s.id, IF(s.mode = 7, 8, s.mode), s.tscore, s.rscore, s.pp, s.plays,
+			s.playtime, s.acc, s.max_combo, %s, %s, %s, %s, %s, %s, %s
+		FROM %s s JOIN users u ON u.id = s.id`,
+			src.Column("stats", "s.", "total_hits", "0"),
+			src.Column("stats", "s.", "replay_views", "0"),
+			src.Column("stats", "s.", "xh_count", "0"),
+			src.Column("stats", "s.", "x_count", "0"),
+			src.Column("stats", "s.", "sh_count", "0"),
+			src.Column("stats", "s.", "s_count", "0"),
+			src.Column("stats", "s.", "a_count", "0"),
+			src.Table("stats")))
+		if err != nil {
+			return 0, err
+		}
+		copied += n
+	} else {
+		for _, group := range gulagWideStatsModes {
+			for i, mode := range group.modes {
+				col := func(name string) string {
+					column := name + "_" + group.mods + "_" + mode
+					if name == "max_combo" && !src.HasColumn("stats", column) {
+						column = "maxcombo_" + group.mods + "_" + mode // before v3.2.6
+					}
+					return src.Column("stats", "s.", column, "0")
+				}
+
+				n, err := copyRows(fmt.Sprintf(`
+				INSERT IGNORE INTO stats (id, mode, tscore, rscore, pp, plays, playtime, acc, max_combo)
+				SELECT s.id, %d, %s, %s, %s, %s, %s, %s, %s
+				FROM %s s JOIN users u ON u.id = s.id`,
+					i+group.offset, col("tscore"), col("rscore"), col("pp"), col("plays"),
+					col("playtime"), col("acc"), col("max_combo"), src.Table("stats")))
+				if err != nil {
+					return 0, err
+				}
+				copied += n
+			}
+		}
+	}
+
+	if err := fillStatsModes(); err != nil {
+		return 0, err
+	}
+
+	// older stats have no grade counts, which are worked out from the scores
+	if !src.HasColumn("stats", "xh_count") {
+		if _, err := DB.Exec(update_stats_from_scores); err != nil {
+			return 0, fmt.Errorf("failed to update stats from scores: %w", err)
+		}
+	}
+	return copied, nil
+}
+
+func convertRelationships(src *OldSchema) (int64, error) {
+	// friendships became relationships in v3.3.0, which added blocks
+	table, kind := "relationships", "r.type"
+	if !src.Has(table) {
+		table, kind = "friendships", "'friend'"
+	}
+	if !src.Has(table) {
+		return 0, nil
+	}
+
+	return copyRows(fmt.Sprintf(`
+	INSERT IGNORE INTO relationships (user1, user2, type)
+	SELECT r.user1, r.user2, %s FROM %s r
+	JOIN users u1 ON u1.id = r.user1 JOIN users u2 ON u2.id = r.user2`,
+		kind, src.Table(table)))
+}
+
+func convertFavourites(src *OldSchema) (int64, error) {
+	if !src.Has("favourites") {
+		return 0, nil
+	}
+	return copyRows(fmt.Sprintf(`
+	INSERT IGNORE INTO favourites (userid, setid, created_at)
+	SELECT f.userid, f.setid, %s FROM %s f JOIN users u ON u.id = f.userid`,
+		src.Column("favourites", "f.", "created_at", "0"), src.Table("favourites")))
+}
+
+// convertComments copies comments, pointing those on replays at the scores'
+// new ids. comments on replays whose scores weren't imported are dropped.
+func convertComments(src *OldSchema) (int64, error) {
+	if !src.Has("comments") {
+		return 0, nil
+	}
+
+	tables := []string{""} // so the IN () is never empty
+	for _, table := range src.ScoreTables {
+		tables = append(tables, table.Name)
+	}
+
+	query, args, err := sqlx.In(fmt.Sprintf(`
+	INSERT IGNORE INTO comments (id, target_id, target_type, userid, time, comment, colour)
+	SELECT c.id, IF(c.target_type = 'replay', m.new_id, c.target_id), c.target_type,
+		c.userid, c.time, c.comment, c.colour
+	FROM %s c JOIN users u ON u.id = c.userid
+	LEFT JOIN migration_score_ids m ON c.target_type = 'replay'
+		AND m.old_id = c.target_id AND m.source_table IN (?)
+	WHERE c.target_type != 'replay' OR m.new_id IS NOT NULL`, src.Table("comments")), tables)
+	if err != nil {
+		return 0, err
+	}
+	return copyRows(query, args...)
+}
+
+func convertMail(src *OldSchema) (int64, error) {
+	if !src.Has("mail") {
+		return 0, nil
+	}
+	return copyRows(fmt.Sprintf(`
+	INSERT IGNORE INTO mail (id, from_id, to_id, msg, time, `+"`read`"+`)
+	SELECT m.id, m.from_id, m.to_id, m.msg, m.time, m.read FROM %s m
+	JOIN users u1 ON u1.id = m.from_id JOIN users u2 ON u2.id = m.to_id`,
+		src.Table("mail")))
+}
+
+// convertChannels brings over custom channels, and changes made to the
+// default ones (which base.sql creates) by name.
+func convertChannels(src *OldSchema) (int64, error) {
+	if !src.Has("channels") {
+		return 0, nil
+	}
+
+	updated, err := copyRows(fmt.Sprintf(`
+	UPDATE channels c JOIN %s o ON o.name = c.name
+	SET c.topic = o.topic, c.read_priv = o.read_priv,
+		c.write_priv = o.write_priv, c.auto_join = o.auto_join`, src.Table("channels")))
+	if err != nil {
+		return 0, err
+	}
+
+	inserted, err := copyRows(fmt.Sprintf(`
+	INSERT IGNORE INTO channels (name, topic, read_priv, write_priv, auto_join)
+	SELECT name, topic, read_priv, write_priv, auto_join FROM %s ORDER BY id`,
+		src.Table("channels")))
+	return updated + inserted, err
+}
+
+func convertLogs(src *OldSchema) (int64, error) {
+	if !src.Has("logs") {
+		return 0, nil
+	}
+	return copyRows(fmt.Sprintf(`
+	INSERT IGNORE INTO logs (id, `+"`from`, `to`, `action`"+`, msg, time)
+	SELECT l.id, l.from, l.to, %s, l.msg, l.time
+	FROM %s l JOIN users u ON u.id = l.to`,
+		src.Column("logs", "l.", "action", "''"), src.Table("logs")))
+}
+
+// convertMaps copies the cached beatmaps. gulag's own maps were on the
+// 'gulag' server, which became 'private' in v4.3.1.
+func convertMaps(src *OldSchema) (int64, error) {
+	if !src.Has("maps") {
+		return 0, nil
+	}
+	return copyRows(fmt.Sprintf(`
+	INSERT IGNORE INTO maps (server, id, set_id, status, md5, artist, title, version,
+		creator, filename, last_update, total_length, max_combo, frozen, plays,
+		passes, mode, bpm, cs, ar, od, hp, diff)
+	SELECT IF(%s = 'osu!', 'osu!', 'private'), m.id, m.set_id, m.status, m.md5,
+		m.artist, m.title, m.version, m.creator, %s, m.last_update, m.total_length,
+		%s, %s, %s, %s, m.mode, m.bpm, m.cs, m.ar, m.od, m.hp, m.diff
+	FROM %s m`,
+		serverColumn(src, "maps", "m."),
+		src.Column("maps", "m.", "filename", "''"),
+		src.Column("maps", "m.", "max_combo", "0"),
+		src.Column("maps", "m.", "frozen", "0"),
+		src.Column("maps", "m.", "plays", "0"),
+		src.Column("maps", "m.", "passes", "0"),
+		src.Table("maps")))
+}
+
+func convertMapsets(src *OldSchema) (int64, error) {
+	if !src.Has("mapsets") {
+		return 0, nil
+	}
+	return copyRows(fmt.Sprintf(`
+	INSERT IGNORE INTO mapsets (server, id, last_osuapi_check)
+	SELECT IF(%s = 'osu!', 'osu!', 'private'), s.id, %s FROM %s s`,
+		serverColumn(src, "mapsets", "s."),
+		src.Column("mapsets", "s.", "last_osuapi_check", "NOW()"),
+		src.Table("mapsets")))
+}
+
+func serverColumn(src *OldSchema, table, prefix string) string {
+	if src.HasColumn(table, "server") {
+		return prefix + "server"
+	}
+	return "'osu!'"
+}
+
+func convertScores(src *OldSchema) (int64, error) {
+	if len(src.ScoreTables) == 0 {
+		return 0, nil
+	}
+	if err := migrateScores(src.ScoreTables, cfg.Resume); err != nil {
+		return 0, err
+	}
+
+	var inserted int64
+	for _, table := range src.ScoreTables {
+		inserted += atomic.LoadInt64(&progress.tables[table.Name].Inserted)
+	}
+	return inserted, nil
+}
+
+// copyUserRows converts a table which is the same in every version, and
+// belongs to the user in userColumn.
+func copyUserRows(table, userColumn string, columns ...string) func(*OldSchema) (int64, error) {
+	return func(src *OldSchema) (int64, error) {
+		if !src.Has(table) {
+			return 0, nil
+		}
+		return copyRows(fmt.Sprintf(`
+		INSERT IGNORE INTO %s (%s)
+		SELECT t.%s FROM %s t JOIN users u ON u.id = t.%s`,
+			table, strings.Join(columns, ", "), strings.Join(columns, ", t."),
+			src.Table(table), userColumn))
+	}
+}
+
+func runImportGulag() error {
+	if !validSchemaName.MatchString(cfg.GulagDB) {
+		return errors.New("--gulag-db must be the name of the old database")
+	}
+	if cfg.GulagReplays == "" {
+		return errors.New("--gulag-replays must be the old .data/osr directory")
+	}
+
+	// forks' own tables, see modules.go
+	if cfg.TablesFile != "" {
+		if err := loadTableMappings(cfg.TablesFile); err != nil {
+			return err
+		}
+	}
+
+	order, err := converterOrder()
+	if err != nil {
+		return err
+	}
+
+	// the bancho.py database must already have its tables (from base.sql)
+	for _, c := range order {
+		if c.Create != "" {
+			if _, err := DB.Exec(c.Create); err != nil {
+				return fmt.Errorf("failed to create %s: %w", c.Table, err)
+			}
+		}
+		exists, err := tableExists(c.Table)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("the %s table does not exist, create the bancho.py database from migrations/base.sql first", c.Table)
+		}
+	}
+
+	src, err := loadOldSchema(cfg.GulagDB)
+	if err != nil {
+		return err
+	}
+	if !src.Has("users") {
+		return fmt.Errorf("%s does not look like a gulag database", cfg.GulagDB)
+	}
+
+	if !cfg.Resume {
+		var scores int
+		if err := DB.Get(&scores, "SELECT COUNT(*) FROM scores"); err != nil {
+			return err
+		}
+		if scores != 0 {
+			return errors.New("the bancho.py database already has scores, gulag can only be imported into a fresh database")
+		}
+	}
+
+	if err := setupReplayStores(); err != nil {
+		return err
+	}
+	if src.ScoreTables, err = gulagSourceTables(src); err != nil {
+		return err
+	}
+
+	// ctrl-c stops the migration gracefully, see signal.go
+	handleSignals()
+
+	if err := tuneWorkers(); err != nil {
+		return err
+	}
+	if err := tuneBatching(); err != nil {
+		return err
+	}
+	progress = newProgress(src.ScoreTables, NumWorkers)
+	replayJournal, err = openReplayJournal(cfg.ReplayJournalPath)
+	if err != nil {
+		return err
+	}
+	defer replayJournal.Close()
+
+	// rows which can't be migrated are kept here, instead of being lost
+	deadLetters = newDeadLetterFile(cfg.DeadLetterPath)
+	defer deadLetters.Close()
+
+	if cfg.Resume {
+		if err := resumePendingReplays(src.ScoreTables); err != nil {
+			return err
+		}
+	} else if err := createCheckpointTables(); err != nil {
+		return err
+	}
+
+	// rows which were already imported are skipped, so every
+	// converter is safe to run again when resuming
+	start := time.Now()
+	for _, c := range order {
+		if isInterrupted() {
+			return errInterrupted
+		}
+
+		tableStart := time.Now()
+		n, err := c.Convert(src)
+		if errors.Is(err, errInterrupted) {
+			return err
+		} else if err != nil {
+			return fmt.Errorf("failed to import %s: %w", c.Table, err)
+		}
+		logger.Info("imported table", "table", c.Table, "rows", n,
+			"elapsed", time.Since(tableStart).Round(time.Millisecond))
+	}
+
+	if len(src.ScoreTables) != 0 {
+		progress.summary()
+	}
+	if err := dropCheckpointTables(); err != nil {
+		return err
+	}
+
+	logger.Info("gulag import finished", "elapsed", time.Since(start).Round(time.Second))
+	return nil
+}
+
+func init() {
+	registerTableConverter(&TableConverter{Table: "users", Convert: convertUsers})
+	registerTableConverter(&TableConverter{Table: "maps", Convert: convertMaps})
+	registerTableConverter(&TableConverter{Table: "mapsets", Convert: convertMapsets})
+	registerTableConverter(&TableConverter{Table: "channels", Convert: convertChannels})
+	registerTableConverter(&TableConverter{Table: "clans", DependsOn: []string{"users"}, Convert: convertClans})
+	registerTableConverter(&TableConverter{Table: "scores", DependsOn: []string{"users", "maps"}, Convert: convertScores})
+	registerTableConverter(&TableConverter{Table: "stats", DependsOn: []string{"users", "scores"}, Convert: convertStats})
+	registerTableConverter(&TableConverter{Table: "relationships", DependsOn: []string{"users"}, Convert: convertRelationships})
+	registerTableConverter(&TableConverter{Table: "favourites", DependsOn: []string{"users", "mapsets"}, Convert: convertFavourites})
+	registerTableConverter(&TableConverter{Table: "comments", DependsOn: []string{"users", "scores"}, Convert: convertComments})
+	registerTableConverter(&TableConverter{Table: "mail", DependsOn: []string{"users"}, Convert: convertMail})
+	registerTableConverter(&TableConverter{Table: "logs", DependsOn: []string{"users"}, Convert: convertLogs})
+	registerTableConverter(&TableConverter{
+		Table:     "ratings",
+		DependsOn: []string{"users", "maps"},
+		Convert:   copyUserRows("ratings", "userid", "userid", "map_md5", "rating"),
+	})
+	registerTableConverter(&TableConverter{
+		Table:     "ingame_logins",
+		DependsOn: []string{"users"},
+		Convert:   copyUserRows("ingame_logins", "userid", "id", "userid", "ip", "osu_ver", "osu_stream", "datetime"),
+	})
+	registerTableConverter(&TableConverter{
+		Table:     "client_hashes",
+		DependsOn: []string{"users"},
+		Convert: copyUserRows("client_hashes", "userid", "userid", "osupath", "adapters",
+			"uninstall_id", "disk_serial", "latest_time", "occurrences"),
+	})
+	registerTableConverter(&TableConverter{
+		Table:     "map_requests",
+		DependsOn: []string{"users", "maps"},
+		Convert:   copyUserRows("map_requests", "player_id", "id", "map_id", "player_id", "datetime", "active"),
+	})
+
+	registerCommand(&Command{
+		Name:              "import gulag",
+		Summary:           "import a gulag (or older bancho.py) database into a fresh bancho.py database",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.GulagDB, "gulag-db", "", "name of the old database, on the same server as bancho.py's")
+			flags.StringVar(&c.GulagReplays, "gulag-replays", "", "the old instance's replays (its .data/osr), a path or s3://bucket/prefix")
+			flags.StringVar(&c.TablesFile, "tables", "", "json file of extra tables to import, e.g. a fork's own (see modules.go)")
+			flags.BoolVar(&c.Resume, "resume", false, "continue an interrupted import")
+			flags.IntVar(&c.Workers, "workers", 0, "number of concurrent workers (default: tuned to the database's max_connections)")
+			flags.IntVar(&c.MaxRetries, "max-retries", 5, "times to retry a batch after a deadlock, lock wait timeout or lost connection")
+			batchingFlags(flags, c)
+			filterFlags(flags, c)
+			flags.StringVar(&c.DeadLetterPath, "dead-letter", "", "file to write rows which failed to migrate to (default: DATA_DIRECTORY/migrate_dead_letters.jsonl)")
+			flags.StringVar(&c.ReplayJournalPath, "replay-journal", "", "journal of replay moves (default: DATA_DIRECTORY/migrate_replays.journal)")
+			flags.DurationVar(&c.ProgressInterval, "progress-interval", 10*time.Second, "how often to report progress (0 to disable)")
+			flags.StringVar(&c.ProgressFormat, "progress-format", "auto", "progress output format: tui for a dashboard, text, or log to report through the (structured) logger (default: tui on a terminal, otherwise text)")
+			flags.StringVar(&c.NewReplays, "new-replays", "", "where imported replays are written, a path or s3://bucket/prefix (default: DATA_DIRECTORY/osr)")
+		},
+		Run: runImportGulag,
+	})
+}
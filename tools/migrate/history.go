@@ -0,0 +1,301 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// rank_history keeps each player's global rank & pp per mode, once a day,
+// for frontends to draw rank graphs from. `history snapshot` records today's
+// from the stats table, `history daemon` does so on a schedule, and
+// `history backfill` reconstructs past days from the scores table.
+
+var create_rank_history = `
+CREATE TABLE IF NOT EXISTS rank_history (
+	userid int not null,
+	mode tinyint(1) not null,
+	date date not null,
+	pp int unsigned not null,
+	global_rank int unsigned not null,
+	primary key (userid, mode, date),
+	index rank_history_mode_date_index (mode, date)
+)`
+
+var insert_rank_history = `
+INSERT INTO rank_history (userid, mode, date, pp, global_rank)
+VALUES (:userid, :mode, :date, :pp, :global_rank)
+ON DUPLICATE KEY UPDATE pp = VALUES(pp), global_rank = VALUES(global_rank)`
+
+// restricted players have no rank, as in bancho.py
+var select_snapshot_stats = `
+SELECT st.id AS userid, st.mode, st.pp
+FROM stats st JOIN users u ON u.id = st.id
+WHERE u.priv & 1 AND st.pp > 0`
+
+// backfilling replays every ranked pass in the order they were played
+var select_backfill_scores = `
+SELECT s.userid, s.mode, s.map_md5, s.pp, s.play_time
+FROM scores s
+JOIN users u ON u.id = s.userid
+JOIN maps m ON m.md5 = s.map_md5
+WHERE s.status != 0 AND u.priv & 1 AND m.status IN (?, ?) AND s.play_time < ?
+ORDER BY s.play_time`
+
+// RankHistory is a player's rank & pp on a day.
+type RankHistory struct {
+	UserID int64 `db:"userid"`
+	Mode   int
+	Date   string // yyyy-mm-dd
+	PP     int64  `db:"pp"`
+	Rank   int    `db:"global_rank"`
+}
+
+type userMode struct {
+	userID int64
+	mode   int
+}
+
+// weightedPP works out a player's total pp from their best pp on each map,
+// in the same way as bancho.py.
+func weightedPP(pps []float64) int64 {
+	sort.Sort(sort.Reverse(sort.Float64Slice(pps)))
+
+	var weighted float64
+	for i, pp := range pps {
+		weighted += pp * math.Pow(0.95, float64(i))
+	}
+	bonus := 416.6667 * (1 - math.Pow(0.9994, float64(len(pps))))
+	return int64(math.Round(weighted + bonus))
+}
+
+// rankPlayers ranks each mode's players by pp, for a day. ties are broken
+// by user id, so that every player has a distinct rank.
+func rankPlayers(pps map[userMode]int64, date string) []RankHistory {
+	rows := make([]RankHistory, 0, len(pps))
+	for player, pp := range pps {
+		if pp > 0 {
+			rows = append(rows, RankHistory{UserID: player.userID, Mode: player.mode, Date: date, PP: pp})
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if a.Mode != b.Mode {
+			return a.Mode < b.Mode
+		}
+		if a.PP != b.PP {
+			return a.PP > b.PP
+		}
+		return a.UserID < b.UserID
+	})
+
+	for i := range rows {
+		if i == 0 || rows[i].Mode != rows[i-1].Mode {
+			rows[i].Rank = 1
+		} else {
+			rows[i].Rank = rows[i-1].Rank + 1
+		}
+	}
+	return rows
+}
+
+func writeRankHistory(rows []RankHistory) error {
+	for start := 0; start < len(rows); start += BatchSize {
+		end := start + BatchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		if err := throttle(end - start); err != nil {
+			return err
+		}
+		if _, err := DB.NamedExec(insert_rank_history, rows[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// takeRankSnapshot records every player's current rank & pp, as of today.
+func takeRankSnapshot() error {
+	if _, err := DB.Exec(create_rank_history); err != nil {
+		return err
+	}
+
+	var stats []struct {
+		UserID int64 `db:"userid"`
+		Mode   int
+		PP     int64 `db:"pp"`
+	}
+	if err := DB.Select(&stats, select_snapshot_stats); err != nil {
+		return err
+	}
+
+	pps := make(map[userMode]int64, len(stats))
+	for _, s := range stats {
+		pps[userMode{s.UserID, s.Mode}] = s.PP
+	}
+	rows := rankPlayers(pps, time.Now().Format("2006-01-02"))
+	if err := writeRankHistory(rows); err != nil {
+		return err
+	}
+
+	logger.Info("took rank snapshot", "players", len(rows))
+	return nil
+}
+
+func runHistorySnapshot() error {
+	return takeRankSnapshot()
+}
+
+func runHistoryDaemon() error {
+	schedule, err := parseSchedule(cfg.HistorySchedule)
+	if err != nil {
+		return err
+	}
+
+	handleSignals()
+	for {
+		next := schedule.next(time.Now())
+		if next.IsZero() {
+			return fmt.Errorf("schedule %q never runs", cfg.HistorySchedule)
+		}
+		logger.Info("waiting for the next rank snapshot", "at", next.Format(time.RFC3339))
+
+		select {
+		case <-time.After(time.Until(next)):
+		case <-interrupted:
+			return nil
+		}
+
+		// a failed snapshot is retried at the next scheduled time
+		if err := takeRankSnapshot(); err != nil {
+			logger.Error("failed to take rank snapshot", "err", err)
+		}
+	}
+}
+
+// runHistoryBackfill reconstructs each day's ranks from the scores played
+// up to the end of it. this uses scores' current pp & maps' current
+// statuses, so it shows what ranks would have been under today's pp.
+func runHistoryBackfill() error {
+	// play_time is read as utc, see wallClock
+	from, err := time.ParseInLocation("2006-01-02", cfg.HistoryFrom, time.UTC)
+	if err != nil {
+		return fmt.Errorf("--from %q must be a date, e.g. 2024-01-31", cfg.HistoryFrom)
+	}
+	// today is left for snapshots, which use the stats table
+	now := wallClock(time.Now())
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if !from.Before(today) {
+		return errors.New("--from must be before today")
+	}
+
+	if _, err := DB.Exec(create_rank_history); err != nil {
+		return err
+	}
+
+	rows, err := DB.Queryx(select_backfill_scores, mapStatusRanked, mapStatusApproved, today)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	start := time.Now()
+	bests := make(map[userMode]map[string]float64)
+	pps := make(map[userMode]int64)
+	dirty := make(map[userMode]bool)
+	day := from
+	written := 0
+
+	// finishDay ranks every player as of the end of day, then moves on
+	finishDay := func() error {
+		for player := range dirty {
+			maps := make([]float64, 0, len(bests[player]))
+			for _, pp := range bests[player] {
+				maps = append(maps, pp)
+			}
+			pps[player] = weightedPP(maps)
+			delete(dirty, player)
+		}
+
+		ranks := rankPlayers(pps, day.Format("2006-01-02"))
+		if err := writeRankHistory(ranks); err != nil {
+			return err
+		}
+		written += len(ranks)
+		logger.Debug("backfilled rank history", "date", day.Format("2006-01-02"), "players", len(ranks))
+
+		day = day.AddDate(0, 0, 1)
+		return nil
+	}
+
+	for rows.Next() {
+		var score struct {
+			UserID   int64 `db:"userid"`
+			Mode     int
+			MapMD5   string `db:"map_md5"`
+			PP       float64
+			PlayTime time.Time `db:"play_time"`
+		}
+		if err := rows.StructScan(&score); err != nil {
+			return err
+		}
+
+		for !score.PlayTime.Before(day.AddDate(0, 0, 1)) {
+			if err := finishDay(); err != nil {
+				return err
+			}
+		}
+
+		player := userMode{score.UserID, score.Mode}
+		if bests[player] == nil {
+			bests[player] = make(map[string]float64)
+		}
+		if score.PP > bests[player][score.MapMD5] {
+			bests[player][score.MapMD5] = score.PP
+			dirty[player] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for day.Before(today) {
+		if err := finishDay(); err != nil {
+			return err
+		}
+	}
+
+	logger.Info("backfilled rank history", "from", cfg.HistoryFrom, "rows", written,
+		"elapsed", time.Since(start).Round(time.Second))
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "history snapshot",
+		Summary: "record every player's current rank & pp in the rank_history table",
+		Run:     runHistorySnapshot,
+	})
+
+	registerCommand(&Command{
+		Name:    "history daemon",
+		Summary: "record rank snapshots on a schedule, until stopped",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.HistorySchedule, "schedule", "@daily", "when to take snapshots, as a cron expression (e.g. \"0 0 * * *\")")
+		},
+		Run: runHistoryDaemon,
+	})
+
+	registerCommand(&Command{
+		Name:    "history backfill",
+		Summary: "reconstruct past days' ranks & pp in the rank_history table from the scores table",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.HistoryFrom, "from", time.Now().AddDate(0, 0, -90).Format("2006-01-02"), "first day to backfill")
+		},
+		Run: runHistoryBackfill,
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// the new scores table is created without secondary indexes, as keeping
+// them up to date would slow every insert of the bulk copy. they're built
+// once it's done, one at a time, so that a slow index is easy to spot, and
+// a resumed run only builds the ones it hasn't yet.
+
+// ScoreIndex is a secondary index of the new scores table.
+type ScoreIndex struct {
+	Name    string `db:"name"`
+	Columns string `db:"columns"`
+}
+
+// the ones leaderboards & pp recalculation can't do without are built with
+// bancho.py's own names, so the tables aren't scanned until bancho.py's
+// updater runs migrations.sql (v5.0.1 & v5.2.2), which skips an index that
+// already exists. it creates the rest when it next starts.
+var scoreIndexes = []ScoreIndex{
+	// leaderboards, by map, mode & status
+	{"scores_fetch_leaderboard_generic_index", "map_md5, status, mode"},
+	// top plays are ordered by pp
+	{"scores_pp_index", "pp"},
+	// profiles list a player's scores by mode & status, which bancho.py has
+	// no index for
+	{"migrate_scores_profile_index", "userid, mode, status"},
+}
+
+// tableIndexes returns a table's secondary (non-unique) indexes, for a
+// rebuilt table to have the same ones.
+func tableIndexes(table string) ([]ScoreIndex, error) {
+	var indexes []ScoreIndex
+	err := DB.Select(&indexes, `
+	SELECT index_name AS name,
+	GROUP_CONCAT(IF(sub_part IS NULL, column_name, CONCAT(column_name, '(', sub_part, ')'))
+		ORDER BY seq_in_index SEPARATOR ', ') AS columns
+	FROM information_schema.statistics
+	WHERE table_schema = DATABASE() AND table_name = ? AND non_unique = 1
+	GROUP BY index_name ORDER BY index_name`, table)
+	return indexes, err
+}
+
+func indexExists(table, name string) (bool, error) {
+	var count int
+	err := DB.Get(&count, `
+	SELECT COUNT(*) FROM information_schema.statistics
+	WHERE table_schema = DATABASE() AND table_name = ? AND index_name = ?`, table, name)
+	return count != 0, err
+}
+
+// createScoreIndexes builds the new scores table's indexes, then has mysql
+// analyze it, so the query planner isn't left with the statistics of an
+// empty table.
+func createScoreIndexes(indexes []ScoreIndex) error {
+	start := time.Now()
+	created := 0
+	for _, index := range indexes {
+		if isInterrupted() {
+			return errInterrupted
+		}
+
+		exists, err := indexExists("scores", index.Name)
+		if err != nil {
+			return err
+		}
+		if exists {
+			logger.Debug("index already exists", "index", index.Name)
+			continue
+		}
+
+		indexStart := time.Now()
+		_, err = DB.Exec(fmt.Sprintf("ALTER TABLE scores ADD INDEX %s (%s)", index.Name, index.Columns))
+		if err != nil {
+			return fmt.Errorf("failed to create index %s: %w", index.Name, err)
+		}
+		created++
+		logger.Info("created index", "index", index.Name, "columns", index.Columns,
+			"elapsed", time.Since(indexStart).Round(time.Millisecond))
+	}
+
+	analyzeStart := time.Now()
+	if _, err := DB.Exec("ANALYZE TABLE scores"); err != nil {
+		return err
+	}
+	logger.Info("analyzed the scores table", "elapsed", time.Since(analyzeStart).Round(time.Millisecond))
+
+	logger.Info("index phase finished", "created", created, "total", len(indexes),
+		"elapsed", time.Since(start).Round(time.Second))
+	return nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// v4.2.0 gives the merged scores new ids by default, so each replay is moved
+// to its new id, and anything holding the old ones (replay links, score
+// pages, third-party tools) needs score_id_map to find them. with
+// up --keep-ids, each score keeps its old id instead, plus its table's
+// offset from --id-offsets, e.g. --id-offsets scores_rx=1000000000, for
+// servers whose tables' ids overlap. gulag v3.1.9 already moved scores_rx
+// & scores_ap's ids far apart (see migrations.sql), so they rarely need one.
+//
+// with every offset 0, the replays keep their names, so they're left where
+// they are rather than staged & moved. an offset moves the table's replays
+// as usual, as do --old-replays & --new-replays.
+//
+// before migrating, the tables' kept ids are checked for collisions, which
+// would otherwise fail as duplicate keys. with --online, scores submitted
+// while migrating aren't known yet: one colliding with another table's kept
+// id fails, and is kept in the dead letter file.
+
+// replaysInPlace is set when the ids are kept as they are, so the replays
+// needn't move at all.
+var replaysInPlace bool
+
+// parseIDOffsets parses --id-offsets, e.g. scores_rx=1000000000,scores_ap=2000000000.
+func parseIDOffsets(s string) (map[string]int64, error) {
+	offsets := make(map[string]int64)
+	if s == "" {
+		return offsets, nil
+	}
+	for _, field := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return nil, fmt.Errorf("--id-offsets %q must be table=offset, e.g. scores_rx=1000000000", field)
+		}
+		known := false
+		for _, table := range SourceTables {
+			known = known || table.Name == name
+		}
+		if !known {
+			return nil, fmt.Errorf("--id-offsets: unknown table %q, expected scores_vn, scores_rx or scores_ap", name)
+		}
+		offset, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || offset < 0 {
+			return nil, fmt.Errorf("--id-offsets: %s's offset %q must be a whole number, 0 or more", name, value)
+		}
+		offsets[name] = offset
+	}
+	return offsets, nil
+}
+
+// keepScoreIDs has the source tables keep their ids, with --keep-ids.
+func keepScoreIDs() error {
+	if !cfg.KeepScoreIDs {
+		return nil
+	}
+	offsets, err := parseIDOffsets(cfg.IDOffsets)
+	if err != nil {
+		return err
+	}
+	move := cfg.OldReplays != "" || cfg.NewReplays != ""
+	for _, offset := range offsets {
+		move = move || offset != 0
+	}
+	for i := range SourceTables {
+		SourceTables[i].KeepIDs = true
+		SourceTables[i].IDOffset = offsets[SourceTables[i].Name]
+		SourceTables[i].MoveKeptReplays = move
+	}
+	replaysInPlace = !move
+	return nil
+}
+
+// keptIDRange is the range of a table's ids, once offset.
+type keptIDRange struct {
+	table    SourceTable
+	min, max int64
+	tooBig   bool // some ids would be more than an id can hold
+}
+
+// keptIDRanges returns the tables' kept id ranges, skipping empty tables.
+func keptIDRanges(tables []SourceTable) ([]keptIDRange, error) {
+	var ranges []keptIDRange
+	for _, table := range tables {
+		var r struct {
+			Found  bool  `db:"found"`
+			Min    int64 `db:"min_id"`
+			Max    int64 `db:"max_id"`
+			TooBig bool  `db:"too_big"`
+		}
+		// ids past what an int64 holds are clamped, and reported instead
+		err := DB.Get(&r, fmt.Sprintf(`
+		SELECT MIN(id) IS NOT NULL AS found, COALESCE(LEAST(MIN(id), ?), 0) AS min_id,
+		COALESCE(LEAST(MAX(id), ?), 0) AS max_id, COALESCE(MAX(id) > ?, 0) AS too_big
+		FROM %s`, table.Name), int64(math.MaxInt64), int64(math.MaxInt64), int64(math.MaxInt64)-table.IDOffset)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s's ids: %w", table.Name, err)
+		}
+		if !r.Found {
+			continue
+		}
+		ranges = append(ranges, keptRange(table, r.Min, r.Max, r.TooBig))
+	}
+	return ranges, nil
+}
+
+// keptRange offsets a table's ids, clamping those which wouldn't fit.
+func keptRange(table SourceTable, minID, maxID int64, tooBig bool) keptIDRange {
+	return keptIDRange{table, minID + table.IDOffset, min(maxID, math.MaxInt64-table.IDOffset) + table.IDOffset, tooBig}
+}
+
+// overlap returns the kept ids two tables' ranges share, if any.
+func (a keptIDRange) overlap(b keptIDRange) (from, to int64, ok bool) {
+	from, to = max(a.min, b.min), min(a.max, b.max)
+	return from, to, from <= to
+}
+
+// offsetAfter returns the offset which puts b's ids after a's.
+func (a keptIDRange) offsetAfter(b keptIDRange) int64 {
+	return a.max - b.min + b.table.IDOffset + 1
+}
+
+// idCollisions returns the problems keeping the tables' ids would have:
+// ids shared between tables, and ids too big to keep.
+func idCollisions(tables []SourceTable) ([]string, error) {
+	ranges, err := keptIDRanges(tables)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	for i, a := range ranges {
+		if a.tooBig {
+			problems = append(problems, fmt.Sprintf("some of %s's ids would be more than %d once offset by %d, which can't be kept",
+				a.table.Name, int64(math.MaxInt64), a.table.IDOffset))
+		}
+		for _, b := range ranges[i+1:] {
+			from, to, ok := a.overlap(b)
+			if !ok {
+				continue
+			}
+			// hi's ids collide with lo's which are larger by the difference in offsets
+			lo, hi := a.table, b.table
+			if lo.IDOffset > hi.IDOffset {
+				lo, hi = hi, lo
+			}
+			var shared struct {
+				Count   int64 `db:"count"`
+				Example int64 `db:"example"`
+			}
+			err := DB.Get(&shared, fmt.Sprintf(`
+			SELECT COUNT(*) AS count, COALESCE(MIN(hi.id), 0) AS example
+			FROM %s hi JOIN %s lo ON lo.id = hi.id + ?
+			WHERE hi.id BETWEEN ? AND ?`, hi.Name, lo.Name),
+				hi.IDOffset-lo.IDOffset, from-hi.IDOffset, to-hi.IDOffset)
+			if err != nil {
+				return nil, fmt.Errorf("failed to compare %s & %s's ids: %w", a.table.Name, b.table.Name, err)
+			}
+			if shared.Count == 0 {
+				continue
+			}
+			problems = append(problems, fmt.Sprintf(
+				"%d of %s & %s's ids would collide (e.g. %s's %d & %s's %d), "+
+					"--id-offsets %s=%d would put %s's ids after %s's",
+				shared.Count, a.table.Name, b.table.Name,
+				hi.Name, shared.Example, lo.Name, shared.Example+hi.IDOffset-lo.IDOffset,
+				b.table.Name, a.offsetAfter(b), b.table.Name, a.table.Name))
+		}
+	}
+	return problems, nil
+}
+
+var errIDCollisions = errors.New("the scores' ids can't be kept, give --id-offsets to move the colliding tables' ids apart, or migrate without --keep-ids")
+
+// checkIDCollisions stops v4.2.0 before it starts if the kept ids collide.
+func checkIDCollisions(tables []SourceTable) error {
+	if !cfg.KeepScoreIDs {
+		return nil
+	}
+	problems, err := idCollisions(tables)
+	if err != nil {
+		return err
+	}
+	for _, problem := range problems {
+		logger.Error(problem)
+	}
+	if len(problems) != 0 {
+		return errIDCollisions
+	}
+	logger.Info("keeping the scores' ids", "replays_in_place", replaysInPlace)
+	return nil
+}
+
+// replaysMoved reports whether the migration has moved any replays, which
+// it hasn't when the ids were kept in place.
+func replaysMoved() (bool, error) {
+	var moved bool
+	err := DB.Get(&moved, "SELECT EXISTS(SELECT 1 FROM migration_score_ids WHERE has_replay = 1)")
+	return moved, err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestParseIDOffsets(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  map[string]int64
+		ok    bool
+	}{
+		{"", map[string]int64{}, true},
+		{"scores_rx=1000000000", map[string]int64{"scores_rx": 1000000000}, true},
+		{"scores_rx=1000000000, scores_ap=2000000000", map[string]int64{"scores_rx": 1000000000, "scores_ap": 2000000000}, true},
+		{"scores_vn=0", map[string]int64{"scores_vn": 0}, true},
+		{"scores_rx", nil, false},
+		{"scores_xx=5", nil, false},
+		{"scores_rx=-5", nil, false},
+		{"scores_rx=1e9", nil, false},
+	} {
+		got, err := parseIDOffsets(tt.value)
+		if (err == nil) != tt.ok || (tt.ok && !reflect.DeepEqual(got, tt.want)) {
+			t.Errorf("parseIDOffsets(%q) = %v, %v, want %v (ok %v)", tt.value, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestKeepScoreIDs(t *testing.T) {
+	tables := append([]SourceTable{}, SourceTables...)
+	defer func(c *Config) { cfg, SourceTables, replaysInPlace = c, tables, false }(cfg)
+
+	for _, tt := range []struct {
+		name    string
+		config  Config
+		offsets []int64
+		inPlace bool
+	}{
+		{"in place", Config{KeepScoreIDs: true}, []int64{0, 0, 0}, true},
+		{"zero offsets", Config{KeepScoreIDs: true, IDOffsets: "scores_rx=0"}, []int64{0, 0, 0}, true},
+		{"offset", Config{KeepScoreIDs: true, IDOffsets: "scores_ap=2000000000"}, []int64{0, 0, 2000000000}, false},
+		{"new replays", Config{KeepScoreIDs: true, NewReplays: "/srv/osr"}, []int64{0, 0, 0}, false},
+	} {
+		cfg, SourceTables = &tt.config, append([]SourceTable{}, tables...)
+		if err := keepScoreIDs(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		for i, table := range SourceTables {
+			if !table.KeepIDs || table.IDOffset != tt.offsets[i] || table.MoveKeptReplays == tt.inPlace {
+				t.Errorf("%s: %s keeps ids %v, offset %d, moving replays %v, want offset %d, moving replays %v",
+					tt.name, table.Name, table.KeepIDs, table.IDOffset, table.MoveKeptReplays, tt.offsets[i], !tt.inPlace)
+			}
+		}
+		if replaysInPlace != tt.inPlace {
+			t.Errorf("%s: replaysInPlace = %v, want %v", tt.name, replaysInPlace, tt.inPlace)
+		}
+	}
+}
+
+func TestKeptIDRanges(t *testing.T) {
+	vn := SourceTable{Name: "scores_vn"}
+	rx := SourceTable{Name: "scores_rx"}
+	ap := SourceTable{Name: "scores_ap", IDOffset: 1000}
+
+	a, b := keptRange(vn, 1, 500, false), keptRange(rx, 200, 800, false)
+	if from, to, ok := a.overlap(b); !ok || from != 200 || to != 500 {
+		t.Errorf("overlap() = %d-%d, %v, want 200-500", from, to, ok)
+	}
+	if c := keptRange(ap, 1, 300, false); c.min != 1001 || c.max != 1300 {
+		t.Errorf("keptRange() with an offset = %d-%d, want 1001-1300", c.min, c.max)
+	} else if _, _, ok := a.overlap(c); ok {
+		t.Error("overlap() found ids shared with a table offset past them")
+	}
+
+	// the offset suggested for b puts its ids after a's
+	rx.IDOffset = a.offsetAfter(b)
+	moved := keptRange(rx, 200, 800, false)
+	if _, _, ok := a.overlap(moved); ok || moved.min != a.max+1 {
+		t.Errorf("offsetAfter() = %d, which puts %d-%d after 1-500", rx.IDOffset, moved.min, moved.max)
+	}
+	// also when b already has an offset, which is added to
+	ap.IDOffset = 100
+	c := keptRange(ap, 1, 600, false)
+	ap.IDOffset = a.offsetAfter(c)
+	if c = keptRange(ap, 1, 600, false); c.min != a.max+1 {
+		t.Errorf("offsetAfter() of an offset table = %d, which puts it at %d, want %d", ap.IDOffset, c.min, a.max+1)
+	}
+
+	// ids which don't fit once offset are clamped, rather than wrapping around
+	big := keptRange(SourceTable{Name: "scores_rx", IDOffset: 10}, 1, math.MaxInt64-5, true)
+	if big.max != math.MaxInt64 || !big.tooBig {
+		t.Errorf("keptRange() past the largest id = %d, too big %v, want %d, true", big.max, big.tooBig, int64(math.MaxInt64))
+	}
+}
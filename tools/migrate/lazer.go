@@ -0,0 +1,557 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// osu!lazer keeps its scores & collections in client.realm, realm's own
+// database format, see realm.go. import lazer --realm reads the scores from
+// it, with their replays from the files directory beside it, and with
+// --collections, the collections too, into a stable collection.db, since
+// bancho.py has nowhere to keep them.
+//
+// scores can also be exchanged as .osr files: lazer exports any score as
+// one (from the score's context menu), and imports them by dropping them
+// onto the client. lazer's replays are stable's format, with lazer's own
+// score info (mods by acronym, etc.) appended.
+
+// lazerReplayVersion is the first replay version written by lazer,
+// which has lazer's score info after the score id.
+const lazerReplayVersion = 30000001
+
+// exportReplayVersion is the osu! version written to exported replays,
+// the same as bancho.py's /api/get_replay.
+const exportReplayVersion = 20200207
+
+// legacyMods maps lazer's mod acronyms to stable's mod bits.
+var legacyMods = []struct {
+	acronym string
+	bits    int
+}{
+	{"NF", 1 << 0},
+	{"EZ", 1 << 1},
+	{"TD", 1 << 2},
+	{"HD", 1 << 3},
+	{"HR", 1 << 4},
+	{"SD", 1 << 5},
+	{"DT", 1 << 6},
+	{"RX", 1 << 7},
+	{"HT", 1 << 8},
+	{"NC", 1<<9 | 1<<6}, // nightcore implies double time
+	{"FL", 1 << 10},
+	{"AT", 1 << 11},
+	{"SO", 1 << 12},
+	{"AP", 1 << 13},
+	{"PF", 1<<14 | 1<<5}, // perfect implies sudden death
+	{"4K", 1 << 15},
+	{"5K", 1 << 16},
+	{"6K", 1 << 17},
+	{"7K", 1 << 18},
+	{"8K", 1 << 19},
+	{"FI", 1 << 20},
+	{"RD", 1 << 21},
+	{"CN", 1 << 22},
+	{"TP", 1 << 23},
+	{"9K", 1 << 24},
+	{"DS", 1 << 25}, // dual stages, stable's co-op
+	{"1K", 1 << 26},
+	{"3K", 1 << 27},
+	{"2K", 1 << 28},
+	{"SV2", 1 << 29},
+	{"MR", 1 << 30},
+}
+
+// lazer mods which have no bit in stable, but don't change a score
+// enough to matter. classic is what stable scores are, by definition.
+var ignoredLazerMods = map[string]bool{"CL": true}
+
+// modsFromAcronyms converts lazer's mods to stable's, and returns the
+// acronyms of any which have no stable equivalent.
+func modsFromAcronyms(acronyms []string) (mods int, unsupported []string) {
+next:
+	for _, acronym := range acronyms {
+		acronym = strings.ToUpper(acronym)
+		for _, mod := range legacyMods {
+			if mod.acronym == acronym {
+				mods |= mod.bits
+				continue next
+			}
+		}
+		if !ignoredLazerMods[acronym] {
+			unsupported = append(unsupported, acronym)
+		}
+	}
+	return mods, unsupported
+}
+
+// acronymsFromMods converts stable's mods to lazer's acronyms.
+func acronymsFromMods(mods int) []string {
+	var acronyms []string
+	for _, mod := range legacyMods {
+		// nightcore & perfect are told by their own bit, as it's often set
+		// without the bit of the mod they imply
+		switch {
+		case mod.acronym == "NC" && mods&(1<<9) != 0, mod.acronym == "PF" && mods&(1<<14) != 0:
+		case mods&mod.bits != mod.bits:
+			continue
+		}
+		// and replace the mods they imply
+		if mod.acronym == "DT" && mods&(1<<9) != 0 || mod.acronym == "SD" && mods&(1<<14) != 0 {
+			continue
+		}
+		acronyms = append(acronyms, mod.acronym)
+	}
+	return acronyms
+}
+
+// lazerScoreInfo is the part of lazer's appended score info which matters here.
+type lazerScoreInfo struct {
+	Mods []struct {
+		Acronym string `json:"acronym"`
+	} `json:"mods"`
+}
+
+// parseLazerReplay reads a replay exported by lazer, converting its mods.
+func parseLazerReplay(data []byte) (*Replay, error) {
+	replay, err := parseReplay(data)
+	if err != nil {
+		return nil, err
+	}
+	if !replay.HasHeader {
+		return nil, errors.New("not an .osr file")
+	}
+	if replay.LazerData == nil {
+		// replays from stable, or set on stable & exported by lazer
+		return replay, nil
+	}
+
+	decoded, err := decodeLZMA(replay.LazerData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress lazer's score info: %w", err)
+	}
+	var info lazerScoreInfo
+	if err := json.Unmarshal(decoded, &info); err != nil {
+		return nil, fmt.Errorf("failed to parse lazer's score info: %w", err)
+	}
+
+	acronyms := make([]string, 0, len(info.Mods))
+	for _, mod := range info.Mods {
+		acronyms = append(acronyms, mod.Acronym)
+	}
+	mods, unsupported := modsFromAcronyms(acronyms)
+	if len(unsupported) != 0 {
+		return nil, fmt.Errorf("mods %s have no stable equivalent", strings.Join(unsupported, ", "))
+	}
+	replay.Mods = mods
+	return replay, nil
+}
+
+// lazerReplayScores reads a directory of .osr files exported from lazer,
+// and where each score's replay is, by its ReplayMD5.
+func lazerReplayScores(dir string) ([]Replay, map[string]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var scores []Replay
+	replays := make(map[string]string)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(strings.ToLower(entry.Name()), ".osr") {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		replay, err := parseLazerReplay(data)
+		if err != nil {
+			logger.Warn("skipping replay", "path", path, "err", err)
+			continue
+		}
+
+		// lazer doesn't always fill in the replay md5, which is only used
+		// to match scores to their replays here
+		if replay.ReplayMD5 == "" {
+			replay.ReplayMD5 = path
+		}
+		replay.Frames = nil
+		scores = append(scores, *replay)
+		replays[replay.ReplayMD5] = path
+	}
+	logger.Info("read lazer replays", "scores", len(scores))
+	return scores, replays, nil
+}
+
+// lazerStatistics are a lazer score's hit counts, by lazer's HitResult names.
+type lazerStatistics map[string]int
+
+// count fills in a score's hit counts, which stable counts differently per mode.
+func (s lazerStatistics) count(r *Replay) {
+	switch r.Mode {
+	case 0:
+		r.N300, r.N100, r.N50, r.Nmiss = s["Great"], s["Ok"], s["Meh"], s["Miss"]
+	case 1:
+		r.N300, r.N100, r.Nmiss = s["Great"], s["Ok"], s["Miss"]
+	case 2:
+		// fruits, drops & droplets
+		r.N300, r.N100, r.N50 = s["Great"], s["LargeTickHit"], s["SmallTickHit"]
+		r.Nkatu, r.Nmiss = s["SmallTickMiss"], s["Miss"]+s["LargeTickMiss"]
+	case 3:
+		r.Ngeki, r.N300, r.Nkatu = s["Perfect"], s["Great"], s["Good"]
+		r.N100, r.N50, r.Nmiss = s["Ok"], s["Meh"], s["Miss"]
+	}
+}
+
+// lazerRealmScores reads the scores in lazer's client.realm, and where each
+// one's replay is in lazer's files directory, by its ReplayMD5.
+func lazerRealmScores(realm *Realm, files string) ([]Replay, map[string]string, error) {
+	tables := make(map[string]*RealmTable)
+	for _, name := range []string{"Score", "Ruleset", "Beatmap", "RealmUser", "RealmNamedFileUsage", "File"} {
+		table, err := realm.Table("class_" + name)
+		if err != nil {
+			return nil, nil, err
+		}
+		tables[name] = table
+	}
+	hasLegacyScore := tables["Score"].Has("LegacyTotalScore")
+
+	var scores []Replay
+	replays := make(map[string]string)
+	skipped, withoutReplays := 0, 0
+	for _, o := range tables["Score"].Objects {
+		if o.Bool("DeletePending") {
+			continue
+		}
+
+		// other rulesets' scores, failed ones (ranked F) & ones whose
+		// beatmap is gone can't be imported
+		ruleset, ok := o.Link("Ruleset", tables["Ruleset"])
+		beatmap, hasBeatmap := o.Link("BeatmapInfo", tables["Beatmap"])
+		mode := -1
+		if ok {
+			mode = int(ruleset.Int("OnlineID"))
+		}
+		if mode < 0 || mode > 3 || !hasBeatmap || o.Int("Rank") < 0 {
+			skipped++
+			continue
+		}
+
+		mods, err := modsFromJSON(o.String("Mods"))
+		if err != nil {
+			logger.Warn("skipping score", "key", o.key, "err", err)
+			skipped++
+			continue
+		}
+		var statistics lazerStatistics
+		if err := json.Unmarshal([]byte(o.String("Statistics")), &statistics); err != nil {
+			logger.Warn("skipping score", "key", o.key, "err", fmt.Errorf("failed to parse its statistics: %w", err))
+			skipped++
+			continue
+		}
+
+		replay := Replay{
+			Mode:      mode,
+			MapMD5:    beatmap.String("MD5Hash"),
+			ReplayMD5: fmt.Sprintf("client.realm#%d", o.key),
+			Score:     int(o.Int("TotalScore")),
+			MaxCombo:  int(o.Int("MaxCombo")),
+			Mods:      mods,
+			Timestamp: o.Time("Date"),
+		}
+		// scores set on stable keep their original score, lazer's are standardised
+		if hasLegacyScore {
+			if legacy := o.Int("LegacyTotalScore"); legacy > 0 {
+				replay.Score = int(legacy)
+			}
+		}
+		if user, ok := o.Link("User", tables["RealmUser"]); ok {
+			replay.PlayerName = user.String("Username")
+		}
+		statistics.count(&replay)
+		replay.Perfect = replay.Nmiss == 0 && statistics["LargeTickMiss"] == 0
+		scores = append(scores, replay)
+
+		// a score's only file is its replay
+		found := false
+		for _, usage := range o.Links("Files", tables["RealmNamedFileUsage"]) {
+			file, ok := usage.Link("File", tables["File"])
+			if !ok {
+				continue
+			}
+			hash := file.String("Hash")
+			if len(hash) < 2 {
+				continue
+			}
+			path := filepath.Join(files, hash[:1], hash[:2], hash)
+			if _, err := os.Stat(path); err == nil {
+				replays[replay.ReplayMD5], found = path, true
+				break
+			}
+		}
+		if !found {
+			withoutReplays++
+		}
+	}
+	if realm.err != nil {
+		return nil, nil, realm.err
+	}
+	logger.Info("read lazer's scores", "scores", len(scores), "without_replays", withoutReplays, "skipped", skipped)
+	return scores, replays, nil
+}
+
+// lazerRealmCollections reads the collections in lazer's client.realm.
+func lazerRealmCollections(realm *Realm) ([]Collection, error) {
+	table, err := realm.Table("class_BeatmapCollection")
+	if err != nil {
+		return nil, err
+	}
+	collections := make([]Collection, 0, len(table.Objects))
+	for _, o := range table.Objects {
+		collections = append(collections, Collection{Name: o.String("Name"), MD5s: o.Strings("BeatmapMD5Hashes")})
+	}
+	return collections, realm.err
+}
+
+func runImportLazer() error {
+	switch {
+	case cfg.LazerRealm == "" && cfg.LazerReplays == "":
+		return errors.New("--realm must be lazer's client.realm, or --replays a directory of .osr files exported from lazer")
+	case cfg.LazerRealm != "" && cfg.LazerReplays != "":
+		return errors.New("--realm & --replays can't be used together")
+	case cfg.LazerCollections != "" && cfg.LazerRealm == "":
+		return errors.New("--collections needs --realm, .osr files have no collections")
+	case cfg.ImportOwner == "" && cfg.LazerCollections == "":
+		return errors.New("--owner must be the name or id of the bancho.py user to import scores for")
+	}
+
+	var realm *Realm
+	if cfg.LazerRealm != "" {
+		var err error
+		if realm, err = openRealm(cfg.LazerRealm); err != nil {
+			return fmt.Errorf("failed to read %s: %w", cfg.LazerRealm, err)
+		}
+	}
+	if cfg.LazerCollections != "" {
+		collections, err := lazerRealmCollections(realm)
+		if err != nil {
+			return fmt.Errorf("failed to read the collections: %w", err)
+		}
+		if err := mergeCollections(cfg.LazerCollections, collections); err != nil {
+			return err
+		}
+	}
+	// only the collections were wanted
+	if cfg.ImportOwner == "" {
+		return nil
+	}
+
+	owner, err := findUser(cfg.ImportOwner)
+	if err != nil {
+		return err
+	}
+	if err := setupReplayStores(); err != nil {
+		return err
+	}
+
+	var scores []Replay
+	var replays map[string]string
+	if realm != nil {
+		files := cfg.LazerFiles
+		if files == "" {
+			files = filepath.Join(filepath.Dir(cfg.LazerRealm), "files")
+		}
+		scores, replays, err = lazerRealmScores(realm, files)
+	} else {
+		scores, replays, err = lazerReplayScores(cfg.LazerReplays)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := importOwnedScores(owner, scores, replays); err != nil {
+		return fmt.Errorf("failed to import scores: %w", err)
+	}
+
+	logger.Warn("imported scores have no pp, recalculate them with bancho.py's tools/recalc.py")
+	return nil
+}
+
+type exportScore struct {
+	ID       int64
+	MapMD5   string `db:"map_md5"`
+	Score    int
+	MaxCombo int `db:"max_combo"`
+	Mods     int
+	N300     int
+	N100     int
+	N50      int
+	Nmiss    int
+	Ngeki    int
+	Nkatu    int
+	Mode     int
+	Perfect  bool
+	PlayTime int64 `db:"play_time"`
+	Username string
+	Artist   string
+	Title    string
+	Version  string
+
+	// only selected by export replays, for its manifest
+	UserID int64 `db:"userid"`
+	PP     float64
+	Acc    float64
+	Grade  string
+	Status int
+	MapID  int64 `db:"map_id"`
+	SetID  int64 `db:"set_id"`
+}
+
+// replayMD5 generates a replay's checksum, in the same way as bancho.py.
+func (s exportScore) replayMD5() string {
+	perfect := "False"
+	if s.Perfect {
+		perfect = "True"
+	}
+	sum := md5.Sum([]byte(fmt.Sprintf("%dp%do%do%dt%da%sr%de%sy%so%du%d%dTrue",
+		s.N100+s.N300, s.N50, s.Ngeki, s.Nkatu, s.Nmiss, s.MapMD5,
+		s.MaxCombo, perfect, s.Username, s.Score, 0, s.Mods)))
+	return hex.EncodeToString(sum[:])
+}
+
+// filename names an exported replay the same way as bancho.py, with the
+// score id added so that names are unique.
+func (s exportScore) filename() string {
+	name := fmt.Sprintf("%s - %s - %s [%s] (%s) %d.osr", s.Username, s.Artist, s.Title,
+		s.Version, time.Unix(s.PlayTime, 0).Format("2006-01-02"), s.ID)
+	return strings.NewReplacer("/", "_", "\\", "_", ":", "_", "*", "_", "?", "_",
+		"\"", "_", "<", "_", ">", "_", "|", "_").Replace(name)
+}
+
+// encode builds the score's full .osr file around its replay frames.
+func (s exportScore) encode(frames []byte) []byte {
+	return encodeReplay(&Replay{
+		Mode:       s.Mode % 4,
+		Version:    exportReplayVersion,
+		MapMD5:     s.MapMD5,
+		PlayerName: s.Username,
+		ReplayMD5:  s.replayMD5(),
+		N300:       s.N300,
+		N100:       s.N100,
+		N50:        s.N50,
+		Ngeki:      s.Ngeki,
+		Nkatu:      s.Nkatu,
+		Nmiss:      s.Nmiss,
+		Score:      s.Score,
+		MaxCombo:   s.MaxCombo,
+		Perfect:    s.Perfect,
+		Mods:       s.Mods,
+		Timestamp:  time.Unix(s.PlayTime, 0),
+		ScoreID:    s.ID,
+		Frames:     frames,
+	})
+}
+
+func runExportLazer() error {
+	if cfg.ExportUser == "" {
+		return errors.New("--user must be the name or id of the bancho.py user to export")
+	}
+	if cfg.ExportDirectory == "" {
+		return errors.New("--out must be the directory to export replays to")
+	}
+
+	user, err := findUser(cfg.ExportUser)
+	if err != nil {
+		return err
+	}
+	if err := setupReplayStores(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cfg.ExportDirectory, 0755); err != nil {
+		return err
+	}
+
+	var scores []exportScore
+	err = DB.Select(&scores, `
+	SELECT s.id, s.map_md5, s.score, s.max_combo, s.mods, s.n300, s.n100, s.n50,
+	s.nmiss, s.ngeki, s.nkatu, s.mode, s.perfect, UNIX_TIMESTAMP(s.play_time) AS play_time,
+	u.name AS username, COALESCE(m.artist, '') AS artist,
+	COALESCE(m.title, s.map_md5) AS title, COALESCE(m.version, '') AS version
+	FROM scores s JOIN users u ON u.id = s.userid
+	LEFT JOIN maps m ON m.md5 = s.map_md5
+	WHERE s.userid = ? AND s.status != 0
+	ORDER BY s.id`, user)
+	if err != nil {
+		return err
+	}
+
+	exported, missing := 0, 0
+	for _, s := range scores {
+		// lazer can't import a score without its replay
+		in, err := newReplays.Open(replayKey(s.ID))
+		if errors.Is(err, os.ErrNotExist) {
+			missing++
+			continue
+		} else if err != nil {
+			return err
+		}
+		frames, err := io.ReadAll(in)
+		in.Close()
+		if err != nil {
+			return err
+		}
+
+		data := s.encode(frames)
+
+		path := filepath.Join(cfg.ExportDirectory, s.filename())
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			return err
+		}
+		logger.Debug("exported score", "id", s.ID, "mods", strings.Join(acronymsFromMods(s.Mods), ""), "path", path)
+		exported++
+	}
+
+	logger.Info("exported scores", "exported", exported, "without_replays", missing, "path", cfg.ExportDirectory)
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:              "import lazer",
+		Summary:           "import scores from osu!lazer's client.realm, or exported as .osr files",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.LazerRealm, "realm", "", "lazer's client.realm, to import its scores from")
+			flags.StringVar(&c.LazerFiles, "files", "", "lazer's files directory, with the scores' replays (default: beside --realm)")
+			flags.StringVar(&c.LazerCollections, "collections", "", "collection.db to add lazer's collections to, with --realm")
+			flags.StringVar(&c.LazerReplays, "replays", "", "directory of .osr files exported from lazer")
+			flags.StringVar(&c.ImportOwner, "owner", "", "name or id of the bancho.py user who will own the scores")
+			flags.StringVar(&c.NewReplays, "new-replays", "", "where imported replays are written, a path or s3://bucket/prefix (default: DATA_DIRECTORY/osr)")
+		},
+		Run: runImportLazer,
+	})
+
+	registerCommand(&Command{
+		Name:              "export lazer",
+		Summary:           "export a user's scores as .osr files, for importing into osu!lazer",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.ExportUser, "user", "", "name or id of the bancho.py user to export")
+			flags.StringVar(&c.ExportDirectory, "out", "", "directory to write the .osr files to")
+			flags.StringVar(&c.NewReplays, "new-replays", "", "where bancho.py's replays are, a path or s3://bucket/prefix (default: DATA_DIRECTORY/osr)")
+		},
+		Run: runExportLazer,
+	})
+}
@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+import "errors"
+
+var errUnsupported = errors.New("not supported on this platform")
+
+func diskFree(path string) (uint64, error) {
+	return 0, errUnsupported
+}
+
+func openFileLimit() (uint64, error) {
+	return 0, errUnsupported
+}
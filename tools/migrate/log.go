@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// logger is used for everything the tools report while working; reports
+// which are the actual output of a command are printed directly instead.
+var logger = slog.New(slog.NewTextHandler(stderr, nil))
+
+// maxSummaryRecords caps how many warnings/errors are kept for the summary.
+const maxSummaryRecords = 100_000
+
+// summaryHandler passes records through to another handler, while keeping
+// a copy of every warning & error so they can be written out at the end
+// of a long run, rather than having to be dug out of hours of output.
+type summaryHandler struct {
+	slog.Handler
+	json    slog.Handler // formats records into the summary, with the same attrs
+	summary *logSummary
+}
+
+type logSummary struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	kept    int
+	dropped int
+	counts  map[slog.Level]int
+}
+
+func (h *summaryHandler) Handle(ctx context.Context, record slog.Record) error {
+	if record.Level >= slog.LevelWarn {
+		h.summary.mu.Lock()
+		h.summary.counts[record.Level]++
+		if h.summary.kept < maxSummaryRecords {
+			h.summary.kept++
+			_ = h.json.Handle(ctx, record)
+		} else {
+			h.summary.dropped++
+		}
+		h.summary.mu.Unlock()
+		if h.Handler.Enabled(ctx, record.Level) {
+			stderr.feed(record)
+		}
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *summaryHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &summaryHandler{h.Handler.WithAttrs(attrs), h.json.WithAttrs(attrs), h.summary}
+}
+
+func (h *summaryHandler) WithGroup(name string) slog.Handler {
+	return &summaryHandler{h.Handler.WithGroup(name), h.json.WithGroup(name), h.summary}
+}
+
+var logWarnings *logSummary
+
+// setupLogging configures the logger from the --log-* flags.
+func setupLogging(level, format string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("unknown log level %q, expected debug, info, warn or error", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(stderr, opts)
+	default:
+		return fmt.Errorf("unknown log format %q, expected text or json", format)
+	}
+
+	logWarnings = &logSummary{counts: make(map[slog.Level]int)}
+	json := slog.NewJSONHandler(&logWarnings.buf, nil)
+	logger = slog.New(&summaryHandler{handler, json, logWarnings})
+	return nil
+}
+
+// logged is how many warnings & errors have been logged.
+func (s *logSummary) logged() (warnings, errors int) {
+	if s == nil {
+		return 0, 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counts[slog.LevelWarn], s.counts[slog.LevelError]
+}
+
+// writeLogSummary writes every warning & error logged during the run to
+// path, and mentions how many there were.
+func writeLogSummary(path string) error {
+	if logWarnings == nil {
+		return nil
+	}
+
+	s := logWarnings
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	warnings, errors := s.counts[slog.LevelWarn], s.counts[slog.LevelError]
+	if warnings+errors != 0 {
+		fmt.Fprintf(os.Stderr, "%d warnings and %d errors were logged", warnings, errors)
+		if path != "" {
+			fmt.Fprintf(os.Stderr, ", see %s", path)
+		}
+		fmt.Fprintln(os.Stderr)
+	}
+
+	if path == "" {
+		return nil
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, &s.buf); err != nil {
+		return err
+	}
+	if s.dropped != 0 {
+		fmt.Fprintf(f, `{"level":"WARN","msg":"summary truncated","dropped":%d}`+"\n", s.dropped)
+	}
+	return nil
+}
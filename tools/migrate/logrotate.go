@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// logs rotate moves the logs table's rows older than --older-than days into
+// gzipped json lines files, in a directory or object storage (s3://, b2://
+// or sftp://, as with backup), as bancho.py never removes them. each file is
+// only deleted from once it's fully written, a few rows at a time with a
+// pause in between, so replicas keep up with the deletes. with --chat-log,
+// the lines of bancho.py's chat log (DATA_DIRECTORY/logs/chat.log) older
+// than the cutoff are moved out the same way.
+//
+// a file's rows are all deleted before ctrl-c stops the rotation, so a row
+// is only ever in one file, unless it's killed while deleting them.
+
+// chat log lines start with "[31/01/2024 09:15:02PM]", in utc
+const chatLogTimeLayout = "02/01/2006 03:04:05PM"
+
+var select_log_ids = `
+SELECT id FROM logs WHERE time < ? AND id > ?
+ORDER BY id LIMIT ?`
+
+// logFileName names a file of logs by its range of ids, so that files sort
+// in id order.
+func logFileName(first, last int64) string {
+	return fmt.Sprintf("logs-%012d-%012d.jsonl.gz", first, last)
+}
+
+// writeLogFile writes logs as gzipped json lines, only visible at the
+// destination once they're all written.
+func writeLogFile(dest BackupDestination, name string, ids []int64) error {
+	query, args, err := sqlx.In("SELECT * FROM logs WHERE id IN (?) ORDER BY id", ids)
+	if err != nil {
+		return err
+	}
+	rows, err := DB.Queryx(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns, err := rows.ColumnTypes()
+	if err != nil {
+		return err
+	}
+
+	upload, err := dest.Create(name, map[string]string{"type": "logs"})
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(upload)
+	enc := json.NewEncoder(gz)
+	n := 0
+	for rows.Next() {
+		values, err := rows.SliceScan()
+		if err != nil {
+			upload.Abort()
+			return err
+		}
+		record := make(map[string]interface{}, len(values))
+		for i, v := range values {
+			if t, ok := v.(time.Time); ok {
+				v = t.Format(time.DateTime)
+			}
+			record[columns[i].Name()] = jsonValue(v, columns[i])
+		}
+		if err := enc.Encode(record); err != nil {
+			upload.Abort()
+			return err
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		upload.Abort()
+		return err
+	}
+	if n != len(ids) {
+		upload.Abort()
+		return fmt.Errorf("expected %d logs, but read %d", len(ids), n)
+	}
+	if err := gz.Close(); err != nil {
+		upload.Abort()
+		return err
+	}
+	return upload.Commit()
+}
+
+// deleteLogs deletes logs a few at a time, pausing between deletes.
+func deleteLogs(ids []int64) error {
+	for start := 0; start < len(ids); start += cfg.LogsDeleteBatch {
+		end := min(start+cfg.LogsDeleteBatch, len(ids))
+		if err := throttle(end - start); err != nil {
+			return err
+		}
+		query, args, err := sqlx.In("DELETE FROM logs WHERE id IN (?)", ids[start:end])
+		if err != nil {
+			return err
+		}
+		if _, err := DB.Exec(query, args...); err != nil {
+			return err
+		}
+		if end < len(ids) {
+			time.Sleep(cfg.LogsPause)
+		}
+	}
+	return nil
+}
+
+// rotateLogsTable moves the logs before cutoff out, a file at a time.
+func rotateLogsTable(dest BackupDestination, cutoff time.Time) (int64, int, error) {
+	var rotated, lastID int64
+	var files int
+	for !isInterrupted() {
+		var ids []int64
+		if err := DB.Select(&ids, select_log_ids, cutoff, lastID, cfg.LogsFileRows); err != nil {
+			return rotated, files, err
+		}
+		if len(ids) == 0 {
+			return rotated, files, nil
+		}
+		name := logFileName(ids[0], ids[len(ids)-1])
+		if err := writeLogFile(dest, name, ids); err != nil {
+			return rotated, files, fmt.Errorf("failed to write %s: %w", dest.Location(name), err)
+		}
+		if err := deleteLogs(ids); err != nil {
+			return rotated, files, fmt.Errorf("failed to delete the logs in %s, which can be deleted by running this again: %w", name, err)
+		}
+		rotated += int64(len(ids))
+		files++
+		lastID = ids[len(ids)-1]
+		logger.Debug("rotated logs", "file", dest.Location(name), "logs", len(ids), "rotated", rotated)
+	}
+	return rotated, files, errInterrupted
+}
+
+// splitChatLog finds where the chat log's lines reach cutoff. lines are in
+// the order they were written, and those without a time (e.g. the rest of
+// a message with a newline in it) go with the line before them.
+func splitChatLog(data []byte, cutoff time.Time) (int, string, string) {
+	var first, last string
+	offset := 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if end := strings.Index(line, "]"); strings.HasPrefix(line, "[") && end > 0 {
+			if t, err := time.Parse(chatLogTimeLayout, line[1:end]); err == nil {
+				if !t.Before(cutoff) {
+					break
+				}
+				if first == "" {
+					first = t.Format("20060102T150405")
+				}
+				last = t.Format("20060102T150405")
+			}
+		}
+		offset += len(line) + 1
+	}
+	return min(offset, len(data)), first, last
+}
+
+// rotateChatLog moves the chat log's lines before cutoff out. bancho.py
+// appends to it while running, so whatever it appends meanwhile is kept.
+func rotateChatLog(dest BackupDestination, cutoff time.Time, dryRun bool) (int, error) {
+	path := filepath.Join(cfg.DataDirectory, "logs", "chat.log")
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	split, first, last := splitChatLog(data, cutoff)
+	if split == 0 {
+		return 0, nil
+	}
+	lines := bytes.Count(data[:split], []byte("\n"))
+	if dryRun {
+		return lines, nil
+	}
+
+	name := fmt.Sprintf("chat-%s-%s.log.gz", first, last)
+	upload, err := dest.Create(name, map[string]string{"type": "chat-log"})
+	if err != nil {
+		return 0, err
+	}
+	gz := gzip.NewWriter(upload)
+	if _, err := gz.Write(data[:split]); err != nil {
+		upload.Abort()
+		return 0, err
+	}
+	if err := gz.Close(); err != nil {
+		upload.Abort()
+		return 0, err
+	}
+	if err := upload.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to write %s: %w", dest.Location(name), err)
+	}
+
+	// the lines appended since it was read are kept too
+	current, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	if !bytes.HasPrefix(current, data) {
+		return 0, errors.New("the chat log was replaced while being rotated, its old lines are archived but kept")
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, current[split:], info.Mode()); err != nil {
+		return 0, err
+	}
+	return lines, os.Rename(tmp, path)
+}
+
+func runLogsRotate() error {
+	if cfg.LogsOlderThan < 1 {
+		return errors.New("--older-than must be at least a day")
+	}
+	if cfg.LogsFileRows < 1 || cfg.LogsDeleteBatch < 1 {
+		return errors.New("--file-rows and --delete-batch must be at least 1")
+	}
+	if cfg.LogsDestination == "" {
+		cfg.LogsDestination = filepath.Join(cfg.DataDirectory, "archive", "logs")
+	}
+	dest, err := openBackupDestination(cfg.LogsDestination)
+	if err != nil {
+		return err
+	}
+	// logs.time is the server's wall clock, the chat log's is utc
+	before := time.Now().AddDate(0, 0, -cfg.LogsOlderThan)
+	cutoff := wallClock(before)
+
+	var total int64
+	if err := DB.Get(&total, "SELECT COUNT(*) FROM logs WHERE time < ?", cutoff); err != nil {
+		return err
+	}
+	logger.Info("found logs to rotate", "logs", total, "before", cutoff.Format(time.DateOnly), "to", cfg.LogsDestination)
+	if cfg.RotateChatLog {
+		lines, err := rotateChatLog(dest, before.UTC(), true)
+		if err != nil {
+			return err
+		}
+		logger.Info("found chat log lines to rotate", "lines", lines)
+	}
+	if cfg.DryRun {
+		return nil
+	}
+
+	handleSignals()
+	start := time.Now()
+	rotated, files, err := rotateLogsTable(dest, cutoff)
+	if err == errInterrupted {
+		logger.Info("interrupted, the rest can be rotated by running this again", "logs", rotated, "files", files)
+		return err
+	} else if err != nil {
+		return err
+	}
+	if cfg.RotateChatLog {
+		lines, err := rotateChatLog(dest, before.UTC(), false)
+		if err != nil {
+			return fmt.Errorf("failed to rotate the chat log: %w", err)
+		}
+		logger.Info("rotated the chat log", "lines", lines)
+	}
+
+	logger.Info("rotated logs", "logs", rotated, "files", files, "to", cfg.LogsDestination,
+		"elapsed", time.Since(start).Round(time.Second))
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:              "logs rotate",
+		Summary:           "move old rows of the logs table (and the chat log) into gzipped json files, locally or in object storage",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.IntVar(&c.LogsOlderThan, "older-than", 90, "rotate logs written more than this many days ago")
+			flags.StringVar(&c.LogsDestination, "dir", "", "where the files are written: a directory, s3://bucket/prefix, b2://bucket/prefix or sftp://user@host/path (default: DATA_DIRECTORY/archive/logs)")
+			flags.IntVar(&c.LogsFileRows, "file-rows", 100000, "logs per file")
+			flags.IntVar(&c.LogsDeleteBatch, "delete-batch", 1000, "logs deleted per statement, smaller batches keep replication lag down")
+			flags.DurationVar(&c.LogsPause, "pause", 100*time.Millisecond, "pause between deletes, so replicas can keep up")
+			flags.BoolVar(&c.RotateChatLog, "chat-log", false, "also rotate the chat log's old lines, DATA_DIRECTORY/logs/chat.log")
+			flags.IntVar(&c.MaxRetries, "max-retries", 5, "times to retry an upload part")
+			flags.BoolVar(&c.DryRun, "dry-run", false, "count the logs which would be rotated, without rotating them")
+		},
+		Run: runLogsRotate,
+	})
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// a minimal lzma ("lzma alone") decoder, following the reference decoder
+// in the lzma sdk (LzmaSpec.cpp). osu! compresses replay frames with it,
+// and fully decoding a replay is the only reliable way to tell whether
+// it's intact, so it's worth the few hundred lines over a dependency.
+
+var (
+	errLZMACorrupt   = errors.New("lzma data is corrupt")
+	errLZMATruncated = errors.New("lzma data is truncated")
+)
+
+// maxLZMAOutput bounds how much a single replay may decompress to,
+// so a corrupt size header can't exhaust memory. real replays are
+// a few megabytes at most.
+const maxLZMAOutput = 256 << 20
+
+const (
+	lzmaNumBitModelTotalBits = 11
+	lzmaBitModelTotal        = 1 << lzmaNumBitModelTotalBits
+	lzmaNumMoveBits          = 5
+	lzmaProbInit             = lzmaBitModelTotal / 2
+
+	lzmaNumStates          = 12
+	lzmaNumPosBitsMax      = 4
+	lzmaNumLenToPosStates  = 4
+	lzmaNumAlignBits       = 4
+	lzmaStartPosModelIndex = 4
+	lzmaEndPosModelIndex   = 14
+	lzmaNumFullDistances   = 1 << (lzmaEndPosModelIndex >> 1)
+	lzmaMatchMinLen        = 2
+)
+
+type rangeDecoder struct {
+	data      []byte
+	pos       int
+	rng       uint32
+	code      uint32
+	corrupt   bool
+	truncated bool
+}
+
+func (rc *rangeDecoder) next() uint32 {
+	if rc.pos >= len(rc.data) {
+		rc.truncated = true
+		return 0
+	}
+	b := rc.data[rc.pos]
+	rc.pos++
+	return uint32(b)
+}
+
+func (rc *rangeDecoder) init() {
+	rc.rng = 0xFFFFFFFF
+	if rc.next() != 0 {
+		rc.corrupt = true
+	}
+	for i := 0; i < 4; i++ {
+		rc.code = rc.code<<8 | rc.next()
+	}
+	if rc.code == rc.rng {
+		rc.corrupt = true
+	}
+}
+
+func (rc *rangeDecoder) finishedOK() bool {
+	return rc.code == 0
+}
+
+func (rc *rangeDecoder) normalize() {
+	if rc.rng < 1<<24 {
+		rc.rng <<= 8
+		rc.code = rc.code<<8 | rc.next()
+	}
+}
+
+func (rc *rangeDecoder) decodeDirectBits(numBits int) uint32 {
+	var res uint32
+	for ; numBits > 0; numBits-- {
+		rc.rng >>= 1
+		rc.code -= rc.rng
+		t := 0 - (rc.code >> 31)
+		rc.code += rc.rng & t
+		if rc.code == rc.rng {
+			rc.corrupt = true
+		}
+		rc.normalize()
+		res = res<<1 + t + 1
+	}
+	return res
+}
+
+func (rc *rangeDecoder) decodeBit(prob *uint16) uint32 {
+	v := uint32(*prob)
+	bound := (rc.rng >> lzmaNumBitModelTotalBits) * v
+	var symbol uint32
+	if rc.code < bound {
+		v += (lzmaBitModelTotal - v) >> lzmaNumMoveBits
+		rc.rng = bound
+	} else {
+		v -= v >> lzmaNumMoveBits
+		rc.code -= bound
+		rc.rng -= bound
+		symbol = 1
+	}
+	*prob = uint16(v)
+	rc.normalize()
+	return symbol
+}
+
+func (rc *rangeDecoder) bitTree(probs []uint16, numBits int) uint32 {
+	m := uint32(1)
+	for i := 0; i < numBits; i++ {
+		m = m<<1 + rc.decodeBit(&probs[m])
+	}
+	return m - (1 << numBits)
+}
+
+func (rc *rangeDecoder) bitTreeReverse(probs []uint16, numBits int) uint32 {
+	m := uint32(1)
+	var symbol uint32
+	for i := 0; i < numBits; i++ {
+		bit := rc.decodeBit(&probs[m])
+		m = m<<1 + bit
+		symbol |= bit << i
+	}
+	return symbol
+}
+
+func newProbs(n int) []uint16 {
+	probs := make([]uint16, n)
+	for i := range probs {
+		probs[i] = lzmaProbInit
+	}
+	return probs
+}
+
+type lenDecoder struct {
+	choice  uint16
+	choice2 uint16
+	low     []uint16 // [1 << lzmaNumPosBitsMax][1 << 3]
+	mid     []uint16 // [1 << lzmaNumPosBitsMax][1 << 3]
+	high    []uint16 // [1 << 8]
+}
+
+func newLenDecoder() *lenDecoder {
+	return &lenDecoder{
+		choice:  lzmaProbInit,
+		choice2: lzmaProbInit,
+		low:     newProbs(1 << lzmaNumPosBitsMax << 3),
+		mid:     newProbs(1 << lzmaNumPosBitsMax << 3),
+		high:    newProbs(1 << 8),
+	}
+}
+
+func (ld *lenDecoder) decode(rc *rangeDecoder, posState uint32) uint32 {
+	if rc.decodeBit(&ld.choice) == 0 {
+		return rc.bitTree(ld.low[posState<<3:], 3)
+	}
+	if rc.decodeBit(&ld.choice2) == 0 {
+		return 8 + rc.bitTree(ld.mid[posState<<3:], 3)
+	}
+	return 16 + rc.bitTree(ld.high, 8)
+}
+
+// decodeLZMA decompresses an lzma alone stream: 5 bytes of properties,
+// the uncompressed size as an int64 (or -1 when the stream ends with an
+// end marker), then the range coded data.
+func decodeLZMA(data []byte) ([]byte, error) {
+	if len(data) < 13 {
+		return nil, errLZMATruncated
+	}
+
+	d := uint32(data[0])
+	if d >= 9*5*5 {
+		return nil, fmt.Errorf("%w: bad properties byte %#x", errLZMACorrupt, d)
+	}
+	lc, lp, pb := d%9, (d/9)%5, d/45
+	dictSize := binary.LittleEndian.Uint32(data[1:5])
+	if dictSize < 1<<12 {
+		dictSize = 1 << 12
+	}
+
+	unpackSize := binary.LittleEndian.Uint64(data[5:13])
+	sizeDefined := unpackSize != ^uint64(0)
+	if sizeDefined && unpackSize > maxLZMAOutput {
+		return nil, fmt.Errorf("%w: implausible uncompressed size %d", errLZMACorrupt, unpackSize)
+	}
+
+	rc := &rangeDecoder{data: data[13:]}
+	rc.init()
+	if rc.corrupt {
+		return nil, errLZMACorrupt
+	}
+
+	var out []byte
+	if sizeDefined {
+		out = make([]byte, 0, unpackSize)
+	}
+
+	literals := newProbs(0x300 << (lc + lp))
+	posSlot := newProbs(lzmaNumLenToPosStates << 6)
+	posDecoders := newProbs(1 + lzmaNumFullDistances - lzmaEndPosModelIndex)
+	align := newProbs(1 << lzmaNumAlignBits)
+	isMatch := newProbs(lzmaNumStates << lzmaNumPosBitsMax)
+	isRep := newProbs(lzmaNumStates)
+	isRepG0 := newProbs(lzmaNumStates)
+	isRepG1 := newProbs(lzmaNumStates)
+	isRepG2 := newProbs(lzmaNumStates)
+	isRep0Long := newProbs(lzmaNumStates << lzmaNumPosBitsMax)
+	lens := newLenDecoder()
+	repLens := newLenDecoder()
+
+	decodeDistance := func(length uint32) uint32 {
+		lenState := length
+		if lenState > lzmaNumLenToPosStates-1 {
+			lenState = lzmaNumLenToPosStates - 1
+		}
+
+		slot := rc.bitTree(posSlot[lenState<<6:], 6)
+		if slot < 4 {
+			return slot
+		}
+
+		numDirectBits := int(slot>>1) - 1
+		dist := (2 | slot&1) << numDirectBits
+		if slot < lzmaEndPosModelIndex {
+			dist += rc.bitTreeReverse(posDecoders[dist-slot:], numDirectBits)
+		} else {
+			dist += rc.decodeDirectBits(numDirectBits-lzmaNumAlignBits) << lzmaNumAlignBits
+			dist += rc.bitTreeReverse(align, lzmaNumAlignBits)
+		}
+		return dist
+	}
+
+	var rep0, rep1, rep2, rep3 uint32
+	var state uint32
+	remaining := unpackSize
+
+	for {
+		if rc.truncated {
+			return nil, errLZMATruncated
+		}
+		if rc.corrupt {
+			return nil, errLZMACorrupt
+		}
+		if len(out) > maxLZMAOutput {
+			return nil, fmt.Errorf("%w: decompresses to over %d bytes", errLZMACorrupt, maxLZMAOutput)
+		}
+
+		if sizeDefined && remaining == 0 && rc.finishedOK() {
+			return out, nil
+		}
+
+		posState := uint32(len(out)) & (1<<pb - 1)
+
+		if rc.decodeBit(&isMatch[state<<lzmaNumPosBitsMax+posState]) == 0 {
+			if sizeDefined && remaining == 0 {
+				return nil, errLZMACorrupt
+			}
+
+			// literal
+			var prevByte uint32
+			if len(out) > 0 {
+				prevByte = uint32(out[len(out)-1])
+			}
+			litState := (uint32(len(out))&(1<<lp-1))<<lc + prevByte>>(8-lc)
+			probs := literals[0x300*litState:]
+
+			symbol := uint32(1)
+			if state >= 7 {
+				matchByte := uint32(out[len(out)-int(rep0)-1])
+				for symbol < 0x100 {
+					matchBit := (matchByte >> 7) & 1
+					matchByte <<= 1
+					bit := rc.decodeBit(&probs[((1+matchBit)<<8)+symbol])
+					symbol = symbol<<1 | bit
+					if matchBit != bit {
+						break
+					}
+				}
+			}
+			for symbol < 0x100 {
+				symbol = symbol<<1 | rc.decodeBit(&probs[symbol])
+			}
+			out = append(out, byte(symbol-0x100))
+			remaining--
+
+			switch {
+			case state < 4:
+				state = 0
+			case state < 10:
+				state -= 3
+			default:
+				state -= 6
+			}
+			continue
+		}
+
+		var length uint32
+		if rc.decodeBit(&isRep[state]) != 0 {
+			if sizeDefined && remaining == 0 || len(out) == 0 {
+				return nil, errLZMACorrupt
+			}
+
+			if rc.decodeBit(&isRepG0[state]) == 0 {
+				if rc.decodeBit(&isRep0Long[state<<lzmaNumPosBitsMax+posState]) == 0 {
+					// short rep, a single byte at rep0
+					if state < 7 {
+						state = 9
+					} else {
+						state = 11
+					}
+					out = append(out, out[len(out)-int(rep0)-1])
+					remaining--
+					continue
+				}
+			} else {
+				var dist uint32
+				if rc.decodeBit(&isRepG1[state]) == 0 {
+					dist = rep1
+				} else {
+					if rc.decodeBit(&isRepG2[state]) == 0 {
+						dist = rep2
+					} else {
+						dist = rep3
+						rep3 = rep2
+					}
+					rep2 = rep1
+				}
+				rep1 = rep0
+				rep0 = dist
+			}
+
+			length = repLens.decode(rc, posState)
+			if state < 7 {
+				state = 8
+			} else {
+				state = 11
+			}
+		} else {
+			rep3, rep2, rep1 = rep2, rep1, rep0
+			length = lens.decode(rc, posState)
+			if state < 7 {
+				state = 7
+			} else {
+				state = 10
+			}
+
+			rep0 = decodeDistance(length)
+			if rep0 == 0xFFFFFFFF {
+				// end marker
+				if rc.truncated {
+					return nil, errLZMATruncated
+				}
+				if !rc.finishedOK() || sizeDefined && remaining != 0 {
+					return nil, errLZMACorrupt
+				}
+				return out, nil
+			}
+			if sizeDefined && remaining == 0 || rep0 >= dictSize || int(rep0) >= len(out) {
+				return nil, errLZMACorrupt
+			}
+		}
+
+		length += lzmaMatchMinLen
+		if sizeDefined && remaining < uint64(length) {
+			return nil, errLZMACorrupt
+		}
+		for i := uint32(0); i < length; i++ {
+			out = append(out, out[len(out)-int(rep0)-1])
+		}
+		remaining -= uint64(length)
+	}
+}
+
+// rangeEncoder is the encoding side of rangeDecoder, as in the lzma sdk's
+// LzmaEnc.c.
+type rangeEncoder struct {
+	out       []byte
+	low       uint64
+	rng       uint32
+	cache     byte
+	cacheSize int
+}
+
+func (rc *rangeEncoder) shiftLow() {
+	if uint32(rc.low) < 0xFF000000 || rc.low>>32 != 0 {
+		carry := byte(rc.low >> 32)
+		temp := rc.cache
+		for ; rc.cacheSize > 0; rc.cacheSize-- {
+			rc.out = append(rc.out, temp+carry)
+			temp = 0xFF
+		}
+		rc.cache = byte(rc.low >> 24)
+	}
+	rc.cacheSize++
+	rc.low = uint64(uint32(rc.low) << 8)
+}
+
+func (rc *rangeEncoder) encodeBit(prob *uint16, bit uint32) {
+	v := uint32(*prob)
+	bound := (rc.rng >> lzmaNumBitModelTotalBits) * v
+	if bit == 0 {
+		rc.rng = bound
+		v += (lzmaBitModelTotal - v) >> lzmaNumMoveBits
+	} else {
+		rc.low += uint64(bound)
+		rc.rng -= bound
+		v -= v >> lzmaNumMoveBits
+	}
+	*prob = uint16(v)
+	for rc.rng < 1<<24 {
+		rc.rng <<= 8
+		rc.shiftLow()
+	}
+}
+
+// encodeLZMALiterals compresses data as an lzma stream of literals only,
+// which any decoder reads, but which is only about half the size. it's
+// good enough for generated replays (see seed.go), not for real ones.
+func encodeLZMALiterals(data []byte) []byte {
+	const lc, lp, pb = 3, 0, 2
+	header := make([]byte, 13)
+	header[0] = byte((pb*5+lp)*9 + lc)
+	binary.LittleEndian.PutUint32(header[1:5], 1<<16)
+	binary.LittleEndian.PutUint64(header[5:13], uint64(len(data)))
+
+	rc := &rangeEncoder{out: header, rng: 0xFFFFFFFF, cacheSize: 1}
+	literals := newProbs(0x300 << (lc + lp))
+	isMatch := newProbs(lzmaNumStates << lzmaNumPosBitsMax)
+
+	// with only literals, the state is always 0
+	var prevByte uint32
+	for i, b := range data {
+		posState := uint32(i) & (1<<pb - 1)
+		rc.encodeBit(&isMatch[posState], 0)
+
+		probs := literals[0x300*(prevByte>>(8-lc)):]
+		symbol := uint32(b) | 0x100
+		for m := uint32(1); m < 0x100; {
+			bit := (symbol >> 7) & 1
+			symbol <<= 1
+			rc.encodeBit(&probs[m], bit)
+			m = m<<1 | bit
+		}
+		prevByte = uint32(b)
+	}
+	for i := 0; i < 5; i++ {
+		rc.shiftLow()
+	}
+	return rc.out
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func TestLZMARoundTrip(t *testing.T) {
+	random := make([]byte, 5000)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	for _, tt := range []struct {
+		name string
+		data []byte
+	}{
+		{"empty", []byte{}},
+		{"one byte", []byte{0}},
+		{"frames", []byte("-1|256|-500|0,16|256.5|192|1,-12345|0|0|0,")},
+		{"repeated", bytes.Repeat([]byte("16|0|0|0,"), 10000)},
+		{"random", random},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeLZMA(encodeLZMALiterals(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.data) {
+				t.Errorf("decodeLZMA(encodeLZMALiterals()) = %d bytes, want the %d given", len(got), len(tt.data))
+			}
+		})
+	}
+}
+
+func TestDecodeLZMA(t *testing.T) {
+	// testdata/frames.lzma is from python's lzma module, so it has matches
+	// as well as literals, an unknown size, and an end marker
+	got, err := decodeLZMA(readTestdata(t, "frames.lzma"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, readTestdata(t, "frames.txt")) {
+		t.Error("decodeLZMA(frames.lzma) doesn't match testdata/frames.txt")
+	}
+}
+
+func TestDecodeLZMACorrupt(t *testing.T) {
+	valid := readTestdata(t, "frames.lzma")
+
+	badProperties := bytes.Clone(valid)
+	badProperties[0] = 225
+
+	tooBig := bytes.Clone(valid)
+	binary.LittleEndian.PutUint64(tooBig[5:13], maxLZMAOutput+1)
+
+	// the stream's size is given, but longer than its data
+	longer := encodeLZMALiterals([]byte("16|0|0|0,"))
+	binary.LittleEndian.PutUint64(longer[5:13], 1000)
+
+	for _, tt := range []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty", nil, errLZMATruncated},
+		{"header only", valid[:13], errLZMATruncated},
+		{"bad properties", badProperties, errLZMACorrupt},
+		{"too big", tooBig, errLZMACorrupt},
+		{"truncated", valid[:len(valid)/2], errLZMATruncated},
+		{"longer than its data", longer, errLZMATruncated},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeLZMA(tt.data); !errors.Is(err, tt.want) {
+				t.Errorf("decodeLZMA() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
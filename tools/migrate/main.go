@@ -0,0 +1,180 @@
+package main
+
+import (
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+/// MIGRATION TOOL INSTRUCTIONS ///
+// first install golang from https://go.dev/doc/install
+
+// next, build the tool
+// $ go build -o migrate .
+
+// next, configure the tool. it reads the same settings as bancho.py's
+// .env file (DB_USER, DB_PASS, DB_NAME, DB_HOST, DB_PORT, DATA_DIRECTORY),
+// which can be given as a config file, as environment variables, or as
+// command-line flags, in increasing order of precedence.
+// $ ./migrate help
+
+// then, check which migrations your database still needs, and apply them.
+// each migration is recorded in the schema_version table once it's done,
+// so running `up` again is always safe.
+// NOTE: you may want to back up your database and .data/osr folder
+//       before migrating, just in case there are any issues.
+// $ ./migrate status --config /home/user/bancho.py/.env
+// $ ./migrate up --config /home/user/bancho.py/.env
+
+// to audit the pending migrations beforehand, run them with --dry-run.
+// nothing will be created, inserted, moved or dropped.
+// $ ./migrate up --config /home/user/bancho.py/.env --dry-run
+
+// if a migration is interrupted (crash, network issue, power loss),
+// simply run it again with --resume to continue where it left off.
+// $ ./migrate up --config /home/user/bancho.py/.env --resume
+
+// once a migration has finished, cross-check its results. the report is
+// written as json to the given path, and the exit code is non-zero on mismatch.
+// $ ./migrate verify --config /home/user/bancho.py/.env --report verify.json
+
+// if something went wrong, the latest migration can be undone.
+// $ ./migrate down --config /home/user/bancho.py/.env
+
+// every other command (imports, checks, recalculations, backups etc) is
+// described in README.md, and `./migrate <command> --help` lists its flags.
+
+var DB *sqlx.DB
+var cfg *Config
+
+// Command is a subcommand of the migrate binary.
+type Command struct {
+	Name              string // may contain spaces for nested commands, e.g. "recalc stats"
+	Summary           string
+	UsesDataDirectory bool
+	ConnectsItself    bool // rather than before it runs, e.g. to report failing to
+	Flags             func(*flag.FlagSet, *Config)
+	Run               func() error
+}
+
+// the exit codes, for scripts running the tool
+const (
+	exitFailed      = 1
+	exitUsage       = 2
+	exitWarnings    = 3 // the command succeeded, but warnings or errors were logged
+	exitInterrupted = 130
+)
+
+var commands = map[string]*Command{}
+
+// registerCommand makes a command available on the command line,
+// and is intended to be called from init functions.
+func registerCommand(cmd *Command) {
+	if _, exists := commands[cmd.Name]; exists {
+		panic("command registered twice: " + cmd.Name)
+	}
+	commands[cmd.Name] = cmd
+}
+
+// findCommand resolves the longest command name at the start of args,
+// returning the command and the arguments remaining after it.
+func findCommand(args []string) (*Command, []string) {
+	for n := len(args); n > 0; n-- {
+		if cmd, ok := commands[strings.Join(args[:n], " ")]; ok {
+			return cmd, args[n:]
+		}
+	}
+	return nil, args
+}
+
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "usage: migrate <command> [flags]\n\ncommands:\n")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-20s %s\n", name, commands[name].Summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nrun `migrate <command> --help` for a command's flags\n")
+}
+
+// setup loads & validates the config, then connects to the database.
+func setup(cmd *Command, args []string) {
+	var err error
+	cfg, err = LoadConfig(cmd, args)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitUsage)
+	}
+
+	if !cmd.ConnectsItself {
+		if err := connectDatabase(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitFailed)
+		}
+	}
+
+	if cfg.MetricsAddr != "" {
+		if err := startMetricsServer(cfg.MetricsAddr); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitFailed)
+		}
+	}
+}
+
+// connectDatabase connects DB, and ReadDB to the replica if there is one.
+func connectDatabase() error {
+	dsn, err := cfg.DSN()
+	if err == nil {
+		DB, err = sqlx.Connect("mysql", dsn)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s as %s: %w", cfg.DBAddress(), cfg.DBUser, err)
+	}
+	return connectReplica()
+}
+
+func main() {
+	cmd, args := findCommand(os.Args[1:])
+	if cmd == nil {
+		usage()
+		if len(os.Args) > 1 && os.Args[1] != "help" && os.Args[1] != "--help" && os.Args[1] != "-h" {
+			os.Exit(exitUsage)
+		}
+		return
+	}
+
+	// load & validate the config before touching anything
+	setup(cmd, args)
+
+	commandName = cmd.Name
+	notify("started", "started", 0, nil)
+	err := cmd.Run()
+	if err != nil && !errors.Is(err, errInterrupted) {
+		logger.Error("command failed", "command", cmd.Name, "err", err)
+	}
+
+	notifyFinished(err)
+	if err := writeLogSummary(cfg.LogFile); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write log file: %s\n", err)
+	}
+
+	if errors.Is(err, errInterrupted) {
+		os.Exit(exitInterrupted)
+	} else if err != nil {
+		os.Exit(exitFailed)
+	} else if warnings, errs := logWarnings.logged(); warnings+errs != 0 {
+		os.Exit(exitWarnings)
+	}
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bancho.py only keeps multiplayer matches in memory while they're open, so
+// their history is kept in the migrator's own tables: matches, their games
+// (a map played in the match), and each player's score in a game. they're
+// created by whatever fills them in (import akatsuki), and aren't part of
+// bancho.py's schema.
+//
+// export matches writes that history as json, a file per match, e.g. for a
+// tournament's archive or a stats site: the players, and each game's map,
+// mods & scores, with the winner of each game and of the match. files go to
+// a directory or object storage (s3://, b2:// or sftp://, as with backup),
+// named match_<id>.json, and are replaced when exported again.
+//
+// games are won as in osu!: by score, accuracy or combo, depending on the
+// game's win condition, by the best player in head to head & tag co-op, or
+// by the team with the highest total in team vs (their average accuracy,
+// for accuracy). failed scores don't count towards a win.
+
+// the tables, in the order they're created
+var matchTables = []string{"matches", "match_games", "match_game_scores"}
+
+var create_matches = `
+create table if not exists matches
+(
+	id int auto_increment
+		primary key,
+	name varchar(50) charset utf8mb4 not null,
+	host_id int null,
+	private tinyint(1) default 0 not null,
+	created_at datetime not null,
+	ended_at datetime null
+);`
+
+// win_condition & team_type are osu!'s, see app/objects/match.py
+var create_match_games = `
+create table if not exists match_games
+(
+	id int auto_increment
+		primary key,
+	match_id int not null,
+	map_id int not null,
+	mode tinyint(1) not null,
+	mods int not null,
+	win_condition tinyint(1) default 0 not null,
+	team_type tinyint(1) default 0 not null,
+	started_at datetime not null,
+	ended_at datetime null,
+	index match_games_match_id_index (match_id)
+);`
+
+var create_match_game_scores = `
+create table if not exists match_game_scores
+(
+	id int auto_increment
+		primary key,
+	game_id int not null,
+	userid int not null,
+	team tinyint(1) default 0 not null comment '0 neutral, 1 blue, 2 red',
+	mods int not null,
+	score int not null,
+	acc float(6,3) not null,
+	max_combo int not null,
+	n300 int not null,
+	n100 int not null,
+	n50 int not null,
+	nmiss int not null,
+	ngeki int not null,
+	nkatu int not null,
+	passed tinyint(1) not null,
+	index match_game_scores_game_id_index (game_id),
+	index match_game_scores_userid_index (userid)
+);`
+
+// createMatchTables creates the match history tables, if they're not there yet.
+func createMatchTables() error {
+	for _, stmt := range []string{create_matches, create_match_games, create_match_game_scores} {
+		if _, err := DB.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	logger.Info("created the match history tables")
+	return nil
+}
+
+var matchWinConditions = []string{"score", "accuracy", "combo", "scorev2"}
+
+var matchTeamTypes = []string{"head_to_head", "tag_coop", "team_vs", "tag_team_vs"}
+
+var matchTeams = []string{"neutral", "blue", "red"}
+
+// enumName names one of osu!'s match enums, or just numbers it if it's not
+// one we know of.
+func enumName(names []string, value int) string {
+	if value >= 0 && value < len(names) {
+		return names[value]
+	}
+	return strconv.Itoa(value)
+}
+
+// MatchExport is a match's file.
+type MatchExport struct {
+	ID        int64         `json:"id" db:"id"`
+	Name      string        `json:"name" db:"name"`
+	HostID    *int64        `json:"host_id" db:"host_id"`
+	Private   bool          `json:"private" db:"private"`
+	CreatedAt time.Time     `json:"created_at" db:"created_at"`
+	EndedAt   *time.Time    `json:"ended_at" db:"ended_at"`
+	Players   []MatchPlayer `json:"players"`
+	Games     []*MatchGame  `json:"games"`
+	Results   MatchResults  `json:"results"`
+}
+
+type MatchPlayer struct {
+	ID      int64  `json:"id"`
+	Name    string `json:"name"`
+	Country string `json:"country"`
+}
+
+// MatchGame is a map played in a match, scanned by hand as its map is
+// nested.
+type MatchGame struct {
+	ID           int64        `json:"id"`
+	MatchID      int64        `json:"-"`
+	Map          MatchMap     `json:"map"`
+	Mode         int          `json:"mode"`
+	Mods         int          `json:"mods"`
+	ModAcronyms  []string     `json:"mod_acronyms"`
+	Condition    int          `json:"-"`
+	TeamTypeID   int          `json:"-"`
+	WinCondition string       `json:"win_condition"`
+	TeamType     string       `json:"team_type"`
+	StartedAt    time.Time    `json:"started_at"`
+	EndedAt      *time.Time   `json:"ended_at"`
+	Scores       []MatchScore `json:"scores"`
+
+	// the teams' totals, in team vs, and who won: a team, or a player
+	Teams       map[string]float64 `json:"team_totals,omitempty"`
+	WinningTeam string             `json:"winning_team,omitempty"`
+	WinnerID    int64              `json:"winner_id,omitempty"`
+}
+
+type MatchMap struct {
+	ID      int64  `json:"id"`
+	MD5     string `json:"md5"`
+	SetID   int64  `json:"set_id"`
+	Artist  string `json:"artist"`
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type MatchScore struct {
+	GameID      int64    `json:"-" db:"game_id"`
+	UserID      int64    `json:"user_id" db:"userid"`
+	Username    string   `json:"username" db:"username"`
+	Country     string   `json:"-" db:"country"`
+	TeamID      int      `json:"-" db:"team"`
+	Team        string   `json:"team" db:"-"`
+	Mods        int      `json:"mods" db:"mods"`
+	ModAcronyms []string `json:"mod_acronyms"`
+	Score       int64    `json:"score" db:"score"`
+	Acc         float64  `json:"acc" db:"acc"`
+	MaxCombo    int      `json:"max_combo" db:"max_combo"`
+	N300        int      `json:"n300" db:"n300"`
+	N100        int      `json:"n100" db:"n100"`
+	N50         int      `json:"n50" db:"n50"`
+	NMiss       int      `json:"nmiss" db:"nmiss"`
+	NGeki       int      `json:"ngeki" db:"ngeki"`
+	NKatu       int      `json:"nkatu" db:"nkatu"`
+	Passed      bool     `json:"passed" db:"passed"`
+}
+
+// MatchResults counts the games each team, or player, won.
+type MatchResults struct {
+	TeamWins   map[string]int `json:"team_wins,omitempty"`
+	PlayerWins map[int64]int  `json:"player_wins,omitempty"`
+	Winner     string         `json:"winner,omitempty"` // a team, or a player's id, unless it's tied
+}
+
+var select_export_match_games = `
+SELECT g.id, g.match_id, g.map_id, g.mode, g.mods, g.win_condition, g.team_type,
+g.started_at, g.ended_at, COALESCE(m.md5, '') AS md5, COALESCE(m.set_id, 0) AS set_id,
+COALESCE(m.artist, '') AS artist, COALESCE(m.title, '') AS title, COALESCE(m.version, '') AS version
+FROM match_games g LEFT JOIN maps m ON m.id = g.map_id
+WHERE g.match_id = ? ORDER BY g.started_at, g.id`
+
+var select_export_match_scores = `
+SELECT s.game_id, s.userid, COALESCE(u.name, '') AS username, COALESCE(u.country, 'xx') AS country,
+s.team, s.mods, s.score, s.acc, s.max_combo, s.n300, s.n100, s.n50, s.nmiss, s.ngeki, s.nkatu, s.passed
+FROM match_game_scores s JOIN match_games g ON g.id = s.game_id
+LEFT JOIN users u ON u.id = s.userid
+WHERE g.match_id = ? ORDER BY s.game_id, s.score DESC, s.id`
+
+// winValue is what a score counts for under a win condition.
+func winValue(s MatchScore, condition int) float64 {
+	if !s.Passed {
+		return 0
+	}
+	switch condition {
+	case 1:
+		return s.Acc
+	case 2:
+		return float64(s.MaxCombo)
+	}
+	return float64(s.Score)
+}
+
+// decideGame works out who won a game.
+func decideGame(g *MatchGame) {
+	if g.TeamTypeID == 2 || g.TeamTypeID == 3 {
+		totals := map[string]float64{}
+		counts := map[string]int{}
+		for _, s := range g.Scores {
+			if s.TeamID == 1 || s.TeamID == 2 {
+				totals[s.Team] += winValue(s, g.Condition)
+				counts[s.Team]++
+			}
+		}
+		if g.Condition == 1 {
+			for team, n := range counts {
+				totals[team] /= float64(n)
+			}
+		}
+		g.Teams = totals
+		switch blue, red := totals["blue"], totals["red"]; {
+		case blue > red:
+			g.WinningTeam = "blue"
+		case red > blue:
+			g.WinningTeam = "red"
+		}
+		return
+	}
+
+	var best float64
+	tied := false
+	for _, s := range g.Scores {
+		v := winValue(s, g.Condition)
+		if v > best {
+			best, g.WinnerID, tied = v, s.UserID, false
+		} else if v == best && v != 0 {
+			tied = true
+		}
+	}
+	if tied {
+		g.WinnerID = 0
+	}
+}
+
+// decideMatch counts the games won, and who won the most.
+func decideMatch(m *MatchExport) {
+	results := MatchResults{}
+	wins := map[string]int{}
+	for _, g := range m.Games {
+		switch {
+		case g.WinningTeam != "":
+			if results.TeamWins == nil {
+				results.TeamWins = map[string]int{}
+			}
+			results.TeamWins[g.WinningTeam]++
+			wins[g.WinningTeam]++
+		case g.WinnerID != 0:
+			if results.PlayerWins == nil {
+				results.PlayerWins = map[int64]int{}
+			}
+			results.PlayerWins[g.WinnerID]++
+			wins[strconv.FormatInt(g.WinnerID, 10)]++
+		}
+	}
+	most := 0
+	for winner, n := range wins {
+		if n > most {
+			most, results.Winner = n, winner
+		} else if n == most {
+			results.Winner = ""
+		}
+	}
+	m.Results = results
+}
+
+// loadMatch reads a match's games & scores.
+func loadMatch(m *MatchExport) error {
+	rows, err := DB.Queryx(select_export_match_games, m.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	games := map[int64]*MatchGame{}
+	m.Games = []*MatchGame{}
+	for rows.Next() {
+		g := &MatchGame{}
+		if err := rows.Scan(&g.ID, &g.MatchID, &g.Map.ID, &g.Mode, &g.Mods, &g.Condition, &g.TeamTypeID,
+			&g.StartedAt, &g.EndedAt, &g.Map.MD5, &g.Map.SetID, &g.Map.Artist, &g.Map.Title, &g.Map.Version); err != nil {
+			return err
+		}
+		g.ModAcronyms = acronymsFromMods(g.Mods)
+		g.WinCondition = enumName(matchWinConditions, g.Condition)
+		g.TeamType = enumName(matchTeamTypes, g.TeamTypeID)
+		g.Scores = []MatchScore{}
+		games[g.ID] = g
+		m.Games = append(m.Games, g)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var scores []MatchScore
+	if err := DB.Select(&scores, select_export_match_scores, m.ID); err != nil {
+		return err
+	}
+	seen := map[int64]bool{}
+	m.Players = []MatchPlayer{}
+	for _, s := range scores {
+		s.Team = enumName(matchTeams, s.TeamID)
+		s.ModAcronyms = acronymsFromMods(s.Mods)
+		games[s.GameID].Scores = append(games[s.GameID].Scores, s)
+		if !seen[s.UserID] {
+			seen[s.UserID] = true
+			m.Players = append(m.Players, MatchPlayer{ID: s.UserID, Name: s.Username, Country: s.Country})
+		}
+	}
+
+	for _, g := range m.Games {
+		decideGame(g)
+	}
+	decideMatch(m)
+	return nil
+}
+
+// writeMatch writes a match's file, replacing it if it's there.
+func writeMatch(dest BackupDestination, m *MatchExport) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(m); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("match_%d.json", m.ID)
+	return retryUpload(name, func() error {
+		upload, err := dest.Create(name, map[string]string{"type": "match"})
+		if err != nil {
+			return err
+		}
+		if _, err := upload.Write(buf.Bytes()); err != nil {
+			upload.Abort()
+			return err
+		}
+		return upload.Commit()
+	})
+}
+
+func runExportMatches() error {
+	for _, table := range matchTables {
+		if exists, err := tableExists(table); err != nil {
+			return err
+		} else if !exists {
+			return fmt.Errorf("the %s table does not exist, import akatsuki fills in the match history", table)
+		}
+	}
+
+	var conditions []string
+	var args []interface{}
+	if cfg.ExportMatches != "" {
+		var ids []string
+		for _, id := range strings.Split(cfg.ExportMatches, ",") {
+			id = strings.TrimSpace(id)
+			if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+				return fmt.Errorf("--matches must be a list of match ids, not %q", id)
+			}
+			ids = append(ids, id)
+		}
+		conditions = append(conditions, fmt.Sprintf("id IN (%s)", strings.Join(ids, ", ")))
+	}
+	if cfg.MatchesSince != "" {
+		since, err := parseFilterTime("since", cfg.MatchesSince)
+		if err != nil {
+			return err
+		}
+		conditions = append(conditions, "created_at >= FROM_UNIXTIME(?)")
+		args = append(args, since)
+	}
+	if len(conditions) == 0 {
+		conditions = []string{"1"}
+	}
+
+	if cfg.MatchesDestination == "" {
+		cfg.MatchesDestination = filepath.Join(cfg.DataDirectory, "matches")
+	}
+	dest, err := openBackupDestination(cfg.MatchesDestination)
+	if err != nil {
+		return err
+	}
+
+	var matches []*MatchExport
+	err = DB.Select(&matches, fmt.Sprintf(`
+	SELECT id, name, host_id, private, created_at, ended_at FROM matches
+	WHERE %s ORDER BY id`, strings.Join(conditions, " AND ")), args...)
+	if err != nil {
+		return err
+	}
+	if len(matches) == 0 {
+		return errors.New("no matches to export")
+	}
+
+	handleSignals()
+	start := time.Now()
+	games, scores := 0, 0
+	for i, m := range matches {
+		if isInterrupted() {
+			logger.Info("interrupted", "exported", i)
+			return errInterrupted
+		}
+		if err := loadMatch(m); err != nil {
+			return fmt.Errorf("failed to read match %d: %w", m.ID, err)
+		}
+		if err := writeMatch(dest, m); err != nil {
+			return fmt.Errorf("failed to write match %d: %w", m.ID, err)
+		}
+		games += len(m.Games)
+		for _, g := range m.Games {
+			scores += len(g.Scores)
+		}
+		logger.Debug("exported match", "match", m.ID, "games", len(m.Games))
+	}
+
+	logger.Info("exported matches", "matches", len(matches), "games", games, "scores", scores,
+		"to", cfg.MatchesDestination, "elapsed", time.Since(start).Round(time.Second))
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:              "export matches",
+		Summary:           "write multiplayer match history as json, a file per match with its players, games, scores & results",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.ExportMatches, "matches", "", "comma separated ids of the matches to export (default: all of them)")
+			flags.StringVar(&c.MatchesSince, "since", "", "only matches created since this date, or duration ago (e.g. 720h)")
+			flags.StringVar(&c.MatchesDestination, "dir", "", "where the files are written: a directory, s3://bucket/prefix, b2://bucket/prefix or sftp://user@host/path (default: DATA_DIRECTORY/matches)")
+			flags.IntVar(&c.MaxRetries, "max-retries", 5, "times to retry an upload part")
+		},
+		Run: runExportMatches,
+	})
+}
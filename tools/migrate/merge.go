@@ -0,0 +1,545 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// merge brings a second bancho.py instance's users, scores, stats & replays
+// into this one, e.g. when two servers join together. unlike the imports,
+// this database needn't be fresh, so the second instance's users may clash
+// with its own:
+//
+//   - ids which are taken here are remapped, to ids after both instances'.
+//   - names which are taken here are renamed, with --rename-suffix, unless
+//     --on-conflict link finds they're the same player.
+//   - with --on-conflict link, users with the same email on both instances
+//     are linked: the player keeps their account here, and the second
+//     instance's scores are added to it.
+//
+// with --merge-avatars, the second instance's avatars are copied to its
+// users' ids here, see avatars.go.
+//
+// the scores go through the same pipeline as migrations, with replays copied
+// to the new score ids (the second instance's are left in place), so an
+// interrupted merge can be continued with --resume. once they're in, each
+// player's best score on a map is the one with the most pp across both
+// instances, and the merged players' stats are rebuilt from their scores.
+// scores which are on both instances (e.g. from a player who submitted to
+// both) are kept twice, and can be removed with dedupe scores afterwards.
+
+const (
+	mergeConflictRename = "rename"
+	mergeConflictLink   = "link"
+)
+
+// bancho.py's limit on names, which renamed users' names are kept within
+const maxNameLength = 15
+
+var validNameSuffix = regexp.MustCompile(`^[\w \[\]-]*$`)
+
+// the mapping of the second instance's users to this one's, which is kept
+// until the merge finishes so that it can be resumed
+var create_merge_user_ids = `
+create table merge_user_ids (
+	old_id int not null
+		primary key,
+	new_id int not null,
+	name varchar(32) charset utf8 not null,
+	safe_name varchar(32) charset utf8 not null,
+	email varchar(254) not null,
+	linked tinyint(1) not null
+)`
+
+var insert_merge_user_ids = `
+INSERT INTO merge_user_ids (old_id, new_id, name, safe_name, email, linked)
+VALUES (:old_id, :new_id, :name, :safe_name, :email, :linked)`
+
+// MergedUser is where one of the second instance's users ends up.
+type MergedUser struct {
+	OldID    int64  `db:"old_id" json:"old_id"`
+	NewID    int64  `db:"new_id" json:"new_id"`
+	OldName  string `db:"-" json:"old_name"`
+	Name     string `json:"name"`
+	SafeName string `db:"safe_name" json:"-"`
+	Email    string `json:"-"`
+	Remapped bool   `db:"-" json:"remapped"`
+	Renamed  bool   `db:"-" json:"renamed"`
+	Linked   bool   `json:"linked"`
+}
+
+type MergeReport struct {
+	Users    int          `json:"users"`
+	Remapped int          `json:"remapped"`
+	Renamed  int          `json:"renamed"`
+	Linked   int          `json:"linked"`
+	Emails   int          `json:"emails_changed"`
+	Merged   []MergedUser `json:"merged"`
+}
+
+type mergeUser struct {
+	ID       int64
+	Name     string
+	SafeName string `db:"safe_name"`
+	Email    string
+}
+
+// renamedName gives a user's name with the suffix, and a number from the
+// second attempt on (or _2, _3, ... without a suffix), cut short to fit
+// bancho.py's limit.
+func renamedName(name, suffix string, attempt int) string {
+	switch {
+	case suffix == "":
+		suffix = "_" + strconv.Itoa(attempt+1)
+	case attempt > 1:
+		suffix += strconv.Itoa(attempt)
+	}
+	base := []rune(name)
+	if keep := maxNameLength - len([]rune(suffix)); len(base) > keep {
+		base = base[:max(keep, 1)]
+	}
+	return string(base) + suffix
+}
+
+// resolveMergedUsers works out where each of the second instance's users
+// ends up, see the top of this file.
+func resolveMergedUsers(src *OldSchema) ([]MergedUser, MergeReport, error) {
+	var report MergeReport
+	var incoming, existing []mergeUser
+	if err := DB.Select(&incoming, fmt.Sprintf("SELECT id, name, safe_name, email FROM %s ORDER BY id", src.Table("users"))); err != nil {
+		return nil, report, err
+	}
+	if err := DB.Select(&existing, "SELECT id, name, safe_name, email FROM users"); err != nil {
+		return nil, report, err
+	}
+
+	ids := make(map[int64]bool, len(existing))
+	names := make(map[string]bool, len(existing))
+	emails := make(map[string]int64, len(existing))
+	var nextID int64
+	for _, u := range existing {
+		ids[u.ID] = true
+		names[u.SafeName] = true
+		emails[strings.ToLower(u.Email)] = u.ID
+		nextID = max(nextID, u.ID)
+	}
+	for _, u := range incoming {
+		nextID = max(nextID, u.ID)
+	}
+	nextID++
+
+	merged := make([]MergedUser, 0, len(incoming))
+	for _, u := range incoming {
+		m := MergedUser{OldID: u.ID, NewID: u.ID, OldName: u.Name, Name: u.Name, SafeName: u.SafeName, Email: u.Email}
+
+		// the bot is the same user on every instance
+		if u.ID == 1 {
+			m.Linked = true
+			merged = append(merged, m)
+			continue
+		}
+
+		if id, ok := emails[strings.ToLower(u.Email)]; ok && cfg.MergeConflict == mergeConflictLink {
+			m.NewID, m.Linked = id, true
+			report.Linked++
+			merged = append(merged, m)
+			continue
+		}
+
+		if ids[m.NewID] {
+			m.NewID, m.Remapped = nextID, true
+			nextID++
+			report.Remapped++
+		}
+		for attempt := 1; names[m.SafeName]; attempt++ {
+			m.Name = renamedName(u.Name, cfg.MergeSuffix, attempt)
+			m.SafeName = strings.ReplaceAll(strings.ToLower(m.Name), " ", "_")
+			m.Renamed = true
+		}
+		if m.Renamed {
+			report.Renamed++
+		}
+
+		// emails are unique too, so a player with accounts on both instances
+		// who isn't linked keeps getting mail through a subaddress
+		if _, ok := emails[strings.ToLower(m.Email)]; ok {
+			local, domain, _ := strings.Cut(m.Email, "@")
+			m.Email = fmt.Sprintf("%s+merged%d@%s", local, m.NewID, domain)
+			report.Emails++
+		}
+
+		ids[m.NewID] = true
+		names[m.SafeName] = true
+		emails[strings.ToLower(m.Email)] = m.NewID
+		merged = append(merged, m)
+	}
+
+	report.Users = len(merged)
+	for _, m := range merged {
+		if m.Remapped || m.Renamed || (m.Linked && m.OldID != 1) {
+			report.Merged = append(report.Merged, m)
+		}
+	}
+	return merged, report, nil
+}
+
+// saveMergedUsers records the mapping, for the rest of the merge to join on.
+func saveMergedUsers(merged []MergedUser) error {
+	if _, err := DB.Exec(create_merge_user_ids); err != nil {
+		return fmt.Errorf("%w (if a previous merge was interrupted, rerun with --resume)", err)
+	}
+	for start := 0; start < len(merged); start += BatchSize {
+		end := min(start+BatchSize, len(merged))
+		if err := throttle(end - start); err != nil {
+			return err
+		}
+		if _, err := DB.NamedExec(insert_merge_user_ids, merged[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeUsers copies the users who weren't linked, with their stats. clans
+// aren't merged, so they start out clanless, and api keys which are taken
+// here are dropped.
+func mergeUsers(src *OldSchema) error {
+	apiKey := "NULL"
+	if src.HasColumn("users", "api_key") {
+		apiKey = "IF(u.api_key IN (SELECT api_key FROM users WHERE api_key IS NOT NULL), NULL, u.api_key)"
+	}
+	n, err := copyRows(fmt.Sprintf(`
+	INSERT IGNORE INTO users (id, name, safe_name, email, priv, pw_bcrypt, country,
+		silence_end, donor_end, creation_time, latest_activity, preferred_mode,
+		play_style, custom_badge_name, custom_badge_icon, userpage_content, api_key)
+	SELECT m.new_id, m.name, m.safe_name, m.email, u.priv, u.pw_bcrypt, u.country,
+		u.silence_end, u.donor_end, u.creation_time, u.latest_activity, %s, %s, %s, %s, %s, %s
+	FROM %s u JOIN merge_user_ids m ON m.old_id = u.id
+	WHERE NOT m.linked`,
+		src.Column("users", "u.", "preferred_mode", "0"),
+		src.Column("users", "u.", "play_style", "0"),
+		src.Column("users", "u.", "custom_badge_name", "NULL"),
+		src.Column("users", "u.", "custom_badge_icon", "NULL"),
+		src.Column("users", "u.", "userpage_content", "NULL"),
+		apiKey, src.Table("users")))
+	if err != nil {
+		return fmt.Errorf("failed to merge users: %w", err)
+	}
+	logger.Info("merged users", "users", n)
+
+	// everything else is rebuilt from the scores once they're merged
+	_, err = copyRows(fmt.Sprintf(`
+	INSERT IGNORE INTO stats (id, mode, replay_views)
+	SELECT m.new_id, s.mode, %s
+	FROM %s s JOIN merge_user_ids m ON m.old_id = s.id
+	WHERE NOT m.linked`, src.Column("stats", "s.", "replay_views", "0"), src.Table("stats")))
+	if err != nil {
+		return fmt.Errorf("failed to merge stats: %w", err)
+	}
+	return fillStatsModes()
+}
+
+// mergeUserRows copies the rows which belong to users, with their new ids.
+// achievements are matched by file, as their ids may differ.
+func mergeUserRows(src *OldSchema) error {
+	for table, query := range map[string]string{
+		"relationships": `
+		INSERT IGNORE INTO relationships (user1, user2, type)
+		SELECT m1.new_id, m2.new_id, r.type FROM %s r
+		JOIN merge_user_ids m1 ON m1.old_id = r.user1
+		JOIN merge_user_ids m2 ON m2.old_id = r.user2
+		WHERE m1.new_id != m2.new_id`,
+		"favourites": `
+		INSERT IGNORE INTO favourites (userid, setid, created_at)
+		SELECT m.new_id, f.setid, f.created_at FROM %s f
+		JOIN merge_user_ids m ON m.old_id = f.userid`,
+		"ratings": `
+		INSERT IGNORE INTO ratings (userid, map_md5, rating)
+		SELECT m.new_id, r.map_md5, r.rating FROM %s r
+		JOIN merge_user_ids m ON m.old_id = r.userid`,
+		"user_achievements": `
+		INSERT IGNORE INTO user_achievements (userid, achid)
+		SELECT m.new_id, a.id FROM %s ua
+		JOIN merge_user_ids m ON m.old_id = ua.userid
+		JOIN ` + src.Table("achievements") + ` sa ON sa.id = ua.achid
+		JOIN achievements a ON a.file = sa.file`,
+	} {
+		if !src.Has(table) || table == "user_achievements" && !src.Has("achievements") {
+			continue
+		}
+		n, err := copyRows(fmt.Sprintf(query, src.Table(table)))
+		if err != nil {
+			return fmt.Errorf("failed to merge %s: %w", table, err)
+		}
+		logger.Info("merged table", "table", table, "rows", n)
+	}
+	return nil
+}
+
+// mergeSourceTable sets the second instance's scores up to be read by the
+// score pipeline, with their users' new ids.
+func mergeSourceTable(src *OldSchema, merged []MergedUser) (SourceTable, error) {
+	schemas, err := loadTableSchemas(src.Name, []string{"scores"})
+	if err != nil {
+		return SourceTable{}, err
+	}
+	if len(schemas) == 0 {
+		return SourceTable{}, fmt.Errorf("%s has no scores table", src.Name)
+	}
+	check := checkTableSchema(schemas[0], expectedScoreColumns, nil)
+	if printSchemaChecks([]SchemaCheck{check}) {
+		return SourceTable{}, errPreflightFailed
+	}
+
+	replays, err := openReplayStore(cfg.MergeReplays)
+	if err != nil {
+		return SourceTable{}, err
+	}
+	userIDs := make(map[int64]int64, len(merged))
+	for _, m := range merged {
+		userIDs[m.OldID] = m.NewID
+	}
+	return SourceTable{
+		Name:    src.Table("scores"),
+		Columns: selectExpectedColumns(expectedScoreColumns, check.Exprs),
+		Prepare: func(score *Score) { score.UserID = userIDs[score.UserID] },
+		Replays: replays,
+	}, nil
+}
+
+var select_merge_best_pp = `
+SELECT s.userid, s.pp FROM scores s JOIN maps m ON m.md5 = s.map_md5
+WHERE s.mode = ? AND s.userid IN (?) AND s.status = 2 AND m.status IN (?, ?)`
+
+// recalculatePP works out a chunk of users' total pp in a mode from their
+// best scores, which the rest of the tool leaves to tools/recalc.py.
+func recalculatePP(mode int, users []int64) error {
+	query, args, err := sqlx.In(select_merge_best_pp, mode, users, mapStatusRanked, mapStatusApproved)
+	if err != nil {
+		return err
+	}
+	var bests []struct {
+		UserID int64 `db:"userid"`
+		PP     float64
+	}
+	if err := DB.Select(&bests, query, args...); err != nil {
+		return err
+	}
+
+	pps := make(map[int64][]float64, len(users))
+	for _, best := range bests {
+		pps[best.UserID] = append(pps[best.UserID], best.PP)
+	}
+	if err := throttle(len(users)); err != nil {
+		return err
+	}
+	tx, err := DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, id := range users {
+		if _, err := tx.Exec("UPDATE stats SET pp = ? WHERE id = ? AND mode = ?", weightedPP(pps[id]), id, mode); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// rebuildMergedStats picks the merged players' best scores across both
+// instances, and rebuilds their stats from them.
+func rebuildMergedStats(merged []MergedUser) error {
+	users := make(map[int64]bool, len(merged))
+	for _, m := range merged {
+		users[m.NewID] = true
+	}
+	counts, err := rebuildUserStats(users)
+	if err != nil {
+		return err
+	}
+	logger.Info("recalculated the players' best scores & stats", "users", len(users),
+		"promoted", counts.Promoted, "demoted", counts.Demoted)
+	return nil
+}
+
+func runMerge() error {
+	if !validSchemaName.MatchString(cfg.MergeDB) {
+		return errors.New("--merge-db must be the name of the other instance's database")
+	}
+	if cfg.MergeReplays == "" {
+		return errors.New("--merge-replays must be the other instance's .data/osr directory")
+	}
+	if cfg.MergeConflict != mergeConflictRename && cfg.MergeConflict != mergeConflictLink {
+		return fmt.Errorf("unknown --on-conflict %q, expected rename or link", cfg.MergeConflict)
+	}
+	if !validNameSuffix.MatchString(cfg.MergeSuffix) || len([]rune(cfg.MergeSuffix)) >= maxNameLength {
+		return fmt.Errorf("--rename-suffix %q must be a few letters, numbers, spaces, _, -, [ or ]", cfg.MergeSuffix)
+	}
+
+	src, err := loadOldSchema(cfg.MergeDB)
+	if err != nil {
+		return err
+	}
+	switch {
+	case !src.Has("users"):
+		return fmt.Errorf("%s does not look like a bancho.py database", cfg.MergeDB)
+	case src.Has("scores_vn"):
+		return fmt.Errorf("%s is from before v4.2.0, run migrate up on it first", cfg.MergeDB)
+	}
+
+	// scores whose users are gone would have nowhere to go
+	var orphans int
+	err = DB.Get(&orphans, fmt.Sprintf(`
+	SELECT COUNT(*) FROM %s s LEFT JOIN %s u ON u.id = s.userid WHERE u.id IS NULL`,
+		src.Table("scores"), src.Table("users")))
+	if err != nil {
+		return err
+	}
+	if orphans != 0 {
+		return fmt.Errorf("%d of %s's scores belong to users which don't exist there, remove them before merging", orphans, cfg.MergeDB)
+	}
+
+	var merged []MergedUser
+	if cfg.Resume {
+		if err := DB.Select(&merged, "SELECT old_id, new_id, name, safe_name, email, linked FROM merge_user_ids"); err != nil {
+			return fmt.Errorf("cannot resume: %w", err)
+		}
+	} else {
+		var report MergeReport
+		if merged, report, err = resolveMergedUsers(src); err != nil {
+			return err
+		}
+		if err := writeReport(cfg.ReportPath, report); err != nil {
+			return err
+		}
+		logger.Info("resolved the users", "users", report.Users, "remapped", report.Remapped,
+			"renamed", report.Renamed, "linked", report.Linked, "emails_changed", report.Emails)
+		if cfg.DryRun {
+			logger.Info("nothing was changed", "dry_run", true)
+			return nil
+		}
+		if err := saveMergedUsers(merged); err != nil {
+			return err
+		}
+	}
+
+	if err := setupReplayStores(); err != nil {
+		return err
+	}
+	table, err := mergeSourceTable(src, merged)
+	if err != nil {
+		return err
+	}
+	tables := []SourceTable{table}
+
+	// the other instance keeps its replays
+	keepReplayOriginals = true
+
+	// ctrl-c stops the merge gracefully, see signal.go
+	handleSignals()
+
+	if err := tuneWorkers(); err != nil {
+		return err
+	}
+	if err := tuneBatching(); err != nil {
+		return err
+	}
+	progress = newProgress(tables, NumWorkers)
+	replayJournal, err = openReplayJournal(cfg.ReplayJournalPath)
+	if err != nil {
+		return err
+	}
+	defer replayJournal.Close()
+
+	// rows which can't be merged are kept here, instead of being lost
+	deadLetters = newDeadLetterFile(cfg.DeadLetterPath)
+	defer deadLetters.Close()
+
+	// rows which were already merged are skipped, so these
+	// are safe to run again when resuming
+	start := time.Now()
+	if err := mergeUsers(src); err != nil {
+		return err
+	}
+	if err := mergeUserRows(src); err != nil {
+		return err
+	}
+	if cfg.MergeAvatars != "" {
+		// users linked to one here keep their avatar, if they have one
+		mapping := make(map[int64]int64, len(merged))
+		for _, user := range merged {
+			mapping[user.OldID] = user.NewID
+		}
+		report, err := copyAvatars(cfg.MergeAvatars, mapping, false, false)
+		if err != nil {
+			return fmt.Errorf("failed to merge avatars: %w", err)
+		}
+		logger.Info("merged avatars", "copied", report.Rekeyed, "kept", len(report.Kept))
+	}
+	for _, convert := range []func(*OldSchema) (int64, error){convertMaps, convertMapsets} {
+		if _, err := convert(src); err != nil {
+			return fmt.Errorf("failed to merge beatmaps: %w", err)
+		}
+	}
+
+	if cfg.Resume {
+		if err := resumePendingReplays(tables); err != nil {
+			return err
+		}
+	} else if err := createCheckpointTables(); err != nil {
+		return err
+	}
+	if err := migrateScores(tables, cfg.Resume); err != nil {
+		return err
+	}
+	progress.summary()
+
+	if err := rebuildMergedStats(merged); err != nil {
+		return err
+	}
+
+	if err := dropCheckpointTables(); err != nil {
+		return err
+	}
+	if _, err := DB.Exec("drop table if exists merge_user_ids"); err != nil {
+		return err
+	}
+
+	logger.Info("merge finished", "from", cfg.MergeDB, "elapsed", time.Since(start).Round(time.Second))
+	logger.Info("run cache rebuild to bring the leaderboards in redis up to date")
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:              "merge",
+		Summary:           "merge another bancho.py instance's users, scores, stats & replays into this one",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.MergeDB, "merge-db", "", "name of the other instance's database, on the same server as this one's")
+			flags.StringVar(&c.MergeReplays, "merge-replays", "", "the other instance's replays (its .data/osr), a path or s3://bucket/prefix")
+			flags.StringVar(&c.MergeAvatars, "merge-avatars", "", "the other instance's avatars (its .data/avatars), copied to the users' ids here (default: leave them)")
+			flags.StringVar(&c.MergeConflict, "on-conflict", mergeConflictRename, "users whose name or email is taken here: rename them, or link those with the same email to the user here")
+			flags.StringVar(&c.MergeSuffix, "rename-suffix", "", "added to renamed users' names, e.g. _eu (default: _2, _3, ...)")
+			flags.BoolVar(&c.DryRun, "dry-run", false, "report how the users would be merged, without changing anything")
+			flags.StringVar(&c.ReportPath, "report", "", "write the remapped, renamed & linked users as json to this path (- for stdout)")
+			flags.BoolVar(&c.Resume, "resume", false, "continue an interrupted merge")
+			flags.IntVar(&c.Workers, "workers", 0, "number of concurrent workers (default: tuned to the database's max_connections)")
+			flags.IntVar(&c.MaxRetries, "max-retries", 5, "times to retry a batch after a deadlock, lock wait timeout or lost connection")
+			batchingFlags(flags, c)
+			flags.StringVar(&c.DeadLetterPath, "dead-letter", "", "file to write rows which failed to merge to (default: DATA_DIRECTORY/migrate_dead_letters.jsonl)")
+			flags.StringVar(&c.ReplayJournalPath, "replay-journal", "", "journal of replay copies (default: DATA_DIRECTORY/migrate_replays.journal)")
+			flags.DurationVar(&c.ProgressInterval, "progress-interval", 10*time.Second, "how often to report progress (0 to disable)")
+			flags.StringVar(&c.ProgressFormat, "progress-format", "auto", "progress output format: tui for a dashboard, text, or log to report through the (structured) logger (default: tui on a terminal, otherwise text)")
+			flags.StringVar(&c.NewReplays, "new-replays", "", "where merged replays are written, a path or s3://bucket/prefix (default: DATA_DIRECTORY/osr)")
+		},
+		Run: runMerge,
+	})
+}
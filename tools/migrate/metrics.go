@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a minimal implementation of the prometheus text exposition format,
+// so that long-running commands can be watched from grafana without
+// pulling in the full prometheus client library.
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+
+type metric interface {
+	write(w io.Writer)
+}
+
+// Registry holds every metric exposed on the metrics endpoint.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+var metrics = &Registry{}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range r.metrics {
+		m.write(w)
+	}
+}
+
+// labelKey renders label values as they appear in the exposition format.
+func labelKey(names []string, values []string) string {
+	if len(names) != len(values) {
+		panic(fmt.Sprintf("expected %d label values, got %d", len(names), len(values)))
+	}
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i := range names {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i])
+		pairs[i] = fmt.Sprintf(`%s="%s"`, names[i], value)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// vec is a set of values of one metric, keyed by their labels.
+type vec struct {
+	name, help, kind string
+	labels           []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func (v *vec) add(delta float64, labelValues []string) {
+	key := labelKey(v.labels, labelValues)
+	v.mu.Lock()
+	v.values[key] += delta
+	v.mu.Unlock()
+}
+
+func (v *vec) set(value float64, labelValues []string) {
+	key := labelKey(v.labels, labelValues)
+	v.mu.Lock()
+	v.values[key] = value
+	v.mu.Unlock()
+}
+
+func (v *vec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %g\n", v.name, key, v.values[key])
+	}
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct{ vec }
+
+func newCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{vec{name: name, help: help, kind: "counter", labels: labels, values: map[string]float64{}}}
+	metrics.register(c)
+	return c
+}
+
+func (c *Counter) Add(delta float64, labelValues ...string) { c.add(delta, labelValues) }
+func (c *Counter) Inc(labelValues ...string)                { c.add(1, labelValues) }
+
+// Gauge is a value which can go up and down.
+type Gauge struct{ vec }
+
+func newGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{vec{name: name, help: help, kind: "gauge", labels: labels, values: map[string]float64{}}}
+	metrics.register(g)
+	return g
+}
+
+func (g *Gauge) Set(value float64, labelValues ...string) { g.set(value, labelValues) }
+func (g *Gauge) Add(delta float64, labelValues ...string) { g.add(delta, labelValues) }
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	name, help string
+	buckets    []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	metrics.register(h)
+	return h
+}
+
+func (h *Histogram) Observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// ObserveSince records the seconds elapsed since start.
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", h.name, bound, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", h.name, h.sum, h.name, h.count)
+}
+
+// gaugeFunc is a gauge whose value is computed whenever it's scraped.
+type gaugeFunc struct {
+	name, help string
+	fn         func() float64
+}
+
+func newGaugeFunc(name, help string, fn func() float64) {
+	metrics.register(&gaugeFunc{name: name, help: help, fn: fn})
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	value := g.fn()
+	if math.IsNaN(value) {
+		return
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", g.name, g.help, g.name, g.name, value)
+}
+
+// startMetricsServer serves the metrics endpoint in the background.
+func startMetricsServer(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s for metrics: %w", addr, err)
+	}
+
+	go func() {
+		server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		if err := server.Serve(listener); err != nil {
+			logger.Error("metrics server stopped", "err", err)
+		}
+	}()
+	return nil
+}
+
+// the metrics exported by the score migration
+var (
+	metricRowsMigrated = newCounter("migrate_rows_migrated_total",
+		"Rows inserted into the new table.", "table")
+	metricRowErrors = newCounter("migrate_row_errors_total",
+		"Rows which failed to migrate.", "table")
+	metricReplayMoveFailures = newCounter("migrate_replay_move_failures_total",
+		"Replays which could not be found or moved.", "reason")
+	metricReplaysMoved = newCounter("migrate_replays_moved_total",
+		"Replays moved to their new score id.")
+	metricBatchRetries = newCounter("migrate_batch_retries_total",
+		"Batches retried after a deadlock, lock wait timeout or lost connection.", "reason")
+	metricBatchCommitSeconds = newHistogram("migrate_batch_commit_seconds",
+		"Time taken to commit a batch of inserted rows.",
+		[]float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30})
+	metricBusyWorkers = newGauge("migrate_workers_busy",
+		"Workers currently processing a batch.")
+	metricWorkers = newGauge("migrate_workers",
+		"Size of the worker pool.")
+)
+
+func init() {
+	newGaugeFunc("migrate_progress_ratio", "Fraction of rows processed so far by the running migration.", func() float64 {
+		if progress == nil {
+			return math.NaN()
+		}
+		total, _, inserted, failed, skipped := progress.totals()
+		if total == 0 {
+			return math.NaN()
+		}
+		return float64(inserted+failed+skipped) / float64(total)
+	})
+}
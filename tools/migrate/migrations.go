@@ -0,0 +1,445 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version is a bancho.py release version, e.g. 4.2.0.
+type Version struct {
+	Major, Minor, Micro int
+}
+
+func parseVersion(s string) (Version, error) {
+	parts := strings.Split(strings.TrimPrefix(s, "v"), ".")
+	if len(parts) != 3 {
+		return Version{}, fmt.Errorf("invalid version %q, expected major.minor.micro", s)
+	}
+
+	var nums [3]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return Version{}, fmt.Errorf("invalid version %q, expected major.minor.micro", s)
+		}
+		nums[i] = n
+	}
+	return Version{nums[0], nums[1], nums[2]}, nil
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Micro)
+}
+
+func (v Version) Less(other Version) bool {
+	if v.Major != other.Major {
+		return v.Major < other.Major
+	}
+	if v.Minor != other.Minor {
+		return v.Minor < other.Minor
+	}
+	return v.Micro < other.Micro
+}
+
+// Migration brings the database (and .data) from the previous
+// migration's version up to the bancho.py release in Version.
+type Migration struct {
+	Version     Version
+	Description string
+
+	Up func() error
+	// Down undoes Up, and is nil if the migration cannot be undone.
+	Down func() error
+	// DryRun, if set, reports what Up would do without changing anything.
+	DryRun func() error
+	// Benchmark, if set, times Up's inserts with a sample of the rows, and
+	// leaves the database as it was.
+	Benchmark func() error
+	// Verify, if set, checks the results of Up, reporting whether they're correct.
+	Verify func() (bool, error)
+	// Preflight, if set, checks the tables Up reads are as it expects, and
+	// adapts to any differences it can. see preflight.go.
+	Preflight func() error
+	// Applied, if set, detects whether the migration was applied before
+	// the schema_version table existed, e.g. by one of the old one-off tools.
+	Applied func() (bool, error)
+}
+
+var migrations []*Migration
+
+// registerMigration adds a migration to the registry, and is intended
+// to be called from the init function of the migration's file.
+func registerMigration(version string, m *Migration) {
+	v, err := parseVersion(version)
+	if err != nil {
+		panic(err)
+	}
+	m.Version = v
+
+	for _, existing := range migrations {
+		if existing.Version == v {
+			panic("migration registered twice: " + version)
+		}
+	}
+
+	migrations = append(migrations, m)
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version.Less(migrations[j].Version)
+	})
+}
+
+var create_schema_version = `
+create table if not exists schema_version (
+	version varchar(16) not null primary key,
+	description varchar(256) not null,
+	applied_at datetime not null
+);
+`
+
+type appliedMigration struct {
+	Version   string
+	AppliedAt time.Time `db:"applied_at"`
+}
+
+// appliedMigrations returns when each applied migration was applied, by version.
+func appliedMigrations() (map[Version]time.Time, error) {
+	if _, err := DB.Exec(create_schema_version); err != nil {
+		return nil, err
+	}
+
+	var rows []appliedMigration
+	if err := DB.Select(&rows, "SELECT version, applied_at FROM schema_version"); err != nil {
+		return nil, err
+	}
+
+	applied := make(map[Version]time.Time, len(rows))
+	for _, row := range rows {
+		v, err := parseVersion(row.Version)
+		if err != nil {
+			return nil, fmt.Errorf("schema_version contains an invalid row: %w", err)
+		}
+		applied[v] = row.AppliedAt
+	}
+	return applied, nil
+}
+
+func recordMigration(m *Migration) error {
+	_, err := DB.Exec(
+		"INSERT INTO schema_version (version, description, applied_at) VALUES (?, ?, NOW())",
+		m.Version.String(), m.Description,
+	)
+	return err
+}
+
+func forgetMigration(m *Migration) error {
+	_, err := DB.Exec("DELETE FROM schema_version WHERE version = ?", m.Version.String())
+	return err
+}
+
+// targetVersion parses --to, defaulting to the newest registered migration.
+func targetVersion() (Version, error) {
+	if cfg.TargetVersion == "" {
+		return migrations[len(migrations)-1].Version, nil
+	}
+	return parseVersion(cfg.TargetVersion)
+}
+
+func runStatus() error {
+	applied, err := appliedMigrations()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-10s %-8s %-20s %s\n", "version", "status", "applied at", "description")
+	for _, m := range migrations {
+		status, at := "pending", ""
+		if t, ok := applied[m.Version]; ok {
+			status, at = "applied", t.Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%-10s %-8s %-20s %s\n", m.Version, status, at, m.Description)
+	}
+	return nil
+}
+
+func runUp() error {
+	if cfg.Resume && cfg.DryRun {
+		return errors.New("--resume and --dry-run cannot be used together")
+	}
+	if cfg.Benchmark && (cfg.Resume || cfg.DryRun || cfg.Online) {
+		return errors.New("--benchmark cannot be used with --resume, --dry-run or --online")
+	}
+
+	target, err := targetVersion()
+	if err != nil {
+		return err
+	}
+
+	applied, err := appliedMigrations()
+	if err != nil {
+		return err
+	}
+
+	ran := 0
+	for _, m := range migrations {
+		if target.Less(m.Version) {
+			break
+		}
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+
+		if m.Applied != nil {
+			done, err := m.Applied()
+			if err != nil {
+				return fmt.Errorf("v%s: %w", m.Version, err)
+			}
+			if done {
+				logger.Info("migration was already applied, recording it in schema_version", "version", m.Version.String())
+				if !cfg.DryRun {
+					if err := recordMigration(m); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+		}
+
+		if m.Preflight != nil {
+			if err := m.Preflight(); err != nil {
+				return fmt.Errorf("v%s: %w", m.Version, err)
+			}
+		}
+
+		if cfg.Benchmark {
+			fmt.Printf("Benchmark of v%s: %s\n", m.Version, m.Description)
+			if m.Benchmark == nil {
+				fmt.Println("  (this migration has no benchmark)")
+				continue
+			}
+			if err := m.Benchmark(); err != nil {
+				return fmt.Errorf("v%s: %w", m.Version, err)
+			}
+			continue
+		}
+
+		if cfg.DryRun {
+			fmt.Printf("Dry run of v%s: %s\n", m.Version, m.Description)
+			if m.DryRun == nil {
+				fmt.Println("  (this migration has no dry run report)")
+				continue
+			}
+			if err := m.DryRun(); err != nil {
+				return fmt.Errorf("v%s: %w", m.Version, err)
+			}
+			continue
+		}
+
+		logger.Info("applying migration", "version", m.Version.String(), "description", m.Description)
+		start := time.Now()
+		if err := m.Up(); err != nil {
+			return fmt.Errorf("v%s failed: %w", m.Version, err)
+		}
+		if err := recordMigration(m); err != nil {
+			return err
+		}
+		logger.Info("applied migration", "version", m.Version.String(), "elapsed", time.Since(start).Round(time.Millisecond).String())
+		ran++
+
+		// resuming only makes sense for the first migration we run
+		cfg.Resume = false
+	}
+
+	if ran == 0 && !cfg.DryRun && !cfg.Benchmark {
+		logger.Info("the database is already up to date")
+	}
+	return nil
+}
+
+func runDown() error {
+	applied, err := appliedMigrations()
+	if err != nil {
+		return err
+	}
+
+	// by default, only the latest applied migration is undone
+	var toUndo []*Migration
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		if cfg.TargetVersion == "" {
+			toUndo = append(toUndo, m)
+			break
+		}
+
+		target, err := parseVersion(cfg.TargetVersion)
+		if err != nil {
+			return err
+		}
+		if !target.Less(m.Version) {
+			break
+		}
+		toUndo = append(toUndo, m)
+	}
+
+	if len(toUndo) == 0 {
+		fmt.Println("There are no migrations to undo")
+		return nil
+	}
+
+	for _, m := range toUndo {
+		if m.Down == nil {
+			return fmt.Errorf("v%s (%s) cannot be undone", m.Version, m.Description)
+		}
+	}
+
+	fmt.Printf("This will undo %d migration(s):\n", len(toUndo))
+	for _, m := range toUndo {
+		fmt.Printf("  v%s: %s\n", m.Version, m.Description)
+	}
+	if !confirm("Continue?") {
+		fmt.Println("Not undoing migrations")
+		return nil
+	}
+
+	for _, m := range toUndo {
+		logger.Info("undoing migration", "version", m.Version.String())
+		if err := m.Down(); err != nil {
+			return fmt.Errorf("failed to undo v%s: %w", m.Version, err)
+		}
+		if err := forgetMigration(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var errVerificationFailed = errors.New("verification failed")
+
+func runVerifyMigration() error {
+	var m *Migration
+	if cfg.TargetVersion != "" {
+		v, err := parseVersion(cfg.TargetVersion)
+		if err != nil {
+			return err
+		}
+		for _, candidate := range migrations {
+			if candidate.Version == v {
+				m = candidate
+			}
+		}
+		if m == nil {
+			return fmt.Errorf("there is no migration for v%s", v)
+		}
+	} else {
+		// default to the latest applied migration which can be verified
+		applied, err := appliedMigrations()
+		if err != nil {
+			return err
+		}
+		for i := len(migrations) - 1; i >= 0 && m == nil; i-- {
+			if _, ok := applied[migrations[i].Version]; ok && migrations[i].Verify != nil {
+				m = migrations[i]
+			}
+		}
+		if m == nil {
+			return errors.New("there are no applied migrations which can be verified")
+		}
+	}
+
+	if m.Verify == nil {
+		return fmt.Errorf("v%s has no verification", m.Version)
+	}
+
+	fmt.Fprintf(os.Stderr, "Verifying v%s: %s\n", m.Version, m.Description)
+	ok, err := m.Verify()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errVerificationFailed
+	}
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "status",
+		Summary: "list the registered migrations, and whether they have been applied",
+		Run:     runStatus,
+	})
+
+	registerCommand(&Command{
+		Name:              "up",
+		Summary:           "apply all pending migrations",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.TargetVersion, "to", "", "only migrate up to (and including) this version")
+			flags.BoolVar(&c.Resume, "resume", false, "continue an interrupted migration from its last checkpoint")
+			flags.BoolVar(&c.DryRun, "dry-run", false, "report what would be migrated without changing anything")
+			flags.BoolVar(&c.Benchmark, "benchmark", false, "time the migration with a sample of the rows, and several worker & commit sizes, without migrating (see benchmark.go)")
+			flags.Float64Var(&c.BenchmarkSample, "benchmark-sample", 1, "the percentage of each table's rows the benchmark inserts")
+			flags.StringVar(&c.BenchmarkWorkers, "benchmark-workers", "", "the numbers of workers to benchmark, comma separated (default: powers of 2, up to the free connections)")
+			flags.StringVar(&c.BenchmarkCommitEvery, "benchmark-commit-every", "1000,5000,20000", "the --commit-every sizes to benchmark, comma separated")
+			flags.BoolVar(&c.Online, "online", false, "migrate while bancho.py is still running, only stopping it for v4.2.0's cutover")
+			flags.BoolVar(&c.KeepScoreIDs, "keep-ids", false, "keep the scores' ids, rather than renumbering them, so their replays needn't move (see keepids.go)")
+			flags.StringVar(&c.IDOffsets, "id-offsets", "", "with --keep-ids, added to each table's ids so they don't collide, e.g. scores_rx=1000000000,scores_ap=2000000000")
+			flags.BoolVar(&c.NoSpaceCheck, "no-space-check", false, "migrate even if the disk space v4.2.0 needs doesn't look free (see diskspace.go)")
+			flags.StringVar(&c.ColumnMapPath, "column-map", "", "json file mapping the old tables' columns, if they've drifted from the expected schema (see preflight.go)")
+			flags.IntVar(&c.Workers, "workers", 0, "number of concurrent workers (default: tuned to the database's max_connections)")
+			flags.IntVar(&c.MaxRetries, "max-retries", 5, "times to retry a batch after a deadlock, lock wait timeout or lost connection")
+			flags.StringVar(&c.InsertMode, "insert-mode", insertModeRow, "how scores are inserted: row, multirow, or infile to use LOAD DATA LOCAL INFILE (see fastinsert.go)")
+			batchingFlags(flags, c)
+			filterFlags(flags, c)
+			flags.BoolVar(&c.DropOldTables, "drop-old-tables", false, "drop the old scores tables once they've been migrated, without asking (they're kept if any rows failed)")
+			flags.BoolVar(&c.DropFiltered, "drop-filtered", false, "with --drop-old-tables, drop them even if the filters left scores out, which are lost")
+			flags.BoolVar(&c.KeepOldTables, "keep-old-tables", false, "keep the old scores tables once they've been migrated, without asking")
+			flags.StringVar(&c.DeadLetterPath, "dead-letter", "", "file to write rows which failed to migrate to (default: DATA_DIRECTORY/migrate_dead_letters.jsonl)")
+			flags.StringVar(&c.ReplayJournalPath, "replay-journal", "", "journal of replay moves (default: DATA_DIRECTORY/migrate_replays.journal)")
+			flags.DurationVar(&c.ProgressInterval, "progress-interval", 10*time.Second, "how often to report progress (0 to disable)")
+			flags.StringVar(&c.ProgressFormat, "progress-format", "auto", "progress output format: tui for a dashboard, text, or log to report through the (structured) logger (default: tui on a terminal, otherwise text)")
+			replayStoreFlags(flags, c)
+		},
+		Run: runUp,
+	})
+
+	registerCommand(&Command{
+		Name:    "preflight",
+		Summary: "check the tables read by pending migrations have the schema they expect",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.ColumnMapPath, "column-map", "", "json file mapping the old tables' columns, if they've drifted from the expected schema (see preflight.go)")
+		},
+		Run: runPreflight,
+	})
+
+	registerCommand(&Command{
+		Name:              "down",
+		Summary:           "undo the latest applied migration",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.TargetVersion, "to", "", "undo every migration newer than this version")
+			flags.StringVar(&c.ReplayJournalPath, "replay-journal", "", "journal of replay moves (default: DATA_DIRECTORY/migrate_replays.journal)")
+			replayStoreFlags(flags, c)
+		},
+		Run: runDown,
+	})
+
+	registerCommand(&Command{
+		Name:              "verify",
+		Summary:           "cross-check the results of an applied migration",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.TargetVersion, "version", "", "the migration to verify (default: the latest applied)")
+			flags.StringVar(&c.ReportPath, "report", "", "write the verification report as json to this path (- for stdout)")
+			replayStoreFlags(flags, c)
+		},
+		Run: runVerifyMigration,
+	})
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+)
+
+// a reader for maxmind's .mmdb databases (GeoLite2-Country, GeoLite2-City,
+// etc.), as documented at https://maxmind.github.io/MaxMind-DB/. the whole
+// file is read into memory, which is ~10mb for the country database. it
+// only decodes what lookups need: the search tree, and the data section's
+// values as maps, slices, strings & numbers.
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// MMDB is an opened .mmdb database.
+type MMDB struct {
+	data       []byte
+	tree       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint // the node ipv4 addresses start from, in ipv6 trees
+	dataStart  int
+}
+
+// openMMDB reads a .mmdb database.
+func openMMDB(path string) (*MMDB, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	marker := bytes.LastIndex(data, mmdbMetadataMarker)
+	if marker < 0 {
+		return nil, fmt.Errorf("%s is not a maxmind database", path)
+	}
+
+	db := &MMDB{data: data}
+	metadataStart := marker + len(mmdbMetadataMarker)
+	value, _, err := db.decode(data[metadataStart:], 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: failed to read the metadata: %w", path, err)
+	}
+	metadata, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: malformed metadata", path)
+	}
+	for key, field := range map[string]*uint{"node_count": &db.nodeCount, "record_size": &db.recordSize, "ip_version": &db.ipVersion} {
+		n, ok := metadata[key].(uint64)
+		if !ok {
+			return nil, fmt.Errorf("%s: metadata has no %s", path, key)
+		}
+		*field = uint(n)
+	}
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("%s: unsupported record size %d", path, db.recordSize)
+	}
+
+	treeSize := int(db.nodeCount * db.recordSize / 4)
+	if treeSize+16 > marker {
+		return nil, fmt.Errorf("%s: truncated search tree", path)
+	}
+	db.tree = data[:treeSize]
+	db.dataStart = treeSize + 16
+	db.data = data[:marker]
+
+	// ipv4 addresses are at ::a.b.c.d in ipv6 trees, past 96 zero bits
+	if db.ipVersion == 6 {
+		for i := 0; i < 96 && db.ipv4Start < db.nodeCount; i++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// record reads one of a node's two records, 0 for left, 1 for right.
+func (db *MMDB) record(node uint, side int) uint {
+	b := db.tree[node*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		b = b[side*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if side == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[side*4:]))
+	}
+}
+
+// Lookup returns the data for an address, or nil if it isn't in the database.
+func (db *MMDB) Lookup(ip netip.Addr) (map[string]interface{}, error) {
+	ip = ip.Unmap()
+	node, bits := uint(0), ip.AsSlice()
+	if ip.Is4() && db.ipVersion == 6 {
+		node = db.ipv4Start
+	} else if ip.Is6() && db.ipVersion == 4 {
+		return nil, nil
+	}
+
+	for i := 0; i < len(bits)*8 && node < db.nodeCount; i++ {
+		bit := int(bits[i/8]>>(7-i%8)) & 1
+		node = db.record(node, bit)
+	}
+	if node == db.nodeCount {
+		return nil, nil
+	}
+	if node < db.nodeCount {
+		return nil, errors.New("the search tree is deeper than the address")
+	}
+
+	offset := int(node-db.nodeCount) - 16
+	value, _, err := db.decode(db.data[db.dataStart:], offset)
+	if err != nil {
+		return nil, err
+	}
+	record, _ := value.(map[string]interface{})
+	return record, nil
+}
+
+// decode reads the value at offset in a data section, returning it & the
+// offset after it.
+func (db *MMDB) decode(section []byte, offset int) (interface{}, int, error) {
+	if offset >= len(section) {
+		return nil, 0, errors.New("offset past the end of the data section")
+	}
+	ctrl := section[offset]
+	offset++
+	kind := int(ctrl >> 5)
+
+	if kind == 1 { // pointer, to an offset in the data section
+		size := int(ctrl>>3) & 3
+		if offset+size+1 > len(section) {
+			return nil, 0, errors.New("truncated pointer")
+		}
+		b := section[offset : offset+size+1]
+		var target int
+		switch size {
+		case 0:
+			target = int(ctrl&7)<<8 | int(b[0])
+		case 1:
+			target = (int(ctrl&7)<<16 | int(b[0])<<8 | int(b[1])) + 2048
+		case 2:
+			target = (int(ctrl&7)<<24 | int(b[0])<<16 | int(b[1])<<8 | int(b[2])) + 526336
+		default:
+			target = int(binary.BigEndian.Uint32(b))
+		}
+		value, _, err := db.decode(section, target)
+		return value, offset + size + 1, err
+	}
+
+	if kind == 0 { // extended types
+		if offset >= len(section) {
+			return nil, 0, errors.New("truncated extended type")
+		}
+		kind = 7 + int(section[offset])
+		offset++
+	}
+
+	size := int(ctrl & 0x1f)
+	if size >= 29 && kind != 14 {
+		n := size - 28
+		if offset+n > len(section) {
+			return nil, 0, errors.New("truncated size")
+		}
+		extra := 0
+		for _, b := range section[offset : offset+n] {
+			extra = extra<<8 | int(b)
+		}
+		size = []int{29, 285, 65821}[n-1] + extra
+		offset += n
+	}
+
+	// maps & arrays hold values, everything else holds size bytes
+	switch kind {
+	case 7:
+		m := make(map[string]interface{}, size)
+		for i := 0; i < size; i++ {
+			key, next, err := db.decode(section, offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, next, err := db.decode(section, next)
+			if err != nil {
+				return nil, 0, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			m[k] = value
+			offset = next
+		}
+		return m, offset, nil
+	case 11:
+		a := make([]interface{}, 0, size)
+		for i := 0; i < size; i++ {
+			value, next, err := db.decode(section, offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+			offset = next
+		}
+		return a, offset, nil
+	case 14:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > len(section) {
+		return nil, 0, errors.New("value past the end of the data section")
+	}
+	b := section[offset : offset+size]
+	offset += size
+	switch kind {
+	case 2:
+		return string(b), offset, nil
+	case 3:
+		if size != 8 {
+			return nil, 0, errors.New("malformed double")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 15:
+		if size != 4 {
+			return nil, 0, errors.New("malformed float")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case 4, 10: // bytes, & uint128s, which nothing here needs as numbers
+		return b, offset, nil
+	case 5, 6, 9:
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, offset, nil
+	case 8:
+		var n int32
+		for _, c := range b {
+			n = n<<8 | int32(c)
+		}
+		return int64(n), offset, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported data type %d", kind)
+}
+
+// mmdbString reads a string at a path of map keys, e.g. country, iso_code.
+func mmdbString(record map[string]interface{}, path ...string) string {
+	var value interface{} = record
+	for _, key := range path {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		value = m[key]
+	}
+	s, _ := value.(string)
+	return s
+}
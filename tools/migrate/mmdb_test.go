@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// encodeMMDB encodes a value for a .mmdb's data section, as maxmind's
+// writers do, see https://maxmind.github.io/MaxMind-DB/.
+func encodeMMDB(v interface{}) []byte {
+	var kind int
+	var size int
+	var payload []byte
+	switch v := v.(type) {
+	case string:
+		kind, size, payload = 2, len(v), []byte(v)
+	case float64:
+		kind, size, payload = 3, 8, binary.BigEndian.AppendUint64(nil, math.Float64bits(v))
+	case []byte:
+		kind, size, payload = 4, len(v), v
+	case uint16:
+		kind, size, payload = 5, 2, binary.BigEndian.AppendUint16(nil, v)
+	case uint32:
+		kind, size, payload = 6, 4, binary.BigEndian.AppendUint32(nil, v)
+	case map[string]interface{}:
+		kind, size = 7, len(v)
+		for key, value := range v {
+			payload = append(payload, encodeMMDB(key)...)
+			payload = append(payload, encodeMMDB(value)...)
+		}
+	case int32:
+		kind, size, payload = 8, 4, binary.BigEndian.AppendUint32(nil, uint32(v))
+	case uint64:
+		kind, size, payload = 9, 8, binary.BigEndian.AppendUint64(nil, v)
+	case []interface{}:
+		kind, size = 11, len(v)
+		for _, value := range v {
+			payload = append(payload, encodeMMDB(value)...)
+		}
+	case bool:
+		kind = 14
+		if v {
+			size = 1
+		}
+	case float32:
+		kind, size, payload = 15, 4, binary.BigEndian.AppendUint32(nil, math.Float32bits(v))
+	default:
+		panic("can't encode a " + reflect.TypeOf(v).String())
+	}
+
+	var extra []byte
+	switch {
+	case size < 29:
+	case size < 285:
+		extra, size = []byte{byte(size - 29)}, 29
+	case size < 65821:
+		extra, size = binary.BigEndian.AppendUint16(nil, uint16(size-285)), 30
+	default:
+		extra, size = binary.BigEndian.AppendUint32(nil, uint32(size-65821))[1:], 31
+	}
+	out := []byte{byte(kind<<5 | size)}
+	if kind > 7 {
+		out = []byte{byte(size), byte(kind - 7)}
+	}
+	out = append(out, extra...)
+	return append(out, payload...)
+}
+
+// writeTestMMDB writes a .mmdb of 24 bit records, with a record for each
+// network, which mustn't overlap. ipv4 networks in ipv6 databases are at
+// ::a.b.c.d, as in maxmind's.
+func writeTestMMDB(t *testing.T, ipVersion int, networks map[string]map[string]interface{}) *MMDB {
+	t.Helper()
+	const empty = -1
+	type record struct{ node, data int } // a child node, a data offset, or neither
+	newNode := func() [2]record { return [2]record{{0, empty}, {0, empty}} }
+	nodes := [][2]record{newNode()}
+
+	var section []byte
+	for network, value := range networks {
+		prefix := netip.MustParsePrefix(network)
+		addr, bits := prefix.Addr().AsSlice(), prefix.Bits()
+		if ipVersion == 6 && prefix.Addr().Is4() {
+			addr, bits = append(make([]byte, 12), addr...), bits+96
+		}
+
+		node := 0
+		for i := 0; i < bits; i++ {
+			bit := int(addr[i/8]>>(7-i%8)) & 1
+			if i == bits-1 {
+				nodes[node][bit] = record{data: len(section)}
+				break
+			}
+			if nodes[node][bit].node == 0 {
+				nodes = append(nodes, newNode())
+				nodes[node][bit] = record{node: len(nodes) - 1, data: empty}
+			}
+			node = nodes[node][bit].node
+		}
+		section = append(section, encodeMMDB(value)...)
+	}
+
+	var data []byte
+	for _, n := range nodes {
+		for _, r := range n {
+			v := len(nodes) // not found
+			if r.node != 0 {
+				v = r.node
+			} else if r.data != empty {
+				v = len(nodes) + 16 + r.data
+			}
+			data = append(data, byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+	data = append(data, make([]byte, 16)...)
+	data = append(data, section...)
+	data = append(data, mmdbMetadataMarker...)
+	data = append(data, encodeMMDB(map[string]interface{}{
+		"node_count":    uint32(len(nodes)),
+		"record_size":   uint16(24),
+		"ip_version":    uint16(ipVersion),
+		"database_type": "Test-Country",
+	})...)
+
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := openMMDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func country(code string) map[string]interface{} {
+	return map[string]interface{}{"country": map[string]interface{}{"iso_code": code}}
+}
+
+func TestMMDBLookup(t *testing.T) {
+	for _, ipVersion := range []int{4, 6} {
+		networks := map[string]map[string]interface{}{
+			"1.0.0.0/8":    country("AU"),
+			"2.3.0.0/16":   country("FR"),
+			"81.2.69.0/24": country("GB"),
+		}
+		if ipVersion == 6 {
+			networks["2001:db8::/32"] = country("NL")
+		}
+		db := writeTestMMDB(t, ipVersion, networks)
+
+		for _, tt := range []struct {
+			ip   string
+			want string // "" if not found
+			v6   bool   // only in the ipv6 database
+		}{
+			{"1.2.3.4", "AU", false},
+			{"1.255.255.255", "AU", false},
+			{"2.3.4.5", "FR", false},
+			{"2.4.0.1", "", false},
+			{"81.2.69.160", "GB", false},
+			{"81.2.70.1", "", false},
+			{"::ffff:1.2.3.4", "AU", false},
+			{"2001:db8::1", "NL", true},
+			{"2001:db9::1", "", true},
+		} {
+			want := tt.want
+			if tt.v6 && ipVersion == 4 {
+				want = ""
+			}
+			record, err := db.Lookup(netip.MustParseAddr(tt.ip))
+			if err != nil {
+				t.Errorf("ipv%d: Lookup(%s) = %v", ipVersion, tt.ip, err)
+				continue
+			}
+			if got := mmdbString(record, "country", "iso_code"); got != want {
+				t.Errorf("ipv%d: Lookup(%s) = %q, want %q", ipVersion, tt.ip, got, want)
+			}
+		}
+	}
+}
+
+func TestOpenMMDBErrors(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string][]byte{
+		"no marker":        []byte("not a database"),
+		"no node count":    append(append(make([]byte, 16), mmdbMetadataMarker...), encodeMMDB(map[string]interface{}{"record_size": uint16(24), "ip_version": uint16(4)})...),
+		"bad record size":  append(append(make([]byte, 16), mmdbMetadataMarker...), encodeMMDB(map[string]interface{}{"node_count": uint32(0), "record_size": uint16(20), "ip_version": uint16(4)})...),
+		"truncated tree":   append(append(make([]byte, 16), mmdbMetadataMarker...), encodeMMDB(map[string]interface{}{"node_count": uint32(100), "record_size": uint16(24), "ip_version": uint16(4)})...),
+		"metadata not map": append(append([]byte{}, mmdbMetadataMarker...), encodeMMDB("metadata")...),
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := openMMDB(path); err == nil {
+			t.Errorf("%s: openMMDB() succeeded, want an error", name)
+		}
+	}
+}
+
+func TestMMDBRecord(t *testing.T) {
+	for _, tt := range []struct {
+		size        uint
+		node        []byte
+		left, right uint
+	}{
+		{24, []byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc}, 0x123456, 0x789abc},
+		{28, []byte{0x12, 0x34, 0x56, 0xab, 0x78, 0x9a, 0xbc}, 0xa123456, 0xb789abc},
+		{32, []byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0}, 0x12345678, 0x9abcdef0},
+	} {
+		// the node's second in the tree, after one of zeroes
+		tree := append(make([]byte, len(tt.node)), tt.node...)
+		db := &MMDB{tree: tree, recordSize: tt.size}
+		if left, right := db.record(1, 0), db.record(1, 1); left != tt.left || right != tt.right {
+			t.Errorf("%d bit records = %#x, %#x, want %#x, %#x", tt.size, left, right, tt.left, tt.right)
+		}
+	}
+}
+
+func TestMMDBDecode(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		data []byte
+		want interface{}
+	}{
+		{"string", encodeMMDB("Australia"), "Australia"},
+		{"long string", encodeMMDB(string(make([]byte, 300))), string(make([]byte, 300))},
+		{"double", encodeMMDB(-33.494), -33.494},
+		{"float", encodeMMDB(float32(0.5)), 0.5},
+		{"bytes", encodeMMDB([]byte{1, 2}), []byte{1, 2}},
+		{"uint16", encodeMMDB(uint16(1000)), uint64(1000)},
+		{"uint32", encodeMMDB(uint32(2077456)), uint64(2077456)},
+		{"short uint32", []byte{0xc1, 0x2a}, uint64(42)},
+		{"uint64", encodeMMDB(uint64(1) << 40), uint64(1) << 40},
+		{"int32", encodeMMDB(int32(-7)), int64(-7)},
+		{"true", encodeMMDB(true), true},
+		{"false", encodeMMDB(false), false},
+		{"array", encodeMMDB([]interface{}{"en", uint16(1)}), []interface{}{"en", uint64(1)}},
+		{"map", encodeMMDB(country("AU")), country("AU")},
+		// a pointer to the string at offset 0, after which it's read
+		{"pointer", append(encodeMMDB("AU"), 0x20, 0x00), "AU"},
+	} {
+		offset := 0
+		if tt.name == "pointer" {
+			offset = 3
+		}
+		got, _, err := (&MMDB{}).decode(tt.data, offset)
+		if err != nil {
+			t.Errorf("%s: decode() = %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: decode() = %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMMDBDecodeErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"truncated string", []byte{0x45, 'a'}},
+		{"truncated pointer", []byte{0x28}},
+		{"truncated extended type", []byte{0x01}},
+		{"truncated size", []byte{0x5e, 0x01}},
+		{"map key not a string", []byte{0xe1, 0xc1, 0x01, 0xc1, 0x01}},
+		{"malformed double", []byte{0x62, 0, 0}},
+		{"unsupported type", []byte{0x00, 0x05}},
+	} {
+		if _, _, err := (&MMDB{}).decode(tt.data, 0); err == nil {
+			t.Errorf("%s: decode() succeeded, want an error", tt.name)
+		}
+	}
+}
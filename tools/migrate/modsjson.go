@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// lazer describes mods as a list of acronyms, each with its settings,
+// instead of stable's bitmask, e.g. [{"acronym":"DT","settings":
+// {"speed_change":1.5}}]. scores.mods_json keeps a score's mods in lazer's
+// form, alongside the bitmask, for the transition to lazer's mods. until
+// bancho.py writes it itself, the bitmask is the authority, and
+// scores mods-json brings mods_json back in line with it.
+//
+// mods_json isn't part of bancho.py's schema (migrations/base.sql), so it's
+// only there once --action add has added it, filling it in from the
+// bitmask a batch at a time, so bancho.py can keep running; the scores it
+// submits meanwhile are filled in by --action sync. --action drop removes it.
+
+// the rates stable's speed mods play at, which lazer lets be changed
+const (
+	doubleTimeRate = 1.5
+	halfTimeRate   = 0.75
+)
+
+var errModsJSONMismatched = errors.New("scores with mods_json which disagrees with their mods were found")
+
+// LazerMod is a mod as lazer describes it.
+type LazerMod struct {
+	Acronym  string         `json:"acronym"`
+	Settings map[string]any `json:"settings,omitempty"`
+}
+
+// lazerModsFromLegacy converts stable's mods to lazer's, with the settings
+// which make them play as they do on stable.
+func lazerModsFromLegacy(mods int) []LazerMod {
+	lazerMods := []LazerMod{}
+	for _, acronym := range acronymsFromMods(mods) {
+		mod := LazerMod{Acronym: acronym}
+		switch acronym {
+		case "DT", "NC":
+			mod.Settings = map[string]any{"speed_change": doubleTimeRate}
+		case "HT":
+			mod.Settings = map[string]any{"speed_change": halfTimeRate}
+		}
+		lazerMods = append(lazerMods, mod)
+	}
+	return lazerMods
+}
+
+// legacyFromLazerMods converts lazer's mods to stable's, failing for mods,
+// or settings, which stable has no equivalent of.
+func legacyFromLazerMods(lazerMods []LazerMod) (int, error) {
+	acronyms := make([]string, 0, len(lazerMods))
+	for _, mod := range lazerMods {
+		acronym := strings.ToUpper(mod.Acronym)
+		for name, value := range mod.Settings {
+			rate, ok := value.(float64)
+			switch {
+			case name != "speed_change":
+				return 0, fmt.Errorf("%s's %s setting has no stable equivalent", acronym, name)
+			case !ok:
+				return 0, fmt.Errorf("%s's speed_change is %v, not a number", acronym, value)
+			case (acronym == "DT" || acronym == "NC") && rate == doubleTimeRate,
+				acronym == "HT" && rate == halfTimeRate:
+			default:
+				return 0, fmt.Errorf("%s at %gx has no stable equivalent", acronym, rate)
+			}
+		}
+		acronyms = append(acronyms, acronym)
+	}
+
+	mods, unsupported := modsFromAcronyms(acronyms)
+	if len(unsupported) != 0 {
+		return 0, fmt.Errorf("mods %s have no stable equivalent", strings.Join(unsupported, ", "))
+	}
+	return mods, nil
+}
+
+// modsJSON is stable's mods as lazer's, encoded for mods_json.
+func modsJSON(mods int) string {
+	data, _ := json.Marshal(lazerModsFromLegacy(mods))
+	return string(data)
+}
+
+// modsFromJSON decodes mods_json back into stable's mods.
+func modsFromJSON(data string) (int, error) {
+	var lazerMods []LazerMod
+	if err := json.Unmarshal([]byte(data), &lazerMods); err != nil {
+		return 0, err
+	}
+	return legacyFromLazerMods(lazerMods)
+}
+
+var count_mods_json_column = `
+SELECT COUNT(*) FROM information_schema.columns
+WHERE table_schema = DATABASE() AND table_name = 'scores' AND column_name = 'mods_json'`
+
+var add_mods_json = `
+ALTER TABLE scores ADD COLUMN mods_json JSON NULL AFTER mods`
+
+// hasModsJSON reports whether scores.mods_json exists.
+func hasModsJSON() (bool, error) {
+	var count int
+	err := DB.Get(&count, count_mods_json_column)
+	return count != 0, err
+}
+
+var select_missing_mods_json = `
+SELECT id, mods FROM scores WHERE id > ? AND mods_json IS NULL ORDER BY id LIMIT ?`
+
+// scores submitted meanwhile may have been filled in by bancho.py
+var fill_mods_json = `
+UPDATE scores SET mods_json = ? WHERE id IN (?) AND mods_json IS NULL`
+
+// mods_json is compared by what it decodes to, not as text, as the
+// database is free to reformat json
+var select_mods_json_pairs = `
+SELECT mods, CAST(mods_json AS CHAR) AS mods_json, COUNT(*) AS count FROM scores
+WHERE mods_json IS NOT NULL GROUP BY mods, CAST(mods_json AS CHAR)`
+
+var update_mismatched_mods_json = `
+UPDATE scores SET mods_json = ? WHERE mods = ? AND CAST(mods_json AS CHAR) = ?`
+
+type modsJSONPair struct {
+	Mods     int
+	ModsJSON string `db:"mods_json"`
+	Count    int64
+}
+
+// ModsJSONProblem is a combination of mods & mods_json which disagree.
+type ModsJSONProblem struct {
+	Mods     int    `json:"mods"`
+	ModsJSON string `json:"mods_json"`
+	Scores   int64  `json:"scores"`
+	Problem  string `json:"problem"`
+}
+
+// ModsJSONReport is the result of checking mods_json against mods.
+type ModsJSONReport struct {
+	Missing    int64             `json:"missing"` // scores without mods_json
+	Mismatched int64             `json:"mismatched"`
+	Fixed      int64             `json:"fixed"`
+	Problems   []ModsJSONProblem `json:"problems"`
+}
+
+// fillModsJSON sets mods_json for the scores without it, a batch at a time
+// in order of id, so it can run while bancho.py is. it returns how many
+// scores were filled.
+func fillModsJSON() (int64, error) {
+	var filled, lastID int64
+	for {
+		if isInterrupted() {
+			return filled, errInterrupted
+		}
+		var scores []struct {
+			ID   int64
+			Mods int
+		}
+		if err := DB.Select(&scores, select_missing_mods_json, lastID, BatchSize); err != nil {
+			return filled, err
+		}
+		if len(scores) == 0 {
+			return filled, nil
+		}
+		lastID = scores[len(scores)-1].ID
+
+		byJSON := make(map[string][]int64)
+		for _, s := range scores {
+			encoded := modsJSON(s.Mods)
+			byJSON[encoded] = append(byJSON[encoded], s.ID)
+		}
+		if err := throttle(len(scores)); err != nil {
+			return filled, err
+		}
+		for encoded, ids := range byJSON {
+			query, args, err := sqlx.In(fill_mods_json, encoded, ids)
+			if err != nil {
+				return filled, err
+			}
+			res, err := DB.Exec(query, args...)
+			if err != nil {
+				return filled, err
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return filled, err
+			}
+			filled += n
+		}
+		logger.Debug("filled mods_json", "last_id", lastID, "filled", filled)
+	}
+}
+
+// checkModsJSON finds the scores whose mods_json is missing, or which
+// disagrees with their mods.
+func checkModsJSON() (*ModsJSONReport, error) {
+	report := &ModsJSONReport{Problems: []ModsJSONProblem{}}
+	if err := DB.Get(&report.Missing, "SELECT COUNT(*) FROM scores WHERE mods_json IS NULL"); err != nil {
+		return nil, err
+	}
+
+	var pairs []modsJSONPair
+	if err := DB.Select(&pairs, select_mods_json_pairs); err != nil {
+		return nil, err
+	}
+	for _, pair := range pairs {
+		mods, err := modsFromJSON(pair.ModsJSON)
+		problem := ""
+		switch {
+		case err != nil:
+			problem = err.Error()
+		case mods != pair.Mods:
+			problem = fmt.Sprintf("mods_json is mods %d", mods)
+		default:
+			continue
+		}
+		report.Mismatched += pair.Count
+		report.Problems = append(report.Problems, ModsJSONProblem{pair.Mods, pair.ModsJSON, pair.Count, problem})
+	}
+	return report, nil
+}
+
+// printModsJSONReport prints what checkModsJSON found.
+func printModsJSONReport(report *ModsJSONReport) {
+	fmt.Printf("scores: %d without mods_json, %d with mods_json which disagrees with their mods\n",
+		report.Missing, report.Mismatched)
+	for i, p := range report.Problems {
+		if i == maxExamples {
+			fmt.Printf("  ... and %d more\n", len(report.Problems)-maxExamples)
+			break
+		}
+		fmt.Printf("  mods %d, mods_json %s (%d scores): %s\n", p.Mods, p.ModsJSON, p.Scores, p.Problem)
+	}
+}
+
+// printModsJSONPreview prints what --action add would fill mods_json in with.
+func printModsJSONPreview() error {
+	var counts []struct {
+		Mods  int
+		Count int64
+	}
+	if err := DB.Select(&counts, "SELECT mods, COUNT(*) AS count FROM scores GROUP BY mods ORDER BY count DESC"); err != nil {
+		return err
+	}
+
+	var total int64
+	for _, c := range counts {
+		total += c.Count
+	}
+	fmt.Println("scores.mods_json doesn't exist, --action add would add it")
+	fmt.Printf("  %d scores, with %d combinations of mods, would have mods_json filled in\n", total, len(counts))
+	for i, c := range counts {
+		if i == maxExamples {
+			break
+		}
+		fmt.Printf("  %-10d %-12s %s\n", c.Count, strings.Join(acronymsFromMods(c.Mods), ""), modsJSON(c.Mods))
+	}
+	return nil
+}
+
+// addModsJSON adds scores.mods_json, and fills it in.
+func addModsJSON() error {
+	// ctrl-c stops filling in mods_json, which the next run picks up again
+	handleSignals()
+
+	exists, err := hasModsJSON()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		logger.Info("adding scores.mods_json")
+		if _, err := DB.Exec(add_mods_json); err != nil {
+			return err
+		}
+	}
+
+	filled, err := fillModsJSON()
+	if err != nil {
+		return err
+	}
+	logger.Info("filled in mods_json", "scores", filled)
+	return nil
+}
+
+// dropModsJSON removes scores.mods_json.
+func dropModsJSON() error {
+	exists, err := hasModsJSON()
+	if err != nil || !exists {
+		return err
+	}
+	if !confirm("This will drop scores.mods_json. Continue?") {
+		return errors.New("not dropping scores.mods_json")
+	}
+	_, err = DB.Exec("ALTER TABLE scores DROP COLUMN mods_json")
+	return err
+}
+
+func runScoresModsJSON() error {
+	switch cfg.ModsJSONAction {
+	case "report", "sync":
+	case "add":
+		return addModsJSON()
+	case "drop":
+		return dropModsJSON()
+	default:
+		return fmt.Errorf("unknown --action %q, expected report, sync, add or drop", cfg.ModsJSONAction)
+	}
+	start := time.Now()
+
+	exists, err := hasModsJSON()
+	if err != nil {
+		return err
+	}
+	if !exists && cfg.ModsJSONAction == "report" {
+		return printModsJSONPreview()
+	} else if !exists {
+		return errors.New("scores.mods_json doesn't exist, add it with --action add")
+	}
+
+	report, err := checkModsJSON()
+	if err != nil {
+		return fmt.Errorf("failed to check mods_json: %w", err)
+	}
+	printModsJSONReport(report)
+	found := report.Missing + report.Mismatched
+
+	if found != 0 && cfg.ModsJSONAction == "sync" {
+		handleSignals()
+
+		for _, p := range report.Problems {
+			res, err := DB.Exec(update_mismatched_mods_json, modsJSON(p.Mods), p.Mods, p.ModsJSON)
+			if err != nil {
+				return fmt.Errorf("failed to rewrite mods_json: %w", err)
+			}
+			n, _ := res.RowsAffected()
+			report.Fixed += n
+		}
+		filled, err := fillModsJSON()
+		report.Fixed += filled
+		if err != nil {
+			return fmt.Errorf("failed to fill mods_json: %w", err)
+		}
+		logger.Info("synced mods_json with mods", "fixed", report.Fixed)
+	}
+
+	if err := writeReport(cfg.ReportPath, report); err != nil {
+		return err
+	}
+	logger.Info("scores mods-json finished", "found", found, "action", cfg.ModsJSONAction,
+		"elapsed", time.Since(start).Round(time.Second))
+	if found != 0 && cfg.ModsJSONAction == "report" {
+		return errModsJSONMismatched
+	}
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "scores mods-json",
+		Summary: "add scores.mods_json (lazer's mods), check it against scores' mods, and fill in or rewrite it from them",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.ModsJSONAction, "action", "report", "what to do: report, sync (mods_json is rewritten from mods), add (the column, filled in) or drop (the column)")
+			flags.StringVar(&c.ReportPath, "report", "", "write what was found as json to this path (- for stdout)")
+		},
+		Run: runScoresModsJSON,
+	})
+}
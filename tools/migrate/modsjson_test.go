@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func TestModsJSON(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		mods int
+		json string
+		// the mods read back, when it's not mods itself
+		back int
+	}{
+		{"nomod", 0, `[]`, -1},
+		{"hidden hard rock", modHidden | modHardRock, `[{"acronym":"HD"},{"acronym":"HR"}]`, -1},
+		{"double time", modDoubleTime, `[{"acronym":"DT","settings":{"speed_change":1.5}}]`, -1},
+		{"half time", modHalfTime | modEasy, `[{"acronym":"EZ"},{"acronym":"HT","settings":{"speed_change":0.75}}]`, -1},
+		{"nightcore replaces double time", modNightcore | modDoubleTime, `[{"acronym":"NC","settings":{"speed_change":1.5}}]`, -1},
+		// often sent without double time's bit, which reads back with it
+		{"nightcore alone", modNightcore, `[{"acronym":"NC","settings":{"speed_change":1.5}}]`, modNightcore | modDoubleTime},
+		{"perfect replaces sudden death", modPerfect | modSuddenDeath, `[{"acronym":"PF"}]`, -1},
+		{"perfect alone", modPerfect, `[{"acronym":"PF"}]`, modPerfect | modSuddenDeath},
+		{"relax", modRelax | modHidden, `[{"acronym":"HD"},{"acronym":"RX"}]`, -1},
+		{"mania keys & score v2", 1<<15 | 1<<29, `[{"acronym":"4K"},{"acronym":"SV2"}]`, -1},
+	} {
+		if got := modsJSON(tt.mods); got != tt.json {
+			t.Errorf("%s: modsJSON(%d) = %s, want %s", tt.name, tt.mods, got, tt.json)
+		}
+		want := tt.back
+		if want == -1 {
+			want = tt.mods
+		}
+		if got, err := modsFromJSON(tt.json); err != nil || got != want {
+			t.Errorf("%s: modsFromJSON(%s) = %d, %v, want %d", tt.name, tt.json, got, err, want)
+		}
+	}
+}
+
+func TestModsFromJSON(t *testing.T) {
+	for _, tt := range []struct {
+		json string
+		want int
+		ok   bool
+	}{
+		{`[{"acronym":"hd"},{"acronym":"dt","settings":{"speed_change":1.5}}]`, modHidden | modDoubleTime, true},
+		// classic is what stable scores are
+		{`[{"acronym":"CL"},{"acronym":"HR"}]`, modHardRock, true},
+		{`[{"acronym":"DT"}]`, modDoubleTime, true},
+		{`[{"acronym":"DT","settings":{"speed_change":1.25}}]`, 0, false},
+		{`[{"acronym":"HT","settings":{"speed_change":1.5}}]`, 0, false},
+		{`[{"acronym":"HR","settings":{"adjust_pitch":true}}]`, 0, false},
+		{`[{"acronym":"DT","settings":{"speed_change":"fast"}}]`, 0, false},
+		{`[{"acronym":"DA"}]`, 0, false},
+		{`{"acronym":"HD"}`, 0, false},
+	} {
+		got, err := modsFromJSON(tt.json)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("modsFromJSON(%s) = %d, %v, want %d (ok %v)", tt.json, got, err, tt.want, tt.ok)
+		}
+	}
+}
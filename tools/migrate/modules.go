@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// forks of bancho.py often add tables of their own (clan invites, badges,
+// etc), which import gulag would otherwise leave behind. they can be
+// carried over by registering a TableMapping, either from a go file of
+// their own (calling registerTableMapping from init), or without any code,
+// by listing them in a json file given to --tables, e.g.
+//
+//	[{
+//		"table": "clan_invites",
+//		"create": "create table if not exists clan_invites (id int auto_increment primary key, clan int not null, userid int not null)",
+//		"depends_on": ["clans", "users"],
+//		"user_column": "userid",
+//		"columns": {"id": "id", "clan": "clan_id", "userid": "userid"}
+//	}]
+
+// TableMapping describes how to copy a table which needs no special handling.
+type TableMapping struct {
+	Table  string `json:"table"`  // in the new database
+	Source string `json:"source"` // in the old database, if it was named differently
+
+	// each new column, and the old column (or sql expression over the old
+	// row) it's copied from. when empty, every column the old & new tables
+	// have in common is copied as-is.
+	Columns map[string]string `json:"columns"`
+
+	// rows belonging to users which weren't imported are left out
+	UserColumn string `json:"user_column"`
+
+	DependsOn []string `json:"depends_on"`
+
+	// creates the table, if it isn't in base.sql
+	Create string `json:"create"`
+}
+
+// registerTableMapping makes a table importable with a mapping, and is
+// intended to be called from init functions.
+func registerTableMapping(m TableMapping) {
+	registerTableConverter(m.converter())
+}
+
+func (m TableMapping) converter() *TableConverter {
+	return &TableConverter{
+		Table:     m.Table,
+		DependsOn: m.DependsOn,
+		Create:    m.Create,
+		Convert:   m.convert,
+	}
+}
+
+func (m TableMapping) convert(src *OldSchema) (int64, error) {
+	source := m.Source
+	if source == "" {
+		source = m.Table
+	}
+	if !src.Has(source) {
+		return 0, nil
+	}
+
+	columns, exprs := make([]string, 0, len(m.Columns)), make([]string, 0, len(m.Columns))
+	if len(m.Columns) == 0 {
+		newColumns, err := tableColumns(cfg.DBName, m.Table)
+		if err != nil {
+			return 0, err
+		}
+		for _, column := range newColumns {
+			if src.HasColumn(source, column) {
+				columns = append(columns, "`"+column+"`")
+				exprs = append(exprs, "`"+column+"`")
+			}
+		}
+	} else {
+		for column := range m.Columns {
+			columns = append(columns, column)
+		}
+		sort.Strings(columns)
+		for i, column := range columns {
+			exprs = append(exprs, m.Columns[column])
+			columns[i] = "`" + column + "`"
+		}
+	}
+	if len(columns) == 0 {
+		return 0, fmt.Errorf("%s has no columns in common with %s", m.Table, src.Table(source))
+	}
+
+	// a subquery, rather than a join, so columns don't need qualifying
+	var filter string
+	if m.UserColumn != "" {
+		filter = fmt.Sprintf("WHERE `%s` IN (SELECT id FROM users)", m.UserColumn)
+	}
+	return copyRows(fmt.Sprintf("INSERT IGNORE INTO %s (%s) SELECT %s FROM %s %s",
+		m.Table, strings.Join(columns, ", "), strings.Join(exprs, ", "), src.Table(source), filter))
+}
+
+// tableColumns returns the columns of a table, in order.
+func tableColumns(schema, table string) ([]string, error) {
+	var columns []string
+	err := DB.Select(&columns, `
+	SELECT column_name FROM information_schema.columns
+	WHERE table_schema = ? AND table_name = ? ORDER BY ordinal_position`, schema, table)
+	return columns, err
+}
+
+// loadTableMappings registers the mappings listed in a json file.
+func loadTableMappings(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var mappings []TableMapping
+	if err := json.Unmarshal(data, &mappings); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	for i, m := range mappings {
+		if !validSchemaName.MatchString(m.Table) {
+			return fmt.Errorf("%s: table %d has an invalid name %q", path, i, m.Table)
+		}
+		if m.Source != "" && !validSchemaName.MatchString(m.Source) {
+			return fmt.Errorf("%s: %s has an invalid source table %q", path, m.Table, m.Source)
+		}
+		if m.UserColumn != "" && !validSchemaName.MatchString(m.UserColumn) {
+			return fmt.Errorf("%s: %s has an invalid user column %q", path, m.Table, m.UserColumn)
+		}
+		if tableConverters[m.Table] != nil {
+			return fmt.Errorf("%s: %s is already imported", path, m.Table)
+		}
+		tableConverters[m.Table] = m.converter()
+	}
+	return nil
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// mojibake is text which was encoded as utf-8, then decoded as latin1 (which
+// is cp1252 to mysql), e.g. "Ã©" for "é", or "æ—¥æœ¬" for "日本". old gulag
+// databases are full of it: their clients wrote utf-8 into latin1 columns,
+// which charset convert's conversion to utf8mb4 then faithfully keeps. it can often
+// be undone by encoding the text as cp1252 again, and decoding the bytes as
+// utf-8, which is only done when they are valid utf-8.
+//
+// charset mojibake looks for it in every text column (scores' are only ever
+// hashes & grades, so they're skipped, unless --tables names them), and
+// --action redecode replaces each value found with what it decodes to.
+
+// cp1252's characters for bytes 0x80-0x9f. the bytes it leaves undefined
+// are mapped to the control characters of the same value, as mysql does.
+var cp1252High = [32]rune{
+	'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8d, 'Ž', 0x8f,
+	0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9d, 'ž', 'Ÿ',
+}
+
+var cp1252Bytes = func() map[rune]byte {
+	bytes := make(map[rune]byte, 256)
+	for b := 0; b < 256; b++ {
+		bytes[rune(b)] = byte(b)
+	}
+	for i, r := range cp1252High {
+		delete(bytes, rune(0x80+i))
+		bytes[r] = byte(0x80 + i)
+	}
+	return bytes
+}()
+
+// redecodeMojibake undoes text's mojibake, at most twice over, reporting
+// whether it was mojibake at all.
+func redecodeMojibake(text string) (string, bool) {
+	decoded := text
+	for i := 0; i < 2; i++ {
+		next, ok := redecodeOnce(decoded)
+		if !ok {
+			break
+		}
+		decoded = next
+	}
+	return decoded, decoded != text
+}
+
+func redecodeOnce(text string) (string, bool) {
+	buf := make([]byte, 0, len(text))
+	multibyte := false
+	for _, r := range text {
+		b, ok := cp1252Bytes[r]
+		if !ok {
+			return "", false
+		}
+		multibyte = multibyte || b >= 0x80
+		buf = append(buf, b)
+	}
+	if !multibyte || !utf8.Valid(buf) {
+		return "", false
+	}
+	return string(buf), true
+}
+
+var errMojibakeFound = errors.New("text with mojibake was found")
+
+// tables whose text columns are skipped unless named by --tables
+var mojibakeSkipped = map[string]bool{"scores": true, "migration_score_ids": true, "migration_checkpoints": true}
+
+var select_text_columns = `
+SELECT c.table_name AS table_name, c.column_name AS column_name FROM information_schema.columns c
+JOIN information_schema.tables t ON t.table_schema = c.table_schema AND t.table_name = c.table_name
+WHERE c.table_schema = DATABASE() AND t.table_type = 'BASE TABLE'
+AND c.data_type IN ('char', 'varchar', 'tinytext', 'text', 'mediumtext', 'longtext')
+ORDER BY c.table_name, c.ordinal_position`
+
+var select_primary_key = `
+SELECT column_name FROM information_schema.key_column_usage
+WHERE table_schema = DATABASE() AND table_name = ? AND constraint_name = 'PRIMARY'
+ORDER BY ordinal_position`
+
+type textColumn struct {
+	Table  string `db:"table_name"`
+	Column string `db:"column_name"`
+}
+
+// Mojibake is a value with mojibake, & what it decodes to.
+type Mojibake struct {
+	Table   string            `json:"table"`
+	Column  string            `json:"column"`
+	Key     map[string]string `json:"key,omitempty"` // the row's primary key
+	Value   string            `json:"value"`
+	Decoded string            `json:"decoded"`
+	Problem string            `json:"problem,omitempty"` // why it couldn't be replaced
+}
+
+// MojibakeReport is the result of charset mojibake.
+type MojibakeReport struct {
+	Columns   map[string]int64 `json:"columns"` // values with mojibake, by table.column
+	Found     int64            `json:"found"`
+	Redecoded int64            `json:"redecoded"`
+	Failed    int64            `json:"failed"`
+	Values    []Mojibake       `json:"values"`
+}
+
+// mojibakeColumns lists the text columns to check, by table.
+func mojibakeColumns(tables []string) (map[string][]string, []string, error) {
+	var columns []textColumn
+	if err := DB.Select(&columns, select_text_columns); err != nil {
+		return nil, nil, err
+	}
+	wanted := make(map[string]bool)
+	for _, table := range tables {
+		wanted[table] = true
+	}
+
+	byTable := make(map[string][]string)
+	var order []string
+	for _, c := range columns {
+		if len(wanted) != 0 && !wanted[c.Table] || len(wanted) == 0 && mojibakeSkipped[c.Table] {
+			continue
+		}
+		if byTable[c.Table] == nil {
+			order = append(order, c.Table)
+		}
+		byTable[c.Table] = append(byTable[c.Table], c.Column)
+	}
+	return byTable, order, nil
+}
+
+// findMojibake reads a column's values which aren't plain ascii, keeping
+// those with mojibake. only the rows' primary keys & values are read.
+func findMojibake(table, column string, key []string) ([]Mojibake, error) {
+	selected := append(append([]string{}, key...), column)
+	// latin1 columns are read as utf8mb4, before they're converted
+	rows, err := DB.Query(fmt.Sprintf("SELECT %s FROM `%s` WHERE LENGTH(CONVERT(`%s` USING utf8mb4)) != CHAR_LENGTH(`%s`)",
+		"`"+strings.Join(selected, "`, `")+"`", table, column, column))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var found []Mojibake
+	values := make([]sql.NullString, len(selected))
+	dest := make([]interface{}, len(selected))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		value := values[len(key)]
+		decoded, ok := redecodeMojibake(value.String)
+		if !value.Valid || !ok {
+			continue
+		}
+		m := Mojibake{Table: table, Column: column, Value: value.String, Decoded: decoded}
+		if len(key) != 0 {
+			m.Key = make(map[string]string, len(key))
+			for i, k := range key {
+				m.Key[k] = values[i].String
+			}
+		}
+		found = append(found, m)
+	}
+	return found, rows.Err()
+}
+
+// replaceMojibake updates a value to what it decodes to, as long as it
+// hasn't changed since it was read.
+func replaceMojibake(m Mojibake, key []string) error {
+	conds := make([]string, 0, len(key)+1)
+	args := []interface{}{m.Decoded}
+	for _, k := range key {
+		conds = append(conds, fmt.Sprintf("`%s` = ?", k))
+		args = append(args, m.Key[k])
+	}
+	conds = append(conds, fmt.Sprintf("`%s` = ?", m.Column))
+	args = append(args, m.Value)
+
+	_, err := DB.Exec(fmt.Sprintf("UPDATE `%s` SET `%s` = ? WHERE %s", m.Table, m.Column, strings.Join(conds, " AND ")), args...)
+	return err
+}
+
+// scanMojibake checks every text column of the tables (all but scores' by
+// default), redecoding the mojibake found if redecode is set.
+func scanMojibake(tables []string, redecode bool) (*MojibakeReport, error) {
+	byTable, order, err := mojibakeColumns(tables)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &MojibakeReport{Columns: map[string]int64{}, Values: []Mojibake{}}
+	for _, table := range order {
+		var key []string
+		if err := DB.Select(&key, select_primary_key, table); err != nil {
+			return nil, err
+		}
+		for _, column := range byTable[table] {
+			if isInterrupted() {
+				return report, errInterrupted
+			}
+			found, err := findMojibake(table, column, key)
+			if err != nil {
+				return nil, fmt.Errorf("failed to check %s.%s: %w", table, column, err)
+			}
+			if len(found) == 0 {
+				continue
+			}
+			report.Columns[table+"."+column] += int64(len(found))
+			report.Found += int64(len(found))
+			if redecode {
+				if err := throttle(len(found)); err != nil {
+					return nil, err
+				}
+			}
+
+			for _, m := range found {
+				if redecode {
+					if len(key) == 0 {
+						m.Problem = "the table has no primary key"
+					} else if err := replaceMojibake(m, key); err != nil {
+						// e.g. a unique name which is taken once it's decoded
+						m.Problem = err.Error()
+					}
+					if m.Problem != "" {
+						report.Failed++
+					} else {
+						report.Redecoded++
+					}
+				}
+				if len(report.Values) < maxExamples || m.Problem != "" {
+					report.Values = append(report.Values, m)
+				}
+			}
+			logger.Debug("checked column for mojibake", "table", table, "column", column, "found", len(found))
+		}
+	}
+	return report, nil
+}
+
+// printMojibakeReport prints the mojibake found, by column.
+func printMojibakeReport(report *MojibakeReport) {
+	fmt.Printf("%d values with mojibake\n", report.Found)
+	columns := make([]string, 0, len(report.Columns))
+	for column := range report.Columns {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	for _, column := range columns {
+		fmt.Printf("  %-32s %d\n", column, report.Columns[column])
+	}
+	for _, m := range report.Values {
+		line := fmt.Sprintf("  %s.%s: %q -> %q", m.Table, m.Column, m.Value, m.Decoded)
+		if m.Problem != "" {
+			line += " (not replaced: " + m.Problem + ")"
+		}
+		fmt.Println(line)
+	}
+}
+
+func runCharsetMojibake() error {
+	if cfg.MojibakeAction != "report" && cfg.MojibakeAction != "redecode" {
+		return fmt.Errorf("unknown --action %q, expected report or redecode", cfg.MojibakeAction)
+	}
+	var tables []string
+	if cfg.MojibakeTables != "" {
+		tables = strings.Split(cfg.MojibakeTables, ",")
+	}
+	redecode := cfg.MojibakeAction == "redecode"
+	if redecode {
+		fmt.Println("This will replace every value with mojibake with what it decodes to.")
+		if !confirm("Continue?") {
+			fmt.Println("Not redecoding anything")
+			return nil
+		}
+	}
+
+	// ctrl-c stops between columns
+	handleSignals()
+
+	start := time.Now()
+	report, err := scanMojibake(tables, redecode)
+	if err != nil {
+		return err
+	}
+	printMojibakeReport(report)
+	if err := writeReport(cfg.ReportPath, report); err != nil {
+		return err
+	}
+
+	logger.Info("charset mojibake finished", "found", report.Found, "redecoded", report.Redecoded,
+		"failed", report.Failed, "elapsed", time.Since(start).Round(time.Second))
+	if report.Found != 0 && !redecode {
+		return errMojibakeFound
+	}
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "charset mojibake",
+		Summary: "find text which was double-encoded by latin1 columns, and decode it back",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.MojibakeAction, "action", "report", "what to do with it: report, or redecode (best effort, values which can't be replaced are reported)")
+			flags.StringVar(&c.MojibakeTables, "tables", "", "only check these tables, comma separated (default: every table but scores)")
+			flags.StringVar(&c.ReportPath, "report", "", "write what was found as json to this path (- for stdout)")
+		},
+		Run: runCharsetMojibake,
+	})
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestRedecodeMojibake(t *testing.T) {
+	for _, tt := range []struct {
+		text, want string
+		mojibake   bool
+	}{
+		{"cafÃ©", "café", true},
+		{"â€™", "’", true},
+		{"æ—¥æœ¬èªž", "日本語", true},
+		{"ÃœnÃ¯cÃ¶dÃ© â˜…", "Ünïcödé ★", true},
+		// mangled twice over, by two latin1 round trips
+		{"cafÃƒÂ©", "café", true},
+		{"Ã¢â‚¬â„¢", "’", true},
+		// already utf8, or plain ascii
+		{"café", "café", false},
+		{"日本語", "日本語", false},
+		{"cmyui", "cmyui", false},
+		{"", "", false},
+		// latin1 which doesn't decode as utf8, e.g. a real Ã followed by a space
+		{"Ã ", "Ã ", false},
+		{"naïve", "naïve", false},
+	} {
+		got, mojibake := redecodeMojibake(tt.text)
+		if got != tt.want || mojibake != tt.mojibake {
+			t.Errorf("redecodeMojibake(%q) = %q, %v, want %q, %v", tt.text, got, mojibake, tt.want, tt.mojibake)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// long migrations are usually left running unattended (overnight, say), so
+// with --notify-url, a webhook is posted to when a command starts, when the
+// scores migrated pass 25, 50 & 75%, and when it completes or fails, with
+// the row counts & time elapsed. discord webhooks are posted to as embeds,
+// anything else gets the notification as json.
+//
+// a notification failing to send is only logged, so a webhook being down
+// never fails the migration itself.
+
+const (
+	notifyFormatAuto    = "auto"
+	notifyFormatDiscord = "discord"
+	notifyFormatJSON    = "json"
+)
+
+// the percentages of the scores migrated which are notified about
+var notifyMilestones = []int{25, 50, 75}
+
+// how many times a notification is sent, if the webhook errors
+const notifyAttempts = 3
+
+var notifyHTTP = &http.Client{Timeout: 15 * time.Second}
+
+// Notification is what's posted to generic webhooks, as json.
+type Notification struct {
+	Event   string `json:"event"` // started, progress, completed or failed
+	Command string `json:"command"`
+	Host    string `json:"host"`
+	Message string `json:"message"`
+
+	Percent        int     `json:"percent,omitempty"`
+	Rows           int64   `json:"rows"` // migrated so far
+	Total          int64   `json:"total"`
+	Failed         int64   `json:"failed"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	Error          string  `json:"error,omitempty"`
+}
+
+// the colours of discord embeds, by event
+var discordColours = map[string]int{
+	"started":   0x3498db,
+	"progress":  0x95a5a6,
+	"completed": 0x2ecc71,
+	"failed":    0xe74c3c,
+}
+
+// the command being run, and when it started
+var (
+	commandName string
+	notifyStart = time.Now()
+)
+
+// isDiscordWebhook reports whether a url is a discord webhook.
+func isDiscordWebhook(u *url.URL) bool {
+	host := strings.TrimPrefix(u.Hostname(), "www.")
+	return (host == "discord.com" || host == "discordapp.com" || strings.HasSuffix(host, ".discord.com")) &&
+		strings.HasPrefix(u.Path, "/api/webhooks/")
+}
+
+// notify posts a notification about the running command, if --notify-url
+// was given.
+func notify(event, message string, percent int, err error) {
+	if cfg == nil || cfg.NotifyURL == "" {
+		return
+	}
+
+	n := Notification{
+		Event:          event,
+		Command:        commandName,
+		Message:        message,
+		Percent:        percent,
+		ElapsedSeconds: time.Since(notifyStart).Round(time.Second).Seconds(),
+	}
+	n.Host, _ = os.Hostname()
+	if progress != nil {
+		n.Total, _, n.Rows, n.Failed, _ = progress.totals()
+	}
+	if err != nil {
+		n.Error = err.Error()
+	}
+
+	if err := postNotification(n); err != nil {
+		logger.Warn("failed to send a notification", "event", event, "err", err)
+	}
+}
+
+func postNotification(n Notification) error {
+	u, err := url.Parse(cfg.NotifyURL)
+	if err != nil {
+		return err
+	}
+	format := cfg.NotifyFormat
+	if format == notifyFormatAuto || format == "" {
+		format = notifyFormatJSON
+		if isDiscordWebhook(u) {
+			format = notifyFormatDiscord
+		}
+	}
+
+	var body []byte
+	if format == notifyFormatDiscord {
+		body, err = json.Marshal(discordMessage(n))
+	} else {
+		body, err = json.Marshal(n)
+	}
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = postWebhook(u.String(), body)
+		if err == nil || attempt == notifyAttempts {
+			return err
+		}
+		time.Sleep(time.Duration(attempt) * 2 * time.Second)
+	}
+}
+
+func postWebhook(u string, body []byte) error {
+	resp, err := notifyHTTP.Post(u, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("the webhook responded %s", resp.Status)
+	}
+	return nil
+}
+
+type discordEmbed struct {
+	Title       string         `json:"title"`
+	Description string         `json:"description,omitempty"`
+	Color       int            `json:"color"`
+	Fields      []discordField `json:"fields"`
+	Timestamp   string         `json:"timestamp"`
+}
+
+type discordField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
+
+// discordMessage renders a notification as a discord webhook's embed.
+func discordMessage(n Notification) map[string]any {
+	embed := discordEmbed{
+		Title:       fmt.Sprintf("migrate %s %s", n.Command, n.Event),
+		Description: n.Message,
+		Color:       discordColours[n.Event],
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+	}
+	if n.Total != 0 {
+		embed.Fields = append(embed.Fields,
+			discordField{"Rows", fmt.Sprintf("%d / %d", n.Rows, n.Total), true},
+			discordField{"Failed", fmt.Sprint(n.Failed), true})
+	}
+	embed.Fields = append(embed.Fields,
+		discordField{"Elapsed", (time.Duration(n.ElapsedSeconds) * time.Second).String(), true},
+		discordField{"Host", n.Host, true})
+	if n.Error != "" {
+		// embeds' field values are limited to 1024 characters
+		embed.Fields = append(embed.Fields, discordField{"Error", truncate(n.Error, 1024), false})
+	}
+	return map[string]any{"embeds": []discordEmbed{embed}}
+}
+
+// notifyMilestones notifies as the scores migrated pass each milestone,
+// until stop is closed. milestones already passed when it starts (e.g. when
+// resuming) aren't notified about.
+func (p *Progress) notifyMilestones(stop <-chan struct{}) {
+	if cfg.NotifyURL == "" {
+		return
+	}
+	percent := func() int {
+		total, _, inserted, failed, skipped := p.totals()
+		if total == 0 {
+			return 0
+		}
+		return int((inserted + failed + skipped) * 100 / total)
+	}
+
+	next := 0
+	for next < len(notifyMilestones) && percent() >= notifyMilestones[next] {
+		next++
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for next < len(notifyMilestones) {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		reached := -1
+		for now := percent(); next < len(notifyMilestones) && now >= notifyMilestones[next]; next++ {
+			reached = notifyMilestones[next]
+		}
+		if reached != -1 {
+			notify("progress", fmt.Sprintf("%d%% of the scores have been migrated", reached), reached, nil)
+		}
+	}
+}
+
+// notifyFinished notifies about how the command finished.
+func notifyFinished(err error) {
+	switch {
+	case errors.Is(err, errInterrupted):
+		notify("failed", "interrupted, rerun with --resume to continue", 0, err)
+	case err != nil:
+		notify("failed", "failed", 0, err)
+	default:
+		message := "completed"
+		if warnings, errs := logWarnings.logged(); warnings+errs != 0 {
+			message = fmt.Sprintf("completed, with %d warnings and %d errors logged", warnings, errs)
+		}
+		notify("completed", message, 0, nil)
+	}
+}
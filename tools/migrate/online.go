@@ -0,0 +1,368 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// with --online, v4.2.0 is applied while the old server keeps running. before
+// the bulk copy starts, triggers on the old tables record the id of every
+// score inserted, updated or deleted into migration_score_changes. once the
+// bulk copy is done, those scores are synced from the old tables into the new
+// one, over and over, until the operator stops bancho.py for the cutover.
+// the last changes are then synced, and the replay directories are swapped.
+//
+// triggers are used rather than tailing the binlog, as they need neither
+// replication privileges nor binlog_format=ROW. as the merged table has a
+// new name, there's no table to swap; the old server simply stops being run.
+//
+// the old server still serves replays by their old ids until the cutover,
+// so they're copied rather than moved, which needs --new-replays to be
+// somewhere other than .data/osr.
+
+// changes younger than this are left for the next pass, as bancho.py saves
+// a score's replay after inserting it
+const onlineSettleDelay = 10 * time.Second
+
+const onlinePollInterval = 5 * time.Second
+
+var create_score_changes = `
+create table if not exists migration_score_changes (
+	id bigint unsigned auto_increment primary key,
+	source_table varchar(64) not null,
+	score_id bigint unsigned not null,
+	changed_at datetime not null default current_timestamp
+);
+`
+
+var select_score_changes = `
+SELECT id, source_table, score_id FROM migration_score_changes
+WHERE changed_at <= NOW() - INTERVAL ? SECOND ORDER BY id LIMIT ?`
+
+// select_scores_by_id reads the current state of changed scores.
+var select_scores_by_id = `
+SELECT id, map_md5, score, pp, acc, max_combo, mods, n300, n100,
+n50, nmiss, ngeki, nkatu, grade, status, mode, UNIX_TIMESTAMP(play_time) AS play_time,
+time_elapsed, client_flags, userid, perfect, online_checksum FROM %s
+WHERE id IN (?)`
+
+var update_score = `
+UPDATE scores SET map_md5 = :map_md5, score = :score, pp = :pp, acc = :acc,
+max_combo = :max_combo, mods = :mods, n300 = :n300, n100 = :n100, n50 = :n50,
+nmiss = :nmiss, ngeki = :ngeki, nkatu = :nkatu, grade = :grade, status = :status,
+mode = :mode, play_time = FROM_UNIXTIME(:play_time), time_elapsed = :time_elapsed,
+client_flags = :client_flags, userid = :userid, perfect = :perfect,
+online_checksum = :online_checksum
+WHERE id = :id`
+
+type scoreChange struct {
+	ID      int64
+	Table   string `db:"source_table"`
+	ScoreID int64  `db:"score_id"`
+}
+
+// the events captured on each old table, and which row's id they record
+var changeEvents = []struct{ event, row string }{
+	{"INSERT", "NEW"},
+	{"UPDATE", "NEW"},
+	{"DELETE", "OLD"},
+}
+
+func changeTriggerName(table SourceTable, event string) string {
+	return fmt.Sprintf("migration_%s_%s", table.Name, event)
+}
+
+// createChangeCapture creates the change table & triggers, unless a previous
+// run already did. creating triggers needs the TRIGGER privilege, and when
+// binary logging is on, SUPER or log_bin_trust_function_creators too.
+func createChangeCapture(tables []SourceTable) error {
+	if _, err := DB.Exec(create_score_changes); err != nil {
+		return err
+	}
+
+	for _, table := range tables {
+		for _, e := range changeEvents {
+			name := changeTriggerName(table, e.event)
+
+			var count int
+			err := DB.Get(&count, `
+			SELECT COUNT(*) FROM information_schema.triggers
+			WHERE trigger_schema = DATABASE() AND trigger_name = ?`, name)
+			if err != nil {
+				return err
+			}
+			if count != 0 {
+				continue
+			}
+
+			_, err = DB.Exec(fmt.Sprintf(`
+			CREATE TRIGGER %s AFTER %s ON %s FOR EACH ROW
+			INSERT INTO migration_score_changes (source_table, score_id) VALUES ('%s', %s.id)`,
+				name, e.event, table.Name, table.Name, e.row))
+			if err != nil {
+				return fmt.Errorf("failed to create trigger %s: %w", name, err)
+			}
+		}
+	}
+	logger.Info("capturing changes to the old tables", "tables", len(tables))
+	return nil
+}
+
+func dropChangeCapture(tables []SourceTable) error {
+	for _, table := range tables {
+		for _, e := range changeEvents {
+			if _, err := DB.Exec("DROP TRIGGER IF EXISTS " + changeTriggerName(table, e.event)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// applyChanges syncs the scores changed at least settle ago, oldest first,
+// returning how many changes were applied.
+func applyChanges(tables []SourceTable, settle time.Duration) (int, error) {
+	byName := make(map[string]SourceTable, len(tables))
+	for _, table := range tables {
+		byName[table.Name] = table
+	}
+
+	applied := 0
+	for {
+		if isInterrupted() {
+			return applied, errInterrupted
+		}
+
+		var changes []scoreChange
+		err := DB.Select(&changes, select_score_changes, int(settle.Seconds()), BatchSize)
+		if err != nil {
+			return applied, err
+		}
+		if len(changes) == 0 {
+			return applied, nil
+		}
+
+		// a score changed many times only needs syncing once
+		ids := make(map[string][]int64)
+		seen := make(map[scoreChange]bool)
+		changeIDs := make([]int64, 0, len(changes))
+		for _, change := range changes {
+			changeIDs = append(changeIDs, change.ID)
+			key := scoreChange{Table: change.Table, ScoreID: change.ScoreID}
+			if !seen[key] {
+				seen[key] = true
+				ids[change.Table] = append(ids[change.Table], change.ScoreID)
+			}
+		}
+
+		for name, tableIDs := range ids {
+			table, ok := byName[name]
+			if !ok {
+				return applied, fmt.Errorf("migration_score_changes has changes to an unknown table %s", name)
+			}
+			if err := syncScores(table, tableIDs); err != nil {
+				return applied, fmt.Errorf("failed to sync changes to %s: %w", name, err)
+			}
+		}
+
+		// only the changes which were read are removed, as changes from
+		// transactions committed out of order may have lower ids
+		query, args, err := sqlx.In("DELETE FROM migration_score_changes WHERE id IN (?)", changeIDs)
+		if err != nil {
+			return applied, err
+		}
+		if _, err := DB.Exec(query, args...); err != nil {
+			return applied, err
+		}
+
+		applied += len(changes)
+		if len(changes) < BatchSize {
+			return applied, nil
+		}
+	}
+}
+
+// syncScores brings scores in the new table in line with the old table:
+// new scores are migrated, changed scores updated, and deleted scores deleted.
+func syncScores(table SourceTable, ids []int64) error {
+	query := fmt.Sprintf(select_scores_by_id, table.Name)
+	if table.Columns != "" {
+		query = fmt.Sprintf("SELECT %s FROM %s WHERE id IN (?)", table.Columns, table.Name)
+	}
+	query, args, err := sqlx.In(query, ids)
+	if err != nil {
+		return err
+	}
+	var scores []Score
+	if err := DB.Select(&scores, query, args...); err != nil {
+		return err
+	}
+
+	query, args, err = sqlx.In(`
+	SELECT old_id, new_id FROM migration_score_ids
+	WHERE source_table = ? AND old_id IN (?)`, table.Name, ids)
+	if err != nil {
+		return err
+	}
+	var mapped []ReplayMove
+	if err := DB.Select(&mapped, query, args...); err != nil {
+		return err
+	}
+	newIDs := make(map[int64]int64, len(mapped))
+	for _, m := range mapped {
+		newIDs[m.OldID] = m.NewID
+	}
+
+	var inserts []Score
+	present := make(map[int64]bool, len(scores))
+	for _, score := range scores {
+		present[score.ID] = true
+		newID, ok := newIDs[score.ID]
+		if !ok {
+			if scoreFilter.match(table, score) {
+				inserts = append(inserts, score)
+			}
+			continue
+		}
+
+		score.ID = newID
+		score.Mode += table.ModeOffset
+		if !score.OnlineChecksum.Valid {
+			score.OnlineChecksum.String, score.OnlineChecksum.Valid = "", true
+		}
+		if _, err := DB.NamedExec(update_score, &score); err != nil {
+			return err
+		}
+	}
+
+	// new scores go through the pipeline, so their replays are copied too
+	if len(inserts) != 0 {
+		migrateBatch(ScoreBatch{Table: table, Scores: inserts}, 0)
+	}
+
+	for _, id := range ids {
+		newID, ok := newIDs[id]
+		if present[id] || !ok {
+			continue
+		}
+		if _, err := DB.Exec("DELETE FROM scores WHERE id = ?", newID); err != nil {
+			return err
+		}
+		if _, err := DB.Exec("DELETE FROM migration_score_ids WHERE source_table = ? AND old_id = ?", table.Name, id); err != nil {
+			return err
+		}
+		if err := newReplays.Delete(replayKey(newID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Warn("failed to remove the replay of a deleted score", "table", table.Name, "old_id", id, "new_id", newID, "err", err)
+		}
+	}
+	return nil
+}
+
+// changeLag returns how many changes are waiting, and the age of the oldest.
+func changeLag() (int, time.Duration, error) {
+	var lag struct {
+		Count   int
+		Seconds int64
+	}
+	err := DB.Get(&lag, `
+	SELECT COUNT(*) AS count, COALESCE(TIMESTAMPDIFF(SECOND, MIN(changed_at), NOW()), 0) AS seconds
+	FROM migration_score_changes`)
+	return lag.Count, time.Duration(lag.Seconds) * time.Second, err
+}
+
+// cutoverOnline keeps the new table in sync until the operator has stopped
+// bancho.py, then syncs the last changes and swaps the replay directories.
+func cutoverOnline(tables []SourceTable) error {
+	logger.Info("bulk copy finished, syncing the scores changed during it")
+	for {
+		applied, err := applyChanges(tables, onlineSettleDelay)
+		if err != nil {
+			return err
+		}
+		if applied < BatchSize {
+			break
+		}
+	}
+
+	fmt.Printf("The new scores table has caught up, and will be kept in sync.\n" +
+		"Stop bancho.py for the cutover, then press enter\n>> ")
+	// with nobody to press enter, e.g. when run from a script with stdin
+	// closed, bancho.py can't be known to be stopped, so there's no cutover
+	ready := make(chan bool)
+	go func() {
+		_, err := stdin.ReadString('\n')
+		ready <- err == nil
+	}()
+
+	for waiting := true; waiting; {
+		select {
+		case pressed := <-ready:
+			if !pressed {
+				return fmt.Errorf("stdin was closed before the cutover, rerun with --online --resume from a terminal")
+			}
+			waiting = false
+		case <-interrupted:
+			return errInterrupted
+		case <-time.After(onlinePollInterval):
+			if _, err := applyChanges(tables, onlineSettleDelay); err != nil {
+				return err
+			}
+			count, age, err := changeLag()
+			if err != nil {
+				return err
+			}
+			logger.Debug("synced changes", "pending", count, "oldest", age)
+		}
+	}
+
+	// bancho.py is stopped, so every replay is saved, and nothing new will
+	// be captured. the triggers are dropped first, then whatever they
+	// captured up to that point is synced.
+	logger.Info("cutting over, syncing the last changes")
+	if err := dropChangeCapture(tables); err != nil {
+		return err
+	}
+	if _, err := applyChanges(tables, 0); err != nil {
+		return err
+	}
+	count, _, err := changeLag()
+	if err != nil {
+		return err
+	}
+	if count != 0 {
+		return fmt.Errorf("%d changes are left unsynced in migration_score_changes, rerun with --online --resume", count)
+	}
+	if _, err := DB.Exec("drop table if exists migration_score_changes"); err != nil {
+		return err
+	}
+
+	return swapReplayDirectories()
+}
+
+// swapReplayDirectories puts the new replays where bancho.py reads them
+// from, keeping the old ones alongside, as they were only copied.
+func swapReplayDirectories() error {
+	// with the ids kept, the replays never left
+	if replaysInPlace {
+		return nil
+	}
+	dir, ok := newReplays.(LocalStore)
+	if !ok || cfg.OldReplays != "" {
+		logger.Info("point bancho.py at the new replays before starting it", "location", cfg.NewReplays)
+		return nil
+	}
+
+	old := cfg.ReplayDirectory() + "_pre_4.2.0"
+	if err := moveDirectory(cfg.ReplayDirectory(), old); err != nil {
+		return err
+	}
+	if err := moveDirectory(dir.Dir, cfg.ReplayDirectory()); err != nil {
+		return err
+	}
+	logger.Info("swapped the replay directories, the old replays can be removed once everything checks out", "old", old)
+	return nil
+}
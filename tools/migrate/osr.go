@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bancho.py only keeps the compressed replay frames on disk, and builds the
+// .osr header from the scores table when a replay is downloaded. replays
+// from elsewhere (other servers, exported from the client) are full .osr
+// files though, so both are understood here.
+
+var errReplayTruncated = errors.New("replay is truncated")
+
+// ticksAtUnixEpoch is 1970-01-01 in .net ticks (100ns since 0001-01-01),
+// which is how osu! stores timestamps. (DATETIME_OFFSET in bancho.py)
+const ticksAtUnixEpoch = 0x89F7FF5F7B58000
+
+// Replay is a decoded .osr file.
+type Replay struct {
+	// false if this is only the compressed frames, as stored by bancho.py
+	HasHeader bool
+
+	Mode       int
+	Version    int
+	MapMD5     string
+	PlayerName string
+	ReplayMD5  string
+	N300       int
+	N100       int
+	N50        int
+	Ngeki      int
+	Nkatu      int
+	Nmiss      int
+	Score      int
+	MaxCombo   int
+	Perfect    bool
+	Mods       int
+	LifeBar    string
+	Timestamp  time.Time
+	ScoreID    int64
+
+	Frames []byte // lzma compressed
+
+	// lazer appends its own score info, as lzma compressed json
+	LazerData []byte
+}
+
+type osrReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *osrReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.data)-r.pos < n {
+		r.err = errReplayTruncated
+		return nil
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *osrReader) u8() int {
+	if b := r.bytes(1); b != nil {
+		return int(b[0])
+	}
+	return 0
+}
+
+func (r *osrReader) i16() int {
+	if b := r.bytes(2); b != nil {
+		return int(int16(binary.LittleEndian.Uint16(b)))
+	}
+	return 0
+}
+
+func (r *osrReader) i32() int {
+	if b := r.bytes(4); b != nil {
+		return int(int32(binary.LittleEndian.Uint32(b)))
+	}
+	return 0
+}
+
+func (r *osrReader) i64() int64 {
+	if b := r.bytes(8); b != nil {
+		return int64(binary.LittleEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (r *osrReader) f32() float64 {
+	if b := r.bytes(4); b != nil {
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+	}
+	return 0
+}
+
+func (r *osrReader) f64() float64 {
+	if b := r.bytes(8); b != nil {
+		return math.Float64frombits(binary.LittleEndian.Uint64(b))
+	}
+	return 0
+}
+
+// uleb128 reads an unsigned leb128 varint, as used for string lengths.
+func (r *osrReader) uleb128() int {
+	var value, shift int
+	for {
+		b := r.u8()
+		if r.err != nil {
+			return 0
+		}
+		value |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return value
+		}
+		shift += 7
+		if shift > 28 {
+			r.err = errors.New("string length is too long")
+			return 0
+		}
+	}
+}
+
+// string reads an osu! string: 0x00 if it's empty, otherwise 0x0b
+// followed by the uleb128 length & utf-8 bytes.
+func (r *osrReader) string() string {
+	switch marker := r.u8(); {
+	case r.err != nil:
+		return ""
+	case marker == 0x00:
+		return ""
+	case marker == 0x0b:
+		return string(r.bytes(r.uleb128()))
+	default:
+		if r.err == nil {
+			r.err = fmt.Errorf("bad string marker %#x at offset %d", marker, r.pos-1)
+		}
+		return ""
+	}
+}
+
+func ticksToTime(ticks int64) time.Time {
+	ticks -= ticksAtUnixEpoch
+	return time.Unix(ticks/1e7, (ticks%1e7)*100).UTC()
+}
+
+// hasReplayHeader guesses whether data is a full .osr file, rather than
+// only its frames. a full replay starts with the mode (0-3), a 4 byte
+// version, then the beatmap md5 string; the frames start with the lzma
+// properties byte, which is 0x5d for every replay osu! writes.
+func hasReplayHeader(data []byte) bool {
+	return len(data) > 5 && data[0] <= 3 && (data[5] == 0x0b || data[5] == 0x00)
+}
+
+// parseReplay decodes the header of a replay, if it has one. the frames
+// are left compressed, see Replay.DecodeFrames.
+func parseReplay(data []byte) (*Replay, error) {
+	if !hasReplayHeader(data) {
+		return &Replay{Frames: data}, nil
+	}
+
+	r := &osrReader{data: data}
+	replay := &Replay{HasHeader: true}
+
+	replay.Mode = r.u8()
+	replay.Version = r.i32()
+	replay.MapMD5 = r.string()
+	replay.PlayerName = r.string()
+	replay.ReplayMD5 = r.string()
+	replay.N300 = r.i16()
+	replay.N100 = r.i16()
+	replay.N50 = r.i16()
+	replay.Ngeki = r.i16()
+	replay.Nkatu = r.i16()
+	replay.Nmiss = r.i16()
+	replay.Score = r.i32()
+	replay.MaxCombo = int(uint16(r.i16()))
+	replay.Perfect = r.u8() != 0
+	replay.Mods = r.i32()
+	replay.LifeBar = r.string()
+	replay.Timestamp = ticksToTime(r.i64())
+	replay.Frames = r.bytes(r.i32())
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	// the online score id was only added later, and is an int32 before that
+	switch remaining := len(data) - r.pos; {
+	case remaining >= 8:
+		replay.ScoreID = r.i64()
+	case remaining >= 4:
+		replay.ScoreID = int64(r.i32())
+	}
+
+	if replay.Mods&modTargetPractice != 0 && len(data)-r.pos >= 8 {
+		r.f64() // additional mod info
+	}
+	if replay.Version >= lazerReplayVersion && len(data)-r.pos >= 4 {
+		if size := r.i32(); size > 0 {
+			replay.LazerData = r.bytes(size)
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+	}
+
+	return replay, nil
+}
+
+// writeOsuString writes an osu! string, as read by osrReader.string.
+func writeOsuString(buf *bytes.Buffer, s string) {
+	if s == "" {
+		buf.WriteByte(0x00)
+		return
+	}
+	buf.WriteByte(0x0b)
+	n := uint(len(s))
+	for n >= 0x80 {
+		buf.WriteByte(byte(n) | 0x80)
+		n >>= 7
+	}
+	buf.WriteByte(byte(n))
+	buf.WriteString(s)
+}
+
+// encodeReplay writes a full .osr file, in the same way as bancho.py's
+// /api/get_replay. (stable's replay format, without lazer's score info)
+func encodeReplay(replay *Replay) []byte {
+	var buf bytes.Buffer
+	le := func(v interface{}) { binary.Write(&buf, binary.LittleEndian, v) }
+	str := func(s string) { writeOsuString(&buf, s) }
+
+	buf.WriteByte(byte(replay.Mode))
+	le(int32(replay.Version))
+	str(replay.MapMD5)
+	str(replay.PlayerName)
+	str(replay.ReplayMD5)
+	for _, n := range []int{replay.N300, replay.N100, replay.N50, replay.Ngeki, replay.Nkatu, replay.Nmiss} {
+		le(int16(n))
+	}
+	le(int32(replay.Score))
+	le(uint16(replay.MaxCombo))
+	if replay.Perfect {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+	le(int32(replay.Mods))
+	str(replay.LifeBar)
+	le(replay.Timestamp.UnixNano()/100 + ticksAtUnixEpoch)
+	le(int32(len(replay.Frames)))
+	buf.Write(replay.Frames)
+	le(replay.ScoreID)
+	return buf.Bytes()
+}
+
+// DecodeFrames decompresses the replay's frames, and checks that each is a
+// valid w|x|y|z frame. it returns how many frames the replay has.
+func (replay *Replay) DecodeFrames() (int, error) {
+	data, err := decodeLZMA(replay.Frames)
+	if err != nil {
+		return 0, err
+	}
+
+	frames := 0
+	for i, frame := range strings.Split(string(data), ",") {
+		if frame == "" {
+			continue
+		}
+
+		parts := strings.Split(frame, "|")
+		if len(parts) != 4 {
+			return 0, fmt.Errorf("frame %d is malformed: %q", i, frame)
+		}
+		if _, err := strconv.ParseInt(parts[0], 10, 64); err != nil {
+			return 0, fmt.Errorf("frame %d has a bad time: %q", i, frame)
+		}
+		for _, part := range parts[1:3] {
+			if v, err := strconv.ParseFloat(part, 64); err != nil || math.IsNaN(v) {
+				return 0, fmt.Errorf("frame %d has a bad position: %q", i, frame)
+			}
+		}
+		if _, err := strconv.ParseInt(parts[3], 10, 64); err != nil {
+			return 0, fmt.Errorf("frame %d has bad keys: %q", i, frame)
+		}
+		frames++
+	}
+
+	if frames == 0 {
+		return 0, errors.New("replay has no frames")
+	}
+	return frames, nil
+}
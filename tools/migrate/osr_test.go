@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testdata/stable.osr & lazer.osr were written by python's struct & lzma
+// modules, rather than by encodeReplay, so they check the format as osu!
+// writes it. both hold testdata/frames.txt's frames.
+
+func readTestdata(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestParseReplay(t *testing.T) {
+	played := time.Date(2021, 5, 20, 12, 34, 56, 0, time.UTC)
+	for _, tt := range []struct {
+		file      string
+		version   int
+		mods      int
+		lazerData bool
+	}{
+		{"stable.osr", 20210520, modHidden | modDoubleTime, false},
+		{"lazer.osr", 30000016, 0, true},
+	} {
+		t.Run(tt.file, func(t *testing.T) {
+			replay, err := parseReplay(readTestdata(t, tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := Replay{
+				HasHeader: true, Mode: 0, Version: tt.version,
+				MapMD5: "c8f08438204abfcdd1a748ebfae67421", PlayerName: "cmyui", ReplayMD5: "e0a2ec5d7fd5bc9e2b5b18b2ed4ab6a8",
+				N300: 512, N100: 30, N50: 2, Ngeki: 80, Nkatu: 12, Nmiss: 1,
+				Score: 7654321, MaxCombo: 40000, Mods: tt.mods, LifeBar: "0|1,1000|0.9,",
+				Timestamp: played, ScoreID: 3000000000,
+			}
+			got := *replay
+			got.Frames, got.LazerData = nil, nil
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("parseReplay() = %+v, want %+v", got, want)
+			}
+			if (replay.LazerData != nil) != tt.lazerData {
+				t.Errorf("LazerData = %d bytes, want some: %v", len(replay.LazerData), tt.lazerData)
+			}
+
+			frames, err := decodeLZMA(replay.Frames)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(frames, readTestdata(t, "frames.txt")) {
+				t.Error("the frames don't match testdata/frames.txt")
+			}
+		})
+	}
+}
+
+func TestParseReplayFramesOnly(t *testing.T) {
+	// bancho.py's replays are only the frames, which start with lzma's properties byte
+	frames := readTestdata(t, "frames.lzma")
+	replay, err := parseReplay(frames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replay.HasHeader || !bytes.Equal(replay.Frames, frames) {
+		t.Errorf("parseReplay() = header %v & %d bytes of frames, want only the frames", replay.HasHeader, len(replay.Frames))
+	}
+}
+
+func TestParseReplayTruncated(t *testing.T) {
+	data := readTestdata(t, "stable.osr")
+	for _, n := range []int{10, 60, 100, len(data) - 2200} {
+		if _, err := parseReplay(data[:n]); !errors.Is(err, errReplayTruncated) {
+			t.Errorf("parseReplay(first %d bytes) = %v, want errReplayTruncated", n, err)
+		}
+	}
+}
+
+func TestEncodeReplayRoundTrip(t *testing.T) {
+	for _, want := range []Replay{
+		{
+			HasHeader: true, Mode: 3, Version: exportReplayVersion,
+			MapMD5: "1cf5b2c2edfafd055536d2cefcb89c0e", PlayerName: "Ｔｅｓｔ", ReplayMD5: "0123456789abcdef0123456789abcdef",
+			N300: 1200, N100: 4, Ngeki: 900, Nkatu: 33, Score: 999999, MaxCombo: 65535, Perfect: true,
+			Mods: modHidden | modFadeIn, Timestamp: time.Date(2013, 2, 3, 4, 5, 6, 700, time.UTC),
+			ScoreID: 1 << 40, Frames: encodeLZMALiterals([]byte("0|1|2|0,")),
+		},
+		{
+			HasHeader: true, Version: exportReplayVersion, MapMD5: "1cf5b2c2edfafd055536d2cefcb89c0e",
+			Timestamp: time.Date(2007, 9, 16, 0, 0, 0, 0, time.UTC), Frames: []byte{},
+		},
+	} {
+		got, err := parseReplay(encodeReplay(&want))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.MapMD5 != want.MapMD5 || got.PlayerName != want.PlayerName || got.Score != want.Score ||
+			got.MaxCombo != want.MaxCombo || got.Perfect != want.Perfect || got.Mods != want.Mods ||
+			got.Ngeki != want.Ngeki || got.ScoreID != want.ScoreID || !got.Timestamp.Equal(want.Timestamp) ||
+			!bytes.Equal(got.Frames, want.Frames) {
+			t.Errorf("parseReplay(encodeReplay(%+v)) = %+v", want, got)
+		}
+	}
+}
+
+func TestParseLazerReplay(t *testing.T) {
+	replay, err := parseLazerReplay(readTestdata(t, "lazer.osr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := modHidden | modDoubleTime; replay.Mods != want {
+		t.Errorf("Mods = %d, want %d, from lazer's score info", replay.Mods, want)
+	}
+}
+
+func TestDecodeFrames(t *testing.T) {
+	for _, tt := range []struct {
+		frames string
+		want   int
+		ok     bool
+	}{
+		{"0|256|192|0,16|257.5|193|1,", 2, true},
+		{"-1|256|-500|0,16|1|2|0,-12345|0|0|0,", 3, true},
+		{"", 0, false},
+		{"16|1|2,", 0, false},
+		{"x|1|2|0,", 0, false},
+		{"16|NaN|2|0,", 0, false},
+		{"16|1|2|k,", 0, false},
+	} {
+		replay := Replay{Frames: encodeLZMALiterals([]byte(tt.frames))}
+		got, err := replay.DecodeFrames()
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("DecodeFrames(%q) = %d, %v, want %d, ok %v", tt.frames, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestTicksToTime(t *testing.T) {
+	for _, tt := range []struct {
+		ticks int64
+		want  time.Time
+	}{
+		{ticksAtUnixEpoch, time.Unix(0, 0).UTC()},
+		{ticksAtUnixEpoch + 1, time.Unix(0, 100).UTC()},
+		{637571108960000000, time.Date(2021, 5, 20, 12, 34, 56, 0, time.UTC)},
+	} {
+		if got := ticksToTime(tt.ticks); !got.Equal(tt.want) {
+			t.Errorf("ticksToTime(%d) = %v, want %v", tt.ticks, got, tt.want)
+		}
+	}
+}
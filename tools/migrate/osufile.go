@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// osu!standard's max combo, worked out from a .osu file: a circle or spinner
+// is 1 combo, and a slider 1 for its head, plus its ticks & the end of each
+// span (a repeat, or its tail). this is how lazer works out legacy maps'
+// combo, which can be off by one or two from stable's on odd sliders.
+
+// ticks closer than this (in ms) to the end of a span aren't added
+const sliderTickMinDistance = 10
+
+type timingPoint struct {
+	time        float64
+	beatLength  float64
+	uninherited bool
+}
+
+// beatmapMaxCombo reads an osu!standard .osu file's max combo.
+func beatmapMaxCombo(r io.Reader) (int, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	version := 14
+	sliderMultiplier, tickRate := 1.4, 1.0
+	var points []timingPoint
+	type slider struct {
+		time   float64
+		slides int
+		length float64
+	}
+	var sliders []slider
+	combo := 0
+
+	section := ""
+	for first := true; sc.Scan(); first = false {
+		line := strings.TrimSpace(sc.Text())
+		if first {
+			line = strings.TrimPrefix(line, "\ufeff")
+			if v, ok := strings.CutPrefix(line, "osu file format v"); ok {
+				if n, err := strconv.Atoi(v); err == nil {
+					version = n
+				}
+			}
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "//") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = line[1 : len(line)-1]
+			continue
+		}
+
+		switch section {
+		case "General":
+			if key, value, ok := strings.Cut(line, ":"); ok && strings.TrimSpace(key) == "Mode" && strings.TrimSpace(value) != "0" {
+				return 0, errors.New("not an osu!standard map")
+			}
+		case "Difficulty":
+			key, value, ok := strings.Cut(line, ":")
+			if !ok {
+				continue
+			}
+			v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				continue
+			}
+			switch strings.TrimSpace(key) {
+			case "SliderMultiplier":
+				sliderMultiplier = v
+			case "SliderTickRate":
+				tickRate = v
+			}
+		case "TimingPoints":
+			fields := strings.Split(line, ",")
+			if len(fields) < 2 {
+				continue
+			}
+			t, err1 := strconv.ParseFloat(fields[0], 64)
+			beatLength, err2 := strconv.ParseFloat(fields[1], 64)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			uninherited := beatLength > 0
+			if len(fields) > 6 {
+				uninherited = strings.TrimSpace(fields[6]) != "0"
+			}
+			points = append(points, timingPoint{t, beatLength, uninherited})
+		case "HitObjects":
+			fields := strings.Split(line, ",")
+			if len(fields) < 4 {
+				continue
+			}
+			t, err1 := strconv.ParseFloat(fields[2], 64)
+			kind, err2 := strconv.Atoi(fields[3])
+			if err1 != nil || err2 != nil {
+				return 0, errors.New("malformed hit object: " + line)
+			}
+			if kind&2 == 0 || len(fields) < 8 {
+				combo++ // circles & spinners
+				continue
+			}
+			slides, err1 := strconv.Atoi(fields[6])
+			length, err2 := strconv.ParseFloat(fields[7], 64)
+			if err1 != nil || err2 != nil {
+				return 0, errors.New("malformed slider: " + line)
+			}
+			sliders = append(sliders, slider{t, max(slides, 1), length})
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return 0, err
+	}
+
+	sort.SliceStable(points, func(i, j int) bool { return points[i].time < points[j].time })
+	for _, s := range sliders {
+		beatLength, sv := 1000.0, 1.0
+		for _, p := range points {
+			if p.time > s.time {
+				break
+			}
+			if p.uninherited {
+				beatLength, sv = p.beatLength, 1
+			} else if p.beatLength < 0 {
+				sv = math.Min(math.Max(-100/p.beatLength, 0.1), 10)
+			}
+		}
+
+		// px per ms, and between ticks, which older maps didn't scale by sv
+		velocity := 100 * sliderMultiplier * sv / beatLength
+		tickDistance := 100 * sliderMultiplier * sv / tickRate
+		if version < 8 {
+			tickDistance /= sv
+		}
+
+		ticks := 0
+		if tickDistance > 0 && s.length > 0 {
+			minDistance := velocity * sliderTickMinDistance
+			for d := tickDistance; d < s.length-minDistance; d += tickDistance {
+				ticks++
+			}
+		}
+		combo += 1 + s.slides*(ticks+1)
+	}
+	return combo, nil
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// a minimal parquet writer, for export analytics: flat schemas of int64,
+// double, string, bytes & timestamp columns, each of which may be null.
+// every column chunk is a single PLAIN encoded data page (v1), optionally
+// gzipped, and the metadata is thrift's compact protocol, as described at
+// https://github.com/apache/parquet-format. there are no dictionaries or
+// statistics, which readers (duckdb, bigquery, spark, pandas) don't need.
+
+// rows per row group, i.e. buffered in memory before they're written
+const parquetRowGroupRows = 1 << 16
+
+// parquet's physical types
+const (
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+)
+
+// parquet's converted types
+const (
+	parquetUTF8            = 0
+	parquetTimestampMillis = 9
+)
+
+// ParquetColumn is a column of a parquet file.
+type ParquetColumn struct {
+	Name string
+	Type int // parquetInt64, parquetDouble or parquetByteArray
+	// for int64, parquetTimestampMillis, and for byte arrays, parquetUTF8
+	// if they're text, or -1
+	Converted int
+}
+
+// thriftWriter encodes structs in thrift's compact protocol.
+type thriftWriter struct {
+	buf  []byte
+	last []int16 // the last field id written, of each struct being written
+}
+
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+func newThriftWriter() *thriftWriter {
+	return &thriftWriter{last: []int16{0}}
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	last := &t.last[len(t.last)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		t.buf = append(t.buf, byte(delta)<<4|typ)
+	} else {
+		t.buf = append(t.buf, typ)
+		t.buf = binary.AppendVarint(t.buf, int64(id))
+	}
+	*last = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.buf = binary.AppendVarint(t.buf, int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.buf = binary.AppendVarint(t.buf, v)
+}
+
+func (t *thriftWriter) binary(id int16, v string) {
+	t.field(id, thriftBinary)
+	t.buf = binary.AppendUvarint(t.buf, uint64(len(v)))
+	t.buf = append(t.buf, v...)
+}
+
+// list starts a list of n elements of a type, which are written next.
+func (t *thriftWriter) list(id int16, elem byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.buf = append(t.buf, byte(n)<<4|elem)
+	} else {
+		t.buf = append(t.buf, 0xf0|elem)
+		t.buf = binary.AppendUvarint(t.buf, uint64(n))
+	}
+}
+
+func (t *thriftWriter) i32Element(v int32) {
+	t.buf = binary.AppendVarint(t.buf, int64(v))
+}
+
+func (t *thriftWriter) binaryElement(v string) {
+	t.buf = binary.AppendUvarint(t.buf, uint64(len(v)))
+	t.buf = append(t.buf, v...)
+}
+
+// begin starts a struct, as a field if id isn't 0, or as a list element.
+func (t *thriftWriter) begin(id int16) {
+	if id != 0 {
+		t.field(id, thriftStruct)
+	}
+	t.last = append(t.last, 0)
+}
+
+func (t *thriftWriter) end() {
+	t.buf = append(t.buf, 0)
+	t.last = t.last[:len(t.last)-1]
+}
+
+// parquetChunk is where a column chunk was written, for the footer.
+type parquetChunk struct {
+	offset int64
+	size   int64 // compressed, including the page header
+	raw    int64 // uncompressed, including the page header
+	values int64
+}
+
+type parquetRowGroup struct {
+	rows   int64
+	chunks []parquetChunk
+}
+
+// parquetColumnBuffer holds a column's values of the row group being built.
+type parquetColumnBuffer struct {
+	values  bytes.Buffer
+	defined []bool
+}
+
+// ParquetWriter writes rows to a parquet file.
+type ParquetWriter struct {
+	w         io.Writer
+	offset    int64
+	columns   []ParquetColumn
+	buffers   []parquetColumnBuffer
+	rows      int
+	rowGroups []parquetRowGroup
+	gzip      bool
+}
+
+// NewParquetWriter starts a parquet file, whose pages are gzipped if asked.
+func NewParquetWriter(w io.Writer, columns []ParquetColumn, gzipped bool) (*ParquetWriter, error) {
+	pw := &ParquetWriter{w: w, columns: columns, buffers: make([]parquetColumnBuffer, len(columns)), gzip: gzipped}
+	return pw, pw.write([]byte("PAR1"))
+}
+
+func (pw *ParquetWriter) write(b []byte) error {
+	n, err := pw.w.Write(b)
+	pw.offset += int64(n)
+	return err
+}
+
+// Write adds a row, whose values are nil, or an int64, float64, string,
+// []byte or time.Time, as its column's type takes.
+func (pw *ParquetWriter) Write(row []interface{}) error {
+	for i, v := range row {
+		buf := &pw.buffers[i]
+		buf.defined = append(buf.defined, v != nil)
+		var scratch [8]byte
+		switch v := v.(type) {
+		case nil:
+		case int64:
+			binary.LittleEndian.PutUint64(scratch[:], uint64(v))
+			buf.values.Write(scratch[:])
+		case float64:
+			binary.LittleEndian.PutUint64(scratch[:], math.Float64bits(v))
+			buf.values.Write(scratch[:])
+		case time.Time:
+			binary.LittleEndian.PutUint64(scratch[:], uint64(v.UnixMilli()))
+			buf.values.Write(scratch[:])
+		case string:
+			binary.LittleEndian.PutUint32(scratch[:4], uint32(len(v)))
+			buf.values.Write(scratch[:4])
+			buf.values.WriteString(v)
+		case []byte:
+			binary.LittleEndian.PutUint32(scratch[:4], uint32(len(v)))
+			buf.values.Write(scratch[:4])
+			buf.values.Write(v)
+		default:
+			return fmt.Errorf("parquet: %s can't hold a %T", pw.columns[i].Name, v)
+		}
+	}
+	if pw.rows++; pw.rows == parquetRowGroupRows {
+		return pw.flush()
+	}
+	return nil
+}
+
+// definitionLevels encodes which values are null, as a bit-packed run of
+// the rle/bit-packing hybrid, prefixed with its length.
+func definitionLevels(defined []bool) []byte {
+	groups := (len(defined) + 7) / 8
+	levels := binary.AppendUvarint(make([]byte, 4, 4+binary.MaxVarintLen64+groups), uint64(groups<<1|1))
+	packed := make([]byte, groups)
+	for i, d := range defined {
+		if d {
+			packed[i/8] |= 1 << (i % 8)
+		}
+	}
+	levels = append(levels, packed...)
+	binary.LittleEndian.PutUint32(levels, uint32(len(levels)-4))
+	return levels
+}
+
+// flush writes the row group being built, a page per column.
+func (pw *ParquetWriter) flush() error {
+	if pw.rows == 0 {
+		return nil
+	}
+	group := parquetRowGroup{rows: int64(pw.rows)}
+	for i := range pw.columns {
+		buf := &pw.buffers[i]
+		page := append(definitionLevels(buf.defined), buf.values.Bytes()...)
+		raw := len(page)
+		if pw.gzip {
+			var compressed bytes.Buffer
+			gz := gzip.NewWriter(&compressed)
+			gz.Write(page)
+			if err := gz.Close(); err != nil {
+				return err
+			}
+			page = compressed.Bytes()
+		}
+
+		header := newThriftWriter()
+		header.i32(1, 0) // DATA_PAGE
+		header.i32(2, int32(raw))
+		header.i32(3, int32(len(page)))
+		header.begin(5)
+		header.i32(1, int32(pw.rows))
+		header.i32(2, 0) // PLAIN
+		header.i32(3, 3) // RLE
+		header.i32(4, 3)
+		header.end()
+		header.end()
+
+		chunk := parquetChunk{
+			offset: pw.offset,
+			size:   int64(len(header.buf) + len(page)),
+			raw:    int64(len(header.buf) + raw),
+			values: int64(pw.rows),
+		}
+		if err := pw.write(header.buf); err != nil {
+			return err
+		}
+		if err := pw.write(page); err != nil {
+			return err
+		}
+		group.chunks = append(group.chunks, chunk)
+		buf.values.Reset()
+		buf.defined = buf.defined[:0]
+	}
+	pw.rowGroups = append(pw.rowGroups, group)
+	pw.rows = 0
+	return nil
+}
+
+// Close writes the last row group, and the footer.
+func (pw *ParquetWriter) Close() error {
+	if err := pw.flush(); err != nil {
+		return err
+	}
+
+	var total int64
+	for _, group := range pw.rowGroups {
+		total += group.rows
+	}
+	codec := int32(0) // UNCOMPRESSED
+	if pw.gzip {
+		codec = 2 // GZIP
+	}
+
+	meta := newThriftWriter()
+	meta.i32(1, 1)
+	meta.list(2, thriftStruct, len(pw.columns)+1)
+	meta.begin(0)
+	meta.binary(4, "schema")
+	meta.i32(5, int32(len(pw.columns)))
+	meta.end()
+	for _, column := range pw.columns {
+		meta.begin(0)
+		meta.i32(1, int32(column.Type))
+		meta.i32(3, 1) // OPTIONAL
+		meta.binary(4, column.Name)
+		if column.Converted >= 0 {
+			meta.i32(6, int32(column.Converted))
+		}
+		meta.end()
+	}
+	meta.i64(3, total)
+	meta.list(4, thriftStruct, len(pw.rowGroups))
+	for _, group := range pw.rowGroups {
+		meta.begin(0)
+		meta.list(1, thriftStruct, len(group.chunks))
+		var size int64
+		for i, chunk := range group.chunks {
+			size += chunk.raw
+			meta.begin(0)
+			meta.i64(2, chunk.offset)
+			meta.begin(3)
+			meta.i32(1, int32(pw.columns[i].Type))
+			meta.list(2, thriftI32, 2)
+			meta.i32Element(0) // PLAIN
+			meta.i32Element(3) // RLE
+			meta.list(3, thriftBinary, 1)
+			meta.binaryElement(pw.columns[i].Name)
+			meta.i32(4, codec)
+			meta.i64(5, chunk.values)
+			meta.i64(6, chunk.raw)
+			meta.i64(7, chunk.size)
+			meta.i64(9, chunk.offset)
+			meta.end()
+			meta.end()
+		}
+		meta.i64(2, size)
+		meta.i64(3, group.rows)
+		meta.end()
+	}
+	meta.binary(6, "bancho.py migrate")
+	meta.end()
+
+	footer := binary.LittleEndian.AppendUint32(meta.buf, uint32(len(meta.buf)))
+	return pw.write(append(footer, "PAR1"...))
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// thriftReader decodes thrift's compact protocol, as parquet readers do, to
+// check what thriftWriter & ParquetWriter write. structs are read as maps
+// of their field ids.
+type thriftReader struct {
+	t *testing.T
+	b []byte
+}
+
+func (r *thriftReader) varint() int64 {
+	v, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.t.Fatal("bad varint")
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.t.Fatal("bad uvarint")
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *thriftReader) byte() byte {
+	if len(r.b) == 0 {
+		r.t.Fatal("truncated thrift")
+	}
+	b := r.b[0]
+	r.b = r.b[1:]
+	return b
+}
+
+func (r *thriftReader) value(typ byte) interface{} {
+	switch typ {
+	case thriftI32, thriftI64:
+		return r.varint()
+	case thriftBinary:
+		n := r.uvarint()
+		s := string(r.b[:n])
+		r.b = r.b[n:]
+		return s
+	case thriftList:
+		header := r.byte()
+		n, elem := uint64(header>>4), header&0xf
+		if n == 15 {
+			n = r.uvarint()
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			list[i] = r.value(elem)
+		}
+		return list
+	case thriftStruct:
+		return r.structure()
+	}
+	r.t.Fatalf("unexpected thrift type %d", typ)
+	return nil
+}
+
+func (r *thriftReader) structure() map[int16]interface{} {
+	fields := make(map[int16]interface{})
+	var last int16
+	for {
+		header := r.byte()
+		if header == 0 {
+			return fields
+		}
+		id := last + int16(header>>4)
+		if header>>4 == 0 {
+			id = int16(r.varint())
+		}
+		fields[id] = r.value(header & 0xf)
+		last = id
+	}
+}
+
+func TestThriftWriter(t *testing.T) {
+	w := newThriftWriter()
+	w.i32(1, -3)
+	w.i64(2, 1<<40)
+	w.binary(20, "far") // too far after 2 for the short form
+	w.list(21, thriftI32, 2)
+	w.i32Element(7)
+	w.i32Element(-7)
+	w.list(22, thriftBinary, 20)
+	for i := 0; i < 20; i++ {
+		w.binaryElement("x")
+	}
+	w.begin(23)
+	w.i32(1, 5) // structs count their fields from 0 again
+	w.end()
+	w.end()
+
+	r := &thriftReader{t: t, b: w.buf}
+	got := r.structure()
+	twenty := make([]interface{}, 20)
+	for i := range twenty {
+		twenty[i] = "x"
+	}
+	want := map[int16]interface{}{
+		1: int64(-3), 2: int64(1 << 40), 20: "far",
+		21: []interface{}{int64(7), int64(-7)},
+		22: twenty,
+		23: map[int16]interface{}{1: int64(5)},
+	}
+	if !reflect.DeepEqual(got, want) || len(r.b) != 0 {
+		t.Errorf("thriftWriter wrote %v (and %d bytes more), want %v", got, len(r.b), want)
+	}
+}
+
+func TestDefinitionLevels(t *testing.T) {
+	for _, tt := range []struct {
+		defined []bool
+		want    []byte
+	}{
+		{nil, []byte{1, 0, 0, 0, 0x01}},
+		{[]bool{true}, []byte{2, 0, 0, 0, 0x03, 0x01}},
+		{[]bool{false, true, true}, []byte{2, 0, 0, 0, 0x03, 0x06}},
+		{[]bool{true, false, true, false, true, false, true, false, true}, []byte{3, 0, 0, 0, 0x05, 0x55, 0x01}},
+	} {
+		if got := definitionLevels(tt.defined); !bytes.Equal(got, tt.want) {
+			t.Errorf("definitionLevels(%v) = %x, want %x", tt.defined, got, tt.want)
+		}
+	}
+}
+
+func TestParquetWriter(t *testing.T) {
+	columns := []ParquetColumn{
+		{"id", parquetInt64, -1},
+		{"pp", parquetDouble, -1},
+		{"name", parquetByteArray, parquetUTF8},
+		{"played", parquetInt64, parquetTimestampMillis},
+		{"checksum", parquetByteArray, -1},
+	}
+	played := time.Date(2023, 4, 5, 6, 7, 8, 9e6, time.UTC)
+	rows := [][]interface{}{
+		{int64(1), 727.5, "cmyui", played, []byte{0xde, 0xad}},
+		{int64(2), nil, "", nil, nil},
+		{int64(-3), math.Inf(1), nil, played, []byte{}},
+	}
+
+	for _, gzipped := range []bool{false, true} {
+		var buf bytes.Buffer
+		pw, err := NewParquetWriter(&buf, columns, gzipped)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, row := range rows {
+			if err := pw.Write(row); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := pw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		data := buf.Bytes()
+		if !bytes.HasPrefix(data, []byte("PAR1")) || !bytes.HasSuffix(data, []byte("PAR1")) {
+			t.Fatal("the file doesn't start & end with PAR1")
+		}
+		footerSize := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+		footer := &thriftReader{t: t, b: data[len(data)-8-footerSize : len(data)-8]}
+		meta := footer.structure()
+
+		if meta[3] != int64(len(rows)) {
+			t.Errorf("num_rows = %v, want %d", meta[3], len(rows))
+		}
+		schema := meta[2].([]interface{})
+		if len(schema) != len(columns)+1 {
+			t.Fatalf("the schema has %d elements, want %d", len(schema), len(columns)+1)
+		}
+		for i, column := range columns {
+			element := schema[i+1].(map[int16]interface{})
+			if element[4] != column.Name || element[1] != int64(column.Type) {
+				t.Errorf("schema element %d = %v, want %s", i+1, element, column.Name)
+			}
+		}
+
+		// read each column's values back from its page
+		chunks := meta[4].([]interface{})[0].(map[int16]interface{})[1].([]interface{})
+		for i, column := range columns {
+			chunk := chunks[i].(map[int16]interface{})[3].(map[int16]interface{})
+			offset := chunk[9].(int64)
+			page := &thriftReader{t: t, b: data[offset:]}
+			header := page.structure()
+			body := page.b[:header[3].(int64)]
+			if gzipped {
+				gz, err := gzip.NewReader(bytes.NewReader(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if body, err = io.ReadAll(gz); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if int64(len(body)) != header[2].(int64) {
+				t.Errorf("%s's page is %d bytes uncompressed, its header says %d", column.Name, len(body), header[2])
+			}
+
+			levels := int(binary.LittleEndian.Uint32(body))
+			packed, values := body[5:4+levels], body[4+levels:]
+			for row := range rows {
+				defined := packed[row/8]>>(row%8)&1 != 0
+				want := rows[row][i]
+				if defined != (want != nil) {
+					t.Errorf("%s row %d is defined: %v, want %v", column.Name, row, defined, want != nil)
+					continue
+				}
+				if !defined {
+					continue
+				}
+				var got interface{}
+				if column.Type == parquetByteArray {
+					n := binary.LittleEndian.Uint32(values)
+					got, values = values[4:4+n], values[4+n:]
+				} else {
+					got, values = binary.LittleEndian.Uint64(values), values[8:]
+				}
+				var expected interface{}
+				switch want := want.(type) {
+				case int64:
+					expected = uint64(want)
+				case float64:
+					expected = math.Float64bits(want)
+				case time.Time:
+					expected = uint64(want.UnixMilli())
+				case string:
+					expected = []byte(want)
+				case []byte:
+					expected = want
+				}
+				if !reflect.DeepEqual(got, expected) {
+					t.Errorf("gzip %v: %s row %d = %v, want %v", gzipped, column.Name, row, got, expected)
+				}
+			}
+		}
+	}
+}
+
+func TestParquetWriterWrongType(t *testing.T) {
+	pw, err := NewParquetWriter(io.Discard, []ParquetColumn{{"id", parquetInt64, -1}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pw.Write([]interface{}{int32(1)}); err == nil {
+		t.Error("Write(int32) succeeded, want an error")
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// scores partition rebuilds the scores table with mysql's partitioning,
+// either a partition per mode, or per year or month of play_time, so that
+// pruning old scores becomes dropping a partition, rather than a DELETE
+// which rewrites a table of hundreds of gigabytes:
+//
+//	ALTER TABLE scores DROP PARTITION p2014;
+//
+// a table partitioned by play_time ends with a catch-all partition, which
+// new years (or months) are split out of as they come:
+//
+//	ALTER TABLE scores REORGANIZE PARTITION p_future INTO (
+//		PARTITION p2027 VALUES LESS THAN ('2028-01-01'),
+//		PARTITION p_future VALUES LESS THAN (MAXVALUE));
+//
+// the table is renamed to scores_unpartitioned, and copied into the new one
+// through the same pipeline as v4.2.0 (workers, checkpoints, --resume and
+// dead letters), keeping every score's id, so replays stay where they are.
+// bancho.py must be stopped until it's done. mysql needs the partitioning
+// column in every unique key, so the primary key becomes (id, mode) or
+// (id, play_time), and partitioned tables can't have foreign keys, so the
+// scores constraint added by `constraints add` is left out.
+
+const (
+	partitionByMode     = "mode"
+	partitionByPlayTime = "play_time"
+)
+
+// unpartitionedTable is where the scores are copied from.
+const unpartitionedTable = "scores_unpartitioned"
+
+var count_partitions = `
+SELECT COUNT(*) FROM information_schema.partitions
+WHERE table_schema = DATABASE() AND table_name = ? AND partition_name IS NOT NULL`
+
+// partitionClause builds the PARTITION BY of the new table. play_time's
+// partitions start from the oldest score's.
+func partitionClause(by, interval string, oldest time.Time) (string, error) {
+	var partitions []string
+	switch by {
+	case partitionByMode:
+		// modes without stats get a partition too, so no score is turned away
+		for mode := 0; mode <= 11; mode++ {
+			partitions = append(partitions, fmt.Sprintf("PARTITION p_mode%d VALUES IN (%d)", mode, mode))
+		}
+		return fmt.Sprintf("PARTITION BY LIST (mode) (\n\t%s)", strings.Join(partitions, ",\n\t")), nil
+
+	case partitionByPlayTime:
+		var step func(time.Time) time.Time
+		var name string
+		switch interval {
+		case "year":
+			oldest = time.Date(oldest.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+			step, name = func(t time.Time) time.Time { return t.AddDate(1, 0, 0) }, "p2006"
+		case "month":
+			oldest = time.Date(oldest.Year(), oldest.Month(), 1, 0, 0, 0, 0, time.UTC)
+			step, name = func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }, "p200601"
+		default:
+			return "", fmt.Errorf("unknown --interval %q, expected year or month", interval)
+		}
+
+		// up to the next interval, past which p_future takes the scores
+		end := step(time.Now().UTC())
+		for from := oldest; from.Before(end); from = step(from) {
+			partitions = append(partitions, fmt.Sprintf("PARTITION %s VALUES LESS THAN ('%s')",
+				from.Format(name), step(from).Format("2006-01-02")))
+		}
+		partitions = append(partitions, "PARTITION p_future VALUES LESS THAN (MAXVALUE)")
+		return fmt.Sprintf("PARTITION BY RANGE COLUMNS (play_time) (\n\t%s)", strings.Join(partitions, ",\n\t")), nil
+	}
+	return "", fmt.Errorf("unknown --by %q, expected mode or play_time", by)
+}
+
+// checkCopiedColumns makes sure the pipeline copies every column of the
+// scores table, besides mods_json, which is filled in again afterwards.
+func checkCopiedColumns() error {
+	columns, err := tableColumns(cfg.DBName, "scores")
+	if err != nil {
+		return err
+	}
+	copied := map[string]bool{"mods_json": true}
+	for _, column := range scoreColumns {
+		copied[column] = true
+	}
+	var missing []string
+	for _, column := range columns {
+		if !copied[strings.ToLower(column)] {
+			missing = append(missing, column)
+		}
+	}
+	if len(missing) != 0 {
+		return fmt.Errorf("scores has columns which wouldn't be copied: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// createPartitionedScores moves the scores table aside, and creates the
+// partitioned one in its place.
+func createPartitionedScores() error {
+	var oldest time.Time
+	if cfg.PartitionBy == partitionByPlayTime {
+		var unix int64
+		if err := DB.Get(&unix, "SELECT COALESCE(UNIX_TIMESTAMP(MIN(play_time)), UNIX_TIMESTAMP()) FROM scores"); err != nil {
+			return err
+		}
+		oldest = time.Unix(unix, 0).UTC()
+	}
+	partitions, err := partitionClause(cfg.PartitionBy, cfg.PartitionInterval, oldest)
+	if err != nil {
+		return err
+	}
+	withModsJSON, err := hasModsJSON()
+	if err != nil {
+		return err
+	}
+
+	// the table is only partitioned once it's empty, which is instant
+	stmts := []string{
+		fmt.Sprintf("RENAME TABLE scores TO %s", unpartitionedTable),
+		create_scores,
+		fmt.Sprintf("ALTER TABLE scores DROP PRIMARY KEY, ADD PRIMARY KEY (id, %s)", cfg.PartitionBy),
+		"ALTER TABLE scores " + partitions,
+	}
+	if withModsJSON {
+		stmts = append(stmts, add_mods_json)
+	}
+	for _, stmt := range stmts {
+		if _, err := DB.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	// new scores carry on from the old table's ids
+	var next int64
+	if err := DB.Get(&next, fmt.Sprintf("SELECT COALESCE(MAX(id), 0) + 1 FROM %s", unpartitionedTable)); err != nil {
+		return err
+	}
+	_, err = DB.Exec(fmt.Sprintf("ALTER TABLE scores AUTO_INCREMENT = %d", next))
+	return err
+}
+
+func runScoresPartition() error {
+	if cfg.PartitionBy != partitionByMode && cfg.PartitionBy != partitionByPlayTime {
+		return fmt.Errorf("unknown --by %q, expected mode or play_time", cfg.PartitionBy)
+	}
+	if _, err := partitionClause(cfg.PartitionBy, cfg.PartitionInterval, time.Now()); err != nil {
+		return err
+	}
+
+	// ctrl-c stops the copy gracefully, see signal.go
+	handleSignals()
+
+	if cfg.Resume {
+		exists, err := tableExists(unpartitionedTable)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("cannot resume: %s does not exist", unpartitionedTable)
+		}
+	} else {
+		var partitions int
+		if err := DB.Get(&partitions, count_partitions, "scores"); err != nil {
+			return err
+		}
+		if partitions != 0 {
+			return errors.New("the scores table is already partitioned")
+		}
+		if err := checkCopiedColumns(); err != nil {
+			return err
+		}
+
+		fmt.Printf("This will rebuild the scores table, partitioned by %s, moving the current one to %s.\n",
+			cfg.PartitionBy, unpartitionedTable)
+		fmt.Println("bancho.py must be stopped until it's done.")
+		if !confirm("Continue?") {
+			fmt.Println("Not partitioning the scores table")
+			return nil
+		}
+
+		if err := createCheckpointTables(); err != nil {
+			return err
+		}
+		if err := createPartitionedScores(); err != nil {
+			return fmt.Errorf("failed to create the partitioned scores table: %w", err)
+		}
+		logger.Info("created the partitioned scores table", "by", cfg.PartitionBy)
+	}
+
+	if err := tuneWorkers(); err != nil {
+		return err
+	}
+	if err := tuneBatching(); err != nil {
+		return err
+	}
+	if err := checkInsertMode(); err != nil {
+		return err
+	}
+
+	tables := []SourceTable{{Name: unpartitionedTable, KeepIDs: true}}
+	progress = newProgress(tables, NumWorkers)
+
+	// rows which can't be copied are kept here, instead of being lost
+	deadLetters = newDeadLetterFile(cfg.DeadLetterPath)
+	defer deadLetters.Close()
+
+	start := time.Now()
+	if err := migrateScores(tables, cfg.Resume); err != nil {
+		return err
+	}
+	// bancho.py's indexes (see indexes.go) are rebuilt as the old table had them
+	indexes, err := tableIndexes(unpartitionedTable)
+	if err != nil {
+		return err
+	}
+	if err := createScoreIndexes(indexes); err != nil {
+		return err
+	}
+
+	// the pipeline doesn't copy mods_json, see modsjson.go
+	if exists, err := hasModsJSON(); err != nil {
+		return err
+	} else if exists {
+		filled, err := fillModsJSON()
+		if err != nil {
+			return fmt.Errorf("failed to fill in mods_json, run scores mods-json --action sync: %w", err)
+		}
+		logger.Info("filled in mods_json", "scores", filled)
+	}
+	progress.summary()
+
+	// as with v4.2.0, the old table is only dropped once it's certain
+	// every score made it across
+	var drop bool
+	_, _, _, failed, _ := progress.totals()
+	switch {
+	case cfg.DropOldTables && failed != 0:
+		logger.Warn("some rows failed to copy, so the old table is kept despite --drop-old-tables", "failed", failed)
+	case cfg.DropOldTables:
+		drop = true
+	case cfg.KeepOldTables || cfg.Yes:
+	default:
+		drop = confirm(fmt.Sprintf("Do you wish to drop %s? [only do this if you're certain the copy was successful]", unpartitionedTable))
+	}
+	if drop {
+		if _, err := DB.Exec("DROP TABLE " + unpartitionedTable); err != nil {
+			return err
+		}
+		if err := dropCheckpointTables(); err != nil {
+			return err
+		}
+	} else {
+		logger.Info("not dropping the old table", "table", unpartitionedTable)
+	}
+
+	logger.Info("partitioned the scores table", "by", cfg.PartitionBy, "elapsed", time.Since(start).Round(time.Second))
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:              "scores partition",
+		Summary:           "rebuild the scores table partitioned by mode or play_time, so old scores can be pruned by dropping partitions",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.PartitionBy, "by", partitionByMode, "partition by mode, or by play_time")
+			flags.StringVar(&c.PartitionInterval, "interval", "year", "with --by play_time, a partition per year or month")
+			flags.BoolVar(&c.Resume, "resume", false, "continue an interrupted rebuild from its last checkpoint")
+			flags.IntVar(&c.Workers, "workers", 0, "number of concurrent workers (default: tuned to the database's max_connections)")
+			flags.IntVar(&c.MaxRetries, "max-retries", 5, "times to retry a batch after a deadlock, lock wait timeout or lost connection")
+			flags.StringVar(&c.InsertMode, "insert-mode", insertModeRow, "how scores are inserted: row, multirow, or infile to use LOAD DATA LOCAL INFILE (see fastinsert.go)")
+			batchingFlags(flags, c)
+			flags.BoolVar(&c.DropOldTables, "drop-old-table", false, "drop "+unpartitionedTable+" once it's been copied, without asking (it's kept if any rows failed)")
+			flags.BoolVar(&c.KeepOldTables, "keep-old-table", false, "keep "+unpartitionedTable+" once it's been copied, without asking")
+			flags.StringVar(&c.DeadLetterPath, "dead-letter", "", "file to write rows which failed to copy to (default: DATA_DIRECTORY/migrate_dead_letters.jsonl)")
+			flags.DurationVar(&c.ProgressInterval, "progress-interval", 10*time.Second, "how often to report progress (0 to disable)")
+			flags.StringVar(&c.ProgressFormat, "progress-format", "auto", "progress output format: tui for a dashboard, text, or log to report through the (structured) logger (default: tui on a terminal, otherwise text)")
+		},
+		Run: runScoresPartition,
+	})
+}
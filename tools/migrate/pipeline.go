@@ -0,0 +1,571 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// NumWorkers is the number of goroutines inserting scores concurrently,
+// each of which holds its own database connection. it's set by --workers,
+// or tuned to the database's connection limit, see tuneWorkers.
+var NumWorkers = 8
+
+// maxAutoWorkers caps how many workers are picked automatically. past this,
+// lock contention on the scores table outweighs any extra parallelism.
+const maxAutoWorkers = 16
+
+// freeConnections returns how many more connections the database accepts,
+// leaving one for the reader, and its connection limit.
+func freeConnections() (free int, maxConnections int, err error) {
+	if err := DB.Get(&maxConnections, "SELECT @@max_connections"); err != nil {
+		return 0, 0, err
+	}
+	var connected struct {
+		Name  string `db:"Variable_name"`
+		Value int    `db:"Value"`
+	}
+	if err := DB.Get(&connected, "SHOW STATUS LIKE 'Threads_connected'"); err != nil {
+		return 0, 0, err
+	}
+
+	// the reader needs a connection of its own
+	return maxConnections - connected.Value - 1, maxConnections, nil
+}
+
+// tuneWorkers picks the number of workers, and sizes the connection pool to
+// match. unless --workers is given, half of the database's free connections
+// are used, so that bancho.py (and anything else) can still connect.
+func tuneWorkers() error {
+	free, maxConnections, err := freeConnections()
+	if err != nil {
+		return err
+	}
+
+	if cfg.Workers > 0 {
+		NumWorkers = cfg.Workers
+		if NumWorkers > free {
+			logger.Warn("more workers were requested than the database has free connections",
+				"workers", NumWorkers, "free_connections", free, "max_connections", maxConnections)
+		}
+	} else {
+		NumWorkers = free / 2
+		if NumWorkers > maxAutoWorkers {
+			NumWorkers = maxAutoWorkers
+		}
+		if NumWorkers < 1 {
+			NumWorkers = 1
+		}
+	}
+	if cfg.MaxTransactions > 0 && NumWorkers > cfg.MaxTransactions {
+		NumWorkers = cfg.MaxTransactions
+	}
+	logger.Info("starting workers", "workers", NumWorkers, "free_connections", free, "max_connections", maxConnections)
+
+	// the reader holds one connection while each worker holds another
+	DB.SetMaxOpenConns(NumWorkers + 1)
+	DB.SetMaxIdleConns(NumWorkers + 1)
+	return nil
+}
+
+// BatchSize is the number of rows read per page, by the tools which page
+// through tables. migrating scores is sized by --chunk-size instead.
+const BatchSize = 3000
+
+// the bounds of the batching picked by tuneBatching
+const (
+	minCommitEvery = 1000
+	maxCommitEvery = 20000
+	maxInsertRows  = 1000
+)
+
+// a rough upper bound of the redo log written per migrated score, including
+// its id mapping, and of the size of a score in an insert statement
+const (
+	scoreRedoBytes   = 1024
+	scoreInsertBytes = 256
+)
+
+// batchingFlags registers the flags sizing how scores are read & written.
+func batchingFlags(flags *flag.FlagSet, c *Config) {
+	flags.IntVar(&c.ChunkSize, "chunk-size", 0, "rows read from the old tables at a time, and handed to a worker (default: --commit-every)")
+	flags.IntVar(&c.BatchSize, "batch-size", 0, "rows per insert statement with --insert-mode multirow (default: sized to max_allowed_packet)")
+	flags.IntVar(&c.CommitEvery, "commit-every", 0, "rows per transaction (default: sized to the innodb redo log)")
+}
+
+// redoLogCapacity returns the size of innodb's redo log, which is set by a
+// different variable depending on the server's version.
+func redoLogCapacity() (int64, error) {
+	var capacity int64
+	queries := []string{
+		"SELECT @@innodb_redo_log_capacity",                           // mysql 8.0.30+
+		"SELECT @@innodb_log_file_size * @@innodb_log_files_in_group", // older mysql, mariadb < 10.6
+		"SELECT @@innodb_log_file_size",                               // mariadb 10.6+
+	}
+	var err error
+	for _, query := range queries {
+		if err = DB.Get(&capacity, query); err == nil {
+			return capacity, nil
+		}
+	}
+	return 0, err
+}
+
+// tuneBatching fills in whichever of --chunk-size, --batch-size and
+// --commit-every weren't given. a transaction is kept to a tenth of the redo
+// log, so that innodb never has to stall on a checkpoint mid-commit, and an
+// insert statement to a quarter of max_allowed_packet.
+func tuneBatching() error {
+	if cfg.CommitEvery == 0 {
+		capacity, err := redoLogCapacity()
+		if err != nil {
+			return err
+		}
+		cfg.CommitEvery = int(capacity / 10 / scoreRedoBytes)
+		if cfg.CommitEvery < minCommitEvery {
+			cfg.CommitEvery = minCommitEvery
+		}
+		if cfg.CommitEvery > maxCommitEvery {
+			cfg.CommitEvery = maxCommitEvery
+		}
+	}
+	if cfg.ChunkSize == 0 {
+		cfg.ChunkSize = cfg.CommitEvery
+	}
+	if cfg.BatchSize == 0 {
+		var maxPacket int64
+		if err := DB.Get(&maxPacket, "SELECT @@max_allowed_packet"); err != nil {
+			return err
+		}
+		cfg.BatchSize = int(maxPacket / 4 / scoreInsertBytes)
+		if cfg.BatchSize > maxInsertRows {
+			cfg.BatchSize = maxInsertRows
+		}
+		if cfg.BatchSize < 1 {
+			cfg.BatchSize = 1
+		}
+	}
+	if cfg.BatchSize > cfg.CommitEvery {
+		cfg.BatchSize = cfg.CommitEvery
+	}
+
+	logger.Info("sized batches", "chunk_size", cfg.ChunkSize, "batch_size", cfg.BatchSize, "commit_every", cfg.CommitEvery)
+	return nil
+}
+
+// ScoreBatch is a page of rows read from a single source table.
+type ScoreBatch struct {
+	Table  SourceTable
+	Seq    int // position of this batch within its table
+	Scores []Score
+}
+
+// ReplayMove is a replay which must be moved from its old score id to its new one.
+type ReplayMove struct {
+	OldID int64 `db:"old_id"`
+	NewID int64 `db:"new_id"`
+}
+
+func oldReplayKey(move ReplayMove) string { return replayKey(move.OldID) }
+func newReplayKey(move ReplayMove) string { return replayKey(move.NewID) }
+
+// streamScores pages through a source table in id order and feeds each
+// page into the batches channel. since the channel is bounded, the reader
+// blocks whenever the workers fall behind, keeping memory usage flat.
+// when resuming, reading starts from the table's checkpoint and any rows
+// beyond it which were already migrated are skipped.
+func streamScores(table SourceTable, batches chan<- ScoreBatch, resume bool) error {
+	query := table.selectQuery()
+	var lastID int64
+	seq := 0
+
+	if resume {
+		var err error
+		if lastID, err = loadCheckpoint(table); err != nil {
+			return err
+		}
+		if lastID != 0 {
+			logger.Info("resuming table from checkpoint", "table", table.Name, "after_id", lastID)
+		}
+	}
+
+	for {
+		if isInterrupted() {
+			return errInterrupted
+		}
+
+		rows, err := DB.Queryx(query, lastID, cfg.ChunkSize)
+		if err != nil {
+			return err
+		}
+
+		scores := make([]Score, 0, cfg.ChunkSize)
+		for rows.Next() {
+			score := Score{}
+			if err := rows.StructScan(&score); err != nil {
+				rows.Close()
+				return err
+			}
+			scores = append(scores, score)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if len(scores) == 0 {
+			return nil
+		}
+
+		lastID = scores[len(scores)-1].ID
+		pageFull := len(scores) == cfg.ChunkSize
+		progress.addRead(table, len(scores))
+
+		if scoreFilter != nil {
+			kept := scores[:0]
+			for _, score := range scores {
+				if scoreFilter.match(table, score) {
+					kept = append(kept, score)
+				}
+			}
+			progress.addFiltered(table, len(scores)-len(kept))
+			scores = kept
+		}
+
+		if resume && len(scores) != 0 {
+			migrated, err := migratedIDs(table, scores[0].ID, lastID)
+			if err != nil {
+				return err
+			}
+
+			remaining := scores[:0]
+			for _, score := range scores {
+				if !migrated[score.ID] {
+					remaining = append(remaining, score)
+				}
+			}
+			progress.addSkipped(table, len(scores)-len(remaining))
+			scores = remaining
+		}
+
+		if len(scores) != 0 {
+			select {
+			case batches <- ScoreBatch{Table: table, Seq: seq, Scores: scores}:
+				seq++
+			case <-interrupted:
+				return errInterrupted
+			}
+		}
+
+		if !pageFull {
+			return nil
+		}
+	}
+}
+
+// migrateBatch inserts a batch of scores into the new table, committing
+// every --commit-every rows, then moves the replays of any submitted scores.
+// it reports whether every row in the batch was migrated successfully.
+func migrateBatch(batch ScoreBatch, worker int) bool {
+	log := logger.With("table", batch.Table.Name, "chunk", batch.Seq, "worker", worker)
+	log.Debug("migrating chunk", "rows", len(batch.Scores), "first_id", batch.Scores[0].ID)
+
+	// the checkpoint only passes the chunk once every transaction of it has
+	// committed, and a resumed run skips the rows which were, so transactions
+	// needn't line up with chunks
+	step := cfg.CommitEvery
+	if step <= 0 {
+		step = len(batch.Scores)
+	}
+	ok := true
+	for start := 0; start < len(batch.Scores); start += step {
+		end := start + step
+		if end > len(batch.Scores) {
+			end = len(batch.Scores)
+		}
+		part := batch
+		part.Scores = batch.Scores[start:end]
+		if !commitBatch(part, worker, log) {
+			ok = false
+			if isInterrupted() {
+				return false
+			}
+		}
+	}
+	return ok
+}
+
+// commitBatch inserts scores in a single transaction, retrying it as needed.
+func commitBatch(batch ScoreBatch, worker int, log *slog.Logger) bool {
+	// deadlocks & lock wait timeouts abort the whole transaction,
+	// so the batch is retried from the start
+	if err := throttle(len(batch.Scores)); err != nil {
+		// nothing was written, so the rows are left for --resume
+		log.Warn("abandoning chunk before writing it", "rows", len(batch.Scores), "err", err)
+		return false
+	}
+	var result batchResult
+	for attempt := 0; ; attempt++ {
+		var err error
+		if result, err = insertBatch(batch); err == nil {
+			break
+		}
+
+		reason, retryable := retryReason(err)
+		if !retryable || attempt >= cfg.MaxRetries {
+			log.Error("failed to migrate chunk", "rows", len(batch.Scores), "attempts", attempt+1, "err", err)
+			letters := make([]DeadLetter, 0, len(batch.Scores))
+			for _, score := range batch.Scores {
+				letters = append(letters, failedRow(batch.Table, score, err))
+			}
+			deadLetter(letters)
+			progress.addFailed(batch.Table, len(batch.Scores))
+			metricRowErrors.Add(float64(len(batch.Scores)), batch.Table.Name)
+			return false
+		}
+
+		delay := retryDelay(attempt)
+		log.Warn("retrying chunk", "reason", reason, "attempt", attempt+1, "delay", delay, "err", err)
+		metricBatchRetries.Inc(reason)
+		select {
+		case <-time.After(delay):
+		case <-interrupted:
+			// nothing was committed, so the rows are left for --resume
+			log.Warn("abandoning chunk, it was rolled back", "rows", len(batch.Scores))
+			return false
+		}
+	}
+
+	deadLetter(result.failed)
+	progress.addInserted(batch.Table, worker, result.inserted)
+	progress.addFailed(batch.Table, len(result.failed))
+	metricRowsMigrated.Add(float64(result.inserted), batch.Table.Name)
+	metricRowErrors.Add(float64(len(result.failed)), batch.Table.Name)
+
+	// only move replays once their scores are committed
+	if !benchmarking {
+		moveReplays(batch.Table, result.moves)
+	}
+
+	// rows which failed to insert hold back the checkpoint,
+	// so that they will be retried by a resumed run.
+	return len(result.failed) == 0
+}
+
+type batchResult struct {
+	inserted int
+	moves    []ReplayMove
+	failed   []DeadLetter // rows which can never be inserted as they are
+}
+
+// insertBatch makes a single attempt at inserting a batch. rows which fail
+// on their own are skipped, while retryable errors abort the transaction.
+func insertBatch(batch ScoreBatch) (batchResult, error) {
+	switch cfg.InsertMode {
+	case insertModeMultirow:
+		return insertBatchBulk(batch, insertModeMultirow)
+	case insertModeInfile:
+		result, err := insertBatchBulk(batch, insertModeInfile)
+		if errors.Is(err, errInfileRejected) {
+			logger.Warn("falling back to multi-row inserts for a chunk", "table", batch.Table.Name, "chunk", batch.Seq, "err", err)
+			return insertBatchBulk(batch, insertModeMultirow)
+		}
+		return result, err
+	}
+
+	var result batchResult
+	var insertedIDs []int64
+
+	tx, err := DB.Beginx()
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	for _, score := range batch.Scores {
+		original := score
+		score.Mode += batch.Table.ModeOffset
+		if batch.Table.Prepare != nil {
+			batch.Table.Prepare(&score)
+		}
+
+		if !score.OnlineChecksum.Valid {
+			score.OnlineChecksum.String = ""
+			score.OnlineChecksum.Valid = true
+		}
+
+		query, row := insert_score, score
+		if batch.Table.KeepIDs {
+			query = insert_score_with_id
+			row.ID = batch.Table.keptID(score.ID)
+		}
+		res, err := tx.NamedExec(query, &row)
+		if err != nil {
+			if _, retryable := retryReason(err); retryable {
+				return result, err
+			}
+			logger.Warn("failed to insert score", "table", batch.Table.Name, "old_id", score.ID, "err", err)
+			result.failed = append(result.failed, failedRow(batch.Table, original, err))
+			continue
+		}
+
+		new_id, err := res.LastInsertId()
+		if err != nil {
+			return result, fmt.Errorf("failed to get new id of score %d: %w", score.ID, err)
+		}
+
+		// this is a submitted score, its replay file must move as well
+		hasReplay := score.Status != 0 && (!batch.Table.KeepIDs || batch.Table.MoveKeptReplays)
+
+		// a score without its mapping couldn't be rolled back, so this fails the batch
+		_, err = tx.Exec(insert_score_id, batch.Table.Name, score.ID, new_id, hasReplay)
+		if err != nil {
+			return result, fmt.Errorf("failed to record id mapping of score %d: %w", score.ID, err)
+		}
+
+		if hasReplay {
+			result.moves = append(result.moves, ReplayMove{OldID: score.ID, NewID: new_id})
+		}
+		insertedIDs = append(insertedIDs, score.ID)
+		result.inserted++
+	}
+
+	commitStart := time.Now()
+	if err := tx.Commit(); err != nil {
+		// if the connection dropped during the commit, it may have gone
+		// through anyway, and retrying would insert every score twice
+		if reason, _ := retryReason(err); reason == "connection" && batchCommitted(batch.Table, insertedIDs) {
+			return result, nil
+		}
+		return result, err
+	}
+	metricBatchCommitSeconds.ObserveSince(commitStart)
+
+	return result, nil
+}
+
+// batchCommitted checks whether a batch was committed, by looking for the
+// id mappings which were inserted along with its scores.
+func batchCommitted(table SourceTable, oldIDs []int64) bool {
+	if len(oldIDs) == 0 {
+		return false
+	}
+	migrated, err := migratedIDs(table, oldIDs[0], oldIDs[0])
+	if err != nil {
+		logger.Error("failed to check whether a chunk was committed", "table", table.Name, "err", err)
+		return false
+	}
+	return migrated[oldIDs[0]]
+}
+
+// moveReplays moves replays to their new ids, and marks them as moved.
+func moveReplays(table SourceTable, moves []ReplayMove) {
+	if len(moves) == 0 {
+		return
+	}
+	moved := make([]int64, 0, len(moves))
+	pending := make([]ReplayMove, 0, len(moves))
+
+	for _, move := range moves {
+		if _, err := table.replays().Stat(table.oldReplayKey(move)); errors.Is(err, os.ErrNotExist) {
+			if replayAlreadyMoved(move) {
+				moved = append(moved, move.OldID)
+			} else {
+				logger.Warn("replay file could not be found", "table", table.Name, "old_id", move.OldID)
+				atomic.AddInt64(&progress.ReplaysMissing, 1)
+				metricReplayMoveFailures.Inc("missing")
+			}
+		} else {
+			pending = append(pending, move)
+		}
+	}
+
+	relocated, err := relocateReplays("move", table.Name, pending,
+		table.replays(), table.oldReplayKey, newReplays, newReplayKey)
+	if err != nil {
+		logger.Error("failed to move replays", "table", table.Name, "err", err)
+	}
+	for _, move := range relocated {
+		atomic.AddInt64(&progress.ReplaysMoved, 1)
+		metricReplaysMoved.Inc()
+		moved = append(moved, move.OldID)
+	}
+
+	if err := markReplaysMoved(table, moved); err != nil {
+		logger.Error("failed to record moved replays", "table", table.Name, "count", len(moved), "err", err)
+	}
+}
+
+// migrateScores streams every source table through a fixed pool of workers.
+func migrateScores(tables []SourceTable, resume bool) error {
+	// users are looked up by name once imports have created them
+	if err := setupScoreFilter(); err != nil {
+		return err
+	}
+	batches := make(chan ScoreBatch, NumWorkers)
+	tracker := newCheckpointTracker()
+
+	// report progress periodically while the migration runs
+	if err := progress.countRemaining(tables, resume); err != nil {
+		return err
+	}
+	stopReporting := make(chan struct{})
+	reported := make(chan struct{})
+	go func() {
+		progress.run(cfg.ProgressInterval, cfg.ProgressFormat, stopReporting)
+		close(reported)
+	}()
+	go progress.notifyMilestones(stopReporting)
+
+	metricWorkers.Set(float64(NumWorkers))
+
+	var wg sync.WaitGroup
+	for i := 0; i < NumWorkers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for batch := range batches {
+				// once interrupted, queued chunks are dropped rather than
+				// started, which holds their table's checkpoint back
+				if isInterrupted() {
+					continue
+				}
+				metricBusyWorkers.Add(1)
+				progress.setBusy(worker, true)
+				tracker.complete(batch, migrateBatch(batch, worker))
+				progress.setBusy(worker, false)
+				metricBusyWorkers.Add(-1)
+			}
+		}(i)
+	}
+
+	var err error
+	for _, table := range tables {
+		if err = streamScores(table, batches, resume); err != nil {
+			if err != errInterrupted {
+				err = fmt.Errorf("failed to read %s: %w", table.Name, err)
+			}
+			break
+		}
+	}
+
+	// let the workers drain whatever was already queued
+	close(batches)
+	wg.Wait()
+
+	// the dashboard's last frame is drawn before anything else is printed
+	close(stopReporting)
+	<-reported
+
+	if isInterrupted() {
+		progress.summary()
+		printResumeState(tables)
+		return errInterrupted
+	}
+	return err
+}
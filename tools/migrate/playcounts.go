@@ -0,0 +1,292 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// recalc playcounts rebuilds the maps table's plays & passes from the scores
+// (and the archive's, see archive.go), which bancho.py only ever adds to as
+// scores are submitted, so they drift as scores are deleted, wiped or
+// imported. with --summary, it also rebuilds user_map_plays, each user's
+// plays & passes per map, which makes a profile's most played maps a lookup
+// rather than a GROUP BY over all of the user's scores.
+//
+// --incremental only adds the scores submitted since the last run to
+// user_map_plays, by the highest score id it's counted, kept in
+// aggregate_watermarks. it's cheap enough to run every few minutes; a full
+// run every so often then takes deleted & archived scores back out. maps'
+// plays & passes aren't touched by it, as bancho.py counts new scores itself.
+
+// maps are recounted this many at a time
+const playcountMapChunk = 5000
+
+// users' summaries are rebuilt this many at a time
+const playcountUserChunk = 1000
+
+// new scores are added this many ids at a time
+const playcountScoreChunk = 50000
+
+const playcountWatermark = "user_map_plays"
+
+var create_user_map_plays = `
+create table if not exists user_map_plays
+(
+	userid int not null,
+	map_md5 char(32) not null,
+	mode tinyint(1) not null,
+	plays int unsigned default 0 not null,
+	passes int unsigned default 0 not null,
+	last_played datetime not null,
+	primary key (userid, mode, map_md5),
+	index user_map_plays_userid_mode_plays_index (userid, mode, plays)
+);`
+
+var create_aggregate_watermarks = `
+create table if not exists aggregate_watermarks
+(
+	name varchar(64) not null primary key,
+	last_id bigint unsigned not null,
+	updated_at datetime not null
+);`
+
+var upsert_watermark = `
+INSERT INTO aggregate_watermarks (name, last_id, updated_at) VALUES (?, ?, NOW())
+ON DUPLICATE KEY UPDATE last_id = VALUES(last_id), updated_at = NOW()`
+
+// playSources returns the scores (& archived scores) matching a condition,
+// as a derived table, and the args for each of its conditions.
+func playSources(tables []string, condition string, args ...interface{}) (string, []interface{}) {
+	selects := make([]string, len(tables))
+	var all []interface{}
+	for i, table := range tables {
+		selects[i] = fmt.Sprintf("SELECT userid, map_md5, mode, status, play_time FROM %s WHERE %s", table, condition)
+		all = append(all, args...)
+	}
+	return "(" + strings.Join(selects, " UNION ALL ") + ")", all
+}
+
+// recountMaps sets every map's plays & passes from its scores, returning
+// how many maps were off.
+func recountMaps(tables []string) (int64, error) {
+	var first, last int64
+	if err := DB.QueryRow("SELECT COALESCE(MIN(id), 0), COALESCE(MAX(id), 0) FROM maps").Scan(&first, &last); err != nil {
+		return 0, err
+	}
+	var fixed int64
+	for from := first; from <= last && last != 0; from += playcountMapChunk {
+		if isInterrupted() {
+			return fixed, errInterrupted
+		}
+		to := from + playcountMapChunk - 1
+		source, args := playSources(tables, "map_md5 IN (SELECT md5 FROM maps WHERE id BETWEEN ? AND ?)", from, to)
+		join := fmt.Sprintf(`maps m LEFT JOIN (
+			SELECT map_md5, COUNT(*) AS plays, SUM(status != 0) AS passes FROM %s s GROUP BY map_md5
+		) c ON c.map_md5 = m.md5`, source)
+		args = append(args, from, to)
+
+		if cfg.DryRun {
+			var n int64
+			err := DB.Get(&n, "SELECT COUNT(*) FROM "+join+` WHERE m.id BETWEEN ? AND ?
+			AND (m.plays != COALESCE(c.plays, 0) OR m.passes != COALESCE(c.passes, 0))`, args...)
+			if err != nil {
+				return fixed, err
+			}
+			fixed += n
+			continue
+		}
+		if err := throttle(playcountMapChunk); err != nil {
+			return fixed, err
+		}
+		res, err := DB.Exec("UPDATE "+join+` SET m.plays = COALESCE(c.plays, 0), m.passes = COALESCE(c.passes, 0)
+		WHERE m.id BETWEEN ? AND ?`, args...)
+		if err != nil {
+			return fixed, err
+		}
+		n, _ := res.RowsAffected()
+		fixed += n
+	}
+	return fixed, nil
+}
+
+// rebuildUserMapPlays rebuilds every user's summary from their scores up
+// to the watermark, a few users at a time.
+func rebuildUserMapPlays(tables []string, watermark int64) (int64, error) {
+	var first, last int64
+	if err := DB.QueryRow("SELECT COALESCE(MIN(id), 0), COALESCE(MAX(id), 0) FROM users").Scan(&first, &last); err != nil {
+		return 0, err
+	}
+	var rows int64
+	for from := first; from <= last && last != 0; from += playcountUserChunk {
+		if isInterrupted() {
+			return rows, errInterrupted
+		}
+		to := from + playcountUserChunk - 1
+		source, args := playSources(tables, "userid BETWEEN ? AND ? AND id <= ?", from, to, watermark)
+		if err := throttle(playcountUserChunk); err != nil {
+			return rows, err
+		}
+
+		tx, err := DB.Beginx()
+		if err != nil {
+			return rows, err
+		}
+		if _, err := tx.Exec("DELETE FROM user_map_plays WHERE userid BETWEEN ? AND ?", from, to); err != nil {
+			tx.Rollback()
+			return rows, err
+		}
+		res, err := tx.Exec(fmt.Sprintf(`
+		INSERT INTO user_map_plays (userid, map_md5, mode, plays, passes, last_played)
+		SELECT userid, map_md5, mode, COUNT(*), SUM(status != 0), MAX(play_time)
+		FROM %s s GROUP BY userid, mode, map_md5`, source), args...)
+		if err != nil {
+			tx.Rollback()
+			return rows, err
+		}
+		if err := tx.Commit(); err != nil {
+			return rows, err
+		}
+		n, _ := res.RowsAffected()
+		rows += n
+	}
+	return rows, nil
+}
+
+// addNewPlays adds the scores after the watermark to the summary, moving
+// the watermark along with each chunk.
+func addNewPlays(watermark, high int64) (int64, error) {
+	var added int64
+	for from := watermark; from < high; from += playcountScoreChunk {
+		if isInterrupted() {
+			return added, errInterrupted
+		}
+		to := min(from+playcountScoreChunk, high)
+		if err := throttle(int(to - from)); err != nil {
+			return added, err
+		}
+
+		tx, err := DB.Beginx()
+		if err != nil {
+			return added, err
+		}
+		res, err := tx.Exec(`
+		INSERT INTO user_map_plays (userid, map_md5, mode, plays, passes, last_played)
+		SELECT userid, map_md5, mode, COUNT(*), SUM(status != 0), MAX(play_time)
+		FROM scores WHERE id > ? AND id <= ? GROUP BY userid, mode, map_md5
+		ON DUPLICATE KEY UPDATE plays = plays + VALUES(plays), passes = passes + VALUES(passes),
+			last_played = GREATEST(last_played, VALUES(last_played))`, from, to)
+		if err != nil {
+			tx.Rollback()
+			return added, err
+		}
+		if _, err := tx.Exec(upsert_watermark, playcountWatermark, to); err != nil {
+			tx.Rollback()
+			return added, err
+		}
+		if err := tx.Commit(); err != nil {
+			return added, err
+		}
+		n, _ := res.RowsAffected()
+		added += n
+	}
+	return added, nil
+}
+
+// highestScoreID is the newest score counted by this run; scores submitted
+// meanwhile are left for the next.
+func highestScoreID(tables []string) (int64, error) {
+	var high int64
+	for _, table := range tables {
+		var id int64
+		if err := DB.Get(&id, fmt.Sprintf("SELECT COALESCE(MAX(id), 0) FROM %s", table)); err != nil {
+			return 0, err
+		}
+		high = max(high, id)
+	}
+	return high, nil
+}
+
+func runRecalcPlaycounts() error {
+	if cfg.PlaycountIncremental && !cfg.PlaycountSummary {
+		return errors.New("--incremental only updates the summary, so needs --summary")
+	}
+	tables := []string{"scores"}
+	if exists, err := tableExists(archiveTable); err != nil {
+		return err
+	} else if exists {
+		tables = append(tables, archiveTable)
+	}
+
+	handleSignals()
+	start := time.Now()
+
+	if cfg.PlaycountIncremental {
+		var watermark int64
+		err := DB.Get(&watermark, "SELECT last_id FROM aggregate_watermarks WHERE name = ?", playcountWatermark)
+		if err != nil {
+			return fmt.Errorf("no watermark for user_map_plays, run without --incremental first: %w", err)
+		}
+		high, err := highestScoreID([]string{"scores"})
+		if err != nil {
+			return err
+		}
+		logger.Info("adding new plays", "from_score", watermark, "to_score", high, "dry_run", cfg.DryRun)
+		if cfg.DryRun {
+			return nil
+		}
+		added, err := addNewPlays(watermark, high)
+		if err != nil {
+			return err
+		}
+		logger.Info("added new plays", "rows", added, "elapsed", time.Since(start).Round(time.Millisecond))
+		return nil
+	}
+
+	fixed, err := recountMaps(tables)
+	if err != nil {
+		return fmt.Errorf("failed to recount maps' plays: %w", err)
+	}
+	if cfg.DryRun {
+		logger.Info("found maps whose plays or passes are off", "maps", fixed)
+		return nil
+	}
+	logger.Info("recounted maps' plays", "fixed", fixed, "elapsed", time.Since(start).Round(time.Second))
+	if !cfg.PlaycountSummary {
+		return nil
+	}
+
+	for _, ddl := range []string{create_user_map_plays, create_aggregate_watermarks} {
+		if _, err := DB.Exec(ddl); err != nil {
+			return err
+		}
+	}
+	high, err := highestScoreID(tables)
+	if err != nil {
+		return err
+	}
+	rows, err := rebuildUserMapPlays(tables, high)
+	if err != nil {
+		return fmt.Errorf("failed to rebuild user_map_plays: %w", err)
+	}
+	if _, err := DB.Exec(upsert_watermark, playcountWatermark, high); err != nil {
+		return err
+	}
+	logger.Info("rebuilt user_map_plays", "rows", rows, "to_score", high, "elapsed", time.Since(start).Round(time.Second))
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "recalc playcounts",
+		Summary: "rebuild maps' plays & passes from the scores, and optionally each user's plays per map (user_map_plays)",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.BoolVar(&c.PlaycountSummary, "summary", false, "also rebuild user_map_plays, each user's plays & passes per map")
+			flags.BoolVar(&c.PlaycountIncremental, "incremental", false, "only add scores submitted since the last run to user_map_plays")
+			flags.BoolVar(&c.DryRun, "dry-run", false, "count the maps whose plays are off, or the scores to add, without changing anything")
+		},
+		Run: runRecalcPlaycounts,
+	})
+}
@@ -0,0 +1,78 @@
+#!/usr/bin/env python3
+"""pp calculator for `migrate recalc pp`, using the same rosu-pp bindings
+(akatsuki-pp-py) as bancho.py itself, so pp always matches the server's.
+
+reads one json score per line from stdin, and writes its pp & star rating
+(or an error) as one json object per line to stdout, in the same order.
+"""
+from __future__ import annotations
+
+import json
+import math
+import sys
+from collections import OrderedDict
+
+from akatsuki_pp_py import Beatmap
+from akatsuki_pp_py import Calculator
+
+DOUBLETIME = 1 << 6
+NIGHTCORE = 1 << 9
+
+# scores are sent in order of beatmap, so only a few need to be kept parsed
+MAX_CACHED_BEATMAPS = 64
+
+
+def calculate(score: dict, beatmaps: OrderedDict[str, Beatmap]) -> dict:
+    beatmap = beatmaps.get(score["path"])
+    if beatmap is None:
+        beatmap = Beatmap(path=score["path"])
+        beatmaps[score["path"]] = beatmap
+        if len(beatmaps) > MAX_CACHED_BEATMAPS:
+            beatmaps.popitem(last=False)
+    else:
+        beatmaps.move_to_end(score["path"])
+
+    # rosu-pp ignores NC and requires DT
+    mods = score["mods"]
+    if mods & NIGHTCORE:
+        mods |= DOUBLETIME
+
+    calculator = Calculator(
+        mode=score["mode"],
+        mods=mods,
+        combo=score["combo"],
+        n_geki=score["ngeki"],
+        n300=score["n300"],
+        n_katu=score["nkatu"],
+        n100=score["n100"],
+        n50=score["n50"],
+        n_misses=score["nmiss"],
+    )
+    performance = calculator.performance(beatmap)
+    pp, stars = performance.pp, performance.difficulty.stars
+
+    if math.isnan(pp) or math.isinf(pp):
+        pp = 0.0
+    if math.isnan(stars) or math.isinf(stars):
+        stars = 0.0
+    return {"pp": pp, "stars": stars}
+
+
+def main() -> int:
+    beatmaps: OrderedDict[str, Beatmap] = OrderedDict()
+
+    for line in sys.stdin:
+        score = json.loads(line)
+        try:
+            result = calculate(score, beatmaps)
+        except Exception as exc:
+            result = {"error": str(exc)}
+
+        sys.stdout.write(json.dumps(result) + "\n")
+        sys.stdout.flush()
+
+    return 0
+
+
+if __name__ == "__main__":
+    raise SystemExit(main())
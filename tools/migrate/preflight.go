@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// forks of gulag & bancho.py have often drifted from the schema migrations
+// expect, with renamed, retyped or missing columns, which would otherwise
+// only surface as a scan error partway through migrating. before each
+// migration runs, the tables it reads are compared against what it expects.
+// missing optional columns fall back to a default, and anything else can
+// be mapped with --column-map, a json file of sql expressions over the old
+// row, per table & column, e.g.
+//
+//	{"scores_vn": {"play_time": "FROM_UNIXTIME(time)", "userid": "user_id"}}
+
+// ExpectedColumn is a column a migration reads from an old table.
+type ExpectedColumn struct {
+	Name     string
+	Kind     string   // integer, float, string or time
+	Fallback string   // for optional columns, the expression used when it's missing
+	Aliases  []string // what older versions named it, read if it's missing
+}
+
+// columnKind groups mysql's types by how they're scanned.
+func columnKind(dataType string) string {
+	switch dataType {
+	case "tinyint", "smallint", "mediumint", "int", "integer", "bigint", "bit", "bool", "boolean", "year":
+		return "integer"
+	case "float", "double", "real", "decimal", "numeric":
+		return "float"
+	case "datetime", "timestamp", "date":
+		return "time"
+	}
+	return "string"
+}
+
+// kindCompatible reports whether a column of one kind can be scanned as another.
+func kindCompatible(expected, actual string) bool {
+	return expected == actual || expected == "float" && actual == "integer"
+}
+
+// the columns of the pre-v4.2.0 scores tables, as read by select_scores
+var expectedScoreColumns = []ExpectedColumn{
+	{Name: "id", Kind: "integer"},
+	{Name: "map_md5", Kind: "string"},
+	{Name: "score", Kind: "integer"},
+	{Name: "pp", Kind: "float"},
+	{Name: "acc", Kind: "float"},
+	{Name: "max_combo", Kind: "integer"},
+	{Name: "mods", Kind: "integer"},
+	{Name: "n300", Kind: "integer"},
+	{Name: "n100", Kind: "integer"},
+	{Name: "n50", Kind: "integer"},
+	{Name: "nmiss", Kind: "integer"},
+	{Name: "ngeki", Kind: "integer"},
+	{Name: "nkatu", Kind: "integer"},
+	{Name: "grade", Kind: "string"},
+	{Name: "status", Kind: "integer"},
+	{Name: "mode", Kind: "integer", Aliases: []string{"game_mode"}}, // renamed in gulag v3
+	{Name: "play_time", Kind: "time"},
+	{Name: "time_elapsed", Kind: "integer", Fallback: "0"}, // missing from early gulag v3
+	{Name: "client_flags", Kind: "integer", Fallback: "0"}, // missing from early gulag v3
+	{Name: "userid", Kind: "integer"},
+	{Name: "perfect", Kind: "integer"},
+	{Name: "online_checksum", Kind: "string", Fallback: "NULL"}, // added in v3.5.2
+}
+
+// ColumnMap maps a table's columns to sql expressions over its old rows.
+type ColumnMap map[string]map[string]string
+
+func loadColumnMap(path string) (ColumnMap, error) {
+	if path == "" {
+		return ColumnMap{}, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m ColumnMap
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return m, nil
+}
+
+// SchemaCheck is the result of comparing one table against what's expected.
+type SchemaCheck struct {
+	Table    string
+	Problems []string // which stop the migration from running
+	Notes    []string // which it adapts to
+
+	// the expression each expected column is read with
+	Exprs map[string]string
+}
+
+// checkTableSchema compares a table against the columns a migration reads.
+func checkTableSchema(t *TableSchema, expected []ExpectedColumn, mapped map[string]string) SchemaCheck {
+	check := SchemaCheck{Table: t.Name, Exprs: make(map[string]string)}
+	actual := make(map[string]ColumnSchema, len(t.Columns))
+	for _, c := range t.Columns {
+		actual[strings.ToLower(c.Name)] = c
+	}
+
+	known := make(map[string]bool, len(expected))
+	aliased := make(map[string]bool)
+	for _, e := range expected {
+		known[e.Name] = true
+		if expr, ok := mapped[e.Name]; ok {
+			check.Exprs[e.Name] = expr
+			check.Notes = append(check.Notes, fmt.Sprintf("%s is mapped to %s", e.Name, expr))
+			continue
+		}
+
+		c, ok := actual[e.Name]
+		for i := 0; !ok && i < len(e.Aliases); i++ {
+			if c, ok = actual[e.Aliases[i]]; ok {
+				check.Notes = append(check.Notes, fmt.Sprintf("%s is read from %s", e.Name, c.Name))
+				aliased[e.Aliases[i]] = true
+			}
+		}
+		switch {
+		case !ok && e.Fallback != "":
+			check.Exprs[e.Name] = e.Fallback
+			check.Notes = append(check.Notes, fmt.Sprintf("%s is missing, and will be %s", e.Name, e.Fallback))
+		case !ok:
+			check.Problems = append(check.Problems, fmt.Sprintf("%s is missing", e.Name))
+		case !kindCompatible(e.Kind, columnKind(c.DataType)):
+			problem := fmt.Sprintf("%s is %s, but should be a %s", e.Name, c.ColumnType, e.Kind)
+			if e.Kind == "time" && columnKind(c.DataType) == "integer" {
+				problem += fmt.Sprintf(" (if it's a unix timestamp, map it to FROM_UNIXTIME(%s))", e.Name)
+			}
+			check.Problems = append(check.Problems, problem)
+		default:
+			check.Exprs[e.Name] = "`" + c.Name + "`"
+		}
+	}
+
+	for name := range mapped {
+		if !known[name] {
+			check.Problems = append(check.Problems, fmt.Sprintf("--column-map maps %s, which isn't migrated", name))
+		}
+	}
+
+	var extra []string
+	for _, c := range t.Columns {
+		if name := strings.ToLower(c.Name); !known[name] && !aliased[name] {
+			extra = append(extra, c.Name)
+		}
+	}
+	if len(extra) != 0 {
+		sort.Strings(extra)
+		check.Notes = append(check.Notes, fmt.Sprintf("%s won't be migrated", strings.Join(extra, ", ")))
+	}
+	return check
+}
+
+// selectExpectedColumns builds a select list reading each expected column
+// with its expression, e.g. `time` AS play_time.
+func selectExpectedColumns(expected []ExpectedColumn, exprs map[string]string) string {
+	columns := make([]string, len(expected))
+	for i, e := range expected {
+		expr := exprs[e.Name]
+		if e.Kind == "time" {
+			expr = "UNIX_TIMESTAMP(" + expr + ")"
+		}
+		columns[i] = expr + " AS " + e.Name
+	}
+	return strings.Join(columns, ", ")
+}
+
+var errPreflightFailed = errors.New("the database's schema doesn't match what the migration expects")
+
+// printSchemaChecks reports the checks, returning whether any found problems.
+func printSchemaChecks(checks []SchemaCheck) bool {
+	failed := false
+	for _, check := range checks {
+		if len(check.Problems) == 0 && len(check.Notes) == 0 {
+			fmt.Printf("%s: ok\n", check.Table)
+			continue
+		}
+		for _, problem := range check.Problems {
+			fmt.Printf("%s: error: %s\n", check.Table, problem)
+			failed = true
+		}
+		for _, note := range check.Notes {
+			fmt.Printf("%s: %s\n", check.Table, note)
+		}
+	}
+	return failed
+}
+
+// preflightScores checks the old scores tables, and adapts how each is read
+// to any missing optional or mapped columns.
+func preflightScores(tables []SourceTable) error {
+	mapping, err := loadColumnMap(cfg.ColumnMapPath)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, len(tables))
+	for i, table := range tables {
+		names[i] = table.Name
+	}
+	schemas, err := loadTableSchemas(cfg.DBName, names)
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]*TableSchema, len(schemas))
+	for _, t := range schemas {
+		byName[t.Name] = t
+	}
+
+	checks := make([]SchemaCheck, 0, len(tables))
+	for _, table := range tables {
+		t := byName[table.Name]
+		if t == nil {
+			checks = append(checks, SchemaCheck{Table: table.Name, Problems: []string{"the table doesn't exist"}})
+			continue
+		}
+		checks = append(checks, checkTableSchema(t, expectedScoreColumns, mapping[table.Name]))
+	}
+	for name := range mapping {
+		if byName[name] == nil {
+			return fmt.Errorf("--column-map maps %s, which isn't migrated", name)
+		}
+	}
+
+	if printSchemaChecks(checks) {
+		return errPreflightFailed
+	}
+
+	for i, check := range checks {
+		tables[i].Columns = selectExpectedColumns(expectedScoreColumns, check.Exprs)
+	}
+	return nil
+}
+
+func runPreflight() error {
+	applied, err := appliedMigrations()
+	if err != nil {
+		return err
+	}
+
+	failed := false
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok || m.Preflight == nil {
+			continue
+		}
+		if m.Applied != nil {
+			if done, err := m.Applied(); err != nil || done {
+				continue
+			}
+		}
+
+		fmt.Printf("Checking v%s: %s\n", m.Version, m.Description)
+		if err := m.Preflight(); errors.Is(err, errPreflightFailed) {
+			failed = true
+		} else if err != nil {
+			return fmt.Errorf("v%s: %w", m.Version, err)
+		}
+	}
+	if failed {
+		return errPreflightFailed
+	}
+	return nil
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// the privileges commands save admins from editing users' priv integers by
+// hand:
+//
+//   - privileges show decodes a user's privileges (or any integer, in any
+//     known layout) into bancho.py's names for them.
+//   - privileges translate rewrites every user's privileges from one layout
+//     to another, e.g. for a database which a fork with its own bits ran on.
+//   - privileges grant & revoke add or remove bits, by name or group (e.g.
+//     supporter, or staff), from a list of users, or from every user who has
+//     some other bits (e.g. every administrator).
+//
+// layouts are translated through bancho.py's, by name. besides bancho.py's
+// own, ripple & akatsuki are known (see ripple.go), and forks which moved
+// bits around can describe theirs in a json file, with the bit each of
+// bancho.py's names is in their layout:
+//
+//	{"name": "myfork", "bits": {"unrestricted": 1, "verified": 2, "supporter": 8, "developer": 65536}}
+
+// a named privilege bit, or group of bits
+type privilegeName struct {
+	name string
+	bits int
+}
+
+// bancho.py's privileges, from app/constants/privileges.py
+var banchoPyPrivileges = []privilegeName{
+	{"unrestricted", privUnrestricted},
+	{"verified", privVerified},
+	{"whitelisted", privWhitelisted},
+	{"supporter", privSupporter},
+	{"premium", privPremium},
+	{"alumni", privAlumni},
+	{"tourney_manager", privTourneyManager},
+	{"nominator", privNominator},
+	{"moderator", privModerator},
+	{"administrator", privAdministrator},
+	{"developer", privDeveloper},
+}
+
+var banchoPyPrivilegeGroups = []privilegeName{
+	{"donator", privSupporter | privPremium},
+	{"staff", privModerator | privAdministrator | privDeveloper},
+}
+
+// privilegeLayout is how a server lays its privileges out, translated to &
+// from bancho.py's.
+type privilegeLayout struct {
+	name         string
+	toBanchoPy   func(int) int
+	fromBanchoPy func(int) int
+}
+
+var privilegeLayouts = map[string]privilegeLayout{
+	"banchopy": {
+		name:         "banchopy",
+		toBanchoPy:   func(priv int) int { return priv },
+		fromBanchoPy: func(priv int) int { return priv },
+	},
+	"ripple": {
+		name:         "ripple",
+		toBanchoPy:   ripplePrivileges,
+		fromBanchoPy: rippleExportPrivilege,
+	},
+	"akatsuki": {
+		name:       "akatsuki",
+		toBanchoPy: akatsukiPrivileges,
+		fromBanchoPy: func(priv int) int {
+			akatsuki := rippleExportPrivilege(priv)
+			if priv&privPremium != 0 {
+				akatsuki |= akatsukiUserPremium
+			}
+			return akatsuki
+		},
+	},
+}
+
+// PrivilegeLayoutFile is a fork's layout, see the top of this file.
+type PrivilegeLayoutFile struct {
+	Name string         `json:"name"`
+	Bits map[string]int `json:"bits"`
+}
+
+// loadPrivilegeLayout adds a fork's layout to the known ones.
+func loadPrivilegeLayout(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var file PrivilegeLayoutFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if file.Name == "" {
+		return fmt.Errorf("%s: the layout has no name", path)
+	}
+
+	// each of the fork's bits, and the bancho.py bit it is
+	type mapping struct{ bits, bpy int }
+	var mappings []mapping
+	for name, bits := range file.Bits {
+		bpy, ok := privilegeByName(name, banchoPyPrivileges)
+		if !ok {
+			return fmt.Errorf("%s: %q isn't one of bancho.py's privileges", path, name)
+		}
+		mappings = append(mappings, mapping{bits, bpy})
+	}
+
+	privilegeLayouts[file.Name] = privilegeLayout{
+		name: file.Name,
+		toBanchoPy: func(priv int) int {
+			bpy := 0
+			for _, m := range mappings {
+				if priv&m.bits == m.bits {
+					bpy |= m.bpy
+				}
+			}
+			return bpy
+		},
+		fromBanchoPy: func(bpy int) int {
+			priv := 0
+			for _, m := range mappings {
+				if bpy&m.bpy != 0 {
+					priv |= m.bits
+				}
+			}
+			return priv
+		},
+	}
+	return nil
+}
+
+func findPrivilegeLayout(name string) (privilegeLayout, error) {
+	if cfg.PrivLayoutFile != "" {
+		if err := loadPrivilegeLayout(cfg.PrivLayoutFile); err != nil {
+			return privilegeLayout{}, err
+		}
+	}
+	layout, ok := privilegeLayouts[name]
+	if !ok {
+		names := make([]string, 0, len(privilegeLayouts))
+		for name := range privilegeLayouts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return layout, fmt.Errorf("unknown privileges layout %q, expected one of %s, or a --layout-file", name, strings.Join(names, ", "))
+	}
+	return layout, nil
+}
+
+func privilegeByName(name string, names []privilegeName) (int, bool) {
+	name = strings.ReplaceAll(strings.ToLower(strings.TrimSpace(name)), "-", "_")
+	for _, p := range names {
+		if p.name == name {
+			return p.bits, true
+		}
+	}
+	return 0, false
+}
+
+// parsePrivileges reads bancho.py privileges by name, group or integer,
+// comma separated.
+func parsePrivileges(value string) (int, error) {
+	bits := 0
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(part); err == nil {
+			bits |= n
+		} else if p, ok := privilegeByName(part, banchoPyPrivileges); ok {
+			bits |= p
+		} else if p, ok := privilegeByName(part, banchoPyPrivilegeGroups); ok {
+			bits |= p
+		} else {
+			return 0, fmt.Errorf("unknown privilege %q", part)
+		}
+	}
+	if bits == 0 {
+		return 0, errors.New("no privileges were given")
+	}
+	return bits, nil
+}
+
+// decodePrivileges names the bits of bancho.py privileges, with any it
+// doesn't know left as an integer.
+func decodePrivileges(priv int) []string {
+	var names []string
+	for _, p := range banchoPyPrivileges {
+		if priv&p.bits != 0 {
+			names = append(names, p.name)
+			priv &^= p.bits
+		}
+	}
+	if priv != 0 {
+		names = append(names, fmt.Sprintf("unknown (%d)", priv))
+	}
+	return names
+}
+
+func runPrivilegesShow() error {
+	layout, err := findPrivilegeLayout(cfg.PrivLayout)
+	if err != nil {
+		return err
+	}
+
+	var priv int
+	switch {
+	case cfg.PrivValue != "":
+		if priv, err = strconv.Atoi(cfg.PrivValue); err != nil {
+			return fmt.Errorf("--value %q must be an integer", cfg.PrivValue)
+		}
+	case cfg.PrivUser != "":
+		id, err := findUser(cfg.PrivUser)
+		if err != nil {
+			return err
+		}
+		var user struct {
+			Name string
+			Priv int
+		}
+		if err := DB.Get(&user, "SELECT name, priv FROM users WHERE id = ?", id); err != nil {
+			return err
+		}
+		fmt.Printf("%s (%d)\n", user.Name, id)
+		priv = user.Priv
+	default:
+		return errors.New("--user or --value must be given")
+	}
+
+	bpy := layout.toBanchoPy(priv)
+	if layout.name != "banchopy" {
+		fmt.Printf("  %s: %d, which in bancho.py's layout is %d\n", layout.name, priv, bpy)
+	} else {
+		fmt.Printf("  privileges: %d\n", priv)
+	}
+	for _, name := range decodePrivileges(bpy) {
+		fmt.Printf("    %s\n", name)
+	}
+	for _, group := range banchoPyPrivilegeGroups {
+		if bpy&group.bits != 0 {
+			fmt.Printf("  in the %s group\n", group.name)
+		}
+	}
+	if bpy&privUnrestricted == 0 {
+		fmt.Println("  restricted")
+	}
+	return nil
+}
+
+// runPrivilegesTranslate rewrites every user's privileges in one statement,
+// with a case for each distinct value, as there are only ever a few.
+func runPrivilegesTranslate() error {
+	from, err := findPrivilegeLayout(cfg.PrivLayout)
+	if err != nil {
+		return err
+	}
+	to, err := findPrivilegeLayout(cfg.PrivTo)
+	if err != nil {
+		return err
+	}
+	if from.name == to.name {
+		return errors.New("--from & --to are the same layout")
+	}
+
+	var values []struct {
+		Priv  int
+		Users int64
+	}
+	if err := DB.Select(&values, "SELECT priv, COUNT(*) AS users FROM users WHERE id != 1 GROUP BY priv ORDER BY priv"); err != nil {
+		return err
+	}
+
+	var cases []string
+	var changed []int
+	var users int64
+	fmt.Printf("%12s %12s %8s  %s\n", from.name, to.name, "users", "bancho.py's names")
+	for _, v := range values {
+		bpy := from.toBanchoPy(v.Priv)
+		translated := to.fromBanchoPy(bpy)
+		fmt.Printf("%12d %12d %8d  %s\n", v.Priv, translated, v.Users, strings.Join(decodePrivileges(bpy), ", "))
+		if translated != v.Priv {
+			cases = append(cases, fmt.Sprintf("WHEN %d THEN %d", v.Priv, translated))
+			changed = append(changed, v.Priv)
+			users += v.Users
+		}
+	}
+	if cfg.DryRun || len(changed) == 0 {
+		logger.Info("nothing was changed", "users", users, "dry_run", cfg.DryRun)
+		return nil
+	}
+	if !confirm(fmt.Sprintf("Translate %d users' privileges from %s to %s?", users, from.name, to.name)) {
+		fmt.Println("Not translating the privileges")
+		return nil
+	}
+
+	query, args, err := sqlx.In(fmt.Sprintf("UPDATE users SET priv = CASE priv %s END WHERE id != 1 AND priv IN (?)",
+		strings.Join(cases, " ")), changed)
+	if err != nil {
+		return err
+	}
+	n, err := copyRows(query, args...)
+	if err != nil {
+		return err
+	}
+	logger.Info("translated the privileges", "from", from.name, "to", to.name, "users", n)
+	logger.Info("run cache rebuild, as who's restricted may have changed")
+	return nil
+}
+
+// privilegeTargets finds the users --users & --with select.
+func privilegeTargets() ([]int64, error) {
+	if cfg.PrivUsers == "" && cfg.PrivWith == "" {
+		return nil, errors.New("--users or --with must select the users")
+	}
+	var ids []int64
+	for _, user := range strings.Split(cfg.PrivUsers, ",") {
+		if user = strings.TrimSpace(user); user == "" {
+			continue
+		}
+		id, err := findUser(user)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if cfg.PrivWith != "" {
+		with, err := parsePrivileges(cfg.PrivWith)
+		if err != nil {
+			return nil, fmt.Errorf("--with: %w", err)
+		}
+		// the bot is left alone unless it's asked for by name
+		var withIDs []int64
+		if err := DB.Select(&withIDs, "SELECT id FROM users WHERE priv & ? = ? AND id != 1", with, with); err != nil {
+			return nil, err
+		}
+		ids = append(ids, withIDs...)
+	}
+
+	seen := make(map[int64]bool, len(ids))
+	unique := ids[:0]
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique, nil
+}
+
+// changePrivileges grants or revokes bits from the selected users, noting
+// the change in bancho.py's logs table for each of them.
+func changePrivileges(grant bool) error {
+	bits, err := parsePrivileges(cfg.PrivBits)
+	if err != nil {
+		return fmt.Errorf("--bits: %w", err)
+	}
+	ids, err := privilegeTargets()
+	if err != nil {
+		return err
+	}
+	by := int64(1)
+	if cfg.PrivBy != "" {
+		if by, err = findUser(cfg.PrivBy); err != nil {
+			return err
+		}
+	}
+
+	verb, update := "revoke", "priv & ~?"
+	if grant {
+		verb, update = "grant", "priv | ?"
+	}
+	names := strings.Join(decodePrivileges(bits), ", ")
+	fmt.Printf("This will %s %s (%d) for %d users.\n", verb, names, bits, len(ids))
+	if cfg.DryRun || len(ids) == 0 {
+		return nil
+	}
+	if !confirm("Continue?") {
+		fmt.Println("Not changing the privileges")
+		return nil
+	}
+
+	tx, err := DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for start := 0; start < len(ids); start += BatchSize {
+		chunk := ids[start:min(start+BatchSize, len(ids))]
+		query, args, err := sqlx.In(fmt.Sprintf("UPDATE users SET priv = %s WHERE id IN (?)", update), bits, chunk)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(query, args...); err != nil {
+			return err
+		}
+		query, args, err = sqlx.In("INSERT INTO logs (`from`, `to`, `action`, msg, time) SELECT ?, id, 'privs', ?, NOW() FROM users WHERE id IN (?)",
+			by, fmt.Sprintf("%sed %s", strings.TrimSuffix(verb, "e"), names), chunk)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(query, args...); err != nil {
+			return fmt.Errorf("failed to record the change: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	logger.Info("changed the privileges", "action", verb, "privileges", names, "users", len(ids))
+	if bits&privUnrestricted != 0 {
+		logger.Info("run cache rebuild, as who's restricted has changed")
+	}
+	return nil
+}
+
+func init() {
+	layoutFlag := func(flags *flag.FlagSet, c *Config) {
+		flags.StringVar(&c.PrivLayoutFile, "layout-file", "", "json file of a fork's privileges layout (see privileges.go)")
+	}
+	changeFlags := func(flags *flag.FlagSet, c *Config) {
+		flags.StringVar(&c.PrivBits, "bits", "", "privileges by name (e.g. supporter), group (donator, staff) or integer, comma separated")
+		flags.StringVar(&c.PrivUsers, "users", "", "names or ids of the users, comma separated")
+		flags.StringVar(&c.PrivWith, "with", "", "every user who has all of these privileges, e.g. administrator")
+		flags.StringVar(&c.PrivBy, "by", "", "name or id of the staff member making the change, for bancho.py's logs (default: the bot)")
+		flags.BoolVar(&c.DryRun, "dry-run", false, "show how many users would change, without changing them")
+	}
+
+	registerCommand(&Command{
+		Name:    "privileges show",
+		Summary: "decode a user's privileges, or any privileges integer, into their names",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.PrivUser, "user", "", "name or id of the user")
+			flags.StringVar(&c.PrivValue, "value", "", "a privileges integer to decode, instead of a user's")
+			flags.StringVar(&c.PrivLayout, "layout", "banchopy", "the layout the privileges are in: banchopy, ripple, akatsuki, or a --layout-file's")
+			layoutFlag(flags, c)
+		},
+		Run: runPrivilegesShow,
+	})
+	registerCommand(&Command{
+		Name:    "privileges translate",
+		Summary: "rewrite every user's privileges from one layout to another",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.PrivLayout, "from", "", "the layout the privileges are in: banchopy, ripple, akatsuki, or a --layout-file's")
+			flags.StringVar(&c.PrivTo, "to", "banchopy", "the layout to translate them to")
+			flags.BoolVar(&c.DryRun, "dry-run", false, "show how each value would be translated, without changing anything")
+			layoutFlag(flags, c)
+		},
+		Run: runPrivilegesTranslate,
+	})
+	registerCommand(&Command{
+		Name:    "privileges grant",
+		Summary: "grant privileges to users, by name or group",
+		Flags:   changeFlags,
+		Run:     func() error { return changePrivileges(true) },
+	})
+	registerCommand(&Command{
+		Name:    "privileges revoke",
+		Summary: "revoke privileges from users, by name or group",
+		Flags:   changeFlags,
+		Run:     func() error { return changePrivileges(false) },
+	})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParsePrivileges(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  int
+		ok    bool
+	}{
+		{"supporter", privSupporter, true},
+		{"unrestricted, verified", privUnrestricted | privVerified, true},
+		{"Tourney-Manager", privTourneyManager, true},
+		{"staff", privModerator | privAdministrator | privDeveloper, true},
+		{"donator,alumni", privSupporter | privPremium | privAlumni, true},
+		{"3", privUnrestricted | privVerified, true},
+		{"8192, nominator", privAdministrator | privNominator, true},
+		{"supporter,,", privSupporter, true},
+		{"owner", 0, false},
+		{"", 0, false},
+		{"0", 0, false},
+	} {
+		got, err := parsePrivileges(tt.value)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parsePrivileges(%q) = %d, %v, want %d (ok %v)", tt.value, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestDecodePrivileges(t *testing.T) {
+	for _, tt := range []struct {
+		priv int
+		want []string
+	}{
+		{0, nil},
+		{privUnrestricted | privVerified, []string{"unrestricted", "verified"}},
+		{privUnrestricted | privVerified | privDeveloper, []string{"unrestricted", "verified", "developer"}},
+		{privSupporter | 1<<3 | 1<<20, []string{"supporter", "unknown (1048584)"}},
+	} {
+		if got := decodePrivileges(tt.priv); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("decodePrivileges(%d) = %q, want %q", tt.priv, got, tt.want)
+		}
+	}
+}
+
+func TestPrivilegeLayoutFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "layout.json")
+	layout := `{"name": "testfork", "bits": {"unrestricted": 1, "verified": 2, "supporter": 8, "developer": 65536}}`
+	if err := os.WriteFile(path, []byte(layout), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadPrivilegeLayout(path); err != nil {
+		t.Fatal(err)
+	}
+	fork := privilegeLayouts["testfork"]
+	defer delete(privilegeLayouts, "testfork")
+
+	if got, want := fork.toBanchoPy(1|2|8|65536|4), privUnrestricted|privVerified|privSupporter|privDeveloper; got != want {
+		t.Errorf("toBanchoPy() = %d, want %d", got, want)
+	}
+	// bits the fork has no place for are dropped
+	if got, want := fork.fromBanchoPy(privUnrestricted|privDeveloper|privModerator), 1|65536; got != want {
+		t.Errorf("fromBanchoPy() = %d, want %d", got, want)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"name": "testfork", "bits": {"owner": 1}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadPrivilegeLayout(path); err == nil {
+		t.Error("loadPrivilegeLayout() accepted a name which isn't bancho.py's")
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tableCounters tracks the progress of a single source table.
+// NOTE: the counters are updated atomically, and must stay 64-bit aligned.
+type tableCounters struct {
+	Total    int64 // rows expected to be read, known before migrating
+	Read     int64
+	Inserted int64
+	Failed   int64
+	Skipped  int64 // already migrated by an interrupted run
+	Filtered int64 // left out by the filters, see filter.go
+}
+
+// Progress tracks how far along the migration is, for periodic reporting.
+type Progress struct {
+	ReplaysMoved   int64
+	ReplaysMissing int64
+
+	start   time.Time
+	tables  map[string]*tableCounters
+	order   []string
+	workers []int64 // rows inserted by each worker
+	busy    []int32 // whether each worker is inserting a chunk
+
+	mu           sync.Mutex
+	lastReport   time.Time
+	lastInserted int64
+	lastWorkers  []int64
+}
+
+var progress *Progress
+
+func newProgress(tables []SourceTable, workers int) *Progress {
+	p := &Progress{
+		start:       time.Now(),
+		tables:      make(map[string]*tableCounters, len(tables)),
+		workers:     make([]int64, workers),
+		busy:        make([]int32, workers),
+		lastWorkers: make([]int64, workers),
+	}
+	p.lastReport = p.start
+
+	for _, table := range tables {
+		p.tables[table.Name] = &tableCounters{}
+		p.order = append(p.order, table.Name)
+	}
+	return p
+}
+
+// countRemaining fills in how many rows each table has left to migrate.
+func (p *Progress) countRemaining(tables []SourceTable, resume bool) error {
+	for _, table := range tables {
+		var fromID int64
+		if resume {
+			var err error
+			if fromID, err = loadCheckpoint(table); err != nil {
+				return err
+			}
+		}
+
+		var total int64
+		err := DB.Get(&total, fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE id > ?", table.Name), fromID)
+		if err != nil {
+			return err
+		}
+		atomic.StoreInt64(&p.tables[table.Name].Total, total)
+	}
+	return nil
+}
+
+func (p *Progress) addRead(table SourceTable, n int) {
+	atomic.AddInt64(&p.tables[table.Name].Read, int64(n))
+}
+
+func (p *Progress) addInserted(table SourceTable, worker int, n int) {
+	atomic.AddInt64(&p.tables[table.Name].Inserted, int64(n))
+	atomic.AddInt64(&p.workers[worker], int64(n))
+}
+
+func (p *Progress) addFailed(table SourceTable, n int) {
+	atomic.AddInt64(&p.tables[table.Name].Failed, int64(n))
+}
+
+func (p *Progress) addSkipped(table SourceTable, n int) {
+	atomic.AddInt64(&p.tables[table.Name].Skipped, int64(n))
+}
+
+func (p *Progress) addFiltered(table SourceTable, n int) {
+	atomic.AddInt64(&p.tables[table.Name].Filtered, int64(n))
+}
+
+func (p *Progress) setBusy(worker int, busy bool) {
+	var v int32
+	if busy {
+		v = 1
+	}
+	atomic.StoreInt32(&p.busy[worker], v)
+}
+
+// totals sums the counters of every table.
+func (p *Progress) totals() (total, read, inserted, failed, skipped int64) {
+	for _, name := range p.order {
+		t := p.tables[name]
+		total += atomic.LoadInt64(&t.Total)
+		read += atomic.LoadInt64(&t.Read)
+		inserted += atomic.LoadInt64(&t.Inserted)
+		failed += atomic.LoadInt64(&t.Failed)
+		skipped += atomic.LoadInt64(&t.Skipped) + atomic.LoadInt64(&t.Filtered)
+	}
+	return
+}
+
+// formatETA estimates the time remaining from the average rate so far.
+func formatETA(done, total int64, elapsed time.Duration) string {
+	if done == 0 || total <= done {
+		return "-"
+	}
+	rate := float64(done) / elapsed.Seconds()
+	remaining := time.Duration(float64(total-done)/rate) * time.Second
+	return remaining.Round(time.Second).String()
+}
+
+// report prints the current progress, either as human-readable lines
+// or through the structured logger, for piping into monitoring.
+func (p *Progress) report(structured bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	interval := now.Sub(p.lastReport).Seconds()
+	elapsed := now.Sub(p.start)
+
+	total, read, inserted, failed, skipped := p.totals()
+	done := inserted + failed + skipped
+	rate := float64(inserted-p.lastInserted) / interval
+	eta := formatETA(inserted+failed, total-skipped, elapsed)
+	percent := 0.0
+	if total != 0 {
+		percent = float64(done) / float64(total) * 100
+	}
+
+	workerRates := make([]string, len(p.workers))
+	for i := range p.workers {
+		n := atomic.LoadInt64(&p.workers[i])
+		workerRates[i] = fmt.Sprintf("%.0f", float64(n-p.lastWorkers[i])/interval)
+		p.lastWorkers[i] = n
+	}
+
+	replaysMoved := atomic.LoadInt64(&p.ReplaysMoved)
+	replaysMissing := atomic.LoadInt64(&p.ReplaysMissing)
+
+	if structured {
+		logger.Info("progress", "elapsed", elapsed.Round(time.Second).String(),
+			"percent", fmt.Sprintf("%.2f", percent), "total", total, "read", read,
+			"inserted", inserted, "failed", failed, "rate", fmt.Sprintf("%.0f", rate), "eta", eta,
+			"replays_moved", replaysMoved, "replays_missing", replaysMissing,
+			"worker_rates", strings.Join(workerRates, ","))
+
+		for _, name := range p.order {
+			t := p.tables[name]
+			logger.Info("table progress", "table", name, "total", atomic.LoadInt64(&t.Total),
+				"read", atomic.LoadInt64(&t.Read), "inserted", atomic.LoadInt64(&t.Inserted),
+				"failed", atomic.LoadInt64(&t.Failed))
+		}
+	} else {
+		fmt.Printf("[%s] %.1f%% (%d/%d rows), %.0f rows/s, eta %s, %d replays moved\n",
+			elapsed.Round(time.Second), percent, done, total, rate, eta, replaysMoved)
+
+		for _, name := range p.order {
+			t := p.tables[name]
+			fmt.Printf("    %-10s %d/%d inserted, %d failed\n", name,
+				atomic.LoadInt64(&t.Inserted), atomic.LoadInt64(&t.Total), atomic.LoadInt64(&t.Failed))
+		}
+		fmt.Printf("    rows/s per worker: %s\n", strings.Join(workerRates, " "))
+	}
+
+	p.lastReport = now
+	p.lastInserted = inserted
+}
+
+// run reports progress on an interval until stop is closed, or shows the
+// dashboard (see tui.go). an interval of zero disables reporting.
+func (p *Progress) run(interval time.Duration, format string, stop <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+	if format == "auto" || format == "" {
+		format = "text"
+		if isTerminal(os.Stderr) {
+			format = "tui"
+		}
+	}
+	if format == "tui" {
+		p.showDashboard(stop)
+		return
+	}
+	structured := format == "log"
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.report(structured)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// summary prints the final counts once the migration is over.
+func (p *Progress) summary() {
+	_, _, inserted, failed, _ := p.totals()
+	elapsed := time.Since(p.start)
+	fmt.Printf("Migrated %d scores (%d failed) in %s, averaging %.0f rows/s\n",
+		inserted, failed, elapsed.Round(time.Second), float64(inserted)/elapsed.Seconds())
+	var filtered int64
+	for _, name := range p.order {
+		filtered += atomic.LoadInt64(&p.tables[name].Filtered)
+	}
+	if filtered != 0 {
+		fmt.Printf("Left out %d scores by the filters, which are only in the old tables\n", filtered)
+	}
+	fmt.Printf("Moved %d replays, %d could not be found\n",
+		atomic.LoadInt64(&p.ReplaysMoved), atomic.LoadInt64(&p.ReplaysMissing))
+}
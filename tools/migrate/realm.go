@@ -0,0 +1,638 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"time"
+)
+
+// osu!lazer keeps its data in client.realm, realm's own database file.
+// there's no realm library for go, so this reads what import lazer needs of
+// it: realm core's file formats 20-24 (realm-dotnet 10 onwards, which lazer
+// has used since 2022), read-only, and only the column types lazer's
+// schema uses (ints, bools, strings, timestamps, links & lists).
+//
+// a realm file is a tree of arrays ("nodes"), each with an 8 byte header:
+//
+//	bytes 0-3  a checksum, unused
+//	byte 4     flags: 0x80 an inner b+tree node, 0x40 its elements are refs
+//	           (or tagged ints, whose lowest bit is set), 0x20 a context
+//	           flag, 0x18 how the width is counted, 0x07 the width
+//	bytes 5-7  the number of elements, big endian
+//
+// refs are offsets into the file. the file's header holds the ref of the
+// group, which lists the table names & tables. each table has a spec (its
+// columns' names & keys) and a cluster tree, a b+tree whose leaves hold an
+// array per column, for a range of object keys.
+
+var errRealmFormat = errors.New("not a realm file, or not one this can read")
+
+// the realm file formats this reads, see above
+const (
+	minRealmFileFormat = 20
+	maxRealmFileFormat = 24
+)
+
+// what a node's width counts
+const (
+	realmWidthBits     = 0 // bits per element
+	realmWidthMultiply = 1 // bytes per element
+	realmWidthIgnore   = 2 // elements are bytes
+)
+
+// column types & attributes, which are part of their keys
+const (
+	realmTypeInt       = 0
+	realmTypeBool      = 1
+	realmTypeString    = 2
+	realmTypeTimestamp = 8
+	realmTypeLink      = 12
+	realmTypeLinkList  = 13
+
+	realmAttrNullable = 16
+	realmAttrList     = 32
+)
+
+// positions in the group's, tables', specs' & inner cluster nodes' arrays
+const (
+	realmGroupNames       = 0
+	realmGroupTables      = 1
+	realmTableSpec        = 0
+	realmTableClusters    = 2
+	realmSpecNames        = 1
+	realmSpecKeys         = 5
+	realmInnerKeys        = 0
+	realmInnerDepth       = 1
+	realmInnerFirstChild  = 3
+	realmClusterNodeShift = 8 // an inner node's children hold 1<<8 keys each, per level
+)
+
+// realmMaxDepth is how deep a tree of nodes may be. realm's are a few levels
+// at most, so a deeper one is a ref cycle.
+const realmMaxDepth = 16
+
+// realmFooterCookie ends files written in streaming form, whose top ref is
+// in a footer instead of the header
+const realmFooterCookie = 0x3034125237E526C8
+
+// realmNode is an array in a realm file.
+type realmNode struct {
+	inner, hasRefs, context bool
+	wtype, width, size      int
+	payload                 []byte
+	realm                   *Realm
+}
+
+// int returns element i of an array of integers. one which is past the end
+// of the payload (in a corrupt file, or a blob) is 0, and keeps
+// errRealmFormat in the realm's err.
+func (n realmNode) int(i int) int64 {
+	if i < 0 || i >= n.size {
+		return 0
+	}
+	if (i+1)*n.width > 8*len(n.payload) {
+		if n.realm.err == nil {
+			n.realm.err = fmt.Errorf("%w: an array's elements run past its end", errRealmFormat)
+		}
+		return 0
+	}
+	switch n.width {
+	case 0:
+		return 0
+	case 1, 2, 4:
+		bit := i * n.width
+		return int64(n.payload[bit/8]>>(bit%8)) & (1<<n.width - 1)
+	case 8:
+		return int64(int8(n.payload[i]))
+	case 16:
+		return int64(int16(binary.LittleEndian.Uint16(n.payload[2*i:])))
+	case 32:
+		return int64(int32(binary.LittleEndian.Uint32(n.payload[4*i:])))
+	default:
+		return int64(binary.LittleEndian.Uint64(n.payload[8*i:]))
+	}
+}
+
+// ref returns element i of an array of refs, or 0 if it's a tagged int.
+func (n realmNode) ref(i int) uint64 {
+	v := n.int(i)
+	if v&1 != 0 {
+		return 0
+	}
+	return uint64(v)
+}
+
+// Realm is a realm file, read into memory.
+type Realm struct {
+	data   []byte
+	tables map[string]uint64 // each table's top array, by name
+	err    error             // the first error reading a node or an object, see RealmObject
+}
+
+// node reads the node at ref.
+func (r *Realm) node(ref uint64) (realmNode, error) {
+	if ref == 0 || ref&7 != 0 || ref > uint64(len(r.data))-8 {
+		return realmNode{}, fmt.Errorf("%w: a ref (%d) is out of the file", errRealmFormat, ref)
+	}
+	h := r.data[ref : ref+8]
+	n := realmNode{
+		inner:   h[4]&0x80 != 0,
+		hasRefs: h[4]&0x40 != 0,
+		context: h[4]&0x20 != 0,
+		wtype:   int(h[4]&0x18) >> 3,
+		width:   (1 << (h[4] & 7)) >> 1,
+		size:    int(h[5])<<16 | int(h[6])<<8 | int(h[7]),
+		realm:   r,
+	}
+	var length int
+	switch n.wtype {
+	case realmWidthBits:
+		length = (n.size*n.width + 7) / 8
+	case realmWidthMultiply:
+		length = n.size * n.width
+	case realmWidthIgnore:
+		length = n.size
+	default:
+		return n, fmt.Errorf("%w: it has compressed arrays, from a newer realm", errRealmFormat)
+	}
+	if uint64(length) > uint64(len(r.data))-(ref+8) {
+		return n, fmt.Errorf("%w: an array at %d runs past the end of the file", errRealmFormat, ref)
+	}
+	n.payload = r.data[ref+8 : ref+8+uint64(length)]
+	return n, nil
+}
+
+// blob reads a blob's bytes, which are split into several when big.
+func (r *Realm) blob(ref uint64, depth int) ([]byte, error) {
+	if depth > realmMaxDepth {
+		return nil, fmt.Errorf("%w: a blob at %d is nested too deep", errRealmFormat, ref)
+	}
+	n, err := r.node(ref)
+	if err != nil || !n.hasRefs {
+		return n.payload, err
+	}
+	var data []byte
+	for i := 0; i < n.size; i++ {
+		part, err := r.blob(n.ref(i), depth+1)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, part...)
+	}
+	return data, nil
+}
+
+// strings reads a leaf of strings, which is in one of three forms, by the
+// strings' lengths. nulls are read as "".
+func (r *Realm) strings(ref uint64) ([]string, error) {
+	n, err := r.node(ref)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case !n.hasRefs && n.wtype == realmWidthMultiply:
+		// short: each padded to the width, its last byte the padding's length
+		strs := make([]string, n.size)
+		for i := range strs {
+			if n.width == 0 {
+				continue
+			}
+			slot := n.payload[i*n.width : (i+1)*n.width]
+			if length := n.width - 1 - int(slot[n.width-1]); length > 0 {
+				strs[i] = string(slot[:length])
+			}
+		}
+		return strs, nil
+
+	case !n.hasRefs:
+		return nil, fmt.Errorf("%w: it has enumerated strings", errRealmFormat)
+
+	case !n.context:
+		// medium: the end of each (zero terminated) in one blob
+		offsets, err := r.node(n.ref(0))
+		if err != nil {
+			return nil, err
+		}
+		blob, err := r.blob(n.ref(1), 0)
+		if err != nil {
+			return nil, err
+		}
+		strs := make([]string, offsets.size)
+		begin := 0
+		for i := range strs {
+			end := int(offsets.int(i))
+			if end < begin || end > len(blob) {
+				return nil, fmt.Errorf("%w: a string at %d is out of its blob", errRealmFormat, ref)
+			}
+			if end > begin {
+				strs[i] = string(blob[begin : end-1])
+			}
+			begin = end
+		}
+		return strs, nil
+
+	default:
+		// long: a (zero terminated) blob each, 0 for null
+		strs := make([]string, n.size)
+		for i := range strs {
+			if n.ref(i) == 0 {
+				continue
+			}
+			blob, err := r.blob(n.ref(i), 0)
+			if err != nil {
+				return nil, err
+			}
+			if len(blob) > 0 {
+				strs[i] = string(blob[:len(blob)-1])
+			}
+		}
+		return strs, nil
+	}
+}
+
+// openRealm reads a realm file, and finds its tables.
+func openRealm(path string) (*Realm, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 24 || string(data[16:20]) != "T-DB" {
+		return nil, errRealmFormat
+	}
+	r := &Realm{data: data, tables: make(map[string]uint64)}
+
+	// the header has two top refs, its flags pick the current one
+	slot := int(data[23] & 1)
+	if format := int(data[20+slot]); format < minRealmFileFormat || format > maxRealmFileFormat {
+		return nil, fmt.Errorf("%w: its file format is %d, this reads %d-%d", errRealmFormat, format, minRealmFileFormat, maxRealmFileFormat)
+	}
+	top := binary.LittleEndian.Uint64(data[8*slot:])
+	if top == math.MaxUint64 && len(data) >= 40 {
+		footer := data[len(data)-16:]
+		if binary.LittleEndian.Uint64(footer[8:]) != realmFooterCookie {
+			return nil, fmt.Errorf("%w: its footer is missing", errRealmFormat)
+		}
+		top = binary.LittleEndian.Uint64(footer)
+	}
+
+	group, err := r.node(top)
+	if err != nil {
+		return nil, err
+	}
+	names, err := r.strings(group.ref(realmGroupNames))
+	if err != nil {
+		return nil, err
+	}
+	tables, err := r.node(group.ref(realmGroupTables))
+	if err != nil {
+		return nil, err
+	}
+	for i, name := range names {
+		// removed tables leave a tagged int behind
+		if ref := tables.ref(i); ref != 0 {
+			r.tables[name] = ref
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return r, nil
+}
+
+// realmLeaf is a leaf of a table's cluster tree: its objects' keys, and an
+// array of each column's values.
+type realmLeaf struct {
+	keys    []int64
+	columns realmNode
+	strings map[int][]string // columns' strings, once read
+}
+
+// leaves visits the leaves of the cluster tree at ref, whose keys start at offset.
+func (r *Realm) leaves(ref uint64, offset int64, depth int, visit func(*realmLeaf) error) error {
+	if depth > realmMaxDepth {
+		return fmt.Errorf("%w: a cluster tree at %d is too deep", errRealmFormat, ref)
+	}
+	n, err := r.node(ref)
+	if err != nil {
+		return err
+	}
+	if n.inner {
+		if n.size < realmInnerFirstChild {
+			return fmt.Errorf("%w: a cluster node at %d is too short", errRealmFormat, ref)
+		}
+		// each child's keys start at an offset, either listed, or spaced evenly
+		shift := (n.int(realmInnerDepth) >> 1) * realmClusterNodeShift
+		var offsets *realmNode
+		if keys := n.ref(realmInnerKeys); keys != 0 {
+			node, err := r.node(keys)
+			if err != nil {
+				return err
+			}
+			offsets = &node
+		}
+		for i := realmInnerFirstChild; i < n.size; i++ {
+			child := int64(i - realmInnerFirstChild)
+			childOffset := child << shift
+			if offsets != nil {
+				childOffset = offsets.int(int(child))
+			}
+			if err := r.leaves(n.ref(i), offset+childOffset, depth+1, visit); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if n.size == 0 {
+		return nil
+	}
+	leaf := &realmLeaf{columns: n, strings: make(map[int][]string)}
+	if v := n.int(0); v&1 != 0 {
+		// the keys are consecutive, only their count is kept
+		for k := int64(0); k < v>>1; k++ {
+			leaf.keys = append(leaf.keys, offset+k)
+		}
+	} else {
+		keys, err := r.node(uint64(v))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < keys.size; i++ {
+			leaf.keys = append(leaf.keys, offset+keys.int(i))
+		}
+	}
+	return visit(leaf)
+}
+
+// RealmTable is one of a realm file's tables, e.g. class_Score for lazer's scores.
+type RealmTable struct {
+	realm   *Realm
+	Name    string
+	columns map[string]int64 // each column's key, by name
+	Objects []RealmObject
+	byKey   map[int64]int
+}
+
+// Table reads every object of a table.
+func (r *Realm) Table(name string) (*RealmTable, error) {
+	ref, ok := r.tables[name]
+	if !ok {
+		return nil, fmt.Errorf("the realm file has no %s table", name)
+	}
+	top, err := r.node(ref)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := r.node(top.ref(realmTableSpec))
+	if err != nil {
+		return nil, err
+	}
+	names, err := r.strings(spec.ref(realmSpecNames))
+	if err != nil {
+		return nil, err
+	}
+	keys, err := r.node(spec.ref(realmSpecKeys))
+	if err != nil {
+		return nil, err
+	}
+
+	t := &RealmTable{realm: r, Name: name, columns: make(map[string]int64), byKey: make(map[int64]int)}
+	for i, column := range names {
+		t.columns[column] = keys.int(i)
+	}
+	if clusters := top.ref(realmTableClusters); clusters != 0 {
+		err = r.leaves(clusters, 0, 0, func(leaf *realmLeaf) error {
+			for row, key := range leaf.keys {
+				t.byKey[key] = len(t.Objects)
+				t.Objects = append(t.Objects, RealmObject{table: t, key: key, leaf: leaf, row: row})
+			}
+			return nil
+		})
+	}
+	if err == nil {
+		err = r.err
+	}
+	return t, err
+}
+
+// Has reports whether the table has a column, e.g. one added in a newer version.
+func (t *RealmTable) Has(column string) bool {
+	_, ok := t.columns[column]
+	return ok
+}
+
+// Get returns the object with a key.
+func (t *RealmTable) Get(key int64) (RealmObject, bool) {
+	i, ok := t.byKey[key]
+	if !ok {
+		return RealmObject{}, false
+	}
+	return t.Objects[i], true
+}
+
+// RealmObject is an object of a table. reading a column which isn't there,
+// or is corrupt, returns its zero value, and keeps the error in the realm's
+// err, as osrReader does.
+type RealmObject struct {
+	table *RealmTable
+	key   int64
+	leaf  *realmLeaf
+	row   int
+}
+
+func (o RealmObject) fail(err error) {
+	if o.table.realm.err == nil {
+		o.table.realm.err = fmt.Errorf("%s: %w", o.table.Name, err)
+	}
+}
+
+// column returns a column's values in the object's leaf, checking its type.
+func (o RealmObject) column(name string, types ...int) (values realmNode, typ, attrs int, ok bool) {
+	key, found := o.table.columns[name]
+	if !found {
+		o.fail(fmt.Errorf("there's no %s column", name))
+		return values, 0, 0, false
+	}
+	typ, attrs = int(key>>16)&0x3f, int(key>>22)&0xff
+	if !slices.Contains(types, typ) {
+		o.fail(fmt.Errorf("%s is of type %d, not %v", name, typ, types))
+		return values, typ, attrs, false
+	}
+	values, err := o.table.realm.node(o.leaf.columns.ref(columnIndex(key)))
+	if err != nil {
+		o.fail(fmt.Errorf("%s: %w", name, err))
+		return values, typ, attrs, false
+	}
+	return values, typ, attrs, true
+}
+
+// columnIndex returns where a column's values are in a leaf, after its keys.
+func columnIndex(key int64) int {
+	return int(key&0xffff) + 1
+}
+
+// nullableInt reads element i of an array of nullable ints, whose first
+// element is the value standing for null.
+func nullableInt(n realmNode, i int) (int64, bool) {
+	v := n.int(i + 1)
+	return v, v != n.int(0)
+}
+
+// Int reads an int column, 0 for null.
+func (o RealmObject) Int(name string) int64 {
+	values, _, attrs, ok := o.column(name, realmTypeInt, realmTypeBool)
+	if !ok || attrs&realmAttrList != 0 {
+		return 0
+	}
+	if attrs&realmAttrNullable != 0 {
+		if v, ok := nullableInt(values, o.row); ok {
+			return v
+		}
+		return 0
+	}
+	return values.int(o.row)
+}
+
+// Bool reads a bool column, which is kept as an int.
+func (o RealmObject) Bool(name string) bool {
+	return o.Int(name) != 0
+}
+
+// String reads a string column, "" for null.
+func (o RealmObject) String(name string) string {
+	index := columnIndex(o.table.columns[name])
+	strs, ok := o.leaf.strings[index]
+	if !ok {
+		_, _, attrs, ok := o.column(name, realmTypeString)
+		if !ok || attrs&realmAttrList != 0 {
+			return ""
+		}
+		var err error
+		if strs, err = o.table.realm.strings(o.leaf.columns.ref(index)); err != nil {
+			o.fail(fmt.Errorf("%s: %w", name, err))
+			return ""
+		}
+		o.leaf.strings[index] = strs
+	}
+	if o.row >= len(strs) {
+		return ""
+	}
+	return strs[o.row]
+}
+
+// Time reads a timestamp column, kept as seconds & nanoseconds.
+func (o RealmObject) Time(name string) time.Time {
+	values, _, _, ok := o.column(name, realmTypeTimestamp)
+	if !ok {
+		return time.Time{}
+	}
+	seconds, err := o.table.realm.node(values.ref(0))
+	if err != nil {
+		o.fail(fmt.Errorf("%s: %w", name, err))
+		return time.Time{}
+	}
+	nanoseconds, err := o.table.realm.node(values.ref(1))
+	if err != nil {
+		o.fail(fmt.Errorf("%s: %w", name, err))
+		return time.Time{}
+	}
+	s, ok := nullableInt(seconds, o.row)
+	if !ok {
+		return time.Time{}
+	}
+	return time.Unix(s, nanoseconds.int(o.row)).UTC()
+}
+
+// Link reads a link column, to an object of target, which is false when
+// it's null (or the object's gone).
+func (o RealmObject) Link(name string, target *RealmTable) (RealmObject, bool) {
+	values, _, attrs, ok := o.column(name, realmTypeLink)
+	if !ok || attrs&realmAttrList != 0 {
+		return RealmObject{}, false
+	}
+	// links are kept as the key + 1, so that 0 is null
+	key := values.int(o.row)
+	if key == 0 {
+		return RealmObject{}, false
+	}
+	return target.Get(key - 1)
+}
+
+// listLeaves visits the leaves of a list's b+tree, in order.
+func (r *Realm) listLeaves(ref uint64, depth int, visit func(uint64) error) error {
+	if depth > realmMaxDepth {
+		return fmt.Errorf("%w: a list at %d is too deep", errRealmFormat, ref)
+	}
+	n, err := r.node(ref)
+	if err != nil {
+		return err
+	}
+	if !n.inner {
+		return visit(ref)
+	}
+	// the first element is the children's offsets, the last the list's size
+	for i := 1; i < n.size-1; i++ {
+		if err := r.listLeaves(n.ref(i), depth+1, visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// list returns the root of a list column's b+tree, or 0 if it's empty.
+func (o RealmObject) list(name string, types ...int) uint64 {
+	values, typ, attrs, ok := o.column(name, types...)
+	if !ok {
+		return 0
+	}
+	if attrs&realmAttrList == 0 && typ != realmTypeLinkList {
+		o.fail(fmt.Errorf("%s isn't a list", name))
+		return 0
+	}
+	return values.ref(o.row)
+}
+
+// Strings reads a list of strings column.
+func (o RealmObject) Strings(name string) []string {
+	root := o.list(name, realmTypeString)
+	if root == 0 {
+		return nil
+	}
+	var strs []string
+	err := o.table.realm.listLeaves(root, 0, func(ref uint64) error {
+		leaf, err := o.table.realm.strings(ref)
+		strs = append(strs, leaf...)
+		return err
+	})
+	if err != nil {
+		o.fail(fmt.Errorf("%s: %w", name, err))
+	}
+	return strs
+}
+
+// Links reads a list of links column, to objects of target.
+func (o RealmObject) Links(name string, target *RealmTable) []RealmObject {
+	root := o.list(name, realmTypeLink, realmTypeLinkList)
+	if root == 0 {
+		return nil
+	}
+	var objects []RealmObject
+	err := o.table.realm.listLeaves(root, 0, func(ref uint64) error {
+		leaf, err := o.table.realm.node(ref)
+		for i := 0; i < leaf.size; i++ {
+			// kept as the key + 1, as single links are
+			if object, ok := target.Get(leaf.int(i) - 1); ok {
+				objects = append(objects, object)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		o.fail(fmt.Errorf("%s: %w", name, err))
+	}
+	return objects
+}
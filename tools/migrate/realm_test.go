@@ -0,0 +1,441 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// there's no realm for go to write test files with, so realmBuilder writes
+// them as realm core does, in the layout described in realm.go.
+type realmBuilder struct {
+	data []byte
+}
+
+// node flags, see realm.go
+const (
+	testRealmInner   = 0x80
+	testRealmHasRefs = 0x40
+	testRealmContext = 0x20
+)
+
+func newRealmBuilder() *realmBuilder {
+	return &realmBuilder{data: make([]byte, 24)}
+}
+
+func tagged(v int64) int64 {
+	return v<<1 | 1
+}
+
+func realmColumnKey(index, typ, attrs int) int64 {
+	return int64(index | typ<<16 | attrs<<22)
+}
+
+// node appends a node, returning its ref.
+func (b *realmBuilder) node(flags byte, wtype, width, size int, payload []byte) int64 {
+	ref := int64(len(b.data))
+	code := byte(0)
+	for w := width; w > 0; w >>= 1 {
+		code++
+	}
+	b.data = append(b.data, 'A', 'A', 'A', 'A', flags|byte(wtype)<<3|code, byte(size>>16), byte(size>>8), byte(size))
+	b.data = append(b.data, payload...)
+	for len(b.data)%8 != 0 {
+		b.data = append(b.data, 0)
+	}
+	return ref
+}
+
+// ints appends an array of integers (or refs), in the narrowest width which
+// holds them all.
+func (b *realmBuilder) ints(flags byte, values ...int64) int64 {
+	fits := func(v int64, width int) bool {
+		switch width {
+		case 0:
+			return v == 0
+		case 1, 2, 4:
+			return v >= 0 && v < 1<<width
+		case 64:
+			return true
+		default:
+			return v >= -1<<(width-1) && v < 1<<(width-1)
+		}
+	}
+	width := 0
+	for _, v := range values {
+		for !fits(v, width) {
+			width = max(1, width*2)
+		}
+	}
+
+	var payload []byte
+	switch width {
+	case 0:
+	case 1, 2, 4:
+		payload = make([]byte, (len(values)*width+7)/8)
+		for i, v := range values {
+			bit := i * width
+			payload[bit/8] |= byte(v << (bit % 8))
+		}
+	default:
+		for _, v := range values {
+			payload = binary.LittleEndian.AppendUint64(payload, uint64(v))[:len(payload)+width/8]
+		}
+	}
+	return b.node(flags, realmWidthBits, width, len(values), payload)
+}
+
+func (b *realmBuilder) blob(data []byte) int64 {
+	return b.node(0, realmWidthIgnore, 1, len(data), data)
+}
+
+// shortStrings appends strings padded to the width, the form of short ones.
+func (b *realmBuilder) shortStrings(strs ...string) int64 {
+	width := 0
+	for _, s := range strs {
+		for width <= len(s) {
+			width = max(1, width*2)
+		}
+	}
+	var payload []byte
+	for _, s := range strs {
+		slot := make([]byte, width)
+		copy(slot, s)
+		slot[width-1] = byte(width - 1 - len(s))
+		payload = append(payload, slot...)
+	}
+	return b.node(0, realmWidthMultiply, width, len(strs), payload)
+}
+
+// mediumStrings appends zero terminated strings in one blob, with their ends.
+func (b *realmBuilder) mediumStrings(strs ...string) int64 {
+	var blob []byte
+	var ends []int64
+	for _, s := range strs {
+		blob = append(append(blob, s...), 0)
+		ends = append(ends, int64(len(blob)))
+	}
+	return b.ints(testRealmHasRefs, b.ints(0, ends...), b.blob(blob))
+}
+
+// longStrings appends a zero terminated blob per string, with a ref to each.
+func (b *realmBuilder) longStrings(strs ...string) int64 {
+	var refs []int64
+	for _, s := range strs {
+		refs = append(refs, b.blob(append([]byte(s), 0)))
+	}
+	return b.ints(testRealmHasRefs|testRealmContext, refs...)
+}
+
+// table appends a table's spec, returning its top array's ref.
+func (b *realmBuilder) table(names []string, keys []int64, clusters int64) int64 {
+	spec := b.ints(testRealmHasRefs, tagged(0), b.shortStrings(names...), tagged(0), tagged(0), tagged(0), b.ints(0, keys...))
+	return b.ints(testRealmHasRefs, spec, tagged(0), clusters)
+}
+
+// write writes the file, with its tables, in the streaming form if asked.
+func (b *realmBuilder) write(t *testing.T, names []string, tables []int64, streaming bool) string {
+	t.Helper()
+	group := b.ints(testRealmHasRefs, b.shortStrings(names...), b.ints(testRealmHasRefs, tables...))
+	if streaming {
+		binary.LittleEndian.PutUint64(b.data, math.MaxUint64)
+		b.data = binary.LittleEndian.AppendUint64(b.data, uint64(group))
+		b.data = binary.LittleEndian.AppendUint64(b.data, realmFooterCookie)
+	} else {
+		binary.LittleEndian.PutUint64(b.data, uint64(group))
+	}
+	copy(b.data[16:], "T-DB")
+	b.data[20], b.data[21] = 22, 22
+
+	path := filepath.Join(t.TempDir(), "client.realm")
+	if err := os.WriteFile(path, b.data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+type realmTestThing struct {
+	Key    int64
+	Name   string
+	Count  int64
+	Maybe  int64
+	Flag   bool
+	When   time.Time
+	Other  string
+	Others []string
+	Tags   []string
+	Notes  string
+}
+
+// writeTestRealm writes a realm with a class_Thing table of every column
+// type, over two leaves, which link to class_Other's objects.
+func writeTestRealm(t *testing.T, streaming bool) string {
+	b := newRealmBuilder()
+
+	// class_Other, keys 0-2
+	otherLeaf := b.ints(testRealmHasRefs, tagged(3), b.shortStrings("zero", "one", "two"))
+	other := b.table([]string{"Label"}, []int64{realmColumnKey(0, realmTypeString, 0)}, otherLeaf)
+
+	names := []string{"Name", "Count", "Maybe", "Flag", "When", "Other", "Others", "Tags", "Notes"}
+	keys := []int64{
+		realmColumnKey(0, realmTypeString, 0),
+		realmColumnKey(1, realmTypeInt, 0),
+		realmColumnKey(2, realmTypeInt, realmAttrNullable),
+		realmColumnKey(3, realmTypeBool, 0),
+		realmColumnKey(4, realmTypeTimestamp, 0),
+		realmColumnKey(5, realmTypeLink, 0),
+		realmColumnKey(6, realmTypeLink, realmAttrList),
+		realmColumnKey(7, realmTypeString, realmAttrList),
+		realmColumnKey(8, realmTypeString, realmAttrNullable),
+	}
+
+	// the first leaf's keys are 0 & 1, kept as their count, and its strings are short
+	first := b.ints(testRealmHasRefs,
+		tagged(2),
+		b.shortStrings("cmyui", ""),
+		b.ints(0, 727, -5),
+		b.ints(0, -1, 42, -1), // the first is the value standing for null
+		b.ints(0, 1, 0),
+		b.ints(testRealmHasRefs, b.ints(0, -1, 1700000000, 0), b.ints(0, 5e8, 0)),
+		b.ints(0, 2, 0), // keys + 1, 0 for null
+		b.ints(testRealmHasRefs, b.ints(0, 3, 1, 9), 0),
+		b.ints(testRealmHasRefs,
+			// a list split over two leaves
+			b.ints(testRealmHasRefs|testRealmInner, tagged(0), b.shortStrings("a", "b"), b.mediumStrings("c"), tagged(3)),
+			b.shortStrings("solo"),
+		),
+		b.longStrings("a long note", ""),
+	)
+	// the second's keys are 5 & 9, and its strings are medium length
+	second := b.ints(testRealmHasRefs,
+		b.ints(0, 5, 9),
+		b.mediumStrings("a much longer name, to need a blob", "rrtyui"),
+		b.ints(0, 1<<40, 0),
+		b.ints(0, -1, 99, 7),
+		b.ints(0, 0, 1),
+		b.ints(testRealmHasRefs, b.ints(0, -1, 0, 1), b.ints(0, 0, 0)),
+		b.ints(0, 1, 3),
+		b.ints(testRealmHasRefs, 0, 0),
+		b.ints(testRealmHasRefs, 0, b.mediumStrings()),
+		b.longStrings("", "note"),
+	)
+	// the second leaf's keys start at 1000
+	clusters := b.ints(testRealmHasRefs|testRealmInner, b.ints(0, 0, 1000), tagged(1), tagged(4), first, second)
+	thing := b.table(names, keys, clusters)
+
+	// a removed table leaves a tagged int behind
+	return b.write(t, []string{"class_Other", "class_Gone", "class_Thing"}, []int64{other, tagged(0), thing}, streaming)
+}
+
+func TestRealm(t *testing.T) {
+	want := []realmTestThing{
+		{Key: 0, Name: "cmyui", Count: 727, Maybe: 42, Flag: true, When: time.Unix(1700000000, 5e8).UTC(),
+			Other: "one", Others: []string{"two", "zero"}, Tags: []string{"a", "b", "c"}, Notes: "a long note"},
+		{Key: 1, Count: -5, Tags: []string{"solo"}, When: time.Unix(0, 0).UTC()},
+		{Key: 1005, Name: "a much longer name, to need a blob", Count: 1 << 40, Maybe: 99, When: time.Unix(0, 0).UTC(), Other: "zero"},
+		{Key: 1009, Name: "rrtyui", Maybe: 7, Flag: true, When: time.Unix(1, 0).UTC(), Other: "two", Notes: "note"},
+	}
+	for _, streaming := range []bool{false, true} {
+		realm, err := openRealm(writeTestRealm(t, streaming))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := realm.Table("class_Gone"); err == nil {
+			t.Error("the removed table was found")
+		}
+		other, err := realm.Table("class_Other")
+		if err != nil {
+			t.Fatal(err)
+		}
+		things, err := realm.Table("class_Thing")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []realmTestThing
+		for _, o := range things.Objects {
+			thing := realmTestThing{
+				Key: o.key, Name: o.String("Name"), Count: o.Int("Count"), Maybe: o.Int("Maybe"),
+				Flag: o.Bool("Flag"), When: o.Time("When"), Tags: o.Strings("Tags"), Notes: o.String("Notes"),
+			}
+			if linked, ok := o.Link("Other", other); ok {
+				thing.Other = linked.String("Label")
+			}
+			for _, linked := range o.Links("Others", other) {
+				thing.Others = append(thing.Others, linked.String("Label"))
+			}
+			got = append(got, thing)
+		}
+		if realm.err != nil {
+			t.Fatal(realm.err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("streaming %v: read %+v, want %+v", streaming, got, want)
+		}
+
+		// reading a missing or mistyped column fails, once it's checked
+		o := things.Objects[0]
+		if things.Has("Missing") || o.Int("Missing") != 0 || realm.err == nil {
+			t.Error("reading a missing column didn't fail")
+		}
+		realm.err = nil
+		if o.Int("Name") != 0 || realm.err == nil {
+			t.Error("reading a string as an int didn't fail")
+		}
+	}
+}
+
+func TestOpenRealmErrors(t *testing.T) {
+	valid, err := os.ReadFile(writeTestRealm(t, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	streaming, err := os.ReadFile(writeTestRealm(t, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldFormat := append([]byte{}, valid...)
+	oldFormat[20] = 9
+
+	noFooter := append([]byte{}, streaming...)
+	noFooter[len(noFooter)-1] ^= 0xff
+
+	badRef := append([]byte{}, valid...)
+	binary.LittleEndian.PutUint64(badRef, uint64(len(valid)+8))
+
+	dir := t.TempDir()
+	for name, data := range map[string][]byte{
+		"empty":           nil,
+		"not a realm":     []byte("SQLite format 3\x00 and then some more bytes"),
+		"old format":      oldFormat,
+		"no footer":       noFooter,
+		"ref out of file": badRef,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := openRealm(path); !errors.Is(err, errRealmFormat) {
+			t.Errorf("%s: openRealm() = %v, want errRealmFormat", name, err)
+		}
+	}
+}
+
+func TestRealmUnsupportedArrays(t *testing.T) {
+	for name, leaf := range map[string]func(b *realmBuilder) int64{
+		"compressed": func(b *realmBuilder) int64 { return b.node(0, 3, 8, 1, []byte{0}) },
+		"enumerated": func(b *realmBuilder) int64 { return b.ints(0, 0) },
+	} {
+		b := newRealmBuilder()
+		clusters := b.ints(testRealmHasRefs, tagged(1), leaf(b))
+		table := b.table([]string{"Name"}, []int64{realmColumnKey(0, realmTypeString, 0)}, clusters)
+		realm, err := openRealm(b.write(t, []string{"class_Thing"}, []int64{table}, false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		things, err := realm.Table("class_Thing")
+		if err != nil {
+			t.Fatal(err)
+		}
+		things.Objects[0].String("Name")
+		if !errors.Is(realm.err, errRealmFormat) {
+			t.Errorf("%s: reading the strings = %v, want errRealmFormat", name, realm.err)
+		}
+	}
+}
+
+func TestRealmCorruptArrays(t *testing.T) {
+	for name, tc := range map[string]struct {
+		column int64
+		leaf   func(b *realmBuilder) int64
+		read   func(o RealmObject)
+	}{
+		// a blob's declared width is ignored, its elements are bytes
+		"ints past the payload": {
+			realmColumnKey(0, realmTypeInt, 0),
+			func(b *realmBuilder) int64 { return b.node(0, realmWidthIgnore, 64, 2, []byte{1, 2}) },
+			func(o RealmObject) { o.Int("Value") },
+		},
+		"blob cycle": {
+			realmColumnKey(0, realmTypeString, 0),
+			func(b *realmBuilder) int64 {
+				ends := b.ints(0, 1)
+				blob := int64(len(b.data))
+				b.ints(testRealmHasRefs, blob)
+				return b.ints(testRealmHasRefs, ends, blob)
+			},
+			func(o RealmObject) { o.String("Value") },
+		},
+	} {
+		b := newRealmBuilder()
+		clusters := b.ints(testRealmHasRefs, tagged(1), tc.leaf(b))
+		table := b.table([]string{"Value"}, []int64{tc.column}, clusters)
+		realm, err := openRealm(b.write(t, []string{"class_Thing"}, []int64{table}, false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		things, err := realm.Table("class_Thing")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tc.read(things.Objects[0])
+		if !errors.Is(realm.err, errRealmFormat) {
+			t.Errorf("%s: reading it = %v, want errRealmFormat", name, realm.err)
+		}
+	}
+}
+
+func TestLazerRealmCollections(t *testing.T) {
+	b := newRealmBuilder()
+	clusters := b.ints(testRealmHasRefs,
+		tagged(2),
+		b.shortStrings("tourney pool", "empty"),
+		b.ints(testRealmHasRefs, b.shortStrings("1cf5b2c2edfafd055536d2cefcb89c0e", "c8f08438204abfcdd1a748ebfae67421"), 0),
+	)
+	table := b.table([]string{"Name", "BeatmapMD5Hashes"},
+		[]int64{realmColumnKey(0, realmTypeString, 0), realmColumnKey(1, realmTypeString, realmAttrList)}, clusters)
+	realm, err := openRealm(b.write(t, []string{"class_BeatmapCollection"}, []int64{table}, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := lazerRealmCollections(realm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Collection{
+		{Name: "tourney pool", MD5s: []string{"1cf5b2c2edfafd055536d2cefcb89c0e", "c8f08438204abfcdd1a748ebfae67421"}},
+		{Name: "empty"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("lazerRealmCollections() = %+v, want %+v", got, want)
+	}
+}
+
+func TestLazerStatistics(t *testing.T) {
+	statistics := lazerStatistics{
+		"Perfect": 1, "Great": 2, "Good": 3, "Ok": 4, "Meh": 5, "Miss": 6,
+		"LargeTickHit": 7, "LargeTickMiss": 8, "SmallTickHit": 9, "SmallTickMiss": 10,
+	}
+	for _, tt := range []struct {
+		mode int
+		want Replay
+	}{
+		{0, Replay{N300: 2, N100: 4, N50: 5, Nmiss: 6}},
+		{1, Replay{Mode: 1, N300: 2, N100: 4, Nmiss: 6}},
+		{2, Replay{Mode: 2, N300: 2, N100: 7, N50: 9, Nkatu: 10, Nmiss: 14}},
+		{3, Replay{Mode: 3, Ngeki: 1, N300: 2, Nkatu: 3, N100: 4, N50: 5, Nmiss: 6}},
+	} {
+		got := Replay{Mode: tt.mode}
+		statistics.count(&got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("mode %d: count() = %+v, want %+v", tt.mode, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// recalc stats rebuilds the stats table from the scores table, the same way
+// bancho.py adds up each submitted score. pp isn't touched, as changing it
+// also means updating the leaderboards in redis; tools/recalc.py does that.
+
+// how many users' stats are recalculated per transaction
+const recalcChunkSize = 1000
+
+// a beatmap's status, as in bancho.py's RankedStatus
+const (
+	mapStatusRanked   = 2
+	mapStatusApproved = 3
+	mapStatusLoved    = 5
+)
+
+// every submitted score counts towards plays, playtime & total score,
+// including those moved to the archive table by archive scores
+var select_recalc_totals = `
+SELECT userid, COUNT(*) AS plays, SUM(time_elapsed DIV 1000) AS playtime,
+SUM(score) AS tscore, SUM(n300 + n100 + n50 + IF(mode % 4 IN (1, 3), ngeki + nkatu, 0)) AS total_hits
+FROM %s WHERE mode = ? AND userid IN (?)
+GROUP BY userid`
+
+// the tables scores are counted from, see select_recalc_totals
+var recalcScoreTables = []string{"scores"}
+
+// passes on maps with a leaderboard count towards max combo, and best scores
+// on ranked maps towards ranked score & accuracy, weighted by their pp.
+var select_recalc_passes = `
+SELECT s.userid, s.score, s.max_combo, s.acc, s.status, m.status AS map_status
+FROM scores s JOIN maps m ON m.md5 = s.map_md5
+WHERE s.mode = ? AND s.userid IN (?) AND s.status != 0 AND m.status IN (?, ?, ?)
+ORDER BY s.userid, s.pp DESC`
+
+var update_recalc_stats = `
+UPDATE stats SET tscore = :tscore, rscore = :rscore, plays = :plays,
+	playtime = :playtime, acc = :acc, max_combo = :max_combo, total_hits = :total_hits
+WHERE id = :userid AND mode = :mode`
+
+// userStats are the stats recalculated for a user in a mode.
+type userStats struct {
+	ID        int64 `db:"userid"`
+	Mode      int
+	Plays     int
+	Playtime  int64
+	TScore    int64 `db:"tscore"`
+	RScore    int64 `db:"rscore"`
+	TotalHits int64 `db:"total_hits"`
+	MaxCombo  int   `db:"max_combo"`
+	Acc       float64
+}
+
+type recalcPass struct {
+	UserID    int64 `db:"userid"`
+	Score     int64
+	MaxCombo  int `db:"max_combo"`
+	Acc       float64
+	Status    int
+	MapStatus int `db:"map_status"`
+}
+
+// recalcChunk is a chunk of users, whose stats in a mode are recalculated together.
+type recalcChunk struct {
+	Mode  int
+	Users []int64
+}
+
+// userChunks splits a set of users into chunks of recalcChunkSize.
+func userChunks(set map[int64]bool) [][]int64 {
+	var ids []int64
+	for id := range set {
+		ids = append(ids, id)
+	}
+	var chunks [][]int64
+	for len(ids) != 0 {
+		n := recalcChunkSize
+		if n > len(ids) {
+			n = len(ids)
+		}
+		chunks = append(chunks, ids[:n])
+		ids = ids[n:]
+	}
+	return chunks
+}
+
+// recalcScorePages pages through the scores selected by --mode & --user,
+// with a query taking "WHERE id > ? %s ... LIMIT ?", handing each page to
+// one of NumWorkers workers. it returns how many pages failed.
+func recalcScorePages(query string, fn func([]Score) error) (int64, error) {
+	if cfg.RecalcMode >= 0 && !statsModes[cfg.RecalcMode] {
+		return 0, fmt.Errorf("--mode %d is not one of bancho.py's modes", cfg.RecalcMode)
+	}
+
+	var filters []string
+	var filterArgs []interface{}
+	if cfg.RecalcMode >= 0 {
+		filters = append(filters, "AND mode = ?")
+		filterArgs = append(filterArgs, cfg.RecalcMode)
+	}
+	if cfg.RecalcUser != "" {
+		user, err := findUser(cfg.RecalcUser)
+		if err != nil {
+			return 0, err
+		}
+		filters = append(filters, "AND userid = ?")
+		filterArgs = append(filterArgs, user)
+	}
+	query = fmt.Sprintf(query, strings.Join(filters, " "))
+
+	if err := tuneWorkers(); err != nil {
+		return 0, err
+	}
+
+	var failed int64
+	pages := make(chan []Score, NumWorkers)
+	var wg sync.WaitGroup
+	for i := 0; i < NumWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for page := range pages {
+				if err := fn(page); err != nil {
+					logger.Error("failed to recalculate scores", "first_score", page[0].ID, "scores", len(page), "err", err)
+					atomic.AddInt64(&failed, 1)
+				}
+			}
+		}()
+	}
+
+	var lastID int64
+	var err error
+	for !isInterrupted() {
+		var scores []Score
+		args := append([]interface{}{lastID}, filterArgs...)
+		if err = ReadDB.Select(&scores, query, append(args, BatchSize)...); err != nil || len(scores) == 0 {
+			break
+		}
+		if err = throttle(len(scores)); err != nil {
+			break
+		}
+		pages <- scores
+		lastID = scores[len(scores)-1].ID
+	}
+	close(pages)
+	wg.Wait()
+	if err == nil && isInterrupted() {
+		err = errInterrupted
+	}
+	return failed, err
+}
+
+// rebuildUserStats recalculates a set of users' best scores, then their
+// stats in every mode, after their scores were moved around.
+func rebuildUserStats(users map[int64]bool) (*statusCounts, error) {
+	chunks := userChunks(users)
+
+	cfg.RecalcMode = -1
+	counts := &statusCounts{}
+	for _, chunk := range chunks {
+		if isInterrupted() {
+			return nil, errInterrupted
+		}
+		if err := recalculateStatuses(chunk, nil, counts); err != nil {
+			return nil, err
+		}
+	}
+	for mode := range statsModes {
+		for _, chunk := range chunks {
+			if isInterrupted() {
+				return nil, errInterrupted
+			}
+			if err := recalculateChunk(recalcChunk{Mode: mode, Users: chunk}); err != nil {
+				return nil, err
+			}
+			if err := recalculatePP(mode, chunk); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if _, err := DB.Exec(update_stats_from_scores); err != nil {
+		return nil, fmt.Errorf("failed to update stats from scores: %w", err)
+	}
+	return counts, nil
+}
+
+// weightedAccuracy works out a user's overall accuracy from their best
+// scores' accuracies (in order of pp), in the same way as bancho.py.
+func weightedAccuracy(accs []float64) float64 {
+	if len(accs) == 0 {
+		return 0
+	}
+
+	var weighted float64
+	for i, acc := range accs {
+		weighted += acc * math.Pow(0.95, float64(i))
+	}
+	bonus := 100 / (20 * (1 - math.Pow(0.95, float64(len(accs)))))
+	return weighted * bonus / 100
+}
+
+// recalculateChunk recalculates & saves the stats of a chunk of users.
+func recalculateChunk(chunk recalcChunk) error {
+	if err := throttle(len(chunk.Users)); err != nil {
+		return err
+	}
+	stats := make(map[int64]*userStats, len(chunk.Users))
+	for _, id := range chunk.Users {
+		// users without any scores are reset
+		stats[id] = &userStats{ID: id, Mode: chunk.Mode}
+	}
+
+	for _, table := range recalcScoreTables {
+		query, args, err := sqlx.In(fmt.Sprintf(select_recalc_totals, table), chunk.Mode, chunk.Users)
+		if err != nil {
+			return err
+		}
+		var totals []userStats
+		if err := DB.Select(&totals, query, args...); err != nil {
+			return err
+		}
+		for _, total := range totals {
+			s := stats[total.ID]
+			s.Plays += total.Plays
+			s.Playtime += total.Playtime
+			s.TScore += total.TScore
+			s.TotalHits += total.TotalHits
+		}
+	}
+
+	query, args, err := sqlx.In(select_recalc_passes, chunk.Mode, chunk.Users,
+		mapStatusRanked, mapStatusApproved, mapStatusLoved)
+	if err != nil {
+		return err
+	}
+	var passes []recalcPass
+	if err := DB.Select(&passes, query, args...); err != nil {
+		return err
+	}
+
+	accs := make(map[int64][]float64)
+	for _, pass := range passes {
+		s := stats[pass.UserID]
+		if pass.MaxCombo > s.MaxCombo {
+			s.MaxCombo = pass.MaxCombo
+		}
+		if pass.Status == 2 && (pass.MapStatus == mapStatusRanked || pass.MapStatus == mapStatusApproved) {
+			s.RScore += pass.Score
+			accs[pass.UserID] = append(accs[pass.UserID], pass.Acc)
+		}
+	}
+
+	tx, err := DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, id := range chunk.Users {
+		s := stats[id]
+		s.Acc = weightedAccuracy(accs[id])
+		if _, err := tx.NamedExec(update_recalc_stats, s); err != nil {
+			return fmt.Errorf("failed to update stats of user %d: %w", id, err)
+		}
+	}
+	return tx.Commit()
+}
+
+func runRecalcStats() error {
+	modes := make([]int, 0, len(statsModes))
+	if cfg.RecalcMode >= 0 {
+		if !statsModes[cfg.RecalcMode] {
+			return fmt.Errorf("--mode %d is not one of bancho.py's modes", cfg.RecalcMode)
+		}
+		modes = append(modes, cfg.RecalcMode)
+	} else {
+		for mode := range statsModes {
+			modes = append(modes, mode)
+		}
+		sort.Ints(modes)
+	}
+
+	var onlyUser int64
+	if cfg.RecalcUser != "" {
+		var err error
+		if onlyUser, err = findUser(cfg.RecalcUser); err != nil {
+			return err
+		}
+	}
+
+	if exists, err := tableExists(archiveTable); err != nil {
+		return err
+	} else if exists {
+		recalcScoreTables = append(recalcScoreTables, archiveTable)
+	}
+
+	if err := tuneWorkers(); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	chunks := make(chan recalcChunk, NumWorkers)
+	var recalculated, failed int64
+
+	var wg sync.WaitGroup
+	for i := 0; i < NumWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range chunks {
+				if err := recalculateChunk(chunk); err != nil {
+					logger.Error("failed to recalculate stats", "mode", chunk.Mode,
+						"first_user", chunk.Users[0], "users", len(chunk.Users), "err", err)
+					atomic.AddInt64(&failed, int64(len(chunk.Users)))
+					continue
+				}
+				atomic.AddInt64(&recalculated, int64(len(chunk.Users)))
+			}
+		}()
+	}
+
+	var err error
+	for _, mode := range modes {
+		var users []int64
+		if onlyUser != 0 {
+			err = DB.Select(&users, "SELECT id FROM stats WHERE mode = ? AND id = ?", mode, onlyUser)
+		} else {
+			err = DB.Select(&users, "SELECT id FROM stats WHERE mode = ? ORDER BY id", mode)
+		}
+		if err != nil {
+			break
+		}
+
+		logger.Info("recalculating stats", "mode", mode, "users", len(users))
+		for len(users) != 0 {
+			n := recalcChunkSize
+			if n > len(users) {
+				n = len(users)
+			}
+			chunks <- recalcChunk{Mode: mode, Users: users[:n]}
+			users = users[n:]
+		}
+	}
+
+	close(chunks)
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+
+	logger.Info("recalculated stats", "users", recalculated, "failed", failed,
+		"elapsed", time.Since(start).Round(time.Second))
+	if failed != 0 {
+		return errors.New("some users' stats could not be recalculated")
+	}
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "recalc stats",
+		Summary: "recalculate users' stats (ranked & total score, plays, playtime, max combo, accuracy) from their scores",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.IntVar(&c.RecalcMode, "mode", -1, "only recalculate this mode (0-3 vanilla, 4-6 relax, 8 autopilot)")
+			flags.StringVar(&c.RecalcUser, "user", "", "only recalculate this user, by name or id")
+			flags.IntVar(&c.Workers, "workers", 0, "number of concurrent workers (default: tuned to the database's max_connections)")
+		},
+		Run: runRecalcStats,
+	})
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// recalc acc works out every score's accuracy again from its hit counts,
+// with its mode's formula (see calculateAccuracy), as scores imported from
+// other servers have often had taiko, catch & mania's worked out as if
+// they were osu!'s. only the scores whose acc changed are updated, and how
+// much they changed by is reported per mode.
+
+var select_acc_scores = `
+SELECT id, mode, mods, n300, n100, n50, nmiss, ngeki, nkatu, acc FROM scores
+WHERE id > ? %s ORDER BY id LIMIT ?`
+
+// acc is stored with 3 decimal places, so smaller changes are rounding
+const accEpsilon = 0.0005
+
+// accBuckets are the bounds of the corrections' distribution, in percentage points.
+var accBuckets = []float64{0.01, 0.1, 1, 5, 10, 25}
+
+// accCounts are the totals of an accuracy recalculation.
+type accCounts struct {
+	Scores  int64
+	Changed int64
+
+	mu      sync.Mutex
+	buckets map[int][]int64 // per mode, corrections within each of accBuckets, & above
+	largest map[int]float64 // per mode
+}
+
+// accBucket is the index of the bucket a correction falls into.
+func accBucket(change float64) int {
+	for i, bound := range accBuckets {
+		if change < bound {
+			return i
+		}
+	}
+	return len(accBuckets)
+}
+
+// recalculateAccuracies works out a page of scores' acc, updating those which changed.
+func recalculateAccuracies(scores []Score, counts *accCounts) error {
+	type correction struct {
+		id   int64
+		mode int
+		acc  float32
+		diff float64
+	}
+	var changed []correction
+	for i := range scores {
+		score := &scores[i]
+		acc := calculateAccuracy(score)
+		if diff := math.Abs(float64(acc - score.Acc)); diff > accEpsilon {
+			changed = append(changed, correction{score.ID, score.Mode, acc, diff})
+		}
+	}
+
+	if !cfg.DryRun && len(changed) != 0 {
+		tx, err := DB.Beginx()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		stmt, err := tx.Preparex("UPDATE scores SET acc = ? WHERE id = ?")
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, c := range changed {
+			if _, err := stmt.Exec(c.acc, c.id); err != nil {
+				return err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	atomic.AddInt64(&counts.Scores, int64(len(scores)))
+	atomic.AddInt64(&counts.Changed, int64(len(changed)))
+	counts.mu.Lock()
+	defer counts.mu.Unlock()
+	for _, c := range changed {
+		if counts.buckets[c.mode] == nil {
+			counts.buckets[c.mode] = make([]int64, len(accBuckets)+1)
+		}
+		counts.buckets[c.mode][accBucket(c.diff)]++
+		counts.largest[c.mode] = max(counts.largest[c.mode], c.diff)
+	}
+	return nil
+}
+
+func runRecalcAcc() error {
+	start := time.Now()
+	logger.Info("recalculating accuracy", "dry_run", cfg.DryRun)
+
+	counts := &accCounts{buckets: map[int][]int64{}, largest: map[int]float64{}}
+	failed, err := recalcScorePages(select_acc_scores, func(page []Score) error {
+		return recalculateAccuracies(page, counts)
+	})
+	if err != nil {
+		return err
+	}
+
+	// the distribution of corrections, per mode
+	if counts.Changed != 0 {
+		fmt.Printf("%-6s", "mode")
+		lower := 0.0
+		for _, bound := range accBuckets {
+			fmt.Printf(" %10s", fmt.Sprintf("%g-%g%%", lower, bound))
+			lower = bound
+		}
+		fmt.Printf(" %10s %10s\n", fmt.Sprintf(">%g%%", lower), "largest")
+		for mode := 0; mode <= 11; mode++ {
+			buckets := counts.buckets[mode]
+			if buckets == nil {
+				continue
+			}
+			fmt.Printf("%-6d", mode)
+			for _, n := range buckets {
+				fmt.Printf(" %10d", n)
+			}
+			fmt.Printf(" %9.3f%%\n", counts.largest[mode])
+		}
+	}
+
+	logger.Info("recalculated accuracy", "scores", counts.Scores, "changed", counts.Changed,
+		"failed_pages", failed, "dry_run", cfg.DryRun, "elapsed", time.Since(start).Round(time.Second))
+	if failed != 0 {
+		return errors.New("some scores' accuracy could not be recalculated")
+	}
+	if !cfg.DryRun && counts.Changed != 0 {
+		logger.Info("accuracy changed, grades & users' stats can be updated with `migrate recalc grades` & `migrate recalc stats`")
+	}
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "recalc acc",
+		Summary: "work out every score's accuracy again with its mode's formula, updating those which changed",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.IntVar(&c.RecalcMode, "mode", -1, "only recalculate this mode (0-3 vanilla, 4-6 relax, 8 autopilot)")
+			flags.StringVar(&c.RecalcUser, "user", "", "only recalculate this user's scores, by name or id")
+			flags.BoolVar(&c.DryRun, "dry-run", false, "report how accuracy would change without changing it")
+			flags.IntVar(&c.Workers, "workers", 0, "number of concurrent workers (default: tuned to the database's max_connections)")
+		},
+		Run: runRecalcAcc,
+	})
+}
@@ -0,0 +1,626 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// a full recalc pp of a large server's scores is days of cpu on one
+// machine, so it can be spread over several: recalc pp-coordinator splits
+// the scores into ranges of ids, and hands them out over http to any
+// number of recalc pp-worker processes, each with its own copy of
+// .data/osu and its own calculators, writing pp straight to the database.
+//
+// workers hold a lease on each range, renewed as they go; a range whose
+// worker fails, or stops renewing (crashed, lost its network), goes back to
+// be handed out again, up to --max-attempts times. finished ranges are kept
+// in the recalc_pp_ranges table, so a coordinator which is stopped picks up
+// where it left off when it's run again, unless --restart is given.
+//
+//	coordinator: ./migrate recalc pp-coordinator --listen :8700 --token secret
+//	workers:     ./migrate recalc pp-worker --coordinator http://10.0.0.1:8700 --token secret
+
+var create_recalc_pp_ranges = `
+create table if not exists recalc_pp_ranges
+(
+	id int not null primary key,
+	from_id bigint unsigned not null,
+	to_id bigint unsigned not null,
+	mode tinyint not null,
+	userid int not null,
+	done tinyint(1) default 0 not null,
+	recalculated int unsigned default 0 not null,
+	changed int unsigned default 0 not null,
+	failed int unsigned default 0 not null,
+	worker varchar(64) null,
+	finished_at datetime null
+);`
+
+// how long a worker waits when every range is out, before asking again
+const ppWorkerPollInterval = 5 * time.Second
+
+// ppRange is a range of score ids, recalculated by one worker at a time.
+type ppRange struct {
+	ID     int   `db:"id" json:"id"`
+	From   int64 `db:"from_id" json:"from"`
+	To     int64 `db:"to_id" json:"to"`
+	Mode   int   `db:"mode" json:"mode"`
+	UserID int64 `db:"userid" json:"userid"`
+	Done   bool  `db:"done" json:"-"`
+
+	worker      string
+	leasedUntil time.Time
+	attempts    int
+	failed      bool // out of attempts
+}
+
+// the coordinator's requests & responses
+type (
+	ppLeaseRequest struct {
+		Worker string `json:"worker"`
+	}
+	ppLeaseResponse struct {
+		Range *ppRange `json:"range,omitempty"`
+		Lease float64  `json:"lease,omitempty"` // seconds the worker has to renew it
+		Wait  bool     `json:"wait,omitempty"`  // every range is out, but not done
+		Done  bool     `json:"done,omitempty"`
+	}
+	ppRangeRequest struct {
+		Worker string   `json:"worker"`
+		Range  int      `json:"range"`
+		Counts ppCounts `json:"counts"`
+		Error  string   `json:"error,omitempty"`
+	}
+	ppStatus struct {
+		Ranges    int      `json:"ranges"`
+		Done      int      `json:"done"`
+		Leased    int      `json:"leased"`
+		Failed    int      `json:"failed"`
+		Workers   []string `json:"workers"`
+		Counts    ppCounts `json:"counts"`
+		StartedAt string   `json:"started_at"`
+	}
+)
+
+var metricPPRanges = newGauge("migrate_pp_ranges",
+	"Ranges of scores being recalculated, by state: pending, leased, done or failed.", "state")
+
+// ppCoordinator hands out the ranges, and takes them back.
+type ppCoordinator struct {
+	mu      sync.Mutex
+	ranges  []*ppRange
+	counts  ppCounts
+	started time.Time
+}
+
+// planPPRanges splits the scores being recalculated into ranges, or loads
+// the ranges of an earlier run.
+func planPPRanges(filter ppFilter) ([]*ppRange, error) {
+	if cfg.PPRestart {
+		if _, err := DB.Exec("DROP TABLE IF EXISTS recalc_pp_ranges"); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := DB.Exec(create_recalc_pp_ranges); err != nil {
+		return nil, err
+	}
+
+	var ranges []*ppRange
+	if err := DB.Select(&ranges, "SELECT id, from_id, to_id, mode, userid, done FROM recalc_pp_ranges ORDER BY id"); err != nil {
+		return nil, err
+	}
+	if len(ranges) != 0 {
+		if ranges[0].Mode != filter.Mode || ranges[0].UserID != filter.UserID {
+			return nil, errors.New("an earlier run recalculated other scores (--mode or --user differ), use --restart to start over")
+		}
+		logger.Info("resuming an earlier run", "ranges", len(ranges))
+		return ranges, nil
+	}
+
+	conditions, args := filter.conditions()
+	var first, last int64
+	err := DB.QueryRow(fmt.Sprintf("SELECT COALESCE(MIN(s.id), 0), COALESCE(MAX(s.id), 0) FROM scores s WHERE s.status != 0 %s",
+		conditions), args...).Scan(&first, &last)
+	if err != nil {
+		return nil, err
+	}
+	for from := first; from <= last && last != 0; from += cfg.PPRangeSize {
+		ranges = append(ranges, &ppRange{ID: len(ranges) + 1, From: from, To: from + cfg.PPRangeSize - 1,
+			Mode: filter.Mode, UserID: filter.UserID})
+	}
+	for start := 0; start < len(ranges); start += BatchSize {
+		_, err := DB.NamedExec(`
+		INSERT INTO recalc_pp_ranges (id, from_id, to_id, mode, userid)
+		VALUES (:id, :from_id, :to_id, :mode, :userid)`, ranges[start:min(start+BatchSize, len(ranges))])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ranges, nil
+}
+
+// lease hands out the next range which isn't done, or leased to a worker
+// who's still renewing it.
+func (c *ppCoordinator) lease(worker string) ppLeaseResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	outstanding := false
+	for _, r := range c.ranges {
+		if r.Done || r.failed {
+			continue
+		}
+		if r.worker != "" && now.Before(r.leasedUntil) {
+			outstanding = true
+			continue
+		}
+		if r.worker != "" {
+			// the worker stopped renewing, so this counts as a failed attempt
+			logger.Warn("range's lease expired, handing it out again", "range", r.ID, "worker", r.worker)
+			if r.attempts++; r.attempts >= cfg.PPMaxAttempts {
+				logger.Error("giving up on range", "range", r.ID, "from", r.From, "to", r.To, "attempts", r.attempts)
+				r.failed, r.worker = true, ""
+				continue
+			}
+		}
+		r.worker, r.leasedUntil = worker, now.Add(cfg.PPLease)
+		return ppLeaseResponse{Range: r, Lease: cfg.PPLease.Seconds()}
+	}
+	if outstanding {
+		return ppLeaseResponse{Wait: true}
+	}
+	return ppLeaseResponse{Done: true}
+}
+
+// leased finds a range the worker holds the lease on.
+func (c *ppCoordinator) leased(worker string, id int) *ppRange {
+	if id < 1 || id > len(c.ranges) {
+		return nil
+	}
+	r := c.ranges[id-1]
+	if r.worker != worker || r.Done || r.failed {
+		return nil
+	}
+	return r
+}
+
+func (c *ppCoordinator) renew(req ppRangeRequest) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := c.leased(req.Worker, req.Range)
+	if r == nil {
+		return false
+	}
+	r.leasedUntil = time.Now().Add(cfg.PPLease)
+	return true
+}
+
+func (c *ppCoordinator) complete(req ppRangeRequest) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := c.leased(req.Worker, req.Range)
+	if r == nil {
+		// handed out again meanwhile; whichever finishes first counts
+		return nil
+	}
+	_, err := DB.Exec(`
+	UPDATE recalc_pp_ranges SET done = 1, recalculated = ?, changed = ?, failed = ?, worker = ?, finished_at = NOW()
+	WHERE id = ?`, req.Counts.Recalculated, req.Counts.Changed, req.Counts.Failed, req.Worker, r.ID)
+	if err != nil {
+		return err
+	}
+	r.Done, r.worker = true, ""
+	c.counts.Recalculated += req.Counts.Recalculated
+	c.counts.Changed += req.Counts.Changed
+	c.counts.NoBeatmap += req.Counts.NoBeatmap
+	c.counts.Failed += req.Counts.Failed
+	return nil
+}
+
+func (c *ppCoordinator) fail(req ppRangeRequest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := c.leased(req.Worker, req.Range)
+	if r == nil {
+		return
+	}
+	logger.Warn("worker failed to recalculate range", "range", r.ID, "worker", req.Worker, "err", req.Error)
+	r.worker = ""
+	if r.attempts++; r.attempts >= cfg.PPMaxAttempts {
+		logger.Error("giving up on range", "range", r.ID, "from", r.From, "to", r.To, "attempts", r.attempts)
+		r.failed = true
+	}
+}
+
+func (c *ppCoordinator) status() ppStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status := ppStatus{Ranges: len(c.ranges), Workers: []string{}, Counts: c.counts,
+		StartedAt: c.started.UTC().Format(time.RFC3339)}
+	now := time.Now()
+	for _, r := range c.ranges {
+		switch {
+		case r.Done:
+			status.Done++
+		case r.failed:
+			status.Failed++
+		case r.worker != "" && now.Before(r.leasedUntil):
+			status.Leased++
+			status.Workers = append(status.Workers, r.worker)
+		}
+	}
+	metricPPRanges.Set(float64(status.Done), "done")
+	metricPPRanges.Set(float64(status.Failed), "failed")
+	metricPPRanges.Set(float64(status.Leased), "leased")
+	metricPPRanges.Set(float64(status.Ranges-status.Done-status.Failed-status.Leased), "pending")
+	return status
+}
+
+// authorized checks the request carries --token.
+func authorized(req *http.Request) bool {
+	return subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte("Bearer "+cfg.PPToken)) == 1
+}
+
+func (c *ppCoordinator) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !authorized(req) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var response interface{}
+	switch req.URL.Path {
+	case "/status":
+		response = c.status()
+
+	case "/lease":
+		var body ppLeaseRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Worker == "" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		response = c.lease(body.Worker)
+
+	case "/renew", "/complete", "/fail":
+		var body ppRangeRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Worker == "" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		switch req.URL.Path {
+		case "/renew":
+			if !c.renew(body) {
+				http.Error(w, "the range isn't leased to you", http.StatusConflict)
+				return
+			}
+		case "/complete":
+			if err := c.complete(body); err != nil {
+				logger.Error("failed to record finished range", "range", body.Range, "err", err)
+				http.Error(w, "failed to record the range", http.StatusInternalServerError)
+				return
+			}
+		case "/fail":
+			c.fail(body)
+		}
+		response = struct{}{}
+
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func runRecalcPPCoordinator() error {
+	if cfg.PPToken == "" {
+		return errors.New("--token is required, as anyone who can reach the coordinator could otherwise take ranges")
+	}
+	if cfg.PPRangeSize < 1 || cfg.PPLease < time.Second || cfg.PPMaxAttempts < 1 {
+		return errors.New("--range-size, --lease and --max-attempts must be positive")
+	}
+	filter, err := loadPPFilter()
+	if err != nil {
+		return err
+	}
+	ranges, err := planPPRanges(filter)
+	if err != nil {
+		return err
+	}
+	c := &ppCoordinator{ranges: ranges, started: time.Now()}
+	if status := c.status(); status.Done == status.Ranges {
+		logger.Info("every range has been recalculated", "ranges", status.Ranges)
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", cfg.PPListen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", cfg.PPListen, err)
+	}
+	server := &http.Server{Handler: c, ReadHeaderTimeout: 10 * time.Second}
+	go server.Serve(listener)
+	defer server.Close()
+	logger.Info("waiting for workers", "listen", cfg.PPListen, "ranges", len(ranges))
+
+	handleSignals()
+	ticker := time.NewTicker(max(cfg.ProgressInterval, time.Second))
+	defer ticker.Stop()
+	var finished time.Time
+	for {
+		select {
+		case <-ticker.C:
+		case <-interrupted:
+			logger.Warn("stopping, ranges still out will be handed out again next run")
+			return errInterrupted
+		}
+
+		status := c.status()
+		if cfg.ProgressInterval > 0 {
+			logger.Info("recalculating pp", "done", status.Done, "ranges", status.Ranges, "workers", len(status.Workers),
+				"recalculated", status.Counts.Recalculated, "changed", status.Counts.Changed)
+		}
+		if status.Done+status.Failed < status.Ranges {
+			continue
+		}
+		// linger, so workers asking for another range hear that it's done
+		if finished.IsZero() {
+			finished = time.Now()
+		}
+		if time.Since(finished) < ppWorkerPollInterval*2 {
+			continue
+		}
+
+		logger.Info("recalculated pp", "recalculated", status.Counts.Recalculated, "changed", status.Counts.Changed,
+			"without_beatmap", status.Counts.NoBeatmap, "failed", status.Counts.Failed,
+			"elapsed", time.Since(c.started).Round(time.Second))
+		if status.Failed != 0 {
+			return fmt.Errorf("%d ranges could not be recalculated, run the coordinator again to retry them", status.Failed)
+		}
+		if status.Counts.Failed != 0 {
+			return errors.New("the pp of some scores could not be recalculated")
+		}
+		return nil
+	}
+}
+
+// ppWorkerClient talks to the coordinator.
+type ppWorkerClient struct {
+	http *http.Client
+	name string
+}
+
+// call posts a request to the coordinator, retrying lost connections up to
+// --max-retries times.
+func (c *ppWorkerClient) call(path string, request, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		err = c.post(path, body, response)
+		var statusErr ppStatusError
+		if err == nil || errors.As(err, &statusErr) || attempt >= cfg.MaxRetries {
+			return err
+		}
+		logger.Warn("failed to reach the coordinator, retrying", "attempt", attempt+1, "err", err)
+		select {
+		case <-time.After(retryDelay(attempt)):
+		case <-interrupted:
+			return errInterrupted
+		}
+	}
+}
+
+// ppStatusError is an error response from the coordinator.
+type ppStatusError struct {
+	status int
+	body   string
+}
+
+func (e ppStatusError) Error() string {
+	return fmt.Sprintf("coordinator responded %d: %s", e.status, e.body)
+}
+
+func (c *ppWorkerClient) post(path string, body []byte, response interface{}) error {
+	req, err := http.NewRequest(http.MethodPost, cfg.PPCoordinator+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+cfg.PPToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var msg bytes.Buffer
+		msg.ReadFrom(resp.Body)
+		return ppStatusError{resp.StatusCode, string(bytes.TrimSpace(msg.Bytes()))}
+	}
+	if response == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+// recalculateRange recalculates a leased range's scores, renewing the lease
+// as it goes. it stops early if the lease is lost.
+func (c *ppWorkerClient) recalculateRange(calc **ppCalculator, r *ppRange, lease time.Duration) (*ppCounts, error) {
+	lost := make(chan struct{})
+	stopRenewing := make(chan struct{})
+	defer close(stopRenewing)
+	go func() {
+		ticker := time.NewTicker(lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				err := c.call("/renew", ppRangeRequest{Worker: c.name, Range: r.ID}, nil)
+				if err != nil {
+					logger.Warn("lost the lease on range", "range", r.ID, "err", err)
+					close(lost)
+					return
+				}
+			case <-stopRenewing:
+				return
+			}
+		}
+	}()
+
+	conditions, filterArgs := ppFilter{Mode: r.Mode, UserID: r.UserID}.conditions()
+	query := fmt.Sprintf(select_pp_scores, "AND s.id <= ? "+conditions)
+	counts := &ppCounts{}
+	lastID := r.From - 1
+	for {
+		select {
+		case <-lost:
+			return counts, errors.New("lost the lease")
+		case <-interrupted:
+			return counts, errInterrupted
+		default:
+		}
+
+		var scores []ppScore
+		args := append([]interface{}{lastID, r.To}, filterArgs...)
+		if err := ReadDB.Select(&scores, query, append(args, BatchSize)...); err != nil {
+			return counts, err
+		}
+		if len(scores) == 0 {
+			return counts, nil
+		}
+		lastID = scores[len(scores)-1].ID
+		if err := recalculateBatchPP(calc, scores, counts); err != nil {
+			return counts, err
+		}
+	}
+}
+
+// work leases ranges & recalculates them until the coordinator's done.
+func (c *ppWorkerClient) work(total *ppCounts) error {
+	var calc *ppCalculator
+	defer func() {
+		if calc != nil {
+			calc.Close()
+		}
+	}()
+	for !isInterrupted() {
+		var lease ppLeaseResponse
+		if err := c.call("/lease", ppLeaseRequest{Worker: c.name}, &lease); err != nil {
+			return err
+		}
+		if lease.Done {
+			return nil
+		}
+		if lease.Range == nil {
+			select {
+			case <-time.After(ppWorkerPollInterval):
+			case <-interrupted:
+			}
+			continue
+		}
+
+		r := lease.Range
+		logger.Debug("recalculating range", "range", r.ID, "from", r.From, "to", r.To)
+		counts, err := c.recalculateRange(&calc, r, time.Duration(lease.Lease*float64(time.Second)))
+		atomic.AddInt64(&total.Recalculated, counts.Recalculated)
+		atomic.AddInt64(&total.Changed, counts.Changed)
+		atomic.AddInt64(&total.NoBeatmap, counts.NoBeatmap)
+		atomic.AddInt64(&total.Failed, counts.Failed)
+		if err != nil {
+			if failErr := c.call("/fail", ppRangeRequest{Worker: c.name, Range: r.ID, Error: err.Error()}, nil); failErr != nil {
+				logger.Warn("failed to tell the coordinator", "range", r.ID, "err", failErr)
+			}
+			if errors.Is(err, errInterrupted) {
+				return err
+			}
+			logger.Error("failed to recalculate range", "range", r.ID, "err", err)
+			continue
+		}
+		// if this fails, the lease runs out and the range is done again
+		if err := c.call("/complete", ppRangeRequest{Worker: c.name, Range: r.ID, Counts: *counts}, nil); err != nil {
+			logger.Error("failed to tell the coordinator the range is done", "range", r.ID, "err", err)
+		}
+	}
+	return errInterrupted
+}
+
+func runRecalcPPWorker() error {
+	if cfg.PPCoordinator == "" {
+		return errors.New("--coordinator is required")
+	}
+	calc, err := startPPCalculator(cfg.PPCalculator)
+	if err != nil {
+		return err
+	}
+	calc.Close()
+
+	if err := tuneWorkers(); err != nil {
+		return err
+	}
+	if cfg.Workers == 0 && NumWorkers > runtime.NumCPU() {
+		NumWorkers = runtime.NumCPU()
+	}
+	host, _ := os.Hostname()
+
+	handleSignals()
+	start := time.Now()
+	total := &ppCounts{}
+	errs := make(chan error, NumWorkers)
+	for i := 0; i < NumWorkers; i++ {
+		client := &ppWorkerClient{http: &http.Client{Timeout: time.Minute}, name: fmt.Sprintf("%s/%d/%d", host, os.Getpid(), i)}
+		go func() { errs <- client.work(total) }()
+	}
+	var firstErr error
+	for i := 0; i < NumWorkers; i++ {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	logger.Info("finished recalculating", "recalculated", total.Recalculated, "changed", total.Changed,
+		"without_beatmap", total.NoBeatmap, "failed", total.Failed, "elapsed", time.Since(start).Round(time.Second))
+	return firstErr
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "recalc pp-coordinator",
+		Summary: "split recalc pp's scores into ranges, and hand them out to recalc pp-worker processes on other machines",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.PPListen, "listen", ":8700", "address to listen for workers on")
+			flags.StringVar(&c.PPToken, "token", "", "shared secret the workers must present")
+			flags.Int64Var(&c.PPRangeSize, "range-size", 100000, "score ids per range")
+			flags.DurationVar(&c.PPLease, "lease", 2*time.Minute, "how long a worker may go without renewing its range before it's handed out again")
+			flags.IntVar(&c.PPMaxAttempts, "max-attempts", 3, "times a range is handed out before giving up on it")
+			flags.BoolVar(&c.PPRestart, "restart", false, "forget an earlier run's progress, and start over")
+			flags.IntVar(&c.RecalcMode, "mode", -1, "only recalculate this mode (0-3 vanilla, 4-6 relax, 8 autopilot)")
+			flags.StringVar(&c.RecalcUser, "user", "", "only recalculate this user's scores, by name or id")
+			flags.DurationVar(&c.ProgressInterval, "progress-interval", 10*time.Second, "how often to report progress (0 to disable)")
+		},
+		Run: runRecalcPPCoordinator,
+	})
+
+	registerCommand(&Command{
+		Name:              "recalc pp-worker",
+		Summary:           "recalculate the ranges of scores handed out by a recalc pp-coordinator",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.PPCoordinator, "coordinator", "", "the coordinator's url, e.g. http://10.0.0.1:8700")
+			flags.StringVar(&c.PPToken, "token", "", "shared secret the coordinator was given")
+			flags.StringVar(&c.PPCalculator, "calculator", "python3 pp_calculator.py", "command which calculates pp, see pp_calculator.py")
+			flags.IntVar(&c.Workers, "workers", 0, "number of concurrent calculators (default: one per cpu core, within the database's free connections)")
+			flags.IntVar(&c.MaxRetries, "max-retries", 5, "times to retry reaching the coordinator")
+		},
+		Run: runRecalcPPWorker,
+	})
+}
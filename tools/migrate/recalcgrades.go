@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// recalc grades works out every score's letter grade again from its hit
+// counts & mods, as osu! does (see calculateGrade), as the grades kept by
+// old databases are often wrong after imports, or after acc was recalculated.
+// only the scores whose grade changed are updated, and the players' grade
+// counts are rebuilt from their best scores afterwards.
+
+var select_grade_scores = `
+SELECT id, mode, mods, status, n300, n100, n50, nmiss, ngeki, nkatu, grade FROM scores
+WHERE id > ? %s ORDER BY id LIMIT ?`
+
+// gradeCounts are the totals of a grade recalculation.
+type gradeCounts struct {
+	Scores  int64
+	Changed int64
+
+	mu          sync.Mutex
+	transitions map[string]int64 // e.g. "A -> S"
+}
+
+// recalculateGrades regrades a page of scores, updating those which changed.
+func recalculateGrades(scores []Score, counts *gradeCounts) error {
+	changed := make(map[string][]int64)
+	var transitions []string
+	for i := range scores {
+		score := &scores[i]
+		grade := calculateGrade(score)
+		if grade == score.Grade {
+			continue
+		}
+		changed[grade] = append(changed[grade], score.ID)
+		transitions = append(transitions, score.Grade+" -> "+grade)
+	}
+
+	if !cfg.DryRun && len(changed) != 0 {
+		tx, err := DB.Beginx()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		for grade, ids := range changed {
+			query, args, err := sqlx.In("UPDATE scores SET grade = ? WHERE id IN (?)", grade, ids)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(query, args...); err != nil {
+				return err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	atomic.AddInt64(&counts.Scores, int64(len(scores)))
+	atomic.AddInt64(&counts.Changed, int64(len(transitions)))
+	counts.mu.Lock()
+	for _, t := range transitions {
+		counts.transitions[t]++
+	}
+	counts.mu.Unlock()
+	return nil
+}
+
+func runRecalcGrades() error {
+	start := time.Now()
+	logger.Info("recalculating grades", "dry_run", cfg.DryRun)
+
+	counts := &gradeCounts{transitions: map[string]int64{}}
+	failed, err := recalcScorePages(select_grade_scores, func(page []Score) error {
+		return recalculateGrades(page, counts)
+	})
+	if err != nil {
+		return err
+	}
+
+	var transitions []string
+	for t := range counts.transitions {
+		transitions = append(transitions, t)
+	}
+	sort.Slice(transitions, func(i, j int) bool {
+		if counts.transitions[transitions[i]] != counts.transitions[transitions[j]] {
+			return counts.transitions[transitions[i]] > counts.transitions[transitions[j]]
+		}
+		return transitions[i] < transitions[j]
+	})
+	for _, t := range transitions {
+		fmt.Printf("  %-8s %d\n", t, counts.transitions[t])
+	}
+
+	logger.Info("recalculated grades", "scores", counts.Scores, "changed", counts.Changed,
+		"failed_pages", failed, "dry_run", cfg.DryRun, "elapsed", time.Since(start).Round(time.Second))
+	if failed != 0 {
+		return errors.New("some scores' grades could not be recalculated")
+	}
+
+	// the players' grade counts are counted from their best scores
+	if !cfg.DryRun && counts.Changed != 0 {
+		if _, err := DB.Exec(update_stats_from_scores); err != nil {
+			return fmt.Errorf("failed to update the players' grade counts: %w", err)
+		}
+		logger.Info("updated the players' grade counts")
+	}
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "recalc grades",
+		Summary: "work out every score's grade again from its hit counts & mods, updating those which changed",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.IntVar(&c.RecalcMode, "mode", -1, "only recalculate this mode (0-3 vanilla, 4-6 relax, 8 autopilot)")
+			flags.StringVar(&c.RecalcUser, "user", "", "only recalculate this user's scores, by name or id")
+			flags.BoolVar(&c.DryRun, "dry-run", false, "report how many grades would change without changing them")
+			flags.IntVar(&c.Workers, "workers", 0, "number of concurrent workers (default: tuned to the database's max_connections)")
+		},
+		Run: runRecalcGrades,
+	})
+}
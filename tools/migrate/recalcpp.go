@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// recalc pp recalculates the pp of every submitted score. there's no pp
+// calculator for go, so each worker runs a calculator process, and sends it
+// scores one json line at a time. the default is pp_calculator.py, which
+// uses the same rosu-pp bindings as bancho.py; anything speaking the same
+// protocol (e.g. a small rust binary linking rosu-pp) can be used instead.
+
+// the highest pp which fits in the scores table, float(7,3)
+const maxScorePP = 9999.999
+
+// errCalculatorStopped means the calculator process exited, or stopped responding.
+var errCalculatorStopped = errors.New("pp calculator stopped")
+
+var select_pp_scores = `
+SELECT s.id, s.mode, s.mods, s.max_combo, s.n300, s.n100, s.n50,
+s.nmiss, s.ngeki, s.nkatu, s.pp, m.id AS map_id
+FROM scores s JOIN maps m ON m.md5 = s.map_md5
+WHERE s.id > ? AND s.status != 0 %s
+ORDER BY s.id LIMIT ?`
+
+type ppScore struct {
+	ID       int64
+	Mode     int
+	Mods     int
+	MaxCombo int `db:"max_combo"`
+	N300     int
+	N100     int
+	N50      int
+	Nmiss    int
+	Ngeki    int
+	Nkatu    int
+	PP       float64
+	MapID    int64 `db:"map_id"`
+}
+
+// ppRequest is a score sent to the calculator.
+type ppRequest struct {
+	Path  string `json:"path"`
+	Mode  int    `json:"mode"`
+	Mods  int    `json:"mods"`
+	Combo int    `json:"combo"`
+	N300  int    `json:"n300"`
+	N100  int    `json:"n100"`
+	N50   int    `json:"n50"`
+	Nmiss int    `json:"nmiss"`
+	Ngeki int    `json:"ngeki"`
+	Nkatu int    `json:"nkatu"`
+}
+
+type ppResponse struct {
+	PP    *float64 `json:"pp"`
+	Stars float64  `json:"stars"`
+	Error string   `json:"error"`
+}
+
+// ppResult is a score's pp, and the star rating of its beatmap with its mods.
+type ppResult struct {
+	PP    float64
+	Stars float64
+}
+
+// ppCalculator is a running calculator process.
+type ppCalculator struct {
+	cmd     *exec.Cmd
+	in      io.WriteCloser
+	encoder *json.Encoder
+	out     *bufio.Scanner
+}
+
+func startPPCalculator(command string) (*ppCalculator, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("no pp calculator was given")
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start pp calculator %q: %w", command, err)
+	}
+
+	return &ppCalculator{cmd: cmd, in: in, encoder: json.NewEncoder(in), out: bufio.NewScanner(out)}, nil
+}
+
+// calculate works out a score's pp. errors which aren't errCalculatorStopped
+// are only about this score, such as a beatmap which couldn't be parsed.
+func (c *ppCalculator) calculate(req ppRequest) (ppResult, error) {
+	if err := c.encoder.Encode(req); err != nil {
+		return ppResult{}, fmt.Errorf("%w: %s", errCalculatorStopped, err)
+	}
+	if !c.out.Scan() {
+		err := c.out.Err()
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return ppResult{}, fmt.Errorf("%w: %s", errCalculatorStopped, err)
+	}
+
+	var resp ppResponse
+	if err := json.Unmarshal(c.out.Bytes(), &resp); err != nil {
+		return ppResult{}, fmt.Errorf("%w: bad response %q", errCalculatorStopped, c.out.Text())
+	}
+	if resp.Error != "" {
+		return ppResult{}, errors.New(resp.Error)
+	}
+	if resp.PP == nil {
+		return ppResult{}, fmt.Errorf("%w: response without pp %q", errCalculatorStopped, c.out.Text())
+	}
+
+	result := ppResult{PP: *resp.PP, Stars: resp.Stars}
+	if math.IsNaN(result.PP) || math.IsInf(result.PP, 0) || result.PP < 0 {
+		result.PP = 0
+	}
+	if math.IsNaN(result.Stars) || math.IsInf(result.Stars, 0) || result.Stars < 0 {
+		result.Stars = 0
+	}
+	result.PP = math.Min(math.Round(result.PP*1000)/1000, maxScorePP)
+	return result, nil
+}
+
+func (c *ppCalculator) Close() error {
+	c.in.Close()
+	return c.cmd.Wait()
+}
+
+// ppCounts are the totals of a pp recalculation.
+type ppCounts struct {
+	Recalculated int64
+	Changed      int64
+	NoBeatmap    int64 // the map's .osu file isn't in .data/osu
+	Failed       int64
+}
+
+// recalculateBatchPP works out the pp of a batch of scores, and saves any
+// which changed. the calculator is restarted if it stops.
+func recalculateBatchPP(calc **ppCalculator, scores []ppScore, counts *ppCounts) error {
+	// keep each beatmap's scores together, for the calculator's cache
+	sort.Slice(scores, func(i, j int) bool { return scores[i].MapID < scores[j].MapID })
+
+	changed := make(map[int64]float64)
+	haveBeatmap := make(map[int64]bool)
+	for i, score := range scores {
+		path := filepath.Join(cfg.BeatmapDirectory(), fmt.Sprintf("%d.osu", score.MapID))
+		have, checked := haveBeatmap[score.MapID]
+		if !checked {
+			_, err := os.Stat(path)
+			have = err == nil
+			haveBeatmap[score.MapID] = have
+		}
+		if !have {
+			atomic.AddInt64(&counts.NoBeatmap, 1)
+			continue
+		}
+
+		if *calc == nil {
+			var err error
+			if *calc, err = startPPCalculator(cfg.PPCalculator); err != nil {
+				atomic.AddInt64(&counts.Failed, int64(len(scores)-i))
+				return err
+			}
+		}
+
+		result, err := (*calc).calculate(ppRequest{
+			Path: path, Mode: score.Mode % 4, Mods: score.Mods, Combo: score.MaxCombo,
+			N300: score.N300, N100: score.N100, N50: score.N50,
+			Nmiss: score.Nmiss, Ngeki: score.Ngeki, Nkatu: score.Nkatu,
+		})
+		if errors.Is(err, errCalculatorStopped) {
+			(*calc).Close()
+			*calc = nil
+			atomic.AddInt64(&counts.Failed, int64(len(scores)-i))
+			return err
+		} else if err != nil {
+			logger.Warn("failed to calculate pp", "score_id", score.ID, "map_id", score.MapID, "err", err)
+			atomic.AddInt64(&counts.Failed, 1)
+			continue
+		}
+
+		atomic.AddInt64(&counts.Recalculated, 1)
+		if math.Abs(result.PP-score.PP) >= 0.001 {
+			changed[score.ID] = result.PP
+		}
+	}
+
+	if err := updateScorePP(changed); err != nil {
+		atomic.AddInt64(&counts.Failed, int64(len(changed)))
+		return err
+	}
+	atomic.AddInt64(&counts.Changed, int64(len(changed)))
+	return nil
+}
+
+// updateScorePP saves scores' new pp with a single statement.
+func updateScorePP(pps map[int64]float64) error {
+	if len(pps) == 0 {
+		return nil
+	}
+	if err := throttle(len(pps)); err != nil {
+		return err
+	}
+
+	var query strings.Builder
+	args := make([]interface{}, 0, 3*len(pps))
+	query.WriteString("UPDATE scores SET pp = CASE id")
+	for id, pp := range pps {
+		query.WriteString(" WHEN ? THEN ?")
+		args = append(args, id, pp)
+	}
+	query.WriteString(" END WHERE id IN (?" + strings.Repeat(", ?", len(pps)-1) + ")")
+	for id := range pps {
+		args = append(args, id)
+	}
+
+	_, err := DB.Exec(query.String(), args...)
+	return err
+}
+
+// ppFilter picks the scores being recalculated, by --mode & --user; -1
+// and 0 are every mode & user.
+type ppFilter struct {
+	Mode   int   `json:"mode"`
+	UserID int64 `json:"userid"`
+}
+
+// loadPPFilter checks --mode & looks --user up.
+func loadPPFilter() (ppFilter, error) {
+	filter := ppFilter{Mode: cfg.RecalcMode}
+	if cfg.RecalcMode >= 0 && !statsModes[cfg.RecalcMode] {
+		return filter, fmt.Errorf("--mode %d is not one of bancho.py's modes", cfg.RecalcMode)
+	}
+	if cfg.RecalcUser != "" {
+		user, err := findUser(cfg.RecalcUser)
+		if err != nil {
+			return filter, err
+		}
+		filter.UserID = user
+	}
+	return filter, nil
+}
+
+// conditions returns the filter's conditions on the scores, and their args.
+func (f ppFilter) conditions() (string, []interface{}) {
+	var filters []string
+	var args []interface{}
+	if f.Mode >= 0 {
+		filters = append(filters, "AND s.mode = ?")
+		args = append(args, f.Mode)
+	}
+	if f.UserID != 0 {
+		filters = append(filters, "AND s.userid = ?")
+		args = append(args, f.UserID)
+	}
+	return strings.Join(filters, " "), args
+}
+
+func runRecalcPP() error {
+	filter, err := loadPPFilter()
+	if err != nil {
+		return err
+	}
+	conditions, filterArgs := filter.conditions()
+	query := fmt.Sprintf(select_pp_scores, conditions)
+
+	// make sure the calculator can be started before starting any workers
+	calc, err := startPPCalculator(cfg.PPCalculator)
+	if err != nil {
+		return err
+	}
+	calc.Close()
+
+	if err := tuneWorkers(); err != nil {
+		return err
+	}
+	// calculating pp is cpu bound, so more workers than cores won't help
+	if cfg.Workers == 0 && NumWorkers > runtime.NumCPU() {
+		NumWorkers = runtime.NumCPU()
+	}
+
+	start := time.Now()
+	counts := &ppCounts{}
+	batches := make(chan []ppScore, NumWorkers)
+
+	stopReporting := make(chan struct{})
+	defer close(stopReporting)
+	if cfg.ProgressInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(cfg.ProgressInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					logger.Info("recalculating pp", "recalculated", atomic.LoadInt64(&counts.Recalculated),
+						"changed", atomic.LoadInt64(&counts.Changed), "failed", atomic.LoadInt64(&counts.Failed))
+				case <-stopReporting:
+					return
+				}
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < NumWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var calc *ppCalculator
+			for batch := range batches {
+				if err := recalculateBatchPP(&calc, batch, counts); err != nil {
+					logger.Error("failed to recalculate pp", "first_id", batch[0].ID, "err", err)
+				}
+			}
+			if calc != nil {
+				calc.Close()
+			}
+		}()
+	}
+
+	var lastID int64
+	for {
+		var scores []ppScore
+		args := append([]interface{}{lastID}, filterArgs...)
+		if err = ReadDB.Select(&scores, query, append(args, BatchSize)...); err != nil || len(scores) == 0 {
+			break
+		}
+		lastID = scores[len(scores)-1].ID
+		batches <- scores
+	}
+
+	close(batches)
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+
+	logger.Info("recalculated pp", "recalculated", counts.Recalculated, "changed", counts.Changed,
+		"without_beatmap", counts.NoBeatmap, "failed", counts.Failed,
+		"elapsed", time.Since(start).Round(time.Second))
+	if counts.NoBeatmap != 0 {
+		logger.Warn("some scores were skipped, as their beatmaps aren't in .data/osu", "scores", counts.NoBeatmap)
+	}
+	if counts.Failed != 0 {
+		return errors.New("the pp of some scores could not be recalculated")
+	}
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:              "recalc pp",
+		Summary:           "recalculate the pp of every submitted score, with the beatmaps in .data/osu",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.PPCalculator, "calculator", "python3 pp_calculator.py", "command which calculates pp, see pp_calculator.py")
+			flags.IntVar(&c.RecalcMode, "mode", -1, "only recalculate this mode (0-3 vanilla, 4-6 relax, 8 autopilot)")
+			flags.StringVar(&c.RecalcUser, "user", "", "only recalculate this user's scores, by name or id")
+			flags.IntVar(&c.Workers, "workers", 0, "number of concurrent calculators (default: one per cpu core, within the database's free connections)")
+			flags.DurationVar(&c.ProgressInterval, "progress-interval", 10*time.Second, "how often to report progress (0 to disable)")
+		},
+		Run: runRecalcPP,
+	})
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// recalc status re-evaluates which score is each player's best on a map,
+// which depends on pp: for every (map, player, mode), the passed score with
+// the most pp becomes best (status 2), and the rest submitted (status 1).
+// as in bancho.py, the earlier score stays best when pp is tied.
+
+var select_status_scores = `
+SELECT id, map_md5, userid, mode, status FROM scores
+WHERE userid IN (?) AND status != 0 %s
+ORDER BY userid, mode, map_md5, pp DESC, id`
+
+// only the groups with a score played since --since are re-evaluated
+var since_status_filter = `
+AND (map_md5, userid, mode) IN (
+	SELECT map_md5, userid, mode FROM scores
+	WHERE userid IN (?) AND status != 0 AND play_time >= ?
+)`
+
+type statusScore struct {
+	ID     int64
+	MapMD5 string `db:"map_md5"`
+	UserID int64  `db:"userid"`
+	Mode   int
+	Status int
+}
+
+// statusCounts are the totals of a status recalculation.
+type statusCounts struct {
+	Scores   int64
+	Promoted int64 // submitted scores which became best
+	Demoted  int64 // best scores which became submitted
+	Failed   int64 // users whose scores couldn't be updated
+}
+
+// wallClock relabels a local time as utc. datetimes like play_time are
+// stored in the server's local time without a zone, and the driver reads
+// & writes them as utc, so times compared with them must be the same.
+func wallClock(t time.Time) time.Time {
+	t = t.Local()
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+// parseSince reads --since, either as a duration before now (e.g. 24h),
+// or as a date or time.
+func parseSince(since string) (time.Time, error) {
+	if d, err := time.ParseDuration(since); err == nil {
+		return wallClock(time.Now().Add(-d)), nil
+	}
+	for _, layout := range []string{"2006-01-02", "2006-01-02 15:04:05", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, since, time.Local); err == nil {
+			return wallClock(t), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("--since %q must be a duration (e.g. 24h) or a date (e.g. 2024-01-31)", since)
+}
+
+// recalculateStatuses re-evaluates the statuses of a chunk of users' scores.
+func recalculateStatuses(users []int64, since *time.Time, counts *statusCounts) error {
+	var filters []string
+	args := []interface{}{users}
+	if cfg.RecalcMode >= 0 {
+		filters = append(filters, "AND mode = ?")
+		args = append(args, cfg.RecalcMode)
+	}
+	if since != nil {
+		filters = append(filters, since_status_filter)
+		args = append(args, users, *since)
+	}
+
+	query, args, err := sqlx.In(fmt.Sprintf(select_status_scores, strings.Join(filters, " ")), args...)
+	if err != nil {
+		return err
+	}
+	var scores []statusScore
+	if err := DB.Select(&scores, query, args...); err != nil {
+		return err
+	}
+	atomic.AddInt64(&counts.Scores, int64(len(scores)))
+
+	// the first score of each group has the most pp
+	var promote, demote []int64
+	for i, score := range scores {
+		first := i == 0 || score.UserID != scores[i-1].UserID ||
+			score.Mode != scores[i-1].Mode || score.MapMD5 != scores[i-1].MapMD5
+		switch {
+		case first && score.Status != 2:
+			promote = append(promote, score.ID)
+		case !first && score.Status == 2:
+			demote = append(demote, score.ID)
+		}
+	}
+
+	if !cfg.DryRun && len(promote)+len(demote) != 0 {
+		if err := throttle(len(promote) + len(demote)); err != nil {
+			return err
+		}
+		tx, err := DB.Beginx()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		for _, update := range []struct {
+			status int
+			ids    []int64
+		}{{1, demote}, {2, promote}} {
+			if len(update.ids) == 0 {
+				continue
+			}
+			query, args, err := sqlx.In("UPDATE scores SET status = ? WHERE id IN (?)", update.status, update.ids)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(query, args...); err != nil {
+				return err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	atomic.AddInt64(&counts.Promoted, int64(len(promote)))
+	atomic.AddInt64(&counts.Demoted, int64(len(demote)))
+	return nil
+}
+
+func runRecalcStatus() error {
+	if cfg.RecalcMode >= 0 && !statsModes[cfg.RecalcMode] {
+		return fmt.Errorf("--mode %d is not one of bancho.py's modes", cfg.RecalcMode)
+	}
+
+	var since *time.Time
+	if cfg.RecalcSince != "" {
+		t, err := parseSince(cfg.RecalcSince)
+		if err != nil {
+			return err
+		}
+		since = &t
+	}
+
+	var users []int64
+	var err error
+	switch {
+	case cfg.RecalcUser != "":
+		var user int64
+		if user, err = findUser(cfg.RecalcUser); err != nil {
+			return err
+		}
+		users = []int64{user}
+	case since != nil:
+		err = DB.Select(&users, "SELECT DISTINCT userid FROM scores WHERE play_time >= ? ORDER BY userid", *since)
+	default:
+		err = DB.Select(&users, "SELECT id FROM users ORDER BY id")
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := tuneWorkers(); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	logger.Info("recalculating statuses", "users", len(users), "dry_run", cfg.DryRun)
+
+	counts := &statusCounts{}
+	chunks := make(chan []int64, NumWorkers)
+	var wg sync.WaitGroup
+	for i := 0; i < NumWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range chunks {
+				if err := recalculateStatuses(chunk, since, counts); err != nil {
+					logger.Error("failed to recalculate statuses", "first_user", chunk[0], "users", len(chunk), "err", err)
+					atomic.AddInt64(&counts.Failed, int64(len(chunk)))
+				}
+			}
+		}()
+	}
+
+	for len(users) != 0 {
+		n := recalcChunkSize
+		if n > len(users) {
+			n = len(users)
+		}
+		chunks <- users[:n]
+		users = users[n:]
+	}
+	close(chunks)
+	wg.Wait()
+
+	logger.Info("recalculated statuses", "scores", counts.Scores, "promoted", counts.Promoted,
+		"demoted", counts.Demoted, "failed_users", counts.Failed, "dry_run", cfg.DryRun,
+		"elapsed", time.Since(start).Round(time.Second))
+	if counts.Failed != 0 {
+		return errors.New("some users' statuses could not be recalculated")
+	}
+	if !cfg.DryRun && counts.Promoted+counts.Demoted != 0 {
+		logger.Info("best scores changed, users' stats can be updated with `migrate recalc stats`")
+	}
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "recalc status",
+		Summary: "re-evaluate which of each player's scores on a map is their best, by pp",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.IntVar(&c.RecalcMode, "mode", -1, "only recalculate this mode (0-3 vanilla, 4-6 relax, 8 autopilot)")
+			flags.StringVar(&c.RecalcUser, "user", "", "only recalculate this user's scores, by name or id")
+			flags.StringVar(&c.RecalcSince, "since", "", "only re-evaluate maps with scores played since this date, or duration ago (e.g. 24h)")
+			flags.BoolVar(&c.DryRun, "dry-run", false, "report how many scores would change without changing them")
+			flags.IntVar(&c.Workers, "workers", 0, "number of concurrent workers (default: tuned to the database's max_connections)")
+		},
+		Run: runRecalcStatus,
+	})
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// a minimal redis client, speaking just enough of RESP for the bulk writes
+// done here: commands are pipelined, and replies are read back in order.
+
+// RedisError is an error reply from redis.
+type RedisError string
+
+func (e RedisError) Error() string { return "redis: " + string(e) }
+
+type RedisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// dialRedis connects to redis with bancho.py's settings (REDIS_HOST etc).
+func dialRedis(c *Config) (*RedisConn, error) {
+	addr := net.JoinHostPort(c.RedisHost, c.RedisPort)
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to redis at %s: %w", addr, err)
+	}
+	rc := &RedisConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+
+	// like bancho.py, only authenticate when both are set
+	if c.RedisUser != "" && c.RedisPass != "" {
+		if _, err := rc.Do("AUTH", c.RedisUser, c.RedisPass); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.RedisDB != "" && c.RedisDB != "0" {
+		if _, err := rc.Do("SELECT", c.RedisDB); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// Send queues a command, without waiting for its reply.
+func (rc *RedisConn) Send(args ...string) {
+	fmt.Fprintf(rc.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(rc.w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+}
+
+// Flush sends the queued commands, and reads their n replies. the first
+// error reply is returned, after every reply has been read.
+func (rc *RedisConn) Flush(n int) ([]interface{}, error) {
+	if err := rc.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	replies := make([]interface{}, n)
+	var firstErr error
+	for i := range replies {
+		reply, err := rc.readReply()
+		var redisErr RedisError
+		if errors.As(err, &redisErr) {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, firstErr
+}
+
+// Do runs a single command, and returns its reply.
+func (rc *RedisConn) Do(args ...string) (interface{}, error) {
+	rc.Send(args...)
+	replies, err := rc.Flush(1)
+	if err != nil {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+func (rc *RedisConn) Close() error {
+	return rc.conn.Close()
+}
+
+// readReply reads a reply: strings are returned as string, integers as
+// int64, arrays as []interface{}, and nil replies as nil.
+func (rc *RedisConn) readReply() (interface{}, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, line := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, RedisError(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(rc.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(line)
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			if items[i], err = rc.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+	}
+}
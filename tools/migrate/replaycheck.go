@@ -0,0 +1,336 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// replays verify decodes every replay and cross-checks it against its score,
+// to catch corrupt, truncated or mismatched replays before (or after)
+// migrating. replays stored by bancho.py have no header, so only their
+// frames can be checked; full .osr files are also compared to the score.
+
+// maxReplayClockSkew is how far a replay's timestamp may be from its
+// score's play_time, which is only set once the score is submitted.
+const maxReplayClockSkew = 10 * time.Minute
+
+var select_replay_scores = `
+SELECT s.id, s.map_md5, s.score, s.mods, s.mode, s.play_time, COALESCE(u.name, '') AS name
+FROM %s s LEFT JOIN users u ON u.id = s.userid
+WHERE s.id > ? ORDER BY s.id LIMIT ?`
+
+type replayScore struct {
+	ID       int64
+	MapMD5   string `db:"map_md5"`
+	Score    int
+	Mods     int
+	Mode     int
+	PlayTime time.Time `db:"play_time"`
+	Name     string
+}
+
+// ReplayProblem is a replay which failed verification.
+type ReplayProblem struct {
+	Table    string `json:"table,omitempty"`
+	ScoreID  int64  `json:"score_id"`
+	Location string `json:"location"`
+	Problem  string `json:"problem"` // corrupt, truncated, mismatch or orphaned
+	Detail   string `json:"detail,omitempty"`
+}
+
+// ReplaysReport is the machine-readable result of the replays verify subcommand.
+// NOTE: Checked is updated atomically, and must stay 64-bit aligned.
+type ReplaysReport struct {
+	Checked    int64           `json:"checked"`
+	OK         bool            `json:"ok"`
+	Corrupt    int64           `json:"corrupt"`
+	Truncated  int64           `json:"truncated"`
+	Mismatched int64           `json:"mismatched"`
+	Orphaned   int64           `json:"orphaned"`
+	Problems   []ReplayProblem `json:"problems"`
+
+	mu sync.Mutex
+}
+
+func (r *ReplaysReport) add(problem *ReplayProblem) {
+	if problem == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch problem.Problem {
+	case "corrupt":
+		r.Corrupt++
+	case "truncated":
+		r.Truncated++
+	case "mismatch":
+		r.Mismatched++
+	case "orphaned":
+		r.Orphaned++
+	}
+	r.OK = false
+	r.Problems = append(r.Problems, *problem)
+
+	if len(r.Problems) <= maxExamples {
+		logger.Warn("bad replay", "location", problem.Location, "problem", problem.Problem, "detail", problem.Detail)
+	}
+}
+
+// checkReplay decodes a replay and compares its header (if any) to its score.
+func checkReplay(store ReplayStore, table string, score replayScore) *ReplayProblem {
+	key := replayKey(score.ID)
+	problem := func(kind string, err error) *ReplayProblem {
+		return &ReplayProblem{
+			Table:    table,
+			ScoreID:  score.ID,
+			Location: store.Location(key),
+			Problem:  kind,
+			Detail:   err.Error(),
+		}
+	}
+
+	in, err := store.Open(key)
+	if err != nil {
+		return problem("corrupt", err)
+	}
+	data, err := io.ReadAll(in)
+	in.Close()
+	if err != nil {
+		return problem("corrupt", err)
+	}
+
+	replay, err := parseReplay(data)
+	if errors.Is(err, errReplayTruncated) {
+		return problem("truncated", err)
+	} else if err != nil {
+		return problem("corrupt", err)
+	}
+
+	if _, err := replay.DecodeFrames(); errors.Is(err, errLZMATruncated) {
+		return problem("truncated", err)
+	} else if err != nil {
+		return problem("corrupt", err)
+	}
+
+	if !replay.HasHeader {
+		return nil
+	}
+
+	var mismatches []string
+	if replay.MapMD5 != score.MapMD5 {
+		mismatches = append(mismatches, fmt.Sprintf("map_md5 %s != %s", replay.MapMD5, score.MapMD5))
+	}
+	if score.Name != "" && replay.PlayerName != score.Name {
+		mismatches = append(mismatches, fmt.Sprintf("player %q != %q", replay.PlayerName, score.Name))
+	}
+	if replay.Score != score.Score {
+		mismatches = append(mismatches, fmt.Sprintf("score %d != %d", replay.Score, score.Score))
+	}
+	if replay.Mods != score.Mods {
+		mismatches = append(mismatches, fmt.Sprintf("mods %d != %d", replay.Mods, score.Mods))
+	}
+	if replay.Mode != score.Mode%4 {
+		mismatches = append(mismatches, fmt.Sprintf("mode %d != %d", replay.Mode, score.Mode%4))
+	}
+
+	// play_time is stored in the server's local time, without a zone
+	t := score.PlayTime
+	playTime := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.Local)
+	if skew := replay.Timestamp.Sub(playTime); skew > maxReplayClockSkew || skew < -maxReplayClockSkew {
+		mismatches = append(mismatches, fmt.Sprintf("timestamp %s != %s", replay.Timestamp.Format(time.RFC3339), playTime.Format(time.RFC3339)))
+	}
+
+	if len(mismatches) != 0 {
+		return problem("mismatch", errors.New(strings.Join(mismatches, ", ")))
+	}
+	return nil
+}
+
+// verifyTableReplays checks the replay of every score in a table which has
+// one, removing each checked key from keys.
+func verifyTableReplays(store ReplayStore, table string, keys map[string]bool, report *ReplaysReport) error {
+	scores := make(chan replayScore, BatchSize)
+	var wg sync.WaitGroup
+	for i := 0; i < NumWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for score := range scores {
+				report.add(checkReplay(store, table, score))
+				atomic.AddInt64(&report.Checked, 1)
+			}
+		}()
+	}
+
+	var lastID int64
+	var err error
+	for {
+		var rows []replayScore
+		err = ReadDB.Select(&rows, fmt.Sprintf(select_replay_scores, table), lastID, BatchSize)
+		if err != nil || len(rows) == 0 {
+			break
+		}
+
+		for _, row := range rows {
+			key := replayKey(row.ID)
+			if keys[key] {
+				delete(keys, key)
+				scores <- row
+			}
+		}
+		lastID = rows[len(rows)-1].ID
+	}
+
+	close(scores)
+	wg.Wait()
+	return err
+}
+
+// replayCheckGroup is a set of tables whose replays share a store.
+type replayCheckGroup struct {
+	store  ReplayStore
+	tables []string
+}
+
+// replayCheckGroups finds which tables exist, and where their replays are:
+// the old tables' replays before migrating, and the new table's after.
+func replayCheckGroups() ([]replayCheckGroup, error) {
+	var groups []replayCheckGroup
+
+	var oldTables []string
+	for _, table := range SourceTables {
+		exists, err := tableExists(table.Name)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			oldTables = append(oldTables, table.Name)
+		}
+	}
+	if len(oldTables) != 0 {
+		// part way through a migration, the old replays are staged
+		store := oldReplays
+		if _, err := os.Stat(stagingReplayDirectory()); !replaysStaged() || err != nil {
+			if store, err = preMigrationReplays(); err != nil {
+				return nil, err
+			}
+		}
+		groups = append(groups, replayCheckGroup{store, oldTables})
+	}
+
+	exists, err := tableExists("scores")
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		if len(groups) != 0 && groups[0].store.Location("") == newReplays.Location("") {
+			groups[0].tables = append(groups[0].tables, "scores")
+		} else {
+			groups = append(groups, replayCheckGroup{newReplays, []string{"scores"}})
+		}
+	}
+
+	// only check the requested table, if there was one
+	if cfg.ReplayTable != "" {
+		for _, group := range groups {
+			for _, table := range group.tables {
+				if table == cfg.ReplayTable {
+					return []replayCheckGroup{{group.store, []string{table}}}, nil
+				}
+			}
+		}
+		return nil, fmt.Errorf("table %s does not exist", cfg.ReplayTable)
+	}
+	return groups, nil
+}
+
+func runReplaysVerify() error {
+	if err := setupReplayStores(); err != nil {
+		return err
+	}
+
+	groups, err := replayCheckGroups()
+	if err != nil {
+		return err
+	}
+	if len(groups) == 0 {
+		return errors.New("there are no scores tables to check replays against")
+	}
+
+	report := &ReplaysReport{OK: true}
+	for _, group := range groups {
+		keys := make(map[string]bool)
+		err := group.store.List(func(key string) error {
+			keys[key] = true
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Found %d replays in %s\n", len(keys), group.store.Location(""))
+
+		for _, table := range group.tables {
+			fmt.Fprintf(os.Stderr, "Checking replays of %s...\n", table)
+			before := report.Checked
+			if err := verifyTableReplays(group.store, table, keys, report); err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "  checked %d replays\n", report.Checked-before)
+		}
+
+		// anything left over doesn't belong to any score
+		if cfg.ReplayTable != "" {
+			continue
+		}
+		orphans := make([]string, 0, len(keys))
+		for key := range keys {
+			orphans = append(orphans, key)
+		}
+		sort.Strings(orphans)
+		for _, key := range orphans {
+			id, _ := strconv.ParseInt(strings.TrimSuffix(key, ".osr"), 10, 64)
+			report.add(&ReplayProblem{
+				ScoreID:  id,
+				Location: group.store.Location(key),
+				Problem:  "orphaned",
+				Detail:   "no score has this id",
+			})
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "%d replays checked: %d corrupt, %d truncated, %d mismatched, %d orphaned\n",
+		report.Checked, report.Corrupt, report.Truncated, report.Mismatched, report.Orphaned)
+
+	if err := writeReport(cfg.ReportPath, report); err != nil {
+		return err
+	}
+	if !report.OK {
+		return errVerificationFailed
+	}
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:              "replays verify",
+		Summary:           "decode every replay, and check it against its score",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.ReplayTable, "table", "", "only check the replays of this table (default: every scores table)")
+			flags.StringVar(&c.ReportPath, "report", "", "write the list of bad replays as json to this path (- for stdout)")
+			replayStoreFlags(flags, c)
+		},
+		Run: runReplaysVerify,
+	})
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// replays are never renamed in place. instead, each one is copied to its
+// new key, the copy is read back and checked against the original's size
+// and hash, and only once the copy has been durably stored and recorded in
+// the journal is the original removed. a crash at any point leaves at
+// least one intact copy of every replay.
+
+// oldReplays holds the replays being migrated, keyed by their old score ids,
+// and newReplays is where they're moved to, keyed by their new score ids.
+var oldReplays, newReplays ReplayStore
+
+// keepReplayOriginals leaves the originals in place once they're copied,
+// for online migrations, where the old server still serves them.
+var keepReplayOriginals bool
+
+// JournalEntry records a single replay relocation.
+type JournalEntry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"` // "move", or "restore" when rolled back
+	Table  string    `json:"table"`
+	OldID  int64     `json:"old_id"`
+	NewID  int64     `json:"new_id"`
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Size   int64     `json:"size"`
+	SHA256 string    `json:"sha256"`
+}
+
+// ReplayJournal is an append-only log of replay relocations, one json
+// object per line, which makes every move auditable and reversible.
+type ReplayJournal struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+var replayJournal *ReplayJournal
+
+func openReplayJournal(path string) (*ReplayJournal, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open replay journal: %w", err)
+	}
+	return &ReplayJournal{f: f}, nil
+}
+
+// record appends entries to the journal, and syncs it to disk.
+func (j *ReplayJournal) record(entries []JournalEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	w := bufio.NewWriter(j.f)
+	encoder := json.NewEncoder(w)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+func (j *ReplayJournal) Close() error {
+	return j.f.Close()
+}
+
+// readReplayJournal calls fn for each entry in the journal at path, in order.
+func readReplayJournal(path string, fn func(JournalEntry) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// the last line may be torn if we crashed mid-write
+			return fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// copyReplay copies a replay between stores and verifies the copy by
+// reading it back, without removing the original.
+func copyReplay(src ReplayStore, srcKey string, dst ReplayStore, dstKey string) (int64, string, error) {
+	size, err := src.Stat(srcKey)
+	if err != nil {
+		return 0, "", err
+	}
+
+	in, err := src.Open(srcKey)
+	if err != nil {
+		return 0, "", err
+	}
+	data, err := io.ReadAll(in)
+	in.Close()
+	if err != nil {
+		return 0, "", err
+	}
+	if int64(len(data)) != size {
+		return 0, "", fmt.Errorf("read %d bytes of %s, expected %d", len(data), src.Location(srcKey), size)
+	}
+
+	sum := sha256.Sum256(data)
+	srcSum := hex.EncodeToString(sum[:])
+
+	if err := dst.Put(dstKey, bytes.NewReader(data), size); err != nil {
+		return 0, "", err
+	}
+
+	// read the copy back, to make sure what's stored is what we wrote
+	out, err := dst.Open(dstKey)
+	if err != nil {
+		return 0, "", err
+	}
+	h := sha256.New()
+	dstSize, err := io.Copy(h, out)
+	out.Close()
+	if err != nil {
+		return 0, "", err
+	}
+	if dstSize != size || hex.EncodeToString(h.Sum(nil)) != srcSum {
+		dst.Delete(dstKey)
+		return 0, "", fmt.Errorf("copy of %s failed verification (size %d/%d)", src.Location(srcKey), size, dstSize)
+	}
+	return size, srcSum, nil
+}
+
+// relocateReplays copies each replay to its new key, journals the moves,
+// and only then removes the originals. it returns the moves which completed.
+func relocateReplays(action, table string, moves []ReplayMove, src ReplayStore, srcKey func(ReplayMove) string, dst ReplayStore, dstKey func(ReplayMove) string) ([]ReplayMove, error) {
+	done := make([]ReplayMove, 0, len(moves))
+	entries := make([]JournalEntry, 0, len(moves))
+
+	for _, move := range moves {
+		size, sum, err := copyReplay(src, srcKey(move), dst, dstKey(move))
+		if err != nil {
+			logger.Warn("failed to copy replay", "table", table, "old_id", move.OldID,
+				"new_id", move.NewID, "action", action, "err", err)
+			metricReplayMoveFailures.Inc("copy")
+			continue
+		}
+
+		done = append(done, move)
+		entries = append(entries, JournalEntry{
+			Time: time.Now().UTC(), Action: action, Table: table,
+			OldID: move.OldID, NewID: move.NewID,
+			From: src.Location(srcKey(move)), To: dst.Location(dstKey(move)),
+			Size: size, SHA256: sum,
+		})
+	}
+
+	// the originals must not be removed until the journal is on disk
+	if err := replayJournal.record(entries); err != nil {
+		return nil, fmt.Errorf("failed to write replay journal: %w", err)
+	}
+
+	if keepReplayOriginals {
+		return done, nil
+	}
+	for _, move := range done {
+		if err := src.Delete(srcKey(move)); err != nil {
+			logger.Warn("failed to remove original replay", "location", src.Location(srcKey(move)), "err", err)
+		}
+	}
+	return done, nil
+}
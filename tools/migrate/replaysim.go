@@ -0,0 +1,486 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// anticheat replays compares the cursor movement of replays on the same map,
+// to find replays which were stolen (submitted again, maybe with a few
+// changes, by another player) and replays which look like they were made by
+// a bot. it only reads the database & replays, so it can be run from cron,
+// away from the game server.
+//
+// two replays are compared by how far apart their cursors are, on average,
+// while both are playing, and by how closely the times between their frames
+// correlate; osu! doesn't record frames at a steady rate, so two real plays
+// don't correlate, while a copy keeps its original's frame times. only
+// osu!standard (vanilla, relax & autopilot) has cursor movement to compare.
+
+// similarityStep is how often, in ms, the cursors are compared.
+const similarityStep = 10
+
+// minSimilarityOverlap is how long, in ms, two replays must both be playing
+// for their cursors to be compared.
+const minSimilarityOverlap = 5000
+
+// a replay with at least minBotFrames frames, at least botFrameRatio of them
+// after the same delay, was probably not recorded by osu!.
+const (
+	minBotFrames  = 100
+	botFrameRatio = 0.95
+)
+
+var select_similarity_maps = `
+SELECT DISTINCT map_md5 FROM scores
+WHERE userid = ? AND mode IN (0, 4, 8) AND status != 0`
+
+var select_similarity_top = `
+SELECT s.id, s.userid, u.name, s.map_md5, s.mode, s.mods, s.play_time
+FROM scores s JOIN users u ON u.id = s.userid
+WHERE s.map_md5 = ? AND s.mode IN (0, 4, 8) AND s.status = 2
+ORDER BY s.score DESC LIMIT ?`
+
+var select_similarity_user = `
+SELECT s.id, s.userid, u.name, s.map_md5, s.mode, s.mods, s.play_time
+FROM scores s JOIN users u ON u.id = s.userid
+WHERE s.map_md5 = ? AND s.userid = ? AND s.mode IN (0, 4, 8) AND s.status != 0`
+
+// SimilarReplay is a score whose replay was compared.
+type SimilarReplay struct {
+	ScoreID  int64     `json:"score_id" db:"id"`
+	UserID   int64     `json:"user_id" db:"userid"`
+	Name     string    `json:"name"`
+	MapMD5   string    `json:"-" db:"map_md5"`
+	Mode     int       `json:"mode"`
+	Mods     int       `json:"mods"`
+	PlayTime time.Time `json:"play_time" db:"play_time"`
+}
+
+// SimilarPair is two replays which are too alike; the copy was played after
+// the original.
+type SimilarPair struct {
+	MapMD5      string        `json:"map_md5"`
+	Original    SimilarReplay `json:"original"`
+	Copy        SimilarReplay `json:"copy"`
+	Distance    float64       `json:"distance"`    // mean distance between cursors, in osu!pixels
+	Correlation float64       `json:"correlation"` // of the times between frames
+	Reasons     []string      `json:"reasons"`
+}
+
+// SuspiciousReplay is a replay which looks like it was made by a bot.
+type SuspiciousReplay struct {
+	MapMD5 string        `json:"map_md5"`
+	Replay SimilarReplay `json:"replay"`
+	Reason string        `json:"reason"`
+}
+
+// SimilarityReport is the result of anticheat replays.
+type SimilarityReport struct {
+	Maps    int                 `json:"maps"`
+	Replays int                 `json:"replays"`
+	Missing int                 `json:"missing"` // scores without a (readable) replay
+	Pairs   []*SimilarPair      `json:"pairs"`
+	Bots    []*SuspiciousReplay `json:"bots"`
+	mu      sync.Mutex
+}
+
+// cursorFrame is a replay frame, at a time since the start of the map.
+type cursorFrame struct {
+	t    int64
+	x, y float64
+}
+
+// cursorPath is a replay's decoded frames.
+type cursorPath struct {
+	score  SimilarReplay
+	frames []cursorFrame
+	deltas []float64 // the time between each frame & the last
+}
+
+// decodeCursorPath decompresses a replay's frames, leaving out the frames
+// osu! adds which aren't the cursor's: two at the start, at (256, -500),
+// and the rng seed at the end.
+func decodeCursorPath(replay *Replay) ([]cursorFrame, []float64, error) {
+	data, err := decodeLZMA(replay.Frames)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var frames []cursorFrame
+	var deltas []float64
+	var t int64
+	for i, frame := range strings.Split(string(data), ",") {
+		parts := strings.Split(frame, "|")
+		if frame == "" || len(parts) != 4 {
+			continue
+		}
+		w, err1 := strconv.ParseInt(parts[0], 10, 64)
+		x, err2 := strconv.ParseFloat(parts[1], 64)
+		y, err3 := strconv.ParseFloat(parts[2], 64)
+		if err := errors.Join(err1, err2, err3); err != nil {
+			return nil, nil, fmt.Errorf("frame %d is malformed: %q", i, frame)
+		}
+		if w == -12345 {
+			continue
+		}
+		t += w
+		if x == 256 && y == -500 {
+			continue
+		}
+		frames = append(frames, cursorFrame{t, x, y})
+		deltas = append(deltas, float64(w))
+	}
+	if len(frames) == 0 {
+		return nil, nil, errors.New("replay has no frames")
+	}
+	return frames, deltas, nil
+}
+
+// cursorDistance is the mean distance between two replays' cursors while
+// both are playing, or false if they barely overlap. hard rock flips the
+// playfield vertically, so a replay played with it is flipped back to
+// compare it with one played without it.
+func cursorDistance(a, b *cursorPath) (float64, bool) {
+	start := max(a.frames[0].t, b.frames[0].t)
+	end := min(a.frames[len(a.frames)-1].t, b.frames[len(b.frames)-1].t)
+	if end-start < minSimilarityOverlap {
+		return 0, false
+	}
+	flip := a.score.Mods&modHardRock != b.score.Mods&modHardRock
+
+	var total float64
+	var n int
+	i, j := 0, 0
+	for t := start; t <= end; t += similarityStep {
+		for i+1 < len(a.frames) && a.frames[i+1].t <= t {
+			i++
+		}
+		for j+1 < len(b.frames) && b.frames[j+1].t <= t {
+			j++
+		}
+		by := b.frames[j].y
+		if flip {
+			by = 384 - by
+		}
+		total += math.Hypot(a.frames[i].x-b.frames[j].x, a.frames[i].y-by)
+		n++
+	}
+	return total / float64(n), true
+}
+
+// frameCorrelation is the pearson correlation of the times between two
+// replays' frames, or 0 if either's are constant.
+func frameCorrelation(a, b []float64) float64 {
+	n := min(len(a), len(b))
+	if n < 2 {
+		return 0
+	}
+	var meanA, meanB float64
+	for i := 0; i < n; i++ {
+		meanA += a[i]
+		meanB += b[i]
+	}
+	meanA /= float64(n)
+	meanB /= float64(n)
+
+	var cov, varA, varB float64
+	for i := 0; i < n; i++ {
+		cov += (a[i] - meanA) * (b[i] - meanB)
+		varA += (a[i] - meanA) * (a[i] - meanA)
+		varB += (b[i] - meanB) * (b[i] - meanB)
+	}
+	if varA == 0 || varB == 0 {
+		return 0
+	}
+	return cov / math.Sqrt(varA*varB)
+}
+
+// botFrameTimes reports why a replay's frame times look generated, if they do.
+func botFrameTimes(deltas []float64) string {
+	if len(deltas) < minBotFrames {
+		return ""
+	}
+	counts := make(map[float64]int)
+	most, delay := 0, 0.0
+	for _, d := range deltas {
+		counts[d]++
+		if counts[d] > most {
+			most, delay = counts[d], d
+		}
+	}
+	if ratio := float64(most) / float64(len(deltas)); ratio >= botFrameRatio {
+		return fmt.Sprintf("%.1f%% of frames are %gms apart", ratio*100, delay)
+	}
+	return ""
+}
+
+// loadCursorPath reads & decodes a score's replay, or returns nil if it has none.
+func loadCursorPath(score SimilarReplay) (*cursorPath, error) {
+	in, err := newReplays.Open(replayKey(score.ScoreID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(in)
+	in.Close()
+	if err != nil {
+		return nil, err
+	}
+	replay, err := parseReplay(data)
+	if err != nil {
+		return nil, err
+	}
+	frames, deltas, err := decodeCursorPath(replay)
+	if err != nil {
+		return nil, err
+	}
+	return &cursorPath{score: score, frames: frames, deltas: deltas}, nil
+}
+
+// compareMap compares the replays of a map's top scores with each other,
+// or, with a user, the user's replays with the top scores'.
+func compareMap(md5 string, user int64, report *SimilarityReport) error {
+	var scores []SimilarReplay
+	if err := DB.Select(&scores, select_similarity_top, md5, cfg.SimilarityTop); err != nil {
+		return err
+	}
+	if user != 0 {
+		var own []SimilarReplay
+		if err := DB.Select(&own, select_similarity_user, md5, user); err != nil {
+			return err
+		}
+		seen := make(map[int64]bool)
+		for _, s := range scores {
+			seen[s.ScoreID] = true
+		}
+		for _, s := range own {
+			if !seen[s.ScoreID] {
+				scores = append(scores, s)
+			}
+		}
+	}
+
+	var paths []*cursorPath
+	missing := 0
+	for _, score := range scores {
+		path, err := loadCursorPath(score)
+		if err != nil {
+			logger.Warn("unreadable replay", "score", score.ScoreID, "err", err)
+		}
+		if path == nil {
+			missing++
+			continue
+		}
+		paths = append(paths, path)
+	}
+
+	var pairs []*SimilarPair
+	var bots []*SuspiciousReplay
+	for _, p := range paths {
+		if user != 0 && p.score.UserID != user {
+			continue
+		}
+		if reason := botFrameTimes(p.deltas); reason != "" {
+			bots = append(bots, &SuspiciousReplay{MapMD5: md5, Replay: p.score, Reason: reason})
+		}
+	}
+	for i, a := range paths {
+		for _, b := range paths[i+1:] {
+			// a player may well play the same way twice
+			if a.score.UserID == b.score.UserID {
+				continue
+			}
+			if user != 0 && a.score.UserID != user && b.score.UserID != user {
+				continue
+			}
+
+			distance, ok := cursorDistance(a, b)
+			if !ok {
+				continue
+			}
+			correlation := frameCorrelation(a.deltas, b.deltas)
+
+			var reasons []string
+			if distance <= cfg.SimilarityDistance {
+				reasons = append(reasons, fmt.Sprintf("cursors are %.1f osu!pixels apart on average", distance))
+			}
+			if correlation >= cfg.SimilarityCorrelation {
+				reasons = append(reasons, fmt.Sprintf("frame times correlate by %.3f", correlation))
+			}
+			if len(reasons) == 0 {
+				continue
+			}
+
+			original, copied := a.score, b.score
+			if copied.PlayTime.Before(original.PlayTime) {
+				original, copied = copied, original
+			}
+			pairs = append(pairs, &SimilarPair{
+				MapMD5:      md5,
+				Original:    original,
+				Copy:        copied,
+				Distance:    distance,
+				Correlation: correlation,
+				Reasons:     reasons,
+			})
+		}
+	}
+
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	report.Maps++
+	report.Replays += len(paths)
+	report.Missing += missing
+	report.Pairs = append(report.Pairs, pairs...)
+	report.Bots = append(report.Bots, bots...)
+	return nil
+}
+
+// similarityMaps finds the maps to compare: --map, or every map --user has passed.
+func similarityMaps() ([]string, int64, error) {
+	var user int64
+	if cfg.SimilarityUser != "" {
+		var err error
+		if user, err = findUser(cfg.SimilarityUser); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if cfg.SimilarityMap != "" {
+		// a map's md5, or its id
+		md5 := cfg.SimilarityMap
+		if len(md5) != 32 {
+			if _, err := strconv.ParseInt(md5, 10, 64); err != nil {
+				return nil, 0, fmt.Errorf("--map %q must be a beatmap id or md5", cfg.SimilarityMap)
+			}
+			if err := DB.Get(&md5, "SELECT md5 FROM maps WHERE id = ? LIMIT 1", cfg.SimilarityMap); err != nil {
+				return nil, 0, fmt.Errorf("beatmap %s: %w", cfg.SimilarityMap, err)
+			}
+		}
+		return []string{md5}, user, nil
+	}
+	if user == 0 {
+		return nil, 0, errors.New("--map or --user is needed, to select which replays to compare")
+	}
+
+	var maps []string
+	err := DB.Select(&maps, select_similarity_maps, user)
+	return maps, user, err
+}
+
+func runAnticheatReplays() error {
+	if cfg.ReportFormat != "json" && cfg.ReportFormat != "csv" {
+		return fmt.Errorf("unknown --format %q, expected json or csv", cfg.ReportFormat)
+	}
+	if err := setupReplayStores(); err != nil {
+		return err
+	}
+	maps, user, err := similarityMaps()
+	if err != nil {
+		return err
+	}
+
+	report := &SimilarityReport{Pairs: []*SimilarPair{}, Bots: []*SuspiciousReplay{}}
+	work := make(chan string, NumWorkers)
+	var firstErr error
+	var once sync.Once
+	var wg sync.WaitGroup
+	for i := 0; i < NumWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for md5 := range work {
+				if err := compareMap(md5, user, report); err != nil {
+					once.Do(func() { firstErr = fmt.Errorf("map %s: %w", md5, err) })
+				}
+			}
+		}()
+	}
+	for i, md5 := range maps {
+		work <- md5
+		if (i+1)%100 == 0 {
+			logger.Info("comparing replays", "maps", i+1, "of", len(maps))
+		}
+	}
+	close(work)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+
+	sort.Slice(report.Pairs, func(i, j int) bool {
+		return report.Pairs[i].Distance < report.Pairs[j].Distance
+	})
+	sort.Slice(report.Bots, func(i, j int) bool {
+		return report.Bots[i].Replay.ScoreID < report.Bots[j].Replay.ScoreID
+	})
+
+	fmt.Printf("compared %d replays on %d maps (%d without replays): %d similar pairs, %d likely bots\n",
+		report.Replays, report.Maps, report.Missing, len(report.Pairs), len(report.Bots))
+	for i, pair := range report.Pairs {
+		if i == 25 {
+			fmt.Printf("  ... and %d more, see --report\n", len(report.Pairs)-i)
+			break
+		}
+		fmt.Printf("  %s (%d) may be a copy of %s (%d): %s\n", pair.Copy.Name, pair.Copy.ScoreID,
+			pair.Original.Name, pair.Original.ScoreID, strings.Join(pair.Reasons, ", "))
+	}
+	for i, bot := range report.Bots {
+		if i == 25 {
+			fmt.Printf("  ... and %d more, see --report\n", len(report.Bots)-i)
+			break
+		}
+		fmt.Printf("  %s (%d) may be a bot: %s\n", bot.Replay.Name, bot.Replay.ScoreID, bot.Reason)
+	}
+
+	if cfg.ReportPath == "" {
+		return nil
+	}
+	if cfg.ReportFormat == "json" {
+		return writeReport(cfg.ReportPath, report)
+	}
+	var rows [][]string
+	for _, pair := range report.Pairs {
+		rows = append(rows, []string{"similar", pair.MapMD5,
+			strconv.FormatInt(pair.Copy.ScoreID, 10), pair.Copy.Name,
+			strconv.FormatInt(pair.Original.ScoreID, 10), pair.Original.Name,
+			strconv.FormatFloat(pair.Distance, 'f', 2, 64), strconv.FormatFloat(pair.Correlation, 'f', 3, 64),
+			strings.Join(pair.Reasons, "; ")})
+	}
+	for _, bot := range report.Bots {
+		rows = append(rows, []string{"bot", bot.MapMD5,
+			strconv.FormatInt(bot.Replay.ScoreID, 10), bot.Replay.Name, "", "", "", "", bot.Reason})
+	}
+	return writeCSVReport(cfg.ReportPath, []string{"kind", "map_md5", "score_id", "name",
+		"original_score_id", "original_name", "distance", "correlation", "reasons"}, rows)
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:              "anticheat replays",
+		Summary:           "compare replays on the same maps, to find stolen & bot replays",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.SimilarityMap, "map", "", "id or md5 of the beatmap whose replays are compared")
+			flags.StringVar(&c.SimilarityUser, "user", "", "name or id of the user whose replays are compared, on every map they've passed")
+			flags.IntVar(&c.SimilarityTop, "top", 50, "compare against the top n best scores of each map")
+			flags.Float64Var(&c.SimilarityDistance, "max-distance", 20, "flag replays whose cursors are this close on average, in osu!pixels")
+			flags.Float64Var(&c.SimilarityCorrelation, "min-correlation", 0.95, "flag replays whose frame times correlate at least this much")
+			flags.StringVar(&c.ReportPath, "report", "", "write the report to this path (- for stdout)")
+			flags.StringVar(&c.ReportFormat, "format", "json", "the report's format: json or csv")
+			flags.StringVar(&c.NewReplays, "replays", "", "where bancho.py's replays are, a path or s3://bucket/prefix (default: DATA_DIRECTORY/osr)")
+		},
+		Run: runAnticheatReplays,
+	})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// the recalculation & verification commands read every score, which is a
+// lot of load to put on the primary while the server's up. with --read-dsn,
+// their bulk SELECTs go to a replica instead, while their writes still go
+// to the primary (DB_HOST etc, or --write-dsn). reads which decide what's
+// written next, such as recalc status' best scores, stay on the primary, as
+// a replica can be behind.
+//
+// the writes themselves are what a replica has to keep up with, so with a
+// replica, commands which write as they scan pause whenever it's more than
+// --max-replica-lag behind, until it's caught up, see throttle.go.
+
+// ReadDB is where bulk reads go: the replica, or DB when there's none.
+var ReadDB *sqlx.DB
+
+// the replica's lag is checked at most this often
+const replicaLagCheckInterval = time.Second
+
+var metricReplicaLag = newGauge("migrate_replica_lag_seconds",
+	"How far the replica given by --read-dsn is behind the primary.")
+
+var replicaLag struct {
+	sync.Mutex
+	checked  time.Time
+	disabled bool // the read dsn isn't a replica, or its lag can't be read
+}
+
+// normalizeDSN checks a go-sql-driver/mysql dsn, and makes it parse times,
+// as DB_HOST etc's connection does.
+func normalizeDSN(name, dsn string) (string, error) {
+	dsnConfig, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "", fmt.Errorf("--%s isn't a dsn, e.g. user:pass@tcp(10.0.0.2:3306)/banchopy: %w", name, err)
+	}
+	dsnConfig.ParseTime = true
+	return dsnConfig.FormatDSN(), nil
+}
+
+// connectReplica connects ReadDB to --read-dsn, if given.
+func connectReplica() error {
+	ReadDB = DB
+	if cfg.ReadDSN == "" {
+		return nil
+	}
+	dsn, err := normalizeDSN("read-dsn", cfg.ReadDSN)
+	if err != nil {
+		return err
+	}
+	if ReadDB, err = sqlx.Connect("mysql", dsn); err != nil {
+		return fmt.Errorf("failed to connect to the replica: %w", err)
+	}
+	return nil
+}
+
+// readReplicaLag reads how far the replica is behind, or -1 if replication
+// isn't running, and false if it isn't a replica.
+func readReplicaLag() (int64, bool, error) {
+	rows, err := ReadDB.Queryx("SHOW REPLICA STATUS")
+	if err != nil {
+		// before mysql 8.0.22 & mariadb 10.5.1
+		if rows, err = ReadDB.Queryx("SHOW SLAVE STATUS"); err != nil {
+			return 0, false, err
+		}
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return 0, false, rows.Err()
+	}
+	status := map[string]interface{}{}
+	if err := rows.MapScan(status); err != nil {
+		return 0, false, err
+	}
+	for _, column := range []string{"Seconds_Behind_Source", "Seconds_Behind_Master"} {
+		value, ok := status[column]
+		if !ok {
+			continue
+		}
+		var lag sql.NullInt64
+		if b, isBytes := value.([]byte); isBytes {
+			value = string(b)
+		}
+		if err := lag.Scan(value); err != nil {
+			return 0, false, fmt.Errorf("bad %s %v", column, value)
+		}
+		if !lag.Valid {
+			return -1, true, nil
+		}
+		return lag.Int64, true, nil
+	}
+	return 0, false, fmt.Errorf("the replica's status has no Seconds_Behind_Source")
+}
+
+// waitForReplica pauses while the replica is too far behind, before a
+// command writes more. without a replica, it returns straight away.
+func waitForReplica() error {
+	if ReadDB == nil || ReadDB == DB {
+		return nil
+	}
+	replicaLag.Lock()
+	defer replicaLag.Unlock()
+	if replicaLag.disabled || time.Since(replicaLag.checked) < replicaLagCheckInterval {
+		return nil
+	}
+
+	paused := time.Time{}
+	for {
+		lag, isReplica, err := readReplicaLag()
+		replicaLag.checked = time.Now()
+		if err != nil || !isReplica {
+			if err == nil {
+				err = fmt.Errorf("it isn't replicating from anything")
+			}
+			logger.Warn("can't tell how far --read-dsn is behind, so writes won't wait for it", "err", err)
+			replicaLag.disabled = true
+			return nil
+		}
+		metricReplicaLag.Set(float64(lag))
+
+		if lag >= 0 && time.Duration(lag)*time.Second <= cfg.MaxReplicaLag {
+			if !paused.IsZero() {
+				logger.Info("the replica caught up, carrying on", "paused", time.Since(paused).Round(time.Second))
+			}
+			return nil
+		}
+		if paused.IsZero() {
+			paused = time.Now()
+			if lag < 0 {
+				logger.Warn("replication isn't running on the replica, pausing until it is")
+			} else {
+				logger.Warn("the replica is too far behind, pausing writes", "lag", strconv.FormatInt(lag, 10)+"s",
+					"max", cfg.MaxReplicaLag)
+			}
+		}
+
+		metricThrottledSeconds.Add(replicaLagCheckInterval.Seconds(), "replica_lag")
+		select {
+		case <-time.After(replicaLagCheckInterval):
+		case <-interrupted:
+			return errInterrupted
+		}
+	}
+}
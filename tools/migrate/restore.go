@@ -0,0 +1,332 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// backup restore restores the backups taken by backup: the newest full
+// backup before --until, and each increment after it up to --until, in
+// order, so the database & data directory are as they were then. every
+// file is checked against its manifest's checksum before anything is
+// restored.
+//
+// the database's tables are replaced by the backup's, and the data
+// directory's files are overwritten by the backup's, though files which
+// weren't backed up are left alone.
+
+// file finds the backup's file with the given part, e.g. .sql.
+func (m BackupManifest) file(part string) (BackupFile, bool) {
+	for _, f := range m.Files {
+		if strings.HasPrefix(f.Name, m.Name+part+".") {
+			return f, true
+		}
+	}
+	return BackupFile{}, false
+}
+
+// parseUntil reads --until, a time in UTC as a date, or a date & time.
+func parseUntil(s string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.UTC); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("--until %q must be a time, e.g. 2024-01-31 or 2024-01-31 18:00", s)
+}
+
+// verifyBackupFile checks a backup file's size & checksum. files at remote
+// destinations are downloaded to be checked, and again to be restored, so
+// that the local disk needn't have room for them.
+func verifyBackupFile(dest BackupDestination, file BackupFile) error {
+	f, err := dest.Open(file.Name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if n != file.Size || hex.EncodeToString(h.Sum(nil)) != file.SHA256 {
+		return fmt.Errorf("%s doesn't match its manifest, it's corrupt or incomplete", file.Name)
+	}
+	return nil
+}
+
+// openBackupFile reads a backup file, decrypting & decompressing it.
+func openBackupFile(dest BackupDestination, file BackupFile, key []byte) (io.Reader, func(), error) {
+	f, err := dest.Open(file.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+	var r io.Reader = bufio.NewReaderSize(f, 256*1024)
+	if strings.HasSuffix(file.Name, ".enc") {
+		if key == nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("%s is encrypted, so --encryption-key is needed", file.Name)
+		}
+		if r, err = newDecryptReader(r, key); err != nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("%s: %w", file.Name, err)
+		}
+	}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("%s: %w", file.Name, err)
+	}
+	return gz, func() { gz.Close(); f.Close() }, nil
+}
+
+// restoreSQL runs each statement of a dump. statements end with ";" at the
+// end of a line, which values never contain, as their newlines are escaped.
+func restoreSQL(ctx context.Context, r io.Reader) (int, error) {
+	conn, err := DB.Connx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	br := bufio.NewReaderSize(r, 1024*1024)
+	var statement bytes.Buffer
+	statements := 0
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) != 0 {
+			if statement.Len() == 0 && bytes.HasPrefix(line, []byte("--")) {
+				continue
+			}
+			statement.Write(line)
+		}
+		trimmed := bytes.TrimSpace(statement.Bytes())
+		if bytes.HasSuffix(trimmed, []byte(";")) || (err == io.EOF && len(trimmed) != 0) {
+			if _, err := conn.ExecContext(ctx, string(trimmed)); err != nil {
+				return statements, fmt.Errorf("statement %d failed: %w", statements+1, err)
+			}
+			statements++
+			statement.Reset()
+			if statements%100 == 0 && isInterrupted() {
+				return statements, errInterrupted
+			}
+		}
+		if err == io.EOF {
+			return statements, nil
+		} else if err != nil {
+			return statements, err
+		}
+	}
+}
+
+// restoreDataDirectory extracts a tarball into the data directory.
+func restoreDataDirectory(r io.Reader) (int, error) {
+	tr := tar.NewReader(r)
+	files := 0
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		} else if err != nil {
+			return files, err
+		}
+		if isInterrupted() {
+			return files, errInterrupted
+		}
+		if !filepath.IsLocal(header.Name) {
+			return files, fmt.Errorf("the tarball has a file outside the data directory, %q", header.Name)
+		}
+		path := filepath.Join(cfg.DataDirectory, header.Name)
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return files, err
+			}
+		case tar.TypeLink:
+			// a hardlink made by replays compact, which is linked again
+			// (or copied, if the data directory can't have links)
+			if !filepath.IsLocal(header.Linkname) {
+				return files, fmt.Errorf("the tarball has a link outside the data directory, %q", header.Linkname)
+			}
+			target := filepath.Join(cfg.DataDirectory, header.Linkname)
+			os.Remove(path)
+			if err := os.Link(target, path); err != nil {
+				data, err := os.ReadFile(target)
+				if err != nil {
+					return files, err
+				}
+				if err := os.WriteFile(path, data, 0644); err != nil {
+					return files, err
+				}
+			}
+			files++
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return files, err
+			}
+			// written beside the file, so a link to it isn't overwritten too
+			f, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode).Perm())
+			if err != nil {
+				return files, err
+			}
+			_, err = io.Copy(f, tr)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err == nil {
+				err = os.Rename(path+".tmp", path)
+			}
+			if err != nil {
+				os.Remove(path + ".tmp")
+				return files, err
+			}
+			os.Chtimes(path, header.ModTime, header.ModTime)
+			files++
+		}
+	}
+}
+
+// restoreBackup restores one backup of a chain.
+func restoreBackup(ctx context.Context, dest BackupDestination, b BackupManifest, key []byte) error {
+	start := time.Now()
+	sqlFile, ok := b.file(".sql")
+	if !ok {
+		return fmt.Errorf("%s has no sql dump", b.Name)
+	}
+	r, done, err := openBackupFile(dest, sqlFile, key)
+	if err != nil {
+		return err
+	}
+	statements, err := restoreSQL(ctx, r)
+	done()
+	if err != nil {
+		return fmt.Errorf("failed to restore %s: %w", sqlFile.Name, err)
+	}
+
+	files := 0
+	if dataFile, ok := b.file(".data.tar"); ok && cfg.RestoreData {
+		r, done, err := openBackupFile(dest, dataFile, key)
+		if err != nil {
+			return err
+		}
+		files, err = restoreDataDirectory(r)
+		done()
+		if err != nil {
+			return fmt.Errorf("failed to restore %s: %w", dataFile.Name, err)
+		}
+	}
+	logger.Info("restored backup", "name", b.Name, "type", b.Type, "statements", statements, "files", files,
+		"elapsed", time.Since(start).Round(time.Second))
+	return nil
+}
+
+func runBackupRestore() error {
+	var key []byte
+	if cfg.BackupKeyPath != "" {
+		var err error
+		if key, err = loadEncryptionKey(cfg.BackupKeyPath); err != nil {
+			return err
+		}
+	}
+	dest, err := openBackupDestination(cfg.BackupDirectory)
+	if err != nil {
+		return err
+	}
+	backups, err := listBackups(dest)
+	if err != nil {
+		return err
+	}
+	if len(backups) == 0 {
+		return fmt.Errorf("there are no backups at %s", cfg.BackupDirectory)
+	}
+
+	// the newest backup before --until, or the newest of all
+	target := backups[len(backups)-1]
+	if cfg.RestoreUntil != "" {
+		until, err := parseUntil(cfg.RestoreUntil)
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, b := range backups {
+			if !b.StartedAt.After(until) {
+				target, found = b, true
+			}
+		}
+		if !found {
+			return fmt.Errorf("there are no backups from before %s, the oldest is from %s",
+				until.Format(time.RFC3339), backups[0].StartedAt.Format(time.RFC3339))
+		}
+	}
+	chain, err := backupChain(backups, target.Name)
+	if err != nil {
+		return err
+	}
+
+	for _, b := range chain {
+		for _, f := range b.Files {
+			if err := verifyBackupFile(dest, f); err != nil {
+				return err
+			}
+		}
+		if b.Encrypted && key == nil {
+			return fmt.Errorf("%s is encrypted, so --encryption-key is needed", b.Name)
+		}
+	}
+
+	fmt.Printf("This restores the database %s to how it was at %s, from:\n", cfg.DBName, target.StartedAt.Format(time.RFC3339))
+	for _, b := range chain {
+		fmt.Printf("  %s (%s, %s)\n", b.Name, b.Type, b.StartedAt.Format(time.RFC3339))
+	}
+	fmt.Printf("The database's tables are replaced")
+	if cfg.RestoreData {
+		fmt.Printf(", and the backed up files in %s overwritten", cfg.DataDirectory)
+	}
+	fmt.Println(".")
+	if !confirm("Continue?") {
+		fmt.Println("Not restoring")
+		return nil
+	}
+
+	handleSignals()
+	ctx := context.Background()
+	for _, b := range chain {
+		if err := restoreBackup(ctx, dest, b, key); err != nil {
+			if errors.Is(err, errInterrupted) || errors.Is(err, errBackupKey) {
+				return err
+			}
+			return fmt.Errorf("%w, so the database is partly restored, and should be restored again", err)
+		}
+	}
+	logger.Info("restored", "until", target.StartedAt.Format(time.RFC3339), "backups", len(chain))
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:              "backup restore",
+		Summary:           "restore a full backup & its increments, to a point in time",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.BackupDirectory, "dir", "backups", "where the backups are kept: a directory, s3://bucket/prefix, b2://bucket/prefix or sftp://user@host/path")
+			flags.StringVar(&c.RestoreUntil, "until", "", "restore the newest backup from before this time in UTC, e.g. \"2024-01-31 18:00\" (default: the newest backup)")
+			flags.StringVar(&c.BackupKeyPath, "encryption-key", "", "the key file the backups were encrypted with")
+			flags.BoolVar(&c.RestoreData, "data", true, "restore the data directory's files as well as the database")
+		},
+		Run: runBackupRestore,
+	})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// mysql errors after which a batch is worth retrying, by their reason for
+// the retry metrics. these abort (or never start) the transaction through
+// no fault of the rows in it, so the same batch can simply be tried again.
+var retryableMySQLErrors = map[uint16]string{
+	1040: "too_many_connections",
+	1205: "lock_wait_timeout",
+	1213: "deadlock",
+	1637: "too_many_transactions",
+}
+
+// retryReason classifies an error from inserting a batch. anything else,
+// such as a row which doesn't fit the new table, fails the same way
+// every time & is fatal.
+func retryReason(err error) (string, bool) {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		reason, ok := retryableMySQLErrors[mysqlErr.Number]
+		return reason, ok
+	}
+	if errors.Is(err, mysql.ErrInvalidConn) || errors.Is(err, driver.ErrBadConn) {
+		return "connection", true
+	}
+	return "", false
+}
+
+// retryDelay is how long to wait before retrying a batch for the nth
+// time: exponential backoff, with jitter so that workers which deadlocked
+// against each other don't collide again.
+func retryDelay(attempt int) time.Duration {
+	const base, max = 250 * time.Millisecond, 30 * time.Second
+
+	delay := max
+	if attempt < 16 {
+		if d := base << attempt; d < max {
+			delay = d
+		}
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
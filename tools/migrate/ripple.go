@@ -0,0 +1,749 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// import ripple copies users, stats, beatmaps & scores from a ripple (or
+// akatsuki) database on the same mysql server into a fresh bancho.py
+// database, created from migrations/base.sql. the ripple database is only
+// ever read from. scores go through the same pipeline as migrations, so
+// an interrupted import can be continued with --resume.
+
+// rippleBotID is fokabot, ripple's equivalent of banchobot.
+const rippleBotID = 999
+
+// ripple's privilege bits, from ripple's common/privileges.
+const (
+	rippleUserPublic              = 1 << 0
+	rippleUserNormal              = 1 << 1
+	rippleUserDonor               = 1 << 2
+	rippleAdminManageUsers        = 1 << 4
+	rippleAdminBanUsers           = 1 << 5
+	rippleAdminSilenceUsers       = 1 << 6
+	rippleAdminWipeUsers          = 1 << 7
+	rippleAdminManageBeatmaps     = 1 << 8
+	rippleAdminManageServers      = 1 << 9
+	rippleAdminManageSettings     = 1 << 10
+	rippleAdminManagePrivileges   = 1 << 16
+	rippleAdminChatMod            = 1 << 18
+	rippleAdminKickUsers          = 1 << 19
+	rippleUserPendingVerification = 1 << 20
+	rippleUserTournamentStaff     = 1 << 21
+)
+
+// bancho.py's privilege bits, from app/constants/privileges.py.
+const (
+	privUnrestricted   = 1 << 0
+	privVerified       = 1 << 1
+	privWhitelisted    = 1 << 2
+	privSupporter      = 1 << 4
+	privPremium        = 1 << 5
+	privAlumni         = 1 << 7
+	privTourneyManager = 1 << 10
+	privNominator      = 1 << 11
+	privModerator      = 1 << 12
+	privAdministrator  = 1 << 13
+	privDeveloper      = 1 << 14
+)
+
+// ripplePrivileges maps ripple's privileges onto bancho.py's. ripple bans
+// by removing UserNormal & restricts by removing UserPublic, whereas
+// bancho.py only has the unrestricted bit for both.
+func ripplePrivileges(ripple int) int {
+	priv := 0
+	if ripple&rippleUserPublic != 0 && ripple&rippleUserNormal != 0 {
+		priv |= privUnrestricted
+	}
+	if ripple&rippleUserPendingVerification == 0 {
+		priv |= privVerified
+	}
+	if ripple&rippleUserDonor != 0 {
+		priv |= privSupporter
+	}
+	if ripple&rippleUserTournamentStaff != 0 {
+		priv |= privTourneyManager
+	}
+	if ripple&rippleAdminManageBeatmaps != 0 {
+		priv |= privNominator
+	}
+	if ripple&(rippleAdminSilenceUsers|rippleAdminKickUsers|rippleAdminChatMod) != 0 {
+		priv |= privModerator
+	}
+	if ripple&(rippleAdminManageUsers|rippleAdminBanUsers|rippleAdminWipeUsers) != 0 {
+		priv |= privAdministrator
+	}
+	if ripple&(rippleAdminManageServers|rippleAdminManageSettings|rippleAdminManagePrivileges) != 0 {
+		priv |= privDeveloper
+	}
+	return priv
+}
+
+// the per-mode column suffixes of ripple's users_stats, and which
+// bancho.py mode each of users_stats, rx_stats & ap_stats maps to.
+var rippleModeSuffixes = []string{"std", "taiko", "ctb", "mania"}
+
+// rippleModeTable is one of the tables ripple keeps a mode's stats or scores
+// in. schema is the database it's in, if not the ripple database itself.
+type rippleModeTable struct {
+	schema     string
+	table      string
+	modeOffset int
+	replays    string // of scores tables, the directory under lets' .data
+}
+
+var rippleStatsTables = []rippleModeTable{
+	{table: "users_stats", modeOffset: 0},
+	{table: "rx_stats", modeOffset: 4},
+	{table: "ap_stats", modeOffset: 8},
+}
+
+// every mode bancho.py keeps stats for
+var statsModes = map[int]bool{0: true, 1: true, 2: true, 3: true, 4: true, 5: true, 6: true, 8: true}
+
+// ripple's scores tables & the directories their replays are kept in,
+// relative to lets' .data directory.
+var rippleScoresTables = []rippleModeTable{
+	{table: "scores", modeOffset: 0, replays: "replays"},
+	{table: "scores_relax", modeOffset: 4, replays: "replays_relax"},
+	{table: "scores_ap", modeOffset: 8, replays: "replays_ap"},
+}
+
+// ripple stores neither the grade nor an online checksum, and
+// marks personal bests with completed = 3, and passes with 2.
+var select_ripple_scores = `
+SELECT id, beatmap_md5 AS map_md5, score, pp, accuracy AS acc, max_combo, mods,
+` + "`300_count` AS n300, `100_count` AS n100, `50_count` AS n50, misses_count AS nmiss," + `
+gekis_count AS ngeki, katus_count AS nkatu, '' AS grade,
+CASE completed WHEN 3 THEN 2 WHEN 2 THEN 1 ELSE 0 END AS status,
+play_mode AS mode, CAST(time AS UNSIGNED) AS play_time, 0 AS time_elapsed,
+0 AS client_flags, userid, full_combo AS perfect, NULL AS online_checksum FROM %s
+WHERE id > ? ORDER BY id LIMIT ?`
+
+var insert_ripple_user = `
+INSERT INTO users (id, name, safe_name, email, priv, pw_bcrypt, country,
+	silence_end, donor_end, creation_time, latest_activity, preferred_mode,
+	play_style, custom_badge_name, custom_badge_icon, userpage_content)
+VALUES (:id, :name, :safe_name, :email, :priv, :pw_bcrypt, :country,
+	:silence_end, :donor_end, :creation_time, :latest_activity, :preferred_mode,
+	:play_style, :custom_badge_name, :custom_badge_icon, :userpage_content)`
+
+var insert_ripple_map = `
+INSERT INTO maps (server, id, set_id, status, md5, artist, title, version,
+	creator, filename, last_update, total_length, max_combo, frozen, plays,
+	passes, mode, bpm, cs, ar, od, hp, diff)
+VALUES ('osu!', :id, :set_id, :status, :md5, :artist, :title, :version,
+	'', :filename, FROM_UNIXTIME(:last_update), :total_length, :max_combo,
+	:frozen, :plays, :passes, :mode, :bpm, 0, :ar, :od, 0, :diff)`
+
+// grade counts & max combos aren't kept by ripple, so they're
+// worked out from the imported scores instead.
+var update_stats_from_scores = `
+UPDATE stats st JOIN (
+	SELECT userid, mode, MAX(max_combo) AS max_combo,
+	SUM(grade = 'XH') AS xh, SUM(grade = 'X') AS x, SUM(grade = 'SH') AS sh,
+	SUM(grade = 'S') AS s, SUM(grade = 'A') AS a
+	FROM scores WHERE status = 2 GROUP BY userid, mode
+) g ON g.userid = st.id AND g.mode = st.mode
+SET st.max_combo = g.max_combo, st.xh_count = g.xh, st.x_count = g.x,
+	st.sh_count = g.sh, st.s_count = g.s, st.a_count = g.a`
+
+var validSchemaName = regexp.MustCompile(`^[A-Za-z0-9_$]+$`)
+
+// rippleTable returns the qualified name of a table in the ripple database.
+func rippleTable(name string) string {
+	return cfg.RippleDB + "." + name
+}
+
+// qualified returns the qualified name of the table.
+func (t rippleModeTable) qualified() string {
+	if t.schema == "" {
+		return rippleTable(t.table)
+	}
+	return t.schema + "." + t.table
+}
+
+func (t rippleModeTable) exists() (bool, error) {
+	if t.schema == "" {
+		return rippleTableExists(t.table)
+	}
+	return schemaTableExists(t.schema, t.table)
+}
+
+func rippleTableExists(name string) (bool, error) {
+	return schemaTableExists(cfg.RippleDB, name)
+}
+
+// schemaTableExists reports whether a table exists in another database on
+// the same server.
+func schemaTableExists(schema, name string) (bool, error) {
+	var count int
+	err := DB.Get(&count, `
+	SELECT COUNT(*) FROM information_schema.tables
+	WHERE table_schema = ? AND table_name = ?`, schema, name)
+	return count != 0, err
+}
+
+// rippleColumns returns the columns of a ripple table, as forks of ripple
+// add & drop columns freely, and only some of them are needed.
+func rippleColumns(table string) (map[string]bool, error) {
+	return schemaColumns(cfg.RippleDB, table)
+}
+
+// schemaColumns returns the columns of a table in another database on the
+// same server.
+func schemaColumns(schema, table string) (map[string]bool, error) {
+	var names []string
+	err := DB.Select(&names, `
+	SELECT column_name FROM information_schema.columns
+	WHERE table_schema = ? AND table_name = ?`, schema, table)
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make(map[string]bool, len(names))
+	for _, name := range names {
+		columns[strings.ToLower(name)] = true
+	}
+	return columns, nil
+}
+
+// optionalColumn selects a column if it exists, or the fallback if it doesn't.
+func optionalColumn(columns map[string]bool, prefix, column, fallback string) string {
+	if columns[column] {
+		return fmt.Sprintf("COALESCE(%s%s, %s) AS %s", prefix, column, fallback, column)
+	}
+	return fmt.Sprintf("%s AS %s", fallback, column)
+}
+
+type rippleUser struct {
+	ID              int64
+	Name            string
+	SafeName        string `db:"safe_name"`
+	Email           string
+	Privileges      int
+	Password        string `db:"password_md5"`
+	Country         string
+	SilenceEnd      int64  `db:"silence_end"`
+	DonorExpire     int64  `db:"donor_expire"`
+	CreationTime    int64  `db:"register_datetime"`
+	LatestActivity  int64  `db:"latest_activity"`
+	FavouriteMode   int    `db:"favourite_mode"`
+	PlayStyle       int    `db:"play_style"`
+	CustomBadgeName string `db:"custom_badge_name"`
+	CustomBadgeIcon string `db:"custom_badge_icon"`
+	UserpageContent string `db:"userpage_content"`
+}
+
+// existingIDs returns every id in a table of the bancho.py database.
+func existingIDs(table, column string) (map[string]bool, error) {
+	var ids []string
+	if err := DB.Select(&ids, fmt.Sprintf("SELECT %s FROM %s", column, table)); err != nil {
+		return nil, err
+	}
+
+	existing := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		existing[id] = true
+	}
+	return existing, nil
+}
+
+// importRippleUsers copies every user which hasn't been imported yet, with
+// their privileges mapped onto bancho.py's.
+func importRippleUsers(privileges func(int) int) error {
+	columns, err := rippleColumns("users_stats")
+	if err != nil {
+		return err
+	}
+	userColumns, err := rippleColumns("users")
+	if err != nil {
+		return err
+	}
+
+	// akatsuki has since moved the country onto users
+	country := "s.country"
+	if userColumns["country"] {
+		country = "u.country"
+	}
+
+	query := fmt.Sprintf(`
+	SELECT u.id, u.username AS name, u.username_safe AS safe_name, u.email,
+	u.privileges, u.password_md5, LOWER(COALESCE(%s, 'xx')) AS country,
+	u.silence_end, u.donor_expire, u.register_datetime, u.latest_activity,
+	%s, %s, %s, %s, %s
+	FROM %s u LEFT JOIN %s s ON s.id = u.id
+	WHERE u.id > ? ORDER BY u.id LIMIT ?`,
+		country,
+		optionalColumn(columns, "s.", "favourite_mode", "0"),
+		optionalColumn(columns, "s.", "play_style", "0"),
+		optionalColumn(columns, "s.", "custom_badge_name", "''"),
+		optionalColumn(columns, "s.", "custom_badge_icon", "''"),
+		optionalColumn(columns, "s.", "userpage_content", "''"),
+		rippleTable("users"), rippleTable("users_stats"))
+
+	existing, err := existingIDs("users", "id")
+	if err != nil {
+		return err
+	}
+
+	var lastID int64
+	imported, skipped, resetPasswords := 0, 0, 0
+	for {
+		var users []rippleUser
+		if err := DB.Select(&users, query, lastID, BatchSize); err != nil {
+			return err
+		}
+		if len(users) == 0 {
+			break
+		}
+		lastID = users[len(users)-1].ID
+
+		if err := throttle(len(users)); err != nil {
+			return err
+		}
+		tx := DB.MustBegin()
+		for _, u := range users {
+			if u.ID == rippleBotID || existing[fmt.Sprint(u.ID)] {
+				skipped++
+				continue
+			}
+
+			// ripple's current passwords are bcrypt(md5(password)), the same
+			// as bancho.py's. older ones can't be converted, and must be reset.
+			password := u.Password
+			if !strings.HasPrefix(password, "$2") || len(password) != 60 {
+				password = strings.Repeat("_", 60)
+				resetPasswords++
+			}
+
+			_, err := tx.NamedExec(insert_ripple_user, map[string]interface{}{
+				"id":                u.ID,
+				"name":              u.Name,
+				"safe_name":         strings.ReplaceAll(strings.ToLower(u.SafeName), " ", "_"),
+				"email":             u.Email,
+				"priv":              privileges(u.Privileges),
+				"pw_bcrypt":         password,
+				"country":           u.Country,
+				"silence_end":       u.SilenceEnd,
+				"donor_end":         u.DonorExpire,
+				"creation_time":     u.CreationTime,
+				"latest_activity":   u.LatestActivity,
+				"preferred_mode":    u.FavouriteMode,
+				"play_style":        u.PlayStyle,
+				"custom_badge_name": nullIfEmpty(u.CustomBadgeName),
+				"custom_badge_icon": nullIfEmpty(u.CustomBadgeIcon),
+				"userpage_content":  nullIfEmpty(u.UserpageContent),
+			})
+			if err != nil {
+				logger.Error("failed to import user", "id", u.ID, "name", u.Name, "err", err)
+				continue
+			}
+			imported++
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	logger.Info("imported users", "imported", imported, "skipped", skipped)
+	if resetPasswords != 0 {
+		logger.Warn("some users have old-style passwords which can't be imported, and will need to be reset", "count", resetPasswords)
+	}
+	return nil
+}
+
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// importRippleStats copies the per-mode stats of every imported user.
+// modes without stats in ripple (e.g. relax, on plain ripple) start at zero.
+func importRippleStats(tables []rippleModeTable) error {
+	for _, table := range tables {
+		exists, err := table.exists()
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+
+		schema := table.schema
+		if schema == "" {
+			schema = cfg.RippleDB
+		}
+		columns, err := schemaColumns(schema, table.table)
+		if err != nil {
+			return err
+		}
+
+		for mode, suffix := range rippleModeSuffixes {
+			if !statsModes[mode+table.modeOffset] {
+				continue // e.g. relax mania, which bancho.py doesn't have
+			}
+
+			col := func(name string) string {
+				if !columns[name+"_"+suffix] {
+					return "0"
+				}
+				return fmt.Sprintf("COALESCE(s.%s_%s, 0)", name, suffix)
+			}
+
+			_, err := copyRows(fmt.Sprintf(`
+			INSERT IGNORE INTO stats (id, mode, tscore, rscore, pp, plays, playtime, acc, total_hits, replay_views)
+			SELECT u.id, %d, %s, %s, %s, %s, %s, %s, %s, %s
+			FROM %s s JOIN users u ON u.id = s.id`,
+				mode+table.modeOffset, col("total_score"), col("ranked_score"), col("pp"),
+				col("playcount"), col("playtime"), col("avg_accuracy"), col("total_hits"),
+				col("replays_watched"), table.qualified()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := fillStatsModes(); err != nil {
+		return err
+	}
+
+	logger.Info("imported stats")
+	return nil
+}
+
+// fillStatsModes gives every user a row for every mode, as in bancho.py.
+func fillStatsModes() error {
+	for mode := range statsModes {
+		_, err := copyRows(`INSERT IGNORE INTO stats (id, mode) SELECT id, ? FROM users`, mode)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type rippleMap struct {
+	RowID      int64 `db:"id"`
+	ID         int64 `db:"beatmap_id"`
+	SetID      int64 `db:"beatmapset_id"`
+	MD5        string
+	SongName   string `db:"song_name"`
+	Filename   string `db:"file_name"`
+	AR         float32
+	OD         float32
+	Mode       int
+	MaxCombo   int `db:"max_combo"`
+	HitLength  int `db:"hit_length"`
+	BPM        float32
+	Ranked     int
+	LatestDate int64 `db:"latest_update"`
+	Frozen     bool  `db:"ranked_status_freezed"`
+	Playcount  int
+	Passcount  int
+	Difficulty float32
+}
+
+// ripple keeps "artist - title [version]" as a single song name.
+var rippleSongName = regexp.MustCompile(`^(.*) - (.*) \[(.*)\]$`)
+
+// importRippleMaps copies the cached beatmaps. ripple's ranked statuses
+// are the same as bancho.py's, so they (and frozen maps) carry over as-is.
+func importRippleMaps() error {
+	columns, err := rippleColumns("beatmaps")
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf(`
+	SELECT id, beatmap_id, beatmapset_id, beatmap_md5 AS md5, song_name, %s,
+	ar, od, mode, max_combo, hit_length, bpm, ranked, %s, %s, %s, %s,
+	CASE mode WHEN 0 THEN %s WHEN 1 THEN %s WHEN 2 THEN %s ELSE %s END AS difficulty
+	FROM %s WHERE id > ? ORDER BY id LIMIT ?`,
+		optionalColumn(columns, "", "file_name", "''"),
+		optionalColumn(columns, "", "latest_update", "0"),
+		optionalColumn(columns, "", "ranked_status_freezed", "0"),
+		optionalColumn(columns, "", "playcount", "0"),
+		optionalColumn(columns, "", "passcount", "0"),
+		difficultyColumn(columns, "std"), difficultyColumn(columns, "taiko"),
+		difficultyColumn(columns, "ctb"), difficultyColumn(columns, "mania"),
+		rippleTable("beatmaps"))
+
+	existing, err := existingIDs("maps", "md5")
+	if err != nil {
+		return err
+	}
+
+	var lastID int64
+	imported := 0
+	for {
+		var maps []rippleMap
+		if err := DB.Select(&maps, query, lastID, BatchSize); err != nil {
+			return err
+		}
+		if len(maps) == 0 {
+			break
+		}
+		lastID = maps[len(maps)-1].RowID
+
+		if err := throttle(len(maps)); err != nil {
+			return err
+		}
+		tx := DB.MustBegin()
+		for _, m := range maps {
+			if existing[m.MD5] {
+				continue
+			}
+			existing[m.MD5] = true
+
+			artist, title, version := "", m.SongName, ""
+			if parts := rippleSongName.FindStringSubmatch(m.SongName); parts != nil {
+				artist, title, version = parts[1], parts[2], parts[3]
+			}
+
+			_, err := tx.NamedExec(insert_ripple_map, map[string]interface{}{
+				"id":           m.ID,
+				"set_id":       m.SetID,
+				"status":       m.Ranked,
+				"md5":          m.MD5,
+				"artist":       artist,
+				"title":        title,
+				"version":      version,
+				"filename":     m.Filename,
+				"last_update":  m.LatestDate,
+				"total_length": m.HitLength,
+				"max_combo":    m.MaxCombo,
+				"frozen":       m.Frozen,
+				"plays":        m.Playcount,
+				"passes":       m.Passcount,
+				"mode":         m.Mode,
+				"bpm":          m.BPM,
+				"ar":           m.AR,
+				"od":           m.OD,
+				"diff":         m.Difficulty,
+			})
+			if err != nil {
+				logger.Error("failed to import beatmap", "id", m.ID, "md5", m.MD5, "err", err)
+				continue
+			}
+			imported++
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	// bancho.py expects every map's set to be known
+	_, err = copyRows(`
+	INSERT IGNORE INTO mapsets (server, id, last_osuapi_check)
+	SELECT DISTINCT 'osu!', set_id, NOW() FROM maps`)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("imported beatmaps", "imported", imported)
+	return nil
+}
+
+func difficultyColumn(columns map[string]bool, suffix string) string {
+	if columns["difficulty_"+suffix] {
+		return "difficulty_" + suffix
+	}
+	return "0"
+}
+
+// rippleSourceTables returns the ripple scores tables which exist, set up
+// to be read by the score pipeline. replayDir returns where each table's
+// replays are kept.
+func rippleSourceTables(scoresTables []rippleModeTable, replayDir func(rippleModeTable) string) ([]SourceTable, error) {
+	var tables []SourceTable
+	for _, t := range scoresTables {
+		exists, err := t.exists()
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+
+		replays, err := openReplayStore(replayDir(t))
+		if err != nil {
+			return nil, err
+		}
+
+		tables = append(tables, SourceTable{
+			Name:       t.qualified(),
+			ModeOffset: t.modeOffset,
+			Select:     select_ripple_scores,
+			Prepare:    func(score *Score) { score.Grade = calculateGrade(score) },
+			Replays:    replays,
+			ReplayName: func(id int64) string { return fmt.Sprintf("replay_%d.osr", id) },
+		})
+	}
+	return tables, nil
+}
+
+// rippleFork is what differs between importing ripple & its forks, see
+// akatsuki.go for one.
+type rippleFork struct {
+	name        string
+	privileges  func(int) int
+	scores      []rippleModeTable
+	replayDir   func(rippleModeTable) string // where a scores table's replays are
+	importStats func() error
+	afterUsers  func() error // imports anything else of the users', if set
+	afterScores func() error // imports anything else which needs the scores & maps, if set
+}
+
+func runImportRipple() error {
+	if !validSchemaName.MatchString(cfg.RippleDB) {
+		return errors.New("--ripple-db must be the name of the ripple database")
+	}
+	if cfg.RippleReplays == "" {
+		return errors.New("--ripple-replays must be the path to lets' .data directory")
+	}
+
+	return importRippleFork(rippleFork{
+		name:       "ripple",
+		privileges: ripplePrivileges,
+		scores:     rippleScoresTables,
+		replayDir: func(t rippleModeTable) string {
+			return strings.TrimRight(cfg.RippleReplays, "/") + "/" + t.replays
+		},
+		importStats: func() error { return importRippleStats(rippleStatsTables) },
+	})
+}
+
+// importRippleFork imports a ripple database, or one of a fork of ripple.
+func importRippleFork(fork rippleFork) error {
+	// the bancho.py database must already have its tables (from base.sql)
+	for _, table := range []string{"users", "stats", "maps", "mapsets", "scores"} {
+		exists, err := tableExists(table)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("the %s table does not exist, create the bancho.py database from migrations/base.sql first", table)
+		}
+	}
+	if exists, err := rippleTableExists("users"); err != nil {
+		return err
+	} else if !exists {
+		return fmt.Errorf("%s does not look like a %s database", cfg.RippleDB, fork.name)
+	}
+
+	if !cfg.Resume {
+		var scores int
+		if err := DB.Get(&scores, "SELECT COUNT(*) FROM scores"); err != nil {
+			return err
+		}
+		if scores != 0 {
+			return fmt.Errorf("the bancho.py database already has scores, %s can only be imported into a fresh database", fork.name)
+		}
+	}
+
+	if err := setupReplayStores(); err != nil {
+		return err
+	}
+	tables, err := rippleSourceTables(fork.scores, fork.replayDir)
+	if err != nil {
+		return err
+	}
+
+	// ctrl-c stops the migration gracefully, see signal.go
+	handleSignals()
+
+	if err := tuneWorkers(); err != nil {
+		return err
+	}
+	if err := tuneBatching(); err != nil {
+		return err
+	}
+	progress = newProgress(tables, NumWorkers)
+	replayJournal, err = openReplayJournal(cfg.ReplayJournalPath)
+	if err != nil {
+		return err
+	}
+	defer replayJournal.Close()
+
+	// rows which can't be migrated are kept here, instead of being lost
+	deadLetters = newDeadLetterFile(cfg.DeadLetterPath)
+	defer deadLetters.Close()
+
+	// users & beatmaps which were already imported are skipped,
+	// so these are safe to run again when resuming
+	start := time.Now()
+	if err := importRippleUsers(fork.privileges); err != nil {
+		return fmt.Errorf("failed to import users: %w", err)
+	}
+	if fork.afterUsers != nil {
+		if err := fork.afterUsers(); err != nil {
+			return err
+		}
+	}
+	if err := importRippleMaps(); err != nil {
+		return fmt.Errorf("failed to import beatmaps: %w", err)
+	}
+
+	if cfg.Resume {
+		if err := resumePendingReplays(tables); err != nil {
+			return err
+		}
+	} else if err := createCheckpointTables(); err != nil {
+		return err
+	}
+
+	if err := migrateScores(tables, cfg.Resume); err != nil {
+		return err
+	}
+
+	if err := fork.importStats(); err != nil {
+		return fmt.Errorf("failed to import stats: %w", err)
+	}
+	if _, err := DB.Exec(update_stats_from_scores); err != nil {
+		return fmt.Errorf("failed to update stats from scores: %w", err)
+	}
+	if fork.afterScores != nil {
+		if err := fork.afterScores(); err != nil {
+			return err
+		}
+	}
+
+	progress.summary()
+	if err := dropCheckpointTables(); err != nil {
+		return err
+	}
+
+	logger.Info("import finished", "from", fork.name, "elapsed", time.Since(start).Round(time.Second))
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:              "import ripple",
+		Summary:           "import a ripple database into a fresh bancho.py database",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.RippleDB, "ripple-db", "", "name of the ripple database, on the same server as bancho.py's")
+			flags.StringVar(&c.RippleReplays, "ripple-replays", "", "lets' .data directory (with replays, replays_relax & replays_ap), a path or s3://bucket/prefix")
+			flags.BoolVar(&c.Resume, "resume", false, "continue an interrupted import")
+			flags.IntVar(&c.Workers, "workers", 0, "number of concurrent workers (default: tuned to the database's max_connections)")
+			flags.IntVar(&c.MaxRetries, "max-retries", 5, "times to retry a batch after a deadlock, lock wait timeout or lost connection")
+			batchingFlags(flags, c)
+			filterFlags(flags, c)
+			flags.StringVar(&c.DeadLetterPath, "dead-letter", "", "file to write rows which failed to migrate to (default: DATA_DIRECTORY/migrate_dead_letters.jsonl)")
+			flags.StringVar(&c.ReplayJournalPath, "replay-journal", "", "journal of replay moves (default: DATA_DIRECTORY/migrate_replays.journal)")
+			flags.DurationVar(&c.ProgressInterval, "progress-interval", 10*time.Second, "how often to report progress (0 to disable)")
+			flags.StringVar(&c.ProgressFormat, "progress-format", "auto", "progress output format: tui for a dashboard, text, or log to report through the (structured) logger (default: tui on a terminal, otherwise text)")
+			flags.StringVar(&c.NewReplays, "new-replays", "", "where imported replays are written, a path or s3://bucket/prefix (default: DATA_DIRECTORY/osr)")
+		},
+		Run: runImportRipple,
+	})
+}
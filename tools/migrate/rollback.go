@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// tableExists reports whether a table exists in the configured database.
+func tableExists(name string) (bool, error) {
+	var count int
+	err := DB.Get(&count, `
+	SELECT COUNT(*) FROM information_schema.tables
+	WHERE table_schema = DATABASE() AND table_name = ?`, name)
+	return count != 0, err
+}
+
+// restoreReplay moves a single migrated replay back to its old id.
+func restoreReplay(table string, move ReplayMove) error {
+	if _, err := newReplays.Stat(newReplayKey(move)); err != nil {
+		// never moved, or the move was interrupted before it happened
+		return nil
+	}
+
+	done, err := relocateReplays("restore", table, []ReplayMove{move},
+		newReplays, newReplayKey, oldReplays, oldReplayKey)
+	if err != nil {
+		return err
+	}
+	if len(done) == 0 {
+		return fmt.Errorf("failed to restore replay %d -> %d", move.NewID, move.OldID)
+	}
+	return nil
+}
+
+// restoreJournaledReplays moves every replay recorded in the journal file back
+// to where it came from, newest first, returning how many were restored.
+func restoreJournaledReplays(path string) (int, error) {
+	type journaledMove struct {
+		table string
+		move  ReplayMove
+	}
+	var moves []journaledMove
+	restored := make(map[journaledMove]bool)
+
+	err := readReplayJournal(path, func(entry JournalEntry) error {
+		m := journaledMove{entry.Table, ReplayMove{OldID: entry.OldID, NewID: entry.NewID}}
+		switch entry.Action {
+		case "move":
+			moves = append(moves, m)
+		case "restore":
+			restored[m] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for i := len(moves) - 1; i >= 0; i-- {
+		m := moves[i]
+		if restored[m] {
+			continue
+		}
+		if err := restoreReplay(m.table, m.move); err != nil {
+			return count, err
+		}
+		restored[m] = true
+		count++
+	}
+	return count, nil
+}
+
+// restoreReplays moves every migrated replay back to its old id, returning
+// how many were restored. the journal file is used when available,
+// otherwise the id map in the database is.
+func restoreReplays(tables []SourceTable, haveJournal bool) (int, error) {
+	if haveJournal {
+		return restoreJournaledReplays(cfg.ReplayJournalPath)
+	}
+
+	restored := 0
+
+	for _, table := range tables {
+		var lastID int64
+		for {
+			var moves []ReplayMove
+			err := DB.Select(&moves, `
+			SELECT old_id, new_id FROM migration_score_ids
+			WHERE source_table = ? AND old_id > ? AND has_replay = 1
+			ORDER BY old_id LIMIT ?`, table.Name, lastID, BatchSize)
+			if err != nil {
+				return restored, err
+			}
+			if len(moves) == 0 {
+				break
+			}
+
+			for _, move := range moves {
+				if err := restoreReplay(table.Name, move); err != nil {
+					return restored, err
+				}
+				restored++
+			}
+
+			lastID = moves[len(moves)-1].OldID
+		}
+	}
+
+	return restored, nil
+}
+
+// checkUnmigratedScores refuses to roll back when scores has scores the
+// migration didn't create, e.g. ones submitted since, which are only in the
+// new table, so dropping it would lose them.
+func checkUnmigratedScores() error {
+	exists, err := tableExists("scores")
+	if err != nil || !exists {
+		return err
+	}
+	var unmigrated struct {
+		Count   int64 `db:"count"`
+		Example int64 `db:"example"`
+	}
+	err = DB.Get(&unmigrated, `
+	SELECT COUNT(*) AS count, COALESCE(MIN(id), 0) AS example FROM scores
+	WHERE id NOT IN (SELECT new_id FROM migration_score_ids)`)
+	if err != nil {
+		return err
+	}
+	if unmigrated.Count != 0 {
+		return fmt.Errorf("cannot roll back: scores has %d scores the migration didn't create (e.g. id %d), "+
+			"submitted since, which would be lost; copy them into the old tables, or delete them, and rerun the rollback",
+			unmigrated.Count, unmigrated.Example)
+	}
+	return nil
+}
+
+// runRollback undoes a failed or unwanted migration: replays are moved back
+// to their original paths, and the new tables are dropped, leaving the
+// database and replay directory exactly as they were before migrating.
+func runRollback(tables []SourceTable) error {
+	for _, table := range tables {
+		exists, err := tableExists(table.Name)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("cannot roll back: the old table %s has already been dropped", table.Name)
+		}
+	}
+
+	journaled, err := tableExists("migration_score_ids")
+	if err != nil {
+		return err
+	}
+	if !journaled {
+		return fmt.Errorf("cannot roll back: there is no migration journal (migration_score_ids) in this database")
+	}
+
+	if err := checkUnmigratedScores(); err != nil {
+		return err
+	}
+
+	// up --keep-ids leaves the replays in place, with nothing staged
+	staged := replaysStaged()
+	if staged {
+		if err := checkStagedReplays("roll back"); err != nil {
+			if moved, movedErr := replaysMoved(); movedErr != nil || moved {
+				return err
+			}
+			staged = false
+		}
+	}
+
+	if err := setupReplayStores(); err != nil {
+		return err
+	}
+
+	// the restores are journaled as well, alongside the original moves
+	_, statErr := os.Stat(cfg.ReplayJournalPath)
+	haveJournal := statErr == nil
+
+	replayJournal, err = openReplayJournal(cfg.ReplayJournalPath)
+	if err != nil {
+		return err
+	}
+	defer replayJournal.Close()
+
+	// move the replays back to their old ids
+	restored, err := restoreReplays(tables, haveJournal)
+	if err != nil {
+		return err
+	}
+	logger.Info("restored replays", "count", restored)
+
+	// put the staging directory back in place of the new replay directory
+	if staged {
+		entries, err := os.ReadDir(cfg.ReplayDirectory())
+		if err != nil {
+			return err
+		}
+		if len(entries) != 0 {
+			return fmt.Errorf("%s still contains %d files which were not created by the migration; "+
+				"move them elsewhere and rerun the rollback", cfg.ReplayDirectory(), len(entries))
+		}
+		// a mount point can't be removed, so the replays are moved into it
+		if err := os.Remove(cfg.ReplayDirectory()); err != nil && !mountPoint(err) {
+			return err
+		}
+		if err := moveDirectory(stagingReplayDirectory(), cfg.ReplayDirectory()); err != nil {
+			return err
+		}
+	}
+
+	// finally, drop everything the migration created
+	for _, table := range []string{"scores", "score_id_map"} {
+		if _, err := DB.Exec("drop table if exists " + table); err != nil {
+			return err
+		}
+	}
+	if err := dropCheckpointTables(); err != nil {
+		return err
+	}
+
+	logger.Info("rollback complete, the old tables and replays are back in place")
+	return nil
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a small s3 client supporting just the operations the tools need,
+// signed with aws signature v4. it works with aws, minio, backblaze b2,
+// cloudflare r2 and other s3-compatible services.
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+
+// S3Client talks to a single bucket.
+type S3Client struct {
+	Endpoint  *url.URL
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	PathStyle bool // address the bucket as endpoint/bucket, rather than bucket.endpoint
+
+	http *http.Client
+}
+
+func newS3Client(bucket string) (*S3Client, error) {
+	if cfg.S3AccessKey == "" || cfg.S3SecretKey == "" {
+		return nil, fmt.Errorf("s3 credentials are not set (AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY)")
+	}
+
+	region := cfg.S3Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	// custom endpoints (minio, etc.) generally only support path-style addressing
+	endpoint, pathStyle := cfg.S3Endpoint, true
+	if endpoint == "" {
+		endpoint, pathStyle = fmt.Sprintf("https://s3.%s.amazonaws.com", region), false
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3_ENDPOINT %q", endpoint)
+	}
+
+	return &S3Client{
+		Endpoint:  u,
+		Region:    region,
+		Bucket:    bucket,
+		AccessKey: cfg.S3AccessKey,
+		SecretKey: cfg.S3SecretKey,
+		PathStyle: pathStyle,
+		http:      &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+// awsEscape percent-encodes everything but unreserved characters, as sigv4 requires.
+func awsEscape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', keepSlash && c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// do sends a signed request for key (which may be empty for bucket-level requests).
+func (c *S3Client) do(method, key string, query url.Values, body []byte, headers map[string]string) (*http.Response, error) {
+	req, err := c.signedRequest(method, key, query, body, headers, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return c.http.Do(req)
+}
+
+// signedRequest builds a request, signed as of now.
+func (c *S3Client) signedRequest(method, key string, query url.Values, body []byte, headers map[string]string, now time.Time) (*http.Request, error) {
+	host := c.Endpoint.Host
+	path := "/" + key
+	if c.PathStyle {
+		path = "/" + c.Bucket + path
+	} else {
+		host = c.Bucket + "." + host
+	}
+
+	// canonical query string, sorted by key
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			params = append(params, awsEscape(k, false)+"="+awsEscape(v, false))
+		}
+	}
+	rawQuery := strings.Join(params, "&")
+
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	signed := map[string]string{
+		"host":                 host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	for k, v := range headers {
+		signed[strings.ToLower(k)] = v
+	}
+	headerNames := make([]string, 0, len(signed))
+	for k := range signed {
+		headerNames = append(headerNames, k)
+	}
+	sort.Strings(headerNames)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range headerNames {
+		canonicalHeaders.WriteString(k + ":" + strings.TrimSpace(signed[k]) + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		method, awsEscape(path, true), rawQuery,
+		canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+
+	scope := date + "/" + c.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	signingKey := hmacSHA256([]byte("AWS4"+c.SecretKey), date)
+	signingKey = hmacSHA256(signingKey, c.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	u := url.URL{Scheme: c.Endpoint.Scheme, Host: host, Path: path, RawPath: awsEscape(path, true), RawQuery: rawQuery}
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for _, k := range headerNames {
+		if k != "host" {
+			req.Header.Set(k, signed[k])
+		}
+	}
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.AccessKey, scope, signedHeaders, signature,
+	))
+	return req, nil
+}
+
+// s3Error converts an unsuccessful response into an error, mapping
+// missing objects to os.ErrNotExist so callers can treat stores alike.
+func s3Error(resp *http.Response, key string) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("s3 object %s: %w", key, os.ErrNotExist)
+	}
+	return fmt.Errorf("s3 %s %s: %s %s", resp.Request.Method, key, resp.Status, strings.TrimSpace(string(body)))
+}
+
+func (c *S3Client) Get(key string) (io.ReadCloser, error) {
+	resp, err := c.do(http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, s3Error(resp, key)
+	}
+	return resp.Body, nil
+}
+
+func (c *S3Client) Put(key string, body []byte, headers map[string]string) error {
+	resp, err := c.do(http.MethodPut, key, nil, body, headers)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp, key)
+	}
+	return nil
+}
+
+func (c *S3Client) Head(key string) (int64, error) {
+	resp, err := c.do(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, s3Error(resp, key)
+	}
+	return resp.ContentLength, nil
+}
+
+func (c *S3Client) Delete(key string) error {
+	resp, err := c.do(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s3Error(resp, key)
+	}
+	return nil
+}
+
+// CreateMultipartUpload starts an upload of an object in parts, for
+// objects too large to be buffered for Put.
+func (c *S3Client) CreateMultipartUpload(key string, headers map[string]string) (string, error) {
+	resp, err := c.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil, headers)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", s3Error(resp, key)
+	}
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	return result.UploadID, nil
+}
+
+// S3Part is an uploaded part of a multipart upload.
+type S3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// UploadPart uploads the nth part of an upload, numbered from 1. every
+// part but the last must be at least 5 MiB.
+func (c *S3Client) UploadPart(key, uploadID string, n int, body []byte) (S3Part, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {uploadID}}
+	resp, err := c.do(http.MethodPut, key, query, body, nil)
+	if err != nil {
+		return S3Part{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return S3Part{}, s3Error(resp, key)
+	}
+	return S3Part{PartNumber: n, ETag: resp.Header.Get("ETag")}, nil
+}
+
+// CompleteMultipartUpload assembles the parts into the object, returning
+// its etag.
+func (c *S3Client) CompleteMultipartUpload(key, uploadID string, parts []S3Part) (string, error) {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []S3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.do(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, body, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", s3Error(resp, key)
+	}
+
+	// s3 can fail after having replied 200, with an error as the body
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		XMLName xml.Name
+		ETag    string `xml:"ETag"`
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := xml.Unmarshal(data, &result); err != nil {
+		return "", err
+	}
+	if result.XMLName.Local == "Error" {
+		return "", fmt.Errorf("s3 completing %s: %s %s", key, result.Code, result.Message)
+	}
+	return result.ETag, nil
+}
+
+// AbortMultipartUpload removes an unfinished upload's parts.
+func (c *S3Client) AbortMultipartUpload(key, uploadID string) error {
+	resp, err := c.do(http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s3Error(resp, key)
+	}
+	return nil
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key  string `xml:"Key"`
+		Size int64  `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List calls fn for every key under prefix, paging through ListObjectsV2.
+func (c *S3Client) List(prefix string, fn func(key string, size int64) error) error {
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := c.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := s3Error(resp, prefix)
+			resp.Body.Close()
+			return err
+		}
+
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, object := range result.Contents {
+			if err := fn(object.Key, object.Size); err != nil {
+				return err
+			}
+		}
+
+		if !result.IsTruncated {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// S3Store keeps replays as objects under a prefix of a bucket.
+type S3Store struct {
+	client *S3Client
+	prefix string // either empty, or ending in a slash
+}
+
+// openS3Store opens a store from an s3://bucket/prefix url.
+func openS3Store(location string) (*S3Store, error) {
+	u, err := url.Parse(location)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid s3 location %q, expected s3://bucket/prefix", location)
+	}
+
+	client, err := newS3Client(u.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := strings.Trim(u.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &S3Store{client: client, prefix: prefix}, nil
+}
+
+func (s *S3Store) Open(key string) (io.ReadCloser, error) {
+	return s.client.Get(s.prefix + key)
+}
+
+// Put uploads the replay. s3 verifies the body against its signed sha256,
+// and objects are only visible once fully written, so this is durable.
+func (s *S3Store) Put(key string, r io.Reader, size int64) error {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) != size {
+		return fmt.Errorf("read %d bytes, expected %d", len(body), size)
+	}
+	return s.client.Put(s.prefix+key, body, map[string]string{"content-type": "application/octet-stream"})
+}
+
+func (s *S3Store) Delete(key string) error {
+	return s.client.Delete(s.prefix + key)
+}
+
+func (s *S3Store) Stat(key string) (int64, error) {
+	return s.client.Head(s.prefix + key)
+}
+
+func (s *S3Store) List(fn func(key string) error) error {
+	return s.client.List(s.prefix, func(key string, _ int64) error {
+		key = strings.TrimPrefix(key, s.prefix)
+		if strings.Contains(key, "/") || !strings.HasSuffix(key, ".osr") {
+			return nil
+		}
+		return fn(key)
+	})
+}
+
+func (s *S3Store) Location(key string) string {
+	return fmt.Sprintf("s3://%s/%s%s", s.client.Bucket, s.prefix, key)
+}
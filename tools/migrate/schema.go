@@ -0,0 +1,177 @@
+package main
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+)
+
+// TableSchema describes a mysql table, as read from information_schema,
+// so that it can be created again on another server (or another engine).
+type TableSchema struct {
+	Name       string
+	Columns    []ColumnSchema
+	PrimaryKey []string
+	Indexes    []IndexSchema
+}
+
+type ColumnSchema struct {
+	Name          string
+	DataType      string // e.g. int, varchar, enum
+	ColumnType    string // e.g. int unsigned, varchar(32), enum('osu!','private')
+	Nullable      bool
+	Default       sql.NullString
+	DefaultExpr   bool // the default is an expression, e.g. CURRENT_TIMESTAMP
+	AutoIncrement bool
+	Length        sql.NullInt64 // of strings
+	Precision     sql.NullInt64 // of numbers
+	Scale         sql.NullInt64
+	Charset       sql.NullString // of strings
+}
+
+func (c ColumnSchema) Unsigned() bool {
+	return strings.Contains(c.ColumnType, "unsigned")
+}
+
+// Binary reports whether the column holds bytes rather than text.
+func (c ColumnSchema) Binary() bool {
+	return strings.HasSuffix(c.DataType, "blob") || strings.HasSuffix(c.DataType, "binary")
+}
+
+type IndexSchema struct {
+	Name    string
+	Unique  bool
+	Columns []string
+}
+
+// loadTableSchemas reads the tables of a database. tables may be nil for
+// every table, and views are left out.
+func loadTableSchemas(schema string, tables []string) ([]*TableSchema, error) {
+	var names []string
+	err := DB.Select(&names, `
+	SELECT table_name FROM information_schema.tables
+	WHERE table_schema = ? AND table_type = 'BASE TABLE'`, schema)
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := make(map[string]bool, len(tables))
+	for _, table := range tables {
+		wanted[table] = true
+	}
+	byName := make(map[string]*TableSchema)
+	for _, name := range names {
+		if tables == nil || wanted[name] {
+			byName[name] = &TableSchema{Name: name}
+		}
+	}
+
+	var columns []struct {
+		Table     string         `db:"table_name"`
+		Name      string         `db:"column_name"`
+		DataType  string         `db:"data_type"`
+		Type      string         `db:"column_type"`
+		Nullable  string         `db:"is_nullable"`
+		Default   sql.NullString `db:"column_default"`
+		Extra     string         `db:"extra"`
+		Length    sql.NullInt64  `db:"character_maximum_length"`
+		Precision sql.NullInt64  `db:"numeric_precision"`
+		Scale     sql.NullInt64  `db:"numeric_scale"`
+		Charset   sql.NullString `db:"character_set_name"`
+	}
+	err = DB.Select(&columns, `
+	SELECT table_name AS table_name, column_name AS column_name,
+	       data_type AS data_type, column_type AS column_type,
+	       is_nullable AS is_nullable, column_default AS column_default,
+	       extra AS extra, character_maximum_length AS character_maximum_length,
+	       numeric_precision AS numeric_precision, numeric_scale AS numeric_scale,
+	       character_set_name AS character_set_name
+	FROM information_schema.columns WHERE table_schema = ?
+	ORDER BY table_name, ordinal_position`, schema)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range columns {
+		t := byName[row.Table]
+		if t == nil {
+			continue
+		}
+
+		c := ColumnSchema{
+			Name:          row.Name,
+			DataType:      strings.ToLower(row.DataType),
+			ColumnType:    strings.ToLower(row.Type),
+			Nullable:      row.Nullable == "YES",
+			Default:       row.Default,
+			AutoIncrement: strings.Contains(strings.ToLower(row.Extra), "auto_increment"),
+			Length:        row.Length,
+			Precision:     row.Precision,
+			Scale:         row.Scale,
+			Charset:       row.Charset,
+		}
+
+		// mysql 8 marks expressions with DEFAULT_GENERATED, older versions
+		// only have CURRENT_TIMESTAMP. mariadb quotes literals instead, and
+		// spells out NULL.
+		if def := c.Default.String; c.Default.Valid {
+			switch {
+			case def == "NULL" && c.Nullable:
+				c.Default.Valid = false
+			case len(def) >= 2 && def[0] == '\'' && def[len(def)-1] == '\'':
+				c.Default.String = strings.ReplaceAll(def[1:len(def)-1], "''", "'")
+			case strings.Contains(strings.ToLower(row.Extra), "default_generated"),
+				strings.HasPrefix(strings.ToLower(def), "current_timestamp"):
+				c.DefaultExpr = true
+			}
+		}
+		t.Columns = append(t.Columns, c)
+	}
+
+	var indexes []struct {
+		Table     string `db:"table_name"`
+		Name      string `db:"index_name"`
+		NonUnique bool   `db:"non_unique"`
+		Column    string `db:"column_name"`
+	}
+	err = DB.Select(&indexes, `
+	SELECT table_name AS table_name, index_name AS index_name,
+	       non_unique AS non_unique, column_name AS column_name
+	FROM information_schema.statistics WHERE table_schema = ?
+	ORDER BY table_name, index_name, seq_in_index`, schema)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range indexes {
+		t := byName[row.Table]
+		if t == nil {
+			continue
+		}
+		if row.Name == "PRIMARY" {
+			t.PrimaryKey = append(t.PrimaryKey, row.Column)
+			continue
+		}
+		if n := len(t.Indexes); n > 0 && t.Indexes[n-1].Name == row.Name {
+			t.Indexes[n-1].Columns = append(t.Indexes[n-1].Columns, row.Column)
+			continue
+		}
+		t.Indexes = append(t.Indexes, IndexSchema{Name: row.Name, Unique: !row.NonUnique, Columns: []string{row.Column}})
+	}
+
+	result := make([]*TableSchema, 0, len(byName))
+	for _, t := range byName {
+		result = append(result, t)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, nil
+}
+
+// ColumnNames returns the table's columns, in order.
+func (t *TableSchema) ColumnNames() []string {
+	names := make([]string, len(t.Columns))
+	for i, c := range t.Columns {
+		names[i] = c.Name
+	}
+	return names
+}
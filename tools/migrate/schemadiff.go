@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// schema diff compares the database against the schema of a bancho.py
+// release, and prints the statements which would bring it in line, e.g.
+// for servers whose tables were hand-edited over the years. the canonical
+// schema is the release's migrations/base.sql, which is created in a scratch
+// database on the same server, so that mysql normalises both sides alike.
+// the scratch database is dropped afterwards.
+//
+// an older release's schema can be diffed against with its base.sql, e.g.
+// $ git show v4.7.1:migrations/base.sql > base-4.7.1.sql
+
+// readSchemaStatements returns the statements of a .sql file which create
+// tables & indexes, leaving out the rows it inserts.
+func readSchemaStatements(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var stmts []string
+	var stmt strings.Builder
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "--") {
+			continue
+		}
+		stmt.WriteString(line)
+		stmt.WriteByte('\n')
+
+		if strings.HasSuffix(line, ";") {
+			s := strings.TrimSuffix(strings.TrimSpace(stmt.String()), ";")
+			stmt.Reset()
+
+			keyword := strings.ToLower(strings.Fields(s)[0])
+			if keyword == "create" || keyword == "alter" {
+				stmts = append(stmts, s)
+			}
+		}
+	}
+	return stmts, scanner.Err()
+}
+
+// loadCanonicalSchema creates the tables of a .sql file in a scratch
+// database, and reads them back.
+func loadCanonicalSchema(path, scratch string) ([]*TableSchema, error) {
+	stmts, err := readSchemaStatements(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(stmts) == 0 {
+		return nil, fmt.Errorf("%s doesn't create any tables", path)
+	}
+
+	var exists int
+	err = DB.Get(&exists, "SELECT COUNT(*) FROM information_schema.schemata WHERE schema_name = ?", scratch)
+	if err != nil {
+		return nil, err
+	}
+	if exists != 0 {
+		return nil, fmt.Errorf("the scratch database %s already exists, drop it or choose another with --scratch-db", scratch)
+	}
+
+	// the scratch database shares the real one's defaults, so that columns
+	// without an explicit charset compare equal
+	var defaults struct {
+		Charset   string `db:"default_character_set_name"`
+		Collation string `db:"default_collation_name"`
+	}
+	err = DB.Get(&defaults, `
+	SELECT default_character_set_name AS default_character_set_name,
+	       default_collation_name AS default_collation_name
+	FROM information_schema.schemata WHERE schema_name = ?`, cfg.DBName)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = DB.Exec(fmt.Sprintf("CREATE DATABASE `%s` CHARACTER SET %s COLLATE %s", scratch, defaults.Charset, defaults.Collation))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the scratch database (it needs the CREATE & DROP privileges): %w", err)
+	}
+	defer DB.Exec(fmt.Sprintf("DROP DATABASE `%s`", scratch))
+
+	// USE only applies to a single connection, which is switched back
+	// before returning to the pool
+	ctx := context.Background()
+	conn, err := DB.Connx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer conn.ExecContext(ctx, fmt.Sprintf("USE `%s`", cfg.DBName))
+
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf("USE `%s`", scratch)); err != nil {
+		return nil, err
+	}
+	for _, stmt := range stmts {
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			return nil, fmt.Errorf("failed to run %q from %s: %w", strings.SplitN(stmt, "\n", 2)[0], path, err)
+		}
+	}
+	return loadTableSchemas(scratch, nil)
+}
+
+func sameColumn(a, b ColumnSchema) bool {
+	return a.ColumnType == b.ColumnType && a.Nullable == b.Nullable &&
+		a.Default == b.Default && a.DefaultExpr == b.DefaultExpr &&
+		a.AutoIncrement == b.AutoIncrement && a.Charset == b.Charset
+}
+
+// indexKey identifies an index by what it covers, as forks have often
+// renamed them.
+func indexKey(index IndexSchema) string {
+	return fmt.Sprintf("%v:%s", index.Unique, strings.Join(index.Columns, ","))
+}
+
+// diffTable returns the statements altering a live table to match the
+// canonical one. dropping what the canonical table doesn't have is left
+// commented out, unless drop is set.
+func diffTable(live, canonical *TableSchema, drop bool) []string {
+	d := mysqlDialect{}
+	table := d.Quote(canonical.Name)
+	var stmts []string
+	dropStmt := func(s string) {
+		if !drop {
+			s = "-- " + s
+		}
+		stmts = append(stmts, s)
+	}
+
+	liveColumns := make(map[string]ColumnSchema, len(live.Columns))
+	for _, c := range live.Columns {
+		liveColumns[c.Name] = c
+	}
+	position := "FIRST"
+	for _, c := range canonical.Columns {
+		existing, ok := liveColumns[c.Name]
+		switch {
+		case !ok:
+			stmts = append(stmts, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, d.columnDef(c), position))
+		case !sameColumn(existing, c):
+			stmts = append(stmts, fmt.Sprintf("-- was %s\nALTER TABLE %s MODIFY COLUMN %s", d.columnDef(existing), table, d.columnDef(c)))
+		}
+		delete(liveColumns, c.Name)
+		position = "AFTER " + d.Quote(c.Name)
+	}
+	for _, c := range live.Columns {
+		if _, extra := liveColumns[c.Name]; extra {
+			dropStmt(fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", table, d.Quote(c.Name)))
+		}
+	}
+
+	if strings.Join(live.PrimaryKey, ",") != strings.Join(canonical.PrimaryKey, ",") {
+		var alter []string
+		if len(live.PrimaryKey) != 0 {
+			alter = append(alter, "DROP PRIMARY KEY")
+		}
+		if len(canonical.PrimaryKey) != 0 {
+			alter = append(alter, "ADD PRIMARY KEY ("+quoteAll(d, canonical.PrimaryKey)+")")
+		}
+		stmts = append(stmts, fmt.Sprintf("ALTER TABLE %s %s", table, strings.Join(alter, ", ")))
+	}
+
+	liveIndexes := make(map[string]IndexSchema, len(live.Indexes))
+	for _, index := range live.Indexes {
+		liveIndexes[indexKey(index)] = index
+	}
+	for _, index := range canonical.Indexes {
+		if _, ok := liveIndexes[indexKey(index)]; ok {
+			delete(liveIndexes, indexKey(index))
+			continue
+		}
+		kind := "INDEX"
+		if index.Unique {
+			kind = "UNIQUE INDEX"
+		}
+		stmts = append(stmts, fmt.Sprintf("ALTER TABLE %s ADD %s %s (%s)", table, kind, d.Quote(index.Name), quoteAll(d, index.Columns)))
+	}
+	for _, index := range live.Indexes {
+		if _, extra := liveIndexes[indexKey(index)]; extra {
+			dropStmt(fmt.Sprintf("ALTER TABLE %s DROP INDEX %s", table, d.Quote(index.Name)))
+		}
+	}
+	return stmts
+}
+
+func runSchemaDiff() error {
+	scratch := cfg.ScratchDB
+	if scratch == "" {
+		scratch = cfg.DBName + "_schema_diff"
+	}
+	if !validSchemaName.MatchString(scratch) {
+		return fmt.Errorf("invalid scratch database name %q", scratch)
+	}
+
+	canonical, err := loadCanonicalSchema(cfg.SchemaPath, scratch)
+	if err != nil {
+		return err
+	}
+	live, err := loadTableSchemas(cfg.DBName, nil)
+	if err != nil {
+		return err
+	}
+	liveTables := make(map[string]*TableSchema, len(live))
+	for _, t := range live {
+		liveTables[t.Name] = t
+	}
+
+	var stmts []string
+	for _, t := range canonical {
+		existing := liveTables[t.Name]
+		delete(liveTables, t.Name)
+		if existing == nil {
+			stmts = append(stmts, mysqlDialect{}.CreateTable(t)...)
+			continue
+		}
+		stmts = append(stmts, diffTable(existing, t, cfg.DropExtra)...)
+	}
+
+	// tables of the tool's own, and of forks, are only ever mentioned
+	extra := make([]string, 0, len(liveTables))
+	for name := range liveTables {
+		extra = append(extra, name)
+	}
+	sort.Strings(extra)
+
+	changes := 0
+	for _, stmt := range stmts {
+		if !strings.HasPrefix(stmt, "-- ALTER") {
+			changes++
+		}
+		fmt.Printf("%s;\n", stmt)
+	}
+	for _, name := range extra {
+		fmt.Printf("-- %s isn't part of bancho.py's schema\n", name)
+	}
+
+	logger.Info("compared the schema", "against", cfg.SchemaPath, "tables", len(canonical),
+		"statements", changes, "extra_tables", len(extra))
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "schema diff",
+		Summary: "print the statements which bring the database's schema in line with bancho.py's",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.SchemaPath, "schema", "../../migrations/base.sql", "the canonical schema, i.e. a bancho.py release's migrations/base.sql")
+			flags.StringVar(&c.ScratchDB, "scratch-db", "", "database to create the canonical schema in, then drop (default: DB_NAME_schema_diff)")
+			flags.BoolVar(&c.DropExtra, "drop", false, "drop columns & indexes which aren't in the canonical schema, rather than commenting them out")
+		},
+		Run: runSchemaDiff,
+	})
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+)
+
+func TestDiffTable(t *testing.T) {
+	id := ColumnSchema{Name: "id", ColumnType: "int", AutoIncrement: true}
+	name := ColumnSchema{Name: "name", ColumnType: "varchar(32)", Charset: sql.NullString{String: "utf8mb4", Valid: true}}
+	country := ColumnSchema{Name: "country", ColumnType: "char(2)", Default: sql.NullString{String: "xx", Valid: true}}
+	canonical := &TableSchema{
+		Name:       "users",
+		Columns:    []ColumnSchema{id, name, country},
+		PrimaryKey: []string{"id"},
+		Indexes: []IndexSchema{
+			{Name: "users_name_uindex", Unique: true, Columns: []string{"name"}},
+			{Name: "users_country_index", Columns: []string{"country"}},
+		},
+	}
+
+	if stmts := diffTable(canonical, canonical, true); len(stmts) != 0 {
+		t.Errorf("diffTable() of a table with itself = %q, want nothing", stmts)
+	}
+
+	// a fork's table: name is latin1, country's missing, it has a column &
+	// index of its own, and name's unique index was renamed
+	latin1Name := name
+	latin1Name.Charset.String = "latin1"
+	live := &TableSchema{
+		Name:       "users",
+		Columns:    []ColumnSchema{id, latin1Name, {Name: "clan", ColumnType: "int", Nullable: true}},
+		PrimaryKey: []string{"id", "name"},
+		Indexes: []IndexSchema{
+			{Name: "name", Unique: true, Columns: []string{"name"}},
+			{Name: "users_clan_index", Columns: []string{"clan"}},
+		},
+	}
+	want := []string{
+		"-- was `name` varchar(32) CHARACTER SET latin1 NOT NULL\nALTER TABLE `users` MODIFY COLUMN `name` varchar(32) CHARACTER SET utf8mb4 NOT NULL",
+		"ALTER TABLE `users` ADD COLUMN `country` char(2) NOT NULL DEFAULT 'xx' AFTER `name`",
+		"-- ALTER TABLE `users` DROP COLUMN `clan`",
+		"ALTER TABLE `users` DROP PRIMARY KEY, ADD PRIMARY KEY (`id`)",
+		"ALTER TABLE `users` ADD INDEX `users_country_index` (`country`)",
+		"-- ALTER TABLE `users` DROP INDEX `users_clan_index`",
+	}
+	if got := diffTable(live, canonical, false); !reflect.DeepEqual(got, want) {
+		t.Errorf("diffTable() = %q, want %q", got, want)
+	}
+
+	want[2], want[5] = want[2][3:], want[5][3:]
+	if got := diffTable(live, canonical, true); !reflect.DeepEqual(got, want) {
+		t.Errorf("diffTable() with drop = %q, want %q", got, want)
+	}
+
+	// a column added at the start goes first
+	noID := &TableSchema{Name: "users", Columns: []ColumnSchema{name, country}, Indexes: canonical.Indexes}
+	want = []string{
+		"ALTER TABLE `users` ADD COLUMN `id` int NOT NULL AUTO_INCREMENT FIRST",
+		"ALTER TABLE `users` ADD PRIMARY KEY (`id`)",
+	}
+	if got := diffTable(noID, canonical, false); !reflect.DeepEqual(got, want) {
+		t.Errorf("diffTable() without id = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// scores verify looks through a scores table for rows which osu! couldn't
+// have submitted, e.g. ones which were edited by hand, or inserted by a
+// script, or imported from somewhere untrusted.
+//
+// the online_checksum itself can't be recomputed: bancho.py hashes the
+// score's fields along with the client's osu! version, executable hash,
+// storyboard md5 & its own clock, none of which are stored. instead, each
+// row's checksum must look like one, and be its own (bancho.py refuses a
+// checksum it has seen before), and the fields it covers must agree with
+// each other, & with the map, as they did when it was checked on submission.
+
+// scoreCheckProblems are the problems scores verify looks for, in order.
+var scoreCheckProblems = []string{
+	"no checksum", "malformed checksum", "duplicate checksum", "unknown map",
+	"mode", "grade", "accuracy", "perfect", "combo", "play time",
+}
+
+// accuracyTolerance is how far a score's acc may be from its hit counts',
+// as acc is stored rounded to 3 places.
+const accuracyTolerance = 0.01
+
+var validChecksum = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+var select_duplicate_checksums = `
+SELECT s.id, s.online_checksum FROM %[1]s s
+JOIN (SELECT online_checksum FROM %[1]s WHERE online_checksum != ''
+	GROUP BY online_checksum HAVING COUNT(*) > 1) d ON d.online_checksum = s.online_checksum
+ORDER BY s.online_checksum, s.id`
+
+var select_check_maps = `
+SELECT md5, mode, max_combo FROM maps WHERE md5 IN (?)`
+
+type checkMap struct {
+	MD5      string
+	Mode     int
+	MaxCombo int `db:"max_combo"`
+}
+
+// ScoreProblem is a row which failed a check, in the report.
+type ScoreProblem struct {
+	ScoreID int64  `json:"score_id"`
+	UserID  int64  `json:"user_id"`
+	Problem string `json:"problem"`
+	Detail  string `json:"detail"`
+}
+
+// ScoreCheckReport is the result of scores verify.
+type ScoreCheckReport struct {
+	Table    string          `json:"table"`
+	Checked  int64           `json:"checked"`
+	OK       bool            `json:"ok"`
+	Counts   map[string]int  `json:"counts"` // rows with each problem
+	Problems []*ScoreProblem `json:"problems"`
+}
+
+func (r *ScoreCheckReport) add(score *Score, problem, detail string) {
+	r.OK = false
+	r.Counts[problem]++
+	r.Problems = append(r.Problems, &ScoreProblem{ScoreID: score.ID, UserID: score.UserID, Problem: problem, Detail: detail})
+}
+
+// checkScoreFields checks that a score's fields agree with each other, & its map.
+func checkScoreFields(score *Score, m *checkMap, now int64, report *ScoreCheckReport) {
+	checksum := score.OnlineChecksum.String
+	switch {
+	case checksum == "":
+		// scores imported from servers which don't store one
+		if cfg.RequireChecksum {
+			report.add(score, "no checksum", "online_checksum is empty")
+		}
+	case !validChecksum.MatchString(checksum):
+		report.add(score, "malformed checksum", fmt.Sprintf("%q is not an md5 hash", checksum))
+	}
+
+	if m == nil {
+		report.add(score, "unknown map", fmt.Sprintf("%s is not in the maps table", score.MapMD5))
+	}
+
+	if expected := modeFromMods(score.Mode%4, score.Mods); score.Mode != expected || score.Mode > 11 {
+		report.add(score, "mode", fmt.Sprintf("mode %d doesn't match mods %d (expected mode %d)", score.Mode, score.Mods, expected))
+	}
+
+	if grade := calculateGrade(score); score.Grade != grade {
+		report.add(score, "grade", fmt.Sprintf("grade %s, but its hits give %s", score.Grade, grade))
+	}
+
+	if acc := calculateAccuracy(score); math.Abs(float64(score.Acc-acc)) > accuracyTolerance {
+		report.add(score, "accuracy", fmt.Sprintf("acc %.3f, but its hits give %.3f", score.Acc, acc))
+	}
+
+	if score.Perfect != 0 && score.Nmiss != 0 {
+		report.add(score, "perfect", fmt.Sprintf("marked perfect, with %d misses", score.Nmiss))
+	}
+
+	// converts' max combos aren't stored, so only the map's own mode is checked
+	if m != nil && m.MaxCombo > 0 && m.Mode == score.Mode%4 && score.MaxCombo > m.MaxCombo {
+		report.add(score, "combo", fmt.Sprintf("combo %d, over the map's max of %d", score.MaxCombo, m.MaxCombo))
+	}
+
+	if score.PlayTime > now {
+		report.add(score, "play time", fmt.Sprintf("played in the future, at %s", time.Unix(score.PlayTime, 0).Format(time.RFC3339)))
+	}
+}
+
+// checkDuplicateChecksums reports every row sharing its checksum with another.
+func checkDuplicateChecksums(report *ScoreCheckReport) error {
+	var rows []struct {
+		ID             int64
+		OnlineChecksum string `db:"online_checksum"`
+	}
+	if err := ReadDB.Select(&rows, fmt.Sprintf(select_duplicate_checksums, report.Table)); err != nil {
+		return err
+	}
+
+	shared := make(map[string][]string)
+	for _, row := range rows {
+		shared[row.OnlineChecksum] = append(shared[row.OnlineChecksum], strconv.FormatInt(row.ID, 10))
+	}
+	for _, row := range rows {
+		var others []string
+		for _, id := range shared[row.OnlineChecksum] {
+			if id != strconv.FormatInt(row.ID, 10) {
+				others = append(others, id)
+			}
+		}
+		report.add(&Score{ID: row.ID}, "duplicate checksum", fmt.Sprintf("%s is shared with score %s", row.OnlineChecksum, strings.Join(others, ", ")))
+	}
+	return nil
+}
+
+func runScoresVerify() error {
+	if cfg.ReportFormat != "json" && cfg.ReportFormat != "csv" {
+		return fmt.Errorf("unknown --format %q, expected json or csv", cfg.ReportFormat)
+	}
+	exists, err := tableExists(cfg.CheckTable)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("table %s does not exist", cfg.CheckTable)
+	}
+
+	report := &ScoreCheckReport{Table: cfg.CheckTable, OK: true, Counts: map[string]int{}, Problems: []*ScoreProblem{}}
+	now := time.Now().Add(maxReplayClockSkew).Unix()
+	var lastID int64
+	for {
+		var scores []Score
+		if err := ReadDB.Select(&scores, fmt.Sprintf(select_scores, cfg.CheckTable), lastID, BatchSize); err != nil {
+			return err
+		}
+		if len(scores) == 0 {
+			break
+		}
+
+		md5s := make(map[string]bool)
+		for _, score := range scores {
+			md5s[score.MapMD5] = true
+		}
+		var keys []string
+		for md5 := range md5s {
+			keys = append(keys, md5)
+		}
+		query, args, err := sqlx.In(select_check_maps, keys)
+		if err != nil {
+			return err
+		}
+		var maps []checkMap
+		if err := ReadDB.Select(&maps, query, args...); err != nil {
+			return err
+		}
+		byMD5 := make(map[string]*checkMap, len(maps))
+		for i := range maps {
+			byMD5[maps[i].MD5] = &maps[i]
+		}
+
+		for i := range scores {
+			checkScoreFields(&scores[i], byMD5[scores[i].MapMD5], now, report)
+		}
+		report.Checked += int64(len(scores))
+		lastID = scores[len(scores)-1].ID
+		logger.Debug("checked scores", "table", cfg.CheckTable, "checked", report.Checked, "last_id", lastID)
+	}
+	if err := checkDuplicateChecksums(report); err != nil {
+		return err
+	}
+
+	sort.SliceStable(report.Problems, func(i, j int) bool {
+		return report.Problems[i].ScoreID < report.Problems[j].ScoreID
+	})
+
+	var counts []string
+	for _, problem := range scoreCheckProblems {
+		if report.Counts[problem] != 0 {
+			counts = append(counts, fmt.Sprintf("%d %s", report.Counts[problem], problem))
+		}
+	}
+	if len(counts) == 0 {
+		counts = append(counts, "no problems")
+	}
+	fmt.Printf("%d scores checked in %s: %s\n", report.Checked, cfg.CheckTable, strings.Join(counts, ", "))
+	for i, p := range report.Problems {
+		if i == maxExamples {
+			fmt.Printf("  ... and %d more, see --report\n", len(report.Problems)-i)
+			break
+		}
+		fmt.Printf("  %d: %s (%s)\n", p.ScoreID, p.Problem, p.Detail)
+	}
+
+	if cfg.ReportPath != "" {
+		if cfg.ReportFormat == "json" {
+			err = writeReport(cfg.ReportPath, report)
+		} else {
+			rows := make([][]string, len(report.Problems))
+			for i, p := range report.Problems {
+				rows[i] = []string{strconv.FormatInt(p.ScoreID, 10), strconv.FormatInt(p.UserID, 10), p.Problem, p.Detail}
+			}
+			err = writeCSVReport(cfg.ReportPath, []string{"score_id", "user_id", "problem", "detail"}, rows)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !report.OK {
+		return errVerificationFailed
+	}
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "scores verify",
+		Summary: "check every score's checksum & fields, to find rows osu! couldn't have submitted",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.CheckTable, "table", "scores", "the scores table to check, e.g. "+archiveTable)
+			flags.BoolVar(&c.RequireChecksum, "require-checksum", false, "report scores without an online_checksum, which imported scores often lack")
+			flags.StringVar(&c.ReportPath, "report", "", "write the list of problems to this path (- for stdout)")
+			flags.StringVar(&c.ReportFormat, "format", "json", "the report's format: json or csv")
+		},
+		Run: runScoresVerify,
+	})
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// score ids change when v4.2.0 merges the scores tables (and when scores
+// are imported from another server), which breaks whatever holds the old
+// ones: replay links, score pages, and third-party tools' records of scores.
+// the migration's journal (migration_score_ids) has every old id's new one,
+// but is dropped with the old tables, so up copies it into score_id_map,
+// which is kept. export score-ids writes it out for everything else:
+//
+//	--format csv    source_table,old_id,new_id
+//	--format json   [{"source_table": "scores_vn", "old_id": 5, "new_id": 123}]
+//	--format nginx  a map per old table, from --nginx-key (the old id, e.g.
+//	                osu-getreplay's $arg_c) to $<table>_new_id, to redirect
+//	                old links with, e.g. return 301 ...?c=$scores_vn_new_id
+//
+// and --symlinks links <dir>/<table>/<old id>.osr to each moved replay, for
+// anything serving (or holding paths to) replays by their old ids.
+
+var create_saved_score_id_map = `
+create table if not exists score_id_map (
+	source_table varchar(64) not null,
+	old_id bigint unsigned not null,
+	new_id bigint unsigned not null,
+	primary key (source_table, old_id),
+	key score_id_map_new_id (new_id)
+);
+`
+
+// scoreIDRename is an old score id, and its new one.
+type scoreIDRename struct {
+	SourceTable string `db:"source_table" json:"source_table"`
+	OldID       int64  `db:"old_id" json:"old_id"`
+	NewID       int64  `db:"new_id" json:"new_id"`
+}
+
+// saveScoreIDMap copies the migration's journal into score_id_map, so it's
+// kept once the journal's dropped.
+func saveScoreIDMap() error {
+	journaled, err := tableExists("migration_score_ids")
+	if err != nil || !journaled {
+		return err
+	}
+	if _, err := DB.Exec(create_saved_score_id_map); err != nil {
+		return err
+	}
+	result, err := DB.Exec(`
+	INSERT IGNORE INTO score_id_map (source_table, old_id, new_id)
+	SELECT source_table, old_id, new_id FROM migration_score_ids`)
+	if err != nil {
+		return fmt.Errorf("failed to save the old scores' new ids: %w", err)
+	}
+	saved, _ := result.RowsAffected()
+	logger.Info("saved the old scores' new ids in score_id_map", "scores", saved)
+	return nil
+}
+
+// scoreIDWriter writes the renames in one of export score-ids' formats.
+type scoreIDWriter interface {
+	Write(r scoreIDRename) error
+	Close() error
+}
+
+type csvScoreIDs struct{ w *csv.Writer }
+
+func (c csvScoreIDs) Write(r scoreIDRename) error {
+	return c.w.Write([]string{r.SourceTable, strconv.FormatInt(r.OldID, 10), strconv.FormatInt(r.NewID, 10)})
+}
+
+func (c csvScoreIDs) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type jsonScoreIDs struct {
+	w     *bufio.Writer
+	first bool
+}
+
+func (j *jsonScoreIDs) Write(r scoreIDRename) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if j.first {
+		j.w.WriteString("[\n")
+	} else {
+		j.w.WriteString(",\n")
+	}
+	j.first = false
+	_, err = j.w.Write(data)
+	return err
+}
+
+func (j *jsonScoreIDs) Close() error {
+	if j.first {
+		j.w.WriteString("[")
+	}
+	_, err := j.w.WriteString("\n]\n")
+	return err
+}
+
+type nginxScoreIDs struct {
+	w     *bufio.Writer
+	table string // whose map is being written
+}
+
+func (n *nginxScoreIDs) Write(r scoreIDRename) error {
+	if r.SourceTable != n.table {
+		if n.table != "" {
+			n.w.WriteString("}\n\n")
+		}
+		n.table = r.SourceTable
+		fmt.Fprintf(n.w, "# %s's old ids, and their new ones\nmap %s $%s_new_id {\n\tdefault \"\";\n", r.SourceTable, cfg.ScoreIDsNginxKey, r.SourceTable)
+	}
+	_, err := fmt.Fprintf(n.w, "\t%d %d;\n", r.OldID, r.NewID)
+	return err
+}
+
+func (n *nginxScoreIDs) Close() error {
+	if n.table != "" {
+		n.w.WriteString("}\n")
+	}
+	return nil
+}
+
+// symlinkOldReplay links an old id's replay path to its moved replay.
+func symlinkOldReplay(replays LocalStore, r scoreIDRename) (bool, error) {
+	target, err := filepath.Abs(replays.path(replayKey(r.NewID)))
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(target); errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	link := filepath.Join(cfg.ScoreIDsSymlinks, r.SourceTable, replayKey(r.OldID))
+	if err := os.Remove(link); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	return true, os.Symlink(target, link)
+}
+
+func runExportScoreIDs() error {
+	if cfg.ScoreIDsOut == "" && cfg.ScoreIDsSymlinks == "" {
+		return errors.New("--out or --symlinks is required")
+	}
+	// up saves the map, but imports, or a migration still underway, may not have
+	if err := saveScoreIDMap(); err != nil {
+		return err
+	}
+	if exists, err := tableExists("score_id_map"); err != nil {
+		return err
+	} else if !exists {
+		return errors.New("there's no score_id_map or migration_score_ids, have the scores been migrated?")
+	}
+
+	var out *os.File
+	var w *bufio.Writer
+	var ids scoreIDWriter
+	if cfg.ScoreIDsOut != "" {
+		var err error
+		if out, err = os.Create(cfg.ScoreIDsOut + ".tmp"); err != nil {
+			return err
+		}
+		defer os.Remove(out.Name())
+		defer out.Close()
+		w = bufio.NewWriter(out)
+		switch cfg.ScoreIDsFormat {
+		case "csv":
+			cw := csv.NewWriter(w)
+			cw.Write([]string{"source_table", "old_id", "new_id"})
+			ids = csvScoreIDs{cw}
+		case "json":
+			ids = &jsonScoreIDs{w: w, first: true}
+		case "nginx":
+			ids = &nginxScoreIDs{w: w}
+		default:
+			return fmt.Errorf("--format must be csv, json or nginx, not %q", cfg.ScoreIDsFormat)
+		}
+	}
+
+	var replays LocalStore
+	if cfg.ScoreIDsSymlinks != "" {
+		location := cfg.NewReplays
+		if location == "" {
+			location = cfg.ReplayDirectory()
+		}
+		store, err := openReplayStore(location)
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if replays, ok = store.(LocalStore); !ok {
+			return fmt.Errorf("--symlinks needs the replays on local disk, not %s", location)
+		}
+	}
+
+	rows, err := DB.Queryx("SELECT source_table, old_id, new_id FROM score_id_map ORDER BY source_table, old_id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var written, linked int64
+	tables := make(map[string]bool)
+	for rows.Next() {
+		var r scoreIDRename
+		if err := rows.StructScan(&r); err != nil {
+			return err
+		}
+		if ids != nil {
+			if err := ids.Write(r); err != nil {
+				return err
+			}
+		}
+		if cfg.ScoreIDsSymlinks != "" {
+			if !tables[r.SourceTable] {
+				if err := os.MkdirAll(filepath.Join(cfg.ScoreIDsSymlinks, r.SourceTable), 0755); err != nil {
+					return err
+				}
+				tables[r.SourceTable] = true
+			}
+			ok, err := symlinkOldReplay(replays, r)
+			if err != nil {
+				return err
+			} else if ok {
+				linked++
+			}
+		}
+		written++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if out != nil {
+		if err := ids.Close(); err != nil {
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+		if err := os.Rename(out.Name(), cfg.ScoreIDsOut); err != nil {
+			return err
+		}
+	}
+	logger.Info("exported the old scores' new ids", "scores", written, "replays_linked", linked)
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:              "export score-ids",
+		Summary:           "write out the old score ids' new ones (csv, json or an nginx map), or symlink the replays' old ids to them",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.ScoreIDsOut, "out", "", "the file to write the ids to")
+			flags.StringVar(&c.ScoreIDsFormat, "format", "csv", "csv, json, or nginx for a map per old table")
+			flags.StringVar(&c.ScoreIDsNginxKey, "nginx-key", "$arg_c", "with --format nginx, the variable holding the old id")
+			flags.StringVar(&c.ScoreIDsSymlinks, "symlinks", "", "a directory to link <table>/<old id>.osr to each moved replay in")
+			flags.StringVar(&c.NewReplays, "replays", "", "where the moved replays are, for --symlinks (default: DATA_DIRECTORY/osr)")
+		},
+		Run: runExportScoreIDs,
+	})
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// scores modes finds scores whose mode can't be right. relax & autopilot
+// scores are kept in their own modes, offset by 4 & 8 from the vanilla
+// ones, which migrations & imports have often got wrong: there's no relax
+// mania (mode 7), autopilot is only for osu! (so no modes 9-11), and a
+// score's mode should agree with its relax & autopilot mods.
+//
+// by default they're only reported; --action reassign moves each score to
+// the mode its mods give, if that's a real mode, and quarantines the rest
+// (into quarantined_<table>, keeping their ids, so their replays still
+// match), and --action quarantine quarantines every one. stats of modes
+// which don't exist are deleted either way, and the affected players'
+// best scores & stats are recalculated.
+
+const (
+	modesReport     = "report"
+	modesReassign   = "reassign"
+	modesQuarantine = "quarantine"
+)
+
+var errBadModesFound = errors.New("scores with impossible modes were found")
+
+// the modes a row can't have, & rows whose mode disagrees with their mods
+var select_bad_modes = `
+SELECT id, userid, mode, mods FROM %s
+WHERE id > ? AND (mode NOT IN (0, 1, 2, 3, 4, 5, 6, 8)
+	OR mode < 4 AND mods & ? != 0
+	OR mode BETWEEN 4 AND 7 AND mods & ? = 0
+	OR mode >= 8 AND mods & ? = 0)
+ORDER BY id LIMIT ?`
+
+var count_bad_stats = `
+SELECT COUNT(*) FROM stats WHERE mode NOT IN (0, 1, 2, 3, 4, 5, 6, 8)`
+
+var delete_bad_stats = `
+DELETE FROM stats WHERE mode NOT IN (0, 1, 2, 3, 4, 5, 6, 8)`
+
+type badModeScore struct {
+	ID     int64
+	UserID int64 `db:"userid"`
+	Mode   int
+	Mods   int
+}
+
+// ModeProblem is a score with the wrong mode, & what's done with it.
+type ModeProblem struct {
+	ScoreID int64  `json:"score_id"`
+	UserID  int64  `json:"user_id"`
+	Mode    int    `json:"mode"`
+	Mods    int    `json:"mods"`
+	Problem string `json:"problem"`
+	Fix     string `json:"fix"`
+}
+
+// ModesReport is the result of scores modes.
+type ModesReport struct {
+	Table       string        `json:"table"`
+	Action      string        `json:"action"`
+	Impossible  int64         `json:"impossible"` // scores in modes which don't exist
+	Mismatched  int64         `json:"mismatched"` // scores in modes their mods disagree with
+	Reassigned  int64         `json:"reassigned"`
+	Quarantined int64         `json:"quarantined"`
+	Stats       int64         `json:"stats"` // stats rows of modes which don't exist
+	Examples    []ModeProblem `json:"examples"`
+}
+
+// correctMode is the mode a score's mods put it in, or false if they
+// don't give a mode which exists.
+func correctMode(score badModeScore) (int, bool) {
+	if score.Mode < 0 || score.Mode > 11 || score.Mods&modRelax != 0 && score.Mods&modAutopilot != 0 {
+		return 0, false
+	}
+	mode := modeFromMods(score.Mode%4, score.Mods)
+	return mode, statsModes[mode]
+}
+
+// quarantineScores moves scores from a table into quarantined_<table>.
+func quarantineScores(tx *sqlx.Tx, table string, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	quarantined := "quarantined_" + table
+	if _, err := tx.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s LIKE %s", quarantined, table)); err != nil {
+		return err
+	}
+	for len(ids) != 0 {
+		n := min(BatchSize, len(ids))
+		query, args, err := sqlx.In(fmt.Sprintf("INSERT IGNORE INTO %s SELECT * FROM %s WHERE id IN (?)", quarantined, table), ids[:n])
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(query, args...); err != nil {
+			return err
+		}
+		query, args, err = sqlx.In(fmt.Sprintf("DELETE FROM %s WHERE id IN (?)", table), ids[:n])
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(query, args...); err != nil {
+			return err
+		}
+		ids = ids[n:]
+	}
+	return nil
+}
+
+// fixScoreModes reassigns & quarantines a table's scores, in one transaction.
+func fixScoreModes(table string, reassign map[int][]int64, quarantine []int64) error {
+	rows := len(quarantine)
+	for _, ids := range reassign {
+		rows += len(ids)
+	}
+	if err := throttle(rows); err != nil {
+		return err
+	}
+	tx, err := DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for mode, ids := range reassign {
+		for len(ids) != 0 {
+			n := min(BatchSize, len(ids))
+			query, args, err := sqlx.In(fmt.Sprintf("UPDATE %s SET mode = ? WHERE id IN (?)", table), mode, ids[:n])
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(query, args...); err != nil {
+				return err
+			}
+			ids = ids[n:]
+		}
+	}
+
+	if err := quarantineScores(tx, table, quarantine); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(delete_bad_stats); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func runScoresModes() error {
+	switch cfg.ModesAction {
+	case modesReport, modesReassign, modesQuarantine:
+	default:
+		return fmt.Errorf("unknown --action %q, expected report, reassign or quarantine", cfg.ModesAction)
+	}
+	exists, err := tableExists(cfg.CheckTable)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("table %s does not exist", cfg.CheckTable)
+	}
+
+	start := time.Now()
+	report := ModesReport{Table: cfg.CheckTable, Action: cfg.ModesAction, Examples: []ModeProblem{}}
+	reassign := make(map[int][]int64)
+	var quarantine []int64
+	users := make(map[int64]bool)
+
+	var lastID int64
+	for {
+		var scores []badModeScore
+		err := DB.Select(&scores, fmt.Sprintf(select_bad_modes, cfg.CheckTable), lastID,
+			modRelax|modAutopilot, modRelax, modAutopilot, BatchSize)
+		if err != nil {
+			return err
+		}
+		if len(scores) == 0 {
+			break
+		}
+
+		for _, score := range scores {
+			problem := ModeProblem{ScoreID: score.ID, UserID: score.UserID, Mode: score.Mode, Mods: score.Mods}
+			if statsModes[score.Mode] {
+				problem.Problem = "mismatched mode"
+				report.Mismatched++
+			} else {
+				problem.Problem = "impossible mode"
+				report.Impossible++
+			}
+
+			if mode, ok := correctMode(score); ok && cfg.ModesAction != modesQuarantine {
+				problem.Fix = fmt.Sprintf("mode %d", mode)
+				reassign[mode] = append(reassign[mode], score.ID)
+			} else {
+				problem.Fix = "quarantine"
+				quarantine = append(quarantine, score.ID)
+			}
+			users[score.UserID] = true
+
+			if len(report.Examples) < maxExamples {
+				report.Examples = append(report.Examples, problem)
+			}
+		}
+		lastID = scores[len(scores)-1].ID
+	}
+	if err := DB.Get(&report.Stats, count_bad_stats); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: %d scores in modes which don't exist, %d in modes their mods disagree with; %d stats rows of modes which don't exist\n",
+		cfg.CheckTable, report.Impossible, report.Mismatched, report.Stats)
+	for _, p := range report.Examples {
+		fmt.Printf("  %d: %s %d with mods %d (fix: %s)\n", p.ScoreID, p.Problem, p.Mode, p.Mods, p.Fix)
+	}
+	found := report.Impossible + report.Mismatched + report.Stats
+
+	if found != 0 && cfg.ModesAction != modesReport {
+		modes := make([]int, 0, len(reassign))
+		for mode, ids := range reassign {
+			modes = append(modes, mode)
+			report.Reassigned += int64(len(ids))
+		}
+		sort.Ints(modes)
+		var moves []string
+		for _, mode := range modes {
+			moves = append(moves, fmt.Sprintf("%d to mode %d", len(reassign[mode]), mode))
+		}
+		report.Quarantined = int64(len(quarantine))
+
+		fmt.Printf("This will reassign %d scores (%s), quarantine %d into quarantined_%s, and delete %d stats rows.\n",
+			report.Reassigned, strings.Join(moves, ", "), report.Quarantined, cfg.CheckTable, report.Stats)
+		if !confirm("Continue?") {
+			fmt.Println("Not repairing the scores")
+			return nil
+		}
+		if err := fixScoreModes(cfg.CheckTable, reassign, quarantine); err != nil {
+			return fmt.Errorf("failed to repair the scores: %w", err)
+		}
+		logger.Info("repaired the scores' modes", "reassigned", report.Reassigned, "quarantined", report.Quarantined, "stats", report.Stats)
+
+		// the scores have moved by now, so anything failing below
+		// can be finished with recalc status & recalc stats
+		if len(users) != 0 {
+			counts, err := rebuildUserStats(users)
+			if err != nil {
+				return fmt.Errorf("failed to rebuild the stats, run recalc status & recalc stats: %w", err)
+			}
+			logger.Info("recalculated the players' best scores & stats", "users", len(users),
+				"promoted", counts.Promoted, "demoted", counts.Demoted)
+		}
+	}
+
+	if err := writeReport(cfg.ReportPath, report); err != nil {
+		return err
+	}
+	logger.Info("scores modes finished", "found", found, "action", cfg.ModesAction,
+		"elapsed", time.Since(start).Round(time.Second))
+	if found != 0 && cfg.ModesAction == modesReport {
+		return errBadModesFound
+	}
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "scores modes",
+		Summary: "find scores in modes which don't exist, or which their mods disagree with, and reassign or quarantine them",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.CheckTable, "table", "scores", "the scores table to check, e.g. "+archiveTable)
+			flags.StringVar(&c.ModesAction, "action", modesReport, "what to do with them: report, reassign (to the mode their mods give, quarantining the rest) or quarantine (into quarantined_<table>)")
+			flags.StringVar(&c.ReportPath, "report", "", "write what was found as json to this path (- for stdout)")
+		},
+		Run: runScoresModes,
+	})
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+type Score struct {
+	ID             int64
+	MapMD5         string `db:"map_md5"`
+	Score          int
+	PP             float32
+	Acc            float32
+	MaxCombo       int `db:"max_combo"`
+	Mods           int
+	N300           int
+	N100           int
+	N50            int
+	Nmiss          int
+	Ngeki          int
+	Nkatu          int
+	Grade          string
+	Status         int
+	Mode           int
+	PlayTime       int64 `db:"play_time"`
+	TimeElapsed    int   `db:"time_elapsed"`
+	ClientFlags    int   `db:"client_flags"`
+	UserID         int64 `db:"userid"`
+	Perfect        int
+	OnlineChecksum sql.NullString `db:"online_checksum"`
+}
+
+// SourceTable is one of the pre-v4.2.0 per-mod scores tables.
+// ModeOffset is added to each row's mode so that relax and
+// autopilot scores land in their own modes in the new table.
+type SourceTable struct {
+	Name       string
+	ModeOffset int
+
+	// tables imported from other servers have their own schema & replay
+	// naming, and are read with their own query. see ripple.go.
+	Select     string                // defaults to select_scores
+	Columns    string                // the select list, when adapted to the table by preflight.go
+	Prepare    func(*Score)          // called on each row before it's inserted
+	Replays    ReplayStore           // defaults to oldReplays
+	ReplayName func(id int64) string // defaults to replayKey
+
+	// rebuilds of the scores table keep each score's id, so its replay
+	// stays where it is. see partition.go. up --keep-ids keeps them too,
+	// plus an offset, moving the replays only when needed. see keepids.go.
+	KeepIDs         bool
+	IDOffset        int64
+	MoveKeptReplays bool
+}
+
+// keptID is the id a score keeps, with KeepIDs.
+func (t SourceTable) keptID(id int64) int64 {
+	return id + t.IDOffset
+}
+
+func (t SourceTable) selectQuery() string {
+	if t.Columns != "" {
+		return fmt.Sprintf("SELECT %s FROM %s WHERE id > ? ORDER BY id LIMIT ?", t.Columns, t.Name)
+	}
+	if t.Select != "" {
+		return fmt.Sprintf(t.Select, t.Name)
+	}
+	return fmt.Sprintf(select_scores, t.Name)
+}
+
+// mode returns the mode a score is migrated into.
+func (t SourceTable) mode(score Score) int {
+	score.Mode += t.ModeOffset
+	if t.Prepare != nil {
+		t.Prepare(&score)
+	}
+	return score.Mode
+}
+
+// replays returns where the table's replays are before migrating.
+func (t SourceTable) replays() ReplayStore {
+	if t.Replays != nil {
+		return t.Replays
+	}
+	return oldReplays
+}
+
+// oldReplayKey returns the key of a replay before migrating.
+func (t SourceTable) oldReplayKey(move ReplayMove) string {
+	if t.ReplayName != nil {
+		return t.ReplayName(move.OldID)
+	}
+	return oldReplayKey(move)
+}
+
+var SourceTables = []SourceTable{
+	{Name: "scores_vn", ModeOffset: 0},
+	{Name: "scores_rx", ModeOffset: 4},
+	{Name: "scores_ap", ModeOffset: 8},
+}
+
+var create_scores = `
+create table scores (
+	id bigint unsigned auto_increment
+		primary key,
+	map_md5 char(32) not null,
+	score int not null,
+	pp float(7,3) not null,
+	acc float(6,3) not null,
+	max_combo int not null,
+	mods int not null,
+	n300 int not null,
+	n100 int not null,
+	n50 int not null,
+	nmiss int not null,
+	ngeki int not null,
+	nkatu int not null,
+	grade varchar(2) default 'N' not null,
+	status tinyint not null,
+	mode tinyint not null,
+	play_time datetime not null,
+	time_elapsed int not null,
+	client_flags int not null,
+	userid int not null,
+	perfect tinyint(1) not null,
+	online_checksum char(32) not null default ''
+);
+`
+
+var insert_score = `
+INSERT INTO scores VALUES (
+	NULL,
+	:map_md5,
+	:score,
+	:pp,
+	:acc,
+	:max_combo,
+	:mods,
+	:n300,
+	:n100,
+	:n50,
+	:nmiss,
+	:ngeki,
+	:nkatu,
+	:grade,
+	:status,
+	:mode,
+	FROM_UNIXTIME(:play_time),
+	:time_elapsed,
+	:client_flags,
+	:userid,
+	:perfect,
+	:online_checksum
+)`
+
+// insert_score_with_id inserts a score keeping its id, see SourceTable.KeepIDs.
+var insert_score_with_id = strings.Replace(insert_score, "NULL", ":id", 1)
+
+// select_scores reads one page of an old scores table using
+// keyset pagination, so no query ever holds more than a single
+// page of rows, regardless of how large the table is.
+var select_scores = `
+SELECT id, map_md5, score, pp, acc, max_combo, mods, n300, n100,
+n50, nmiss, ngeki, nkatu, grade, status, mode, UNIX_TIMESTAMP(play_time) AS play_time,
+time_elapsed, client_flags, userid, perfect, online_checksum FROM %s
+WHERE id > ? ORDER BY id LIMIT ?`
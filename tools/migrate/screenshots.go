@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gc screenshots removes screenshots from DATA_DIRECTORY/ss, which bancho.py
+// keeps forever. screenshots aren't in the database, only their names,
+// 8 random characters (e.g. "x9Kq-Ab_.png"), so what's known about each is:
+//
+//   - its age, from when the file was written.
+//   - whether it's referenced, i.e. linked (as /ss/<name>) in mail, comments
+//     or logs, whose links would break. referenced screenshots are kept,
+//     unless --keep-referenced=false.
+//   - its owner, from who linked it, or from bancho.py's log lines
+//     ("<name (id)> uploaded <file>."), if --bancho-log is given. only
+//     screenshots with an owner count towards --user-quota.
+//
+// each policy is off unless given: --max-age removes every screenshot past
+// it, --orphaned-after removes unreferenced ones past it, and --user-quota
+// removes users' oldest screenshots past their quota. with --archive, each
+// screenshot is uploaded (to a directory, s3://, b2:// or sftp://, as with
+// backup) before it's removed, and kept if it couldn't be.
+
+var screenshotName = regexp.MustCompile(`^[a-zA-Z0-9_-]{8}\.(png|jpeg|jpg)$`)
+
+// links to screenshots, e.g. https://osu.example.com/ss/x9Kq-Ab_.png
+var screenshotLink = regexp.MustCompile(`/ss/([a-zA-Z0-9_-]{8}\.(?:png|jpeg|jpg))`)
+
+// bancho.py's log line for an upload, see app/api/domains/osu.py
+var screenshotUploadLine = regexp.MustCompile(`\((\d+)\)> uploaded ([a-zA-Z0-9_-]{8}\.(?:png|jpeg))`)
+
+// the text which may link to screenshots, & who wrote it
+var screenshotReferences = []struct {
+	Table string
+	Query string
+}{
+	{"mail", "SELECT from_id, msg FROM mail WHERE msg LIKE '%/ss/%'"},
+	{"comments", "SELECT userid, comment FROM comments WHERE comment LIKE '%/ss/%'"},
+	{"logs", "SELECT `from`, msg FROM logs WHERE msg LIKE '%/ss/%'"},
+}
+
+// why screenshots are removed
+const (
+	removedForAge     = "age"
+	removedAsOrphaned = "orphaned"
+	removedOverQuota  = "quota"
+)
+
+// screenshot is a file in the screenshot directory.
+type screenshot struct {
+	Name       string
+	Size       int64
+	ModTime    time.Time
+	Owner      int64 // 0 if unknown
+	Referenced bool
+	Reason     string // why it's removed, or empty if it's kept
+}
+
+// RemovedScreenshot is a screenshot which was (or would be) removed.
+type RemovedScreenshot struct {
+	Name   string    `json:"name"`
+	Owner  int64     `json:"owner,omitempty"`
+	Size   int64     `json:"size"`
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason"`
+}
+
+// ScreenshotReport is the result of gc screenshots.
+type ScreenshotReport struct {
+	Screenshots int64               `json:"screenshots"`
+	Bytes       int64               `json:"bytes"`
+	Referenced  int64               `json:"referenced"`
+	Owned       int64               `json:"owned"`    // screenshots whose owner is known
+	Dangling    []string            `json:"dangling"` // links to screenshots which don't exist
+	Removed     map[string]int64    `json:"removed"`  // by reason
+	Freed       int64               `json:"freed_bytes"`
+	Archived    int64               `json:"archived"`
+	Failed      []string            `json:"failed"`
+	Examples    []RemovedScreenshot `json:"examples"`
+}
+
+// listScreenshots reads the screenshot directory.
+func listScreenshots(dir string) (map[string]*screenshot, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	screenshots := make(map[string]*screenshot, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !screenshotName.MatchString(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		screenshots[entry.Name()] = &screenshot{Name: entry.Name(), Size: info.Size(), ModTime: info.ModTime()}
+	}
+	return screenshots, nil
+}
+
+// findScreenshotReferences marks the screenshots linked in the database,
+// and who linked them, returning the links to screenshots which are gone.
+func findScreenshotReferences(screenshots map[string]*screenshot) ([]string, error) {
+	var dangling []string
+	for _, ref := range screenshotReferences {
+		exists, err := tableExists(ref.Table)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+		rows, err := DB.Query(ref.Query)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", ref.Table, err)
+		}
+		for rows.Next() {
+			var user int64
+			var text string
+			if err := rows.Scan(&user, &text); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			for _, m := range screenshotLink.FindAllStringSubmatch(text, -1) {
+				ss, ok := screenshots[m[1]]
+				if !ok {
+					dangling = append(dangling, m[1])
+					continue
+				}
+				ss.Referenced = true
+				if ss.Owner == 0 {
+					ss.Owner = user
+				}
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return dangling, nil
+}
+
+// readUploadLogs finds who uploaded screenshots in bancho.py's logs, which
+// is who owns them even if someone else linked them.
+func readUploadLogs(paths []string, screenshots map[string]*screenshot) error {
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			m := screenshotUploadLine.FindStringSubmatch(scanner.Text())
+			if m == nil {
+				continue
+			}
+			if ss, ok := screenshots[m[2]]; ok {
+				ss.Owner, _ = strconv.ParseInt(m[1], 10, 64)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// applyScreenshotPolicies decides which screenshots are removed, & why.
+func applyScreenshotPolicies(screenshots map[string]*screenshot, now time.Time) {
+	byOwner := make(map[int64][]*screenshot)
+	for _, ss := range screenshots {
+		if ss.Owner != 0 {
+			byOwner[ss.Owner] = append(byOwner[ss.Owner], ss)
+		}
+		if ss.Referenced && cfg.KeepReferenced {
+			continue
+		}
+		age := now.Sub(ss.ModTime)
+		switch {
+		case cfg.ScreenshotMaxAge > 0 && age > cfg.ScreenshotMaxAge:
+			ss.Reason = removedForAge
+		case cfg.OrphanedAfter > 0 && !ss.Referenced && age > cfg.OrphanedAfter:
+			ss.Reason = removedAsOrphaned
+		}
+	}
+
+	// users keep their newest screenshots, up to their quota
+	if cfg.UserQuota <= 0 {
+		return
+	}
+	quota := int64(cfg.UserQuota) << 20
+	for _, owned := range byOwner {
+		sort.Slice(owned, func(i, j int) bool { return owned[i].ModTime.After(owned[j].ModTime) })
+		var used int64
+		for _, ss := range owned {
+			if ss.Reason != "" {
+				continue
+			}
+			if used+ss.Size > quota && !(ss.Referenced && cfg.KeepReferenced) {
+				ss.Reason = removedOverQuota
+				continue
+			}
+			used += ss.Size
+		}
+	}
+}
+
+// archiveScreenshot uploads a screenshot before it's removed.
+func archiveScreenshot(dest BackupDestination, path, name string) error {
+	return retryUpload(name, func() error {
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		upload, err := dest.Create(name, map[string]string{"type": "screenshot"})
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(upload, in); err != nil {
+			upload.Abort()
+			return err
+		}
+		return upload.Commit()
+	})
+}
+
+func runGCScreenshots() error {
+	if cfg.ScreenshotMaxAge <= 0 && cfg.OrphanedAfter <= 0 && cfg.UserQuota <= 0 {
+		return errors.New("no policy given, use --max-age, --orphaned-after or --user-quota")
+	}
+	var logs []string
+	for _, pattern := range strings.Split(cfg.BanchoLogs, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil || len(matches) == 0 {
+			return fmt.Errorf("--bancho-log %q matches no files", pattern)
+		}
+		logs = append(logs, matches...)
+	}
+	if cfg.UserQuota > 0 && len(logs) == 0 {
+		logger.Warn("without --bancho-log, only screenshots linked by their owner count towards --user-quota")
+	}
+	var archive BackupDestination
+	if cfg.ScreenshotArchive != "" {
+		var err error
+		if archive, err = openBackupDestination(cfg.ScreenshotArchive); err != nil {
+			return err
+		}
+	}
+
+	dir := cfg.ScreenshotDirectory()
+	screenshots, err := listScreenshots(dir)
+	if err != nil {
+		return err
+	}
+	dangling, err := findScreenshotReferences(screenshots)
+	if err != nil {
+		return err
+	}
+	if err := readUploadLogs(logs, screenshots); err != nil {
+		return err
+	}
+	applyScreenshotPolicies(screenshots, time.Now())
+
+	report := &ScreenshotReport{Dangling: dangling, Removed: map[string]int64{},
+		Failed: []string{}, Examples: []RemovedScreenshot{}}
+	if report.Dangling == nil {
+		report.Dangling = []string{}
+	}
+	var removed []*screenshot
+	for _, ss := range screenshots {
+		report.Screenshots++
+		report.Bytes += ss.Size
+		if ss.Referenced {
+			report.Referenced++
+		}
+		if ss.Owner != 0 {
+			report.Owned++
+		}
+		if ss.Reason != "" {
+			removed = append(removed, ss)
+		}
+	}
+	// oldest first, so an interrupted run has removed the oldest
+	sort.Slice(removed, func(i, j int) bool { return removed[i].ModTime.Before(removed[j].ModTime) })
+
+	var freeing int64
+	for _, ss := range removed {
+		freeing += ss.Size
+	}
+	fmt.Printf("%d screenshots (%d MiB), %d referenced, %d with a known owner, %d dangling links\n",
+		report.Screenshots, report.Bytes>>20, report.Referenced, report.Owned, len(report.Dangling))
+	fmt.Printf("%d screenshots (%d MiB) to remove\n", len(removed), freeing>>20)
+	for _, ss := range removed[:min(len(removed), maxExamples)] {
+		fmt.Printf("  %s %s %d KiB (%s)\n", ss.Name, ss.ModTime.Format(time.DateOnly), ss.Size>>10, ss.Reason)
+	}
+
+	if cfg.DryRun || len(removed) == 0 {
+		for _, ss := range removed {
+			report.Removed[ss.Reason]++
+			report.Freed += ss.Size
+			if len(report.Examples) < maxExamples {
+				report.Examples = append(report.Examples, RemovedScreenshot{ss.Name, ss.Owner, ss.Size, ss.ModTime, ss.Reason})
+			}
+		}
+		return writeReport(cfg.ReportPath, report)
+	}
+	question := fmt.Sprintf("Remove %d screenshots?", len(removed))
+	if archive != nil {
+		question = fmt.Sprintf("Archive %d screenshots to %s, and remove them?", len(removed), cfg.ScreenshotArchive)
+	}
+	if !confirm(question) {
+		fmt.Println("Not removing anything")
+		return nil
+	}
+
+	// ctrl-c stops between screenshots
+	handleSignals()
+	start := time.Now()
+	var count int
+	for _, ss := range removed {
+		if isInterrupted() {
+			break
+		}
+		path := filepath.Join(dir, ss.Name)
+		if archive != nil {
+			if err := archiveScreenshot(archive, path, ss.Name); err != nil {
+				logger.Warn("failed to archive screenshot, keeping it", "screenshot", ss.Name, "err", err)
+				report.Failed = append(report.Failed, ss.Name)
+				continue
+			}
+			report.Archived++
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		count++
+		report.Removed[ss.Reason]++
+		report.Freed += ss.Size
+		if len(report.Examples) < maxExamples {
+			report.Examples = append(report.Examples, RemovedScreenshot{ss.Name, ss.Owner, ss.Size, ss.ModTime, ss.Reason})
+		}
+	}
+	if err := writeReport(cfg.ReportPath, report); err != nil {
+		return err
+	}
+
+	logger.Info("gc screenshots finished", "removed", count,
+		"freed_mib", report.Freed>>20, "archived", report.Archived, "failed", len(report.Failed), "elapsed", time.Since(start).Round(time.Second))
+	if isInterrupted() {
+		return errInterrupted
+	}
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:              "gc screenshots",
+		Summary:           "remove old, unreferenced or over-quota screenshots from the data directory, optionally archiving them first",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.DurationVar(&c.ScreenshotMaxAge, "max-age", 0, "remove screenshots older than this, e.g. 8760h for a year")
+			flags.DurationVar(&c.OrphanedAfter, "orphaned-after", 0, "remove screenshots which aren't linked in mail, comments or logs once older than this, e.g. 720h")
+			flags.IntVar(&c.UserQuota, "user-quota", 0, "MiB of screenshots each user keeps, their oldest past it are removed")
+			flags.BoolVar(&c.KeepReferenced, "keep-referenced", true, "never remove screenshots which are linked in mail, comments or logs")
+			flags.StringVar(&c.BanchoLogs, "bancho-log", "", "bancho.py's log files, to find who uploaded each screenshot, comma separated globs (e.g. /home/user/bancho.py/logs.log*)")
+			flags.StringVar(&c.ScreenshotArchive, "archive", "", "upload screenshots here before removing them: a path, s3://bucket/prefix, b2://bucket/prefix or sftp://user@host/path")
+			flags.IntVar(&c.MaxRetries, "max-retries", 5, "times to retry an upload to --archive")
+			flags.BoolVar(&c.DryRun, "dry-run", false, "report what would be removed, without removing anything")
+			flags.StringVar(&c.ReportPath, "report", "", "write what was removed as json to this path (- for stdout)")
+		},
+		Run: runGCScreenshots,
+	})
+}
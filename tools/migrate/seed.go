@@ -0,0 +1,878 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// seed fills a development database with synthetic users, beatmaps & scores
+// (and their stats & replays), so that migrations & the server itself can be
+// benchmarked without a copy of production data. the data is random, but
+// shaped like a real server's:
+//
+//   - a few players set most of the scores, and a few maps get most plays
+//   - players' skill follows a long tail, and they play maps around it
+//   - whether a score passes, its accuracy, misses & pp follow the map's
+//     difficulty against the player's skill, with the usual mods' effects
+//   - scores are spread over each player's time on the server, more of
+//     them recently
+//
+// --target old writes the scores to the pre-v4.2.0 scores_vn, scores_rx &
+// scores_ap tables instead, with replays named by their ids in them, to
+// benchmark the v4.2.0 migration.
+//
+// the same --seed generates the same data into the same database. the maps'
+// ids start at 1000000001, so they can't be mistaken for real ones, and are
+// frozen so bancho.py doesn't look them up. the users can't log in.
+
+// seedBatchSize is how many rows are inserted per statement, which keeps the
+// scores' placeholders under mysql's limit of 65535.
+const seedBatchSize = 1000
+
+// the first id given to seeded maps & mapsets, past any real one
+const seedMapIDs = 1000000000
+
+var seedCountries = []struct {
+	code   string
+	weight float64
+}{
+	{"us", 20}, {"de", 8}, {"pl", 7}, {"ru", 7}, {"jp", 6}, {"br", 6},
+	{"gb", 5}, {"fr", 5}, {"ca", 4}, {"kr", 4}, {"cn", 4}, {"au", 3},
+	{"ph", 3}, {"id", 3}, {"cl", 2}, {"fi", 2}, {"se", 2}, {"nl", 2},
+}
+
+var seedSyllables = strings.Fields("ka ki ku ke ko sa shi su se so ta chi tsu te to na ni nu ne no " +
+	"ha hi fu he ho ma mi mu me mo ya yu yo ra ri ru re ro wa zer lix vor tam rin kel dra mon")
+
+var seedWords = strings.Fields("blue night star cross light dream fire heart rain echo sky moon " +
+	"storm glass world end river shadow summer winter ghost neon paper flower silent")
+
+// the mods players pick, with how often. relax & autopilot are only picked
+// on osu! maps (& relax on taiko & catch ones too).
+var seedMods = []struct {
+	mods   int
+	weight float64
+}{
+	{0, 45}, {modHidden, 20}, {modHidden | seedModDoubleTime, 8}, {seedModDoubleTime, 7},
+	{seedModHardRock, 6}, {modHidden | seedModHardRock, 6}, {seedModNoFail, 3},
+	{seedModEasy, 1}, {seedModHalfTime, 1}, {modHidden | modFlashlight, 1},
+	{modRelax, 3}, {modRelax | modHidden | seedModDoubleTime, 1}, {modAutopilot, 1},
+}
+
+// the other mods seed uses, along with those in grades.go
+const (
+	seedModNoFail     = 1 << 0
+	seedModEasy       = 1 << 1
+	seedModHardRock   = 1 << 4
+	seedModDoubleTime = 1 << 6
+	seedModHalfTime   = 1 << 8
+)
+
+type seedUser struct {
+	ID       int64
+	Name     string
+	Country  string
+	Skill    float64 // the star rating they're comfortable at
+	Created  int64
+	LastSeen int64
+}
+
+type seedMap struct {
+	ID       int64
+	SetID    int64
+	MD5      string
+	Mode     int
+	Status   int
+	Stars    float64
+	Length   int // seconds
+	MaxCombo int
+	Objects  int
+	BPM      float64
+	Plays    int
+	Passes   int
+}
+
+// seedBest is a player's best score on a map in a mode so far.
+type seedBest struct {
+	ID       int64
+	Table    string
+	PP       float64
+	Acc      float64
+	Score    int
+	Grade    string
+	MapIndex int
+}
+
+type seedBestKey struct {
+	User int64
+	Map  int
+	Mode int
+}
+
+type seedStatsKey struct {
+	User int64
+	Mode int
+}
+
+// seedStats are a player's totals in a mode, as recalc stats adds them up.
+type seedStats struct {
+	Plays     int
+	Playtime  int64
+	TScore    int64
+	TotalHits int64
+	MaxCombo  int
+}
+
+// seeder generates & inserts the data.
+type seeder struct {
+	rng      *rand.Rand
+	now      int64
+	users    []seedUser
+	maps     []seedMap
+	activity []float64 // cumulative, to pick players by how much they play
+	zipf     *rand.Zipf
+	bests    map[seedBestKey]*seedBest
+	stats    map[seedStatsKey]*seedStats
+	replays  ReplayStore
+	nextID   int64
+}
+
+// weighted picks an index, given each one's cumulative weight.
+func (s *seeder) weighted(cumulative []float64) int {
+	return sort.SearchFloat64s(cumulative, s.rng.Float64()*cumulative[len(cumulative)-1])
+}
+
+func (s *seeder) hex(n int) string {
+	b := make([]byte, n)
+	s.rng.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (s *seeder) name() string {
+	var b strings.Builder
+	for i := 1 + s.rng.Intn(3); i >= 0; i-- {
+		b.WriteString(seedSyllables[s.rng.Intn(len(seedSyllables))])
+	}
+	name := b.String()
+	name = strings.ToUpper(name[:1]) + name[1:]
+	switch s.rng.Intn(4) {
+	case 0:
+		name += fmt.Sprint(s.rng.Intn(1000))
+	case 1:
+		name = seedWords[s.rng.Intn(len(seedWords))] + " " + name
+	}
+	return name
+}
+
+func (s *seeder) title() string {
+	words := make([]string, 1+s.rng.Intn(3))
+	for i := range words {
+		w := seedWords[s.rng.Intn(len(seedWords))]
+		words[i] = strings.ToUpper(w[:1]) + w[1:]
+	}
+	return strings.Join(words, " ")
+}
+
+// generateUsers makes up the players, skipping names which are taken.
+func (s *seeder) generateUsers(n int, days int) error {
+	taken, err := existingIDs("users", "safe_name")
+	if err != nil {
+		return err
+	}
+	var firstID int64
+	if err := DB.Get(&firstID, "SELECT COALESCE(MAX(id), 0) + 1 FROM users"); err != nil {
+		return err
+	}
+
+	countries := make([]float64, len(seedCountries))
+	total := 0.0
+	for i, c := range seedCountries {
+		total += c.weight
+		countries[i] = total
+	}
+
+	s.users = make([]seedUser, 0, n)
+	s.activity = make([]float64, 0, n)
+	activity := 0.0
+	for len(s.users) < n {
+		name := s.name()
+		safeName := strings.ReplaceAll(strings.ToLower(name), " ", "_")
+		if len(name) > 32 || taken[safeName] {
+			continue
+		}
+		taken[safeName] = true
+
+		// a pareto distribution, so a few players play most
+		plays := math.Pow(1-s.rng.Float64(), -1/1.2)
+		created := s.now - int64(s.rng.Float64()*float64(days)*86400)
+		lastSeen := created + int64(math.Pow(s.rng.Float64(), 0.3)*float64(s.now-created))
+		s.users = append(s.users, seedUser{
+			ID:      firstID + int64(len(s.users)),
+			Name:    name,
+			Country: seedCountries[s.weighted(countries)].code,
+			// active players tend to be better
+			Skill:    math.Exp(s.rng.NormFloat64()*0.35+1.2) * (1 + 0.1*math.Log(plays)),
+			Created:  created,
+			LastSeen: lastSeen,
+		})
+		activity += plays
+		s.activity = append(s.activity, activity)
+	}
+	return nil
+}
+
+// generateMaps makes up the beatmaps, in sets of a few difficulties.
+func (s *seeder) generateMaps(n int) error {
+	var firstID, firstSetID int64
+	if err := DB.Get(&firstID, "SELECT GREATEST(COALESCE(MAX(id), 0), ?) + 1 FROM maps", seedMapIDs); err != nil {
+		return err
+	}
+	if err := DB.Get(&firstSetID, "SELECT GREATEST(COALESCE(MAX(id), 0), ?) + 1 FROM mapsets", seedMapIDs); err != nil {
+		return err
+	}
+
+	s.maps = make([]seedMap, 0, n)
+	for set := firstSetID; len(s.maps) < n; set++ {
+		mode := 0
+		switch r := s.rng.Float64(); {
+		case r > 0.95:
+			mode = 3
+		case r > 0.90:
+			mode = 2
+		case r > 0.85:
+			mode = 1
+		}
+		status := mapStatusRanked
+		switch r := s.rng.Float64(); {
+		case r > 0.95:
+			status = 0 // pending
+		case r > 0.85:
+			status = mapStatusLoved
+		case r > 0.80:
+			status = mapStatusApproved
+		}
+		length := 60 + int(s.rng.ExpFloat64()*90)
+		bpm := 120 + math.Round(s.rng.NormFloat64()*30)
+		if bpm < 60 {
+			bpm = 60
+		}
+
+		for diff := 1 + s.rng.Intn(6); diff > 0 && len(s.maps) < n; diff-- {
+			stars := 1 + float64(diff)*0.8 + s.rng.Float64()*1.5
+			objects := int(float64(length) * bpm / 60 * (0.4 + 0.25*stars/5))
+			s.maps = append(s.maps, seedMap{
+				ID:       firstID + int64(len(s.maps)),
+				SetID:    set,
+				MD5:      s.hex(16),
+				Mode:     mode,
+				Status:   status,
+				Stars:    math.Round(stars*1000) / 1000,
+				Length:   length,
+				Objects:  objects,
+				MaxCombo: objects + objects/3,
+				BPM:      bpm,
+			})
+		}
+	}
+
+	// a few maps get most plays
+	s.rng.Shuffle(len(s.maps), func(i, j int) { s.maps[i], s.maps[j] = s.maps[j], s.maps[i] })
+	if len(s.maps) > 1 {
+		s.zipf = rand.NewZipf(s.rng, 1.1, 4, uint64(len(s.maps)-1))
+	}
+	return nil
+}
+
+// pickMap picks one of a few popular maps, the nearest to the player's skill.
+func (s *seeder) pickMap(skill float64) int {
+	if s.zipf == nil {
+		return 0
+	}
+	best := -1
+	for i := 0; i < 3; i++ {
+		m := int(s.zipf.Uint64())
+		if best < 0 || math.Abs(s.maps[m].Stars-skill) < math.Abs(s.maps[best].Stars-skill) {
+			best = m
+		}
+	}
+	return best
+}
+
+// pickMods picks mods which can be played in the map's mode.
+func (s *seeder) pickMods(mode int, cumulative []float64) int {
+	for {
+		mods := seedMods[s.weighted(cumulative)].mods
+		if mods&modAutopilot != 0 && mode != 0 || mods&modRelax != 0 && mode == 3 {
+			continue
+		}
+		return mods
+	}
+}
+
+// generateScore plays a map, working out the score's hits, combo & pp from
+// the map's difficulty against the player's skill.
+func (s *seeder) generateScore(u *seedUser, m *seedMap, mods int) Score {
+	stars, speed := m.Stars, 1.0
+	switch {
+	case mods&seedModDoubleTime != 0:
+		stars, speed = stars*1.4, 1.5
+	case mods&seedModHalfTime != 0:
+		stars, speed = stars*0.75, 0.75
+	}
+	switch {
+	case mods&seedModHardRock != 0:
+		stars *= 1.1
+	case mods&seedModEasy != 0:
+		stars *= 0.6
+	}
+	margin := u.Skill - stars
+
+	score := Score{
+		MapMD5: m.MD5,
+		Mods:   mods,
+		Mode:   modeFromMods(m.Mode, mods),
+		Status: 1,
+		UserID: u.ID,
+	}
+	played := 1.0
+	if mods&seedModNoFail == 0 && s.rng.Float64() > 1/(1+math.Exp(-2.5*(margin+0.3))) {
+		score.Status = 0
+		played = 0.05 + 0.9*s.rng.Float64()
+	}
+
+	objects := int(float64(m.Objects) * played)
+	misses := int(s.rng.ExpFloat64() * float64(m.Objects) * 0.003 * math.Exp(-1.5*margin))
+	if misses > objects {
+		misses = objects
+	}
+	acc := 0.985 + 0.015*math.Tanh(margin) - 0.02*math.Abs(s.rng.NormFloat64())
+	hit := objects - misses
+	n100 := int(float64(hit) * (1 - acc) * 1.5)
+	if n100 > hit {
+		n100 = hit
+	}
+	score.Nmiss = misses
+
+	switch m.Mode {
+	case 0:
+		score.N50 = n100 / 10
+		score.N100 = n100 - score.N50
+		score.N300 = hit - n100
+	case 1:
+		score.N100 = n100
+		score.N300 = hit - n100
+	case 2: // n50 are droplets, and nkatu missed droplets
+		score.N50 = hit / 4
+		score.Nkatu = n100 / 3
+		score.N300 = hit - score.N50 - score.Nkatu
+	case 3: // ngeki are max 300s, and nkatu 200s
+		score.Nkatu = n100 / 2
+		score.N100 = n100 - score.Nkatu
+		score.Ngeki = (hit - n100) * 7 / 10
+		score.N300 = hit - n100 - score.Ngeki
+	}
+
+	score.MaxCombo = int(float64(m.MaxCombo) * played)
+	if misses > 0 {
+		score.MaxCombo = int(float64(score.MaxCombo) * (0.2 + 0.7*s.rng.Float64()) / math.Sqrt(float64(misses)))
+	} else if score.Status != 0 {
+		score.Perfect = 1
+	}
+	score.Acc = calculateAccuracy(&score)
+	score.Grade = calculateGrade(&score)
+
+	fraction := float64(score.Acc) / 100
+	if m.Mode == 3 {
+		score.Score = int(1e6 * fraction * played)
+	} else {
+		score.Score = int(math.Min(float64(score.MaxCombo)*float64(score.MaxCombo)*(8+2*stars)*fraction, math.MaxInt32))
+	}
+
+	if score.Status != 0 {
+		pp := 1.3 * math.Pow(stars, 3) * math.Pow(fraction, 6) * math.Pow(0.97, float64(misses)) *
+			math.Pow(float64(score.MaxCombo)/float64(m.MaxCombo), 0.8)
+		if mods&modHidden != 0 {
+			pp *= 1.06
+		}
+		if mods&modFlashlight != 0 {
+			pp *= 1.15
+		}
+		if mods&seedModNoFail != 0 {
+			pp *= 0.9
+		}
+		score.PP = float32(math.Min(math.Round(pp*1000)/1000, 9999))
+	}
+
+	// more scores are recent, within the player's time on the server
+	since := u.Created
+	score.PlayTime = since + int64(math.Sqrt(s.rng.Float64())*float64(u.LastSeen-since))
+	score.TimeElapsed = int(float64(m.Length) * 1000 / speed * played)
+	score.OnlineChecksum.String, score.OnlineChecksum.Valid = s.hex(16), true
+	return score
+}
+
+// replayFrames makes up a replay's frames, a cursor circling the playfield
+// every 200ms or so, in the same format as osu!'s.
+func (s *seeder) replayFrames(score Score) []byte {
+	var b bytes.Buffer
+	b.WriteString("0|256|-500|0,-1|256|-500|0,")
+	angle := s.rng.Float64() * 2 * math.Pi
+	for t := 0; t < score.TimeElapsed; {
+		delta := 150 + s.rng.Intn(100)
+		t += delta
+		angle += float64(delta) / 400
+		keys := 0
+		if s.rng.Intn(3) == 0 {
+			keys = 1 + s.rng.Intn(2)
+		}
+		fmt.Fprintf(&b, "%d|%.4f|%.4f|%d,", delta, 256+180*math.Cos(angle), 192+140*math.Sin(angle), keys)
+	}
+	fmt.Fprintf(&b, "-12345|0|0|%d,", s.rng.Intn(1<<24))
+	return encodeLZMALiterals(b.Bytes())
+}
+
+var seed_score_columns = "id, map_md5, score, pp, acc, max_combo, mods, n300, n100, n50, nmiss, ngeki, nkatu, " +
+	"grade, status, mode, play_time, time_elapsed, client_flags, userid, perfect, online_checksum"
+
+// insertScores inserts a batch of scores into a table, and writes their replays.
+func (s *seeder) insertScores(table string, scores []Score) error {
+	if len(scores) == 0 {
+		return nil
+	}
+	args := make([]interface{}, 0, len(scores)*22)
+	for _, sc := range scores {
+		args = append(args, sc.ID, sc.MapMD5, sc.Score, sc.PP, sc.Acc, sc.MaxCombo, sc.Mods,
+			sc.N300, sc.N100, sc.N50, sc.Nmiss, sc.Ngeki, sc.Nkatu, sc.Grade, sc.Status, sc.Mode,
+			time.Unix(sc.PlayTime, 0).Format("2006-01-02 15:04:05"), sc.TimeElapsed, sc.ClientFlags,
+			sc.UserID, sc.Perfect, sc.OnlineChecksum.String)
+	}
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s", table, seed_score_columns,
+		placeholders(len(scores), 22, func(int) string { return "?" }))
+	if err := throttle(len(scores)); err != nil {
+		return err
+	}
+	if _, err := DB.Exec(query, args...); err != nil {
+		return err
+	}
+
+	if s.replays == nil {
+		return nil
+	}
+	// bancho.py only keeps the replays of passed scores
+	for _, sc := range scores {
+		if sc.Status == 0 {
+			continue
+		}
+		frames := s.replayFrames(sc)
+		if err := s.replays.Put(replayKey(sc.ID), bytes.NewReader(frames), int64(len(frames))); err != nil {
+			return fmt.Errorf("failed to write the replay of score %d: %w", sc.ID, err)
+		}
+	}
+	return nil
+}
+
+// seedTable returns the table a score is inserted into, and its mode there.
+func seedTable(score Score) (string, int) {
+	if cfg.SeedTarget != "old" {
+		return "scores", score.Mode
+	}
+	for i := len(SourceTables) - 1; i >= 0; i-- {
+		if t := SourceTables[i]; score.Mode >= t.ModeOffset {
+			return t.Name, score.Mode - t.ModeOffset
+		}
+	}
+	return SourceTables[0].Name, score.Mode
+}
+
+// generateScores plays every score, inserting them a batch at a time.
+func (s *seeder) generateScores(n int) error {
+	mods := make([]float64, len(seedMods))
+	total := 0.0
+	for i, m := range seedMods {
+		total += m.weight
+		mods[i] = total
+	}
+
+	batches := map[string][]Score{}
+	inserted := 0
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		u := &s.users[s.weighted(s.activity)]
+		mapIndex := s.pickMap(u.Skill)
+		m := &s.maps[mapIndex]
+		score := s.generateScore(u, m, s.pickMods(m.Mode, mods))
+		score.ID = s.nextID
+		s.nextID++
+
+		m.Plays++
+		st := s.stats[seedStatsKey{u.ID, score.Mode}]
+		if st == nil {
+			st = &seedStats{}
+			s.stats[seedStatsKey{u.ID, score.Mode}] = st
+		}
+		st.Plays++
+		st.Playtime += int64(score.TimeElapsed / 1000)
+		st.TScore += int64(score.Score)
+		st.TotalHits += int64(score.N300 + score.N100 + score.N50)
+		if score.Mode%4 == 1 || score.Mode%4 == 3 {
+			st.TotalHits += int64(score.Ngeki + score.Nkatu)
+		}
+
+		table, mode := seedTable(score)
+		if score.Status != 0 {
+			m.Passes++
+			if m.Status != 0 && score.MaxCombo > st.MaxCombo {
+				st.MaxCombo = score.MaxCombo
+			}
+			// as in bancho.py, the earlier score stays best when pp is tied
+			key := seedBestKey{u.ID, mapIndex, score.Mode}
+			if best := s.bests[key]; best == nil || float64(score.PP) > best.PP {
+				s.bests[key] = &seedBest{ID: score.ID, Table: table, PP: float64(score.PP),
+					Acc: float64(score.Acc), Score: score.Score, Grade: score.Grade, MapIndex: mapIndex}
+			}
+		}
+
+		score.Mode = mode
+		batches[table] = append(batches[table], score)
+		if len(batches[table]) == seedBatchSize {
+			if err := s.insertScores(table, batches[table]); err != nil {
+				return err
+			}
+			inserted += len(batches[table])
+			batches[table] = batches[table][:0]
+
+			if isInterrupted() {
+				return errInterrupted
+			}
+			if inserted%(seedBatchSize*50) == 0 {
+				logger.Info("seeding scores", "inserted", inserted, "of", n,
+					"elapsed", time.Since(start).Round(time.Second))
+			}
+		}
+	}
+	for table, batch := range batches {
+		if err := s.insertScores(table, batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markBests sets the status of each player's best score on a map to 2.
+func (s *seeder) markBests() error {
+	ids := map[string][]int64{}
+	for _, best := range s.bests {
+		ids[best.Table] = append(ids[best.Table], best.ID)
+	}
+	for table, ids := range ids {
+		for len(ids) != 0 {
+			n := seedBatchSize
+			if n > len(ids) {
+				n = len(ids)
+			}
+			query, args, err := sqlx.In(fmt.Sprintf("UPDATE %s SET status = 2 WHERE id IN (?)", table), ids[:n])
+			if err != nil {
+				return err
+			}
+			if err := throttle(n); err != nil {
+				return err
+			}
+			if _, err := DB.Exec(query, args...); err != nil {
+				return err
+			}
+			ids = ids[n:]
+		}
+	}
+	return nil
+}
+
+// insertUsers inserts the players, with their stats in every mode.
+func (s *seeder) insertUsers() error {
+	for batch := s.users; len(batch) != 0; {
+		n := seedBatchSize
+		if n > len(batch) {
+			n = len(batch)
+		}
+		var args []interface{}
+		for _, u := range batch[:n] {
+			safeName := strings.ReplaceAll(strings.ToLower(u.Name), " ", "_")
+			args = append(args, u.ID, u.Name, safeName, safeName+"@seed.invalid", 3,
+				strings.Repeat("_", 60), u.Country, u.Created, u.LastSeen)
+		}
+		if err := throttle(n); err != nil {
+			return err
+		}
+		_, err := DB.Exec(`INSERT INTO users (id, name, safe_name, email, priv, pw_bcrypt, country,
+			creation_time, latest_activity) VALUES `+placeholders(n, 9, func(int) string { return "?" }), args...)
+		if err != nil {
+			return fmt.Errorf("failed to insert users: %w", err)
+		}
+		batch = batch[n:]
+	}
+	return nil
+}
+
+// insertStats works out the players' stats from their scores, the same way
+// recalc stats & bancho.py do, including pp & grade counts.
+func (s *seeder) insertStats() error {
+	type ranked struct {
+		pps, accs []float64 // in order of pp, by which accuracy is weighted
+		rscore    int64
+		grades    map[string]int
+	}
+	var ordered []*seedBest
+	keys := map[*seedBest]seedStatsKey{}
+	for key, best := range s.bests {
+		if status := s.maps[best.MapIndex].Status; status == mapStatusRanked || status == mapStatusApproved {
+			ordered = append(ordered, best)
+			keys[best] = seedStatsKey{key.User, key.Mode}
+		}
+	}
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].PP > ordered[j].PP })
+
+	bests := map[seedStatsKey]*ranked{}
+	for _, best := range ordered {
+		r := bests[keys[best]]
+		if r == nil {
+			r = &ranked{grades: map[string]int{}}
+			bests[keys[best]] = r
+		}
+		r.pps = append(r.pps, best.PP)
+		r.accs = append(r.accs, best.Acc)
+		r.rscore += int64(best.Score)
+		r.grades[best.Grade]++
+	}
+
+	modes := make([]int, 0, len(statsModes))
+	for mode := range statsModes {
+		modes = append(modes, mode)
+	}
+	sort.Ints(modes)
+
+	var args []interface{}
+	rows := 0
+	flush := func() error {
+		if rows == 0 {
+			return nil
+		}
+		if err := throttle(rows); err != nil {
+			return err
+		}
+		_, err := DB.Exec(`INSERT INTO stats (id, mode, tscore, rscore, pp, plays, playtime, acc,
+			max_combo, total_hits, xh_count, x_count, sh_count, s_count, a_count) VALUES `+
+			placeholders(rows, 15, func(int) string { return "?" }), args...)
+		args, rows = args[:0], 0
+		return err
+	}
+	for _, u := range s.users {
+		for _, mode := range modes {
+			k := seedStatsKey{u.ID, mode}
+			st := s.stats[k]
+			if st == nil {
+				st = &seedStats{}
+			}
+			r := bests[k]
+			if r == nil {
+				r = &ranked{grades: map[string]int{}}
+			}
+			args = append(args, u.ID, mode, st.TScore, r.rscore, weightedPP(r.pps), st.Plays, st.Playtime,
+				weightedAccuracy(r.accs), st.MaxCombo, st.TotalHits,
+				r.grades["XH"], r.grades["X"], r.grades["SH"], r.grades["S"], r.grades["A"])
+			if rows++; rows == seedBatchSize {
+				if err := flush(); err != nil {
+					return fmt.Errorf("failed to insert stats: %w", err)
+				}
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return fmt.Errorf("failed to insert stats: %w", err)
+	}
+	return nil
+}
+
+// insertMaps inserts the beatmaps & their sets, with their play counts.
+func (s *seeder) insertMaps() error {
+	byID := make([]seedMap, len(s.maps))
+	copy(byID, s.maps)
+	sort.Slice(byID, func(i, j int) bool { return byID[i].ID < byID[j].ID })
+
+	for batch := byID; len(batch) != 0; {
+		n := seedBatchSize
+		if n > len(batch) {
+			n = len(batch)
+		}
+		var args []interface{}
+		for _, m := range batch[:n] {
+			artist, title := s.title(), s.title()
+			version := fmt.Sprintf("%s's %.1f*", seedWords[s.rng.Intn(len(seedWords))], m.Stars)
+			creator := s.users[s.rng.Intn(len(s.users))].Name
+			cs, ar, od, hp := 2+m.Stars/2, 5+m.Stars/1.5, 4+m.Stars/1.5, 3+m.Stars/2
+			args = append(args, "osu!", m.ID, m.SetID, m.Status, m.MD5, artist, title, version, creator,
+				fmt.Sprintf("%s - %s (%s) [%s].osu", artist, title, creator, version),
+				time.Unix(s.now-int64(s.rng.Intn(10*365*86400)), 0).Format("2006-01-02 15:04:05"),
+				m.Length, m.MaxCombo, 1, m.Plays, m.Passes, m.Mode, m.BPM,
+				math.Min(cs, 10), math.Min(ar, 10), math.Min(od, 10), math.Min(hp, 10), m.Stars)
+		}
+		if err := throttle(n); err != nil {
+			return err
+		}
+		_, err := DB.Exec(`INSERT INTO maps (server, id, set_id, status, md5, artist, title, version,
+			creator, filename, last_update, total_length, max_combo, frozen, plays, passes, mode,
+			bpm, cs, ar, od, hp, diff) VALUES `+
+			placeholders(n, 23, func(int) string { return "?" }), args...)
+		if err != nil {
+			return fmt.Errorf("failed to insert maps: %w", err)
+		}
+		batch = batch[n:]
+	}
+
+	_, err := DB.Exec(`
+	INSERT IGNORE INTO mapsets (server, id, last_osuapi_check)
+	SELECT DISTINCT 'osu!', set_id, NOW() FROM maps WHERE id > ?`, seedMapIDs)
+	return err
+}
+
+// seedScoreIDs finds the first id the scores can be given, past any in the
+// tables they're inserted into, and creates the old tables if need be.
+func seedScoreIDs() (int64, error) {
+	tables := []string{"scores"}
+	if cfg.SeedTarget == "old" {
+		tables = tables[:0]
+		for _, t := range SourceTables {
+			// the old tables have the same columns as the new one
+			create := strings.Replace(create_scores, "create table scores", "create table if not exists "+t.Name, 1)
+			if _, err := DB.Exec(create); err != nil {
+				return 0, err
+			}
+			tables = append(tables, t.Name)
+		}
+	} else if exists, err := tableExists("scores"); err != nil {
+		return 0, err
+	} else if !exists {
+		return 0, fmt.Errorf("there's no scores table, run migrate up first (or seed with --target old)")
+	}
+
+	// ids are unique across the old tables too, as their replays share a directory
+	var next int64 = 1
+	for _, table := range tables {
+		var id int64
+		if err := DB.Get(&id, fmt.Sprintf("SELECT COALESCE(MAX(id), 0) + 1 FROM %s", table)); err != nil {
+			return 0, err
+		}
+		if id > next {
+			next = id
+		}
+	}
+	return next, nil
+}
+
+func runSeed() error {
+	if cfg.SeedUsers < 1 || cfg.SeedMaps < 1 || cfg.SeedScores < 0 {
+		return fmt.Errorf("--users & --maps must be at least 1, and --scores at least 0")
+	}
+	if cfg.SeedTarget != "new" && cfg.SeedTarget != "old" {
+		return fmt.Errorf("--target %q must be new or old", cfg.SeedTarget)
+	}
+	if cfg.SeedDays < 1 {
+		return fmt.Errorf("--days must be at least 1")
+	}
+
+	nextID, err := seedScoreIDs()
+	if err != nil {
+		return err
+	}
+	var existingUsers int
+	if err := DB.Get(&existingUsers, "SELECT COUNT(*) FROM users"); err != nil {
+		return err
+	}
+
+	tables := "scores"
+	if cfg.SeedTarget == "old" {
+		tables = "scores_vn, scores_rx & scores_ap"
+	}
+	fmt.Printf("This adds %d users, %d beatmaps & %d scores (into %s) to the database %s,\n",
+		cfg.SeedUsers, cfg.SeedMaps, cfg.SeedScores, tables, cfg.DBName)
+	fmt.Printf("which already has %d users. It's meant for development instances only.\n", existingUsers)
+	if !confirm("Continue?") {
+		fmt.Println("Not seeding")
+		return nil
+	}
+
+	s := &seeder{
+		rng:    rand.New(rand.NewSource(cfg.SeedRandom)),
+		now:    time.Now().Unix(),
+		bests:  map[seedBestKey]*seedBest{},
+		stats:  map[seedStatsKey]*seedStats{},
+		nextID: nextID,
+	}
+	if cfg.SeedReplays {
+		if cfg.SeedReplayDir == "" {
+			s.replays = LocalStore{Dir: cfg.ReplayDirectory()}
+		} else if s.replays, err = openReplayStore(cfg.SeedReplayDir); err != nil {
+			return err
+		}
+	}
+
+	handleSignals()
+	start := time.Now()
+	if err := s.generateUsers(cfg.SeedUsers, cfg.SeedDays); err != nil {
+		return err
+	}
+	if err := s.generateMaps(cfg.SeedMaps); err != nil {
+		return err
+	}
+	if err := s.insertUsers(); err != nil {
+		return err
+	}
+	logger.Info("seeded users", "users", len(s.users))
+
+	if err := s.generateScores(cfg.SeedScores); err != nil {
+		return fmt.Errorf("%w, so some scores were seeded, without their maps or stats", err)
+	}
+	if err := s.markBests(); err != nil {
+		return err
+	}
+	logger.Info("seeded scores", "scores", cfg.SeedScores, "best", len(s.bests))
+
+	if err := s.insertMaps(); err != nil {
+		return err
+	}
+	if err := s.insertStats(); err != nil {
+		return err
+	}
+	logger.Info("seeded", "users", len(s.users), "maps", len(s.maps), "scores", cfg.SeedScores,
+		"elapsed", time.Since(start).Round(time.Second))
+	if existingUsers > 1 {
+		logger.Warn("the seeded players aren't on the leaderboards until they're rebuilt, with migrate cache rebuild")
+	}
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:              "seed",
+		Summary:           "fill a development database with synthetic users, beatmaps, scores & replays",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.IntVar(&c.SeedUsers, "users", 1000, "how many users to generate")
+			flags.IntVar(&c.SeedMaps, "maps", 2000, "how many beatmaps to generate")
+			flags.IntVar(&c.SeedScores, "scores", 100000, "how many scores to generate")
+			flags.IntVar(&c.SeedDays, "days", 3*365, "how many days of history to spread the users & scores over")
+			flags.Int64Var(&c.SeedRandom, "seed", 1, "the random seed, the same one generates the same data")
+			flags.StringVar(&c.SeedTarget, "target", "new", "the tables the scores go into: new (scores), or old (scores_vn, scores_rx & scores_ap, to benchmark the v4.2.0 migration)")
+			flags.BoolVar(&c.SeedReplays, "replays", true, "write a dummy replay for each passed score")
+			flags.StringVar(&c.SeedReplayDir, "replay-dir", "", "where the replays are written, a path or s3://bucket/prefix (default: DATA_DIRECTORY/osr)")
+		},
+		Run: runSeed,
+	})
+}
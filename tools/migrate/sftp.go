@@ -0,0 +1,708 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// a small sftp client, with just what backups need: uploading, listing,
+// downloading & deleting files. it speaks version 3 of the protocol (the
+// one openssh's server speaks) to the server's sftp subsystem, through the
+// ssh command, so ssh's config, keys & agent are used as they are, and an
+// account limited to sftp (e.g. by openssh's internal-sftp, in a chroot)
+// is enough. https://datatracker.ietf.org/doc/html/draft-ietf-secsh-filexfer-02
+
+// packet types
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpFstat    = 8
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpRemove   = 13
+	sftpMkdir    = 14
+	sftpStat     = 17
+	sftpRename   = 18
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpName     = 104
+	sftpAttrs    = 105
+	sftpExtended = 200
+)
+
+// open flags
+const (
+	sftpOpenRead   = 0x01
+	sftpOpenWrite  = 0x02
+	sftpOpenCreate = 0x08
+	sftpOpenTrunc  = 0x10
+)
+
+// status codes
+const (
+	sftpOK         = 0
+	sftpEOF        = 1
+	sftpNoSuchFile = 2
+)
+
+// files are read & written sftpChunk at a time, which every server
+// accepts. up to sftpWindow writes are sent ahead of their replies, so
+// uploads aren't held up by the round trip.
+const (
+	sftpChunk     = 32 * 1024
+	sftpWindow    = 64
+	sftpMaxPacket = 1 << 20
+)
+
+var errSFTPProtocol = errors.New("malformed sftp reply")
+
+// sftpError is a request's failure status.
+type sftpError struct {
+	Code    uint32
+	Message string
+}
+
+func (e *sftpError) Error() string {
+	return fmt.Sprintf("sftp status %d: %s", e.Code, e.Message)
+}
+
+// sftpPacket is a request being built, after its length.
+type sftpPacket []byte
+
+func (p sftpPacket) uint32(v uint32) sftpPacket { return binary.BigEndian.AppendUint32(p, v) }
+func (p sftpPacket) uint64(v uint64) sftpPacket { return binary.BigEndian.AppendUint64(p, v) }
+func (p sftpPacket) string(s string) sftpPacket { return append(p.uint32(uint32(len(s))), s...) }
+func (p sftpPacket) bytes(b []byte) sftpPacket  { return append(p.uint32(uint32(len(b))), b...) }
+
+// sftpFields reads a reply's fields. once they run out, every read is
+// zero, and err is set.
+type sftpFields struct {
+	b   []byte
+	err error
+}
+
+func (f *sftpFields) uint32() uint32 {
+	if len(f.b) < 4 {
+		f.b, f.err = nil, errSFTPProtocol
+		return 0
+	}
+	v := binary.BigEndian.Uint32(f.b)
+	f.b = f.b[4:]
+	return v
+}
+
+func (f *sftpFields) uint64() uint64 {
+	return uint64(f.uint32())<<32 | uint64(f.uint32())
+}
+
+func (f *sftpFields) string() string {
+	n := f.uint32()
+	if uint64(n) > uint64(len(f.b)) {
+		f.b, f.err = nil, errSFTPProtocol
+		return ""
+	}
+	s := string(f.b[:n])
+	f.b = f.b[n:]
+	return s
+}
+
+// attrs skips a file's attributes, returning its size.
+func (f *sftpFields) attrs() uint64 {
+	var size uint64
+	flags := f.uint32()
+	if flags&0x1 != 0 {
+		size = f.uint64()
+	}
+	if flags&0x2 != 0 { // uid & gid
+		f.uint64()
+	}
+	if flags&0x4 != 0 { // permissions
+		f.uint32()
+	}
+	if flags&0x8 != 0 { // atime & mtime
+		f.uint64()
+	}
+	if flags&0x80000000 != 0 {
+		for n := f.uint32(); n > 0 && f.err == nil; n-- {
+			f.string()
+			f.string()
+		}
+	}
+	return size
+}
+
+// status reads a reply which is only a status, returning its failure, or
+// io.EOF at the end of a file or directory.
+func (f *sftpFields) status(typ byte) error {
+	if typ != sftpStatus {
+		return errSFTPProtocol
+	}
+	code, message := f.uint32(), f.string()
+	switch {
+	case f.err != nil:
+		return f.err
+	case code == sftpOK:
+		return nil
+	case code == sftpEOF:
+		return io.EOF
+	case code == sftpNoSuchFile:
+		return fmt.Errorf("%w: %v", os.ErrNotExist, &sftpError{code, message})
+	}
+	return &sftpError{code, message}
+}
+
+// sftpClient is a session with a server. it isn't safe for concurrent use.
+type sftpClient struct {
+	host   string
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	stderr bytes.Buffer
+	err    error // why the session ended, after which every request fails
+
+	nextID      uint32
+	pending     map[uint32]*error // writes sent ahead, and where their failure goes
+	posixRename bool              // the server can rename over an existing file
+}
+
+func dialSFTP(host, port string) (*sftpClient, error) {
+	args := []string{"-o", "BatchMode=yes", "-s"}
+	if port != "" {
+		args = append(args, "-p", port)
+	}
+	// -- so the host can't be taken for one of ssh's options
+	cmd := exec.Command("ssh", append(args, "--", host, "sftp")...)
+	c := &sftpClient{host: host, cmd: cmd, pending: map[uint32]*error{}}
+	cmd.Stderr = &c.stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	c.stdin, c.stdout = stdin, bufio.NewReaderSize(stdout, sftpChunk+1024)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	// the version exchange has no request id
+	if err := c.send(sftpPacket{0, 0, 0, 0, sftpInit}.uint32(3)); err != nil {
+		return nil, err
+	}
+	typ, data, err := c.receive()
+	if err != nil {
+		return nil, err
+	}
+	fields := &sftpFields{b: data}
+	if version := fields.uint32(); typ != sftpVersion || version < 3 {
+		return nil, c.end(fmt.Errorf("the server doesn't speak sftp version 3 (it sent %d, version %d)", typ, version))
+	}
+	for len(fields.b) != 0 && fields.err == nil {
+		name, value := fields.string(), fields.string()
+		if name == "posix-rename@openssh.com" && value == "1" {
+			c.posixRename = true
+		}
+	}
+	return c, nil
+}
+
+// end ends the session after an error it can't carry on from, with what
+// ssh said about it.
+func (c *sftpClient) end(err error) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.stdin.Close()
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+	if msg := strings.TrimSpace(c.stderr.String()); msg != "" {
+		err = fmt.Errorf("%w: %s", err, msg)
+	}
+	c.err = fmt.Errorf("sftp %s: %w", c.host, err)
+	return c.err
+}
+
+// packet starts a request with a new id.
+func (c *sftpClient) packet(typ byte) (sftpPacket, uint32) {
+	c.nextID++
+	return sftpPacket{0, 0, 0, 0, typ}.uint32(c.nextID), c.nextID
+}
+
+func (c *sftpClient) send(p sftpPacket) error {
+	if c.err != nil {
+		return c.err
+	}
+	binary.BigEndian.PutUint32(p, uint32(len(p)-4))
+	if _, err := c.stdin.Write(p); err != nil {
+		return c.end(err)
+	}
+	return nil
+}
+
+func (c *sftpClient) receive() (byte, []byte, error) {
+	if c.err != nil {
+		return 0, nil, c.err
+	}
+	var header [5]byte
+	if _, err := io.ReadFull(c.stdout, header[:]); err != nil {
+		return 0, nil, c.end(err)
+	}
+	n := binary.BigEndian.Uint32(header[:4])
+	if n < 1 || n > sftpMaxPacket {
+		return 0, nil, c.end(errSFTPProtocol)
+	}
+	data := make([]byte, n-1)
+	if _, err := io.ReadFull(c.stdout, data); err != nil {
+		return 0, nil, c.end(err)
+	}
+	return header[4], data, nil
+}
+
+// next reads the next reply. replies to writes sent ahead are taken care of
+// here, leaving their failure where the write asked.
+func (c *sftpClient) next() (uint32, byte, *sftpFields, error) {
+	for {
+		typ, data, err := c.receive()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		fields := &sftpFields{b: data}
+		id := fields.uint32()
+		if fields.err != nil {
+			return 0, 0, nil, c.end(fields.err)
+		}
+		failed, ok := c.pending[id]
+		if !ok {
+			return id, typ, fields, nil
+		}
+		delete(c.pending, id)
+		if err := fields.status(typ); err != nil && *failed == nil {
+			*failed = err
+		}
+	}
+}
+
+// request sends a request, and waits for its reply.
+func (c *sftpClient) request(p sftpPacket, id uint32) (byte, *sftpFields, error) {
+	if err := c.send(p); err != nil {
+		return 0, nil, err
+	}
+	replyID, typ, fields, err := c.next()
+	if err != nil {
+		return 0, nil, err
+	}
+	if replyID != id {
+		return 0, nil, c.end(errSFTPProtocol)
+	}
+	return typ, fields, nil
+}
+
+// settle waits for the replies to every write sent ahead.
+func (c *sftpClient) settle() error {
+	for len(c.pending) != 0 {
+		if c.err != nil {
+			return c.err
+		}
+		// a probe, so next returns once everything before it was replied to
+		p, id := c.packet(sftpStat)
+		if _, _, err := c.request(p.string("."), id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeAhead sends a write without waiting for its reply. if it fails,
+// failed is set, unless it already was.
+func (c *sftpClient) writeAhead(handle string, offset uint64, data []byte, failed *error) error {
+	for len(c.pending) >= sftpWindow {
+		if err := c.settle(); err != nil {
+			return err
+		}
+	}
+	p, id := c.packet(sftpWrite)
+	if err := c.send(p.string(handle).uint64(offset).bytes(data)); err != nil {
+		return err
+	}
+	c.pending[id] = failed
+	return nil
+}
+
+// call sends a request whose reply is only a status.
+func (c *sftpClient) call(p sftpPacket, id uint32) error {
+	typ, fields, err := c.request(p, id)
+	if err != nil {
+		return err
+	}
+	return fields.status(typ)
+}
+
+// handle reads a reply which is a handle, or a failure.
+func (c *sftpClient) handle(p sftpPacket, id uint32) (string, error) {
+	typ, fields, err := c.request(p, id)
+	if err != nil {
+		return "", err
+	}
+	if typ != sftpHandle {
+		return "", fields.status(typ)
+	}
+	handle := fields.string()
+	return handle, fields.err
+}
+
+func (c *sftpClient) open(name string, flags uint32) (string, error) {
+	p, id := c.packet(sftpOpen)
+	return c.handle(p.string(name).uint32(flags).uint32(0), id)
+}
+
+func (c *sftpClient) close(handle string) error {
+	p, id := c.packet(sftpClose)
+	return c.call(p.string(handle), id)
+}
+
+// read reads up to n bytes at offset, or io.EOF past the end of the file.
+func (c *sftpClient) read(handle string, offset uint64, n int) ([]byte, error) {
+	p, id := c.packet(sftpRead)
+	typ, fields, err := c.request(p.string(handle).uint64(offset).uint32(uint32(n)), id)
+	if err != nil {
+		return nil, err
+	}
+	if typ != sftpData {
+		if err := fields.status(typ); err != nil {
+			return nil, err
+		}
+		return nil, errSFTPProtocol
+	}
+	data := fields.string()
+	return []byte(data), fields.err
+}
+
+// size is the size of an open file.
+func (c *sftpClient) size(handle string) (uint64, error) {
+	p, id := c.packet(sftpFstat)
+	typ, fields, err := c.request(p.string(handle), id)
+	if err != nil {
+		return 0, err
+	}
+	if typ != sftpAttrs {
+		return 0, fields.status(typ)
+	}
+	size := fields.attrs()
+	return size, fields.err
+}
+
+func (c *sftpClient) stat(name string) error {
+	p, id := c.packet(sftpStat)
+	typ, fields, err := c.request(p.string(name), id)
+	if err != nil {
+		return err
+	}
+	if typ != sftpAttrs {
+		return fields.status(typ)
+	}
+	return nil
+}
+
+// mkdirAll creates a directory, and any of its parents which don't exist.
+func (c *sftpClient) mkdirAll(dir string) error {
+	if dir == "." || dir == "/" {
+		return nil
+	}
+	err := c.stat(dir)
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := c.mkdirAll(path.Dir(dir)); err != nil {
+		return err
+	}
+	p, id := c.packet(sftpMkdir)
+	return c.call(p.string(dir).uint32(0), id)
+}
+
+func (c *sftpClient) remove(name string) error {
+	p, id := c.packet(sftpRemove)
+	return c.call(p.string(name), id)
+}
+
+// rename renames a file, replacing the file at to, if there's one.
+func (c *sftpClient) rename(from, to string) error {
+	if c.posixRename {
+		p, id := c.packet(sftpExtended)
+		return c.call(p.string("posix-rename@openssh.com").string(from).string(to), id)
+	}
+	// version 3's rename fails if to exists
+	if err := c.remove(to); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	p, id := c.packet(sftpRename)
+	return c.call(p.string(from).string(to), id)
+}
+
+// list lists the names in a directory, other than . & ..
+func (c *sftpClient) list(dir string) ([]string, error) {
+	p, id := c.packet(sftpOpendir)
+	handle, err := c.handle(p.string(dir), id)
+	if err != nil {
+		return nil, err
+	}
+	defer c.close(handle)
+
+	var names []string
+	for {
+		p, id := c.packet(sftpReaddir)
+		typ, fields, err := c.request(p.string(handle), id)
+		if err != nil {
+			return nil, err
+		}
+		if typ != sftpName {
+			if err := fields.status(typ); err != io.EOF {
+				return nil, err
+			}
+			return names, nil
+		}
+		for n := fields.uint32(); n > 0 && fields.err == nil; n-- {
+			name := fields.string()
+			fields.string() // ls -l's line
+			fields.attrs()
+			if name != "." && name != ".." {
+				names = append(names, name)
+			}
+		}
+		if fields.err != nil {
+			return nil, fields.err
+		}
+	}
+}
+
+// SFTPDestination keeps backups in a directory of another server. the
+// session is started on first use, and again after it fails.
+type SFTPDestination struct {
+	host string // [user@]host
+	port string
+	dir  string
+
+	mu      sync.Mutex
+	session *sftpClient
+	created bool // dir exists
+}
+
+func openSFTPDestination(u *url.URL) (*SFTPDestination, error) {
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid sftp destination %q, expected sftp://user@host:port/path", u.String())
+	}
+	host := u.Hostname()
+	if u.User != nil {
+		host = u.User.Username() + "@" + host
+	}
+	// relative to the account's home (or chroot), as with the sftp command
+	dir := strings.TrimPrefix(u.Path, "/")
+	if dir == "" {
+		dir = "."
+	}
+	return &SFTPDestination{host: host, port: u.Port(), dir: dir}, nil
+}
+
+// client returns the session, starting one if needed. d.mu must be held.
+func (d *SFTPDestination) client() (*sftpClient, error) {
+	if d.session == nil || d.session.err != nil {
+		c, err := dialSFTP(d.host, d.port)
+		if err != nil {
+			return nil, err
+		}
+		d.session = c
+	}
+	return d.session, nil
+}
+
+type sftpUpload struct {
+	d      *SFTPDestination
+	c      *sftpClient
+	path   string
+	handle string
+	buf    []byte
+	offset uint64
+	err    error // the first write which failed
+}
+
+func (d *SFTPDestination) Create(name string, _ map[string]string) (BackupUpload, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, err := d.client()
+	if err != nil {
+		return nil, err
+	}
+	if !d.created {
+		if err := c.mkdirAll(d.dir); err != nil {
+			return nil, fmt.Errorf("failed to create %s: %w", d.dir, err)
+		}
+		d.created = true
+	}
+	p := path.Join(d.dir, name)
+	handle, err := c.open(p+".tmp", sftpOpenWrite|sftpOpenCreate|sftpOpenTrunc)
+	if err != nil {
+		return nil, err
+	}
+	return &sftpUpload{d: d, c: c, path: p, handle: handle, buf: make([]byte, 0, sftpChunk)}, nil
+}
+
+func (u *sftpUpload) Write(p []byte) (int, error) {
+	u.d.mu.Lock()
+	defer u.d.mu.Unlock()
+	n := len(p)
+	for len(p) != 0 {
+		if u.err != nil {
+			return 0, u.err
+		}
+		k := copy(u.buf[len(u.buf):cap(u.buf)], p)
+		u.buf, p = u.buf[:len(u.buf)+k], p[k:]
+		if len(u.buf) == cap(u.buf) {
+			if err := u.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flush sends what's buffered. u.d.mu must be held.
+func (u *sftpUpload) flush() error {
+	if len(u.buf) == 0 {
+		return nil
+	}
+	if err := u.c.writeAhead(u.handle, u.offset, u.buf, &u.err); err != nil {
+		return err
+	}
+	u.offset += uint64(len(u.buf))
+	u.buf = u.buf[:0]
+	return nil
+}
+
+// Commit moves the file into place once every write succeeded, and the
+// server has all of it. ssh verifies every packet, so what arrived is what
+// was sent.
+func (u *sftpUpload) Commit() error {
+	u.d.mu.Lock()
+	defer u.d.mu.Unlock()
+	err := u.flush()
+	if err == nil {
+		err = u.c.settle()
+	}
+	if err == nil {
+		err = u.err
+	}
+	var size uint64
+	if err == nil {
+		size, err = u.c.size(u.handle)
+	}
+	if closeErr := u.c.close(u.handle); err == nil {
+		err = closeErr
+	}
+	if err == nil && size != u.offset {
+		err = fmt.Errorf("%s.tmp is %d bytes on the server, but %d were sent", u.path, size, u.offset)
+	}
+	if err == nil {
+		err = u.c.rename(u.path+".tmp", u.path)
+	}
+	if err != nil {
+		u.c.remove(u.path + ".tmp")
+		return err
+	}
+	return nil
+}
+
+func (u *sftpUpload) Abort() {
+	u.d.mu.Lock()
+	defer u.d.mu.Unlock()
+	u.c.settle()
+	u.c.close(u.handle)
+	u.c.remove(u.path + ".tmp")
+}
+
+type sftpFile struct {
+	d      *SFTPDestination
+	c      *sftpClient
+	handle string
+	offset uint64
+}
+
+func (d *SFTPDestination) Open(name string) (io.ReadCloser, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, err := d.client()
+	if err != nil {
+		return nil, err
+	}
+	handle, err := c.open(path.Join(d.dir, name), sftpOpenRead)
+	if err != nil {
+		return nil, err
+	}
+	return &sftpFile{d: d, c: c, handle: handle}, nil
+}
+
+func (f *sftpFile) Read(p []byte) (int, error) {
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+	data, err := f.c.read(f.handle, f.offset, min(len(p), sftpChunk))
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, data)
+	f.offset += uint64(n)
+	return n, nil
+}
+
+func (f *sftpFile) Close() error {
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+	return f.c.close(f.handle)
+}
+
+func (d *SFTPDestination) List() ([]string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, err := d.client()
+	if err != nil {
+		return nil, err
+	}
+	names, err := c.list(d.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	sort.Strings(names)
+	return names, err
+}
+
+func (d *SFTPDestination) Delete(name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, err := d.client()
+	if err != nil {
+		return err
+	}
+	if err := c.remove(path.Join(d.dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (d *SFTPDestination) Location(name string) string {
+	return fmt.Sprintf("sftp://%s/%s", d.host, path.Join(d.dir, name))
+}
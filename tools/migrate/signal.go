@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// errInterrupted is returned by commands which were stopped early by
+// SIGINT or SIGTERM, after leaving everything in a resumable state.
+var errInterrupted = errors.New("interrupted")
+
+// interrupted is closed once SIGINT or SIGTERM is received.
+var interrupted = make(chan struct{})
+
+// handleSignals makes the first SIGINT or SIGTERM stop the migration
+// gracefully: no new chunks are started, chunks already being inserted are
+// committed (along with their replay moves & checkpoints), and the command
+// returns errInterrupted. a second signal exits immediately, in which case
+// mysql rolls back whatever was uncommitted.
+func handleSignals() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		logger.Warn("stopping, waiting for in-flight chunks to finish (send the signal again to exit immediately)", "signal", sig)
+		close(interrupted)
+
+		sig = <-signals
+		logger.Error("exiting immediately, uncommitted chunks will be rolled back", "signal", sig)
+		writeLogSummary(cfg.LogFile)
+		os.Exit(exitInterrupted)
+	}()
+}
+
+func isInterrupted() bool {
+	select {
+	case <-interrupted:
+		return true
+	default:
+		return false
+	}
+}
+
+// printResumeState logs where each table will be resumed from.
+func printResumeState(tables []SourceTable) {
+	for _, table := range tables {
+		lastID, err := loadCheckpoint(table)
+		if err != nil {
+			logger.Error("failed to load checkpoint", "table", table.Name, "err", err)
+			continue
+		}
+		logger.Info("table will resume from checkpoint", "table", table.Name, "after_id", lastID)
+	}
+	logger.Warn("stopped before finishing, run the same command again with --resume to continue")
+}
@@ -0,0 +1,794 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// export snapshot writes the scores & stats tables to a compact binary file,
+// which import snapshot loads into another instance's database. it's a
+// fraction of the size of a sql dump of them, and much quicker to write &
+// load, for moving a server, or seeding a staging copy of it.
+//
+// a snapshot is "BPYSNAP", a byte of the format's version, then a gzipped
+// stream of records, each a varint of its length followed by a Record in
+// protobuf's encoding, so that it can be read by other tools too:
+//
+//	message Record {
+//	  oneof record {
+//	    Header header = 1;   // the first record
+//	    Score score = 2;
+//	    Stats stats = 3;
+//	    Trailer trailer = 4; // the last record
+//	  }
+//	}
+//	message Header {
+//	  int64 created_at = 1; // unix time
+//	  string source = 2;    // the database it was taken from
+//	  repeated string tables = 3;
+//	}
+//	message Score {
+//	  // scores' columns, numbered in scoreColumns' order from 1, where
+//	  // floats are float, map_md5, grade & online_checksum are strings,
+//	  // the rest int64s, and play_time is its wall clock time, in seconds
+//	  // since 1970-01-01 00:00:00, so it doesn't shift between time zones
+//	}
+//	message Stats {
+//	  // stats' columns, numbered in statsColumns' order from 1
+//	}
+//	message Trailer {
+//	  int64 scores = 1; // records written, to tell a truncated file
+//	  int64 stats = 2;
+//	}
+//
+// fields are only ever added, and unknown fields are skipped, so older
+// versions of this tool read newer snapshots of the same format version.
+//
+// scores & stats keep their ids, so the instance imported into should have
+// the same players, and no scores of its own with those ids. rows already
+// in its database are kept as they are, unless --replace is given; stats
+// rows are created as players register, so stats need --replace.
+
+// the snapshot format's version, raised when a field's meaning changes
+const snapshotVersion = 1
+
+const snapshotMagic = "BPYSNAP"
+
+// records larger than this are corrupt
+const maxSnapshotRecord = 1 << 20
+
+var snapshotTables = []string{"scores", "stats"}
+
+// the record kinds, by field number
+const (
+	recordHeader = iota + 1
+	recordScore
+	recordStats
+	recordTrailer
+)
+
+var errCorruptSnapshot = errors.New("the snapshot is corrupt")
+
+var statsColumns = []string{
+	"id", "mode", "tscore", "rscore", "pp", "plays", "playtime", "acc", "max_combo",
+	"total_hits", "replay_views", "xh_count", "x_count", "sh_count", "s_count", "a_count",
+}
+
+// SnapshotStats is a row of the stats table.
+type SnapshotStats struct {
+	ID          int64
+	Mode        int64
+	TScore      int64 `db:"tscore"`
+	RScore      int64 `db:"rscore"`
+	PP          int64
+	Plays       int64
+	Playtime    int64
+	Acc         float32
+	MaxCombo    int64 `db:"max_combo"`
+	TotalHits   int64 `db:"total_hits"`
+	ReplayViews int64 `db:"replay_views"`
+	XHCount     int64 `db:"xh_count"`
+	XCount      int64 `db:"x_count"`
+	SHCount     int64 `db:"sh_count"`
+	SCount      int64 `db:"s_count"`
+	ACount      int64 `db:"a_count"`
+}
+
+// ints are the stats' integer columns, by their field number.
+func (s *SnapshotStats) ints() map[int]*int64 {
+	return map[int]*int64{
+		1: &s.ID, 2: &s.Mode, 3: &s.TScore, 4: &s.RScore, 5: &s.PP, 6: &s.Plays, 7: &s.Playtime,
+		9: &s.MaxCombo, 10: &s.TotalHits, 11: &s.ReplayViews, 12: &s.XHCount, 13: &s.XCount,
+		14: &s.SHCount, 15: &s.SCount, 16: &s.ACount,
+	}
+}
+
+// values are the stats' columns, in statsColumns' order.
+func (s *SnapshotStats) values() []interface{} {
+	return []interface{}{
+		s.ID, s.Mode, s.TScore, s.RScore, s.PP, s.Plays, s.Playtime, s.Acc, s.MaxCombo,
+		s.TotalHits, s.ReplayViews, s.XHCount, s.XCount, s.SHCount, s.SCount, s.ACount,
+	}
+}
+
+// SnapshotHeader describes a snapshot.
+type SnapshotHeader struct {
+	CreatedAt int64
+	Source    string
+	Tables    []string
+}
+
+// protoBuffer builds a protobuf message. zero values are left out, as
+// proto3 does.
+type protoBuffer []byte
+
+func (b *protoBuffer) tag(field, wire int) {
+	*b = binary.AppendUvarint(*b, uint64(field<<3|wire))
+}
+
+func (b *protoBuffer) int(field int, v int64) {
+	if v != 0 {
+		b.tag(field, 0)
+		*b = binary.AppendUvarint(*b, uint64(v))
+	}
+}
+
+func (b *protoBuffer) float(field int, v float32) {
+	if v != 0 {
+		b.tag(field, 5)
+		*b = binary.LittleEndian.AppendUint32(*b, math.Float32bits(v))
+	}
+}
+
+func (b *protoBuffer) string(field int, v string) {
+	if v != "" {
+		b.bytes(field, []byte(v))
+	}
+}
+
+// bytes appends bytes, or an embedded message, even when empty.
+func (b *protoBuffer) bytes(field int, v []byte) {
+	b.tag(field, 2)
+	*b = binary.AppendUvarint(*b, uint64(len(v)))
+	*b = append(*b, v...)
+}
+
+// protoField is a field read from a message: its number, and its varint or
+// fixed value, or its bytes.
+type protoField struct {
+	Num   int
+	Value uint64
+	Data  []byte
+}
+
+func (f protoField) int() int64     { return int64(f.Value) }
+func (f protoField) float() float32 { return math.Float32frombits(uint32(f.Value)) }
+func (f protoField) string() string { return string(f.Data) }
+
+// readProtoFields calls fn with each field of a message.
+func readProtoFields(b []byte, fn func(f protoField) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errCorruptSnapshot
+		}
+		b = b[n:]
+		f := protoField{Num: int(key >> 3)}
+		switch key & 7 {
+		case 0:
+			if f.Value, n = binary.Uvarint(b); n <= 0 {
+				return errCorruptSnapshot
+			}
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return errCorruptSnapshot
+			}
+			f.Value, b = binary.LittleEndian.Uint64(b), b[8:]
+		case 2:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < length {
+				return errCorruptSnapshot
+			}
+			f.Data, b = b[n:n+int(length)], b[n+int(length):]
+		case 5:
+			if len(b) < 4 {
+				return errCorruptSnapshot
+			}
+			f.Value, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		default:
+			return errCorruptSnapshot
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeScore(b *protoBuffer, s *Score) {
+	b.int(1, s.ID)
+	b.string(2, s.MapMD5)
+	b.int(3, int64(s.Score))
+	b.float(4, s.PP)
+	b.float(5, s.Acc)
+	for i, v := range []int{s.MaxCombo, s.Mods, s.N300, s.N100, s.N50, s.Nmiss, s.Ngeki, s.Nkatu} {
+		b.int(6+i, int64(v))
+	}
+	b.string(14, s.Grade)
+	b.int(15, int64(s.Status))
+	b.int(16, int64(s.Mode))
+	b.int(17, s.PlayTime)
+	b.int(18, int64(s.TimeElapsed))
+	b.int(19, int64(s.ClientFlags))
+	b.int(20, s.UserID)
+	b.int(21, int64(s.Perfect))
+	b.string(22, s.OnlineChecksum.String)
+}
+
+func decodeScore(data []byte) (Score, error) {
+	s := Score{OnlineChecksum: sql.NullString{Valid: true}}
+	hits := []*int{&s.MaxCombo, &s.Mods, &s.N300, &s.N100, &s.N50, &s.Nmiss, &s.Ngeki, &s.Nkatu}
+	err := readProtoFields(data, func(f protoField) error {
+		switch f.Num {
+		case 1:
+			s.ID = f.int()
+		case 2:
+			s.MapMD5 = f.string()
+		case 3:
+			s.Score = int(f.int())
+		case 4:
+			s.PP = f.float()
+		case 5:
+			s.Acc = f.float()
+		case 6, 7, 8, 9, 10, 11, 12, 13:
+			*hits[f.Num-6] = int(f.int())
+		case 14:
+			s.Grade = f.string()
+		case 15:
+			s.Status = int(f.int())
+		case 16:
+			s.Mode = int(f.int())
+		case 17:
+			s.PlayTime = f.int()
+		case 18:
+			s.TimeElapsed = int(f.int())
+		case 19:
+			s.ClientFlags = int(f.int())
+		case 20:
+			s.UserID = f.int()
+		case 21:
+			s.Perfect = int(f.int())
+		case 22:
+			s.OnlineChecksum.String = f.string()
+		}
+		return nil
+	})
+	if s.Grade == "" {
+		s.Grade = "N"
+	}
+	return s, err
+}
+
+func encodeStats(b *protoBuffer, s *SnapshotStats) {
+	ints := s.ints()
+	for field := 1; field <= len(statsColumns); field++ {
+		if v, ok := ints[field]; ok {
+			b.int(field, *v)
+		}
+	}
+	b.float(8, s.Acc)
+}
+
+func decodeStats(data []byte) (SnapshotStats, error) {
+	var s SnapshotStats
+	ints := s.ints()
+	err := readProtoFields(data, func(f protoField) error {
+		if v, ok := ints[f.Num]; ok {
+			*v = f.int()
+		} else if f.Num == 8 {
+			s.Acc = f.float()
+		}
+		return nil
+	})
+	return s, err
+}
+
+// snapshotWriter writes a snapshot's records.
+type snapshotWriter struct {
+	gz     *gzip.Writer
+	w      *bufio.Writer
+	record protoBuffer
+	inner  protoBuffer
+	counts map[int]int64
+}
+
+func newSnapshotWriter(w io.Writer) (*snapshotWriter, error) {
+	if _, err := w.Write(append([]byte(snapshotMagic), snapshotVersion)); err != nil {
+		return nil, err
+	}
+	gz := gzip.NewWriter(w)
+	return &snapshotWriter{gz: gz, w: bufio.NewWriterSize(gz, 1<<16), counts: map[int]int64{}}, nil
+}
+
+// write writes the record built in inner.
+func (sw *snapshotWriter) write(kind int) error {
+	sw.record = sw.record[:0]
+	sw.record.bytes(kind, sw.inner)
+	var length [binary.MaxVarintLen64]byte
+	if _, err := sw.w.Write(length[:binary.PutUvarint(length[:], uint64(len(sw.record)))]); err != nil {
+		return err
+	}
+	_, err := sw.w.Write(sw.record)
+	sw.inner = sw.inner[:0]
+	sw.counts[kind]++
+	return err
+}
+
+func (sw *snapshotWriter) Header(h SnapshotHeader) error {
+	sw.inner.int(1, h.CreatedAt)
+	sw.inner.string(2, h.Source)
+	for _, table := range h.Tables {
+		sw.inner.bytes(3, []byte(table))
+	}
+	return sw.write(recordHeader)
+}
+
+func (sw *snapshotWriter) Score(s *Score) error {
+	encodeScore(&sw.inner, s)
+	return sw.write(recordScore)
+}
+
+func (sw *snapshotWriter) Stats(s *SnapshotStats) error {
+	encodeStats(&sw.inner, s)
+	return sw.write(recordStats)
+}
+
+// Close writes the trailer, and flushes the snapshot.
+func (sw *snapshotWriter) Close() error {
+	sw.inner.int(1, sw.counts[recordScore])
+	sw.inner.int(2, sw.counts[recordStats])
+	if err := sw.write(recordTrailer); err != nil {
+		return err
+	}
+	if err := sw.w.Flush(); err != nil {
+		return err
+	}
+	return sw.gz.Close()
+}
+
+// snapshotReader reads a snapshot's records.
+type snapshotReader struct {
+	gz     *gzip.Reader
+	r      *bufio.Reader
+	buf    []byte
+	Header SnapshotHeader
+	counts map[int]int64
+}
+
+// openSnapshot checks the snapshot's format, and reads its header.
+func openSnapshot(r io.Reader) (*snapshotReader, error) {
+	magic := make([]byte, len(snapshotMagic)+1)
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, errors.New("not a snapshot, as written by export snapshot")
+	}
+	if version := magic[len(snapshotMagic)]; version > snapshotVersion {
+		return nil, fmt.Errorf("the snapshot's format is version %d, which this version of the tool can't read (only up to %d)", version, snapshotVersion)
+	}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errCorruptSnapshot, err)
+	}
+	sr := &snapshotReader{gz: gz, r: bufio.NewReaderSize(gz, 1<<16), counts: map[int]int64{}}
+
+	kind, data, err := sr.next()
+	if err == nil && kind != recordHeader {
+		err = errCorruptSnapshot
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = readProtoFields(data, func(f protoField) error {
+		switch f.Num {
+		case 1:
+			sr.Header.CreatedAt = f.int()
+		case 2:
+			sr.Header.Source = f.string()
+		case 3:
+			sr.Header.Tables = append(sr.Header.Tables, f.string())
+		}
+		return nil
+	})
+	return sr, err
+}
+
+// next reads the next record, returning its kind & message, which is only
+// valid until the next call. it returns io.EOF after the trailer, once the
+// trailer's counts have been checked.
+func (sr *snapshotReader) next() (int, []byte, error) {
+	length, err := binary.ReadUvarint(sr.r)
+	if err == io.EOF {
+		return 0, nil, fmt.Errorf("%w: it ends without a trailer, so was cut short", errCorruptSnapshot)
+	} else if err != nil {
+		return 0, nil, fmt.Errorf("%w: %v", errCorruptSnapshot, err)
+	}
+	if length > maxSnapshotRecord {
+		return 0, nil, errCorruptSnapshot
+	}
+	sr.buf = slices.Grow(sr.buf[:0], int(length))[:length]
+	if _, err := io.ReadFull(sr.r, sr.buf); err != nil {
+		return 0, nil, fmt.Errorf("%w: %v", errCorruptSnapshot, err)
+	}
+
+	var kind int
+	var data []byte
+	err = readProtoFields(sr.buf, func(f protoField) error {
+		kind, data = f.Num, f.Data
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	if kind != recordTrailer {
+		sr.counts[kind]++
+		return kind, data, nil
+	}
+
+	var want [2]int64
+	err = readProtoFields(data, func(f protoField) error {
+		if f.Num == 1 || f.Num == 2 {
+			want[f.Num-1] = f.int()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	if want[0] != sr.counts[recordScore] || want[1] != sr.counts[recordStats] {
+		return 0, nil, fmt.Errorf("%w: it should have %d scores & %d stats, but has %d & %d",
+			errCorruptSnapshot, want[0], want[1], sr.counts[recordScore], sr.counts[recordStats])
+	}
+	// reading to the end checks gzip's checksum
+	if _, err := io.Copy(io.Discard, sr.r); err != nil {
+		return 0, nil, fmt.Errorf("%w: %v", errCorruptSnapshot, err)
+	}
+	return 0, nil, io.EOF
+}
+
+// selectedSnapshotTables is the tables given by --tables.
+func selectedSnapshotTables() ([]string, error) {
+	if cfg.SnapshotTables == "" {
+		return snapshotTables, nil
+	}
+	tables := strings.Split(cfg.SnapshotTables, ",")
+	for _, table := range tables {
+		if !slices.Contains(snapshotTables, table) {
+			return nil, fmt.Errorf("--tables: %s can't be snapshotted, only %s", table, strings.Join(snapshotTables, " & "))
+		}
+	}
+	return tables, nil
+}
+
+// snapshotModeFilter is the WHERE of --mode, if given.
+func snapshotModeFilter() (string, []interface{}) {
+	if cfg.RecalcMode < 0 {
+		return "", nil
+	}
+	return " WHERE mode = ?", []interface{}{cfg.RecalcMode}
+}
+
+// exportSnapshotRows writes one of the tables' rows, in the transaction the
+// snapshot's read in.
+func exportSnapshotRows(tx *sqlx.Tx, sw *snapshotWriter, table string) error {
+	where, args := snapshotModeFilter()
+	var query string
+	switch table {
+	case "scores":
+		query = `
+		SELECT id, map_md5, score, pp, acc, max_combo, mods, n300, n100, n50, nmiss, ngeki, nkatu,
+		grade, status, mode, TIMESTAMPDIFF(SECOND, '1970-01-01', play_time) AS play_time,
+		time_elapsed, client_flags, userid, perfect, online_checksum FROM scores` + where + ` ORDER BY id`
+	case "stats":
+		query = "SELECT " + strings.Join(statsColumns, ", ") + " FROM stats" + where + " ORDER BY id, mode"
+	}
+	rows, err := tx.Queryx(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		if n++; n%BatchSize == 0 && isInterrupted() {
+			return errInterrupted
+		}
+		switch table {
+		case "scores":
+			var s Score
+			if err := rows.StructScan(&s); err != nil {
+				return err
+			}
+			err = sw.Score(&s)
+		case "stats":
+			var s SnapshotStats
+			if err := rows.StructScan(&s); err != nil {
+				return err
+			}
+			err = sw.Stats(&s)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func runExportSnapshot() error {
+	if cfg.SnapshotPath == "" {
+		return errors.New("--out is required")
+	}
+	tables, err := selectedSnapshotTables()
+	if err != nil {
+		return err
+	}
+
+	handleSignals()
+	start := time.Now()
+
+	// the tables are read in one transaction, so the stats match the scores
+	tx, err := ReadDB.BeginTxx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	f, err := os.OpenFile(cfg.SnapshotPath+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(cfg.SnapshotPath + ".tmp")
+	defer f.Close()
+
+	sw, err := newSnapshotWriter(f)
+	if err != nil {
+		return err
+	}
+	if err := sw.Header(SnapshotHeader{CreatedAt: time.Now().Unix(), Source: cfg.DBName, Tables: tables}); err != nil {
+		return err
+	}
+	for _, table := range tables {
+		if err := exportSnapshotRows(tx, sw, table); err != nil {
+			return fmt.Errorf("failed to export %s: %w", table, err)
+		}
+		logger.Info("exported table", "table", table)
+	}
+	if err := sw.Close(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(cfg.SnapshotPath+".tmp", cfg.SnapshotPath); err != nil {
+		return err
+	}
+
+	logger.Info("exported snapshot", "path", cfg.SnapshotPath, "scores", sw.counts[recordScore], "stats", sw.counts[recordStats],
+		"size", formatBytes(info.Size()), "elapsed", time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// importSnapshotBatch writes a batch of a table's rows, in one transaction.
+func importSnapshotBatch(table string, columns []string, rows int, values []interface{}) error {
+	if rows == 0 {
+		return nil
+	}
+	if err := throttle(rows); err != nil {
+		return err
+	}
+	verb := "INSERT IGNORE"
+	if cfg.SnapshotReplace {
+		verb = "REPLACE"
+	}
+	query := fmt.Sprintf("%s INTO %s (%s) VALUES %s", verb, table, strings.Join(columns, ", "),
+		placeholders(rows, len(columns), func(n int) string {
+			if table == "scores" && (n-1)%len(columns) == playTimeColumn {
+				return "'1970-01-01' + INTERVAL ? SECOND"
+			}
+			return "?"
+		}))
+
+	for attempt := 0; ; attempt++ {
+		tx, err := DB.Beginx()
+		if err == nil {
+			if _, err = tx.Exec(query, values...); err == nil {
+				err = tx.Commit()
+			} else {
+				tx.Rollback()
+			}
+		}
+		if err == nil {
+			return nil
+		}
+		if _, ok := retryReason(err); !ok || attempt >= cfg.MaxRetries {
+			return err
+		}
+		time.Sleep(retryDelay(attempt))
+	}
+}
+
+// importSnapshot reads the snapshot's records, writing them in batches
+// unless it's only being checked.
+func importSnapshot(sr *snapshotReader, write bool) error {
+	columns := map[int][]string{recordScore: scoreColumns, recordStats: statsColumns}
+	tables := map[int]string{recordScore: "scores", recordStats: "stats"}
+	batches := map[int][]interface{}{}
+	flush := func(kind int) error {
+		values := batches[kind]
+		if err := importSnapshotBatch(tables[kind], columns[kind], len(values)/len(columns[kind]), values); err != nil {
+			return fmt.Errorf("failed to import %s: %w", tables[kind], err)
+		}
+		batches[kind] = values[:0]
+		return nil
+	}
+
+	for {
+		kind, data, err := sr.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		var values []interface{}
+		switch kind {
+		case recordScore:
+			s, err := decodeScore(data)
+			if err != nil {
+				return err
+			}
+			values = scoreValues(s.ID, &s)
+		case recordStats:
+			s, err := decodeStats(data)
+			if err != nil {
+				return err
+			}
+			values = s.values()
+		default:
+			// records of a newer version of the format
+			continue
+		}
+		if !write {
+			continue
+		}
+
+		batches[kind] = append(batches[kind], values...)
+		if len(batches[kind]) >= BatchSize*len(columns[kind]) {
+			if err := flush(kind); err != nil {
+				return err
+			}
+			if isInterrupted() {
+				return errInterrupted
+			}
+		}
+	}
+	if !write {
+		return nil
+	}
+	for _, kind := range []int{recordScore, recordStats} {
+		if err := flush(kind); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSnapshotFile opens the snapshot at path, and reads it through fn.
+func readSnapshotFile(path string, fn func(sr *snapshotReader) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sr, err := openSnapshot(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if err := fn(sr); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+func runImportSnapshot() error {
+	if cfg.SnapshotPath == "" {
+		return errors.New("--in is required")
+	}
+
+	// the whole file is checked before anything's written, so a truncated
+	// or corrupt snapshot isn't half imported
+	var checked *snapshotReader
+	err := readSnapshotFile(cfg.SnapshotPath, func(sr *snapshotReader) error {
+		checked = sr
+		return importSnapshot(sr, false)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("the snapshot of %s, taken %s, has %d scores & %d stats\n", checked.Header.Source,
+		time.Unix(checked.Header.CreatedAt, 0).UTC().Format(time.RFC3339), checked.counts[recordScore], checked.counts[recordStats])
+	if cfg.DryRun {
+		return nil
+	}
+
+	handleSignals()
+	start := time.Now()
+	err = readSnapshotFile(cfg.SnapshotPath, func(sr *snapshotReader) error {
+		return importSnapshot(sr, true)
+	})
+	if err != nil {
+		return err
+	}
+
+	// snapshots don't carry mods_json, see modsjson.go
+	if checked.counts[recordScore] != 0 {
+		if exists, err := hasModsJSON(); err != nil {
+			return err
+		} else if exists {
+			filled, err := fillModsJSON()
+			if err != nil {
+				return fmt.Errorf("failed to fill in mods_json, run scores mods-json --action sync: %w", err)
+			}
+			logger.Info("filled in mods_json", "scores", filled)
+		}
+	}
+	logger.Info("imported snapshot", "scores", checked.counts[recordScore], "stats", checked.counts[recordStats],
+		"replace", cfg.SnapshotReplace, "elapsed", time.Since(start).Round(time.Millisecond))
+	logger.Info("run cache rebuild to put the imported players on the leaderboards")
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "export snapshot",
+		Summary: "write the scores & stats tables to a compact binary snapshot, for import snapshot",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.SnapshotPath, "out", "", "file to write the snapshot to")
+			flags.StringVar(&c.SnapshotTables, "tables", "", "comma-separated tables to include, scores and/or stats (default: both)")
+			flags.IntVar(&c.RecalcMode, "mode", -1, "only include this mode (0-3 vanilla, 4-6 relax, 8 autopilot)")
+		},
+		Run: runExportSnapshot,
+	})
+
+	registerCommand(&Command{
+		Name:    "import snapshot",
+		Summary: "load a snapshot written by export snapshot into the database",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.SnapshotPath, "in", "", "the snapshot to import")
+			flags.BoolVar(&c.SnapshotReplace, "replace", false, "overwrite scores & stats which are already in the database, rather than keeping them")
+			flags.IntVar(&c.MaxRetries, "max-retries", 5, "times to retry a batch after a deadlock, lock wait timeout or lost connection")
+			flags.BoolVar(&c.DryRun, "dry-run", false, "check the snapshot is whole, and report what's in it, without importing it")
+		},
+		Run: runImportSnapshot,
+	})
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+)
+
+var snapshotTestScores = []Score{
+	{
+		ID: 1, MapMD5: "1cf5b2c2edfafd055536d2cefcb89c0e", Score: 727727, PP: 420.69, Acc: 98.76, MaxCombo: 1200,
+		Mods: modHidden | modDoubleTime, N300: 900, N100: 12, N50: 1, Nmiss: 2, Ngeki: 150, Nkatu: 8, Grade: "A",
+		Status: 2, Mode: 4, PlayTime: 1700000000, TimeElapsed: 183000, ClientFlags: 4, UserID: 3, Perfect: 1,
+		OnlineChecksum: sql.NullString{String: "0123456789abcdef0123456789abcdef", Valid: true},
+	},
+	// zero values are left out of the records, and read back as zero
+	{ID: 1 << 40, MapMD5: "c8f08438204abfcdd1a748ebfae67421", Grade: "F", UserID: 4, OnlineChecksum: sql.NullString{Valid: true}},
+}
+
+var snapshotTestStats = []SnapshotStats{
+	{ID: 3, Mode: 0, TScore: 1 << 35, RScore: 1 << 33, PP: 7270, Plays: 1000, Playtime: 360000, Acc: 97.5,
+		MaxCombo: 2000, TotalHits: 500000, ReplayViews: 10, XHCount: 1, XCount: 2, SHCount: 3, SCount: 4, ACount: 5},
+	{ID: 3, Mode: 8},
+}
+
+// writeTestSnapshot writes the test scores & stats, after adjusting the
+// writer, e.g. to miscount its records.
+func writeTestSnapshot(t *testing.T, adjust func(sw *snapshotWriter)) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	sw, err := newSnapshotWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.Header(SnapshotHeader{CreatedAt: 1700000000, Source: "banchopy", Tables: snapshotTables}); err != nil {
+		t.Fatal(err)
+	}
+	for i := range snapshotTestScores {
+		if err := sw.Score(&snapshotTestScores[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range snapshotTestStats {
+		if err := sw.Stats(&snapshotTestStats[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if adjust != nil {
+		adjust(sw)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	sr, err := openSnapshot(bytes.NewReader(writeTestSnapshot(t, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (SnapshotHeader{CreatedAt: 1700000000, Source: "banchopy", Tables: snapshotTables}); !reflect.DeepEqual(sr.Header, want) {
+		t.Errorf("Header = %+v, want %+v", sr.Header, want)
+	}
+
+	var scores []Score
+	var stats []SnapshotStats
+	for {
+		kind, data, err := sr.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch kind {
+		case recordScore:
+			s, err := decodeScore(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			scores = append(scores, s)
+		case recordStats:
+			s, err := decodeStats(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stats = append(stats, s)
+		default:
+			t.Fatalf("unexpected record kind %d", kind)
+		}
+	}
+	if !reflect.DeepEqual(scores, snapshotTestScores) {
+		t.Errorf("read scores %+v, want %+v", scores, snapshotTestScores)
+	}
+	if !reflect.DeepEqual(stats, snapshotTestStats) {
+		t.Errorf("read stats %+v, want %+v", stats, snapshotTestStats)
+	}
+}
+
+// readTestSnapshot reads a snapshot to its end.
+func readTestSnapshot(data []byte) error {
+	sr, err := openSnapshot(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	for {
+		if _, _, err := sr.next(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func TestSnapshotCorrupt(t *testing.T) {
+	valid := writeTestSnapshot(t, nil)
+
+	newer := bytes.Clone(valid)
+	newer[len(snapshotMagic)] = snapshotVersion + 1
+
+	checksum := bytes.Clone(valid)
+	checksum[len(checksum)-5] ^= 0xff // gzip's crc32
+
+	for _, tt := range []struct {
+		name    string
+		data    []byte
+		corrupt bool // errCorruptSnapshot, rather than some other error
+	}{
+		{"empty", nil, false},
+		{"not a snapshot", []byte("PAR1, not a snapshot"), false},
+		{"newer version", newer, false},
+		{"not gzipped", append([]byte(snapshotMagic), snapshotVersion, 1, 2, 3), true},
+		{"cut short", valid[:len(valid)-30], true},
+		{"bad checksum", checksum, true},
+		{"miscounted", writeTestSnapshot(t, func(sw *snapshotWriter) { sw.counts[recordScore]++ }), true},
+	} {
+		err := readTestSnapshot(tt.data)
+		if err == nil {
+			t.Errorf("%s: the snapshot was read, want an error", tt.name)
+		} else if errors.Is(err, errCorruptSnapshot) != tt.corrupt {
+			t.Errorf("%s: %v, want errCorruptSnapshot: %v", tt.name, err, tt.corrupt)
+		}
+	}
+}
+
+func TestReadProtoFields(t *testing.T) {
+	var b protoBuffer
+	b.int(1, 150)
+	b.int(2, 0) // left out
+	b.float(3, 1.5)
+	b.string(4, "testing")
+	b.bytes(5, nil)
+	b.int(100000, -1)
+
+	var got []protoField
+	err := readProtoFields(b, func(f protoField) error {
+		got = append(got, f)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []protoField{
+		{Num: 1, Value: 150},
+		{Num: 3, Value: 0x3fc00000},
+		{Num: 4, Data: []byte("testing")},
+		{Num: 5, Data: []byte{}},
+		{Num: 100000, Value: math.MaxUint64}, // -1, as negative ints are written
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readProtoFields() = %+v, want %+v", got, want)
+	}
+
+	for _, bad := range [][]byte{
+		{0x08},             // a varint field without its value
+		{0x0a, 0x05, 'a'},  // bytes longer than the message
+		{0x0d, 0x00},       // a truncated fixed32
+		{0x09, 1, 2, 3},    // a truncated fixed64
+		{0x0b},             // groups, which aren't used
+		{0x80, 0x80, 0x80}, // a truncated key
+	} {
+		if err := readProtoFields(bad, func(protoField) error { return nil }); !errors.Is(err, errCorruptSnapshot) {
+			t.Errorf("readProtoFields(%x) = %v, want errCorruptSnapshot", bad, err)
+		}
+	}
+}
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// import stable reads an osu!stable install's local databases, and imports
+// its offline scores (and their replays, from Data/r) into bancho.py under
+// a single owner, along with the beatmaps from osu!.db. it's mostly useful
+// for bootstrapping single player or lan servers.
+//
+// the formats are documented at https://github.com/ppy/osu/wiki/Legacy-database-file-structure
+
+// osu!.db versions at which its format changed
+const (
+	osuDBFloatDifficulty = 20140609 // ar/cs/hp/od are floats, star ratings were added
+	osuDBNoEntrySize     = 20191106 // beatmap entries are no longer prefixed by their size
+	osuDBFloatStars      = 20250107 // star ratings are floats rather than doubles
+)
+
+// StableBeatmap is a beatmap from osu!.db.
+type StableBeatmap struct {
+	Artist      string
+	Title       string
+	Creator     string
+	Version     string
+	MD5         string
+	Filename    string
+	Status      int // bancho.py's ranked status
+	LastUpdate  time.Time
+	AR          float64
+	CS          float64
+	HP          float64
+	OD          float64
+	Stars       float64 // nomod star rating in the beatmap's own mode
+	DrainTime   int     // seconds
+	BPM         float64
+	ID          int
+	SetID       int
+	Mode        int
+	TotalLength int // milliseconds
+}
+
+// stableStatuses maps osu!.db's ranked statuses to bancho.py's.
+var stableStatuses = map[int]int{
+	0: 0,  // unknown
+	1: -1, // unsubmitted
+	2: 0,  // pending, wip & graveyard
+	4: 2,  // ranked
+	5: 3,  // approved
+	6: 4,  // qualified
+	7: 5,  // loved
+}
+
+// readStarRatings reads the star ratings of a single mode, keyed by mods.
+func readStarRatings(r *osrReader, version int) map[int]float64 {
+	count := r.i32()
+	stars := make(map[int]float64, count)
+	for i := 0; i < count && r.err == nil; i++ {
+		r.u8() // 0x08
+		mods := r.i32()
+		r.u8() // 0x0d for doubles, 0x0c for floats
+		if version >= osuDBFloatStars {
+			stars[mods] = r.f32()
+		} else {
+			stars[mods] = r.f64()
+		}
+	}
+	return stars
+}
+
+// parseOsuDB reads every beatmap from an osu!.db file.
+func parseOsuDB(data []byte) ([]StableBeatmap, error) {
+	r := &osrReader{data: data}
+
+	version := r.i32()
+	r.i32()    // folder count
+	r.u8()     // account unlocked
+	r.i64()    // account unlock date
+	r.string() // player name
+	count := r.i32()
+
+	beatmaps := make([]StableBeatmap, 0, count)
+	for i := 0; i < count && r.err == nil; i++ {
+		var m StableBeatmap
+		if version < osuDBNoEntrySize {
+			r.i32() // entry size
+		}
+
+		m.Artist = r.string()
+		r.string() // artist (unicode)
+		m.Title = r.string()
+		r.string() // title (unicode)
+		m.Creator = r.string()
+		m.Version = r.string()
+		r.string() // audio file
+		m.MD5 = r.string()
+		m.Filename = r.string()
+		m.Status = stableStatuses[r.u8()]
+		r.i16() // circles
+		r.i16() // sliders
+		r.i16() // spinners
+		m.LastUpdate = ticksToTime(r.i64())
+
+		difficulty := r.f32
+		if version < osuDBFloatDifficulty {
+			difficulty = func() float64 { return float64(r.u8()) }
+		}
+		m.AR, m.CS, m.HP, m.OD = difficulty(), difficulty(), difficulty(), difficulty()
+		r.f64() // slider velocity
+
+		var stars [4]map[int]float64
+		if version >= osuDBFloatDifficulty {
+			for mode := range stars {
+				stars[mode] = readStarRatings(r, version)
+			}
+		}
+
+		m.DrainTime = r.i32()
+		m.TotalLength = r.i32()
+		r.i32() // audio preview time
+
+		// the first uninherited timing point sets the bpm
+		timingPoints := r.i32()
+		for j := 0; j < timingPoints && r.err == nil; j++ {
+			msPerBeat := r.f64()
+			r.f64() // offset
+			uninherited := r.u8() != 0
+			if uninherited && m.BPM == 0 && msPerBeat > 0 {
+				m.BPM = 60000 / msPerBeat
+			}
+		}
+
+		m.ID = r.i32()
+		m.SetID = r.i32()
+		r.i32()    // thread id
+		r.bytes(4) // local grades, per mode
+		r.i16()    // local offset
+		r.f32()    // stack leniency
+		m.Mode = r.u8()
+		r.string() // source
+		r.string() // tags
+		r.i16()    // online offset
+		r.string() // title font
+		r.u8()     // unplayed
+		r.i64()    // last played
+		r.u8()     // osz2
+		r.string() // folder name
+		r.i64()    // last checked against the osu! repository
+		r.bytes(5) // ignore sound/skin, disable storyboard/video, visual override
+		if version < osuDBFloatDifficulty {
+			r.i16()
+		}
+		r.i32() // last modification time
+		r.u8()  // mania scroll speed
+
+		if m.Mode < len(stars) && stars[m.Mode] != nil {
+			m.Stars = stars[m.Mode][0]
+		}
+		beatmaps = append(beatmaps, m)
+	}
+
+	if r.err != nil {
+		return nil, fmt.Errorf("osu!.db: %w", r.err)
+	}
+	return beatmaps, nil
+}
+
+// parseScoresDB reads every score from a scores.db file. each score has
+// the same layout as a replay's header, without the frames.
+func parseScoresDB(data []byte) ([]Replay, error) {
+	r := &osrReader{data: data}
+
+	r.i32() // version
+	beatmaps := r.i32()
+
+	var scores []Replay
+	for i := 0; i < beatmaps && r.err == nil; i++ {
+		r.string() // beatmap md5
+		count := r.i32()
+
+		for j := 0; j < count && r.err == nil; j++ {
+			var s Replay
+			s.HasHeader = true
+			s.Mode = r.u8()
+			s.Version = r.i32()
+			s.MapMD5 = r.string()
+			s.PlayerName = r.string()
+			s.ReplayMD5 = r.string()
+			s.N300 = r.i16()
+			s.N100 = r.i16()
+			s.N50 = r.i16()
+			s.Ngeki = r.i16()
+			s.Nkatu = r.i16()
+			s.Nmiss = r.i16()
+			s.Score = r.i32()
+			s.MaxCombo = int(uint16(r.i16()))
+			s.Perfect = r.u8() != 0
+			s.Mods = r.i32()
+			s.LifeBar = r.string()
+			s.Timestamp = ticksToTime(r.i64())
+			r.i32() // always -1
+			s.ScoreID = r.i64()
+			if s.Mods&modTargetPractice != 0 {
+				r.f64() // additional mod info
+			}
+			scores = append(scores, s)
+		}
+	}
+
+	if r.err != nil {
+		return nil, fmt.Errorf("scores.db: %w", r.err)
+	}
+	return scores, nil
+}
+
+// stableReplays indexes the replays in Data/r by their replay md5.
+func stableReplays(dir string) (map[string]string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	replays := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".osr") {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		replay, err := parseReplay(data)
+		if err != nil || !replay.HasHeader {
+			logger.Warn("skipping unreadable replay", "path", path, "err", err)
+			continue
+		}
+		replays[replay.ReplayMD5] = path
+	}
+	return replays, nil
+}
+
+var insert_stable_map = `
+INSERT INTO maps (server, id, set_id, status, md5, artist, title, version,
+	creator, filename, last_update, total_length, max_combo, frozen, plays,
+	passes, mode, bpm, cs, ar, od, hp, diff)
+VALUES ('osu!', :id, :set_id, :status, :md5, :artist, :title, :version,
+	:creator, :filename, :last_update, :total_length, 0, 0, 0, 0, :mode,
+	:bpm, :cs, :ar, :od, :hp, :diff)`
+
+// importStableMaps adds every submitted beatmap which bancho.py doesn't know yet.
+func importStableMaps(beatmaps []StableBeatmap) error {
+	existing, err := existingIDs("maps", "md5")
+	if err != nil {
+		return err
+	}
+
+	imported := 0
+	tx := DB.MustBegin()
+	for _, m := range beatmaps {
+		// unsubmitted maps can't be played online
+		if m.ID <= 0 || m.SetID <= 0 || existing[m.MD5] {
+			continue
+		}
+		existing[m.MD5] = true
+
+		_, err := tx.NamedExec(insert_stable_map, map[string]interface{}{
+			"id":           m.ID,
+			"set_id":       m.SetID,
+			"status":       m.Status,
+			"md5":          m.MD5,
+			"artist":       m.Artist,
+			"title":        m.Title,
+			"version":      m.Version,
+			"creator":      m.Creator,
+			"filename":     m.Filename,
+			"last_update":  m.LastUpdate,
+			"total_length": m.DrainTime,
+			"mode":         m.Mode,
+			"bpm":          m.BPM,
+			"cs":           m.CS,
+			"ar":           m.AR,
+			"od":           m.OD,
+			"hp":           m.HP,
+			"diff":         m.Stars,
+		})
+		if err != nil {
+			logger.Error("failed to import beatmap", "id", m.ID, "md5", m.MD5, "err", err)
+			continue
+		}
+		imported++
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	_, err = DB.Exec(`
+	INSERT IGNORE INTO mapsets (server, id, last_osuapi_check)
+	SELECT DISTINCT 'osu!', set_id, NOW() FROM maps`)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("imported beatmaps", "imported", imported)
+	return nil
+}
+
+// findUser finds a bancho.py user by their id or name.
+func findUser(user string) (int64, error) {
+	var id int64
+	err := DB.Get(&id, `
+	SELECT id FROM users WHERE id = ? OR safe_name = ?`,
+		user, strings.ReplaceAll(strings.ToLower(user), " ", "_"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to find user %q: %w", user, err)
+	}
+	return id, nil
+}
+
+// bestScore is a user's best score on a beatmap in a mode.
+type bestScore struct {
+	MapMD5 string `db:"map_md5"`
+	Mode   int
+	ID     int64
+	Score  int
+}
+
+// importOwnedScores inserts the owner's scores, skipping any which were
+// imported before, and writes the replays of those which have one. the
+// replays are .osr files, keyed by their replay md5.
+func importOwnedScores(owner int64, scores []Replay, replays map[string]string) error {
+	type scoreKey struct {
+		mapMD5   string
+		playTime int64
+		score    int
+	}
+
+	var existing []struct {
+		MapMD5   string `db:"map_md5"`
+		PlayTime int64  `db:"play_time"`
+		Score    int
+	}
+	err := DB.Select(&existing, `
+	SELECT map_md5, UNIX_TIMESTAMP(play_time) AS play_time, score
+	FROM scores WHERE userid = ?`, owner)
+	if err != nil {
+		return err
+	}
+	seen := make(map[scoreKey]bool, len(existing))
+	for _, s := range existing {
+		seen[scoreKey{s.MapMD5, s.PlayTime, s.Score}] = true
+	}
+
+	// the owner's current best on each beatmap & mode, which the
+	// imported scores must beat to take their place
+	var bests []bestScore
+	err = DB.Select(&bests, `
+	SELECT map_md5, mode, id, score FROM scores
+	WHERE userid = ? AND status = 2`, owner)
+	if err != nil {
+		return err
+	}
+	type bestKey struct {
+		mapMD5 string
+		mode   int
+	}
+	best := make(map[bestKey]bestScore, len(bests))
+	for _, b := range bests {
+		best[bestKey{b.MapMD5, b.Mode}] = b
+	}
+
+	imported, withReplays := 0, 0
+	for start := 0; start < len(scores); start += BatchSize {
+		end := start + BatchSize
+		if end > len(scores) {
+			end = len(scores)
+		}
+
+		// replays are only written once their scores are committed
+		type pendingReplay struct {
+			id   int64
+			path string
+		}
+		var pending []pendingReplay
+
+		tx := DB.MustBegin()
+
+		for _, s := range scores[start:end] {
+			score := Score{
+				MapMD5:   s.MapMD5,
+				Score:    s.Score,
+				MaxCombo: s.MaxCombo,
+				Mods:     s.Mods,
+				N300:     s.N300,
+				N100:     s.N100,
+				N50:      s.N50,
+				Nmiss:    s.Nmiss,
+				Ngeki:    s.Ngeki,
+				Nkatu:    s.Nkatu,
+				Status:   1, // scores.db only has passes
+				Mode:     modeFromMods(s.Mode, s.Mods),
+				PlayTime: s.Timestamp.Unix(),
+				UserID:   owner,
+			}
+			if s.Perfect {
+				score.Perfect = 1
+			}
+			score.OnlineChecksum.Valid = true
+			score.Acc = calculateAccuracy(&score)
+			score.Grade = calculateGrade(&score)
+
+			key := scoreKey{score.MapMD5, score.PlayTime, score.Score}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			res, err := tx.NamedExec(insert_score, &score)
+			if err != nil {
+				logger.Error("failed to insert score", "map_md5", s.MapMD5, "score", s.Score, "err", err)
+				continue
+			}
+			id, err := res.LastInsertId()
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+			imported++
+
+			// without pp, the best score is the one with the highest score
+			bk := bestKey{score.MapMD5, score.Mode}
+			if prev, ok := best[bk]; !ok || score.Score > prev.Score {
+				if ok {
+					if _, err := tx.Exec("UPDATE scores SET status = 1 WHERE id = ?", prev.ID); err != nil {
+						tx.Rollback()
+						return err
+					}
+				}
+				if _, err := tx.Exec("UPDATE scores SET status = 2 WHERE id = ?", id); err != nil {
+					tx.Rollback()
+					return err
+				}
+				best[bk] = bestScore{score.MapMD5, score.Mode, id, score.Score}
+			}
+
+			if path, ok := replays[s.ReplayMD5]; ok {
+				pending = append(pending, pendingReplay{id, path})
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+
+		// bancho.py only keeps the replay frames, not the header
+		for _, p := range pending {
+			data, err := os.ReadFile(p.path)
+			if err == nil {
+				var replay *Replay
+				if replay, err = parseReplay(data); err == nil {
+					err = newReplays.Put(replayKey(p.id), bytes.NewReader(replay.Frames), int64(len(replay.Frames)))
+				}
+			}
+			if err != nil {
+				logger.Error("failed to import replay", "path", p.path, "score_id", p.id, "err", err)
+				continue
+			}
+			withReplays++
+		}
+	}
+
+	logger.Info("imported scores", "imported", imported, "with_replays", withReplays, "skipped", len(scores)-imported)
+	return nil
+}
+
+func runImportStable() error {
+	if cfg.StableDirectory == "" {
+		return errors.New("--osu-dir must be the path to an osu!stable install")
+	}
+	if cfg.ImportOwner == "" {
+		return errors.New("--owner must be the name or id of the bancho.py user to import scores for")
+	}
+
+	owner, err := findUser(cfg.ImportOwner)
+	if err != nil {
+		return err
+	}
+	if err := setupReplayStores(); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(filepath.Join(cfg.StableDirectory, "osu!.db"))
+	if err != nil {
+		return err
+	}
+	beatmaps, err := parseOsuDB(data)
+	if err != nil {
+		return err
+	}
+	logger.Info("read osu!.db", "beatmaps", len(beatmaps))
+
+	data, err = os.ReadFile(filepath.Join(cfg.StableDirectory, "scores.db"))
+	if err != nil {
+		return err
+	}
+	scores, err := parseScoresDB(data)
+	if err != nil {
+		return err
+	}
+
+	// scores.db holds the scores of everyone who played on this install
+	if cfg.StablePlayer != "" {
+		mine := scores[:0]
+		for _, s := range scores {
+			if strings.EqualFold(s.PlayerName, cfg.StablePlayer) {
+				mine = append(mine, s)
+			}
+		}
+		scores = mine
+	}
+	logger.Info("read scores.db", "scores", len(scores))
+
+	replays, err := stableReplays(filepath.Join(cfg.StableDirectory, "Data", "r"))
+	if err != nil {
+		return err
+	}
+	logger.Info("read replays", "replays", len(replays))
+
+	if err := importStableMaps(beatmaps); err != nil {
+		return fmt.Errorf("failed to import beatmaps: %w", err)
+	}
+	if err := importOwnedScores(owner, scores, replays); err != nil {
+		return fmt.Errorf("failed to import scores: %w", err)
+	}
+
+	logger.Warn("imported scores have no pp, recalculate them with bancho.py's tools/recalc.py")
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:              "import stable",
+		Summary:           "import an osu!stable install's local scores & replays",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.StableDirectory, "osu-dir", "", "the osu!stable install, with osu!.db, scores.db & Data/r")
+			flags.StringVar(&c.ImportOwner, "owner", "", "name or id of the bancho.py user who will own the scores")
+			flags.StringVar(&c.StablePlayer, "player", "", "only import scores set under this name (default: every local player's)")
+			flags.StringVar(&c.NewReplays, "new-replays", "", "where imported replays are written, a path or s3://bucket/prefix (default: DATA_DIRECTORY/osr)")
+		},
+		Run: runImportStable,
+	})
+}
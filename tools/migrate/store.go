@@ -0,0 +1,354 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// ReplayStore is somewhere replay files are kept, keyed by file name
+// (e.g. "123.osr"). replays may live on local disk, as bancho.py keeps
+// them in .data/osr by default, or in s3-compatible object storage.
+type ReplayStore interface {
+	// Open returns the contents of a replay, or an error
+	// satisfying errors.Is(err, os.ErrNotExist) if it doesn't exist.
+	Open(key string) (io.ReadCloser, error)
+	// Put durably stores a replay, replacing any existing one.
+	Put(key string, r io.Reader, size int64) error
+	Delete(key string) error
+	// Stat returns the size of a replay, with the same errors as Open.
+	Stat(key string) (int64, error)
+	// List calls fn with the key of every replay in the store.
+	List(fn func(key string) error) error
+	// Location describes where a key is stored, for logs & journals.
+	Location(key string) string
+}
+
+func replayKey(id int64) string {
+	return fmt.Sprintf("%d.osr", id)
+}
+
+// openReplayStore opens a store from a path or s3://bucket/prefix url.
+func openReplayStore(location string) (ReplayStore, error) {
+	if strings.HasPrefix(location, "s3://") {
+		return openS3Store(location)
+	}
+	if strings.Contains(location, "://") {
+		return nil, fmt.Errorf("unsupported replay store %q, expected a path or s3://bucket/prefix", location)
+	}
+	return LocalStore{Dir: strings.TrimRight(location, "/")}, nil
+}
+
+// replayStoreFlags registers the flags selecting where replays are stored.
+func replayStoreFlags(flags *flag.FlagSet, c *Config) {
+	flags.StringVar(&c.OldReplays, "old-replays", "", "where the replays to migrate are, a path or s3://bucket/prefix (default: DATA_DIRECTORY/osr)")
+	flags.StringVar(&c.NewReplays, "new-replays", "", "where migrated replays are written, a path or s3://bucket/prefix (default: DATA_DIRECTORY/osr)")
+}
+
+// stagingReplayDirectory is where the old replays are moved to while
+// migrating, when both the old & new replays are in .data/osr. it's next to
+// .data/osr, so they can be renamed there, unless .data/osr is a mount.
+func stagingReplayDirectory() string {
+	return cfg.ReplayDirectory() + "_staged"
+}
+
+// legacyStagingReplayDirectory is where older versions staged the replays,
+// which often failed, as /tmp is usually a filesystem of its own.
+const legacyStagingReplayDirectory = "/tmp/gulag_replays"
+
+// checkStagedReplays returns an error if the staged replays aren't where
+// they should be, e.g. when resuming or rolling back.
+func checkStagedReplays(action string) error {
+	_, err := os.Stat(stagingReplayDirectory())
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if _, err := os.Stat(legacyStagingReplayDirectory); err == nil {
+		return fmt.Errorf("cannot %s: the replays were staged in %s by an older version, move them to %s first",
+			action, legacyStagingReplayDirectory, stagingReplayDirectory())
+	}
+	return fmt.Errorf("cannot %s: the staged replays at %s do not exist", action, stagingReplayDirectory())
+}
+
+// crossDevice reports whether a rename failed as it was across filesystems.
+func crossDevice(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
+}
+
+// mountPoint reports whether a rename or removal failed as the path is a
+// mount point, which is in use.
+func mountPoint(err error) bool {
+	return errors.Is(err, syscall.EBUSY)
+}
+
+// moveFile renames a file, or where it can't be renamed, copies it (synced
+// to disk) and removes the original.
+func moveFile(from, to string) error {
+	err := os.Rename(from, to)
+	if err == nil || !(crossDevice(err) || mountPoint(err)) {
+		return err
+	}
+
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(to+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(to+".tmp", to)
+	}
+	if err != nil {
+		os.Remove(to + ".tmp")
+		return err
+	}
+	return os.Remove(from)
+}
+
+// moveDirectory renames a directory, or where it can't be renamed (it's a
+// mount point, or the other side of one, or to is an empty directory, e.g.
+// a mount point), moves its files one at a time, and removes it if it can.
+func moveDirectory(from, to string) error {
+	if entries, err := os.ReadDir(to); err != nil || len(entries) != 0 {
+		err := os.Rename(from, to)
+		if err == nil || !(crossDevice(err) || mountPoint(err)) {
+			return err
+		}
+	}
+	logger.Info("can't rename the directory, moving the files one at a time", "from", from, "to", to)
+
+	if err := os.MkdirAll(to, 0755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(from)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		src, dst := filepath.Join(from, entry.Name()), filepath.Join(to, entry.Name())
+		if entry.IsDir() {
+			err = moveDirectory(src, dst)
+		} else {
+			err = moveFile(src, dst)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// a mount point is left in place, empty
+	if err := os.Remove(from); err != nil && !mountPoint(err) {
+		return err
+	}
+	return nil
+}
+
+// replaysStaged reports whether the old replays are staged locally during
+// the migration, which is needed when they share a directory with the new
+// replays, as an old id could otherwise be overwritten by an equal new id.
+// replays whose ids are kept aren't staged, see keepids.go.
+func replaysStaged() bool {
+	return cfg.OldReplays == "" && cfg.NewReplays == "" && !replaysInPlace
+}
+
+// setupReplayStores opens the stores holding the old & new replays.
+func setupReplayStores() error {
+	var err error
+
+	switch {
+	case replaysStaged():
+		oldReplays = LocalStore{Dir: stagingReplayDirectory()}
+	case cfg.OldReplays == "":
+		oldReplays = LocalStore{Dir: cfg.ReplayDirectory()}
+	default:
+		if oldReplays, err = openReplayStore(cfg.OldReplays); err != nil {
+			return err
+		}
+	}
+
+	if cfg.NewReplays == "" {
+		newReplays = LocalStore{Dir: cfg.ReplayDirectory()}
+	} else if newReplays, err = openReplayStore(cfg.NewReplays); err != nil {
+		return err
+	}
+	return nil
+}
+
+// preMigrationReplays returns where the old replays are before migrating.
+func preMigrationReplays() (ReplayStore, error) {
+	if cfg.OldReplays == "" {
+		return LocalStore{Dir: cfg.ReplayDirectory()}, nil
+	}
+	return openReplayStore(cfg.OldReplays)
+}
+
+// LocalStore keeps replays as files in a directory. replays compressed
+// by replays compact (as <key>.gz) are read as if they weren't.
+type LocalStore struct {
+	Dir string
+}
+
+// compressedSuffix is appended to the names of gzipped replays.
+const compressedSuffix = ".gz"
+
+func (s LocalStore) path(key string) string {
+	return filepath.Join(s.Dir, key)
+}
+
+func (s LocalStore) Open(key string) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(key))
+	if !errors.Is(err, os.ErrNotExist) {
+		return f, err
+	}
+	if f, err = os.Open(s.path(key) + compressedSuffix); err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", f.Name(), err)
+	}
+	return gzipFile{zr, f}, nil
+}
+
+type gzipFile struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g gzipFile) Close() error {
+	g.Reader.Close()
+	return g.f.Close()
+}
+
+// Put writes the replay to a temporary file which is synced to disk
+// before being renamed into place, so a replay is never left partial.
+func (s LocalStore) Put(key string, r io.Reader, size int64) error {
+	tmp := s.path(key) + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	written, err := io.Copy(out, r)
+	if err == nil && written != size {
+		err = fmt.Errorf("wrote %d bytes, expected %d", written, size)
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path(key))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// a compressed copy would now be outdated
+	if err := os.Remove(s.path(key) + compressedSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return syncDir(s.Dir)
+}
+
+func (s LocalStore) Delete(key string) error {
+	err := os.Remove(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		err = os.Remove(s.path(key) + compressedSuffix)
+	}
+	return err
+}
+
+func (s LocalStore) Stat(key string) (int64, error) {
+	info, err := os.Stat(s.path(key))
+	if err == nil {
+		return info.Size(), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	return gzipSize(s.path(key) + compressedSuffix)
+}
+
+// gzipSize reads the uncompressed size of a gzip file from its trailer,
+// which is only the size modulo 2^32, though no replay is that large.
+func gzipSize(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var trailer [4]byte
+	if _, err := f.Seek(-4, io.SeekEnd); err != nil {
+		return 0, fmt.Errorf("%s: %w", path, err)
+	}
+	if _, err := io.ReadFull(f, trailer[:]); err != nil {
+		return 0, fmt.Errorf("%s: %w", path, err)
+	}
+	return int64(binary.LittleEndian.Uint32(trailer[:])), nil
+}
+
+func (s LocalStore) List(fn func(key string) error) error {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return err
+	}
+
+	names := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		names[entry.Name()] = !entry.IsDir()
+	}
+	for _, entry := range entries {
+		key := strings.TrimSuffix(entry.Name(), compressedSuffix)
+		if entry.IsDir() || !strings.HasSuffix(key, ".osr") {
+			continue
+		}
+		// a replay both compressed & not is only listed once
+		if key != entry.Name() && names[key] {
+			continue
+		}
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s LocalStore) Location(key string) string {
+	return s.path(key)
+}
+
+// syncDir fsyncs a directory, so that renames within it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// bancho.py takes a player off of the leaderboards, and their #1s away, as
+// they're restricted. when players are restricted by editing the database
+// by hand though, or restricted before first_places existed, they linger:
+// users sweep finds every restricted player still on a leaderboard in redis
+// or holding a #1, removes them, and works out who now has those maps' #1s.
+//
+// with --restore, it's reversed for a player who has been unrestricted: they
+// are put back on their global & country leaderboards, and each map they've
+// a best score on gets its #1 worked out again, which they may well take
+// back. the changes to #1s can be written with --diff, as recalc
+// first-places does, for bots which announce them.
+
+// sweptMaps groups the maps whose #1 needs working out again by mode.
+type sweptMaps map[int][]string
+
+// sweepModes is the modes being swept, in order.
+func sweepModes() ([]int, error) {
+	if cfg.RecalcMode >= 0 {
+		if !statsModes[cfg.RecalcMode] {
+			return nil, fmt.Errorf("--mode %d is not one of bancho.py's modes", cfg.RecalcMode)
+		}
+		return []int{cfg.RecalcMode}, nil
+	}
+	modes := make([]int, 0, len(statsModes))
+	for mode := range statsModes {
+		modes = append(modes, mode)
+	}
+	sort.Ints(modes)
+	return modes, nil
+}
+
+// sweepLeaderboards removes the players from every leaderboard in the modes
+// given, returning how many entries were removed.
+func sweepLeaderboards(rc *RedisConn, users map[int64]bool, modes []int) (int, error) {
+	keys, err := scanLeaderboards(rc)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, key := range keys {
+		if mode, ok := leaderboardMode(key); !ok || !slices.Contains(modes, mode) {
+			continue
+		}
+		reply, err := rc.Do("ZRANGE", key, "0", "-1")
+		if err != nil {
+			return removed, err
+		}
+		members, ok := reply.([]interface{})
+		if !ok {
+			return removed, fmt.Errorf("redis: unexpected ZRANGE reply %v", reply)
+		}
+
+		args := []string{"ZREM", key}
+		for _, member := range members {
+			name, _ := member.(string)
+			if id, err := strconv.ParseInt(name, 10, 64); err == nil && users[id] {
+				args = append(args, name)
+			}
+		}
+		if len(args) == 2 {
+			continue
+		}
+		removed += len(args) - 2
+		logger.Debug("sweeping leaderboard", "key", key, "players", len(args)-2)
+		if cfg.DryRun {
+			continue
+		}
+		for start := 2; start < len(args); start += zaddChunkSize {
+			chunk := append([]string{"ZREM", key}, args[start:min(start+zaddChunkSize, len(args))]...)
+			if _, err := rc.Do(chunk...); err != nil {
+				return removed, err
+			}
+		}
+	}
+	return removed, nil
+}
+
+// restoreLeaderboards puts an unrestricted player back on their global &
+// country leaderboards, in the modes they have pp in.
+func restoreLeaderboards(rc *RedisConn, user int64, modes []int) (int, error) {
+	var entries []leaderboardEntry
+	if err := DB.Select(&entries, fmt.Sprintf(select_leaderboard_stats, "AND st.id = ?"), user); err != nil {
+		return 0, err
+	}
+	restored := 0
+	for _, entry := range entries {
+		if !slices.Contains(modes, entry.Mode) {
+			continue
+		}
+		restored++
+		if cfg.DryRun {
+			continue
+		}
+		pp, id := strconv.FormatInt(entry.PP, 10), strconv.FormatInt(entry.ID, 10)
+		rc.Send("ZADD", fmt.Sprintf("%s%d", leaderboardKeyPrefix, entry.Mode), pp, id)
+		rc.Send("ZADD", fmt.Sprintf("%s%d:%s", leaderboardKeyPrefix, entry.Mode, entry.Country), pp, id)
+	}
+	if cfg.DryRun {
+		return restored, nil
+	}
+	_, err := rc.Flush(2 * restored)
+	return restored, err
+}
+
+// sweptFirstPlaces finds the maps whose #1 is held by a restricted player.
+func sweptFirstPlaces(user int64) (sweptMaps, error) {
+	query := `
+	SELECT fp.mode, fp.map_md5 FROM first_places fp
+	JOIN users u ON u.id = fp.userid
+	WHERE NOT u.priv & 1`
+	var args []interface{}
+	if user != 0 {
+		query += ` AND u.id = ?`
+		args = append(args, user)
+	}
+	return selectSweptMaps(query, args...)
+}
+
+// restoredFirstPlaces finds the maps an unrestricted player may have the #1
+// on: those with leaderboards they have a best score on.
+func restoredFirstPlaces(user int64) (sweptMaps, error) {
+	return selectSweptMaps(`
+	SELECT DISTINCT s.mode, s.map_md5 FROM scores s
+	JOIN maps m ON m.md5 = s.map_md5
+	WHERE s.userid = ? AND s.status = 2 AND m.status IN (?, ?, ?)`,
+		user, mapStatusRanked, mapStatusApproved, mapStatusLoved)
+}
+
+func selectSweptMaps(query string, args ...interface{}) (sweptMaps, error) {
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	maps := sweptMaps{}
+	for rows.Next() {
+		var mode int
+		var md5 string
+		if err := rows.Scan(&mode, &md5); err != nil {
+			return nil, err
+		}
+		maps[mode] = append(maps[mode], md5)
+	}
+	return maps, rows.Err()
+}
+
+// rebuildSweptFirstPlaces works out the maps' #1s again, a batch at a time.
+func rebuildSweptFirstPlaces(maps sweptMaps, modes []int) ([]FirstPlaceChange, error) {
+	var changes []FirstPlaceChange
+	for _, mode := range modes {
+		md5s := maps[mode]
+		for start := 0; start < len(md5s); start += BatchSize {
+			if isInterrupted() {
+				return changes, errInterrupted
+			}
+			batch, err := rebuildFirstPlaces(mode, md5s[start:min(start+BatchSize, len(md5s))])
+			if err != nil {
+				return changes, fmt.Errorf("failed to rebuild mode %d's first places: %w", mode, err)
+			}
+			changes = append(changes, batch...)
+		}
+	}
+	return changes, nil
+}
+
+func runUsersSweep() error {
+	modes, err := sweepModes()
+	if err != nil {
+		return err
+	}
+	var user int64
+	if cfg.SweepUser != "" {
+		if user, err = findUser(cfg.SweepUser); err != nil {
+			return err
+		}
+		var priv int
+		if err := DB.Get(&priv, "SELECT priv FROM users WHERE id = ?", user); err != nil {
+			return err
+		}
+		if restricted := priv&1 == 0; restricted == cfg.SweepRestore {
+			if restricted {
+				return fmt.Errorf("%s is still restricted, so can't be restored", cfg.SweepUser)
+			}
+			return fmt.Errorf("%s isn't restricted, use --restore to put them back", cfg.SweepUser)
+		}
+	} else if cfg.SweepRestore {
+		return errors.New("--restore needs --user, the player who was unrestricted")
+	}
+
+	handleSignals()
+	start := time.Now()
+	rc, err := dialRedis(cfg)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	var maps sweptMaps
+	if cfg.SweepRestore {
+		added, err := restoreLeaderboards(rc, user, modes)
+		if err != nil {
+			return fmt.Errorf("failed to restore leaderboards: %w", err)
+		}
+		logger.Info("restored leaderboards", "user", user, "modes", added, "dry_run", cfg.DryRun)
+		if maps, err = restoredFirstPlaces(user); err != nil {
+			return err
+		}
+	} else {
+		var ids []int64
+		query, args := "SELECT id FROM users WHERE NOT priv & 1", []interface{}{}
+		if user != 0 {
+			query, args = query+" AND id = ?", append(args, user)
+		}
+		if err := DB.Select(&ids, query, args...); err != nil {
+			return err
+		}
+		restricted := make(map[int64]bool, len(ids))
+		for _, id := range ids {
+			restricted[id] = true
+		}
+		removed, err := sweepLeaderboards(rc, restricted, modes)
+		if err != nil {
+			return fmt.Errorf("failed to sweep leaderboards: %w", err)
+		}
+		logger.Info("swept leaderboards", "restricted", len(ids), "removed", removed, "dry_run", cfg.DryRun)
+	}
+
+	if exists, err := tableExists("first_places"); err != nil {
+		return err
+	} else if !exists {
+		logger.Info("there's no first_places table, so no #1s to sweep")
+		return nil
+	}
+	if !cfg.SweepRestore {
+		if maps, err = sweptFirstPlaces(user); err != nil {
+			return err
+		}
+	}
+	changes, err := rebuildSweptFirstPlaces(maps, modes)
+	if err != nil {
+		return err
+	}
+	if changes == nil {
+		changes = []FirstPlaceChange{}
+	}
+	report := &FirstPlacesReport{Time: time.Now().UTC(), Baseline: true, Changes: changes}
+	if err := writeReport(cfg.ReportPath, report); err != nil {
+		return err
+	}
+	logger.Info("worked out #1s again", "changed", len(changes), "dry_run", cfg.DryRun,
+		"elapsed", time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "users sweep",
+		Summary: "remove restricted players from the leaderboards & #1s, or put an unrestricted player back",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.SweepUser, "user", "", "only sweep this player, by name or id")
+			flags.BoolVar(&c.SweepRestore, "restore", false, "put --user back, after they've been unrestricted")
+			flags.IntVar(&c.RecalcMode, "mode", -1, "only sweep this mode (0-3 vanilla, 4-6 relax, 8 autopilot)")
+			flags.StringVar(&c.ReportPath, "diff", "", "write the maps whose #1 changed hands to this file as json (- for stdout)")
+			flags.BoolVar(&c.DryRun, "dry-run", false, "report what would change without changing anything")
+		},
+		Run: runUsersSweep,
+	})
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ALTER TABLE rebuilds the table it changes, which for scores means copying
+// hundreds of gigabytes while bancho.py's queries queue up behind it. schema
+// alter makes the same change without taking the server offline, the way
+// pt-online-schema-change does:
+//
+//  1. _scores_new is created like scores, and altered while it's empty.
+//  2. triggers on scores repeat every insert, update & delete on it.
+//  3. scores is copied across a chunk of its primary key at a time, each
+//     chunk throttled like the bulk commands' batches (see throttle.go).
+//  4. RENAME TABLE swaps the two at once, leaving scores as _scores_old,
+//     which is dropped unless --keep-old-table is given.
+//
+// triggers are used rather than tailing the binlog, as in online.go. each
+// statement which needs the table's metadata lock (creating the triggers,
+// the swap) waits at most --lock-wait-timeout for it, then backs off and
+// tries again: a long query holding the lock would otherwise leave every
+// query after it waiting behind the swap, i.e. the server stalled.
+//
+// the table needs a single integer primary key to copy by, and no foreign
+// keys, which would be left pointing at the old table (run constraints drop
+// first, and constraints add after). columns which the alter renames are
+// dropped & added as far as the copy can tell, so their values would be
+// lost: the command asks before dropping any column's values.
+//
+// if it fails or is stopped part way, the triggers & new table are dropped,
+// leaving the table as it was.
+
+// the metadata lock is waited for this long by default, in seconds
+const defaultLockWaitTimeout = 2
+
+// integer types a table can be copied by
+var swapKeyTypes = []string{"tinyint", "smallint", "mediumint", "int", "bigint"}
+
+// tableSwap is an online alter of one table.
+type tableSwap struct {
+	Table   string
+	Clauses string // what follows ALTER TABLE <table>
+
+	key     string   // the primary key
+	columns []string // the columns copied, those both tables have
+	dropped []string // the columns the alter drops
+}
+
+func (s *tableSwap) shadowTable() string { return "_" + s.Table + "_new" }
+func (s *tableSwap) oldTable() string    { return "_" + s.Table + "_old" }
+
+func (s *tableSwap) triggerName(event string) string {
+	return fmt.Sprintf("swap_%s_%s", s.Table, strings.ToLower(event))
+}
+
+// checkSwappable makes sure the table can be altered online, returning its
+// primary key.
+func checkSwappable(table string) (string, error) {
+	if len("swap_"+table+"_insert") > 64 {
+		return "", fmt.Errorf("%s's name is too long to name its triggers after", table)
+	}
+	schemas, err := loadTableSchemas(cfg.DBName, []string{table})
+	if err != nil {
+		return "", err
+	}
+	if len(schemas) == 0 {
+		return "", fmt.Errorf("there's no %s table", table)
+	}
+	schema := schemas[0]
+	if len(schema.PrimaryKey) != 1 {
+		return "", fmt.Errorf("%s needs a primary key of a single column to be copied by", table)
+	}
+	key := schema.PrimaryKey[0]
+	for _, c := range schema.Columns {
+		if c.Name == key && !slices.Contains(swapKeyTypes, c.DataType) {
+			return "", fmt.Errorf("%s's primary key %s isn't an integer", table, key)
+		}
+	}
+
+	var foreignKeys int
+	err = DB.Get(&foreignKeys, `
+	SELECT COUNT(*) FROM information_schema.key_column_usage
+	WHERE table_schema = DATABASE() AND referenced_table_name IS NOT NULL
+		AND (table_name = ? OR referenced_table_name = ?)`, table, table)
+	if err != nil {
+		return "", err
+	}
+	if foreignKeys != 0 {
+		return "", fmt.Errorf("%s has foreign keys, which the swap would leave behind, run constraints drop first", table)
+	}
+
+	var triggers []string
+	err = DB.Select(&triggers, `
+	SELECT trigger_name FROM information_schema.triggers
+	WHERE trigger_schema = DATABASE() AND event_object_table = ? AND trigger_name NOT LIKE 'swap\_%'`, table)
+	if err != nil {
+		return "", err
+	}
+	if len(triggers) != 0 {
+		return "", fmt.Errorf("%s already has triggers (%s), which the swap would leave behind", table, strings.Join(triggers, ", "))
+	}
+	return key, nil
+}
+
+// execDDL runs a statement which needs a table's metadata lock, giving up
+// on the lock after --lock-wait-timeout, and trying again after a backoff.
+func execDDL(stmt string) error {
+	ctx := context.Background()
+	conn, err := DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	timeout := cfg.LockWaitTimeout
+	if timeout <= 0 {
+		timeout = defaultLockWaitTimeout
+	}
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf("SET SESSION lock_wait_timeout = %d", timeout)); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "SET SESSION lock_wait_timeout = DEFAULT")
+
+	for attempt := 0; ; attempt++ {
+		_, err := conn.ExecContext(ctx, stmt)
+		if reason, ok := retryReason(err); err == nil || !ok || reason != "lock_wait_timeout" || attempt >= cfg.MaxRetries {
+			return err
+		}
+		delay := retryDelay(attempt)
+		logger.Warn("the table is in use, waiting to try again", "attempt", attempt+1, "retry_in", delay.Round(time.Millisecond))
+		select {
+		case <-time.After(delay):
+		case <-interrupted:
+			return errInterrupted
+		}
+	}
+}
+
+// prepare checks the table, and creates & alters the new one.
+func (s *tableSwap) prepare() error {
+	key, err := checkSwappable(s.Table)
+	if err != nil {
+		return err
+	}
+	s.key = key
+	if exists, err := tableExists(s.oldTable()); err != nil {
+		return err
+	} else if exists {
+		return fmt.Errorf("%s is left from an earlier alter, drop it first", s.oldTable())
+	}
+
+	// a run which was killed outright leaves its triggers & table behind
+	if err := s.cleanup(); err != nil {
+		return err
+	}
+
+	stmts := []string{
+		fmt.Sprintf("CREATE TABLE `%s` LIKE `%s`", s.shadowTable(), s.Table),
+		fmt.Sprintf("ALTER TABLE `%s` %s", s.shadowTable(), s.Clauses),
+	}
+	for _, stmt := range stmts {
+		if _, err := DB.Exec(stmt); err != nil {
+			s.cleanup()
+			return err
+		}
+	}
+
+	before, err := tableColumns(cfg.DBName, s.Table)
+	if err != nil {
+		return err
+	}
+	after, err := tableColumns(cfg.DBName, s.shadowTable())
+	if err != nil {
+		return err
+	}
+	s.columns, s.dropped = nil, nil
+	for _, column := range before {
+		if slices.Contains(after, column) {
+			s.columns = append(s.columns, column)
+		} else {
+			s.dropped = append(s.dropped, column)
+		}
+	}
+	if !slices.Contains(s.columns, s.key) {
+		s.cleanup()
+		return fmt.Errorf("the alter drops %s's primary key %s, which it's copied by", s.Table, s.key)
+	}
+	return nil
+}
+
+// createTriggers keeps the new table in step with changes to the old one.
+func (s *tableSwap) createTriggers() error {
+	columns := make([]string, len(s.columns))
+	values := make([]string, len(s.columns))
+	for i, column := range s.columns {
+		columns[i] = "`" + column + "`"
+		values[i] = "NEW.`" + column + "`"
+	}
+	replace := fmt.Sprintf("REPLACE INTO `%s` (%s) VALUES (%s)",
+		s.shadowTable(), strings.Join(columns, ", "), strings.Join(values, ", "))
+	remove := fmt.Sprintf("DELETE IGNORE FROM `%s` WHERE `%s` = OLD.`%s`", s.shadowTable(), s.key, s.key)
+
+	bodies := map[string]string{
+		"INSERT": replace,
+		// the update may have changed the primary key
+		"UPDATE": fmt.Sprintf("BEGIN %s; %s; END", remove, replace),
+		"DELETE": remove,
+	}
+	for _, e := range changeEvents {
+		stmt := fmt.Sprintf("CREATE TRIGGER `%s` AFTER %s ON `%s` FOR EACH ROW %s",
+			s.triggerName(e.event), e.event, s.Table, bodies[e.event])
+		if err := execDDL(stmt); err != nil {
+			return fmt.Errorf("failed to create trigger %s: %w", s.triggerName(e.event), err)
+		}
+	}
+	return nil
+}
+
+// copyRows copies the table across, a chunk of its primary key at a time.
+// rows the triggers already copied are newer, so are kept as they are.
+func (s *tableSwap) copyRows() (int64, error) {
+	var first, last sql.NullInt64
+	err := DB.QueryRow(fmt.Sprintf("SELECT MIN(`%s`), MAX(`%s`) FROM `%s`", s.key, s.key, s.Table)).Scan(&first, &last)
+	if err != nil || !first.Valid {
+		return 0, err
+	}
+
+	chunkSize := cfg.AlterChunkSize
+	if chunkSize <= 0 {
+		chunkSize = BatchSize
+	}
+	columns := "`" + strings.Join(s.columns, "`, `") + "`"
+	selectChunkEnd := fmt.Sprintf("SELECT `%s` FROM `%s` WHERE `%s` >= ? ORDER BY `%s` LIMIT 1 OFFSET %d",
+		s.key, s.Table, s.key, s.key, chunkSize-1)
+	copyChunk := fmt.Sprintf("INSERT IGNORE INTO `%s` (%s) SELECT %s FROM `%s` WHERE `%s` BETWEEN ? AND ? LOCK IN SHARE MODE",
+		s.shadowTable(), columns, columns, s.Table, s.key)
+
+	var copied int64
+	reported := time.Now()
+	for from := first.Int64; from <= last.Int64; {
+		if isInterrupted() {
+			return copied, errInterrupted
+		}
+		var to int64
+		if err := DB.Get(&to, selectChunkEnd, from); errors.Is(err, sql.ErrNoRows) || (err == nil && to > last.Int64) {
+			to = last.Int64
+		} else if err != nil {
+			return copied, err
+		}
+		if err := throttle(chunkSize); err != nil {
+			return copied, err
+		}
+
+		for attempt := 0; ; attempt++ {
+			result, err := DB.Exec(copyChunk, from, to)
+			if err == nil {
+				n, _ := result.RowsAffected()
+				copied += n
+				break
+			}
+			if _, ok := retryReason(err); !ok || attempt >= cfg.MaxRetries {
+				return copied, fmt.Errorf("failed to copy %s %d-%d: %w", s.key, from, to, err)
+			}
+			time.Sleep(retryDelay(attempt))
+		}
+
+		if cfg.ProgressInterval > 0 && time.Since(reported) >= cfg.ProgressInterval {
+			reported = time.Now()
+			logger.Info("copying", "table", s.Table, "rows", copied,
+				"done", fmt.Sprintf("%.1f%%", float64(to-first.Int64+1)/float64(last.Int64-first.Int64+1)*100))
+		}
+		from = to + 1
+	}
+	return copied, nil
+}
+
+// swap renames the new table into the old one's place, at once.
+func (s *tableSwap) swap(keepOld bool) error {
+	err := execDDL(fmt.Sprintf("RENAME TABLE `%s` TO `%s`, `%s` TO `%s`",
+		s.Table, s.oldTable(), s.shadowTable(), s.Table))
+	if err != nil {
+		return err
+	}
+	// the triggers went with the old table
+	for _, e := range changeEvents {
+		if _, err := DB.Exec("DROP TRIGGER IF EXISTS `" + s.triggerName(e.event) + "`"); err != nil {
+			return err
+		}
+	}
+	if keepOld {
+		logger.Info("kept the old table", "table", s.oldTable())
+		return nil
+	}
+	if _, err := DB.Exec("DROP TABLE `" + s.oldTable() + "`"); err != nil {
+		logger.Warn("failed to drop the old table, drop it by hand", "table", s.oldTable(), "err", err)
+	}
+	return nil
+}
+
+// cleanup drops the triggers & the new table, undoing the alter before the swap.
+func (s *tableSwap) cleanup() error {
+	for _, e := range changeEvents {
+		if err := execDDL("DROP TRIGGER IF EXISTS `" + s.triggerName(e.event) + "`"); err != nil {
+			return err
+		}
+	}
+	_, err := DB.Exec("DROP TABLE IF EXISTS `" + s.shadowTable() + "`")
+	return err
+}
+
+// run alters the table, once prepared.
+func (s *tableSwap) run(keepOld bool) error {
+	start := time.Now()
+	err := s.createTriggers()
+	var copied int64
+	if err == nil {
+		copied, err = s.copyRows()
+	}
+	if err == nil {
+		err = s.swap(keepOld)
+	}
+	if err != nil {
+		if cleanupErr := s.cleanup(); cleanupErr != nil {
+			logger.Error("failed to drop the alter's triggers & table, drop them by hand", "table", s.shadowTable(), "err", cleanupErr)
+		}
+		return fmt.Errorf("failed to alter %s: %w", s.Table, err)
+	}
+	logger.Info("altered table", "table", s.Table, "rows", copied, "elapsed", time.Since(start).Round(time.Second))
+	return nil
+}
+
+// alterOnline runs ALTER TABLE table clauses, while the table's in use.
+func alterOnline(table, clauses string, keepOld bool) error {
+	s := &tableSwap{Table: table, Clauses: clauses}
+	if err := s.prepare(); err != nil {
+		return err
+	}
+	if len(s.dropped) != 0 {
+		logger.Warn("the alter drops columns", "table", table, "columns", strings.Join(s.dropped, ", "))
+	}
+	return s.run(keepOld)
+}
+
+func runSchemaAlter() error {
+	if cfg.AlterTable == "" || cfg.AlterClauses == "" {
+		return errors.New("--table and --alter are required")
+	}
+
+	// ctrl-c stops the copy, and drops what was copied
+	handleSignals()
+
+	s := &tableSwap{Table: cfg.AlterTable, Clauses: cfg.AlterClauses}
+	if err := s.prepare(); err != nil {
+		return err
+	}
+	fmt.Printf("%d of %s's columns will be copied to the altered table\n", len(s.columns), s.Table)
+	if len(s.dropped) != 0 {
+		fmt.Printf("the alter drops, or renames, %s, whose values won't be copied\n", strings.Join(s.dropped, ", "))
+	}
+
+	if cfg.DryRun {
+		return s.cleanup()
+	}
+	if len(s.dropped) != 0 && !confirm("Drop these columns' values?") {
+		fmt.Println("Not altering the table")
+		return s.cleanup()
+	}
+	return s.run(cfg.KeepOldTables)
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "schema alter",
+		Summary: "alter a table (e.g. scores or users) without taking bancho.py offline, by copying it & swapping the copy in",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.AlterTable, "table", "", "the table to alter")
+			flags.StringVar(&c.AlterClauses, "alter", "", "what to alter, as it'd follow ALTER TABLE <table>, e.g. \"ADD INDEX (map_md5, pp)\"")
+			flags.IntVar(&c.AlterChunkSize, "chunk-size", BatchSize, "rows copied at a time")
+			flags.IntVar(&c.LockWaitTimeout, "lock-wait-timeout", defaultLockWaitTimeout, "seconds to wait for the table's metadata lock, before backing off & trying again")
+			flags.IntVar(&c.MaxRetries, "max-retries", 10, "times to try again after a lock wait timeout or deadlock")
+			flags.BoolVar(&c.KeepOldTables, "keep-old-table", false, "keep the table as it was, renamed to _<table>_old, after the swap")
+			flags.BoolVar(&c.DryRun, "dry-run", false, "check the alter against an empty copy of the table, without copying anything")
+			flags.DurationVar(&c.ProgressInterval, "progress-interval", 10*time.Second, "how often to report progress (0 to disable)")
+		},
+		Run: runSchemaAlter,
+	})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// the bulk commands (migrating, recalculating, archiving, rotating logs)
+// write as fast as the database lets them, which is fine in a maintenance
+// window, but not against a live server, where bancho.py's queries queue up
+// behind theirs. so each batch they write first goes through throttle:
+//
+//   - --max-rows-per-sec caps how fast rows are written, across all of a
+//     command's workers.
+//   - --max-threads-running backs off while more queries than this are
+//     running on the database at once (Threads_running, which counts the
+//     command's own workers too), until it's quiet again.
+//   - the replica given by --read-dsn is waited for, see replica.go.
+//
+// --max-transactions caps the number of workers, each of which holds one
+// transaction at a time, see tuneWorkers.
+
+// Threads_running is checked at most this often
+const loadCheckInterval = time.Second
+
+var metricThrottledSeconds = newCounter("migrate_throttled_seconds_total",
+	"Time spent waiting before writing, by reason: rate, threads_running or replica_lag.", "reason")
+
+var rateLimit struct {
+	sync.Mutex
+	next time.Time // when the next batch may start
+}
+
+var serverLoad struct {
+	sync.Mutex
+	checked time.Time
+}
+
+// throttle waits until a batch of rows may be written.
+func throttle(rows int) error {
+	if err := waitForLoad(); err != nil {
+		return err
+	}
+	if err := waitForReplica(); err != nil {
+		return err
+	}
+	if cfg.MaxRowsPerSec <= 0 || rows <= 0 {
+		return nil
+	}
+
+	// each batch reserves its share of the rate, and waits for its turn
+	rateLimit.Lock()
+	now, start := time.Now(), rateLimit.next
+	if start.Before(now) {
+		start = now
+	}
+	rateLimit.next = start.Add(time.Duration(float64(rows) / float64(cfg.MaxRowsPerSec) * float64(time.Second)))
+	rateLimit.Unlock()
+
+	if wait := start.Sub(now); wait > 0 {
+		metricThrottledSeconds.Add(wait.Seconds(), "rate")
+		select {
+		case <-time.After(wait):
+		case <-interrupted:
+			return errInterrupted
+		}
+	}
+	return nil
+}
+
+// threadsRunning reads how many queries the database is running right now.
+func threadsRunning() (int, error) {
+	var status struct {
+		Name  string `db:"Variable_name"`
+		Value int    `db:"Value"`
+	}
+	err := DB.Get(&status, "SHOW GLOBAL STATUS LIKE 'Threads_running'")
+	return status.Value, err
+}
+
+// waitForLoad backs off while the database is busier than
+// --max-threads-running, longer each time it's still busy.
+func waitForLoad() error {
+	if cfg.MaxThreadsRunning <= 0 {
+		return nil
+	}
+	serverLoad.Lock()
+	defer serverLoad.Unlock()
+	if time.Since(serverLoad.checked) < loadCheckInterval {
+		return nil
+	}
+
+	paused := time.Time{}
+	for attempt := 0; ; attempt++ {
+		running, err := threadsRunning()
+		serverLoad.checked = time.Now()
+		if err != nil {
+			return err
+		}
+		if running <= cfg.MaxThreadsRunning {
+			if !paused.IsZero() {
+				logger.Info("the database is quiet again, carrying on", "threads_running", running,
+					"paused", time.Since(paused).Round(time.Second))
+			}
+			return nil
+		}
+		if paused.IsZero() {
+			paused = time.Now()
+			logger.Warn("the database is busy, backing off", "threads_running", running, "max", cfg.MaxThreadsRunning)
+		}
+
+		delay := retryDelay(attempt)
+		metricThrottledSeconds.Add(delay.Seconds(), "threads_running")
+		select {
+		case <-time.After(delay):
+		case <-interrupted:
+			return errInterrupted
+		}
+	}
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// timestamps normalize shifts datetime columns written by a server which
+// ran in local time to utc, as bancho.py's datetimes are. mysql's datetimes
+// have no timezone, so the offset is detected by comparing scores'
+// play_time with when their replays were really set: the timestamp in the
+// replay's header, for replays which have one (bancho.py keeps only the
+// frames, but imports often keep whole .osr files), or else when the replay
+// file was written, for replays on local disk. both are utc, so a server
+// 2 hours ahead shows as +2h. replays copied since, e.g. by v4.2.0, only
+// have the time they were copied, which disagrees too much to be counted.
+//
+// a fixed --offset shifts every row by the same amount; --timezone (e.g.
+// Europe/Berlin) follows the zone's daylight saving, which a server in local
+// time did too. only the rows before --until (in the server's local time)
+// are shifted, for servers which have since moved to utc. the changes are
+// always shown first, and --dry-run stops there.
+//
+// each column's progress is kept in timezone_shifts, so an interrupted run
+// carries on where it stopped, and a shifted column isn't shifted twice.
+
+// the columns shifted by default, as table.column
+const defaultShiftedColumns = "scores.play_time,ingame_logins.datetime,logs.time"
+
+// offsets are rounded to this, as every timezone's is a multiple of it
+const offsetResolution = 15 * time.Minute
+
+// the share of samples which must agree on an offset to be trusted
+const offsetAgreement = 0.5
+
+const minOffsetSamples = 20
+
+// rows shifted per update, by id
+const shiftBatchIDs = 10000
+
+var create_timezone_shifts = `
+create table if not exists timezone_shifts (
+	column_name varchar(128) not null primary key,
+	shift varchar(64) not null,
+	last_id bigint not null,
+	done tinyint(1) not null default 0,
+	shifted_at datetime not null
+);`
+
+// datetimes are read as seconds since 1970-01-01 as they are, not through
+// UNIX_TIMESTAMP, which would apply the session's timezone
+var select_offset_samples = `
+SELECT id, TIMESTAMPDIFF(SECOND, '1970-01-01 00:00:00', play_time) AS play_time FROM scores
+WHERE status != 0 AND play_time < ? ORDER BY id DESC LIMIT ?`
+
+// offsetSample is a score's play_time & when its replay says it was set.
+type offsetSample struct {
+	ID       int64
+	PlayTime int64 `db:"play_time"`
+}
+
+// OffsetReport is the detected offset, overall & per month.
+type OffsetReport struct {
+	Samples  int               `json:"samples"`
+	Headers  int               `json:"headers"`  // samples from replay headers
+	Files    int               `json:"files"`    // samples from replay files' modification times
+	Offset   string            `json:"offset"`   // empty if the samples didn't agree
+	Agreeing float64           `json:"agreeing"` // the share of samples within offsetResolution of it
+	Months   map[string]string `json:"months"`   // the most common offset, per month of play_time
+}
+
+// replayTime is when a score's replay was set, from its header, or when it
+// was written.
+func replayTime(id int64) (time.Time, string, bool) {
+	key := replayKey(id)
+	in, err := newReplays.Open(key)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	data, err := io.ReadAll(in)
+	in.Close()
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	if replay, err := parseReplay(data); err == nil && replay.HasHeader {
+		return replay.Timestamp, "header", true
+	}
+
+	local, ok := newReplays.(LocalStore)
+	if !ok {
+		return time.Time{}, "", false
+	}
+	info, err := os.Stat(local.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		info, err = os.Stat(local.path(key) + compressedSuffix)
+	}
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	return info.ModTime(), "file", true
+}
+
+// mostCommonOffset returns the most common of offsets, and the share of
+// them which it is.
+func mostCommonOffset(offsets []time.Duration) (time.Duration, float64) {
+	counts := make(map[time.Duration]int)
+	var best time.Duration
+	for _, offset := range offsets {
+		counts[offset]++
+		if counts[offset] > counts[best] || counts[offset] == counts[best] && offset < best {
+			best = offset
+		}
+	}
+	if len(offsets) == 0 {
+		return 0, 0
+	}
+	return best, float64(counts[best]) / float64(len(offsets))
+}
+
+// detectOffset samples the latest scores before until (a naive local time),
+// and finds the offset most of them agree on.
+func detectOffset(until string) (*OffsetReport, time.Duration, bool, error) {
+	var samples []offsetSample
+	if err := DB.Select(&samples, select_offset_samples, until, cfg.OffsetSamples); err != nil {
+		return nil, 0, false, err
+	}
+
+	report := &OffsetReport{Months: map[string]string{}}
+	var offsets []time.Duration
+	byMonth := make(map[string][]time.Duration)
+	for _, sample := range samples {
+		if isInterrupted() {
+			return nil, 0, false, errInterrupted
+		}
+		at, source, ok := replayTime(sample.ID)
+		if !ok {
+			continue
+		}
+		if source == "header" {
+			report.Headers++
+		} else {
+			report.Files++
+		}
+		offset := (time.Duration(sample.PlayTime-at.Unix()) * time.Second).Round(offsetResolution)
+		offsets = append(offsets, offset)
+		month := time.Unix(sample.PlayTime, 0).UTC().Format("2006-01")
+		byMonth[month] = append(byMonth[month], offset)
+	}
+	report.Samples = len(offsets)
+	for month, monthOffsets := range byMonth {
+		offset, _ := mostCommonOffset(monthOffsets)
+		report.Months[month] = formatOffset(offset)
+	}
+
+	offset, agreeing := mostCommonOffset(offsets)
+	report.Agreeing = agreeing
+	if len(offsets) < minOffsetSamples || agreeing < offsetAgreement {
+		return report, 0, false, nil
+	}
+	report.Offset = formatOffset(offset)
+	return report, offset, true, nil
+}
+
+func formatOffset(offset time.Duration) string {
+	if offset < 0 {
+		return offset.String()
+	}
+	return "+" + offset.String()
+}
+
+// shiftPeriod is a span of naive local times with the same offset, up to
+// End (exclusive), or without an end if it's empty.
+type shiftPeriod struct {
+	End    string
+	Offset time.Duration
+}
+
+// zonePeriods splits the naive local times from..to into the zone's
+// offsets, e.g. its summer & winter times. the hour repeated when clocks
+// go back can't be told apart, and is taken as the earlier offset's.
+func zonePeriods(loc *time.Location, from, to time.Time) []shiftPeriod {
+	var periods []shiftPeriod
+	t := from.Add(-24 * time.Hour)
+	for {
+		local := t.In(loc)
+		_, offset := local.Zone()
+		_, end := local.ZoneBounds()
+		if end.IsZero() || end.After(to) {
+			periods = append(periods, shiftPeriod{Offset: time.Duration(offset) * time.Second})
+			return periods
+		}
+		// the transition, as the naive local time the old offset gives it
+		naive := end.UTC().Add(time.Duration(offset) * time.Second).Format(time.DateTime)
+		periods = append(periods, shiftPeriod{End: naive, Offset: time.Duration(offset) * time.Second})
+		t = end
+	}
+}
+
+// shiftExpr is the number of seconds a column's value is shifted back by.
+func shiftExpr(column string, periods []shiftPeriod) string {
+	if len(periods) == 1 {
+		return fmt.Sprint(int64(periods[0].Offset.Seconds()))
+	}
+	var b strings.Builder
+	b.WriteString("CASE")
+	for _, p := range periods {
+		if p.End == "" {
+			fmt.Fprintf(&b, " ELSE %d", int64(p.Offset.Seconds()))
+			break
+		}
+		fmt.Fprintf(&b, " WHEN `%s` < '%s' THEN %d", column, p.End, int64(p.Offset.Seconds()))
+	}
+	b.WriteString(" END")
+	return b.String()
+}
+
+// shiftedColumn is a table.column to shift.
+type shiftedColumn struct {
+	Table, Column string
+}
+
+func (c shiftedColumn) String() string { return c.Table + "." + c.Column }
+
+func parseShiftedColumns(value string) ([]shiftedColumn, error) {
+	var columns []shiftedColumn
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		table, column, ok := strings.Cut(name, ".")
+		if !ok || !validSchemaName.MatchString(table) || !validSchemaName.MatchString(column) {
+			return nil, fmt.Errorf("--columns %q must be table.column", name)
+		}
+		columns = append(columns, shiftedColumn{table, column})
+	}
+	return columns, nil
+}
+
+// shiftColumn shifts a column's rows before until back by their offset, a
+// batch of ids at a time, recording how far it got in timezone_shifts.
+func shiftColumn(c shiftedColumn, expr, shift, until string, fromID int64) error {
+	var maxID int64
+	if err := DB.Get(&maxID, fmt.Sprintf("SELECT COALESCE(MAX(id), 0) FROM `%s`", c.Table)); err != nil {
+		return err
+	}
+	update := fmt.Sprintf("UPDATE `%s` SET `%s` = `%s` - INTERVAL (%s) SECOND WHERE id > ? AND id <= ? AND `%s` < ?",
+		c.Table, c.Column, c.Column, expr, c.Column)
+
+	for lastID := fromID; lastID < maxID; lastID += shiftBatchIDs {
+		if isInterrupted() {
+			return errInterrupted
+		}
+		if err := throttle(shiftBatchIDs); err != nil {
+			return err
+		}
+		tx, err := DB.Beginx()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(update, lastID, lastID+shiftBatchIDs, until); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec(`
+		INSERT INTO timezone_shifts (column_name, shift, last_id, shifted_at) VALUES (?, ?, ?, NOW())
+		ON DUPLICATE KEY UPDATE last_id = VALUES(last_id)`, c.String(), shift, lastID+shiftBatchIDs); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	_, err := DB.Exec(`
+	INSERT INTO timezone_shifts (column_name, shift, last_id, done, shifted_at) VALUES (?, ?, ?, 1, NOW())
+	ON DUPLICATE KEY UPDATE done = 1, shifted_at = NOW()`, c.String(), shift, maxID)
+	return err
+}
+
+type shiftState struct {
+	Shift  string
+	LastID int64 `db:"last_id"`
+	Done   bool
+}
+
+// shiftPreview is how a column would change.
+type shiftPreview struct {
+	Rows    int64
+	Status  string
+	Changes []struct {
+		Before string
+		After  string
+	}
+}
+
+func runTimestampsNormalize() error {
+	if cfg.ShiftOffset != "" && cfg.ShiftTimezone != "" {
+		return errors.New("--offset and --timezone cannot be used together")
+	}
+	columns, err := parseShiftedColumns(cfg.ShiftColumns)
+	if err != nil {
+		return err
+	}
+	until := "9999-12-31 23:59:59"
+	if cfg.ShiftUntil != "" {
+		t, err := parseFilterTime("until", cfg.ShiftUntil)
+		if err != nil {
+			return err
+		}
+		// the cutoff is the server's local time, which is naive like the columns
+		until = time.Unix(t, 0).In(time.Local).Format(time.DateTime)
+	}
+	if err := setupReplayStores(); err != nil {
+		return err
+	}
+	handleSignals()
+
+	// the offset is detected even when given, as a check
+	var detected time.Duration
+	var found bool
+	if cfg.OffsetSamples > 0 {
+		var report *OffsetReport
+		if report, detected, found, err = detectOffset(until); err != nil {
+			return err
+		}
+		months := make([]string, 0, len(report.Months))
+		for month := range report.Months {
+			months = append(months, month)
+		}
+		sort.Strings(months)
+		fmt.Printf("%d scores' replays sampled (%d headers, %d file times)\n", report.Samples, report.Headers, report.Files)
+		for _, month := range months {
+			fmt.Printf("  %s %s\n", month, report.Months[month])
+		}
+		if found {
+			fmt.Printf("detected offset: %s (%.0f%% of samples agree)\n", report.Offset, 100*report.Agreeing)
+		} else {
+			fmt.Printf("no offset was agreed on (at most %.0f%% of %d samples agree)\n", 100*report.Agreeing, report.Samples)
+		}
+		if err := writeReport(cfg.ReportPath, report); err != nil {
+			return err
+		}
+	}
+
+	// the offsets every naive time is shifted back by
+	var periods []shiftPeriod
+	var shift string
+	switch {
+	case cfg.ShiftTimezone != "":
+		loc, err := time.LoadLocation(cfg.ShiftTimezone)
+		if err != nil {
+			return err
+		}
+		periods = zonePeriods(loc, time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), time.Now())
+		shift = cfg.ShiftTimezone
+	case cfg.ShiftOffset != "":
+		offset, err := time.ParseDuration(cfg.ShiftOffset)
+		if err != nil {
+			return fmt.Errorf("--offset %q must be a duration, e.g. +2h or -5h30m", cfg.ShiftOffset)
+		}
+		if found && offset != detected {
+			logger.Warn("--offset disagrees with the detected offset", "offset", formatOffset(offset), "detected", formatOffset(detected))
+		}
+		periods = []shiftPeriod{{Offset: offset}}
+		shift = formatOffset(offset)
+	case found:
+		periods = []shiftPeriod{{Offset: detected}}
+		shift = formatOffset(detected)
+	default:
+		return errors.New("no offset to shift by, give --offset or --timezone")
+	}
+	if len(periods) == 1 && periods[0].Offset == 0 {
+		fmt.Println("the timestamps are already utc")
+		return nil
+	}
+
+	if _, err := DB.Exec(create_timezone_shifts); err != nil {
+		return err
+	}
+
+	// the diff, column by column
+	var pending []shiftedColumn
+	resumeFrom := make(map[string]int64)
+	for _, c := range columns {
+		var preview shiftPreview
+		exists, err := tableExists(c.Table)
+		if err != nil {
+			return err
+		}
+		var state shiftState
+		err = DB.Get(&state, "SELECT shift, last_id, done FROM timezone_shifts WHERE column_name = ?", c.String())
+		switch {
+		case !exists:
+			preview.Status = "no such table"
+		case err == nil && state.Done:
+			preview.Status = "already shifted by " + state.Shift
+		case err == nil && state.Shift != shift:
+			return fmt.Errorf("%s was partly shifted by %s, carry on with the same shift", c, state.Shift)
+		default:
+			resumeFrom[c.String()] = state.LastID
+			expr := shiftExpr(c.Column, periods)
+			if err := DB.Get(&preview.Rows, fmt.Sprintf("SELECT COUNT(*) FROM `%s` WHERE id > ? AND `%s` < ?", c.Table, c.Column),
+				state.LastID, until); err != nil {
+				return err
+			}
+			if err := DB.Select(&preview.Changes, fmt.Sprintf(`
+			SELECT CAST(%[2]s AS CHAR) AS `+"`before`"+`, CAST(%[2]s - INTERVAL (%[3]s) SECOND AS CHAR) AS `+"`after`"+`
+			FROM %[1]s WHERE id > ? AND %[2]s < ? ORDER BY id DESC LIMIT 3`, "`"+c.Table+"`", "`"+c.Column+"`", expr),
+				state.LastID, until); err != nil {
+				return err
+			}
+			preview.Status = "to shift"
+			if state.LastID != 0 {
+				preview.Status = fmt.Sprintf("to shift, from id %d", state.LastID)
+			}
+			pending = append(pending, c)
+		}
+
+		fmt.Printf("%-24s %-28s %d rows\n", c, preview.Status, preview.Rows)
+		for _, change := range preview.Changes {
+			fmt.Printf("  - %s\n  + %s\n", change.Before, change.After)
+		}
+	}
+
+	if cfg.DryRun || len(pending) == 0 {
+		return nil
+	}
+	fmt.Printf("This will shift %d columns back by %s, to utc.\n", len(pending), shift)
+	if !confirm("Continue?") {
+		fmt.Println("Not shifting anything")
+		return nil
+	}
+
+	for _, c := range pending {
+		start := time.Now()
+		if err := shiftColumn(c, shiftExpr(c.Column, periods), shift, until, resumeFrom[c.String()]); err != nil {
+			if err == errInterrupted {
+				logger.Warn("stopped before finishing, run the same command again to continue", "column", c.String())
+			}
+			return fmt.Errorf("failed to shift %s: %w", c, err)
+		}
+		logger.Info("shifted column to utc", "column", c.String(), "shift", shift, "elapsed", time.Since(start).Round(time.Second))
+	}
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:              "timestamps normalize",
+		Summary:           "detect the offset of datetimes written in a server's local time, and shift them to utc",
+		UsesDataDirectory: true,
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.ShiftColumns, "columns", defaultShiftedColumns, "the datetime columns to shift, as table.column, comma separated (their tables need an id)")
+			flags.StringVar(&c.ShiftOffset, "offset", "", "shift by this offset, e.g. +2h, rather than the detected one")
+			flags.StringVar(&c.ShiftTimezone, "timezone", "", "shift from this timezone, following its daylight saving, e.g. Europe/Berlin")
+			flags.StringVar(&c.ShiftUntil, "until", "", "only shift rows before this date, in the server's local time (e.g. when it moved to utc)")
+			flags.IntVar(&c.OffsetSamples, "samples", 1000, "how many of the latest scores' replays to detect the offset from (0 to skip detecting it)")
+			flags.BoolVar(&c.DryRun, "dry-run", false, "show how the columns would change, without changing them")
+			flags.StringVar(&c.ReportPath, "report", "", "write the detected offsets as json to this path (- for stdout)")
+			flags.StringVar(&c.NewReplays, "replays", "", "where bancho.py's replays are, a path or s3://bucket/prefix (default: DATA_DIRECTORY/osr)")
+		},
+		Run: runTimestampsNormalize,
+	})
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// export tournament aggregates the scores of a tournament's matches (by id,
+// or those created in a date range) into the stats its staff usually write
+// throwaway sql for, as json or csv, three files in --out:
+//
+//   - players: each player's seed, with their maps played, rank sum and
+//     total & average scores.
+//   - maps: each player's average & best score on each map, and their rank
+//     on it, by average score.
+//   - mods: each player's average score & accuracy per mod (or pool slot's
+//     mods), e.g. for seeing who's strongest on hard rock.
+//
+// only the --players pool is counted, if given, and only --pool's maps, if
+// given, which are then labelled by their slot (NM1, HD2, etc). a player's
+// mods are the game's mods & theirs (with freemod) together, less nofail,
+// which tournaments usually force.
+//
+// with --seeding rank (as in most qualifiers), players are seeded by the sum
+// of their ranks on each map, where a map they didn't play counts as ranking
+// below everyone who did; with --seeding score, by their total score.
+
+// TourneyScore is a score in one of the tournament's games.
+type TourneyScore struct {
+	UserID   int64         `db:"userid"`
+	Name     string        `db:"name"`
+	Country  string        `db:"country"`
+	MapID    int64         `db:"map_id"`
+	Artist   string        `db:"artist"`
+	Title    string        `db:"title"`
+	Version  string        `db:"version"`
+	Mods     int           `db:"mods"`
+	PoolMods sql.NullInt64 `db:"pool_mods"`
+	Slot     sql.NullInt64 `db:"slot"`
+	Score    int64         `db:"score"`
+	Acc      float64       `db:"acc"`
+}
+
+// TourneyPlayer is a player's row in players.
+type TourneyPlayer struct {
+	Seed       int     `json:"seed"`
+	UserID     int64   `json:"user_id"`
+	Name       string  `json:"name"`
+	Country    string  `json:"country"`
+	MapsPlayed int     `json:"maps_played"`
+	Plays      int     `json:"plays"`
+	RankSum    int     `json:"rank_sum"`
+	AvgRank    float64 `json:"avg_rank"`
+	TotalScore float64 `json:"total_score"` // the sum of their average score on each map
+	AvgAcc     float64 `json:"avg_acc"`
+
+	acc float64
+}
+
+// TourneyMapResult is a player's row in maps.
+type TourneyMapResult struct {
+	MapID     int64   `json:"map_id"`
+	Label     string  `json:"label"`
+	Artist    string  `json:"artist"`
+	Title     string  `json:"title"`
+	Version   string  `json:"version"`
+	UserID    int64   `json:"user_id"`
+	Name      string  `json:"name"`
+	Plays     int     `json:"plays"`
+	AvgScore  float64 `json:"avg_score"`
+	BestScore int64   `json:"best_score"`
+	AvgAcc    float64 `json:"avg_acc"`
+	Rank      int     `json:"rank"`
+
+	score, acc float64
+}
+
+// TourneyModResult is a player's row in mods.
+type TourneyModResult struct {
+	Mod        string  `json:"mod"`
+	UserID     int64   `json:"user_id"`
+	Name       string  `json:"name"`
+	MapsPlayed int     `json:"maps_played"`
+	Plays      int     `json:"plays"`
+	AvgScore   float64 `json:"avg_score"`
+	AvgAcc     float64 `json:"avg_acc"`
+
+	maps       map[int64]bool
+	score, acc float64
+}
+
+var select_tourney_scores = `
+SELECT s.userid, COALESCE(u.name, '') AS name, COALESCE(u.country, 'xx') AS country, g.map_id,
+COALESCE(m.artist, '') AS artist, COALESCE(m.title, '') AS title, COALESCE(m.version, '') AS version,
+(g.mods | s.mods) & ~1 AS mods, %s, s.score, s.acc
+FROM match_game_scores s JOIN match_games g ON g.id = s.game_id
+LEFT JOIN users u ON u.id = s.userid
+LEFT JOIN maps m ON m.id = g.map_id
+%s
+WHERE g.match_id IN (SELECT id FROM matches WHERE %s)`
+
+// modLabel names mods as bancho.py does, e.g. HDHR, or NM for none.
+func modLabel(mods int) string {
+	if acronyms := acronymsFromMods(mods); len(acronyms) != 0 {
+		return strings.Join(acronyms, "")
+	}
+	return "NM"
+}
+
+// mapLabel & modGroup are what a score's map & mods are called: its pool
+// slot, if there's a pool, otherwise the map's name & the mods played.
+func (s TourneyScore) mapLabel() string {
+	if s.Slot.Valid {
+		return fmt.Sprintf("%s%d", modLabel(int(s.PoolMods.Int64)), s.Slot.Int64)
+	}
+	if s.Title == "" {
+		return fmt.Sprintf("map %d", s.MapID) // one bancho.py hasn't seen
+	}
+	return fmt.Sprintf("%s - %s [%s]", s.Artist, s.Title, s.Version)
+}
+
+func (s TourneyScore) modGroup() string {
+	if s.PoolMods.Valid {
+		return modLabel(int(s.PoolMods.Int64))
+	}
+	return modLabel(s.Mods)
+}
+
+// readPlayerPool reads --players: names or ids, separated by commas, or
+// from a file (one per line) given as @path.
+func readPlayerPool(value string) (map[int64]bool, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if path, ok := strings.CutPrefix(value, "@"); ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		value = strings.ReplaceAll(string(data), "\n", ",")
+	}
+	pool := map[int64]bool{}
+	for _, player := range strings.Split(value, ",") {
+		if player = strings.TrimSpace(player); player == "" {
+			continue
+		}
+		id, err := findUser(player)
+		if err != nil {
+			return nil, err
+		}
+		pool[id] = true
+	}
+	return pool, nil
+}
+
+// aggregateTourney works out the rows of each file from the scores.
+func aggregateTourney(scores []TourneyScore, seeding string) ([]*TourneyPlayer, []*TourneyMapResult, []*TourneyModResult) {
+	players := map[int64]*TourneyPlayer{}
+	type key struct {
+		user int64
+		mod  string
+	}
+	results := map[[2]int64]*TourneyMapResult{}
+	mods := map[key]*TourneyModResult{}
+	for _, s := range scores {
+		p := players[s.UserID]
+		if p == nil {
+			p = &TourneyPlayer{UserID: s.UserID, Name: s.Name, Country: s.Country}
+			players[s.UserID] = p
+		}
+		p.Plays++
+		p.acc += s.Acc
+
+		r := results[[2]int64{s.MapID, s.UserID}]
+		if r == nil {
+			r = &TourneyMapResult{MapID: s.MapID, Label: s.mapLabel(), Artist: s.Artist, Title: s.Title,
+				Version: s.Version, UserID: s.UserID, Name: s.Name}
+			results[[2]int64{s.MapID, s.UserID}] = r
+		}
+		r.Plays++
+		r.score += float64(s.Score)
+		r.acc += s.Acc
+		r.BestScore = max(r.BestScore, s.Score)
+
+		k := key{s.UserID, s.modGroup()}
+		m := mods[k]
+		if m == nil {
+			m = &TourneyModResult{Mod: k.mod, UserID: s.UserID, Name: s.Name, maps: map[int64]bool{}}
+			mods[k] = m
+		}
+		m.Plays++
+		m.score += float64(s.Score)
+		m.acc += s.Acc
+		m.maps[s.MapID] = true
+	}
+
+	// ranks on each map, by average score, with ties sharing a rank
+	byMap := map[int64][]*TourneyMapResult{}
+	for _, r := range results {
+		r.AvgScore = r.score / float64(r.Plays)
+		r.AvgAcc = r.acc / float64(r.Plays)
+		byMap[r.MapID] = append(byMap[r.MapID], r)
+	}
+	var maps []*TourneyMapResult
+	for _, rs := range byMap {
+		slices.SortFunc(rs, func(a, b *TourneyMapResult) int {
+			if a.AvgScore != b.AvgScore {
+				if a.AvgScore > b.AvgScore {
+					return -1
+				}
+				return 1
+			}
+			return int(a.UserID - b.UserID)
+		})
+		for i, r := range rs {
+			r.Rank = i + 1
+			if i > 0 && r.AvgScore == rs[i-1].AvgScore {
+				r.Rank = rs[i-1].Rank
+			}
+			p := players[r.UserID]
+			p.MapsPlayed++
+			p.RankSum += r.Rank
+			p.TotalScore += r.AvgScore
+		}
+		maps = append(maps, rs...)
+	}
+	// a map a player didn't play ranks them below everyone who did
+	for _, p := range players {
+		for _, rs := range byMap {
+			if !slices.ContainsFunc(rs, func(r *TourneyMapResult) bool { return r.UserID == p.UserID }) {
+				p.RankSum += len(rs) + 1
+			}
+		}
+	}
+
+	seeds := make([]*TourneyPlayer, 0, len(players))
+	for _, p := range players {
+		p.AvgAcc = p.acc / float64(p.Plays)
+		if len(byMap) != 0 {
+			p.AvgRank = float64(p.RankSum) / float64(len(byMap))
+		}
+		seeds = append(seeds, p)
+	}
+	slices.SortFunc(seeds, func(a, b *TourneyPlayer) int {
+		if seeding == "rank" && a.RankSum != b.RankSum {
+			return a.RankSum - b.RankSum
+		}
+		if a.TotalScore != b.TotalScore {
+			if a.TotalScore > b.TotalScore {
+				return -1
+			}
+			return 1
+		}
+		return int(a.UserID - b.UserID)
+	})
+	for i, p := range seeds {
+		p.Seed = i + 1
+	}
+	slices.SortFunc(maps, func(a, b *TourneyMapResult) int {
+		if a.Label != b.Label {
+			return strings.Compare(a.Label, b.Label)
+		}
+		if a.MapID != b.MapID {
+			return int(a.MapID - b.MapID)
+		}
+		return a.Rank - b.Rank
+	})
+
+	breakdown := make([]*TourneyModResult, 0, len(mods))
+	for _, m := range mods {
+		m.MapsPlayed = len(m.maps)
+		m.AvgScore = m.score / float64(m.Plays)
+		m.AvgAcc = m.acc / float64(m.Plays)
+		breakdown = append(breakdown, m)
+	}
+	slices.SortFunc(breakdown, func(a, b *TourneyModResult) int {
+		if a.Mod != b.Mod {
+			return strings.Compare(a.Mod, b.Mod)
+		}
+		if a.AvgScore > b.AvgScore {
+			return -1
+		} else if a.AvgScore < b.AvgScore {
+			return 1
+		}
+		return int(a.UserID - b.UserID)
+	})
+	return seeds, maps, breakdown
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', 2, 64)
+}
+
+// writeTourneyFiles writes players, maps & mods in --format.
+func writeTourneyFiles(dir string, players []*TourneyPlayer, maps []*TourneyMapResult, mods []*TourneyModResult) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	path := func(name string) string { return filepath.Join(dir, name+"."+cfg.ReportFormat) }
+	if cfg.ReportFormat == "json" {
+		for name, v := range map[string]interface{}{"players": players, "maps": maps, "mods": mods} {
+			if err := writeReport(path(name), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	rows := make([][]string, len(players))
+	for i, p := range players {
+		rows[i] = []string{strconv.Itoa(p.Seed), strconv.FormatInt(p.UserID, 10), p.Name, p.Country,
+			strconv.Itoa(p.MapsPlayed), strconv.Itoa(p.Plays), strconv.Itoa(p.RankSum), formatFloat(p.AvgRank),
+			formatFloat(p.TotalScore), formatFloat(p.AvgAcc)}
+	}
+	err := writeCSVReport(path("players"), []string{"seed", "user_id", "name", "country", "maps_played", "plays",
+		"rank_sum", "avg_rank", "total_score", "avg_acc"}, rows)
+	if err != nil {
+		return err
+	}
+
+	rows = make([][]string, len(maps))
+	for i, r := range maps {
+		rows[i] = []string{strconv.FormatInt(r.MapID, 10), r.Label, r.Artist, r.Title, r.Version,
+			strconv.FormatInt(r.UserID, 10), r.Name, strconv.Itoa(r.Plays), formatFloat(r.AvgScore),
+			strconv.FormatInt(r.BestScore, 10), formatFloat(r.AvgAcc), strconv.Itoa(r.Rank)}
+	}
+	err = writeCSVReport(path("maps"), []string{"map_id", "label", "artist", "title", "version", "user_id", "name",
+		"plays", "avg_score", "best_score", "avg_acc", "rank"}, rows)
+	if err != nil {
+		return err
+	}
+
+	rows = make([][]string, len(mods))
+	for i, m := range mods {
+		rows[i] = []string{m.Mod, strconv.FormatInt(m.UserID, 10), m.Name, strconv.Itoa(m.MapsPlayed),
+			strconv.Itoa(m.Plays), formatFloat(m.AvgScore), formatFloat(m.AvgAcc)}
+	}
+	return writeCSVReport(path("mods"), []string{"mod", "user_id", "name", "maps_played", "plays", "avg_score", "avg_acc"}, rows)
+}
+
+func runExportTournament() error {
+	if cfg.ReportFormat != "json" && cfg.ReportFormat != "csv" {
+		return fmt.Errorf("unknown --format %q, expected json or csv", cfg.ReportFormat)
+	}
+	if cfg.TourneySeeding != "rank" && cfg.TourneySeeding != "score" {
+		return fmt.Errorf("unknown --seeding %q, expected rank or score", cfg.TourneySeeding)
+	}
+	if cfg.ExportMatches == "" && cfg.MatchesSince == "" {
+		return errors.New("--matches or --since must pick the tournament's matches")
+	}
+	for _, table := range matchTables {
+		if exists, err := tableExists(table); err != nil {
+			return err
+		} else if !exists {
+			return fmt.Errorf("the %s table does not exist, import akatsuki fills in the match history", table)
+		}
+	}
+
+	var conditions []string
+	var args []interface{}
+	if cfg.ExportMatches != "" {
+		var ids []string
+		for _, id := range strings.Split(cfg.ExportMatches, ",") {
+			id = strings.TrimSpace(id)
+			if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+				return fmt.Errorf("--matches must be a list of match ids, not %q", id)
+			}
+			ids = append(ids, id)
+		}
+		conditions = append(conditions, fmt.Sprintf("id IN (%s)", strings.Join(ids, ", ")))
+	}
+	for _, bound := range []struct{ name, value, condition string }{
+		{"since", cfg.MatchesSince, "created_at >= FROM_UNIXTIME(?)"},
+		{"until", cfg.MatchesUntil, "created_at < FROM_UNIXTIME(?)"},
+	} {
+		if bound.value == "" {
+			continue
+		}
+		t, err := parseFilterTime(bound.name, bound.value)
+		if err != nil {
+			return err
+		}
+		conditions = append(conditions, bound.condition)
+		args = append(args, t)
+	}
+
+	players, err := readPlayerPool(cfg.TourneyPlayers)
+	if err != nil {
+		return err
+	}
+
+	poolColumns, poolJoin := "NULL AS pool_mods, NULL AS slot", ""
+	if cfg.TourneyPool != "" {
+		var pool int64
+		err := DB.Get(&pool, "SELECT id FROM tourney_pools WHERE id = ? OR name = ? ORDER BY id = ? DESC LIMIT 1",
+			cfg.TourneyPool, cfg.TourneyPool, cfg.TourneyPool)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("no pool is called %q", cfg.TourneyPool)
+		} else if err != nil {
+			return err
+		}
+		poolColumns = "pm.mods AS pool_mods, pm.slot"
+		poolJoin = fmt.Sprintf("JOIN tourney_pool_maps pm ON pm.map_id = g.map_id AND pm.pool_id = %d", pool)
+	}
+
+	var scores []TourneyScore
+	query := fmt.Sprintf(select_tourney_scores, poolColumns, poolJoin, strings.Join(conditions, " AND "))
+	if err := DB.Select(&scores, query, args...); err != nil {
+		return err
+	}
+	if players != nil {
+		scores = slices.DeleteFunc(scores, func(s TourneyScore) bool { return !players[s.UserID] })
+	}
+	if len(scores) == 0 {
+		return errors.New("the matches have no scores by the players, on the pool's maps")
+	}
+
+	start := time.Now()
+	seeds, maps, mods := aggregateTourney(scores, cfg.TourneySeeding)
+	if err := writeTourneyFiles(cfg.TourneyOut, seeds, maps, mods); err != nil {
+		return err
+	}
+
+	for _, p := range seeds[:min(len(seeds), 10)] {
+		fmt.Printf("  %3d. %-15s rank sum %-5d total %.0f\n", p.Seed, p.Name, p.RankSum, p.TotalScore)
+	}
+	if len(seeds) > 10 {
+		fmt.Printf("  ... and %d more, see %s\n", len(seeds)-10, cfg.TourneyOut)
+	}
+	logger.Info("exported the tournament", "players", len(seeds), "scores", len(scores), "to", cfg.TourneyOut,
+		"elapsed", time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "export tournament",
+		Summary: "aggregate a tournament's matches into seedings, per map & per mod stats of its players, as json or csv",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.ExportMatches, "matches", "", "comma separated ids of the tournament's matches")
+			flags.StringVar(&c.MatchesSince, "since", "", "matches created since this date, or duration ago (e.g. 720h)")
+			flags.StringVar(&c.MatchesUntil, "until", "", "matches created before this date, or duration ago")
+			flags.StringVar(&c.TourneyPlayers, "players", "", "comma separated names or ids of the player pool, or @file with one per line (default: everyone who played)")
+			flags.StringVar(&c.TourneyPool, "pool", "", "name or id of the tourney pool, whose maps are counted & labelled by slot (default: every map)")
+			flags.StringVar(&c.TourneySeeding, "seeding", "rank", "how players are seeded: rank (the sum of their ranks on each map) or score (their total score)")
+			flags.StringVar(&c.TourneyOut, "out", "tournament", "directory to write players, maps & mods to")
+			flags.StringVar(&c.ReportFormat, "format", "csv", "the files' format: json or csv")
+		},
+		Run: runExportTournament,
+	})
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// on a terminal, the migrations show a dashboard rather than printing their
+// progress every --progress-interval: a progress bar per table, what each
+// worker is doing, and the latest warnings & errors, redrawn in place. log
+// lines scroll by above it. it's drawn with plain ansi escape codes, which
+// every terminal bancho.py runs on understands.
+//
+// confirm asks the questions guarding destructive steps, the same way on a
+// terminal or not, but highlighted on one.
+
+// dashboardRedraw is how often the dashboard is redrawn.
+const dashboardRedraw = 500 * time.Millisecond
+
+// dashboardFeedSize is how many of the latest warnings & errors are shown.
+const dashboardFeedSize = 5
+
+// isTerminal reports whether f is an interactive terminal, rather than a
+// file or a pipe.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0 && os.Getenv("TERM") != "dumb"
+}
+
+// terminalWidth is the terminal's width, as the shell exports it, so that
+// lines can be cut short rather than wrapping & throwing the redraw off.
+func terminalWidth() int {
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 20 {
+		return n
+	}
+	return 100
+}
+
+// truncate cuts a line to fit the terminal.
+func truncate(s string, width int) string {
+	if r := []rune(s); len(r) > width {
+		return string(r[:width-1]) + "…"
+	}
+	return s
+}
+
+// stdin is where the user's answers are read from.
+var stdin = bufio.NewReader(os.Stdin)
+
+// confirm asks a yes or no question, which is answered no unless the user
+// types y (or yes), or --yes was given. without anyone to answer, e.g. when
+// run from a script with stdin closed, the answer is no.
+func confirm(question string) bool {
+	if isTerminal(os.Stdout) {
+		fmt.Printf("\x1b[1;33m%s\x1b[0m (y/n)\n>> ", question)
+	} else {
+		fmt.Printf("%s (y/n)\n>> ", question)
+	}
+	if cfg != nil && cfg.Yes {
+		fmt.Println("yes (--yes)")
+		return true
+	}
+
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		fmt.Println()
+		logger.Warn("nothing answered the question, so the answer is no (pass --yes to answer yes)", "question", question)
+		return false
+	}
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
+
+// terminalWriter is where logs are written. while a dashboard is shown, each
+// log line is written above it, by clearing & redrawing it around the line.
+type terminalWriter struct {
+	mu   sync.Mutex
+	dash *dashboard
+}
+
+var stderr = &terminalWriter{}
+
+func (w *terminalWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.dash != nil {
+		w.dash.clear()
+	}
+	n, err := os.Stderr.Write(p)
+	if w.dash != nil {
+		w.dash.draw()
+	}
+	return n, err
+}
+
+// feed adds a warning or error to the dashboard's feed, if one is shown.
+func (w *terminalWriter) feed(record slog.Record) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.dash == nil {
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %-5s %s", record.Time.Format("15:04:05"), record.Level, record.Message)
+	record.Attrs(func(a slog.Attr) bool {
+		fmt.Fprintf(&b, " %s=%v", a.Key, a.Value)
+		return true
+	})
+	w.dash.feed = append(w.dash.feed, b.String())
+	if len(w.dash.feed) > dashboardFeedSize {
+		w.dash.feed = w.dash.feed[1:]
+	}
+}
+
+// dashboard draws a migration's progress.
+type dashboard struct {
+	progress *Progress
+	lines    int // drawn last time, which are cleared before drawing again
+	feed     []string
+
+	// inserted rows a few seconds ago, for the current rate
+	samples []progressSample
+}
+
+type progressSample struct {
+	at       time.Time
+	inserted int64
+}
+
+func (d *dashboard) clear() {
+	if d.lines != 0 {
+		fmt.Fprintf(os.Stderr, "\x1b[%dA\x1b[J", d.lines)
+		d.lines = 0
+	}
+}
+
+// bar draws a progress bar.
+func bar(fraction float64, width int) string {
+	if fraction > 1 {
+		fraction = 1
+	}
+	filled := int(fraction * float64(width))
+	return "\x1b[32m" + strings.Repeat("█", filled) + "\x1b[90m" + strings.Repeat("░", width-filled) + "\x1b[0m"
+}
+
+func (d *dashboard) draw() {
+	p := d.progress
+	width := terminalWidth() - 1
+	now := time.Now()
+	elapsed := now.Sub(p.start)
+	total, _, inserted, failed, skipped := p.totals()
+	done := inserted + failed + skipped
+
+	// the rate over the last 10 seconds or so
+	d.samples = append(d.samples, progressSample{now, inserted})
+	for len(d.samples) > 1 && now.Sub(d.samples[0].at) > 10*time.Second {
+		d.samples = d.samples[1:]
+	}
+	rate := 0.0
+	if first := d.samples[0]; now.Sub(first.at) > 0 {
+		rate = float64(inserted-first.inserted) / now.Sub(first.at).Seconds()
+	}
+	percent := 0.0
+	if total != 0 {
+		percent = float64(done) / float64(total) * 100
+	}
+
+	var lines []string
+	lines = append(lines, "\x1b[1m"+truncate(fmt.Sprintf("%s elapsed · %.1f%% · %d/%d rows · %.0f rows/s · eta %s",
+		elapsed.Round(time.Second), percent, done, total, rate, formatETA(inserted+failed, total-skipped, elapsed)), width)+"\x1b[0m")
+
+	nameWidth := 0
+	for _, name := range p.order {
+		if len(name) > nameWidth {
+			nameWidth = len(name)
+		}
+	}
+	for _, name := range p.order {
+		t := p.tables[name]
+		tableTotal := atomic.LoadInt64(&t.Total)
+		tableDone := atomic.LoadInt64(&t.Inserted) + atomic.LoadInt64(&t.Failed) +
+			atomic.LoadInt64(&t.Skipped) + atomic.LoadInt64(&t.Filtered)
+		fraction := 1.0
+		if tableTotal != 0 {
+			fraction = float64(tableDone) / float64(tableTotal)
+		}
+		status := fmt.Sprintf(" %5.1f%% %d/%d", fraction*100, tableDone, tableTotal)
+		if n := atomic.LoadInt64(&t.Failed); n != 0 {
+			status += fmt.Sprintf(", %d failed", n)
+		}
+		if n := atomic.LoadInt64(&t.Filtered); n != 0 {
+			status += fmt.Sprintf(", %d filtered", n)
+		}
+		lines = append(lines, fmt.Sprintf("%-*s ", nameWidth, name)+bar(fraction, 30)+truncate(status, width-nameWidth-31))
+	}
+
+	var workers strings.Builder
+	busy := 0
+	for i := range p.busy {
+		if atomic.LoadInt32(&p.busy[i]) != 0 {
+			workers.WriteString("\x1b[32m●\x1b[0m")
+			busy++
+		} else {
+			workers.WriteString("\x1b[90m○\x1b[0m")
+		}
+	}
+	lines = append(lines, fmt.Sprintf("%-*s %s %d/%d busy", nameWidth, "workers", workers.String(), busy, len(p.busy)))
+	lines = append(lines, fmt.Sprintf("%-*s %d moved, %d missing", nameWidth, "replays",
+		atomic.LoadInt64(&p.ReplaysMoved), atomic.LoadInt64(&p.ReplaysMissing)))
+
+	if len(d.feed) != 0 {
+		lines = append(lines, "latest warnings & errors:")
+		for _, line := range d.feed {
+			color := "\x1b[33m"
+			if strings.Contains(line, " ERROR ") {
+				color = "\x1b[31m"
+			}
+			lines = append(lines, color+"  "+truncate(line, width-2)+"\x1b[0m")
+		}
+	}
+
+	fmt.Fprintln(os.Stderr, strings.Join(lines, "\n"))
+	d.lines = len(lines)
+}
+
+// showDashboard draws the dashboard until stop is closed, leaving its last
+// frame on the screen.
+func (p *Progress) showDashboard(stop <-chan struct{}) {
+	d := &dashboard{progress: p}
+	stderr.mu.Lock()
+	stderr.dash = d
+	d.draw()
+	stderr.mu.Unlock()
+
+	ticker := time.NewTicker(dashboardRedraw)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			stderr.mu.Lock()
+			d.clear()
+			d.draw()
+			stderr.mu.Unlock()
+		case <-stop:
+			stderr.mu.Lock()
+			d.clear()
+			d.draw()
+			stderr.dash = nil
+			stderr.mu.Unlock()
+			return
+		}
+	}
+}
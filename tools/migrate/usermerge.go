@@ -0,0 +1,328 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// users merge folds a player's duplicate account into their main one: the
+// duplicate's scores (and archived scores), map playcounts, friends &
+// blocks, favourites, achievements and previous names are moved over.
+// replays are named by score id, which doesn't change, so they stay where
+// they are. the duplicate's rank history is deleted, as it ranked
+// separately; history backfill can redraw the main account's from the
+// merged scores.
+//
+// afterwards, the main account's best score on each map is the one with the
+// most pp of either account's, and both accounts' stats are rebuilt. the
+// duplicate is soft-deleted, by removing its privileges, so it can't be
+// played on but can still be looked up, and the merge is recorded in
+// bancho.py's logs table, on both accounts.
+
+// UserMergeStep moves some of the duplicate's rows to the main account, in
+// the order of its queries. :from is the duplicate, and :to the main account.
+type UserMergeStep struct {
+	Name    string
+	Table   string
+	Count   string
+	Queries []string
+}
+
+var userMergeSteps = []UserMergeStep{
+	{
+		"scores", "scores",
+		"SELECT COUNT(*) FROM scores WHERE userid = :from",
+		[]string{"UPDATE scores SET userid = :to WHERE userid = :from"},
+	},
+	{
+		"archived_scores", archiveTable,
+		"SELECT COUNT(*) FROM " + archiveTable + " WHERE userid = :from",
+		[]string{"UPDATE " + archiveTable + " SET userid = :to WHERE userid = :from"},
+	},
+	// maps both accounts played have their playcounts summed
+	{
+		"map_plays", "user_map_plays",
+		"SELECT COUNT(*) FROM user_map_plays WHERE userid = :from",
+		[]string{
+			`INSERT INTO user_map_plays (userid, map_md5, mode, plays, passes, last_played)
+			SELECT :to, map_md5, mode, plays, passes, last_played FROM user_map_plays WHERE userid = :from
+			ON DUPLICATE KEY UPDATE plays = user_map_plays.plays + VALUES(plays),
+			passes = user_map_plays.passes + VALUES(passes),
+			last_played = GREATEST(user_map_plays.last_played, VALUES(last_played))`,
+			"DELETE FROM user_map_plays WHERE userid = :from",
+		},
+	},
+	{
+		"rank_history", "rank_history",
+		"SELECT COUNT(*) FROM rank_history WHERE userid = :from",
+		[]string{"DELETE FROM rank_history WHERE userid = :from"},
+	},
+	// relationships between the two accounts are dropped
+	{
+		"relationships", "relationships",
+		"SELECT COUNT(*) FROM relationships WHERE user1 = :from OR user2 = :from",
+		[]string{
+			`INSERT IGNORE INTO relationships (user1, user2, type)
+			SELECT :to, user2, type FROM relationships WHERE user1 = :from AND user2 != :to`,
+			`INSERT IGNORE INTO relationships (user1, user2, type)
+			SELECT user1, :to, type FROM relationships WHERE user2 = :from AND user1 != :to`,
+			"DELETE FROM relationships WHERE user1 = :from OR user2 = :from",
+		},
+	},
+	{
+		"favourites", "favourites",
+		"SELECT COUNT(*) FROM favourites WHERE userid = :from",
+		[]string{
+			`INSERT IGNORE INTO favourites (userid, setid, created_at)
+			SELECT :to, setid, created_at FROM favourites WHERE userid = :from`,
+			"DELETE FROM favourites WHERE userid = :from",
+		},
+	},
+	{
+		"achievements", "user_achievements",
+		"SELECT COUNT(*) FROM user_achievements WHERE userid = :from",
+		[]string{
+			`INSERT IGNORE INTO user_achievements (userid, achid)
+			SELECT :to, achid FROM user_achievements WHERE userid = :from`,
+			"DELETE FROM user_achievements WHERE userid = :from",
+		},
+	},
+	// the duplicate's previous names stay reserved, for the main account
+	{
+		"name_history", "name_history",
+		"SELECT COUNT(*) FROM name_history WHERE userid = :from",
+		[]string{"UPDATE name_history SET userid = :to WHERE userid = :from"},
+	},
+}
+
+// the grade counts of a user's best scores, per mode
+var update_user_grades = `
+UPDATE stats st LEFT JOIN (
+	SELECT mode, SUM(grade = 'XH') AS xh, SUM(grade = 'X') AS x,
+	SUM(grade = 'SH') AS sh, SUM(grade = 'S') AS s, SUM(grade = 'A') AS a
+	FROM scores WHERE userid = ? AND status = 2 GROUP BY mode
+) g ON g.mode = st.mode
+SET st.xh_count = COALESCE(g.xh, 0), st.x_count = COALESCE(g.x, 0),
+	st.sh_count = COALESCE(g.sh, 0), st.s_count = COALESCE(g.s, 0), st.a_count = COALESCE(g.a, 0)
+WHERE st.id = ?`
+
+type mergeAccount struct {
+	ID      int64
+	Name    string
+	Country string
+	Priv    int
+}
+
+// moveUserRows runs the steps, soft-deletes the duplicate & records the
+// merge, in one transaction.
+func moveUserRows(from, to mergeAccount, by int64) (map[string]int64, error) {
+	tx, err := DB.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	args := map[string]interface{}{"from": from.ID, "to": to.ID}
+	moved := make(map[string]int64)
+	for _, step := range userMergeSteps {
+		exists, err := tableExists(step.Table)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+		for i, query := range step.Queries {
+			res, err := tx.NamedExec(query, args)
+			if err != nil {
+				return nil, fmt.Errorf("failed to move %s: %w", step.Name, err)
+			}
+			// the first query moves the rows, the rest tidy up after it
+			if i == 0 {
+				moved[step.Name], _ = res.RowsAffected()
+			}
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE users SET priv = 0 WHERE id = ?", from.ID); err != nil {
+		return nil, fmt.Errorf("failed to soft-delete the account: %w", err)
+	}
+
+	for _, entry := range []struct {
+		to  int64
+		msg string
+	}{
+		{from.ID, fmt.Sprintf("merged into %s (%d), and soft-deleted (privileges were %d)", to.Name, to.ID, from.Priv)},
+		{to.ID, fmt.Sprintf("merged %s (%d) into this account", from.Name, from.ID)},
+	} {
+		_, err := tx.Exec("INSERT INTO logs (`from`, `to`, `action`, msg, time) VALUES (?, ?, 'merge', ?, NOW())",
+			by, entry.to, entry.msg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to record the merge: %w", err)
+		}
+	}
+	return moved, tx.Commit()
+}
+
+// rebuildMergedAccounts picks the main account's best scores, and rebuilds
+// both accounts' stats. the duplicate, having no scores left, is reset.
+func rebuildMergedAccounts(from, to int64) error {
+	users := []int64{from, to}
+
+	cfg.RecalcMode = -1
+	counts := &statusCounts{}
+	if err := recalculateStatuses([]int64{to}, nil, counts); err != nil {
+		return err
+	}
+	for mode := range statsModes {
+		if err := recalculateChunk(recalcChunk{Mode: mode, Users: users}); err != nil {
+			return err
+		}
+		if err := recalculatePP(mode, users); err != nil {
+			return err
+		}
+	}
+	for _, user := range users {
+		if _, err := DB.Exec(update_user_grades, user, user); err != nil {
+			return err
+		}
+	}
+	logger.Info("recalculated the best scores & stats", "promoted", counts.Promoted, "demoted", counts.Demoted)
+	return nil
+}
+
+// updateMergedLeaderboards takes the duplicate off of redis' leaderboards,
+// and puts the main account's new pp on them.
+func updateMergedLeaderboards(from, to mergeAccount) error {
+	var pps []struct {
+		Mode int
+		PP   int64
+	}
+	if err := DB.Select(&pps, "SELECT mode, pp FROM stats WHERE id = ?", to.ID); err != nil {
+		return err
+	}
+
+	rc, err := dialRedis(cfg)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	fromID, toID := strconv.FormatInt(from.ID, 10), strconv.FormatInt(to.ID, 10)
+	n := 0
+	for mode := 0; mode <= 8; mode++ {
+		key := leaderboardKeyPrefix + strconv.Itoa(mode)
+		rc.Send("ZREM", key, fromID)
+		rc.Send("ZREM", key+":"+strings.ToLower(from.Country), fromID)
+		n += 2
+	}
+	// restricted players aren't on the leaderboards, as in bancho.py
+	for _, s := range pps {
+		if to.Priv&privUnrestricted == 0 || s.PP == 0 {
+			continue
+		}
+		key := leaderboardKeyPrefix + strconv.Itoa(s.Mode)
+		pp := strconv.FormatInt(s.PP, 10)
+		rc.Send("ZADD", key, pp, toID)
+		rc.Send("ZADD", key+":"+strings.ToLower(to.Country), pp, toID)
+		n += 2
+	}
+	_, err = rc.Flush(n)
+	return err
+}
+
+func runUsersMerge() error {
+	if cfg.MergeFrom == "" || cfg.MergeTo == "" {
+		return errors.New("--from & --to must be the names or ids of the duplicate & main accounts")
+	}
+
+	var accounts [2]mergeAccount
+	for i, user := range []string{cfg.MergeFrom, cfg.MergeTo} {
+		id, err := findUser(user)
+		if err != nil {
+			return err
+		}
+		if id <= 2 {
+			// 1 is the bot, and 2 is reserved for ppy
+			return fmt.Errorf("user %d is reserved, and can't be merged", id)
+		}
+		if err := DB.Get(&accounts[i], "SELECT id, name, country, priv FROM users WHERE id = ?", id); err != nil {
+			return err
+		}
+	}
+	from, to := accounts[0], accounts[1]
+	if from.ID == to.ID {
+		return errors.New("--from & --to are the same account")
+	}
+
+	by := int64(1)
+	if cfg.MergeBy != "" {
+		var err error
+		if by, err = findUser(cfg.MergeBy); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("This will merge %s (%d) into %s (%d), moving:\n", from.Name, from.ID, to.Name, to.ID)
+	for _, step := range userMergeSteps {
+		exists, err := tableExists(step.Table)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		query, args, err := DB.BindNamed(step.Count, map[string]interface{}{"from": from.ID})
+		if err != nil {
+			return err
+		}
+		var n int64
+		if err := DB.Get(&n, query, args...); err != nil {
+			return fmt.Errorf("failed to count %s: %w", step.Name, err)
+		}
+		fmt.Printf("  %-20s %d rows\n", step.Name, n)
+	}
+	fmt.Printf("  and soft-delete %s, which keeps its name but loses its privileges\n", from.Name)
+	if cfg.DryRun {
+		return nil
+	}
+	if !confirm("Continue?") {
+		fmt.Println("Not merging the users")
+		return nil
+	}
+
+	moved, err := moveUserRows(from, to, by)
+	if err != nil {
+		return err
+	}
+	logger.Info("moved the duplicate's rows", "from", from.ID, "to", to.ID, "rows", moved)
+
+	// the rows have moved by now, so anything failing below
+	// can be finished with recalc stats & cache rebuild
+	if err := rebuildMergedAccounts(from.ID, to.ID); err != nil {
+		return fmt.Errorf("failed to rebuild the stats, run recalc status & recalc stats: %w", err)
+	}
+	if err := updateMergedLeaderboards(from, to); err != nil {
+		logger.Warn("failed to update redis' leaderboards, run cache rebuild", "err", err)
+	}
+
+	logger.Info("merged the users", "from", from.Name, "to", to.Name)
+	return nil
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "users merge",
+		Summary: "merge a player's duplicate account into their main one, and soft-delete the duplicate",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.MergeFrom, "from", "", "name or id of the duplicate account, which is soft-deleted")
+			flags.StringVar(&c.MergeTo, "to", "", "name or id of the main account, which is kept")
+			flags.StringVar(&c.MergeBy, "by", "", "name or id of the staff member merging them, for bancho.py's logs (default: the bot)")
+			flags.BoolVar(&c.DryRun, "dry-run", false, "show what would be moved, without changing anything")
+		},
+		Run: runUsersMerge,
+	})
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// users rename & users normalize change names in bulk: rename from a csv of
+// user,new_name[,reason] rows (by name or id), and normalize to rename every
+// user whose name has characters which are no longer allowed, e.g. after a
+// policy change to latin letters only.
+//
+// every old name is recorded in name_history, for frontends to show who a
+// player was previously known as. names in name_history are reserved for
+// the players who had them, so nobody else can be renamed to them, unless
+// --ignore-reserved.
+//
+// bancho.py keeps online players' names in memory, so they're only renamed
+// in game once they log in again; it's simplest to rename while it's stopped.
+
+var create_name_history = `
+create table if not exists name_history (
+	id int auto_increment primary key,
+	userid int not null,
+	name varchar(32) charset utf8 not null,
+	safe_name varchar(32) charset utf8 not null,
+	changed_at datetime not null,
+	reason varchar(64) charset utf8 not null,
+	index name_history_userid_index (userid),
+	index name_history_safe_name_index (safe_name)
+);`
+
+// the characters bancho.py allows in names
+const defaultAllowedChars = `[\p{L}\p{N}_ \[\]-]`
+
+// bancho.py's shortest name
+const minNameLength = 2
+
+// UserRename is a name change, and why it can't be made, if it can't.
+type UserRename struct {
+	ID      int64  `json:"id"`
+	OldName string `json:"old_name"`
+	NewName string `json:"new_name"`
+	Reason  string `json:"reason"`
+	Problem string `json:"problem,omitempty"`
+}
+
+type RenameReport struct {
+	Renamed  int          `json:"renamed"`
+	Rejected int          `json:"rejected"`
+	Renames  []UserRename `json:"renames"`
+}
+
+func safeName(name string) string {
+	return strings.ReplaceAll(strings.ToLower(name), " ", "_")
+}
+
+// nameProblem reports what's wrong with a name, if anything, by bancho.py's
+// rules with allowed as the characters it may have.
+func nameProblem(name string, allowed *regexp.Regexp) string {
+	switch n := utf8.RuneCountInString(name); {
+	case n < minNameLength || n > maxNameLength:
+		return fmt.Sprintf("must be %d to %d characters long", minNameLength, maxNameLength)
+	case strings.Contains(name, "_") && strings.Contains(name, " "):
+		return `may have "_" or " ", but not both`
+	case strings.TrimSpace(name) != name:
+		return "can't start or end with a space"
+	}
+	for _, r := range name {
+		if !allowed.MatchString(string(r)) {
+			return fmt.Sprintf("has a character which isn't allowed: %q", r)
+		}
+	}
+	return ""
+}
+
+type nameUser struct {
+	ID       int64
+	Name     string
+	SafeName string `db:"safe_name"`
+}
+
+// nameIndex is who has, and had, each name.
+type nameIndex struct {
+	byID     map[int64]*nameUser
+	bySafe   map[string]int64
+	reserved map[string]int64 // old safe names, to who had them
+}
+
+func loadNameIndex() (*nameIndex, error) {
+	if _, err := DB.Exec(create_name_history); err != nil {
+		return nil, err
+	}
+	var users []*nameUser
+	if err := DB.Select(&users, "SELECT id, name, safe_name FROM users"); err != nil {
+		return nil, err
+	}
+	var history []struct {
+		UserID   int64  `db:"userid"`
+		SafeName string `db:"safe_name"`
+	}
+	if err := DB.Select(&history, "SELECT userid, safe_name FROM name_history ORDER BY id"); err != nil {
+		return nil, err
+	}
+
+	idx := &nameIndex{
+		byID:     make(map[int64]*nameUser, len(users)),
+		bySafe:   make(map[string]int64, len(users)),
+		reserved: make(map[string]int64, len(history)),
+	}
+	for _, u := range users {
+		idx.byID[u.ID] = u
+		idx.bySafe[u.SafeName] = u.ID
+	}
+	for _, h := range history {
+		idx.reserved[h.SafeName] = h.UserID
+	}
+	return idx, nil
+}
+
+// find looks a user up by id or name.
+func (idx *nameIndex) find(user string) (*nameUser, bool) {
+	if id, err := strconv.ParseInt(user, 10, 64); err == nil {
+		if u, ok := idx.byID[id]; ok {
+			return u, true
+		}
+	}
+	id, ok := idx.bySafe[safeName(user)]
+	return idx.byID[id], ok
+}
+
+// taken reports whether a name is somebody else's, now or previously.
+func (idx *nameIndex) taken(name string, user int64) string {
+	safe := safeName(name)
+	if id, ok := idx.bySafe[safe]; ok && id != user {
+		return fmt.Sprintf("is taken by user %d", id)
+	}
+	if id, ok := idx.reserved[safe]; ok && id != user && !cfg.IgnoreReserved {
+		return fmt.Sprintf("is reserved, as user %d used to have it", id)
+	}
+	return ""
+}
+
+// claim moves a user's name in the index, so later renames see it.
+func (idx *nameIndex) claim(r UserRename) {
+	u := idx.byID[r.ID]
+	delete(idx.bySafe, u.SafeName)
+	idx.reserved[u.SafeName] = r.ID
+	u.Name, u.SafeName = r.NewName, safeName(r.NewName)
+	idx.bySafe[u.SafeName] = r.ID
+}
+
+// applyRenames records the old names in name_history & renames the users,
+// in one transaction.
+func applyRenames(renames []UserRename) error {
+	tx, err := DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, r := range renames {
+		if r.Problem != "" {
+			continue
+		}
+		_, err := tx.Exec(`
+		INSERT INTO name_history (userid, name, safe_name, changed_at, reason)
+		SELECT id, name, safe_name, NOW(), ? FROM users WHERE id = ?`, truncate(r.Reason, 64), r.ID)
+		if err != nil {
+			return fmt.Errorf("failed to record %s's old name: %w", r.OldName, err)
+		}
+		res, err := tx.Exec("UPDATE users SET name = ?, safe_name = ? WHERE id = ? AND name = ?",
+			r.NewName, safeName(r.NewName), r.ID, r.OldName)
+		if err != nil {
+			return fmt.Errorf("failed to rename %s: %w", r.OldName, err)
+		}
+		if n, _ := res.RowsAffected(); n != 1 {
+			return fmt.Errorf("%s was renamed while renaming, try again", r.OldName)
+		}
+	}
+	return tx.Commit()
+}
+
+// finishRenames reports the renames, and makes them unless --dry-run.
+func finishRenames(renames []UserRename) error {
+	report := RenameReport{Renames: renames}
+	for _, r := range renames {
+		if r.Problem != "" {
+			report.Rejected++
+			logger.Warn("can't rename user", "user", r.ID, "name", r.OldName, "to", r.NewName, "problem", r.Problem)
+		} else {
+			report.Renamed++
+		}
+	}
+	if err := writeReport(cfg.ReportPath, report); err != nil {
+		return err
+	}
+	if cfg.DryRun || report.Renamed == 0 {
+		logger.Info("nothing was changed", "renames", report.Renamed, "rejected", report.Rejected, "dry_run", cfg.DryRun)
+		return nil
+	}
+
+	fmt.Printf("%d users will be renamed, and %d can't be.\n", report.Renamed, report.Rejected)
+	if !confirm("Continue?") {
+		fmt.Println("Not renaming the users")
+		return nil
+	}
+	if err := applyRenames(renames); err != nil {
+		return err
+	}
+	logger.Info("renamed the users", "renamed", report.Renamed, "rejected", report.Rejected)
+	logger.Info("players who are online keep their old names in game until they log in again")
+	return nil
+}
+
+// readRenames reads user,new_name[,reason] rows, with or without a header.
+func readRenames(path string) ([][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	var rows [][]string
+	for line := 1; ; line++ {
+		row, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			return rows, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if line == 1 && len(row) >= 2 && strings.EqualFold(row[1], "new_name") {
+			continue
+		}
+		if len(row) < 2 || len(row) > 3 {
+			return nil, fmt.Errorf("%s:%d: expected user,new_name[,reason]", path, line)
+		}
+		rows = append(rows, row)
+	}
+}
+
+func runUsersRename() error {
+	if cfg.RenameCSV == "" {
+		return errors.New("--csv must be the csv of renames, with user,new_name[,reason] rows")
+	}
+	allowed, err := regexp.Compile("^" + cfg.AllowedChars + "$")
+	if err != nil {
+		return fmt.Errorf("--allowed-chars: %w", err)
+	}
+	rows, err := readRenames(cfg.RenameCSV)
+	if err != nil {
+		return err
+	}
+	idx, err := loadNameIndex()
+	if err != nil {
+		return err
+	}
+
+	var renames []UserRename
+	for _, row := range rows {
+		r := UserRename{NewName: row[1], Reason: cfg.RenameReason}
+		if len(row) == 3 && row[2] != "" {
+			r.Reason = row[2]
+		}
+		u, ok := idx.find(row[0])
+		if !ok {
+			r.OldName, r.Problem = row[0], "no such user"
+			renames = append(renames, r)
+			continue
+		}
+		r.ID, r.OldName = u.ID, u.Name
+		if r.Problem = nameProblem(r.NewName, allowed); r.Problem == "" {
+			r.Problem = idx.taken(r.NewName, u.ID)
+		}
+		if r.Problem == "" && r.NewName == u.Name {
+			r.Problem = "already has this name"
+		}
+		if r.Problem == "" {
+			idx.claim(r)
+		}
+		renames = append(renames, r)
+	}
+	return finishRenames(renames)
+}
+
+// normalizedName replaces the characters of a name which aren't allowed,
+// and makes it fit bancho.py's other rules.
+func normalizedName(name string, allowed *regexp.Regexp) string {
+	var b strings.Builder
+	for _, r := range name {
+		if allowed.MatchString(string(r)) {
+			b.WriteRune(r)
+		} else {
+			b.WriteString(cfg.ReplaceChars)
+		}
+	}
+	normalized := b.String()
+	if strings.Contains(normalized, "_") && strings.Contains(normalized, " ") {
+		normalized = strings.ReplaceAll(normalized, " ", "_")
+	}
+	normalized = strings.TrimSpace(normalized)
+	if runes := []rune(normalized); len(runes) > maxNameLength {
+		normalized = strings.TrimSpace(string(runes[:maxNameLength]))
+	}
+	return normalized
+}
+
+func isAlphanumeric(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func runUsersNormalize() error {
+	allowed, err := regexp.Compile("^" + cfg.AllowedChars + "$")
+	if err != nil {
+		return fmt.Errorf("--allowed-chars: %w", err)
+	}
+	if problem := nameProblem("ab"+cfg.ReplaceChars, allowed); cfg.ReplaceChars != "" && problem != "" {
+		return fmt.Errorf("--replace-with %q isn't allowed in names itself", cfg.ReplaceChars)
+	}
+	idx, err := loadNameIndex()
+	if err != nil {
+		return err
+	}
+
+	// users are gone through by id, so the numbers added to
+	// names which are taken are given out in a stable order
+	ids := make([]int64, 0, len(idx.byID))
+	for id := range idx.byID {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var renames []UserRename
+	for _, id := range ids {
+		u := idx.byID[id]
+		if nameProblem(u.Name, allowed) == "" {
+			continue
+		}
+
+		r := UserRename{ID: u.ID, OldName: u.Name, Reason: cfg.RenameReason}
+		base := normalizedName(u.Name, allowed)
+		// names made up of characters which aren't allowed have nothing left
+		if utf8.RuneCountInString(base) < minNameLength || strings.IndexFunc(base, isAlphanumeric) < 0 {
+			base = fmt.Sprintf("user%d", u.ID)
+		}
+		r.NewName = base
+		for attempt := 1; idx.taken(r.NewName, u.ID) != "" || nameProblem(r.NewName, allowed) != ""; attempt++ {
+			if attempt > 100 {
+				r.Problem = "no free name could be found"
+				break
+			}
+			r.NewName = renamedName(base, "", attempt)
+		}
+		if r.Problem == "" {
+			idx.claim(r)
+		}
+		renames = append(renames, r)
+	}
+	return finishRenames(renames)
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "users rename",
+		Summary: "rename users in bulk from a csv, keeping their old names in name_history",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.RenameCSV, "csv", "", "csv of user,new_name[,reason] rows, users by name or id")
+			flags.StringVar(&c.RenameReason, "reason", "renamed", "why the users were renamed, for name_history, unless the csv has a reason")
+			flags.StringVar(&c.AllowedChars, "allowed-chars", defaultAllowedChars, "regexp character class of the characters names may have")
+			flags.BoolVar(&c.IgnoreReserved, "ignore-reserved", false, "allow renaming users to names which other users used to have")
+			flags.BoolVar(&c.DryRun, "dry-run", false, "report the renames, without renaming anyone")
+			flags.StringVar(&c.ReportPath, "report", "", "write the renames as json to this path (- for stdout)")
+		},
+		Run: runUsersRename,
+	})
+	registerCommand(&Command{
+		Name:    "users normalize",
+		Summary: "rename every user whose name has characters which aren't allowed, keeping their old names in name_history",
+		Flags: func(flags *flag.FlagSet, c *Config) {
+			flags.StringVar(&c.AllowedChars, "allowed-chars", defaultAllowedChars, "regexp character class of the characters names may have, e.g. [A-Za-z0-9_ \\[\\]-]")
+			flags.StringVar(&c.ReplaceChars, "replace-with", "_", "what characters which aren't allowed are replaced with (empty to remove them)")
+			flags.StringVar(&c.RenameReason, "reason", "normalized", "why the users were renamed, for name_history")
+			flags.BoolVar(&c.IgnoreReserved, "ignore-reserved", false, "allow renaming users to names which other users used to have")
+			flags.BoolVar(&c.DryRun, "dry-run", false, "report the renames, without renaming anyone")
+			flags.StringVar(&c.ReportPath, "report", "", "write the renames as json to this path (- for stdout)")
+		},
+		Run: runUsersNormalize,
+	})
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// v4.2.0 merged the per-mod scores_vn, scores_rx & scores_ap tables into a
+// single scores table, with relax & autopilot scores offset into modes 4-8.
+// since score ids change, each replay in .data/osr is renamed to its new id,
+// unless they're kept with --keep-ids, see keepids.go.
+func init() {
+	registerMigration("4.2.0", &Migration{
+		Description: "merge scores_vn, scores_rx & scores_ap into a single scores table",
+		Up:          migrateV420,
+		Down:        func() error { return runRollback(SourceTables) },
+		DryRun:      dryRunV420,
+		Benchmark:   func() error { return runBenchmark(SourceTables) },
+		Verify:      func() (bool, error) { return runVerify(SourceTables) },
+		Preflight:   func() error { return preflightScores(SourceTables) },
+		Applied:     appliedV420,
+	})
+}
+
+// appliedV420 detects instances migrated by the old migrate_v420 tool,
+// where the new scores table exists and the old ones have been dropped.
+func appliedV420() (bool, error) {
+	exists, err := tableExists("scores")
+	if err != nil || !exists {
+		return false, err
+	}
+
+	for _, table := range SourceTables {
+		exists, err := tableExists(table.Name)
+		if err != nil || exists {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// dryRunV420 reports what v4.2.0 would do, with the ids kept if asked.
+func dryRunV420() error {
+	if err := keepScoreIDs(); err != nil {
+		return err
+	}
+	return runDryRun(SourceTables)
+}
+
+func migrateV420() error {
+	// with --keep-ids, the scores keep their ids, see keepids.go
+	if err := keepScoreIDs(); err != nil {
+		return err
+	}
+
+	// online migrations copy replays, as the old server still serves them,
+	// unless they're left in place
+	if cfg.Online && replaysStaged() {
+		return fmt.Errorf("--online needs --new-replays somewhere other than %s, e.g. %s_new", cfg.ReplayDirectory(), cfg.ReplayDirectory())
+	}
+	keepReplayOriginals = cfg.Online
+
+	// stop now, rather than when the disk fills up, see diskspace.go
+	if err := checkMigrationSpace(SourceTables); err != nil {
+		return err
+	}
+	// or a kept id collides, see keepids.go
+	if err := checkIDCollisions(SourceTables); err != nil {
+		return err
+	}
+
+	// ctrl-c stops the migration gracefully, see signal.go
+	handleSignals()
+
+	// size the worker pool to what the database can handle
+	if err := tuneWorkers(); err != nil {
+		return err
+	}
+	if err := tuneBatching(); err != nil {
+		return err
+	}
+
+	// the faster insert modes need the server's cooperation, see fastinsert.go
+	if err := checkInsertMode(); err != nil {
+		return err
+	}
+
+	// start tracking the migration's progress
+	progress = newProgress(SourceTables, NumWorkers)
+
+	// every replay move is recorded in the journal, see replays.go
+	var err error
+	replayJournal, err = openReplayJournal(cfg.ReplayJournalPath)
+	if err != nil {
+		return err
+	}
+	defer replayJournal.Close()
+
+	// rows which can't be migrated are kept here, instead of being lost
+	deadLetters = newDeadLetterFile(cfg.DeadLetterPath)
+	defer deadLetters.Close()
+
+	// replays may be on local disk, or in object storage
+	if err := setupReplayStores(); err != nil {
+		return err
+	}
+
+	if cfg.Resume {
+		// the previous run already staged the replays & created the new tables
+		if replaysStaged() {
+			if err := checkStagedReplays("resume"); err != nil {
+				return err
+			}
+		}
+
+		// finish moving replays for scores committed before the interruption
+		if err := resumePendingReplays(SourceTables); err != nil {
+			return err
+		}
+	} else {
+		// create the migration bookkeeping tables, these
+		// will fail to create if a previous run was interrupted
+		if err := createCheckpointTables(); err != nil {
+			return err
+		}
+
+		if replaysStaged() {
+			// move replays to the staging directory, see store.go
+			err := moveDirectory(cfg.ReplayDirectory(), stagingReplayDirectory())
+			if err != nil {
+				return err
+			}
+
+			// create new replay directory in .data, unless it's a mount
+			// point, which was left in place
+			err = os.MkdirAll(cfg.ReplayDirectory(), 0755)
+			if err != nil {
+				return err
+			}
+		}
+
+		// create new scores table
+		if _, err := DB.Exec(create_scores); err != nil {
+			return err
+		}
+	}
+
+	// changes made while copying are captured from the start, see online.go
+	if cfg.Online {
+		if err := createChangeCapture(SourceTables); err != nil {
+			return err
+		}
+	}
+
+	// stream the vn, rx & ap tables through the worker pool
+	err = migrateScores(SourceTables, cfg.Resume)
+	if err != nil {
+		return err
+	}
+
+	// build the indexes the bulk copy went without, see indexes.go
+	if err := createScoreIndexes(scoreIndexes); err != nil {
+		return err
+	}
+
+	// keep up with the old server until it's stopped
+	if cfg.Online {
+		if err := cutoverOnline(SourceTables); err != nil {
+			return err
+		}
+	}
+
+	// keep the old ids' new ones once the journal's dropped, see scoreidmap.go
+	if err := saveScoreIDMap(); err != nil {
+		return err
+	}
+
+	// attempt to remove the staging replays directory
+	if replaysStaged() {
+		err = os.Remove(stagingReplayDirectory())
+		if err != nil {
+			logger.Warn("there are some replay files for which scores could not be found in the database, they have been left in place", "path", stagingReplayDirectory())
+		}
+	}
+
+	// print a summary of what was migrated
+	progress.summary()
+
+	// prompt user to delete the old scores tables if they're certain everything
+	// is successful, unless --drop-old-tables or --keep-old-tables decided it.
+	// --yes alone keeps them, as dropping them can't be undone
+	var drop bool
+	_, _, _, failed, _ := progress.totals()
+	switch {
+	case cfg.DropOldTables && failed != 0:
+		logger.Warn("some rows failed to migrate, so the old tables are kept despite --drop-old-tables", "failed", failed)
+	case cfg.DropOldTables && scoreFilter != nil && !cfg.DropFiltered:
+		logger.Warn("the filters left some scores out, which are only in the old tables, so they're kept despite --drop-old-tables (add --drop-filtered to drop them anyway)")
+	case cfg.DropOldTables:
+		drop = true
+	case cfg.KeepOldTables || cfg.Yes:
+	default:
+		if scoreFilter != nil {
+			fmt.Println("The scores left out by the filters are only in the old tables, and are lost if they're dropped.")
+		}
+		drop = confirm("Do you wish to drop the old tables? [only do this if you're certain migrations have been successful]")
+	}
+	if drop {
+		logger.Info("dropping old tables")
+		for _, table := range SourceTables {
+			if _, err := DB.Exec("drop table " + table.Name); err != nil {
+				return err
+			}
+		}
+		if err := dropCheckpointTables(); err != nil {
+			return err
+		}
+	} else {
+		logger.Info("not dropping old tables")
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// key_columns is hashed per row on both sides of the migration. the crc32s
+// are summed per mode, so the checksum doesn't depend on row order. pp and
+// acc are left out as floats may legitimately round differently.
+var key_columns = `CRC32(CONCAT_WS('|', map_md5, userid, score, mods, max_combo,
+	n300, n100, n50, nmiss, ngeki, nkatu, status, UNIX_TIMESTAMP(play_time),
+	COALESCE(online_checksum, '')))`
+
+var select_mode_checksums = `
+SELECT mode + %d AS mode, COUNT(*) AS count, COALESCE(SUM(` + key_columns + `), 0) AS checksum
+FROM %s GROUP BY mode`
+
+var select_user_counts = `
+SELECT userid, mode + %d AS mode, COUNT(*) AS count
+FROM %s GROUP BY userid, mode`
+
+type modeChecksum struct {
+	Mode     int
+	Count    int64
+	Checksum uint64
+}
+
+type userModeCount struct {
+	UserID int64 `db:"userid"`
+	Mode   int
+	Count  int64
+}
+
+// ModeReport compares the rows of a single (new) mode.
+type ModeReport struct {
+	Mode        int    `json:"mode"`
+	OldRows     int64  `json:"old_rows"`
+	NewRows     int64  `json:"new_rows"`
+	OldChecksum uint64 `json:"old_checksum"`
+	NewChecksum uint64 `json:"new_checksum"`
+	OK          bool   `json:"ok"`
+}
+
+// UserMismatch is a (user, mode) whose score count differs after migrating.
+type UserMismatch struct {
+	UserID  int64 `json:"userid"`
+	Mode    int   `json:"mode"`
+	OldRows int64 `json:"old_rows"`
+	NewRows int64 `json:"new_rows"`
+}
+
+// VerifyReport is the machine-readable result of the verify subcommand.
+type VerifyReport struct {
+	OK                    bool           `json:"ok"`
+	Modes                 []ModeReport   `json:"modes"`
+	UserMismatches        int            `json:"user_mismatches"`
+	UserMismatchExamples  []UserMismatch `json:"user_mismatch_examples"`
+	ReplaysChecked        int64          `json:"replays_checked"`
+	ReplaysMissing        int64          `json:"replays_missing"`
+	MissingReplayExamples []int64        `json:"missing_replay_examples"`
+}
+
+// verifyModes compares row counts & checksums per mode between the old and new tables.
+func verifyModes(tables []SourceTable) ([]ModeReport, error) {
+	modes := make(map[int]*ModeReport)
+	get := func(mode int) *ModeReport {
+		if _, ok := modes[mode]; !ok {
+			modes[mode] = &ModeReport{Mode: mode}
+		}
+		return modes[mode]
+	}
+
+	for _, table := range tables {
+		var checksums []modeChecksum
+		if err := DB.Select(&checksums, fmt.Sprintf(select_mode_checksums, table.ModeOffset, table.Name)); err != nil {
+			return nil, err
+		}
+		for _, c := range checksums {
+			m := get(c.Mode)
+			m.OldRows += c.Count
+			m.OldChecksum += c.Checksum
+		}
+	}
+
+	var checksums []modeChecksum
+	if err := DB.Select(&checksums, fmt.Sprintf(select_mode_checksums, 0, "scores")); err != nil {
+		return nil, err
+	}
+	for _, c := range checksums {
+		m := get(c.Mode)
+		m.NewRows += c.Count
+		m.NewChecksum += c.Checksum
+	}
+
+	reports := make([]ModeReport, 0, len(modes))
+	for _, m := range modes {
+		m.OK = m.OldRows == m.NewRows && m.OldChecksum == m.NewChecksum
+		reports = append(reports, *m)
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Mode < reports[j].Mode })
+	return reports, nil
+}
+
+// verifyUsers compares the number of scores each user has in each mode.
+func verifyUsers(tables []SourceTable) ([]UserMismatch, error) {
+	type userMode struct {
+		userID int64
+		mode   int
+	}
+	counts := make(map[userMode]*UserMismatch)
+	get := func(userID int64, mode int) *UserMismatch {
+		key := userMode{userID, mode}
+		if _, ok := counts[key]; !ok {
+			counts[key] = &UserMismatch{UserID: userID, Mode: mode}
+		}
+		return counts[key]
+	}
+
+	for _, table := range tables {
+		var rows []userModeCount
+		if err := DB.Select(&rows, fmt.Sprintf(select_user_counts, table.ModeOffset, table.Name)); err != nil {
+			return nil, err
+		}
+		for _, r := range rows {
+			get(r.UserID, r.Mode).OldRows += r.Count
+		}
+	}
+
+	var rows []userModeCount
+	if err := DB.Select(&rows, fmt.Sprintf(select_user_counts, 0, "scores")); err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		get(r.UserID, r.Mode).NewRows += r.Count
+	}
+
+	var mismatches []UserMismatch
+	for _, c := range counts {
+		if c.OldRows != c.NewRows {
+			mismatches = append(mismatches, *c)
+		}
+	}
+	sort.Slice(mismatches, func(i, j int) bool {
+		if mismatches[i].UserID != mismatches[j].UserID {
+			return mismatches[i].UserID < mismatches[j].UserID
+		}
+		return mismatches[i].Mode < mismatches[j].Mode
+	})
+	return mismatches, nil
+}
+
+// verifyReplays checks every submitted score in the new table has a replay.
+func verifyReplays() (checked int64, missing int64, examples []int64, err error) {
+	var lastID int64
+	for {
+		var ids []int64
+		err = DB.Select(&ids, `
+		SELECT id FROM scores WHERE id > ? AND status != 0
+		ORDER BY id LIMIT ?`, lastID, BatchSize)
+		if err != nil || len(ids) == 0 {
+			return
+		}
+
+		for _, id := range ids {
+			checked++
+			if _, statErr := newReplays.Stat(replayKey(id)); statErr != nil {
+				missing++
+				if len(examples) < maxExamples {
+					examples = append(examples, id)
+				}
+			}
+		}
+
+		lastID = ids[len(ids)-1]
+	}
+}
+
+// runVerify cross-checks the new scores table against the old ones, and
+// reports whether they match.
+func runVerify(tables []SourceTable) (bool, error) {
+	report := VerifyReport{OK: true}
+	var err error
+
+	fmt.Fprintln(os.Stderr, "Comparing row counts and checksums per mode...")
+	if report.Modes, err = verifyModes(tables); err != nil {
+		return false, err
+	}
+	for _, m := range report.Modes {
+		status := "ok"
+		if !m.OK {
+			status = "MISMATCH"
+			report.OK = false
+		}
+		fmt.Fprintf(os.Stderr, "  mode %-2d old %-10d new %-10d %s\n", m.Mode, m.OldRows, m.NewRows, status)
+	}
+
+	fmt.Fprintln(os.Stderr, "Comparing per-user score counts...")
+	mismatches, err := verifyUsers(tables)
+	if err != nil {
+		return false, err
+	}
+	report.UserMismatches = len(mismatches)
+	if len(mismatches) > maxExamples {
+		mismatches = mismatches[:maxExamples]
+	}
+	report.UserMismatchExamples = mismatches
+	if report.UserMismatches != 0 {
+		report.OK = false
+	}
+	fmt.Fprintf(os.Stderr, "  %d (user, mode) pairs differ\n", report.UserMismatches)
+
+	fmt.Fprintln(os.Stderr, "Checking replay files for submitted scores...")
+	report.ReplaysChecked, report.ReplaysMissing, report.MissingReplayExamples, err = verifyReplays()
+	if err != nil {
+		return false, err
+	}
+	if report.ReplaysMissing != 0 {
+		report.OK = false
+	}
+	fmt.Fprintf(os.Stderr, "  %d of %d replays missing\n", report.ReplaysMissing, report.ReplaysChecked)
+
+	if report.OK {
+		fmt.Fprintln(os.Stderr, "Verification passed, the old tables can safely be dropped.")
+	} else {
+		fmt.Fprintln(os.Stderr, "Verification FAILED, do not drop the old tables.")
+	}
+
+	if err := writeReport(cfg.ReportPath, report); err != nil {
+		return false, err
+	}
+	return report.OK, nil
+}
+
+// writeReport writes a report as json to path (- for stdout), if one was requested.
+func writeReport(path string, report interface{}) error {
+	if path == "" {
+		return nil
+	}
+
+	out := os.Stdout
+	if path != "-" {
+		var err error
+		if out, err = os.Create(path); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
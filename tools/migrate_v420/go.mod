@@ -1,8 +0,0 @@
-module scoreMigrator
-
-go 1.17
-
-require (
-	github.com/go-sql-driver/mysql v1.6.0
-	github.com/jmoiron/sqlx v1.3.4
-)